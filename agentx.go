@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// AgentX protocol (RFC 2741) used to attach to a master SNMP agent
+const (
+	AGENTX_VERSION      uint8 = 1
+	AGENTX_FLAG_NBO     uint8 = 0x10 // Payload is in network byte order
+	AGENTX_FLAG_CONTEXT uint8 = 0x08 // PDU contains non-default context
+	AGENTX_HEADER_LEN   int   = 20
+	AGENTX_MAX_PAYLOAD  int   = 65536
+)
+
+// AgentX PDU types
+const (
+	AGENTX_OPEN       uint8 = 1
+	AGENTX_CLOSE      uint8 = 2
+	AGENTX_REGISTER   uint8 = 3
+	AGENTX_GET        uint8 = 5
+	AGENTX_GETNEXT    uint8 = 6
+	AGENTX_GETBULK    uint8 = 7
+	AGENTX_TESTSET    uint8 = 8
+	AGENTX_CLEANUPSET uint8 = 11
+	AGENTX_RESPONSE   uint8 = 18
+)
+
+// Error returned to attempts to change exposed variables
+const AGENTX_NOT_WRITABLE uint16 = 17
+
+// Types of values in variable bindings
+const (
+	SNMP_INTEGER      uint16 = 2
+	SNMP_OCTET_STRING uint16 = 4
+	SNMP_IP_ADDRESS   uint16 = 64
+	SNMP_COUNTER32    uint16 = 65
+	SNMP_GAUGE32      uint16 = 66
+	SNMP_COUNTER64    uint16 = 70
+	SNMP_NO_SUCH      uint16 = 129 // noSuchInstance
+	SNMP_END_OF_MIB   uint16 = 130
+)
+
+// Delay between attempts to connect to the master agent
+const AGENTX_RECONNECT time.Duration = 10 * time.Second
+
+// OID is an SNMP object identifier
+type OID []uint32
+
+// ParseOID converts dotted notation into OID
+func ParseOID(s string) (OID, error) {
+	var oid OID
+	for _, part := range strings.Split(strings.Trim(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad OID %s", s))
+		}
+		oid = append(oid, uint32(n))
+	}
+	return oid, nil
+}
+
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compare returns -1, 0 or 1 if OID is less, equal or greater than other
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] < other[i] {
+			return -1
+		}
+		if o[i] > other[i] {
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// SNMPVar is a single variable exposed to SNMP
+type SNMPVar struct {
+	Name  OID
+	Type  uint16
+	Value interface{} // string, int32, uint32, uint64 or net.IP
+}
+
+// agentxHeader is a header of AgentX PDU
+type agentxHeader struct {
+	Type        uint8
+	Flags       uint8
+	Session     uint32
+	Transaction uint32
+	Packet      uint32
+}
+
+// searchRange is a range of OIDs requested by the master agent
+type searchRange struct {
+	Start   OID
+	End     OID
+	Include bool
+}
+
+func writeOID(b *bytes.Buffer, oid OID, include bool) {
+	b.WriteByte(uint8(len(oid)))
+	b.WriteByte(0) // No prefix compression
+	if include {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+	b.WriteByte(0)
+	for _, n := range oid {
+		binary.Write(b, binary.BigEndian, n)
+	}
+}
+
+func writeOctets(b *bytes.Buffer, data []byte) {
+	binary.Write(b, binary.BigEndian, uint32(len(data)))
+	b.Write(data)
+	for i := len(data); i%4 != 0; i++ {
+		b.WriteByte(0)
+	}
+}
+
+func writeVar(b *bytes.Buffer, v SNMPVar) {
+	binary.Write(b, binary.BigEndian, v.Type)
+	b.Write([]byte{0, 0})
+	writeOID(b, v.Name, false)
+	switch value := v.Value.(type) {
+	case string:
+		writeOctets(b, []byte(value))
+	case net.IP:
+		writeOctets(b, value.To4())
+	case int32, uint32, uint64:
+		binary.Write(b, binary.BigEndian, value)
+	}
+}
+
+// readOID decodes OID from AgentX payload and returns remaining data
+func readOID(data []byte, order binary.ByteOrder) (OID, bool, []byte, error) {
+	if len(data) < 4 {
+		return nil, false, nil, errors.New("Truncated OID")
+	}
+	n, prefix, include := int(data[0]), data[1], data[2] != 0
+	data = data[4:]
+	if len(data) < n*4 {
+		return nil, false, nil, errors.New("Truncated OID")
+	}
+	var oid OID
+	if prefix != 0 {
+		oid = OID{1, 3, 6, 1, uint32(prefix)}
+	}
+	for i := 0; i < n; i++ {
+		oid = append(oid, order.Uint32(data[i*4:]))
+	}
+	return oid, include, data[n*4:], nil
+}
+
+func encodePDU(h agentxHeader, payload []byte) []byte {
+	b := new(bytes.Buffer)
+	b.Write([]byte{AGENTX_VERSION, h.Type, h.Flags | AGENTX_FLAG_NBO, 0})
+	binary.Write(b, binary.BigEndian, h.Session)
+	binary.Write(b, binary.BigEndian, h.Transaction)
+	binary.Write(b, binary.BigEndian, h.Packet)
+	binary.Write(b, binary.BigEndian, uint32(len(payload)))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// readPDU reads a single PDU from the master agent
+func readPDU(r io.Reader) (agentxHeader, binary.ByteOrder, []byte, error) {
+	var h agentxHeader
+	raw := make([]byte, AGENTX_HEADER_LEN)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return h, nil, nil, err
+	}
+	if raw[0] != AGENTX_VERSION {
+		return h, nil, nil, errors.New(fmt.Sprintf("Unsupported AgentX version %d", raw[0]))
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if raw[2]&AGENTX_FLAG_NBO != 0 {
+		order = binary.BigEndian
+	}
+	h.Type, h.Flags = raw[1], raw[2]
+	h.Session = order.Uint32(raw[4:])
+	h.Transaction = order.Uint32(raw[8:])
+	h.Packet = order.Uint32(raw[12:])
+	length := int(order.Uint32(raw[16:]))
+	if length > AGENTX_MAX_PAYLOAD {
+		return h, nil, nil, errors.New("AgentX PDU is too large")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, nil, nil, err
+	}
+	return h, order, payload, nil
+}
+
+// readRanges decodes search range list of Get, GetNext and GetBulk PDUs
+func readRanges(data []byte, order binary.ByteOrder) ([]searchRange, error) {
+	var ranges []searchRange
+	for len(data) > 0 {
+		var r searchRange
+		var err error
+		r.Start, r.Include, data, err = readOID(data, order)
+		if err != nil {
+			return nil, err
+		}
+		r.End, _, data, err = readOID(data, order)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// skipContext removes context octet string from the payload
+func skipContext(h agentxHeader, data []byte, order binary.ByteOrder) []byte {
+	if h.Flags&AGENTX_FLAG_CONTEXT == 0 || len(data) < 4 {
+		return data
+	}
+	length := int(order.Uint32(data))
+	length = (length + 3) &^ 3
+	if len(data) < 4+length {
+		return nil
+	}
+	return data[4+length:]
+}
+
+// lookup finds variable for a search range. Variables must be sorted
+func lookup(vars []SNMPVar, r searchRange, next bool) SNMPVar {
+	if !next {
+		for _, v := range vars {
+			if v.Name.Compare(r.Start) == 0 {
+				return v
+			}
+		}
+		return SNMPVar{Name: r.Start, Type: SNMP_NO_SUCH}
+	}
+	for _, v := range vars {
+		c := v.Name.Compare(r.Start)
+		if c < 0 || (c == 0 && !r.Include) {
+			continue
+		}
+		if len(r.End) > 0 && v.Name.Compare(r.End) >= 0 {
+			break
+		}
+		return v
+	}
+	return SNMPVar{Name: r.Start, Type: SNMP_END_OF_MIB}
+}
+
+// AgentX is a subagent session with a master SNMP agent
+type AgentX struct {
+	Subtree OID
+	Vars    func() []SNMPVar // Returns sorted variables of the subtree
+	conn    io.ReadWriter
+	session uint32
+	packet  uint32
+	started time.Time
+}
+
+// request sends PDU of the subagent and waits for the response
+func (a *AgentX) request(t uint8, payload []byte) (agentxHeader, error) {
+	a.packet++
+	_, err := a.conn.Write(encodePDU(agentxHeader{Type: t, Session: a.session, Packet: a.packet}, payload))
+	if err != nil {
+		return agentxHeader{}, err
+	}
+	h, order, resp, err := readPDU(a.conn)
+	if err != nil {
+		return h, err
+	}
+	if h.Type != AGENTX_RESPONSE || len(resp) < 8 {
+		return h, errors.New("Unexpected reply of master agent")
+	}
+	if code := order.Uint16(resp[4:]); code != 0 {
+		return h, errors.New(fmt.Sprintf("Master agent returned error %d", code))
+	}
+	return h, nil
+}
+
+// Open starts session and registers subtree of the subagent
+func (a *AgentX) Open(conn io.ReadWriter) error {
+	a.conn = conn
+	a.session = 0
+	a.started = time.Now()
+	b := new(bytes.Buffer)
+	b.Write([]byte{0, 0, 0, 0}) // Default timeout
+	writeOID(b, nil, false)
+	writeOctets(b, []byte("p2p "+VERSION))
+	h, err := a.request(AGENTX_OPEN, b.Bytes())
+	if err != nil {
+		return err
+	}
+	a.session = h.Session
+	b.Reset()
+	b.Write([]byte{0, 127, 0, 0}) // Default timeout and priority
+	writeOID(b, a.Subtree, false)
+	_, err = a.request(AGENTX_REGISTER, b.Bytes())
+	return err
+}
+
+// response builds Response PDU
+func (a *AgentX) response(h agentxHeader, code uint16, vars []SNMPVar) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, uint32(time.Since(a.started)/(10*time.Millisecond)))
+	binary.Write(b, binary.BigEndian, code)
+	binary.Write(b, binary.BigEndian, uint16(0))
+	for _, v := range vars {
+		writeVar(b, v)
+	}
+	h.Type = AGENTX_RESPONSE
+	h.Flags &= AGENTX_FLAG_NBO
+	return encodePDU(h, b.Bytes())
+}
+
+// handle answers a single request of the master agent. Returns false when
+// session was closed
+func (a *AgentX) handle(h agentxHeader, order binary.ByteOrder, payload []byte) (bool, error) {
+	var vars []SNMPVar
+	var code uint16
+	switch h.Type {
+	case AGENTX_GET, AGENTX_GETNEXT:
+		ranges, err := readRanges(skipContext(h, payload, order), order)
+		if err != nil {
+			return true, err
+		}
+		snapshot := a.Vars()
+		for _, r := range ranges {
+			vars = append(vars, lookup(snapshot, r, h.Type == AGENTX_GETNEXT))
+		}
+	case AGENTX_GETBULK:
+		payload = skipContext(h, payload, order)
+		if len(payload) < 4 {
+			return true, errors.New("Truncated GetBulk")
+		}
+		nonRepeaters, repetitions := int(order.Uint16(payload)), int(order.Uint16(payload[2:]))
+		ranges, err := readRanges(payload[4:], order)
+		if err != nil {
+			return true, err
+		}
+		snapshot := a.Vars()
+		for i, r := range ranges {
+			count := repetitions
+			if i < nonRepeaters {
+				count = 1
+			}
+			for j := 0; j < count; j++ {
+				v := lookup(snapshot, r, true)
+				vars = append(vars, v)
+				if v.Type == SNMP_END_OF_MIB {
+					break
+				}
+				r.Start, r.Include = v.Name, false
+			}
+		}
+	case AGENTX_TESTSET:
+		code = AGENTX_NOT_WRITABLE
+	case AGENTX_CLEANUPSET:
+		return true, nil
+	case AGENTX_CLOSE:
+		return false, nil
+	case AGENTX_RESPONSE:
+		return true, nil
+	}
+	_, err := a.conn.Write(a.response(h, code, vars))
+	return true, err
+}
+
+// Serve answers requests of the master agent until session is closed
+func (a *AgentX) Serve() error {
+	for {
+		h, order, payload, err := readPDU(a.conn)
+		if err != nil {
+			return err
+		}
+		open, err := a.handle(h, order, payload)
+		if err != nil {
+			return err
+		}
+		if !open {
+			return errors.New("Master agent closed session")
+		}
+	}
+}
+
+// DialAgentX connects to master agent. Address is either a path to unix
+// socket or tcp:HOST:PORT
+func DialAgentX(address string) (net.Conn, error) {
+	if strings.HasPrefix(address, "tcp:") {
+		return net.DialTimeout("tcp", strings.TrimPrefix(address, "tcp:"), AGENTX_RECONNECT)
+	}
+	return net.DialTimeout("unix", address, AGENTX_RECONNECT)
+}
+
+// RunAgentX keeps subagent connected to master agent
+func RunAgentX(address string, subtree OID) {
+	agent := &AgentX{Subtree: subtree, Vars: SNMPVars(subtree)}
+	for {
+		conn, err := DialAgentX(address)
+		if err == nil {
+			err = agent.Open(conn)
+			if err == nil {
+				ptp.Log(ptp.INFO, "Registered SNMP subtree %s with master agent at %s", subtree, address)
+				err = agent.Serve()
+			}
+			conn.Close()
+		}
+		ptp.Log(ptp.WARNING, "SNMP subagent: %v. Reconnecting in %s", err, AGENTX_RECONNECT)
+		time.Sleep(AGENTX_RECONNECT)
+	}
+}
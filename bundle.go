@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ptp "github.com/subutai-io/p2p/lib"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"time"
+)
+
+const BUNDLE_VERSION int = 1
+
+// Passphrase of the bundle is stretched with scrypt and salt of
+// BUNDLE_SALT_SIZE bytes stored in the bundle
+const (
+	BUNDLE_SALT_SIZE int = 16
+	BUNDLE_SCRYPT_N  int = 1 << 15
+	BUNDLE_SCRYPT_R  int = 8
+	BUNDLE_SCRYPT_P  int = 1
+)
+
+// Bundle contains everything needed to reproduce an instance on another machine
+type Bundle struct {
+	Version   int
+	Options   RunArgs     // Options of the instance without keys
+	Keys      []BundleKey // Every known key of the instance
+	Encrypted bool        // Keys are encrypted with a passphrase
+	Salt      []byte      // Salt of the passphrase
+}
+
+// BundleKey is a crypto key with its expiration time
+type BundleKey struct {
+	Key   []byte
+	Until time.Time
+}
+
+type BundleArgs struct {
+	Hash       string
+	Data       string
+	Passphrase string
+}
+
+// NewBundle collects options and keys of the instance. Keys are encrypted
+// when passphrase is not empty
+func NewBundle(inst Instance, passphrase string) (*Bundle, error) {
+	b := new(Bundle)
+	b.Version = BUNDLE_VERSION
+	b.Options = inst.Args
+	b.Options.Key = ""
+	b.Options.TTL = ""
+	if inst.PTP != nil && inst.PTP.UDPSocket != nil && inst.Args.Ports != "" {
+		b.Options.Port = inst.PTP.UDPSocket.GetPort()
+	}
+	if inst.PTP != nil && inst.PTP.CurrentCrypter().Active {
+		for _, key := range inst.PTP.CryptoKeys() {
+			b.Keys = append(b.Keys, BundleKey{key.Key, key.Until})
+		}
+	} else if inst.Args.Key != "" {
+		var c ptp.Crypto
+		key := c.EnrichKeyValues(ptp.CryptoKey{}, inst.Args.Key, inst.Args.TTL)
+		b.Keys = append(b.Keys, BundleKey{key.Key, key.Until})
+	}
+	if passphrase != "" {
+		b.Salt = make([]byte, BUNDLE_SALT_SIZE)
+		if _, err := io.ReadFull(rand.Reader, b.Salt); err != nil {
+			return nil, err
+		}
+		gcm, err := bundleCipher(passphrase, b.Salt)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range b.Keys {
+			encrypted, err := sealBundleKey(gcm, key.Key)
+			if err != nil {
+				return nil, err
+			}
+			b.Keys[i].Key = encrypted
+		}
+		b.Encrypted = true
+	}
+	return b, nil
+}
+
+// ParseBundle decodes bundle and decrypts its keys with provided passphrase
+func ParseBundle(data []byte, passphrase string) (*Bundle, error) {
+	b := new(Bundle)
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	if b.Version != BUNDLE_VERSION {
+		return nil, errors.New(fmt.Sprintf("Unsupported bundle version: %d", b.Version))
+	}
+	if b.Options.Hash == "" {
+		return nil, errors.New("Bundle doesn't contain hash")
+	}
+	if b.Encrypted {
+		if passphrase == "" {
+			return nil, errors.New("Bundle is encrypted. Passphrase is required")
+		}
+		if len(b.Salt) < BUNDLE_SALT_SIZE {
+			return nil, errors.New("Bundle doesn't contain salt of the passphrase")
+		}
+		gcm, err := bundleCipher(passphrase, b.Salt)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range b.Keys {
+			decrypted, err := openBundleKey(gcm, key.Key)
+			if err != nil {
+				return nil, errors.New("Failed to decrypt keys: wrong passphrase")
+			}
+			b.Keys[i].Key = decrypted
+		}
+		b.Encrypted = false
+	}
+	return b, nil
+}
+
+// bundleCipher derives cipher of the bundle keys from passphrase and salt
+func bundleCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	secret, err := scrypt.Key([]byte(passphrase), salt, BUNDLE_SCRYPT_N, BUNDLE_SCRYPT_R, BUNDLE_SCRYPT_P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealBundleKey(gcm cipher.AEAD, key []byte) ([]byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, key, nil), nil
+}
+
+func openBundleKey(gcm cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted key is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func (p *Procedures) Export(args *BundleArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	b, err := NewBundle(inst, args.Passphrase)
+	if err != nil {
+		resp.Output = "Failed to export instance: " + err.Error()
+		return nil
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		resp.Output = "Failed to encode bundle: " + err.Error()
+		return nil
+	}
+	resp.ExitCode = 0
+	resp.Output = string(data)
+	return nil
+}
+
+func (p *Procedures) Import(args *BundleArgs, resp *Response) error {
+	b, err := ParseBundle([]byte(args.Data), args.Passphrase)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Failed to import bundle: " + err.Error()
+		return nil
+	}
+	runArgs := b.Options
+	if len(b.Keys) > 0 {
+		runArgs.Key = string(b.Keys[0].Key)
+		runArgs.TTL = fmt.Sprintf("%d", b.Keys[0].Until.Unix())
+	}
+	err = p.Run(&runArgs, resp)
+	if err != nil || resp.ExitCode != 0 {
+		return err
+	}
+	WaitLock()
+	Lock()
+	defer Unlock()
+	inst, exists := Instances[runArgs.Hash]
+	if exists && inst.PTP != nil && len(b.Keys) > 1 {
+		for _, key := range b.Keys[1:] {
+			inst.PTP.AddKey(ptp.CryptoKey{Key: key.Key, Until: key.Until}, false)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strings"
+)
+
+// Actions of commands that take one before options
+var commandActions = map[string][]string{
+	"ephemeral":  {"create", "destroy"},
+	"identity":   {"show", "rotate"},
+	"manifest":   {"sign", "apply", "show"},
+	"service":    {"list", "announce", "withdraw"},
+	"filter":     {"list", "set", "clear"},
+	"completion": CompletionShells,
+}
+
+// CompletionShells are shells completion script is generated for
+var CompletionShells = []string{"bash", "zsh", "fish"}
+
+// Options completed with hashes of running instances and with peers of the
+// instance specified by -hash
+const (
+	hashOption = "hash"
+	peerOption = "peer"
+)
+
+// CandidatesResponse lists words completed by shells and console
+type CandidatesResponse struct {
+	Hashes []string
+	Peers  []string // IDs and IPs of peers of the instance
+}
+
+// Candidates returns hashes of running instances. IDs and virtual IPs of
+// peers are returned as well when instance is specified
+func (p *Procedures) Candidates(args *RunArgs, resp *CandidatesResponse) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	for hash, inst := range Instances {
+		resp.Hashes = append(resp.Hashes, hash)
+		if hash != args.Hash || inst.PTP == nil {
+			continue
+		}
+		inst.PTP.PeersLock.Lock()
+		for _, peer := range inst.PTP.NetworkPeers {
+			resp.Peers = append(resp.Peers, peer.ID)
+			if peer.PeerLocalIP != nil {
+				resp.Peers = append(resp.Peers, peer.PeerLocalIP.String())
+			}
+		}
+		inst.PTP.PeersLock.Unlock()
+	}
+	sort.Strings(resp.Hashes)
+	sort.Strings(resp.Peers)
+	return nil
+}
+
+// CompleteCandidates prints hashes or peers of an instance for completion
+// scripts, one per line. Nothing is printed if daemon is not running
+func CompleteCandidates(rpcPort string, args []string) {
+	if len(args) == 0 {
+		return
+	}
+	client, err := rpc.DialHTTP("tcp", "localhost:"+rpcPort)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	req := &RunArgs{}
+	if len(args) > 1 {
+		req.Hash = args[1]
+	}
+	var resp CandidatesResponse
+	if client.Call("Procedures.Candidates", req, &resp) != nil {
+		return
+	}
+	words := resp.Hashes
+	if args[0] == "peers" {
+		words = resp.Peers
+	}
+	for _, word := range words {
+		fmt.Println(word)
+	}
+}
+
+// Completion prints completion script of the shell
+func Completion(shell string, commands map[string]*flag.FlagSet) {
+	script, err := CompletionScript(shell, commands)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	fmt.Print(script)
+}
+
+// option describes an option for completion scripts
+type option struct {
+	name  string
+	value bool // Option takes a value
+	usage string
+}
+
+// commandOptions returns options of the command sorted by name
+func commandOptions(fs *flag.FlagSet) []option {
+	var options []option
+	if fs == nil {
+		return options
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		o := option{name: f.Name, value: true}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			o.value = false
+		}
+		// First sentence is enough for a hint
+		o.usage = strings.Replace(f.Usage, "`", "", -1)
+		if i := strings.Index(o.usage, ". "); i > 0 {
+			o.usage = o.usage[:i]
+		}
+		options = append(options, o)
+	})
+	return options
+}
+
+// CompletionScript generates completion script of the shell for commands
+// and their options. Hashes and peers are completed with names of running
+// instances and their peers
+func CompletionScript(shell string, commands map[string]*flag.FlagSet) (string, error) {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch shell {
+	case "bash":
+		return bashCompletion(names, commands), nil
+	case "zsh":
+		// zsh runs bash completion functions through bashcompinit
+		return "autoload -U +X compinit && compinit\nautoload -U +X bashcompinit && bashcompinit\n" +
+			bashCompletion(names, commands), nil
+	case "fish":
+		return fishCompletion(names, commands), nil
+	}
+	return "", errors.New(fmt.Sprintf("Unsupported shell %q: should be one of %s", shell, strings.Join(CompletionShells, ", ")))
+}
+
+func bashCompletion(names []string, commands map[string]*flag.FlagSet) string {
+	var b bytes.Buffer
+	b.WriteString("# p2p completion for bash. Load with: source <(p2p completion bash)\n")
+	b.WriteString("_p2p_hash() {\n")
+	b.WriteString("\tlocal i\n")
+	b.WriteString("\tfor ((i = 2; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("\t\tif [ \"${COMP_WORDS[i-1]}\" = \"-" + hashOption + "\" ]; then echo \"${COMP_WORDS[i]}\"; fi\n")
+	b.WriteString("\tdone\n")
+	b.WriteString("}\n\n")
+	b.WriteString("_p2p() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" words=\"\"\n")
+	b.WriteString("\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(names, " "))
+	b.WriteString("\t\treturn\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("\tcase \"$prev\" in\n")
+	fmt.Fprintf(&b, "\t-%s)\n\t\tCOMPREPLY=($(compgen -W \"$(p2p __complete hashes 2>/dev/null)\" -- \"$cur\"))\n\t\treturn\n\t\t;;\n", hashOption)
+	fmt.Fprintf(&b, "\t-%s)\n\t\tCOMPREPLY=($(compgen -W \"$(p2p __complete peers \"$(_p2p_hash)\" 2>/dev/null)\" -- \"$cur\"))\n\t\treturn\n\t\t;;\n", peerOption)
+	// Other values are completed as file names
+	var values []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		for _, o := range commandOptions(commands[name]) {
+			if o.value && o.name != hashOption && o.name != peerOption && !seen[o.name] {
+				seen[o.name] = true
+				values = append(values, "-"+o.name)
+			}
+		}
+	}
+	sort.Strings(values)
+	if len(values) > 0 {
+		fmt.Fprintf(&b, "\t%s)\n\t\treturn\n\t\t;;\n", strings.Join(values, "|"))
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, name := range names {
+		var words []string
+		words = append(words, commandActions[name]...)
+		if name == "help" {
+			words = append(words, names...)
+		}
+		for _, o := range commandOptions(commands[name]) {
+			words = append(words, "-"+o.name)
+		}
+		if len(words) > 0 {
+			fmt.Fprintf(&b, "\t%s)\n\t\twords=\"%s\"\n\t\t;;\n", name, strings.Join(words, " "))
+		}
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	b.WriteString("}\n\n")
+	b.WriteString("complete -o default -F _p2p p2p\n")
+	return b.String()
+}
+
+// fishQuote quotes string for fish
+func fishQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "'", "\\'", -1) + "'"
+}
+
+func fishCompletion(names []string, commands map[string]*flag.FlagSet) string {
+	var b bytes.Buffer
+	b.WriteString("# p2p completion for fish. Load with: p2p completion fish | source\n")
+	b.WriteString("function __p2p_hash\n")
+	b.WriteString("\tset -l words (commandline -opc)\n")
+	b.WriteString("\tfor i in (seq 2 (count $words))\n")
+	fmt.Fprintf(&b, "\t\tif test \"$words[(math $i - 1)]\" = -%s\n\t\t\techo $words[$i]\n\t\tend\n", hashOption)
+	b.WriteString("\tend\n")
+	b.WriteString("end\n\n")
+	b.WriteString("complete -c p2p -f\n")
+	fmt.Fprintf(&b, "complete -c p2p -n __fish_use_subcommand -a %s\n", fishQuote(strings.Join(names, " ")))
+	fmt.Fprintf(&b, "complete -c p2p -n '__fish_seen_subcommand_from help' -a %s\n", fishQuote(strings.Join(names, " ")))
+	for _, name := range names {
+		cond := fishQuote("__fish_seen_subcommand_from " + name)
+		if actions := commandActions[name]; len(actions) > 0 {
+			fmt.Fprintf(&b, "complete -c p2p -n %s -a %s\n", cond, fishQuote(strings.Join(actions, " ")))
+		}
+		for _, o := range commandOptions(commands[name]) {
+			switch {
+			case o.name == hashOption:
+				fmt.Fprintf(&b, "complete -c p2p -n %s -o %s -x -a '(p2p __complete hashes 2>/dev/null)' -d %s\n",
+					cond, o.name, fishQuote(o.usage))
+			case o.name == peerOption:
+				fmt.Fprintf(&b, "complete -c p2p -n %s -o %s -x -a '(p2p __complete peers (__p2p_hash) 2>/dev/null)' -d %s\n",
+					cond, o.name, fishQuote(o.usage))
+			case o.value:
+				fmt.Fprintf(&b, "complete -c p2p -n %s -o %s -r -F -d %s\n", cond, o.name, fishQuote(o.usage))
+			default:
+				fmt.Fprintf(&b, "complete -c p2p -n %s -o %s -d %s\n", cond, o.name, fishQuote(o.usage))
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// How often console asks daemon for new peer events
+const CONSOLE_EVENTS_INTERVAL time.Duration = time.Second
+
+// Argument of a console command that is completed
+const (
+	argNone = iota
+	argHash
+	argPeer
+	argToggle
+)
+
+// consoleCommand is a command of interactive console
+type consoleCommand struct {
+	name  string
+	usage string
+	arg   int
+	help  string
+}
+
+var consoleCommands = []consoleCommand{
+	{"instances", "instances", argNone, "List running instances"},
+	{"use", "use HASH", argHash, "Select instance that commands below apply to"},
+	{"peers", "peers [HASH]", argHash, "List peers of the instance"},
+	{"peer", "peer ID|IP", argPeer, "Show status of a peer of the selected instance"},
+	{"status", "status", argNone, "Show status of every instance and its peers"},
+	{"neighbors", "neighbors [HASH]", argHash, "Print IP to MAC mapping learned from peers of the instance"},
+	{"traversal", "traversal [HASH]", argHash, "Show success rates of NAT traversal strategies"},
+	{"events", "events on|off", argToggle, "Print peer events as they happen. On by default"},
+	{"help", "help", argNone, "Show this message"},
+	{"exit", "exit", argNone, "Leave console"},
+}
+
+// EventsArgs carries sequence numbers of the latest events client has seen
+// by hash of instance
+type EventsArgs struct {
+	After map[string]uint64
+}
+
+// EventsResponse carries events of every instance in order they happened
+type EventsResponse struct {
+	Events []ptp.PeerEvent
+	Last   map[string]uint64
+}
+
+// Events returns peer events that happened since the last call
+func (p *Procedures) Events(args *EventsArgs, resp *EventsResponse) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.Last = make(map[string]uint64)
+	for hash, inst := range Instances {
+		if inst.PTP == nil || inst.PTP.Events == nil {
+			continue
+		}
+		events, last := inst.PTP.Events.Since(args.After[hash])
+		resp.Events = append(resp.Events, events...)
+		resp.Last[hash] = last
+	}
+	sort.SliceStable(resp.Events, func(i, j int) bool { return resp.Events[i].Time.Before(resp.Events[j].Time) })
+	return nil
+}
+
+// FormatEvent describes peer event in a single line
+func FormatEvent(e ptp.PeerEvent) string {
+	line := fmt.Sprintf("%s %s %s %s", e.Time.Format("15:04:05"), e.Network, e.Type, e.PeerID)
+	if e.PeerIP != "" {
+		line += " " + e.PeerIP
+	}
+	if e.Forwarder != "" {
+		line += " via " + e.Forwarder
+	} else if e.Endpoint != "" && e.Type == ptp.EVENT_JOIN {
+		line += " at " + e.Endpoint
+	}
+	if e.Reason != "" {
+		line += ": " + e.Reason
+	}
+	return line
+}
+
+// Console is an interactive shell that keeps RPC connection to the daemon
+// open, completes commands, hashes and peers and prints peer events as they
+// happen
+type Console struct {
+	client *rpc.Client
+	hash   string // Selected instance
+	events bool
+	after  map[string]uint64
+	editor *LineEditor
+	lock   sync.Mutex
+}
+
+// RunConsole runs console until user leaves it or input ends
+func RunConsole(rpcPort string) {
+	c := &Console{client: Dial(rpcPort), events: true}
+	defer c.client.Close()
+	c.editor = NewLineEditor(os.Stdin, os.Stdout, c.Complete)
+	c.editor.Prompt = c.prompt()
+	if restore, err := rawMode(int(os.Stdin.Fd())); err == nil {
+		c.editor.Raw = true
+		defer restore()
+	}
+	fmt.Printf("p2p console. Type 'help' for list of commands, TAB completes commands, hashes and peers\n")
+	// Events that happened before console was opened are skipped
+	c.pollEvents(false)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(CONSOLE_EVENTS_INTERVAL):
+				c.pollEvents(true)
+			}
+		}
+	}()
+	for {
+		line, err := c.editor.ReadLine()
+		if err != nil {
+			fmt.Printf("\n")
+			return
+		}
+		output, quit := c.Execute(line)
+		if output != "" {
+			c.editor.Print(strings.TrimRight(output, "\n"))
+		}
+		if quit {
+			return
+		}
+		c.editor.Prompt = c.prompt()
+	}
+}
+
+func (c *Console) prompt() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.hash == "" {
+		return "p2p> "
+	}
+	return "p2p:" + c.hash + "> "
+}
+
+// pollEvents fetches new events and prints them if enabled
+func (c *Console) pollEvents(print bool) {
+	c.lock.Lock()
+	after := c.after
+	c.lock.Unlock()
+	var resp EventsResponse
+	if err := c.client.Call("Procedures.Events", &EventsArgs{After: after}, &resp); err != nil {
+		return
+	}
+	c.lock.Lock()
+	c.after = resp.Last
+	enabled := c.events
+	c.lock.Unlock()
+	if !print || !enabled {
+		return
+	}
+	for _, e := range resp.Events {
+		c.editor.Print("[event] " + FormatEvent(e))
+	}
+}
+
+// candidates asks daemon for hashes of instances and peers of the
+// selected one
+func (c *Console) candidates() CandidatesResponse {
+	var resp CandidatesResponse
+	c.lock.Lock()
+	hash := c.hash
+	c.lock.Unlock()
+	c.client.Call("Procedures.Candidates", &RunArgs{Hash: hash}, &resp)
+	return resp
+}
+
+// Complete returns candidates for the last word of the line
+func (c *Console) Complete(line string) []string {
+	return completeConsole(line, c.candidates)
+}
+
+// completeConsole returns candidates for the last word of the line.
+// Candidates are requested from daemon only when argument is completed
+func completeConsole(line string, candidates func() CandidatesResponse) []string {
+	words := strings.Fields(line)
+	if len(words) == 0 || (len(words) == 1 && !strings.HasSuffix(line, " ")) {
+		var names []string
+		for _, cmd := range consoleCommands {
+			names = append(names, cmd.name)
+		}
+		return names
+	}
+	if len(words) > 2 || (len(words) == 2 && strings.HasSuffix(line, " ")) {
+		return nil
+	}
+	for _, cmd := range consoleCommands {
+		if cmd.name != words[0] {
+			continue
+		}
+		switch cmd.arg {
+		case argHash:
+			return candidates().Hashes
+		case argPeer:
+			return candidates().Peers
+		case argToggle:
+			return []string{"on", "off"}
+		}
+	}
+	return nil
+}
+
+// call runs RPC procedure and returns its output
+func (c *Console) call(method string, args *RunArgs) string {
+	var resp Response
+	if err := c.client.Call(method, args, &resp); err != nil {
+		return fmt.Sprintf("[ERROR] Failed to run RPC request: %v", err)
+	}
+	return resp.Output
+}
+
+// Execute runs command of the line and returns its output. Returns true
+// if user leaves console
+func (c *Console) Execute(line string) (string, bool) {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return "", false
+	}
+	c.lock.Lock()
+	hash := c.hash
+	c.lock.Unlock()
+	arg := ""
+	if len(words) > 1 {
+		arg = words[1]
+	}
+	switch words[0] {
+	case "exit", "quit":
+		return "", true
+	case "help":
+		var b strings.Builder
+		for _, cmd := range consoleCommands {
+			fmt.Fprintf(&b, "  %-18s %s\n", cmd.usage, cmd.help)
+		}
+		return b.String(), false
+	case "instances":
+		return c.call("Procedures.Show", &RunArgs{}), false
+	case "use":
+		if arg == "" {
+			return "Specify hash of an instance", false
+		}
+		for _, h := range c.candidates().Hashes {
+			if h == arg {
+				c.lock.Lock()
+				c.hash = arg
+				c.lock.Unlock()
+				return "", false
+			}
+		}
+		return "Specified environment was not found: " + arg, false
+	case "status":
+		return c.call("Procedures.Status", &RunArgs{}), false
+	case "events":
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		switch arg {
+		case "on":
+			c.events = true
+		case "off":
+			c.events = false
+		default:
+			return "Specify on or off", false
+		}
+		return "", false
+	}
+	if arg == "" {
+		arg = hash
+	}
+	switch words[0] {
+	case "peers":
+		if arg == "" {
+			return "Specify hash or select instance with 'use HASH'", false
+		}
+		return c.call("Procedures.Show", &RunArgs{Hash: arg}), false
+	case "neighbors":
+		if arg == "" {
+			return "Specify hash or select instance with 'use HASH'", false
+		}
+		return c.call("Procedures.Neighbors", &RunArgs{Hash: arg}), false
+	case "traversal":
+		return c.call("Procedures.Traversal", &RunArgs{Hash: arg}), false
+	case "peer":
+		if len(words) < 2 {
+			return "Specify ID or IP of the peer", false
+		}
+		// Status lists peers as ID|IP|State|...
+		var lines []string
+		for _, l := range strings.Split(c.call("Procedures.Status", &RunArgs{}), "\n") {
+			fields := strings.Split(strings.TrimSpace(l), "|")
+			if len(fields) > 2 && (fields[0] == words[1] || fields[1] == words[1]) {
+				lines = append(lines, strings.TrimSpace(l))
+			}
+		}
+		if len(lines) == 0 {
+			return "Peer was not found: " + words[1], false
+		}
+		return strings.Join(lines, "\n"), false
+	}
+	return "Unknown command: " + words[0] + ". Type 'help' for list of commands", false
+}
+
+// LineEditor reads lines from terminal in raw mode, so TAB completes the
+// word being typed and output printed in background doesn't garble the
+// line. Lines are read as is when terminal can't switch to raw mode
+type LineEditor struct {
+	Prompt   string
+	Raw      bool // Terminal is in raw mode
+	in       *bufio.Reader
+	out      io.Writer
+	complete func(line string) []string
+	buf      []byte
+	history  []string
+	reading  bool
+	lock     sync.Mutex
+}
+
+// NewLineEditor creates editor. Complete returns candidates for the last
+// word of the line
+func NewLineEditor(in io.Reader, out io.Writer, complete func(line string) []string) *LineEditor {
+	return &LineEditor{in: bufio.NewReader(in), out: out, complete: complete}
+}
+
+// Print prints line above the one being edited
+func (e *LineEditor) Print(line string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.reading && e.Raw {
+		fmt.Fprintf(e.out, "\r\033[K%s\n%s%s", line, e.Prompt, e.buf)
+		return
+	}
+	fmt.Fprintf(e.out, "%s\n", line)
+}
+
+// ReadLine reads next line. Returns io.EOF when input ends or user presses
+// Ctrl-D on empty line
+func (e *LineEditor) ReadLine() (string, error) {
+	e.lock.Lock()
+	e.reading = true
+	e.buf = e.buf[:0]
+	fmt.Fprint(e.out, e.Prompt)
+	e.lock.Unlock()
+	defer func() {
+		e.lock.Lock()
+		e.reading = false
+		e.lock.Unlock()
+	}()
+	if !e.Raw {
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	position := len(e.history)
+	for {
+		b, err := e.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		e.lock.Lock()
+		switch {
+		case b == '\r' || b == '\n':
+			line := string(e.buf)
+			fmt.Fprint(e.out, "\n")
+			if strings.TrimSpace(line) != "" {
+				e.history = append(e.history, line)
+			}
+			e.lock.Unlock()
+			return line, nil
+		case b == 3: // Ctrl-C drops the line
+			e.buf = e.buf[:0]
+			fmt.Fprintf(e.out, "^C\n%s", e.Prompt)
+		case b == 4: // Ctrl-D
+			if len(e.buf) == 0 {
+				e.lock.Unlock()
+				return "", io.EOF
+			}
+		case b == 21: // Ctrl-U
+			e.buf = e.buf[:0]
+			e.redraw()
+		case b == 127 || b == 8:
+			if len(e.buf) > 0 {
+				e.buf = e.buf[:len(e.buf)-1]
+				fmt.Fprint(e.out, "\b \b")
+			}
+		case b == '\t':
+			e.lock.Unlock()
+			candidates := e.complete(string(e.buf))
+			e.lock.Lock()
+			e.completeWord(candidates)
+		case b == 27:
+			// Arrows up and down walk through history
+			e.lock.Unlock()
+			seq := make([]byte, 2)
+			if _, err := io.ReadFull(e.in, seq); err != nil {
+				return "", err
+			}
+			e.lock.Lock()
+			if seq[0] == '[' && seq[1] == 'A' && position > 0 {
+				position--
+				e.buf = append(e.buf[:0], e.history[position]...)
+				e.redraw()
+			} else if seq[0] == '[' && seq[1] == 'B' && position < len(e.history) {
+				position++
+				e.buf = e.buf[:0]
+				if position < len(e.history) {
+					e.buf = append(e.buf, e.history[position]...)
+				}
+				e.redraw()
+			}
+		case b >= 32 && b < 127:
+			e.buf = append(e.buf, b)
+			e.out.Write([]byte{b})
+		}
+		e.lock.Unlock()
+	}
+}
+
+// redraw prints prompt and line again
+func (e *LineEditor) redraw() {
+	fmt.Fprintf(e.out, "\r\033[K%s%s", e.Prompt, e.buf)
+}
+
+// completeWord completes the last word of the line with candidates that
+// start with it. Candidates are listed when they have nothing more in
+// common
+func (e *LineEditor) completeWord(candidates []string) {
+	line := string(e.buf)
+	word := line[strings.LastIndex(line, " ")+1:]
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	if len(matches) == 1 {
+		e.buf = append(e.buf, matches[0][len(word):]+" "...)
+		e.redraw()
+		return
+	}
+	prefix := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		e.buf = append(e.buf, prefix[len(word):]...)
+		e.redraw()
+		return
+	}
+	fmt.Fprintf(e.out, "\n%s\n", strings.Join(matches, "  "))
+	e.redraw()
+}
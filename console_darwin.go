@@ -0,0 +1,10 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioctlGetTermios = unix.TIOCGETA
+	ioctlSetTermios = unix.TIOCSETA
+)
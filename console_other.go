@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+)
+
+// rawMode is not supported, so console reads whole lines without completion
+func rawMode(fd int) (func(), error) {
+	return nil, errors.New("Raw mode is not supported on this platform")
+}
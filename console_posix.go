@@ -0,0 +1,29 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// rawMode switches terminal to raw mode, so console reads keys as they are
+// pressed. Output is still post-processed, so newlines return carriage.
+// Returned function restores previous mode
+func rawMode(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() {
+		unix.IoctlSetTermios(fd, ioctlSetTermios, old)
+	}, nil
+}
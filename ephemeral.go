@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+const (
+	EPHEMERAL_PREFIX    string        = "ephemeral-"
+	EPHEMERAL_HASH_SIZE int           = 16 // Random bytes in hash of ephemeral network
+	EPHEMERAL_LIFETIME  time.Duration = time.Hour * 24
+	EPHEMERAL_KEY_CHARS string        = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+type EphemeralArgs struct {
+	Hash     string
+	IP       string
+	Dht      string
+	Lifetime string // Network is destroyed when it passes
+}
+
+// NewEphemeralNetwork generates random hash and key of a network. Key
+// fills the whole AES block, so it isn't padded with zeros
+func NewEphemeralNetwork() (hash, key string, err error) {
+	buf := make([]byte, EPHEMERAL_HASH_SIZE)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	hash = EPHEMERAL_PREFIX + hex.EncodeToString(buf)
+	chars := big.NewInt(int64(len(EPHEMERAL_KEY_CHARS)))
+	k := make([]byte, ptp.BLOCK_SIZE)
+	for i := range k {
+		n, err := rand.Int(rand.Reader, chars)
+		if err != nil {
+			return "", "", err
+		}
+		k[i] = EPHEMERAL_KEY_CHARS[n.Int64()]
+	}
+	return hash, string(k), nil
+}
+
+// ParseLifetime parses lifetime of ephemeral network. Networks can't
+// outlive EPHEMERAL_LIFETIME, so forgotten ones are cleaned up
+func ParseLifetime(value string) (time.Duration, error) {
+	if value == "" {
+		return EPHEMERAL_LIFETIME, nil
+	}
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime <= 0 {
+		return 0, errors.New(fmt.Sprintf("Bad lifetime %s. Use a duration like 30m or 2h", value))
+	}
+	if lifetime > EPHEMERAL_LIFETIME {
+		return 0, errors.New(fmt.Sprintf("Lifetime can't exceed %s", EPHEMERAL_LIFETIME))
+	}
+	return lifetime, nil
+}
+
+// CreateEphemeral starts instance of a new short-lived network and
+// returns its hash, key and invitation in a form shell can evaluate
+func (p *Procedures) CreateEphemeral(args *EphemeralArgs, resp *Response) error {
+	lifetime, err := ParseLifetime(args.Lifetime)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = err.Error()
+		return nil
+	}
+	hash, key, err := NewEphemeralNetwork()
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Failed to generate network: " + err.Error()
+		return nil
+	}
+	runArgs := RunArgs{IP: args.IP, Hash: hash, Dht: args.Dht, Key: key, Ephemeral: true, Expires: time.Now().Add(lifetime)}
+	if runArgs.IP == "" {
+		runArgs.IP = "dhcp"
+	}
+	var run Response
+	if err := p.Run(&runArgs, &run); err != nil || run.ExitCode != 0 {
+		resp.ExitCode = run.ExitCode
+		resp.Output = run.Output
+		return err
+	}
+	WaitLock()
+	Lock()
+	defer Unlock()
+	inst, exists := Instances[hash]
+	if !exists {
+		resp.ExitCode = 1
+		resp.Output = "Instance of ephemeral network has disappeared"
+		return nil
+	}
+	ptp.Log(ptp.INFO, "Ephemeral network %s was created. It expires at %s", hash, runArgs.Expires.Format(time.RFC1123))
+	inv, err := NewInvitation(inst)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Failed to create invitation: " + err.Error()
+		return nil
+	}
+	resp.ExitCode = 0
+	resp.Output = fmt.Sprintf("HASH=%s\nKEY=%s\nINVITATION=%s\nEXPIRES=%s", hash, key,
+		inv.Encode(), runArgs.Expires.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// DestroyEphemeral stops instance of ephemeral network. Other instances
+// are refused, so cleanup of CI job can't take down a real network
+func (p *Procedures) DestroyEphemeral(args *EphemeralArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	inst, exists := Instances[args.Hash]
+	Unlock()
+	if !exists {
+		resp.ExitCode = 1
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if !inst.Args.Ephemeral {
+		resp.ExitCode = 1
+		resp.Output = "Network " + args.Hash + " is not ephemeral. Use stop command"
+		return nil
+	}
+	return p.Stop(&StopArgs{Hash: args.Hash}, resp)
+}
+
+// ExpireEphemeral stops ephemeral networks whose lifetime has passed
+func ExpireEphemeral() {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	now := time.Now()
+	for hash, inst := range Instances {
+		if !inst.Args.Ephemeral || inst.Args.Expires.IsZero() || now.Before(inst.Args.Expires) {
+			continue
+		}
+		ptp.Log(ptp.INFO, "Ephemeral network %s has expired", hash)
+		if inst.PTP != nil {
+			inst.PTP.StopInstance()
+		}
+		delete(Instances, hash)
+	}
+}
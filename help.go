@@ -10,12 +10,44 @@ func UsageDaemon() {
 		"create new virtual network interfaces (tap). \n" +
 		"When running p2p in daemon mode it will listen to a particular port specified by optional -port \n" +
 		"argument (Default: 52523) for local RPC connection and wait for commands from p2p client (same \n" +
-		"application, but without daemon command)\n\n")
+		"application, but without daemon command)\n" +
+		"With -status option daemon serves read-only status page with instances, peers, paths, \n" +
+		"counters and recent warnings on http://localhost:PORT/\n" +
+		"With -snmp option daemon connects to a master SNMP agent over AgentX protocol and exposes \n" +
+		"instance and peer tables under subtree specified by -snmp-oid. For net-snmp enable \n" +
+		"'master agentx' in snmpd.conf\n" +
+		"With -hardened option daemon refuses to touch files outside of its configuration, state and \n" +
+		"runtime directories and to run tools other than the known ones. See 'p2p help policy'\n\n")
 	fmt.Printf("Usage: p2p daemon [OPTIONS]:\n")
 }
 
 func UsageStart() {
 	fmt.Printf("start command allows user to run new p2p instance. This command executes start procedure in a daemon.\n\n")
+	fmt.Printf("Instance may be limited to specific time windows with -schedule option. Windows are separated \n" +
+		"by semicolon and consist of optional days of week and time interval in local time of the daemon, e.g. \n" +
+		"\"Mon-Fri 09:00-18:00;Sat 10:00-14:00\". Daemon brings instance down outside of these windows\n\n")
+	fmt.Printf("Tags specified with -tags option are signed and advertised to other peers. Peers use them in \n" +
+		"ACL rules of their config.yaml, e.g. allow app-servers to reach db-servers on port 5432, once \n" +
+		"their authentication hook admits the peer with these tags or trust_tags is enabled\n\n")
+	fmt.Printf("With -hubs option instance works as a spoke in split-horizon mode: traffic is exchanged only \n" +
+		"with hub peers specified by ID, IP or tag, so spokes can't reach each other\n\n")
+	fmt.Printf("Peers listed in -relay-only option are always reached through forwarders and never learn \n" +
+		"endpoints of this host. Peers listed in -no-relay option are never relayed: connection to them \n" +
+		"fails instead of falling back to a forwarder. Data sent to peers listed in -redundant option goes \n" +
+		"over direct path and relay at once, receiver drops the copy that arrives last\n\n")
+	fmt.Printf("With -private option instance doesn't advertise addresses of local interfaces to routers and \n" +
+		"reaches every peer through forwarders. Routers still see the public address of the host\n\n")
+	fmt.Printf("Instance started with -observer option connects to peers and learns topology, but only \n" +
+		"broadcast and multicast frames leave it and frames addressed to other hosts are never forwarded, \n" +
+		"so monitoring probes can't interact with production hosts. Status shows withheld frames\n\n")
+	fmt.Printf("Instance started with -split-dns option is a DNS provider of the network. It pushes rules, \n" +
+		"like corp.example=10.10.10.1, to other members. Members started with -accept-dns install them \n" +
+		"with systemd-resolved, NRPT or scutil, so names of the domains are resolved by resolvers on the \n" +
+		"virtual network while instance is up\n\n")
+	fmt.Printf("Members that can't change DNS settings of the whole system may run a stub resolver with \n" +
+		"-resolver option instead. It listens on port 53 of the virtual interface, forwards queries to a \n" +
+		"resolver of a peer through the tunnel and caches answers. Fallback resolvers are tried when the peer \n" +
+		"doesn't respond and expired answers are served while none of them does\n\n")
 	fmt.Printf("Usage: p2p start [-ip IP] [-hash HASH] [OPTIONS]:\n")
 }
 
@@ -24,9 +56,144 @@ func UsageStop() {
 }
 
 func UsageShow() {
-	fmt.Printf("Usage: p2p show [-hash HASH]:\n")
+	fmt.Printf("show command lists instances or peers of an instance. With -watch option it redraws a table \n" +
+		"of instances and peers with their state, path, RTT and throughput every second until interrupted. \n" +
+		"With -neighbors option it prints IP to MAC mapping of peers that is saved and restored with the instance\n\n")
+	fmt.Printf("Usage: p2p show [-hash HASH] [-watch] [-neighbors]:\n")
 }
 
 func UsageSet() {
+	fmt.Printf("set command changes options of the daemon or running instance. With -keyfile option instance \n" +
+		"switches to a key from the file and handshakes with peers again, while interface and its \n" +
+		"configuration are kept. Key file should be replaced on every member of the network\n\n")
 	fmt.Printf("Usage: p2p set [OPTIONS]:\n")
 }
+
+func UsageRekey() {
+	fmt.Printf("rekey command rotates network hash and key for every member of the network. Members leave \n" +
+		"the current network and join the new one at the same time. New key is sealed to identity of every \n" +
+		"connected member, so members that are offline at the moment have to be moved by hand. Rotation \n" +
+		"is approved with key pair from -authority file. Members accept it only if the key is admin key \n" +
+		"of the network or is listed in rekey_authorities of their config\n\n")
+	fmt.Printf("Usage: p2p rekey -hash HASH -newhash HASH -key KEY -authority FILE [-delay SECONDS]:\n")
+}
+
+func UsageDrain() {
+	fmt.Printf("drain command prepares instance for maintenance. Instance stops accepting new peers and asks \n" +
+		"connected peers one by one to stop using this host. Progress is printed on every call. With -wait \n" +
+		"command returns when traffic has ceased\n\n")
+	fmt.Printf("Usage: p2p drain -hash HASH [-wait]:\n")
+}
+
+func UsageDoctor() {
+	fmt.Printf("doctor command checks TAP driver, connectivity with DHT routers, NAT, port binding, \n" +
+		"clock synchronization and forwarding settings and prints what should be fixed\n\n")
+	fmt.Printf("Usage: p2p doctor [-dht HOST:PORT] [-port PORT]:\n")
+}
+
+func UsageExport() {
+	fmt.Printf("export command prints a bundle with options and keys of an instance, so membership can be \n" +
+		"moved to another machine with import command. Keys are stored in plain text unless passphrase is specified\n\n")
+	fmt.Printf("Usage: p2p export -hash HASH [-passphrase PASSPHRASE] > bundle.json:\n")
+}
+
+func UsageImport() {
+	fmt.Printf("Usage: p2p import [-passphrase PASSPHRASE] bundle.json:\n")
+}
+
+func UsageInvite() {
+	fmt.Printf("invite command prints a short code with hash of the network, its routers and fingerprint \n" +
+		"of its key. Key itself is not included and should be passed to a new member separately. \n" +
+		"Code can also be shown as QR code in terminal or saved as PNG image for devices where typing \n" +
+		"it is awkward\n\n")
+	fmt.Printf("Usage: p2p invite -hash HASH [-qr] [-png FILE]:\n")
+}
+
+func UsageIdentity() {
+	fmt.Printf("identity command shows ID of an instance and file its key pair is stored in. ID is derived \n" +
+		"from the key pair, so it stays the same after restarts. 'rotate' action generates new key pair, \n" +
+		"saves it and rejoins the network with the new ID\n\n")
+	fmt.Printf("Usage: p2p identity [show|rotate] -hash HASH:\n")
+}
+
+func UsageManifest() {
+	fmt.Printf("manifest command manages membership manifest: list of public keys of members signed by admin \n" +
+		"key of the network. Instances started with -admin option accept only peers listed in the latest \n" +
+		"manifest and pass it to each other, so it's enough to apply a new manifest to any member. 'sign' \n" +
+		"action creates manifest with public keys shown by 'p2p identity' and prints it, 'apply' passes \n" +
+		"manifest from a file to the instance and 'show' prints manifest the instance enforces\n\n")
+	fmt.Printf("Usage: p2p manifest sign -key FILE -hash HASH -members KEY[,KEY]\n" +
+		"       p2p manifest [show|apply] -hash HASH [FILE]:\n")
+}
+
+func UsageService() {
+	fmt.Printf("service command lists services announced by members of the network, including services of \n" +
+		"this instance. 'announce' action adds a service of this instance and 'withdraw' removes it. Services \n" +
+		"can be announced at start with -services option too. Services of a member are forgotten a few \n" +
+		"minutes after it stops announcing them\n\n")
+	fmt.Printf("Usage: p2p service [list|announce|withdraw] -hash HASH [-name NAME] [-port PORT] [-proto tcp|udp]:\n")
+}
+
+func UsageFilter() {
+	fmt.Printf("filter command limits traffic exchanged with a semi-trusted peer to a few protocols and \n" +
+		"ports of this host, e.g. tcp/22,icmp, without writing ACL rules. Peer is specified by ID, IP or \n" +
+		"tag. Filter applies on top of ACL in both directions: peer reaches listed ports and receives \n" +
+		"replies from them. 'list' action shows filters with hit counters of every entry and number of \n" +
+		"dropped packets. Filters set with this command are lost on restart, use peer_filters in \n" +
+		"config.yaml to keep them\n\n")
+	fmt.Printf("Usage: p2p filter [list] -hash HASH\n" +
+		"       p2p filter set -hash HASH -peer PEER -allow PROTO[/PORTS][,PROTO[/PORTS]]\n" +
+		"       p2p filter clear -hash HASH -peer PEER:\n")
+}
+
+func UsageJoin() {
+	fmt.Printf("join command starts instance from invitation code. Key is checked against the fingerprint \n" +
+		"in the code before instance is started. Code can be read from PNG image produced by invite command\n\n")
+	fmt.Printf("Usage: p2p join [-key KEY] [-ip IP] CODE | -png FILE:\n")
+}
+
+func UsageEphemeral() {
+	fmt.Printf("ephemeral command creates a short-lived network for a CI job or a test: it generates random \n" +
+		"hash and key, starts an instance and prints them with invitation code as shell variables, so \n" +
+		"they can be evaluated and passed to other members. Ephemeral networks are not saved across \n" +
+		"daemon restarts and are destroyed when their lifetime passes. 'destroy' action stops ephemeral \n" +
+		"network and refuses to stop any other one\n\n")
+	fmt.Printf("Usage: eval $(p2p ephemeral create [-ip IP] [-dht HOST:PORT] [-lifetime DURATION])\n" +
+		"       p2p ephemeral destroy -hash HASH:\n")
+}
+
+func UsageTraversal() {
+	fmt.Printf("traversal command shows how often every NAT traversal strategy succeeds for each combination \n" +
+		"of NAT types, how long it takes and why the latest attempts had to fall back to the next strategy\n\n")
+	fmt.Printf("Usage: p2p traversal [-hash HASH]:\n")
+}
+
+func UsageHistory() {
+	fmt.Printf("history command shows average throughput, availability and round trip time of every peer \n" +
+		"of an instance over the last day or week. Counters are recorded only when history_interval is \n" +
+		"set in config. Availability is the share of samples in which peer was connected\n\n")
+	fmt.Printf("Usage: p2p history -hash HASH [-period day|week]:\n")
+}
+
+func UsagePolicy() {
+	fmt.Printf("policy command prints reference AppArmor profile or SELinux module for the daemon. Policy \n" +
+		"allows only the configuration, state and runtime directories, TUN device and tools the daemon \n" +
+		"uses. Daemon should be started with -hardened option under this policy, so it fails early \n" +
+		"instead of being denied by the kernel in the middle of work\n\n")
+	fmt.Printf("Usage: p2p policy [-format apparmor|selinux]:\n")
+}
+
+func UsageConsole() {
+	fmt.Printf("console command runs interactive shell that keeps connection to the daemon open. TAB \n" +
+		"completes commands, hashes of instances and IDs and IPs of peers. Peers joining, leaving and \n" +
+		"switching to relay are printed as they happen. Type 'help' in console for list of commands\n\n")
+	fmt.Printf("Usage: p2p console:\n")
+}
+
+func UsageCompletion() {
+	fmt.Printf("completion command prints completion script for bash, zsh or fish. Script completes \n" +
+		"commands and options, and -hash and -peer with instances and peers of the running daemon\n\n")
+	fmt.Printf("Usage: source <(p2p completion bash)\n" +
+		"       source <(p2p completion zsh)\n" +
+		"       p2p completion fish | source\n")
+}
@@ -7,12 +7,52 @@ import (
 	"fmt"
 	ptp "github.com/subutai-io/p2p/lib"
 	"os"
+	"reflect"
 	"runtime"
+	"runtime/debug"
+	"strings"
 	"time"
 )
 
 var InstanceLock bool = false
 
+const (
+	RESTART_BACKOFF_MIN   time.Duration = 5 * time.Second
+	RESTART_BACKOFF_MAX   time.Duration = 5 * time.Minute
+	MAX_RESTARTS_PER_HOUR int           = 5
+)
+
+// Exit code of drain command while traffic hasn't ceased yet
+const EXIT_DRAINING int = 2
+
+// Exit codes of commands that failed because of a known library error
+const (
+	EXIT_ROUTER_UNREACHABLE int = 3
+	EXIT_HANDSHAKE_TIMEOUT  int = 4
+	EXIT_MALFORMED_MESSAGE  int = 5
+	EXIT_NO_RELAY           int = 6
+)
+
+// ExitCode maps error returned by the library to exit code of a command
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ptp.ErrRouterUnreachable):
+		return EXIT_ROUTER_UNREACHABLE
+	case errors.Is(err, ptp.ErrHandshakeTimeout):
+		return EXIT_HANDSHAKE_TIMEOUT
+	case errors.Is(err, ptp.ErrMalformedMessage):
+		return EXIT_MALFORMED_MESSAGE
+	case errors.Is(err, ptp.ErrNoRelayAvailable):
+		return EXIT_NO_RELAY
+	}
+	return 1
+}
+
+// Number of latest failed traversal attempts shown by traversal command
+const TRAVERSAL_FAILURES_SHOWN int = 10
+
 func WaitLock() {
 	for InstanceLock {
 		time.Sleep(100 * time.Microsecond)
@@ -28,22 +68,84 @@ func Unlock() {
 }
 
 type RunArgs struct {
-	IP      string
-	Mac     string
-	Dev     string
-	Hash    string
-	Dht     string
-	Keyfile string
-	Key     string
-	TTL     string
-	Fwd     bool
-	Port    int
+	IP       string
+	Mac      string
+	Dev      string
+	Hash     string
+	Dht      string
+	Keyfile  string
+	Key      string
+	TTL      string
+	Fwd      bool
+	Port     int
+	Bind     string
+	Ports    string
+	Schedule string
+	DSCP     string
+	Tags     string
+	Hubs     string
+	Relayed  string // Peers reached through forwarders only
+	NoRelay  string // Peers never reached through forwarders
+	Dual     string // Peers data is sent to over direct path and relay at once
+	Private  bool   // Local addresses are not advertised
+	Observer bool   // Unicast data is never sent or forwarded
+	DNS      string // Split-DNS rules pushed to other members
+	PeerDNS  bool   // Split-DNS rules of DNS provider are installed
+	Resolver string // Upstreams of stub resolver on the virtual interface
+	Services string // Services announced to other members
+	Ether    string // Policy for frames of ethertypes other than IP and ARP
+	Admin    string // Key that signs membership manifest
+	// Ephemeral networks are not saved and are stopped when they expire
+	Ephemeral bool
+	Expires   time.Time
+	// IP to MAC mapping learned from peers. Seeds the table on restore
+	Neighbor []ptp.Neighbor
 }
 
 type Instance struct {
-	PTP  *ptp.PTPCloud
-	ID   string
-	Args RunArgs
+	PTP       *ptp.PTPCloud
+	ID        string
+	Args      RunArgs
+	Schedule  *ptp.Schedule    // Time windows during which instance is up
+	Crashes   []time.Time      // Crashes happened during the last hour
+	LastCrash *ptp.CrashReport // Report of the last crash
+	RestartAt time.Time        // When crashed instance will be restarted
+	Failed    bool             // Instance crashed too often and won't be restarted
+}
+
+// Options converts arguments of start command into options of the instance
+func (args *RunArgs) Options() ptp.Options {
+	return ptp.Options{
+		IP:      args.IP,
+		Mac:     args.Mac,
+		Dev:     args.Dev,
+		Hash:    args.Hash,
+		Routers: args.Dht,
+		Keyfile: args.Keyfile,
+		Key:     args.Key,
+		TTL:     args.TTL,
+		Forward: args.Fwd,
+		Port:    args.Port,
+		Bind:    args.Bind,
+		Ports:   args.Ports,
+		DSCP:    args.DSCP,
+		Tags:    args.Tags,
+		Hubs:    args.Hubs,
+
+		RelayOnly: args.Relayed,
+		NoRelay:   args.NoRelay,
+		Redundant: args.Dual,
+		Private:   args.Private,
+		Observer:  args.Observer,
+		SplitDNS:  args.DNS,
+		AcceptDNS: args.PeerDNS,
+		Resolver:  args.Resolver,
+		Services:  args.Services,
+		Neighbors: args.Neighbor,
+		Admin:     args.Admin,
+
+		EtherTypes: args.Ether,
+	}
 }
 
 var (
@@ -55,7 +157,19 @@ func EncodeInstances() ([]byte, error) {
 	var savedInstances []RunArgs
 
 	for _, inst := range Instances {
-		savedInstances = append(savedInstances, inst.Args)
+		args := inst.Args
+		if args.Ephemeral {
+			continue
+		}
+		if inst.PTP != nil && inst.PTP.Stopped != nil && inst.PTP.Stopped.Final() {
+			// Router won't let it back after restart either
+			continue
+		}
+		if args.Ports != "" && inst.PTP != nil && inst.PTP.UDPSocket != nil {
+			// Port may be reselected within range. Save the one in use
+			args.Port = inst.PTP.UDPSocket.GetPort()
+		}
+		savedInstances = append(savedInstances, args)
 	}
 	b := bytes.Buffer{}
 	e := gob.NewEncoder(&b)
@@ -117,6 +231,178 @@ func LoadInstances(filename string) ([]RunArgs, error) {
 	return loadedInstances, nil
 }
 
+// PadKey truncates or pads provided key with zeros to the size of AES block
+func PadKey(k string) string {
+	key := []byte(k)
+	if len(key) > ptp.BLOCK_SIZE {
+		key = key[:ptp.BLOCK_SIZE]
+	} else {
+		zeros := make([]byte, ptp.BLOCK_SIZE-len(key))
+		key = append([]byte(key), zeros...)
+	}
+	return string(key)
+}
+
+// SyncInstances updates list of instances after network hash of any
+// instance was rotated
+func SyncInstances() {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	changed := false
+	for hash, inst := range Instances {
+		if inst.PTP == nil || inst.PTP.Dht == nil || inst.PTP.Dht.NetworkHash == hash {
+			continue
+		}
+		newHash := inst.PTP.Dht.NetworkHash
+		ptp.Log(ptp.INFO, "Instance %s was moved to %s", hash, newHash)
+		inst.ID = newHash
+		inst.Args.Hash = newHash
+		if crypter := inst.PTP.CurrentCrypter(); crypter.Active {
+			inst.Args.Key = string(crypter.ActiveKey.Key)
+		}
+		delete(Instances, hash)
+		Instances[newHash] = inst
+		changed = true
+	}
+	if changed && SaveFile != "" {
+		SaveInstances(SaveFile)
+	}
+}
+
+// SaveNeighbors saves instances when IP to MAC mapping learned by any of
+// them has changed, so restored instances answer ARP right away
+func SaveNeighbors() {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	changed := false
+	for hash, inst := range Instances {
+		if inst.PTP == nil {
+			continue
+		}
+		neighbors := inst.PTP.Neighbors()
+		if reflect.DeepEqual(neighbors, inst.Args.Neighbor) {
+			continue
+		}
+		inst.Args.Neighbor = neighbors
+		Instances[hash] = inst
+		changed = true
+	}
+	if changed && SaveFile != "" {
+		SaveInstances(SaveFile)
+	}
+}
+
+// StartInstance creates P2P instance from saved arguments
+func StartInstance(inst *Instance) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ptp.Log(ptp.ERROR, "Instance %s crashed during startup: %v\n%s", inst.ID, r, debug.Stack())
+			err = errors.New(fmt.Sprintf("Instance crashed during startup: %v", r))
+		}
+	}()
+	args := inst.Args
+	ptpInstance, err := ptp.New(args.Options())
+	if err != nil {
+		return err
+	}
+	inst.PTP = ptpInstance
+	ptpInstance.Go(ptpInstance.Run)
+	return nil
+}
+
+// RestartBackoff returns delay before restart after specified number of crashes
+func RestartBackoff(crashes int) time.Duration {
+	backoff := RESTART_BACKOFF_MIN
+	for i := 1; i < crashes && backoff < RESTART_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+	if backoff > RESTART_BACKOFF_MAX {
+		backoff = RESTART_BACKOFF_MAX
+	}
+	return backoff
+}
+
+// RestartCrashed tears down instances that crashed and starts them
+// again with exponential backoff
+func RestartCrashed() {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	now := time.Now()
+	for hash, inst := range Instances {
+		if inst.PTP != nil {
+			report := inst.PTP.Crashed()
+			if report == nil {
+				continue
+			}
+			ptp.Log(ptp.ERROR, "Instance %s crashed at %s: %s", hash, report.Time.Format(time.RFC1123), report.Error)
+			inst.PTP.Teardown()
+			inst.PTP = nil
+			inst.LastCrash = report
+			var recent []time.Time
+			for _, t := range inst.Crashes {
+				if now.Sub(t) < time.Hour {
+					recent = append(recent, t)
+				}
+			}
+			inst.Crashes = append(recent, now)
+			if len(inst.Crashes) > MAX_RESTARTS_PER_HOUR {
+				ptp.Log(ptp.ERROR, "Instance %s crashed %d times during the last hour. Giving up", hash, len(inst.Crashes))
+				inst.Failed = true
+			} else {
+				inst.RestartAt = now.Add(RestartBackoff(len(inst.Crashes)))
+				ptp.Log(ptp.INFO, "Instance %s will be restarted at %s", hash, inst.RestartAt.Format(time.RFC1123))
+			}
+			Instances[hash] = inst
+			continue
+		}
+		if inst.Failed || inst.RestartAt.IsZero() || now.Before(inst.RestartAt) {
+			continue
+		}
+		inst.RestartAt = time.Time{}
+		if inst.Schedule != nil && !inst.Schedule.Active(now) {
+			// Schedule will bring it up later
+			Instances[hash] = inst
+			continue
+		}
+		ptp.Log(ptp.INFO, "Restarting instance %s", hash)
+		if err := StartInstance(&inst); err != nil {
+			ptp.Log(ptp.ERROR, "Failed to restart instance %s: %v", hash, err)
+			inst.RestartAt = now.Add(RestartBackoff(len(inst.Crashes) + 1))
+		}
+		Instances[hash] = inst
+	}
+}
+
+// ApplySchedules brings instances up and down according to their schedules
+func ApplySchedules() {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	now := time.Now()
+	for hash, inst := range Instances {
+		if inst.Schedule == nil || inst.Failed || !inst.RestartAt.IsZero() {
+			continue
+		}
+		active := inst.Schedule.Active(now)
+		if active && inst.PTP == nil {
+			ptp.Log(ptp.INFO, "Starting instance %s according to schedule", hash)
+			if err := StartInstance(&inst); err != nil {
+				ptp.Log(ptp.ERROR, "Failed to start instance %s: %v", hash, err)
+				continue
+			}
+			Instances[hash] = inst
+		} else if !active && inst.PTP != nil {
+			ptp.Log(ptp.INFO, "Stopping instance %s according to schedule", hash)
+			inst.PTP.StopInstance()
+			inst.PTP = nil
+			Instances[hash] = inst
+		}
+	}
+}
+
 type Args struct {
 	Command string
 	Args    string
@@ -131,6 +417,15 @@ type StopArgs struct {
 	Hash string
 }
 
+type RekeyArgs struct {
+	Hash      string
+	NewHash   string
+	Key       string
+	At        int64  // Unix time of rotation
+	Authority string // Public key that approved rotation
+	Approval  []byte // Signature of the authority
+}
+
 type Response struct {
 	ExitCode int
 	Output   string
@@ -178,16 +473,19 @@ func (p *Procedures) AddKey(args *RunArgs, resp *Response) error {
 		resp.ExitCode = 1
 		resp.Output = "You have not specified key"
 	}
-	_, exists := Instances[args.Hash]
+	inst, exists := Instances[args.Hash]
 	if !exists {
 		resp.ExitCode = 1
 		resp.Output = "No instances with specified hash were found"
+	} else if inst.PTP == nil {
+		resp.ExitCode = 1
+		resp.Output = "Instance is out of schedule"
 	}
 	if resp.ExitCode == 0 {
 		resp.Output = "New key added"
 		var newKey ptp.CryptoKey
-		newKey = Instances[args.Hash].PTP.Crypter.EnrichKeyValues(newKey, args.Key, args.TTL)
-		Instances[args.Hash].PTP.Crypter.Keys = append(Instances[args.Hash].PTP.Crypter.Keys, newKey)
+		newKey = Instances[args.Hash].PTP.CurrentCrypter().EnrichKeyValues(newKey, args.Key, args.TTL)
+		Instances[args.Hash].PTP.AddKey(newKey, false)
 	}
 	Unlock()
 	return nil
@@ -209,7 +507,7 @@ func (p *Procedures) Run(args *RunArgs, resp *Response) error {
 	// Validate if interface name is unique
 	if args.Dev != "" {
 		for _, inst := range Instances {
-			if inst.PTP.DeviceName == args.Dev {
+			if inst.Args.Dev == args.Dev || (inst.PTP != nil && inst.PTP.DeviceName == args.Dev) {
 				resp.ExitCode = 1
 				resp.Output = "Device name is already in use"
 				Unlock()
@@ -223,31 +521,33 @@ func (p *Procedures) Run(args *RunArgs, resp *Response) error {
 	if !exists {
 		resp.Output = resp.Output + "Lookup finished\n"
 		if args.Key != "" {
-			key := []byte(args.Key)
-			if len(key) > ptp.BLOCK_SIZE {
-				key = key[:ptp.BLOCK_SIZE]
-			} else {
-				zeros := make([]byte, ptp.BLOCK_SIZE-len(key))
-				key = append([]byte(key), zeros...)
-			}
-			args.Key = string(key)
+			args.Key = PadKey(args.Key)
 		}
 
 		var newInst Instance
 		newInst.ID = args.Hash
 		newInst.Args = *args
+		if args.Schedule != "" {
+			schedule, err := ptp.ParseSchedule(args.Schedule)
+			if err != nil {
+				resp.Output = resp.Output + "Bad schedule: " + err.Error()
+				resp.ExitCode = 1
+				return err
+			}
+			newInst.Schedule = schedule
+		}
 		Instances[args.Hash] = newInst
-		ptpInstance := ptp.StartP2PInstance(args.IP, args.Mac, args.Dev, "", args.Hash, args.Dht, args.Keyfile, args.Key, args.TTL, "", args.Fwd, args.Port)
-		if ptpInstance == nil {
+		if newInst.Schedule != nil && !newInst.Schedule.Active(time.Now()) {
+			resp.Output = resp.Output + "Instance is out of schedule and will be started at " + newInst.Schedule.NextChange(time.Now()).Format(time.RFC1123) + "\n"
+		} else if err := StartInstance(&newInst); err != nil {
 			delete(Instances, args.Hash)
-			resp.Output = resp.Output + "Failed to create P2P Instance"
-			resp.ExitCode = 1
+			resp.Output = resp.Output + "Failed to create P2P Instance: " + err.Error()
+			resp.ExitCode = ExitCode(err)
 			Unlock()
-			return errors.New("Failed to create P2P Instance")
+			// Error is reported in response, so client receives exit code
+			return nil
 		}
-		newInst.PTP = ptpInstance
 		Instances[args.Hash] = newInst
-		go ptpInstance.Run()
 		if SaveFile != "" {
 			resp.Output = resp.Output + "Saving instance into file"
 			SaveInstances(SaveFile)
@@ -271,7 +571,9 @@ func (p *Procedures) Stop(args *StopArgs, resp *Response) error {
 		resp.Output = "Instance with hash " + args.Hash + " was not found"
 	} else {
 		resp.Output = "Shutting down " + args.Hash
-		Instances[args.Hash].PTP.StopInstance()
+		if Instances[args.Hash].PTP != nil {
+			Instances[args.Hash].PTP.StopInstance()
+		}
 		delete(Instances, args.Hash)
 		SaveInstances(SaveFile)
 	}
@@ -279,11 +581,251 @@ func (p *Procedures) Stop(args *StopArgs, resp *Response) error {
 	return nil
 }
 
+func (p *Procedures) Rekey(args *RekeyArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if inst.PTP == nil {
+		resp.Output = "Instance " + args.Hash + " is out of schedule"
+		return nil
+	}
+	if args.NewHash == "" || args.Key == "" {
+		resp.Output = "New hash and key should be specified"
+		return nil
+	}
+	_, exists = Instances[args.NewHash]
+	if exists {
+		resp.Output = "Hash " + args.NewHash + " is already in use"
+		return nil
+	}
+	at := time.Unix(args.At, 0)
+	err := inst.PTP.Rekey(args.NewHash, []byte(PadKey(args.Key)), at, args.Authority, args.Approval)
+	if err != nil {
+		resp.Output = "Failed to rotate network: " + err.Error()
+		return nil
+	}
+	resp.ExitCode = 0
+	resp.Output = fmt.Sprintf("Network %s will be rotated to %s at %s", args.Hash, args.NewHash, at.Format(time.RFC1123))
+	return nil
+}
+
+// SwapKey loads key file for a running instance without restarting it
+func (p *Procedures) SwapKey(args *RunArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if inst.PTP == nil {
+		resp.Output = "Instance " + args.Hash + " is out of schedule"
+		return nil
+	}
+	key, err := inst.PTP.CurrentCrypter().LoadKeyFile(args.Keyfile)
+	if err != nil {
+		resp.Output = "Failed to load key file: " + err.Error()
+		return nil
+	}
+	err = inst.PTP.SwapKey(key)
+	if err != nil {
+		resp.Output = "Failed to replace key: " + err.Error()
+		return nil
+	}
+	// Instance should come back with the new key after restart
+	inst.Args.Keyfile = args.Keyfile
+	inst.Args.Key = ""
+	inst.Args.TTL = ""
+	Instances[args.Hash] = inst
+	if SaveFile != "" {
+		SaveInstances(SaveFile)
+	}
+	resp.ExitCode = 0
+	resp.Output = "Key was replaced. Peers will handshake with the new key"
+	return nil
+}
+
+type IdentityArgs struct {
+	Hash   string
+	Rotate bool
+}
+
+// Identity shows identity of an instance or replaces it with a new one
+func (p *Procedures) Identity(args *IdentityArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if inst.PTP == nil {
+		resp.Output = "Instance " + args.Hash + " is out of schedule"
+		return nil
+	}
+	identity := inst.PTP.Identity
+	if args.Rotate {
+		var err error
+		old := identity.ID
+		identity, err = inst.PTP.RotateIdentity()
+		if err != nil {
+			resp.Output = "Failed to rotate identity: " + err.Error()
+			return nil
+		}
+		resp.Output = "Identity " + old + " was replaced. "
+	}
+	resp.ExitCode = 0
+	resp.Output += "ID: " + identity.ID + "\nPublic key: " + identity.PublicKeyString() + "\nFile: " + inst.PTP.IdentityFile
+	return nil
+}
+
+type ServiceArgs struct {
+	Hash   string
+	Action string // list, announce or withdraw
+	Name   string
+	Port   int
+	Proto  string
+}
+
+type FilterArgs struct {
+	Hash   string
+	Action string // list, set or clear
+	Peer   string
+	Allow  string
+}
+
+// Filter lists filters of peers with their counters, limits traffic of a
+// peer to specified protocols and ports or removes its filter
+func (p *Procedures) Filter(args *FilterArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if inst.PTP == nil {
+		resp.Output = "Instance " + args.Hash + " is out of schedule"
+		return nil
+	}
+	switch args.Action {
+	case "set":
+		if err := inst.PTP.SetFilter(args.Peer, args.Allow); err != nil {
+			resp.Output = "Failed to set filter: " + err.Error()
+			return nil
+		}
+		resp.Output = "Traffic of " + args.Peer + " is limited to " + args.Allow
+	case "clear":
+		if !inst.PTP.ClearFilter(args.Peer) {
+			resp.Output = "Peer " + args.Peer + " has no filter"
+			return nil
+		}
+		resp.Output = "Filter of " + args.Peer + " is removed"
+	default:
+		for _, f := range inst.PTP.PeerFilters() {
+			resp.Output += f.String() + "\n"
+		}
+		resp.Output = strings.TrimSuffix(resp.Output, "\n")
+		if resp.Output == "" {
+			resp.Output = "No filters"
+		}
+	}
+	resp.ExitCode = 0
+	return nil
+}
+
+// Service lists services announced within the network of an instance,
+// announces a new service of the instance or withdraws one
+func (p *Procedures) Service(args *ServiceArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if inst.PTP == nil {
+		resp.Output = "Instance " + args.Hash + " is out of schedule"
+		return nil
+	}
+	switch args.Action {
+	case "announce":
+		s, err := ptp.ParseService(fmt.Sprintf("%s:%d/%s", args.Name, args.Port, args.Proto))
+		if err != nil {
+			resp.Output = "Failed to announce service: " + err.Error()
+			return nil
+		}
+		inst.PTP.AnnounceService(s)
+		resp.Output = "Service " + s.String() + " is announced"
+	case "withdraw":
+		if !inst.PTP.WithdrawService(args.Name) {
+			resp.Output = "Service " + args.Name + " is not announced by this instance"
+			return nil
+		}
+		resp.Output = "Service " + args.Name + " is withdrawn"
+	default:
+		for _, s := range inst.PTP.FindServices(args.Name) {
+			peer := s.Peer
+			if peer == "" {
+				peer = "local"
+			}
+			resp.Output += fmt.Sprintf("%s\t%s\t%s\t%s\n", s.Name, s.Proto, ptp.JoinEndpoint(s.IP, s.Port), peer)
+		}
+		resp.Output = strings.TrimSuffix(resp.Output, "\n")
+		if resp.Output == "" {
+			resp.Output = "No services were found"
+		}
+	}
+	resp.ExitCode = 0
+	return nil
+}
+
+func (p *Procedures) Drain(args *RunArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if inst.PTP == nil {
+		resp.Output = "Instance " + args.Hash + " is out of schedule"
+		return nil
+	}
+	inst.PTP.Drain()
+	resp.Output = inst.PTP.DrainReport()
+	if inst.PTP.Drained() {
+		resp.ExitCode = 0
+	} else {
+		resp.ExitCode = EXIT_DRAINING
+	}
+	return nil
+}
+
 func (p *Procedures) Show(args *RunArgs, resp *Response) error {
 	if args.Hash != "" {
 		swarm, exists := Instances[args.Hash]
 		resp.ExitCode = 0
-		if exists {
+		if exists && swarm.PTP == nil {
+			resp.Output = "Instance is out of schedule: " + args.Hash
+			resp.ExitCode = 1
+		} else if exists {
 			if args.IP != "" {
 				swarm.PTP.PeersLock.Lock()
 				for _, peer := range swarm.PTP.NetworkPeers {
@@ -340,6 +882,9 @@ func (p *Procedures) Debug(args *Args, resp *Response) error {
 	resp.Output += fmt.Sprintf("Number of gouroutines: %d\n", runtime.NumGoroutine())
 	resp.Output += fmt.Sprintf("Instances information:\n")
 	for _, ins := range Instances {
+		if ins.PTP == nil {
+			continue
+		}
 		resp.Output += fmt.Sprintf("Hash: %s\n", ins.ID)
 		resp.Output += fmt.Sprintf("ID: %s\n", ins.PTP.Dht.ID)
 		resp.Output += fmt.Sprintf("Interface %s, HW Addr: %s, IP: %s\n", ins.PTP.DeviceName, ins.PTP.Mac, ins.PTP.IP)
@@ -365,11 +910,140 @@ func (p *Procedures) Debug(args *Args, resp *Response) error {
 
 func (p *Procedures) Status(args *RunArgs, resp *Response) error {
 	for _, ins := range Instances {
-		resp.Output += ins.ID + " | " + ins.PTP.IP + "\n"
-		for _, peer := range ins.PTP.NetworkPeers {
+		if ins.Schedule != nil {
+			state := "Down"
+			if ins.PTP != nil {
+				state = "Up"
+			}
+			resp.Output += ins.ID + " | Schedule: " + ins.Schedule.String() + " | " + state
+			resp.Output += " until " + ins.Schedule.NextChange(time.Now()).Format(time.RFC1123) + "\n"
+		}
+		if ins.LastCrash != nil {
+			resp.Output += ins.ID + " | Crashed at " + ins.LastCrash.Time.Format(time.RFC1123) + ": " + ins.LastCrash.Error
+			if ins.Failed {
+				resp.Output += " | Crashed too often. Restart it manually\n"
+			} else if !ins.RestartAt.IsZero() {
+				resp.Output += " | Restarting at " + ins.RestartAt.Format(time.RFC1123) + "\n"
+			} else {
+				resp.Output += "\n"
+			}
+		}
+		if ins.PTP == nil {
+			continue
+		}
+		resp.Output += ins.ID + " | " + ins.PTP.IP
+		if ins.PTP.NoNetwork {
+			resp.Output += " | Waiting for network"
+		} else if ins.PTP.Offline {
+			resp.Output += " | Offline: DHT is unreachable"
+		}
+		if ins.PTP.Draining {
+			resp.Output += " | " + ins.PTP.DrainReport()
+		}
+		if ins.PTP.Stopped != nil {
+			resp.Output += " | " + ins.PTP.Stopped.String()
+		}
+		if ins.PTP.Fenced {
+			resp.Output += " | Stopped in favor of duplicate: " + ins.PTP.Conflict
+		} else if ins.PTP.Conflict != "" {
+			resp.Output += " | Duplicate: " + ins.PTP.Conflict
+		}
+		if ins.PTP.Private {
+			resp.Output += " | Privacy mode"
+		}
+		if ins.PTP.Community != nil && ins.PTP.Community.Active {
+			resp.Output += " | " + ins.PTP.Community.String()
+		}
+		if ins.PTP.Observer != nil {
+			resp.Output += " | " + ins.PTP.Observer.String()
+		}
+		if ins.PTP.Resolver != nil {
+			resp.Output += " | " + ins.PTP.Resolver.String()
+		}
+		if len(ins.PTP.SplitDNS) > 0 {
+			resp.Output += " | DNS provider: " + ptp.FormatDNSRules(ins.PTP.SplitDNS)
+		}
+		if len(ins.PTP.DNSInstalled) > 0 {
+			resp.Output += " | DNS from " + ins.PTP.DNSProvider + ": " + ptp.FormatDNSRules(ins.PTP.DNSInstalled)
+		}
+		if len(ins.PTP.Hubs) > 0 {
+			resp.Output += " | Spoke of " + strings.Join(ins.PTP.Hubs, ",")
+		}
+		if ins.PTP.Resources != nil {
+			resp.Output += " | " + ins.PTP.Resources.String()
+			if ins.PTP.Resources.Quota != nil {
+				resp.Output += " | " + ins.PTP.Resources.Quota.String()
+			}
+		}
+		if ins.PTP.Mirror != nil {
+			resp.Output += " | " + ins.PTP.Mirror.String()
+		}
+		if ins.PTP.Writer != nil {
+			resp.Output += " | " + ins.PTP.Writer.String()
+		}
+		if ins.PTP.Sandbox != nil {
+			resp.Output += " | " + ins.PTP.Sandbox.String()
+		}
+		if ins.PTP.AdminKey != "" {
+			if m := ins.PTP.CurrentManifest(); m != nil {
+				resp.Output += " | " + m.String()
+			} else {
+				resp.Output += " | Waiting for membership manifest"
+			}
+		}
+		if summary := ins.PTP.FeatureSummary(); summary != "" {
+			resp.Output += " | Features: " + summary
+		}
+		if counts := ins.PTP.EtherStats.Summary(); len(counts) > 0 {
+			var list []string
+			for _, c := range counts {
+				list = append(list, c.String())
+			}
+			resp.Output += " | Ethertypes (" + ins.PTP.EtherPolicy.String() + "): " + strings.Join(list, ", ")
+		}
+		stats := ins.PTP.Stats()
+		if stats.ClockSkew != 0 {
+			resp.Output += " | Clock skew: " + stats.ClockSkew.String()
+		}
+		resp.Output += "\n"
+		for _, router := range stats.Routers {
+			resp.Output += fmt.Sprintf("Router:%s|Sent:%d|Received:%d|Errors:%d|LastPing:%s ago\n",
+				router.Address, router.Sent, router.Received, router.Errors, time.Since(router.LastPing).Truncate(time.Second))
+		}
+		for _, q := range stats.Queues {
+			resp.Output += fmt.Sprintf("Queue:%s|Depth:%d/%d|Peak:%d|Delivered:%d|Dropped:%d\n",
+				q.Name, q.Depth, q.Capacity, q.Peak, q.Delivered, q.Dropped)
+		}
+		for _, peer := range stats.PeerStats {
 			resp.Output += peer.ID + "|"
-			resp.Output += peer.PeerLocalIP.String() + "|"
+			resp.Output += peer.IP + "|"
 			resp.Output += "State:" + StringifyState(peer.State) + "|"
+			if peer.State == ptp.P_CONNECTED {
+				resp.Output += "LastReceived:" + sinceString(peer.LastReceived) + "|"
+				resp.Output += "LastActivity:" + sinceString(peer.LastActivity) + "|"
+				resp.Output += "Traffic:" + ptp.FormatBytes(int64(peer.BytesSent)) + "/" + ptp.FormatBytes(int64(peer.BytesRecv)) + "|"
+			}
+			if l := peer.Latency; l.Samples > 0 {
+				resp.Output += fmt.Sprintf("Latency:%s/%s/%s|Jitter:%s|", roundLatency(l.P50), roundLatency(l.P95), roundLatency(l.P99), roundLatency(l.Jitter))
+			}
+			if peer.Pacing != "" {
+				resp.Output += peer.Pacing + "|"
+			}
+			if time.Now().Before(peer.RetryAt) {
+				resp.Output += "Retry:in " + time.Until(peer.RetryAt).Truncate(time.Second).String() + "|"
+			}
+			if peer.PathMTU > 0 {
+				resp.Output += fmt.Sprintf("PathMTU:%d|", peer.PathMTU)
+			}
+			if peer.Policy != ptp.PATH_AUTO {
+				resp.Output += "Path:" + peer.Policy.String() + "|"
+			}
+			if peer.Loss > 0 {
+				resp.Output += fmt.Sprintf("Loss:%.1f%%|", peer.Loss*100)
+			}
+			if len(peer.Tags) > 0 {
+				resp.Output += "Tags:" + strings.Join(peer.Tags, ",") + "|"
+			}
 			if peer.LastError != "" {
 				resp.Output += "LastError:" + peer.LastError
 			}
@@ -379,6 +1053,111 @@ func (p *Procedures) Status(args *RunArgs, resp *Response) error {
 	return nil
 }
 
+// roundLatency shortens round trip time for output
+func roundLatency(d time.Duration) string {
+	return d.Round(time.Millisecond / 10).String()
+}
+
+// sinceString describes how long ago something has happened
+func sinceString(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
+
+func (p *Procedures) Neighbors(args *RunArgs, resp *Response) error {
+	inst, exists := Instances[args.Hash]
+	if !exists || inst.PTP == nil {
+		resp.ExitCode = 1
+		resp.Output = "Specified environment was not found: " + args.Hash
+		return nil
+	}
+	resp.Output = "< IP >\t< MAC >\t< Peer ID >\n"
+	for _, n := range inst.PTP.Neighbors() {
+		resp.Output += n.IP + "\t" + n.Mac + "\t" + n.ID + "\n"
+	}
+	return nil
+}
+
+func (p *Procedures) Traversal(args *RunArgs, resp *Response) error {
+	if args.Hash != "" {
+		if _, exists := Instances[args.Hash]; !exists {
+			resp.ExitCode = 1
+			resp.Output = "Specified environment was not found: " + args.Hash
+			return nil
+		}
+	}
+	for _, ins := range Instances {
+		if ins.PTP == nil || (args.Hash != "" && ins.ID != args.Hash) {
+			continue
+		}
+		resp.Output += ins.ID + "\n"
+		for _, s := range ins.PTP.Traversal.Summary() {
+			resp.Output += fmt.Sprintf("Strategy:%s|NAT:%s/%s|Attempts:%d|Success:%.0f%%|AverageTime:%s\n",
+				s.Strategy, s.LocalNAT, s.RemoteNAT, s.Attempts, s.SuccessRate(), s.AverageTime().Truncate(time.Millisecond))
+		}
+		history := ins.PTP.Traversal.History()
+		failures := 0
+		for i := len(history) - 1; i >= 0 && failures < TRAVERSAL_FAILURES_SHOWN; i-- {
+			a := history[i]
+			if a.Success {
+				continue
+			}
+			resp.Output += fmt.Sprintf("Failed:%s|%s|%s|%s\n", a.Time.Format(time.RFC1123), a.Peer, a.Strategy, a.Reason)
+			failures++
+		}
+	}
+	if resp.Output == "" {
+		resp.Output = "No statistics were collected yet"
+	}
+	return nil
+}
+
+type HistoryArgs struct {
+	Hash   string
+	Period string // day or week
+}
+
+// Periods that history command summarizes
+var HistoryPeriods = map[string]time.Duration{
+	"day":  time.Hour * 24,
+	"week": time.Hour * 24 * 7,
+}
+
+// History summarizes throughput and availability of peers recorded over
+// the last day or week. History is read from the file, so it's shown for
+// instances that are stopped or out of schedule too
+func (p *Procedures) History(args *HistoryArgs, resp *Response) error {
+	resp.ExitCode = 1
+	period, exists := HistoryPeriods[args.Period]
+	if !exists {
+		resp.Output = "Unknown period " + args.Period + ". Use day or week"
+		return nil
+	}
+	samples, err := ptp.ReadHistory(ptp.HistoryPath(args.Hash), time.Now().Add(-period))
+	if err != nil && !os.IsNotExist(err) {
+		resp.Output = "Failed to read history: " + err.Error()
+		return nil
+	}
+	if len(samples) == 0 {
+		resp.Output = "No history was recorded for " + args.Hash + ". Set history_interval in config to record it"
+		return nil
+	}
+	resp.Output = fmt.Sprintf("%s: %s to %s\n", args.Hash, samples[0].Time.Format(time.RFC1123), samples[len(samples)-1].Time.Format(time.RFC1123))
+	for _, s := range ptp.SummarizeHistory(samples) {
+		peer := s.Peer
+		if peer == ptp.HISTORY_TOTAL {
+			peer = "total"
+		}
+		resp.Output += fmt.Sprintf("Peer:%s|Availability:%.1f%%|Sent:%s/s|Received:%s/s|RTT:%s\n",
+			peer, s.Availability, ptp.FormatBytes(s.SendRate), ptp.FormatBytes(s.RecvRate), s.RTT.Truncate(time.Millisecond))
+	}
+	resp.Output = strings.TrimSuffix(resp.Output, "\n")
+	resp.ExitCode = 0
+	return nil
+}
+
 func StringifyState(state ptp.PeerState) string {
 	switch state {
 	case ptp.P_INIT:
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"strings"
+)
+
+// Fingerprint of the key is a salted scrypt hash, so key can't be guessed
+// from the code faster than by trying it against the network
+const (
+	INVITE_VERSION     byte   = 1
+	INVITE_PREFIX      string = "p2p-"
+	INVITE_SALT        int    = 8 // Bytes of salt that precede key hash in fingerprint
+	INVITE_FINGERPRINT int    = 8 // Bytes of key hash kept in the code
+	INVITE_CHECKSUM    int    = 4 // Bytes of code hash that catch typos
+	INVITE_SCRYPT_N    int    = 1 << 15
+	INVITE_SCRYPT_R    int    = 8
+	INVITE_SCRYPT_P    int    = 1
+)
+
+var inviteEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Invitation is what new member needs to join a network: hash, routers
+// that network uses and fingerprint of its key. Key itself is never
+// included and has to be passed to a new member separately
+type Invitation struct {
+	Hash        string
+	Routers     string
+	Fingerprint []byte // Salt and hash of the key. Empty if network isn't encrypted
+}
+
+type InviteArgs struct {
+	Hash string
+	Code string
+	Key  string
+	IP   string
+}
+
+// KeyFingerprint returns salt followed by short hash of a key the way
+// instance uses it. New salt is generated if salt is nil
+func KeyFingerprint(key, salt []byte) ([]byte, error) {
+	if salt == nil {
+		salt = make([]byte, INVITE_SALT)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+	}
+	sum, err := scrypt.Key(key, salt, INVITE_SCRYPT_N, INVITE_SCRYPT_R, INVITE_SCRYPT_P, INVITE_FINGERPRINT)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, salt...), sum...), nil
+}
+
+// NewInvitation creates invitation to the network of the instance
+func NewInvitation(inst Instance) (*Invitation, error) {
+	inv := &Invitation{Hash: inst.ID, Routers: inst.Args.Dht}
+	if inst.PTP != nil && inst.PTP.Dht != nil {
+		inv.Routers = inst.PTP.Dht.Routers
+	}
+	var key []byte
+	if inst.PTP != nil && inst.PTP.CurrentCrypter().Active {
+		key = inst.PTP.CurrentCrypter().ActiveKey.Key
+	} else if inst.Args.Key != "" {
+		key = []byte(PadKey(inst.Args.Key))
+	}
+	if key != nil {
+		fingerprint, err := KeyFingerprint(key, nil)
+		if err != nil {
+			return nil, err
+		}
+		inv.Fingerprint = fingerprint
+	}
+	return inv, nil
+}
+
+// Encode packs invitation into a code that can be typed or sent in a chat
+func (inv *Invitation) Encode() string {
+	var buf bytes.Buffer
+	buf.WriteByte(INVITE_VERSION)
+	size := make([]byte, binary.MaxVarintLen64)
+	for _, field := range []string{inv.Hash, inv.Routers, string(inv.Fingerprint)} {
+		buf.Write(size[:binary.PutUvarint(size, uint64(len(field)))])
+		buf.WriteString(field)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:INVITE_CHECKSUM])
+	return INVITE_PREFIX + strings.ToLower(inviteEncoding.EncodeToString(buf.Bytes()))
+}
+
+// ParseInvitation decodes invitation code
+func ParseInvitation(code string) (*Invitation, error) {
+	code = strings.TrimPrefix(strings.TrimSpace(code), INVITE_PREFIX)
+	data, err := inviteEncoding.DecodeString(strings.ToUpper(code))
+	if err != nil {
+		return nil, errors.New("Invitation code is malformed")
+	}
+	if len(data) < 1+INVITE_CHECKSUM {
+		return nil, errors.New("Invitation code is too short")
+	}
+	body := data[:len(data)-INVITE_CHECKSUM]
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:INVITE_CHECKSUM], data[len(body):]) {
+		return nil, errors.New("Invitation code is mistyped")
+	}
+	if body[0] != INVITE_VERSION {
+		return nil, errors.New(fmt.Sprintf("Unsupported invitation version: %d", body[0]))
+	}
+	var fields []string
+	for rest := body[1:]; len(rest) > 0; {
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < size {
+			return nil, errors.New("Invitation code is truncated")
+		}
+		fields = append(fields, string(rest[n:n+int(size)]))
+		rest = rest[n+int(size):]
+	}
+	if len(fields) != 3 || fields[0] == "" {
+		return nil, errors.New("Invitation code is malformed")
+	}
+	inv := &Invitation{Hash: fields[0], Routers: fields[1]}
+	if fields[2] != "" {
+		if len(fields[2]) != INVITE_SALT+INVITE_FINGERPRINT {
+			return nil, errors.New("Invitation code has malformed key fingerprint")
+		}
+		inv.Fingerprint = []byte(fields[2])
+	}
+	return inv, nil
+}
+
+// CheckKey verifies that key matches network the invitation was made for
+func (inv *Invitation) CheckKey(key string) error {
+	if len(inv.Fingerprint) == 0 {
+		if key != "" {
+			return errors.New("Network of the invitation isn't encrypted. Key is not needed")
+		}
+		return nil
+	}
+	if key == "" {
+		return errors.New("Network is encrypted. Specify its key with -key option")
+	}
+	fingerprint, err := KeyFingerprint([]byte(PadKey(key)), inv.Fingerprint[:INVITE_SALT])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(fingerprint, inv.Fingerprint) {
+		return errors.New("Key doesn't match the network of the invitation")
+	}
+	return nil
+}
+
+func (p *Procedures) Invite(args *InviteArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.ExitCode = 1
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	inv, err := NewInvitation(inst)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Failed to create invitation: " + err.Error()
+		return nil
+	}
+	resp.ExitCode = 0
+	resp.Output = inv.Encode()
+	return nil
+}
+
+func (p *Procedures) Join(args *InviteArgs, resp *Response) error {
+	inv, err := ParseInvitation(args.Code)
+	if err == nil {
+		err = inv.CheckKey(args.Key)
+	}
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Failed to join: " + err.Error()
+		return nil
+	}
+	runArgs := RunArgs{IP: args.IP, Hash: inv.Hash, Dht: inv.Routers, Key: args.Key}
+	if runArgs.IP == "" {
+		runArgs.IP = "dhcp"
+	}
+	return p.Run(&runArgs, resp)
+}
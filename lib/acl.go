@@ -0,0 +1,228 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ACLRule allows traffic from peers with one tag to peers with another tag.
+// Ports are destination ports of the connection: replies coming from these
+// ports are allowed in the opposite direction
+type ACLRule struct {
+	From  string `yaml:"from"`  // Tag of the initiating side or TAG_ANY
+	To    string `yaml:"to"`    // Tag of the accepting side or TAG_ANY
+	Proto string `yaml:"proto"` // tcp, udp, icmp or empty for any protocol
+	Ports string `yaml:"ports"` // Single port or range START-END. Empty for any port
+}
+
+// flow describes IPv4 packet for ACL checks
+type flow struct {
+	proto    int
+	src      int
+	dst      int
+	fragment bool // Not the first fragment, ports are unknown
+}
+
+var tagPattern = regexp.MustCompile("^[a-z0-9][a-z0-9._-]*$")
+
+// ParseTags splits comma-separated list of tags
+func ParseTags(tags string) ([]string, error) {
+	var result []string
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, errors.New(fmt.Sprintf("Bad tag %s: only letters, digits, dots, dashes and underscores are allowed", tag))
+		}
+		result = append(result, tag)
+	}
+	return result, nil
+}
+
+// HasTag returns true if tag is in the list. TAG_ANY matches any list
+func HasTag(tags []string, tag string) bool {
+	if tag == TAG_ANY {
+		return true
+	}
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseACLProto(proto string) (int, error) {
+	switch strings.ToLower(proto) {
+	case "", "any":
+		return 0, nil
+	case "icmp":
+		return IPPROTO_ICMP, nil
+	case "tcp":
+		return IPPROTO_TCP, nil
+	case "udp":
+		return IPPROTO_UDP, nil
+	}
+	return 0, errors.New(fmt.Sprintf("Unknown protocol %s", proto))
+}
+
+func parseACLPorts(ports string) (int, int, error) {
+	if ports == "" {
+		return 0, 0, nil
+	}
+	if strings.Contains(ports, "-") {
+		return ParsePortRange(ports)
+	}
+	port, err := strconv.Atoi(ports)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, 0, errors.New(fmt.Sprintf("Bad port %s", ports))
+	}
+	return port, port, nil
+}
+
+// Validate checks that rule can be applied
+func (r ACLRule) Validate() error {
+	if r.From == "" || r.To == "" {
+		return errors.New("Both from and to tags should be specified")
+	}
+	proto, err := parseACLProto(r.Proto)
+	if err != nil {
+		return err
+	}
+	if r.Ports != "" && proto != IPPROTO_TCP && proto != IPPROTO_UDP {
+		return errors.New("Ports can be specified only for tcp and udp")
+	}
+	_, _, err = parseACLPorts(r.Ports)
+	return err
+}
+
+// String returns rule in a form of FROM -> TO PROTO/PORTS
+func (r ACLRule) String() string {
+	s := r.From + " -> " + r.To
+	if r.Proto != "" {
+		s += " " + r.Proto
+		if r.Ports != "" {
+			s += "/" + r.Ports
+		}
+	}
+	return s
+}
+
+// allows checks packet sent by the host with src tags to the host with
+// dst tags. Replies from allowed ports are allowed too, as we don't
+// track connections
+func (r ACLRule) allows(src, dst []string, f flow) bool {
+	if r.Validate() != nil {
+		return false
+	}
+	proto, _ := parseACLProto(r.Proto)
+	if proto != 0 && proto != f.proto {
+		return false
+	}
+	min, max, _ := parseACLPorts(r.Ports)
+	if min == 0 || f.fragment {
+		return (HasTag(src, r.From) && HasTag(dst, r.To)) || (HasTag(src, r.To) && HasTag(dst, r.From))
+	}
+	if HasTag(src, r.From) && HasTag(dst, r.To) && f.dst >= min && f.dst <= max {
+		return true
+	}
+	return HasTag(src, r.To) && HasTag(dst, r.From) && f.src >= min && f.src <= max
+}
+
+// parseFlow extracts protocol and ports from ethernet frame. Returns false
+// if frame doesn't carry IPv4 packet
+func parseFlow(frame []byte) (flow, bool) {
+	var f flow
+	if len(frame) < 34 || binary.BigEndian.Uint16(frame[12:14]) != uint16(PT_IPV4) {
+		return f, false
+	}
+	ip := frame[14:]
+	hlen := int(ip[0]&0x0f) * 4
+	f.proto = int(ip[9])
+	f.fragment = binary.BigEndian.Uint16(ip[6:8])&0x1fff != 0
+	if f.fragment || (f.proto != IPPROTO_TCP && f.proto != IPPROTO_UDP) {
+		return f, true
+	}
+	if len(ip) < hlen+4 {
+		// Truncated header can't be matched against ports
+		f.src, f.dst = -1, -1
+		return f, true
+	}
+	f.src = int(binary.BigEndian.Uint16(ip[hlen : hlen+2]))
+	f.dst = int(binary.BigEndian.Uint16(ip[hlen+2 : hlen+4]))
+	return f, true
+}
+
+// PeerTags returns tags of the peer. Tags assigned in configuration by ID
+// or IP of the peer take precedence over the tags peer has advertised.
+// Peer may advertise any tags, so they are used only when authentication
+// hook has admitted the peer with them, or when TrustTags is set
+func (p *PTPCloud) PeerTags(peer *NetworkPeer) []string {
+	if peer == nil {
+		return nil
+	}
+	if tags, exists := p.ConfigTags[peer.ID]; exists {
+		return tags
+	}
+	if peer.PeerLocalIP != nil {
+		if tags, exists := p.ConfigTags[peer.PeerLocalIP.String()]; exists {
+			return tags
+		}
+	}
+	if !peer.TagsConfirmed && !p.TrustTags {
+		return nil
+	}
+	return peer.Tags
+}
+
+// Allowed checks frame exchanged with the peer against split-horizon mode,
+// filter of the peer and ACL. Everything is allowed when no rules are configured. Frames other
+// than IPv4, like ARP, pass ACL, so peers can find each other. Non-first
+// fragments are allowed, because first fragment was already checked
+func (p *PTPCloud) Allowed(peer *NetworkPeer, frame []byte, outbound bool) bool {
+	if !p.Reachable(peer) || !p.filtered(peer, frame, outbound) {
+		return false
+	}
+	if len(p.ACL) == 0 {
+		return true
+	}
+	f, ok := parseFlow(frame)
+	if !ok {
+		return true
+	}
+	src, dst := p.PeerTags(peer), p.Tags
+	if outbound {
+		src, dst = dst, src
+	}
+	for _, rule := range p.ACL {
+		if rule.allows(src, dst, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkACL reports rules that can't be applied. Such rules are kept and
+// never match, so a mistake doesn't open the network
+func (p *PTPCloud) checkACL() {
+	for _, rule := range p.ACL {
+		if err := rule.Validate(); err != nil {
+			Log(ERROR, "ACL rule %s will never match: %v", rule, err)
+		}
+	}
+	for key, tags := range p.ConfigTags {
+		parsed, err := ParseTags(strings.Join(tags, ","))
+		if err != nil {
+			Log(ERROR, "Ignoring tags of %s: %v", key, err)
+			delete(p.ConfigTags, key)
+			continue
+		}
+		p.ConfigTags[key] = parsed
+	}
+}
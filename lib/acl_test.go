@@ -0,0 +1,115 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// ipv4Frame builds ethernet frame with IPv4 packet of specified protocol
+func ipv4Frame(proto, src, dst int) []byte {
+	frame := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(PT_IPV4))
+	frame[14] = 0x45
+	frame[14+9] = byte(proto)
+	binary.BigEndian.PutUint16(frame[34:36], uint16(src))
+	binary.BigEndian.PutUint16(frame[36:38], uint16(dst))
+	return frame
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags(" DB-Servers, backup,,")
+	if err != nil || len(tags) != 2 || tags[0] != "db-servers" || tags[1] != "backup" {
+		t.Errorf("Wrong tags: %v, %v", tags, err)
+	}
+	for _, bad := range []string{"db servers", "db+servers", "-db", "*"} {
+		if _, err := ParseTags(bad); err == nil {
+			t.Errorf("Bad tag %q was accepted", bad)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	p := new(PTPCloud)
+	app := &NetworkPeer{ID: "app", Tags: []string{"app-servers"}, TagsConfirmed: true}
+	other := &NetworkPeer{ID: "other", PeerLocalIP: net.ParseIP("10.0.0.3"), Tags: []string{"app-servers"}, TagsConfirmed: true}
+	tcp := ipv4Frame(IPPROTO_TCP, 40000, 5432)
+	if !p.Allowed(other, tcp, false) {
+		t.Errorf("Traffic was dropped without ACL")
+	}
+
+	p.Tags = []string{"db-servers"}
+	p.ACL = []ACLRule{{From: "app-servers", To: "db-servers", Proto: "tcp", Ports: "5432"}}
+	p.ConfigTags = map[string][]string{"10.0.0.3": {"web-servers"}}
+	if !p.Allowed(app, tcp, false) {
+		t.Errorf("Connection from app server was dropped")
+	}
+	if !p.Allowed(app, ipv4Frame(IPPROTO_TCP, 5432, 40000), true) {
+		t.Errorf("Reply to app server was dropped")
+	}
+	if p.Allowed(app, ipv4Frame(IPPROTO_TCP, 40000, 22), false) {
+		t.Errorf("Connection to wrong port was allowed")
+	}
+	if p.Allowed(app, ipv4Frame(IPPROTO_UDP, 40000, 5432), false) {
+		t.Errorf("Wrong protocol was allowed")
+	}
+	if p.Allowed(app, tcp, true) {
+		t.Errorf("Connection from db server to app server was allowed")
+	}
+	if p.Allowed(other, tcp, false) {
+		t.Errorf("Advertised tags were used instead of configured ones")
+	}
+	if p.Allowed(nil, tcp, false) {
+		t.Errorf("Connection from unknown peer was allowed")
+	}
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:14], uint16(PT_ARP))
+	if !p.Allowed(nil, arp, false) {
+		t.Errorf("ARP was dropped")
+	}
+
+	p.ACL = append(p.ACL, ACLRule{From: TAG_ANY, To: TAG_ANY, Proto: "icmp"})
+	if !p.Allowed(nil, ipv4Frame(IPPROTO_ICMP, 0, 0), false) {
+		t.Errorf("ICMP was dropped")
+	}
+	// Broken rule never matches
+	p.ACL = []ACLRule{{From: TAG_ANY, To: TAG_ANY, Proto: "icmp", Ports: "80"}}
+	if p.Allowed(app, ipv4Frame(IPPROTO_ICMP, 0, 0), false) {
+		t.Errorf("Invalid rule was applied")
+	}
+}
+
+func TestIntroductionTags(t *testing.T) {
+	p := new(PTPCloud)
+	p.Mac = "01:02:03:04:05:06"
+	p.IP = "127.0.0.1"
+	p.Identity, _ = GenerateIdentity()
+	p.Tags = []string{"db-servers", "backup"}
+
+	msg := p.PrepareIntroductionMessage(p.Identity.ID)
+	data := string(msg.Data)
+	if !p.VerifyIntroString(data) {
+		t.Fatalf("Introduction with tags has bad signature: %s", data)
+	}
+	if id, _, _ := p.ParseIntroString(data); id != p.Identity.ID {
+		t.Errorf("Failed to parse introduction with tags: %s", data)
+	}
+	intro := ParseIntroduction(data)
+	if !intro.Signed || intro.PublicKey != p.Identity.PublicKeyString() || len(intro.Tags) != 2 || intro.Tags[1] != "backup" {
+		t.Errorf("Wrong introduction: %+v", intro)
+	}
+	peer := new(NetworkPeer)
+	p.AcceptIntroduction(peer, intro)
+	if len(p.PeerTags(peer)) != 0 {
+		t.Errorf("Tags peer has advertised itself were trusted: %v", p.PeerTags(peer))
+	}
+	peer.TagsConfirmed = true
+	if !HasTag(p.PeerTags(peer), "db-servers") {
+		t.Errorf("Tags confirmed by authentication hook were not accepted: %v", peer.Tags)
+	}
+	peer.TagsConfirmed = false
+	p.TrustTags = true
+	if !HasTag(p.PeerTags(peer), "db-servers") {
+		t.Errorf("Advertised tags were not accepted: %v", peer.Tags)
+	}
+}
@@ -0,0 +1,366 @@
+package ptp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuthHookConfig describes external command or HTTP endpoint that decides
+// whether a peer is admitted to the network, so membership may follow an
+// existing identity system, like LDAP or OIDC. Exactly one of Command and
+// URL is set
+type AuthHookConfig struct {
+	Command  string            `yaml:"command"`   // Receives request as JSON on stdin and P2P_* variables
+	Args     []string          `yaml:"args"`      // Arguments of the command
+	URL      string            `yaml:"url"`       // Receives request as JSON in POST
+	Headers  map[string]string `yaml:"headers"`   // Extra headers, like authorization token
+	Timeout  int               `yaml:"timeout"`   // Seconds hook is given to decide. AUTH_HOOK_TIMEOUT if zero
+	CacheTTL int               `yaml:"cache_ttl"` // Seconds decision is remembered. AUTH_HOOK_CACHE if zero
+	FailOpen bool              `yaml:"fail_open"` // Admit peers while hook fails. Peers are refused by default
+}
+
+// AuthRequest describes peer that asks to be admitted
+type AuthRequest struct {
+	Network      string   `json:"network"`
+	ID           string   `json:"id"`
+	IP           string   `json:"ip"`         // Virtual IP
+	Endpoint     string   `json:"endpoint"`   // Address introduction came from
+	PublicKey    string   `json:"public_key"` // Identity key. Empty if introduction isn't signed
+	Capabilities []string `json:"capabilities"`
+	Tags         []string `json:"tags"` // Tags the peer has advertised
+}
+
+// AuthDecision is the answer of a hook. Tags replace tags the peer has
+// advertised, unless tags are assigned to it in config file
+type AuthDecision struct {
+	Allow  bool     `json:"allow"`
+	Tags   []string `json:"tags"`
+	Reason string   `json:"reason"`
+}
+
+// AuthHook decides whether a peer is admitted. Error means hook failed to
+// decide
+type AuthHook interface {
+	Authorize(req AuthRequest) (AuthDecision, error)
+}
+
+// ExecAuthHook runs a command for every peer. Command prints decision as
+// JSON. If it prints nothing, zero exit status allows the peer and any
+// other denies it
+type ExecAuthHook struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+// Authorize runs the command
+func (h *ExecAuthHook) Authorize(req AuthRequest) (AuthDecision, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return AuthDecision{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"P2P_NETWORK="+req.Network,
+		"P2P_PEER_ID="+req.ID,
+		"P2P_PEER_IP="+req.IP,
+		"P2P_PEER_ENDPOINT="+req.Endpoint,
+		"P2P_PEER_KEY="+req.PublicKey,
+		"P2P_PEER_TAGS="+strings.Join(req.Tags, ","))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return AuthDecision{}, errors.New(fmt.Sprintf("%s didn't decide in %s", h.Command, h.Timeout))
+	}
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		return AuthDecision{}, err
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return AuthDecision{Allow: err == nil, Reason: strings.TrimSpace(stderr.String())}, nil
+	}
+	var decision AuthDecision
+	if err := json.Unmarshal(stdout.Bytes(), &decision); err != nil {
+		return AuthDecision{}, errors.New(fmt.Sprintf("Bad output of %s: %v", h.Command, err))
+	}
+	return decision, nil
+}
+
+// HTTPAuthHook posts request to an endpoint for every peer. Endpoint
+// answers 200 with decision as JSON, or 401 or 403 to deny the peer
+type HTTPAuthHook struct {
+	URL     string
+	Headers map[string]string
+	client  *http.Client
+}
+
+// Authorize posts request to the endpoint
+func (h *HTTPAuthHook) Authorize(req AuthRequest) (AuthDecision, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return AuthDecision{}, err
+	}
+	r, err := http.NewRequest("POST", h.URL, bytes.NewReader(input))
+	if err != nil {
+		return AuthDecision{}, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for name, value := range h.Headers {
+		r.Header.Set(name, value)
+	}
+	resp, err := h.client.Do(r)
+	if err != nil {
+		return AuthDecision{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return AuthDecision{}, err
+	}
+	var decision AuthDecision
+	switch resp.StatusCode {
+	case http.StatusOK:
+		decision.Allow = true
+	case http.StatusUnauthorized, http.StatusForbidden:
+	default:
+		return AuthDecision{}, errors.New(fmt.Sprintf("%s answered %s", h.URL, resp.Status))
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return decision, nil
+	}
+	if err := json.Unmarshal(body, &decision); err != nil {
+		return AuthDecision{}, errors.New(fmt.Sprintf("Bad answer of %s: %v", h.URL, err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		decision.Allow = false
+	}
+	return decision, nil
+}
+
+// NewAuthHook creates hook of config file
+func NewAuthHook(cfg AuthHookConfig) (AuthHook, error) {
+	timeout := AUTH_HOOK_TIMEOUT
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	switch {
+	case cfg.Command != "" && cfg.URL != "":
+		return nil, errors.New("Authentication hook should have either command or URL")
+	case cfg.Command != "":
+		if err := CheckTool(cfg.Command); err != nil {
+			return nil, err
+		}
+		return &ExecAuthHook{Command: cfg.Command, Args: cfg.Args, Timeout: timeout}, nil
+	case cfg.URL != "":
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New(fmt.Sprintf("Bad URL of authentication hook: %s", cfg.URL))
+		}
+		return &HTTPAuthHook{URL: cfg.URL, Headers: cfg.Headers, client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, errors.New("Authentication hook has neither command nor URL")
+}
+
+// PeerAdmission asks hook about peers and remembers its decisions, so
+// hook isn't run for every introduction. Introductions are ignored while
+// hook decides, and peer is introduced again once it has decided
+type PeerAdmission struct {
+	allowed   uint64
+	denied    uint64
+	failed    uint64
+	hook      AuthHook
+	ttl       time.Duration
+	timeout   time.Duration // Time hook is given to decide
+	failOpen  bool
+	decisions map[string]*admission
+	pending   int       // Peers hook is deciding on
+	swept     time.Time // Last time expired decisions were removed
+	lock      sync.Mutex
+}
+
+// admission is a decision of the hook. Pending admission expires once
+// hook should have decided, so peer is asked about again if it didn't
+type admission struct {
+	decision AuthDecision
+	expires  time.Time
+	pending  bool
+}
+
+// NewPeerAdmission creates admission of config file. Nil is returned if
+// hook isn't configured
+func NewPeerAdmission(cfg AuthHookConfig) (*PeerAdmission, error) {
+	if cfg.Command == "" && cfg.URL == "" {
+		return nil, nil
+	}
+	hook, err := NewAuthHook(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ttl := AUTH_HOOK_CACHE
+	if cfg.CacheTTL > 0 {
+		ttl = time.Duration(cfg.CacheTTL) * time.Second
+	}
+	timeout := AUTH_HOOK_TIMEOUT
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	return &PeerAdmission{hook: hook, ttl: ttl, timeout: timeout, failOpen: cfg.FailOpen, decisions: make(map[string]*admission)}, nil
+}
+
+// admissionKey identifies peer by its ID and identity key, so decision
+// isn't reused when another host claims the same ID. Peer without identity
+// key is identified by its addresses instead
+func admissionKey(req AuthRequest) string {
+	if req.PublicKey == "" {
+		return req.ID + "||" + req.Endpoint + "|" + req.IP
+	}
+	return req.ID + "|" + req.PublicKey
+}
+
+// Lookup returns decision about the peer that hasn't expired. Ask is true
+// when caller should ask hook, since nobody asks it about this peer yet.
+// Hook isn't asked while it decides on AUTH_HOOK_MAX_PENDING peers
+func (a *PeerAdmission) Lookup(req AuthRequest) (decision AuthDecision, known bool, ask bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	a.sweep(now)
+	entry, exists := a.decisions[admissionKey(req)]
+	if exists && now.Before(entry.expires) {
+		if entry.pending {
+			return AuthDecision{}, false, false
+		}
+		return entry.decision, true, false
+	}
+	if !exists || !entry.pending {
+		if a.pending >= AUTH_HOOK_MAX_PENDING {
+			return AuthDecision{}, false, false
+		}
+		a.pending++
+	}
+	a.decisions[admissionKey(req)] = &admission{pending: true, expires: now.Add(a.timeout + AUTH_HOOK_RETRY)}
+	return AuthDecision{}, false, true
+}
+
+// sweep removes expired decisions, so peers that are gone or have
+// changed their keys don't stay in memory. Runs once in AUTH_HOOK_RETRY
+func (a *PeerAdmission) sweep(now time.Time) {
+	if now.Sub(a.swept) < AUTH_HOOK_RETRY {
+		return
+	}
+	a.swept = now
+	for key, entry := range a.decisions {
+		if !now.Before(entry.expires) {
+			if entry.pending {
+				a.pending--
+			}
+			delete(a.decisions, key)
+		}
+	}
+}
+
+// Ask runs hook and remembers its decision. Failures of the hook are
+// remembered for AUTH_HOOK_RETRY only
+func (a *PeerAdmission) Ask(req AuthRequest) AuthDecision {
+	decision, err := a.hook.Authorize(req)
+	ttl := a.ttl
+	if err == nil {
+		decision.Tags, err = ParseTags(strings.Join(decision.Tags, ","))
+	}
+	if err != nil {
+		atomic.AddUint64(&a.failed, 1)
+		Log(WARNING, "Authentication hook failed to decide on peer %s: %v", req.ID, err)
+		decision = AuthDecision{Allow: a.failOpen, Reason: "Authentication hook failed: " + err.Error()}
+		ttl = AUTH_HOOK_RETRY
+	} else if decision.Allow {
+		atomic.AddUint64(&a.allowed, 1)
+	} else {
+		atomic.AddUint64(&a.denied, 1)
+	}
+	a.lock.Lock()
+	if entry, exists := a.decisions[admissionKey(req)]; exists && entry.pending {
+		a.pending--
+	}
+	a.decisions[admissionKey(req)] = &admission{decision: decision, expires: time.Now().Add(ttl)}
+	a.lock.Unlock()
+	return decision
+}
+
+func (a *PeerAdmission) String() string {
+	return fmt.Sprintf("Authentication hook: %d peers allowed, %d denied, %d failures",
+		atomic.LoadUint64(&a.allowed), atomic.LoadUint64(&a.denied), atomic.LoadUint64(&a.failed))
+}
+
+// CheckAdmission returns error if authentication hook denies the peer or
+// hasn't decided yet. Decision is returned for admitted peers. Nothing is
+// checked if hook isn't configured
+func (p *PTPCloud) CheckAdmission(intro Introduction, ip net.IP, src_addr *net.UDPAddr) (*AuthDecision, error) {
+	if p.Admission == nil {
+		return nil, nil
+	}
+	req := AuthRequest{
+		ID:           intro.ID,
+		Endpoint:     src_addr.String(),
+		Capabilities: intro.Capabilities,
+		Tags:         intro.Tags,
+	}
+	if intro.Signed {
+		req.PublicKey = intro.PublicKey
+	}
+	if ip != nil {
+		req.IP = ip.String()
+	}
+	if p.Dht != nil {
+		req.Network = p.Dht.NetworkHash
+	}
+	decision, known, ask := p.Admission.Lookup(req)
+	if ask {
+		p.Go(func() { p.admissionDecided(req, p.Admission.Ask(req)) })
+	}
+	if !known {
+		return nil, errors.New("Waiting for authentication hook")
+	}
+	if !decision.Allow {
+		if decision.Reason != "" {
+			return nil, errors.New("Denied by authentication hook: " + decision.Reason)
+		}
+		return nil, errors.New("Denied by authentication hook")
+	}
+	return &decision, nil
+}
+
+// admissionDecided asks admitted peer to introduce itself again, so it
+// doesn't wait for the next handshake. Connected peer that is denied now
+// is disconnected
+func (p *PTPCloud) admissionDecided(req AuthRequest, decision AuthDecision) {
+	Log(INFO, "Authentication hook has decided on peer %s: allow %t %s", req.ID, decision.Allow, decision.Reason)
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[req.ID]
+	if exists && !decision.Allow && peer.State == P_CONNECTED {
+		Log(WARNING, "Peer %s was denied by authentication hook. Disconnecting", peer.ID)
+		peer.LastError = "Denied by authentication hook"
+		peer.State = P_DISCONNECT
+	}
+	handshake := exists && decision.Allow && peer.State == P_HANDSHAKING && peer.Endpoint != nil
+	p.PeersLock.Unlock()
+	if handshake {
+		peer.SendHandshake(p)
+	}
+}
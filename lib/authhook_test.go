@@ -0,0 +1,197 @@
+package ptp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAuthHook(t *testing.T) {
+	bad := []AuthHookConfig{
+		{Command: "true", URL: "http://ldap-bridge/"},
+		{URL: "ftp://ldap-bridge/"},
+		{},
+	}
+	for _, cfg := range bad {
+		if _, err := NewAuthHook(cfg); err == nil {
+			t.Errorf("Bad hook was accepted: %+v", cfg)
+		}
+	}
+	if a, err := NewPeerAdmission(AuthHookConfig{}); a != nil || err != nil {
+		t.Errorf("Admission was created without hook: %v", err)
+	}
+}
+
+func TestExecAuthHook(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("No shell")
+	}
+	script := `read request; case "$P2P_PEER_ID" in
+	admin) echo '{"allow":true,"tags":["ops"]}';;
+	guest) exit 0;;
+	*) echo "unknown peer" >&2; exit 1;;
+	esac`
+	hook := &ExecAuthHook{Command: "sh", Args: []string{"-c", script}, Timeout: AUTH_HOOK_TIMEOUT}
+	cases := []struct {
+		id     string
+		allow  bool
+		tags   string
+		reason string
+	}{
+		{"admin", true, "ops", ""},
+		{"guest", true, "", ""},
+		{"stranger", false, "", "unknown peer"},
+	}
+	for _, c := range cases {
+		d, err := hook.Authorize(AuthRequest{ID: c.id})
+		if err != nil || d.Allow != c.allow || strings.Join(d.Tags, ",") != c.tags || d.Reason != c.reason {
+			t.Errorf("Wrong decision on %s: %+v %v", c.id, d, err)
+		}
+	}
+	hook.Args = []string{"-c", "echo allow"}
+	if _, err := hook.Authorize(AuthRequest{ID: "admin"}); err == nil {
+		t.Errorf("Bad output was accepted")
+	}
+}
+
+func TestHTTPAuthHook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthRequest
+		if json.NewDecoder(r.Body).Decode(&req) != nil || r.Header.Get("Authorization") != "Bearer x" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.ID {
+		case "admin":
+			w.Write([]byte(`{"allow":true,"tags":["ops"]}`))
+		case "guest":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"allow":true,"reason":"not in group"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	hook, err := NewAuthHook(AuthHookConfig{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer x"}})
+	if err != nil {
+		t.Fatalf("Failed to create hook: %v", err)
+	}
+	if d, err := hook.Authorize(AuthRequest{ID: "admin"}); err != nil || !d.Allow || len(d.Tags) != 1 {
+		t.Errorf("Wrong decision on admin: %+v %v", d, err)
+	}
+	if d, err := hook.Authorize(AuthRequest{ID: "guest"}); err != nil || d.Allow || d.Reason != "not in group" {
+		t.Errorf("Wrong decision on guest: %+v %v", d, err)
+	}
+	if _, err := hook.Authorize(AuthRequest{ID: "other"}); err == nil {
+		t.Errorf("Failure of endpoint wasn't reported")
+	}
+}
+
+type fakeAuthHook struct {
+	calls int
+	err   error
+}
+
+func (h *fakeAuthHook) Authorize(req AuthRequest) (AuthDecision, error) {
+	h.calls++
+	return AuthDecision{Allow: req.ID == "admin", Tags: []string{"Ops"}}, h.err
+}
+
+func TestCheckAdmission(t *testing.T) {
+	hook := new(fakeAuthHook)
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.Admission = &PeerAdmission{hook: hook, ttl: AUTH_HOOK_CACHE, decisions: make(map[string]*admission)}
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 6881}
+	ip := net.ParseIP("10.10.10.2")
+
+	if _, err := p.CheckAdmission(Introduction{ID: "admin"}, ip, src); err == nil {
+		t.Fatalf("Peer was admitted before hook decided")
+	}
+	admin := AuthRequest{ID: "admin", Endpoint: src.String(), IP: ip.String()}
+	if !waitFor(func() bool { _, known, _ := p.Admission.Lookup(admin); return known }) {
+		t.Fatalf("Hook didn't decide")
+	}
+	d, err := p.CheckAdmission(Introduction{ID: "admin"}, ip, src)
+	if err != nil || d == nil || strings.Join(d.Tags, ",") != "ops" {
+		t.Errorf("Admitted peer got wrong decision: %+v %v", d, err)
+	}
+	if hook.calls != 1 {
+		t.Errorf("Decision wasn't cached: %d calls", hook.calls)
+	}
+	// Decision about unsigned introduction isn't reused for other hosts
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.1.66"), Port: 6881}
+	if _, err := p.CheckAdmission(Introduction{ID: "admin"}, ip, other); err == nil {
+		t.Errorf("Unsigned introduction from another host reused decision")
+	}
+	waitFor(func() bool {
+		_, known, _ := p.Admission.Lookup(AuthRequest{ID: "admin", Endpoint: other.String(), IP: ip.String()})
+		return known
+	})
+
+	// Failures are remembered for a short time and deny peers by default
+	hook.err = errors.New("LDAP is down")
+	p.Admission.Ask(AuthRequest{ID: "admin", PublicKey: "other"})
+	if _, err := p.CheckAdmission(Introduction{ID: "admin", PublicKey: "other", Signed: true}, ip, src); err == nil || !strings.Contains(err.Error(), "LDAP is down") {
+		t.Errorf("Peer was admitted while hook fails: %v", err)
+	}
+	p.Admission.failOpen = true
+	p.Admission.Ask(AuthRequest{ID: "guest", Endpoint: src.String(), IP: ip.String()})
+	if _, err := p.CheckAdmission(Introduction{ID: "guest"}, ip, src); err != nil {
+		t.Errorf("Peer wasn't admitted in fail open mode: %v", err)
+	}
+}
+
+func TestAdmissionSweep(t *testing.T) {
+	a := &PeerAdmission{hook: new(fakeAuthHook), ttl: AUTH_HOOK_CACHE, decisions: make(map[string]*admission)}
+	a.Lookup(AuthRequest{ID: "stale"})
+	a.Ask(AuthRequest{ID: "admin"})
+	stale := admissionKey(AuthRequest{ID: "stale"})
+	a.decisions[stale].expires = time.Now().Add(-time.Second)
+	a.swept = time.Time{}
+	if _, _, ask := a.Lookup(AuthRequest{ID: "admin"}); ask {
+		t.Errorf("Hook was asked again before decision expired")
+	}
+	if _, exists := a.decisions[stale]; exists || a.pending != 0 {
+		t.Errorf("Expired pending decision wasn't removed")
+	}
+}
+
+func TestAdmissionPendingLimit(t *testing.T) {
+	a := &PeerAdmission{hook: new(fakeAuthHook), ttl: AUTH_HOOK_CACHE, decisions: make(map[string]*admission)}
+	for i := 0; i < AUTH_HOOK_MAX_PENDING; i++ {
+		if _, _, ask := a.Lookup(AuthRequest{ID: fmt.Sprintf("peer%d", i), PublicKey: "key"}); !ask {
+			t.Fatalf("Hook wasn't asked about peer %d", i)
+		}
+	}
+	if _, _, ask := a.Lookup(AuthRequest{ID: "flood", PublicKey: "key"}); ask {
+		t.Errorf("Hook was asked above limit of pending peers")
+	}
+	a.Ask(AuthRequest{ID: "peer0", PublicKey: "key"})
+	if _, _, ask := a.Lookup(AuthRequest{ID: "flood", PublicKey: "key"}); !ask {
+		t.Errorf("Hook wasn't asked after it had decided on a peer")
+	}
+}
+
+func TestAdmissionOfUnknownPeer(t *testing.T) {
+	hook := new(fakeAuthHook)
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.Admission = &PeerAdmission{hook: hook, ttl: AUTH_HOOK_CACHE, decisions: make(map[string]*admission)}
+	p.Dht = new(DHTClient)
+	p.Dht.ID = "self"
+	p.Mac = "01:02:03:04:05:06"
+	p.IP = "10.10.10.2"
+	msg := p.PrepareIntroductionMessage("stranger")
+	p.HandleIntroMessage(msg, &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 6881})
+	if len(p.Admission.decisions) != 0 {
+		t.Errorf("Hook was asked about unknown peer")
+	}
+}
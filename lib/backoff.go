@@ -0,0 +1,45 @@
+package ptp
+
+import (
+	"time"
+)
+
+// Backoff returns base delay doubled for every failure after the first
+// one and capped at max. No failures mean no delay
+func Backoff(base, max time.Duration, failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// attemptFailed is called when attempt to reach the peer has ended and
+// state machine starts over. First retry is immediate, further ones are
+// delayed, so dead peer doesn't keep routers and its endpoints busy
+func (np *NetworkPeer) attemptFailed() {
+	np.Failures++
+	delay := Backoff(PEER_BACKOFF_MIN, PEER_BACKOFF_MAX, np.Failures-1)
+	np.RetryAt = time.Now().Add(delay)
+	if delay > 0 {
+		Log(INFO, "Failed to reach %s %d times in a row. Next attempt in %s", np.ID, np.Failures, delay)
+	}
+}
+
+// attemptSucceeded resets backoff once peer is connected
+func (np *NetworkPeer) attemptSucceeded() {
+	np.Failures = 0
+	np.RetryAt = time.Time{}
+}
+
+// punchDue returns true when relayed peer should try to switch to direct
+// connection. Interval grows with every failed upgrade
+func (np *NetworkPeer) punchDue() bool {
+	return time.Since(np.LastPunch) > Backoff(PUNCH_RETRY_INTERVAL, PUNCH_RETRY_MAX, np.PunchFailures+1)
+}
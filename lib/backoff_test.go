@@ -0,0 +1,55 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, time.Second * 2},
+		{3, time.Second * 4},
+		{5, time.Second * 10},
+		{100, time.Second * 10},
+	}
+	for _, c := range cases {
+		if delay := Backoff(time.Second, time.Second*10, c.failures); delay != c.delay {
+			t.Errorf("Backoff after %d failures: expected %s, got %s", c.failures, c.delay, delay)
+		}
+	}
+}
+
+func TestPeerRetry(t *testing.T) {
+	np := &NetworkPeer{ID: "Peer"}
+	np.attemptFailed()
+	if time.Now().Before(np.RetryAt) {
+		t.Errorf("First retry was delayed")
+	}
+	np.attemptFailed()
+	if time.Until(np.RetryAt) < PEER_BACKOFF_MIN-time.Second {
+		t.Errorf("Second retry wasn't delayed: %s", np.RetryAt)
+	}
+	p := &PTPCloud{Dht: new(DHTClient)}
+	np.State = P_INIT
+	if err := np.StateInit(p); err != nil || np.State != P_INIT {
+		t.Errorf("Peer was resolved before retry time: %v %d", err, np.State)
+	}
+	np.attemptSucceeded()
+	if np.Failures != 0 || !np.RetryAt.IsZero() {
+		t.Errorf("Backoff wasn't reset after connection")
+	}
+
+	np.LastPunch = time.Now().Add(-PUNCH_RETRY_INTERVAL - time.Second)
+	if !np.punchDue() {
+		t.Errorf("Upgrade to direct connection isn't due")
+	}
+	np.PunchFailures = 2
+	if np.punchDue() {
+		t.Errorf("Upgrade to direct connection wasn't delayed after failures")
+	}
+}
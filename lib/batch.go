@@ -0,0 +1,117 @@
+package ptp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DeviceWriter queues frames received from peers and writes them to the
+// device in batches. Receivers don't wait for the device, and frames that
+// arrive together are written with a single call where the device allows
+type DeviceWriter struct {
+	device  TapDevice
+	queue   chan *Packet
+	stop    chan bool
+	closed  sync.Once
+	frames  uint64
+	batches uint64
+	dropped uint64 // Frames dropped because queue was full
+}
+
+// NewDeviceWriter creates writer for a device. Start should be called
+// before frames are queued
+func NewDeviceWriter(device TapDevice) *DeviceWriter {
+	return &DeviceWriter{
+		device: device,
+		queue:  make(chan *Packet, WRITE_QUEUE_SIZE),
+		stop:   make(chan bool),
+	}
+}
+
+// Start runs writing goroutine
+func (w *DeviceWriter) Start() {
+	go w.run()
+}
+
+// Close stops writing goroutine. Queued frames are discarded
+func (w *DeviceWriter) Close() {
+	w.closed.Do(func() { close(w.stop) })
+}
+
+// Write queues a copy of the frame. Returns false if queue is full
+func (w *DeviceWriter) Write(b []byte, proto uint16) bool {
+	pkt := &Packet{Protocol: int(proto), Packet: append([]byte{}, b...)}
+	select {
+	case w.queue <- pkt:
+		return true
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+		return false
+	}
+}
+
+func (w *DeviceWriter) run() {
+	for {
+		var batch []*Packet
+		select {
+		case <-w.stop:
+			return
+		case pkt := <-w.queue:
+			batch = append(batch, pkt)
+		}
+	collect:
+		for len(batch) < WRITE_BATCH_SIZE {
+			select {
+			case pkt := <-w.queue:
+				batch = append(batch, pkt)
+			default:
+				break collect
+			}
+		}
+		w.flush(batch)
+	}
+}
+
+// flush writes batch of frames to the device
+func (w *DeviceWriter) flush(batch []*Packet) {
+	atomic.AddUint64(&w.batches, 1)
+	atomic.AddUint64(&w.frames, uint64(len(batch)))
+	if bw, ok := w.device.(BatchWriter); ok {
+		if err := bw.WritePackets(batch); err != nil {
+			Log(ERROR, "Failed to write %d frames to TUN/TAP device: %v", len(batch), err)
+		}
+		return
+	}
+	for _, pkt := range batch {
+		if err := w.device.WritePacket(pkt); err != nil {
+			Log(ERROR, "Failed to write to TUN/TAP device: %v", err)
+		}
+	}
+}
+
+// Stats returns number of written frames, batches and dropped frames
+func (w *DeviceWriter) Stats() (frames, batches, dropped uint64) {
+	return atomic.LoadUint64(&w.frames), atomic.LoadUint64(&w.batches), atomic.LoadUint64(&w.dropped)
+}
+
+func (w *DeviceWriter) String() string {
+	frames, batches, dropped := w.Stats()
+	avg := 0.0
+	if batches > 0 {
+		avg = float64(frames) / float64(batches)
+	}
+	return fmt.Sprintf("Device writes: %d frames in %d batches (avg %.1f), %d dropped", frames, batches, avg, dropped)
+}
+
+// QueueToDevice writes frame received from a peer through the batching
+// writer, or directly when instance has no writer
+func (p *PTPCloud) QueueToDevice(b []byte, proto uint16) {
+	if p.Writer == nil {
+		p.WriteToDevice(b, proto, false)
+		return
+	}
+	if !p.Writer.Write(b, proto) {
+		Log(TRACE, "Device write queue is full. Dropping frame")
+	}
+}
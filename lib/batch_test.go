@@ -0,0 +1,52 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceWriter(t *testing.T) {
+	tap := NewFakeTap()
+	w := NewDeviceWriter(tap)
+	frame := []byte{1, 2, 3}
+	for i := 0; i < WRITE_BATCH_SIZE+5; i++ {
+		if !w.Write(frame, uint16(PT_IPV4)) {
+			t.Fatalf("Frame %d wasn't queued", i)
+		}
+	}
+	// Receive buffer is reused by the listener, so frame should be copied
+	frame[0] = 9
+	w.Start()
+	defer w.Close()
+	for started := time.Now(); len(tap.Written()) < WRITE_BATCH_SIZE+5 && time.Since(started) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	written := tap.Written()
+	if len(written) != WRITE_BATCH_SIZE+5 {
+		t.Fatalf("%d frames were written instead of %d", len(written), WRITE_BATCH_SIZE+5)
+	}
+	if written[0].Packet[0] != 1 || written[0].Protocol != int(PT_IPV4) {
+		t.Errorf("Frame was written wrong: %v", written[0])
+	}
+	batches := tap.Batches()
+	if len(batches) != 2 || batches[0] != WRITE_BATCH_SIZE || batches[1] != 5 {
+		t.Errorf("Frames weren't batched: %v", batches)
+	}
+	frames, count, _ := w.Stats()
+	if frames != uint64(WRITE_BATCH_SIZE+5) || count != 2 {
+		t.Errorf("Wrong stats: %s", w)
+	}
+}
+
+func TestDeviceWriterFull(t *testing.T) {
+	w := NewDeviceWriter(NewFakeTap())
+	for i := 0; i < WRITE_QUEUE_SIZE; i++ {
+		w.Write([]byte{1}, uint16(PT_IPV4))
+	}
+	if w.Write([]byte{1}, uint16(PT_IPV4)) {
+		t.Errorf("Frame was queued into full queue")
+	}
+	if _, _, dropped := w.Stats(); dropped != 1 {
+		t.Errorf("Dropped frame wasn't counted")
+	}
+}
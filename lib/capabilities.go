@@ -0,0 +1,164 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Introduction is a parsed introduction string. Capabilities, tags and key
+// are empty for legacy introductions that were not signed
+type Introduction struct {
+	ID           string
+	Capabilities []string
+	Tags         []string
+	PublicKey    string
+	Signed       bool
+	Stamp        time.Time // Zero if peer doesn't stamp introductions
+}
+
+// Capabilities returns features this instance uses in sessions with peers
+func (p *PTPCloud) Capabilities() []string {
+	var caps []string
+	if p.Identity != nil {
+		caps = append(caps, CAP_IDENTITY)
+	}
+	if p.CurrentCrypter().Active {
+		caps = append(caps, CAP_ENCRYPTION)
+	}
+	if p.Features != nil {
+		caps = append(caps, p.Features.Advertised()...)
+	}
+	return caps
+}
+
+// ParseIntroduction extracts capabilities and identity key from an
+// introduction string. Signature should be checked with VerifyIntroString
+func ParseIntroduction(intro string) Introduction {
+	parts := strings.Split(intro, ",")
+	var i Introduction
+	i.ID = parts[0]
+	switch len(parts) {
+	case 5:
+		// Signed introduction without capabilities
+		i.PublicKey = parts[3]
+		i.Signed = true
+		i.Capabilities = []string{CAP_IDENTITY}
+	case 6, 7, 8:
+		i.PublicKey = parts[len(parts)-2]
+		i.Signed = true
+		if parts[3] != "" {
+			i.Capabilities = strings.Split(parts[3], CAP_SEPARATOR)
+		}
+		if len(parts) == 8 {
+			i.Stamp, _ = ParseStamp(parts[5])
+		}
+		if len(parts) >= 7 {
+			// Tags are accepted only together with signature, so they
+			// can't be assigned to the peer by someone else
+			tags, err := ParseTags(strings.Replace(parts[4], TAG_SEPARATOR, ",", -1))
+			if err != nil {
+				Log(WARNING, "Peer %s advertised bad tags: %v", i.ID, err)
+			}
+			i.Tags = tags
+		}
+	}
+	return i
+}
+
+// NegotiateCapabilities returns capabilities supported by both sides
+func NegotiateCapabilities(local, remote []string) []string {
+	var result []string
+	for _, l := range local {
+		for _, r := range remote {
+			if l == r {
+				result = append(result, l)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// HasCapability returns true if capability is in the list
+func HasCapability(caps []string, capability string) bool {
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckDowngrade compares introduction of a peer with what we know about
+// it. Signed capabilities can't be modified on the way, so a peer that
+// once introduced itself with a signature must keep doing so with the
+// same key and without losing any capability
+func (p *PTPCloud) CheckDowngrade(peer *NetworkPeer, intro Introduction) error {
+	if peer.PublicKey != "" {
+		if !intro.Signed {
+			return errors.New("Peer has signed its introductions before, but this one is not signed")
+		}
+		if intro.PublicKey != peer.PublicKey {
+			return errors.New("Identity key of the peer has changed")
+		}
+		for _, c := range peer.Capabilities {
+			// Features may be rolled back at any time
+			if strings.HasPrefix(c, FEATURE_PREFIX) {
+				continue
+			}
+			if !HasCapability(intro.Capabilities, c) {
+				return errors.New(fmt.Sprintf("Capability %s was stripped from introduction", c))
+			}
+		}
+	}
+	if intro.Signed && p.CurrentCrypter().Active && !HasCapability(intro.Capabilities, CAP_ENCRYPTION) {
+		return errors.New("Peer doesn't confirm encryption of the session")
+	}
+	return nil
+}
+
+// AcceptIntroduction remembers key and capabilities of the peer, so later
+// introductions can't downgrade the session
+func (p *PTPCloud) AcceptIntroduction(peer *NetworkPeer, intro Introduction) {
+	if !intro.Signed {
+		return
+	}
+	peer.PublicKey = intro.PublicKey
+	p.rememberIdentity(intro.ID, intro.PublicKey, intro.Stamp)
+	peer.Capabilities = intro.Capabilities
+	peer.Tags = intro.Tags
+	Log(DEBUG, "Negotiated capabilities with %s: %s", peer.ID, strings.Join(NegotiateCapabilities(p.Capabilities(), intro.Capabilities), CAP_SEPARATOR))
+}
+
+// rememberIdentity records identity key of a peer and stamp of its
+// introduction
+func (p *PTPCloud) rememberIdentity(id, key string, stamp time.Time) {
+	p.identityLock.Lock()
+	defer p.identityLock.Unlock()
+	if p.identities == nil {
+		p.identities = make(map[string]string)
+		p.introStamps = make(map[string]time.Time)
+	}
+	p.identities[id] = key
+	if stamp.After(p.introStamps[id]) {
+		p.introStamps[id] = stamp
+	}
+}
+
+// KnownIdentity returns identity key a peer has signed its introductions
+// with, or empty string if it never did
+func (p *PTPCloud) KnownIdentity(id string) string {
+	p.identityLock.Lock()
+	defer p.identityLock.Unlock()
+	return p.identities[id]
+}
+
+// IntroStamp returns stamp of the latest accepted introduction of a peer,
+// or zero time if peer doesn't stamp them
+func (p *PTPCloud) IntroStamp(id string) time.Time {
+	p.identityLock.Lock()
+	defer p.identityLock.Unlock()
+	return p.introStamps[id]
+}
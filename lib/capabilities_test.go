@@ -0,0 +1,59 @@
+package ptp
+
+import (
+	"testing"
+)
+
+func TestCheckDowngrade(t *testing.T) {
+	p := new(PTPCloud)
+	p.Mac = "01:02:03:04:05:06"
+	p.IP = "127.0.0.1"
+	p.Identity, _ = GenerateIdentity()
+	p.Crypter.Active = true
+	p.Crypter.ActiveKey.Key = []byte("01234567890123456789012345678901")
+
+	msg := p.PrepareIntroductionMessage(p.Identity.ID)
+	data, err := p.Crypter.Decrypt(p.Crypter.ActiveKey.Key, msg.Data)
+	if err != nil {
+		t.Fatalf("Failed to decrypt introduction: %v", err)
+	}
+	signed := ParseIntroduction(string(data[:msg.Header.Length]))
+	if !signed.Signed || !HasCapability(signed.Capabilities, CAP_ENCRYPTION) || !HasCapability(signed.Capabilities, CAP_IDENTITY) {
+		t.Fatalf("Capabilities were not advertised: %+v", signed)
+	}
+
+	peer := new(NetworkPeer)
+	if err := p.CheckDowngrade(peer, signed); err != nil {
+		t.Errorf("Valid introduction was rejected: %v", err)
+	}
+	p.AcceptIntroduction(peer, signed)
+	if peer.PublicKey != p.Identity.PublicKeyString() {
+		t.Errorf("Identity key was not pinned")
+	}
+
+	legacy := ParseIntroduction(p.Identity.ID + ",01:02:03:04:05:06,127.0.0.1")
+	if err := p.CheckDowngrade(peer, legacy); err == nil {
+		t.Errorf("Unsigned introduction was accepted after signed one")
+	}
+	stripped := signed
+	stripped.Capabilities = []string{CAP_IDENTITY}
+	if err := p.CheckDowngrade(peer, stripped); err == nil {
+		t.Errorf("Introduction without encryption was accepted")
+	}
+	other, _ := GenerateIdentity()
+	replaced := signed
+	replaced.PublicKey = other.PublicKeyString()
+	if err := p.CheckDowngrade(peer, replaced); err == nil {
+		t.Errorf("Introduction with another key was accepted")
+	}
+	if err := p.CheckDowngrade(new(NetworkPeer), legacy); err != nil {
+		t.Errorf("Legacy introduction of a new peer was rejected: %v", err)
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	caps := NegotiateCapabilities([]string{CAP_IDENTITY, CAP_ENCRYPTION}, []string{CAP_ENCRYPTION, "zstd"})
+	if len(caps) != 1 || caps[0] != CAP_ENCRYPTION {
+		t.Errorf("Wrong negotiated capabilities: %v", caps)
+	}
+}
@@ -0,0 +1,182 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Handshakes, STOP and CP messages carry the time they were sent at, so a
+// captured message can't be replayed later. Devices with a bad RTC would
+// be locked out if their own clock was used, so clock of routers is
+// estimated from their replies and stamps are made and checked with it.
+// Router authenticates its messages together with the stamp using token
+// of the session it issues in CONN reply. Once router has done so, its
+// messages that are not authenticated or not stamped are dropped and only
+// authenticated stamps are used to estimate skew
+
+// ClockSkew returns how far clock of routers is ahead of ours
+func (dht *DHTClient) ClockSkew() time.Duration {
+	dht.StatsLock.Lock()
+	defer dht.StatsLock.Unlock()
+	return dht.Skew
+}
+
+// RouterTime returns current time by the clock of routers
+func (dht *DHTClient) RouterTime() time.Time {
+	return time.Now().Add(dht.ClockSkew())
+}
+
+// Stamp returns a timestamp for an outgoing control message
+func (dht *DHTClient) Stamp() string {
+	return strconv.FormatInt(dht.RouterTime().UnixNano()/int64(time.Millisecond), 10)
+}
+
+// ParseStamp returns time from a timestamp of a message
+func ParseStamp(stamp string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// MessageMAC authenticates message of a router with the session token.
+// Every field except MAC itself is covered
+func MessageMAC(token string, data DHTMessage) string {
+	data.Mac = ""
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, data); err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(b.Bytes())
+	return hex.EncodeToString(mac.Sum(nil)[:DHT_MAC_SIZE])
+}
+
+// Authenticate returns false if message must be dropped. Router that
+// authenticates its first CONN reply starts a session, and every later
+// message of the session must be authenticated with the same token and
+// stamped. Messages of routers that don't do that are accepted as is
+func (dht *DHTClient) Authenticate(data DHTMessage, conn PacketConn) bool {
+	dht.StatsLock.Lock()
+	defer dht.StatsLock.Unlock()
+	token, session := dht.Sessions[conn]
+	if session {
+		return validMAC(token, data)
+	}
+	if data.Command == CMD_CONN && data.Token != "" && validMAC(data.Token, data) {
+		if dht.Sessions == nil {
+			dht.Sessions = make(map[PacketConn]string)
+		}
+		dht.Sessions[conn] = data.Token
+	}
+	return true
+}
+
+func validMAC(token string, data DHTMessage) bool {
+	if data.Mac == "" || data.Stamp == "" {
+		return false
+	}
+	return hmac.Equal([]byte(data.Mac), []byte(MessageMAC(token, data)))
+}
+
+// authenticated returns true if router of the connection authenticates
+// its messages
+func (dht *DHTClient) authenticated(conn PacketConn) bool {
+	dht.StatsLock.Lock()
+	defer dht.StatsLock.Unlock()
+	_, session := dht.Sessions[conn]
+	return session
+}
+
+func (dht *DHTClient) forgetSession(conn PacketConn) {
+	dht.StatsLock.Lock()
+	delete(dht.Sessions, conn)
+	dht.StatsLock.Unlock()
+}
+
+// ObserveStamp estimates skew of our clock from a message of a router.
+// Only messages of authenticated sessions are used, so a forged stamp
+// can't shift our clock. Until skew is known any stamp is accepted, so
+// handshake retransmitted after router rejected our stamp carries
+// corrected time. Later stamps that fit tolerance window are smoothed in
+// to follow the drift
+func (dht *DHTClient) ObserveStamp(data DHTMessage, conn PacketConn) {
+	if !dht.authenticated(conn) {
+		return
+	}
+	remote, ok := ParseStamp(data.Stamp)
+	if !ok {
+		return
+	}
+	sample := time.Until(remote)
+	dht.StatsLock.Lock()
+	defer dht.StatsLock.Unlock()
+	if !dht.SkewKnown {
+		dht.Skew = sample
+		dht.SkewKnown = true
+		if sample > DHT_STAMP_TOLERANCE || sample < -DHT_STAMP_TOLERANCE {
+			Log(WARNING, "Local clock differs from clock of routers by %s", sample.Round(time.Second))
+		}
+		return
+	}
+	diff := sample - dht.Skew
+	if diff <= DHT_STAMP_TOLERANCE && diff >= -DHT_STAMP_TOLERANCE {
+		dht.Skew += diff / DHT_SKEW_SMOOTHING
+	}
+}
+
+// FreshStamp returns false if message was stamped outside of tolerance
+// window. Messages of routers that neither stamp nor authenticate them
+// are accepted
+func (dht *DHTClient) FreshStamp(data DHTMessage, conn PacketConn) bool {
+	if data.Stamp == "" {
+		return !dht.authenticated(conn)
+	}
+	remote, ok := ParseStamp(data.Stamp)
+	if !ok {
+		return false
+	}
+	diff := remote.Sub(dht.RouterTime())
+	return diff <= DHT_STAMP_TOLERANCE && diff >= -DHT_STAMP_TOLERANCE
+}
+
+// clock returns DHT client which clock of routers is estimated by. Local
+// clock is used before instance has connected to routers
+func (p *PTPCloud) clock() *DHTClient {
+	if p.Dht == nil {
+		return new(DHTClient)
+	}
+	return p.Dht
+}
+
+// Stamp returns timestamp for an introduction. Peers estimate clock of the
+// same routers, so their stamps are comparable
+func (p *PTPCloud) Stamp() string {
+	return p.clock().Stamp()
+}
+
+// FreshIntro returns false if introduction of a peer was stamped outside of
+// tolerance window or before its latest accepted introduction
+func (p *PTPCloud) FreshIntro(id, stamp string) bool {
+	remote, ok := ParseStamp(stamp)
+	if !ok {
+		return false
+	}
+	diff := remote.Sub(p.clock().RouterTime())
+	if diff > DHT_STAMP_TOLERANCE || diff < -DHT_STAMP_TOLERANCE {
+		Log(WARNING, "Introduction of %s was stamped %s away from our clock", id, diff.Round(time.Second))
+		return false
+	}
+	if remote.Before(p.IntroStamp(id)) {
+		Log(WARNING, "Introduction of %s is older than the one accepted before", id)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,146 @@
+package ptp
+
+import (
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func stampAt(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
+
+// session authenticates message of router with the token
+func session(token string, msg DHTMessage) DHTMessage {
+	msg.Mac = MessageMAC(token, msg)
+	return msg
+}
+
+func TestClockSkew(t *testing.T) {
+	dht := new(DHTClient)
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	if !dht.FreshStamp(DHTMessage{}, conn) {
+		t.Errorf("Message of router that doesn't stamp messages was dropped")
+	}
+	// Router is an hour ahead of our bad clock
+	router := time.Now().Add(time.Hour)
+	if dht.FreshStamp(DHTMessage{Stamp: stampAt(router)}, conn) {
+		t.Errorf("Message stamped an hour ahead was accepted before skew was estimated")
+	}
+	dht.ObserveStamp(DHTMessage{Command: CMD_CONN, Stamp: stampAt(router)}, conn)
+	if dht.SkewKnown {
+		t.Errorf("Skew was estimated from message that isn't authenticated")
+	}
+	reply := session("token", DHTMessage{Command: CMD_CONN, Token: "token", Stamp: stampAt(router)})
+	if !dht.Authenticate(reply, conn) {
+		t.Fatalf("Authenticated CONN reply was dropped")
+	}
+	dht.ObserveStamp(reply, conn)
+	if skew := dht.Skew - time.Hour; skew > time.Second || skew < -time.Second {
+		t.Errorf("Skew wasn't estimated: %s", dht.Skew)
+	}
+	if stamp, _ := ParseStamp(dht.Stamp()); stamp.Sub(router) > time.Second {
+		t.Errorf("Outgoing stamp isn't corrected: %s", stamp)
+	}
+	if !dht.FreshStamp(DHTMessage{Stamp: stampAt(router.Add(time.Second * 5))}, conn) {
+		t.Errorf("Message within tolerance was dropped")
+	}
+	replayed := session("token", DHTMessage{Command: CMD_STOP, Stamp: stampAt(router.Add(-time.Minute * 5))})
+	dht.ObserveStamp(replayed, conn)
+	if skew := dht.Skew - time.Hour; skew > time.Second || skew < -time.Second {
+		t.Errorf("Stale message moved skew estimate: %s", dht.Skew)
+	}
+	if dht.FreshStamp(replayed, conn) || dht.FreshStamp(DHTMessage{Stamp: "garbage"}, conn) {
+		t.Errorf("Stale message was accepted")
+	}
+	if dht.FreshStamp(DHTMessage{}, conn) {
+		t.Errorf("Message without stamp was accepted from router that stamps them")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	dht := new(DHTClient)
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	stop := DHTMessage{Command: CMD_STOP, Id: "peer", Stamp: dht.Stamp()}
+	if !dht.Authenticate(stop, conn) {
+		t.Errorf("Message of router that doesn't authenticate messages was dropped")
+	}
+	dht.Authenticate(session("token", DHTMessage{Command: CMD_CONN, Id: "peer", Token: "token", Stamp: dht.Stamp()}), conn)
+	if !dht.Authenticate(session("token", stop), conn) {
+		t.Errorf("Authenticated message was dropped")
+	}
+	if dht.Authenticate(stop, conn) {
+		t.Errorf("Message without MAC was accepted in authenticated session")
+	}
+	forged := session("token", stop)
+	forged.Stamp = stampAt(time.Now().Add(time.Second))
+	if dht.Authenticate(forged, conn) {
+		t.Errorf("Message with replaced stamp was accepted")
+	}
+	unstamped := stop
+	unstamped.Stamp = ""
+	if dht.Authenticate(session("token", unstamped), conn) {
+		t.Errorf("Message without stamp was accepted in authenticated session")
+	}
+	hijack := session("other", DHTMessage{Command: CMD_CONN, Id: "peer", Token: "other", Stamp: dht.Stamp()})
+	if dht.Authenticate(hijack, conn) || !dht.Authenticate(session("token", stop), conn) {
+		t.Errorf("Session was replaced by CONN with another token")
+	}
+}
+
+func TestIntroductionStamp(t *testing.T) {
+	p := new(PTPCloud)
+	p.Mac = "01:02:03:04:05:06"
+	p.IP = "127.0.0.1"
+	p.Identity, _ = GenerateIdentity()
+	sign := func(stamp string) string {
+		intro := p.Identity.ID + "," + p.Mac + "," + p.IP + "," + CAP_IDENTITY + ",," + stamp
+		return intro + "," + p.Identity.PublicKeyString() + "," + hex.EncodeToString(p.Identity.Sign([]byte(intro)))
+	}
+	fresh := string(p.PrepareIntroductionMessage(p.Identity.ID).Data)
+	if !p.VerifyIntroString(fresh) || ParseIntroduction(fresh).Stamp.IsZero() {
+		t.Fatalf("Stamped introduction was refused")
+	}
+	if p.VerifyIntroString(sign(stampAt(time.Now().Add(-time.Hour)))) {
+		t.Errorf("Stale introduction was accepted")
+	}
+	parts := strings.Split(fresh, ",")
+	parts[5] = stampAt(time.Now().Add(time.Second))
+	if p.VerifyIntroString(strings.Join(parts, ",")) {
+		t.Errorf("Introduction with replaced stamp was accepted")
+	}
+	older := sign(stampAt(time.Now().Add(-time.Second * 10)))
+	p.AcceptIntroduction(&NetworkPeer{ID: p.Identity.ID}, ParseIntroduction(fresh))
+	if p.VerifyIntroString(older) {
+		t.Errorf("Introduction older than accepted one was accepted")
+	}
+	unstamped := p.Identity.ID + "," + p.Mac + "," + p.IP + "," + CAP_IDENTITY
+	unstamped += "," + p.Identity.PublicKeyString() + "," + hex.EncodeToString(p.Identity.Sign([]byte(unstamped)))
+	if p.VerifyIntroString(unstamped) {
+		t.Errorf("Unstamped introduction of a peer that stamps them was accepted")
+	}
+}
+
+func TestStaleStop(t *testing.T) {
+	dht := &DHTClient{RemovePeerChan: make(chan string, 1)}
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	dht.HandleStop(DHTMessage{Arguments: "peer", Stamp: stampAt(time.Now().Add(-time.Hour))}, conn)
+	select {
+	case id := <-dht.RemovePeerChan:
+		t.Errorf("Replayed STOP removed peer %s", id)
+	default:
+	}
+	dht.HandleStop(DHTMessage{Arguments: "peer", Stamp: dht.Stamp()}, conn)
+	if len(dht.RemovePeerChan) != 1 {
+		t.Errorf("Fresh STOP was dropped")
+	}
+	<-dht.RemovePeerChan
+	dht.Authenticate(session("token", DHTMessage{Command: CMD_CONN, Token: "token", Stamp: dht.Stamp()}), conn)
+	dht.HandleStop(DHTMessage{Arguments: "peer"}, conn)
+	if len(dht.RemovePeerChan) != 0 {
+		t.Errorf("STOP without stamp was accepted from router that stamps messages")
+	}
+}
@@ -0,0 +1,302 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CommunityRelayConfig lets a member with a public endpoint forward
+// traffic of its own network, so members depend less on central
+// forwarders
+type CommunityRelayConfig struct {
+	Enabled      bool  `yaml:"enabled"`
+	MaxSessions  int   `yaml:"max_sessions"`  // Zero means unlimited
+	MaxBandwidth int64 `yaml:"max_bandwidth"` // Kilobytes per second. Zero means unlimited
+}
+
+// CommunityRelay forwards traffic between members of the network. Instance
+// is promoted to community relay while it has a public address that
+// routers see it at, and registers as a forwarder scoped to its network
+// hash, so routers hand it out to members only. Tunnels are opened for
+// members only as well
+type CommunityRelay struct {
+	relayed    uint64 // Bytes forwarded
+	refused    uint64 // Tunnel requests of hosts that are not members
+	Active     bool
+	Since      time.Time // When instance was promoted
+	Admission  *RelayAdmission
+	tunnels    map[uint16]*relayTunnel
+	next       uint16
+	registered time.Time
+	measured   time.Time // When relayed traffic was last measured
+	measuredAt uint64    // Bytes relayed by then
+	lock       sync.Mutex
+}
+
+// relayTunnel carries traffic of a member to another member
+type relayTunnel struct {
+	src      *net.UDPAddr // Member that opened the tunnel
+	dst      *net.UDPAddr // Endpoint of the member traffic is sent to
+	session  string
+	lastSeen time.Time
+}
+
+// NewCommunityRelay creates relay that is not promoted yet
+func NewCommunityRelay(cfg CommunityRelayConfig) *CommunityRelay {
+	return &CommunityRelay{
+		Admission: NewRelayAdmission(cfg.MaxSessions, cfg.MaxBandwidth*1024),
+		tunnels:   make(map[uint16]*relayTunnel),
+	}
+}
+
+// open creates tunnel from src to dst. Tunnel that src has opened to dst
+// before is reused. Returns false when relay is saturated
+func (c *CommunityRelay) open(src, dst *net.UDPAddr) (uint16, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	session := src.String() + "|" + dst.String()
+	for id, t := range c.tunnels {
+		if t.session == session {
+			t.lastSeen = time.Now()
+			return id, true
+		}
+	}
+	if !c.Admission.Admit(session) {
+		return 0, false
+	}
+	// Zero means direct path and PROXY_REQUEST marks handshakes
+	for {
+		c.next++
+		if _, exists := c.tunnels[c.next]; !exists && c.next != 0 && c.next != PROXY_REQUEST {
+			break
+		}
+	}
+	c.tunnels[c.next] = &relayTunnel{src: src, dst: dst, session: session, lastSeen: time.Now()}
+	return c.next, true
+}
+
+// route returns where message received over the tunnel goes. Member
+// behind symmetric NAT is reached at the address its own tunnel comes
+// from rather than at the endpoint routers know
+func (c *CommunityRelay) route(id uint16, src *net.UDPAddr, size int) (*net.UDPAddr, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t, exists := c.tunnels[id]
+	if !exists || t.src.String() != src.String() {
+		return nil, false
+	}
+	t.lastSeen = time.Now()
+	atomic.AddUint64(&c.relayed, uint64(size))
+	for _, other := range c.tunnels {
+		if other != t && other.src.IP.Equal(t.dst.IP) && other.dst.IP.Equal(t.src.IP) {
+			return other.src, true
+		}
+	}
+	return t.dst, true
+}
+
+// expire closes tunnels that carried nothing for COMMUNITY_TUNNEL_TIMEOUT
+func (c *CommunityRelay) expire(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, t := range c.tunnels {
+		if now.Sub(t.lastSeen) > COMMUNITY_TUNNEL_TIMEOUT {
+			c.Admission.Release(t.session)
+			delete(c.tunnels, id)
+		}
+	}
+}
+
+// measure reports rate of relayed traffic to admission control, so new
+// tunnels are refused once bandwidth limit is nearly reached
+func (c *CommunityRelay) measure(now time.Time) {
+	relayed := atomic.LoadUint64(&c.relayed)
+	if elapsed := now.Sub(c.measured).Seconds(); !c.measured.IsZero() && elapsed > 0 {
+		c.Admission.SetBandwidth(int64(float64(relayed-c.measuredAt) / elapsed))
+	}
+	c.measured = now
+	c.measuredAt = relayed
+}
+
+// demote closes every tunnel. Members fall back to other forwarders once
+// their tunnels stop working
+func (c *CommunityRelay) demote() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, t := range c.tunnels {
+		c.Admission.Release(t.session)
+		delete(c.tunnels, id)
+	}
+	c.Active = false
+	c.registered = time.Time{}
+}
+
+// Tunnels returns number of open tunnels
+func (c *CommunityRelay) Tunnels() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.tunnels)
+}
+
+func (c *CommunityRelay) String() string {
+	if !c.Active {
+		return "Community relay: not promoted"
+	}
+	return fmt.Sprintf("Community relay since %s: %d tunnels, %s relayed, %d requests of non-members refused",
+		c.Since.Format(time.RFC1123), c.Tunnels(), FormatBytes(int64(atomic.LoadUint64(&c.relayed))), atomic.LoadUint64(&c.refused))
+}
+
+// relayEligible returns true if instance may relay traffic of members.
+// Routers must see this host at an address of its own interface, so
+// nothing translates or filters traffic on the way
+func (p *PTPCloud) relayEligible() (bool, string) {
+	if p.Observer != nil {
+		return false, "observer never forwards unicast data"
+	}
+	if p.Private {
+		return false, "privacy mode hides endpoints"
+	}
+	if p.LocalNAT() != NAT_NONE {
+		return false, "host has no public address"
+	}
+	for _, public := range p.PublicIPs() {
+		for _, local := range p.LocalIPs {
+			if public.Equal(local) {
+				return true, ""
+			}
+		}
+	}
+	return false, "routers see this host behind NAT"
+}
+
+// PromoteRelay promotes instance that opted in to community relay once
+// it's eligible, keeps its registration fresh and demotes it when it
+// isn't eligible anymore
+func (p *PTPCloud) PromoteRelay() {
+	if !p.RelayConfig.Enabled || p.Dht == nil {
+		return
+	}
+	if p.Community == nil {
+		p.Community = NewCommunityRelay(p.RelayConfig)
+	}
+	c := p.Community
+	c.expire(time.Now())
+	c.measure(time.Now())
+	eligible, reason := p.relayEligible()
+	if !eligible {
+		if c.Active {
+			Log(INFO, "Instance is not a community relay anymore: %s", reason)
+			c.demote()
+		}
+		return
+	}
+	if !c.Active {
+		c.Active = true
+		c.Since = time.Now()
+		Log(INFO, "Instance was promoted to community relay of network %s", p.Dht.NetworkHash)
+	}
+	if time.Since(c.registered) < COMMUNITY_RELAY_INTERVAL {
+		return
+	}
+	c.registered = time.Now()
+	p.Dht.Relay = c.Admission
+	p.Dht.RegisterCommunityRelay()
+	p.Dht.ReportControlPeerLoad(c.Tunnels())
+}
+
+// isMember returns true if address is an endpoint of a member known from
+// routers or connected peers. Port is ignored when member may be behind
+// symmetric NAT, which assigns a new port for every destination
+func (p *PTPCloud) isMember(addr *net.UDPAddr, matchPort bool) bool {
+	matches := func(a *net.UDPAddr) bool {
+		return a != nil && a.IP.Equal(addr.IP) && (!matchPort || a.Port == addr.Port)
+	}
+	for _, peer := range p.Dht.PeerList() {
+		if peer.ID == p.Dht.ID {
+			continue
+		}
+		for _, ip := range peer.Ips {
+			if matches(ip) {
+				return true
+			}
+		}
+	}
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	for _, peer := range p.NetworkPeers {
+		// Endpoint of relayed peer is its forwarder
+		if matches(peer.PeerAddr) {
+			return true
+		}
+		for _, ip := range peer.KnownIPs {
+			if matches(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HandleTunnelRequest opens tunnel for a member that asks community relay
+// to carry its traffic to another member
+func (p *PTPCloud) HandleTunnelRequest(msg *P2PMessage, src_addr *net.UDPAddr) {
+	c := p.Community
+	if c == nil || !c.Active {
+		return
+	}
+	host, port, err := net.SplitHostPort(string(msg.Data))
+	if err != nil || net.ParseIP(host) == nil {
+		Log(DEBUG, "Bad tunnel request from %s", src_addr)
+		return
+	}
+	dst := &net.UDPAddr{IP: net.ParseIP(host), Port: atoi(port)}
+	if !p.isMember(src_addr, false) || !p.isMember(dst, true) {
+		atomic.AddUint64(&c.refused, 1)
+		Log(DEBUG, "Refusing tunnel from %s to %s: not a member", src_addr, dst)
+		return
+	}
+	id, ok := c.open(src_addr, dst)
+	if !ok {
+		Log(DEBUG, "Community relay is saturated. Refusing tunnel from %s", src_addr)
+		p.UDPSocket.SendMessage(CreateRelayBusyMessage(dst.String(), c.Admission.RetryHint), src_addr)
+		return
+	}
+	Log(DEBUG, "Tunnel %d from %s to %s is open", id, src_addr, dst)
+	p.UDPSocket.SendMessage(CreateProxyP2PMessage(int(id), dst.String(), 0), src_addr)
+}
+
+// relayMessage forwards message received over a tunnel. Returns false if
+// message doesn't belong to any tunnel and is handled by this instance
+func (p *PTPCloud) relayMessage(msg *P2PMessage, buf []byte, src_addr *net.UDPAddr) bool {
+	c := p.Community
+	if c == nil || !c.Active || msg.Header.ProxyId == 0 || msg.Header.Type == MT_PROXY {
+		return false
+	}
+	dst, ok := c.route(msg.Header.ProxyId, src_addr, len(buf))
+	if !ok {
+		return false
+	}
+	if _, err := p.UDPSocket.SendRawBytes(buf, dst); err != nil {
+		Log(DEBUG, "Failed to relay message to %s: %v", dst, err)
+	}
+	return true
+}
+
+// RegisterCommunityRelay registers this instance as a forwarder of its own
+// network. Routers hand it out to members of NetworkHash only
+func (dht *DHTClient) RegisterCommunityRelay() {
+	var req DHTMessage
+	req.Id = dht.ID
+	req.Query = dht.NetworkHash
+	req.Command = CMD_REGCP
+	req.Arguments = strconv.Itoa(dht.P2PPort)
+	if dht.Relay != nil {
+		req.Payload = dht.Relay.Capacity()
+	}
+	req.Stamp = dht.Stamp()
+	dht.Send(dht.EncodeRequest(req))
+}
@@ -0,0 +1,161 @@
+package ptp
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCommunityRelayScope(t *testing.T) {
+	router, err := NewMockRouter()
+	if err != nil {
+		t.Fatalf("Failed to start mock router: %v", err)
+	}
+	router.Start()
+	defer router.Close()
+
+	connect := func(hash string, port int) *DHTClient {
+		config := &DHTClient{Routers: router.Endpoint(), NetworkHash: hash, P2PPort: port}
+		dht := new(DHTClient).Initialize(config, []net.IP{net.ParseIP("192.168.1.10")}, make(chan []PeerIP, 10), make(chan Forwarder, 10))
+		if dht == nil {
+			t.Fatalf("Client failed to connect to mock router")
+		}
+		return dht
+	}
+	relay := connect("mock", 7200)
+	defer relay.Stop()
+	relay.RegisterCommunityRelay()
+	member := connect("mock", 7201)
+	defer member.Stop()
+	stranger := connect("other", 7202)
+	defer stranger.Stop()
+
+	request := func(dht *DHTClient) string {
+		dht.RequestControlPeer("peer", nil)
+		select {
+		case fwd := <-dht.ProxyChannel:
+			return fwd.Addr.String()
+		case <-time.After(time.Millisecond * 300):
+			return ""
+		}
+	}
+	if !waitFor(func() bool { return request(member) == "127.0.0.1:7200" }) {
+		t.Errorf("Community relay wasn't handed out to member")
+	}
+	if fwd := request(stranger); fwd != "" {
+		t.Errorf("Community relay was handed out to another network: %s", fwd)
+	}
+}
+
+func TestCommunityRelayTunnels(t *testing.T) {
+	p := new(PTPCloud)
+	p.UDPSocket = new(PTPNet)
+	if err := p.UDPSocket.Init("127.0.0.1", 0); err != nil {
+		t.Skipf("Can't create UDP socket: %v", err)
+	}
+	defer p.UDPSocket.Stop()
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.Community = NewCommunityRelay(CommunityRelayConfig{Enabled: true})
+	p.Community.Active = true
+	p.MessageHandlers = map[uint16]MessageHandler{MT_PROXY: p.HandleProxyMessage}
+	p.Dht = &DHTClient{ID: "relay"}
+	go p.UDPSocket.Listen(p.HandleP2PMessage)
+
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Failed to create socket: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+	a, b := listen(), listen()
+	defer a.Close()
+	defer b.Close()
+	addrA := a.LocalAddr().(*net.UDPAddr)
+	addrB := b.LocalAddr().(*net.UDPAddr)
+	relay := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p.UDPSocket.GetPort()}
+
+	// Non-members are refused before routers report members
+	a.WriteToUDP(CreateProxyP2PMessage(-1, addrB.String(), 0).Serialize(), relay)
+	if !waitFor(func() bool { return atomic.LoadUint64(&p.Community.refused) == 1 }) {
+		t.Fatalf("Tunnel for a stranger was opened")
+	}
+
+	p.Dht.PeersLock.Lock()
+	p.Dht.Peers = []PeerIP{{ID: "a", Ips: []*net.UDPAddr{addrA}}, {ID: "b", Ips: []*net.UDPAddr{addrB}}}
+	p.Dht.PeersLock.Unlock()
+	a.WriteToUDP(CreateProxyP2PMessage(-1, addrB.String(), 0).Serialize(), relay)
+	buf := make([]byte, 1024)
+	n, err := a.Read(buf)
+	if err != nil {
+		t.Fatalf("Relay didn't confirm tunnel: %v", err)
+	}
+	reply, err := P2PMessageFromBytes(buf[:n])
+	if err != nil || reply.Header.ProxyId == 0 || string(reply.Data) != addrB.String() {
+		t.Fatalf("Wrong confirmation of tunnel: %v %+v", err, reply)
+	}
+
+	data := CreateTestP2PMessage(Crypto{}, "relayed", 0)
+	data.Header.ProxyId = reply.Header.ProxyId
+	a.WriteToUDP(data.Serialize(), relay)
+	n, err = b.Read(buf)
+	if err != nil {
+		t.Fatalf("Relay didn't forward message: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data.Serialize()) {
+		t.Errorf("Message was changed on the way")
+	}
+	if p.Community.Tunnels() != 1 {
+		t.Errorf("Expected 1 tunnel, got %d", p.Community.Tunnels())
+	}
+	p.Community.expire(time.Now().Add(COMMUNITY_TUNNEL_TIMEOUT * 2))
+	if p.Community.Tunnels() != 0 {
+		t.Errorf("Idle tunnel wasn't closed")
+	}
+}
+
+func TestCommunityRelayBandwidth(t *testing.T) {
+	c := NewCommunityRelay(CommunityRelayConfig{Enabled: true, MaxBandwidth: 1})
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6882}
+	dst := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 6882}
+	id, ok := c.open(src, dst)
+	if !ok {
+		t.Fatalf("Tunnel was refused by idle relay")
+	}
+	now := time.Now()
+	c.measure(now)
+	c.route(id, src, 2048)
+	c.measure(now.Add(time.Second))
+	if !c.Admission.Saturated() {
+		t.Fatalf("Relayed traffic wasn't reported to admission control")
+	}
+	if _, ok := c.open(dst, src); ok {
+		t.Errorf("Tunnel was opened over bandwidth limit")
+	}
+	c.measure(now.Add(2 * time.Second))
+	if _, ok := c.open(dst, src); !ok {
+		t.Errorf("Tunnel was refused after traffic ceased")
+	}
+}
+
+func TestRelayEligible(t *testing.T) {
+	p := new(PTPCloud)
+	p.Dht = &DHTClient{ID: "self"}
+	p.LocalIPs = []net.IP{net.ParseIP("203.0.113.7")}
+	p.Dht.Peers = []PeerIP{{ID: "self", Ips: []*net.UDPAddr{{IP: net.ParseIP("203.0.113.7"), Port: 6881}}}}
+	if ok, reason := p.relayEligible(); !ok {
+		t.Errorf("Host with public address wasn't eligible: %s", reason)
+	}
+	p.Observer = new(Observer)
+	if ok, _ := p.relayEligible(); ok {
+		t.Errorf("Observer was eligible")
+	}
+	p.Observer = nil
+	p.Dht.Peers[0].Ips[0].IP = net.ParseIP("198.51.100.1")
+	if ok, _ := p.relayEligible(); ok {
+		t.Errorf("Host seen at another address was eligible")
+	}
+}
@@ -0,0 +1,117 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// AccessPaths lists everything the daemon touches on the host. Reference
+// AppArmor and SELinux policies are generated from it, and in hardened
+// mode the daemon refuses to access anything else
+type AccessPaths struct {
+	Binary  string   // Executable of the daemon
+	Config  string   // Configuration, identities and key files. Read-write
+	State   string   // Saved instances. Read-write
+	Runtime string   // Sockets, like mirror socket
+	Devices []string // Character devices opened by the daemon
+	Tools   []string // Programs the daemon runs to configure the host
+	Proc    []string // Files under /proc read by doctor
+}
+
+// Paths the daemon is confined to in hardened mode. Nil if not confined
+var confinement *AccessPaths
+
+// DefaultPaths returns paths used by the daemon installed in the usual way
+func DefaultPaths() AccessPaths {
+	binary, err := os.Executable()
+	if err != nil {
+		binary = "/usr/bin/p2p"
+	}
+	return AccessPaths{
+		Binary:  binary,
+		Config:  filepath.Join(CONFIG_DIR, "p2p"),
+		State:   "/var/lib/p2p",
+		Runtime: "/run/p2p",
+		Devices: []string{"/dev/net/tun"},
+		Tools:   []string{"/sbin/ip", "/usr/bin/resolvectl"},
+		Proc:    []string{"/proc/sys/net/ipv4/ip_forward"},
+	}
+}
+
+// Confine enables hardened mode: files outside of configuration, state and
+// runtime directories and tools not listed in paths are refused. Nil
+// disables hardened mode
+func Confine(paths *AccessPaths) {
+	confinement = paths
+	if paths != nil {
+		Log(INFO, "Hardened mode: access is confined to %s, %s and %s", paths.Config, paths.State, paths.Runtime)
+	}
+}
+
+// Confined returns true in hardened mode
+func Confined() bool {
+	return confinement != nil
+}
+
+// within returns true if path is the directory or is inside of it
+func within(path, dir string) bool {
+	if dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CheckAccess returns error in hardened mode if file is outside of
+// configuration, state and runtime directories
+func CheckAccess(path string) error {
+	if confinement == nil {
+		return nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{confinement.Config, confinement.State, confinement.Runtime} {
+		if within(abs, dir) {
+			return nil
+		}
+	}
+	for _, dev := range confinement.Devices {
+		if abs == dev {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Hardened mode: %s is outside of allowed paths", path))
+}
+
+// CheckTool returns error in hardened mode if program isn't one of the
+// allowed tools. Programs are compared after resolving symlinks
+func CheckTool(tool string) error {
+	if confinement == nil {
+		return nil
+	}
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return err
+	}
+	resolved := resolveLink(path)
+	for _, allowed := range confinement.Tools {
+		if path == allowed || resolved == resolveLink(allowed) {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Hardened mode: %s is not an allowed tool", tool))
+}
+
+func resolveLink(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
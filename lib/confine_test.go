@@ -0,0 +1,34 @@
+package ptp
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAccess(t *testing.T) {
+	dir := t.TempDir()
+	paths := AccessPaths{
+		Config:  filepath.Join(dir, "config"),
+		State:   filepath.Join(dir, "state"),
+		Runtime: filepath.Join(dir, "run"),
+		Devices: []string{"/dev/net/tun"},
+	}
+	if err := CheckAccess("/etc/passwd"); err != nil {
+		t.Errorf("Access was checked while not confined: %v", err)
+	}
+	Confine(&paths)
+	defer Confine(nil)
+	if !Confined() {
+		t.Fatalf("Hardened mode wasn't enabled")
+	}
+	for _, path := range []string{paths.Config, filepath.Join(paths.State, "p2p.save"), filepath.Join(paths.Runtime, "mirror.sock"), "/dev/net/tun"} {
+		if err := CheckAccess(path); err != nil {
+			t.Errorf("Access to %s was refused: %v", path, err)
+		}
+	}
+	for _, path := range []string{"/etc/passwd", filepath.Join(paths.Config, "../state2/file"), paths.Config + "2", "/dev/null"} {
+		if err := CheckAccess(path); err == nil {
+			t.Errorf("Access to %s was allowed", path)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterFeature(Feature{Name: CONTROL_FEATURE, Description: "Reliable control channel between peers", Rollout: 100})
+}
+
+// ControlHandler processes control message of a topic received from a peer
+type ControlHandler func(peer *NetworkPeer, data []byte)
+
+// ControlMessage is a message of control channel. Messages of a session
+// are numbered from one and delivered to handlers in that order
+type ControlMessage struct {
+	Epoch uint32 // Session of the sender. Numbering starts over in new session
+	Seq   uint32 // Zero for acknowledgement
+	Ack   uint32 // Last message of the session known to be received in order
+	Topic string
+	Data  []byte
+	sent  time.Time
+}
+
+// Marshal returns message in a form of EPOCH|SEQ|ACK|TOPIC|DATA
+func (m *ControlMessage) Marshal() []byte {
+	head := fmt.Sprintf("%d|%d|%d|%s|", m.Epoch, m.Seq, m.Ack, m.Topic)
+	return append([]byte(head), m.Data...)
+}
+
+// ParseControlMessage is the reverse of Marshal
+func ParseControlMessage(data []byte) (*ControlMessage, error) {
+	parts := strings.SplitN(string(data), "|", 5)
+	if len(parts) != 5 {
+		return nil, ErrMalformedMessage
+	}
+	m := &ControlMessage{Topic: parts[3], Data: []byte(parts[4])}
+	for i, field := range []*uint32{&m.Epoch, &m.Seq, &m.Ack} {
+		value, err := strconv.ParseUint(parts[i], 10, 32)
+		if err != nil {
+			return nil, ErrMalformedMessage
+		}
+		*field = uint32(value)
+	}
+	return m, nil
+}
+
+// ControlChannel keeps state of control channel with a single peer:
+// messages waiting for acknowledgement and messages received out of order
+type ControlChannel struct {
+	epoch     uint32
+	sent      uint32 // Last sequence number assigned
+	pending   []*ControlMessage
+	retries   int    // Resends since the last acknowledgement
+	peerEpoch uint32 // Session of the peer
+	received  uint32 // Last message of the peer delivered in order
+	early     map[uint32]*ControlMessage
+	lock      sync.Mutex
+}
+
+// NewControlChannel starts a new session
+func NewControlChannel() *ControlChannel {
+	return &ControlChannel{epoch: uint32(time.Now().UnixNano()) | 1, early: make(map[uint32]*ControlMessage)}
+}
+
+// Queue numbers a message and keeps it until it's acknowledged
+func (c *ControlChannel) Queue(topic string, data []byte) (*ControlMessage, error) {
+	if len(data) > CONTROL_MAX_SIZE {
+		return nil, errors.New(fmt.Sprintf("Control message of %d bytes is too large", len(data)))
+	}
+	if strings.Contains(topic, "|") {
+		return nil, errors.New("Bad topic of control message: " + topic)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.pending) >= CONTROL_QUEUE_SIZE {
+		return nil, errors.New("Control channel is full")
+	}
+	m := &ControlMessage{Epoch: c.epoch, Seq: c.sent + 1, Ack: c.acknowledged(), Topic: topic, Data: data, sent: time.Now()}
+	c.sent++
+	c.pending = append(c.pending, m)
+	return m, nil
+}
+
+// acknowledged returns last message peer has confirmed. Must be called with
+// lock held
+func (c *ControlChannel) acknowledged() uint32 {
+	if len(c.pending) > 0 {
+		return c.pending[0].Seq - 1
+	}
+	return c.sent
+}
+
+// Acknowledge forgets messages of our session peer has received
+func (c *ControlChannel) Acknowledge(epoch, ack uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	i := 0
+	for i < len(c.pending) && c.pending[i].Seq <= ack {
+		i++
+	}
+	if i > 0 {
+		c.pending = c.pending[i:]
+		c.retries = 0
+	}
+}
+
+// Receive returns messages that can be delivered in order after m has
+// arrived and acknowledgement for the peer. Copies are not delivered again.
+// In a new session of the peer delivery starts after the message it
+// knows was received, since that was confirmed by our previous session
+func (c *ControlChannel) Receive(m *ControlMessage) (deliver []*ControlMessage, ack *ControlMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if m.Epoch != c.peerEpoch {
+		c.peerEpoch = m.Epoch
+		c.received = m.Ack
+		c.early = make(map[uint32]*ControlMessage)
+	}
+	if m.Seq > c.received && m.Seq <= c.received+uint32(CONTROL_QUEUE_SIZE) {
+		c.early[m.Seq] = m
+	}
+	for {
+		next, exists := c.early[c.received+1]
+		if !exists {
+			break
+		}
+		delete(c.early, c.received+1)
+		c.received++
+		deliver = append(deliver, next)
+	}
+	return deliver, &ControlMessage{Epoch: c.peerEpoch, Ack: c.received}
+}
+
+// Due returns messages that should be resent. Expired is true when peer
+// didn't acknowledge anything for CONTROL_MAX_RETRIES resends, in which
+// case the queue is dropped
+func (c *ControlChannel) Due(now time.Time) (resend []*ControlMessage, expired bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.pending) == 0 || now.Sub(c.pending[0].sent) < CONTROL_RETRANSMIT {
+		return nil, false
+	}
+	if c.retries >= CONTROL_MAX_RETRIES {
+		c.pending = nil
+		c.retries = 0
+		return nil, true
+	}
+	c.retries++
+	for _, m := range c.pending {
+		m.sent = now
+		copy := *m
+		copy.Ack = c.acknowledged()
+		resend = append(resend, &copy)
+	}
+	return resend, false
+}
+
+// Pending returns number of messages waiting for acknowledgement
+func (c *ControlChannel) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.pending)
+}
+
+// RegisterControlHandler sets handler of control messages of a topic
+func (p *PTPCloud) RegisterControlHandler(topic string, handler ControlHandler) {
+	p.controlLock.Lock()
+	defer p.controlLock.Unlock()
+	if p.controlHandlers == nil {
+		p.controlHandlers = make(map[string]ControlHandler)
+	}
+	p.controlHandlers[topic] = handler
+}
+
+// controlChannel returns control channel with a peer, creating it if needed
+func (p *PTPCloud) controlChannel(id string) *ControlChannel {
+	p.controlLock.Lock()
+	defer p.controlLock.Unlock()
+	if p.controls == nil {
+		p.controls = make(map[string]*ControlChannel)
+	}
+	c, exists := p.controls[id]
+	if !exists {
+		c = NewControlChannel()
+		p.controls[id] = c
+	}
+	return c
+}
+
+// dropControlChannel forgets control channel with a removed peer
+func (p *PTPCloud) dropControlChannel(id string) {
+	p.controlLock.Lock()
+	delete(p.controls, id)
+	p.controlLock.Unlock()
+}
+
+// SendControl delivers message to a handler of the topic on the peer.
+// Messages are resent until acknowledged and handled in the order they
+// were sent. Error is returned if peer doesn't support control channel
+// or too many messages are waiting, so caller can fall back
+func (p *PTPCloud) SendControl(peer *NetworkPeer, topic string, data []byte) error {
+	if !p.FeatureEnabled(peer, CONTROL_FEATURE) {
+		return errors.New("Peer doesn't use control channel")
+	}
+	m, err := p.controlChannel(peer.ID).Queue(topic, data)
+	if err != nil {
+		return err
+	}
+	p.SendTo(peer.PeerHW, CreateControlP2PMessage(p.CurrentCrypter(), p.Dht.ID, m))
+	return nil
+}
+
+// RetransmitControl resends control messages connected peers haven't
+// acknowledged in time
+func (p *PTPCloud) RetransmitControl() {
+	now := time.Now()
+	p.PeersLock.Lock()
+	var peers []*NetworkPeer
+	for _, peer := range p.NetworkPeers {
+		if peer.State == P_CONNECTED {
+			peers = append(peers, peer)
+		}
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		p.controlLock.Lock()
+		c, exists := p.controls[peer.ID]
+		p.controlLock.Unlock()
+		if !exists {
+			continue
+		}
+		resend, expired := c.Due(now)
+		if expired {
+			Log(WARNING, "Peer %s didn't acknowledge control messages. Dropping them", peer.ID)
+		}
+		for _, m := range resend {
+			p.SendTo(peer.PeerHW, CreateControlP2PMessage(p.CurrentCrypter(), p.Dht.ID, m))
+		}
+	}
+}
+
+func CreateControlP2PMessage(c Crypto, id string, m *ControlMessage) *P2PMessage {
+	data := append([]byte(id+"|"), m.Marshal()...)
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_CONTROL)
+	msg.Header.Length = uint16(len(data))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, data)
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = data
+	}
+	return msg
+}
+
+// HandleControlMessage is called when peer sends control message or
+// acknowledges ours
+func (p *PTPCloud) HandleControlMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	parts := strings.SplitN(string(msg.Data), "|", 2)
+	if len(parts) != 2 {
+		Log(DEBUG, "Bad control message from %s: %v", src_addr, ErrMalformedMessage)
+		return
+	}
+	id := parts[0]
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[id]
+	p.PeersLock.Unlock()
+	if !exists || peer.Endpoint == nil || peer.Endpoint.String() != src_addr.String() {
+		Log(DEBUG, "Control message from unknown endpoint %s", src_addr)
+		return
+	}
+	m, err := ParseControlMessage([]byte(parts[1]))
+	if err != nil {
+		Log(DEBUG, "Bad control message from %s: %v", id, err)
+		return
+	}
+	c := p.controlChannel(id)
+	if m.Seq == 0 {
+		c.Acknowledge(m.Epoch, m.Ack)
+		return
+	}
+	deliver, ack := c.Receive(m)
+	p.SendTo(peer.PeerHW, CreateControlP2PMessage(p.CurrentCrypter(), p.Dht.ID, ack))
+	for _, m := range deliver {
+		p.controlLock.Lock()
+		handler, exists := p.controlHandlers[m.Topic]
+		p.controlLock.Unlock()
+		if !exists {
+			Log(DEBUG, "No handler of control topic %s from %s", m.Topic, id)
+			continue
+		}
+		handler(peer, m.Data)
+	}
+}
@@ -0,0 +1,90 @@
+package ptp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlMessage(t *testing.T) {
+	m := &ControlMessage{Epoch: 7, Seq: 3, Ack: 2, Topic: "routes", Data: []byte("10.0.0.0/8|via")}
+	parsed, err := ParseControlMessage(m.Marshal())
+	if err != nil || parsed.Epoch != 7 || parsed.Seq != 3 || parsed.Ack != 2 || parsed.Topic != "routes" || string(parsed.Data) != "10.0.0.0/8|via" {
+		t.Errorf("Wrong message: %+v %v", parsed, err)
+	}
+	for _, bad := range []string{"", "1|2|3", "x|1|0|topic|", "1|-1|0|topic|"} {
+		if _, err := ParseControlMessage([]byte(bad)); err == nil {
+			t.Errorf("Malformed message %q was accepted", bad)
+		}
+	}
+}
+
+func TestControlChannel(t *testing.T) {
+	sender, receiver := NewControlChannel(), NewControlChannel()
+	if _, err := sender.Queue("topic", []byte(strings.Repeat("x", CONTROL_MAX_SIZE+1))); err == nil {
+		t.Errorf("Too large message was queued")
+	}
+	var sent []*ControlMessage
+	for _, data := range []string{"one", "two", "three"} {
+		m, err := sender.Queue("topic", []byte(data))
+		if err != nil {
+			t.Fatalf("Failed to queue message: %v", err)
+		}
+		sent = append(sent, m)
+	}
+
+	// Second message is lost, third arrives early and first comes twice
+	deliver, ack := receiver.Receive(sent[2])
+	if len(deliver) != 0 {
+		t.Errorf("Message was delivered out of order")
+	}
+	deliver, ack = receiver.Receive(sent[0])
+	if len(deliver) != 1 || string(deliver[0].Data) != "one" || ack.Ack != 1 {
+		t.Errorf("Wrong delivery: %v ack %d", deliver, ack.Ack)
+	}
+	if deliver, _ = receiver.Receive(sent[0]); len(deliver) != 0 {
+		t.Errorf("Copy of message was delivered")
+	}
+	sender.Acknowledge(ack.Epoch, ack.Ack)
+	if sender.Pending() != 2 {
+		t.Errorf("Acknowledged message is still pending: %d", sender.Pending())
+	}
+
+	resend, expired := sender.Due(time.Now().Add(CONTROL_RETRANSMIT))
+	if expired || len(resend) != 2 || resend[0].Seq != 2 {
+		t.Errorf("Wrong resend: %v %v", resend, expired)
+	}
+	deliver, ack = receiver.Receive(resend[0])
+	if len(deliver) != 2 || string(deliver[0].Data) != "two" || string(deliver[1].Data) != "three" || ack.Ack != 3 {
+		t.Errorf("Wrong delivery after resend: %v ack %d", deliver, ack.Ack)
+	}
+	sender.Acknowledge(ack.Epoch+1, ack.Ack)
+	if sender.Pending() != 2 {
+		t.Errorf("Acknowledgement of another session was accepted")
+	}
+	sender.Acknowledge(ack.Epoch, ack.Ack)
+	if sender.Pending() != 0 {
+		t.Errorf("Messages are pending after acknowledgement: %d", sender.Pending())
+	}
+
+	// New session of the peer continues from its first message
+	restarted := NewControlChannel()
+	restarted.sent = 40
+	m, _ := restarted.Queue("topic", []byte("again"))
+	if deliver, _ = receiver.Receive(m); len(deliver) != 1 {
+		t.Errorf("Message of new session wasn't delivered")
+	}
+
+	// Queue is dropped when peer never answers
+	m, _ = sender.Queue("topic", nil)
+	now := m.sent
+	for i := 0; i < CONTROL_MAX_RETRIES; i++ {
+		now = now.Add(CONTROL_RETRANSMIT)
+		if _, expired := sender.Due(now); expired {
+			t.Fatalf("Queue expired after %d resends", i)
+		}
+	}
+	if _, expired := sender.Due(now.Add(CONTROL_RETRANSMIT)); !expired || sender.Pending() != 0 {
+		t.Errorf("Queue of unresponsive peer was not dropped")
+	}
+}
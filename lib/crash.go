@@ -0,0 +1,70 @@
+package ptp
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// CrashReport describes a panic that happened in one of instance goroutines
+type CrashReport struct {
+	Time  time.Time
+	Error string
+	Stack string
+}
+
+// Go runs function in a new goroutine. Panic inside of this goroutine
+// is reported to the daemon instead of taking down the whole process
+func (p *PTPCloud) Go(f func()) {
+	p.Resources.started()
+	go func() {
+		defer p.Resources.finished()
+		defer p.Recover()
+		f()
+	}()
+}
+
+// Recover should be deferred by every goroutine of the instance
+func (p *PTPCloud) Recover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	report := &CrashReport{
+		Time:  time.Now(),
+		Error: fmt.Sprintf("%v", r),
+		Stack: string(debug.Stack()),
+	}
+	Log(ERROR, "Instance crashed: %s\n%s", report.Error, report.Stack)
+	p.crashLock.Lock()
+	if p.crash == nil {
+		p.crash = report
+	}
+	// Set before report is published, so whoever sees it sees shutdown too
+	p.Shutdown = true
+	p.crashLock.Unlock()
+}
+
+// Crashed returns report of the first panic or nil if instance is healthy
+func (p *PTPCloud) Crashed() *CrashReport {
+	p.crashLock.Lock()
+	defer p.crashLock.Unlock()
+	return p.crash
+}
+
+// Teardown releases resources of crashed instance. Unlike StopInstance it
+// doesn't wait for instance goroutines, because some of them may be dead,
+// and closes the device itself
+func (p *PTPCloud) Teardown() {
+	p.Shutdown = true
+	p.releaseResources()
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				Log(WARNING, "Failed to close device of crashed instance: %v", r)
+			}
+		}()
+		p.Device.Close()
+	}()
+	p.ReadyToStop = true
+}
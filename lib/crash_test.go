@@ -0,0 +1,47 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecover(t *testing.T) {
+	p := new(PTPCloud)
+	done := make(chan bool)
+	p.Go(func() {
+		defer close(done)
+		panic("test panic")
+	})
+	<-done
+	for i := 0; i < 100 && p.Crashed() == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	report := p.Crashed()
+	if report == nil {
+		t.Fatalf("Panic was not reported")
+	}
+	if report.Error != "test panic" || report.Stack == "" {
+		t.Errorf("Wrong crash report: %v", report)
+	}
+	if !p.Shutdown {
+		t.Errorf("Crashed instance was not shut down")
+	}
+	p.Teardown()
+}
+
+func TestTeardownReleasesResources(t *testing.T) {
+	// Steps that fail on half-initialized instance don't keep others from
+	// running
+	p := new(PTPCloud)
+	p.Writer = NewDeviceWriter(nil)
+	p.Teardown()
+	select {
+	case <-p.Writer.stop:
+	default:
+		t.Errorf("Writer of crashed instance wasn't closed")
+	}
+	if !p.ReadyToStop {
+		t.Errorf("Crashed instance isn't ready to stop")
+	}
+	p.Teardown()
+}
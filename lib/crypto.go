@@ -47,23 +47,46 @@ func (c Crypto) EnrichKeyValues(ckey CryptoKey, key, datetime string) CryptoKey
 	return ckey
 }
 
-func (c Crypto) ReadKeysFromFile(filepath string) {
+// LoadKeyFile reads key and its TTL from yaml file
+func (c Crypto) LoadKeyFile(filepath string) (CryptoKey, error) {
+	var ckey CryptoKey
+	if err := CheckAccess(filepath); err != nil {
+		return ckey, err
+	}
 	yamlFile, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		Log(ERROR, "Failed to read key file yaml: %v", err)
-		c.Active = false
-		return
+		return ckey, err
 	}
-	var ckey CryptoKey
-	err = yaml.Unmarshal(yamlFile, ckey)
+	// CryptoKey itself can't be unmarshaled: name of Key field
+	// clashes with the tag of KeyConfig
+	var config struct {
+		Key string `yaml:"key"`
+		TTL string `yaml:"ttl"`
+	}
+	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
-		Log(ERROR, "Failed to parse config: %v", err)
-		c.Active = false
-		return
+		return ckey, err
 	}
+	ckey.KeyConfig = config.Key
+	ckey.TTLConfig = config.TTL
 	ckey = c.EnrichKeyValues(ckey, ckey.KeyConfig, ckey.TTLConfig)
-	c.Active = true
+	if _, err := aes.NewCipher(ckey.Key); err != nil {
+		return ckey, err
+	}
+	return ckey, nil
+}
+
+func (c *Crypto) ReadKeysFromFile(filepath string) {
+	ckey, err := c.LoadKeyFile(filepath)
+	if err != nil {
+		Log(ERROR, "Failed to read key file: %v", err)
+		return
+	}
 	c.Keys = append(c.Keys, ckey)
+	if !c.Active {
+		c.ActiveKey = ckey
+		c.Active = true
+	}
 }
 
 func (c Crypto) Encrypt(key []byte, data []byte) ([]byte, error) {
@@ -113,3 +136,30 @@ func (c Crypto) Decrypt(key []byte, data []byte) ([]byte, error) {
 	}
 	return decrypted_data, nil
 }
+
+// AddKey adds key to a running instance. Key becomes active if activate
+// is set
+func (p *PTPCloud) AddKey(key CryptoKey, activate bool) {
+	p.crypterLock.Lock()
+	defer p.crypterLock.Unlock()
+	p.Crypter.Keys = append(p.Crypter.Keys, key)
+	if activate {
+		p.Crypter.ActiveKey = key
+		p.Crypter.Active = true
+	}
+}
+
+// CryptoKeys returns copy of keys of the instance
+func (p *PTPCloud) CryptoKeys() []CryptoKey {
+	p.crypterLock.RLock()
+	defer p.crypterLock.RUnlock()
+	return append([]CryptoKey(nil), p.Crypter.Keys...)
+}
+
+// CurrentCrypter returns copy of Crypter that isn't changed when keys of
+// the instance are
+func (p *PTPCloud) CurrentCrypter() Crypto {
+	p.crypterLock.RLock()
+	defer p.crypterLock.RUnlock()
+	return p.Crypter
+}
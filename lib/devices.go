@@ -0,0 +1,30 @@
+package ptp
+
+import (
+	"net"
+)
+
+// PacketConn is a connection to a DHT router. *net.UDPConn implements it,
+// FakeConn replaces it in tests
+type PacketConn interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// TapDevice reads and writes frames of the virtual network interface.
+// *Interface implements it, FakeTap replaces it in tests
+type TapDevice interface {
+	Run()
+	ReadPacket() (*Packet, error)
+	WritePacket(pkt *Packet) error
+	Close() error
+}
+
+// BatchWriter is implemented by devices that can write several frames with
+// a single call. DeviceWriter uses it when available
+type BatchWriter interface {
+	WritePackets(pkts []*Packet) error
+}
@@ -6,8 +6,10 @@ import (
 	bencode "github.com/jackpal/bencode-go"
 	"net"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,7 +30,7 @@ const (
 type DHTClient struct {
 	Routers          string
 	FailedRouters    []string
-	Connection       []*net.UDPConn
+	Connection       []PacketConn // Use Connections() to read it while client runs
 	NetworkHash      string
 	NetworkPeers     []string
 	P2PPort          int
@@ -39,7 +41,7 @@ type DHTClient struct {
 	ProxyBlacklist   []*net.UDPAddr
 	ResponseHandlers map[string]DHTResponseCallback
 	Mode             OperatingMode
-	Shutdown         bool
+	shutdown         uint32 // Set once client is stopped. Accessed atomically
 	IPList           []net.IP
 	State            DHTState
 	IP               net.IP
@@ -51,9 +53,50 @@ type DHTClient struct {
 	ProxyChannel     chan Forwarder
 	LastDHTPing      time.Time
 	RemovePeerChan   chan string
+	RateLimit        *RateLimiter // Limits amount of messages processed of each command
+	portConflict     uint32       // DHT reported that our port can't be used
+	ResumeID         string       // ID that was assigned during first connection
+	ResumeToken      string       // Token that allows to restore ID after reconnect
+	Identity         *Identity    // Key pair that our ID is derived from
+	Recover          func()       // Reports panics of client goroutines
+	Stats            map[string]*RouterStats
+	Migrations       map[PacketConn]PacketConn // New router connections waiting for confirmation mapped to old ones
+	Handshakes       map[PacketConn]chan bool  // Connections waiting for CONN reply
+	Sessions         map[PacketConn]string     // Tokens routers authenticate their messages with
+	Quorum           string                    // Policy applied to conflicting responses of routers
+	FindResponses    map[string]string         // Latest list of peers received from every router
+	DHCPResponses    map[string]string         // Latest DHCP data received from every router
+	PunchHandler     PunchCallback             // Receives hole punching proposals
+	ClaimHandler     ClaimCallback             // Receives claims of other instances
+	HintsHandler     HintsCallback             // Receives configuration hints
+	StopHandler      StopCallback              // Receives reasons of STOP sent to this instance
+	PreferredRelays  []*net.UDPAddr            // Forwarders suggested by routers
+	IPv6Only         bool                      // Host has no IPv4 addresses
+	Secret           []byte                    // Seals local addresses and DHCP data. Nil sends them in the clear
+	Skew             time.Duration             // How far clock of routers is ahead of ours
+	SkewKnown        bool                      // Skew was estimated from a message of a router
+	Relay            *RelayAdmission           // Admission control of this forwarder. Nil unless instance relays traffic
+	SaturatedRelays  map[string]time.Time      // Forwarders that refused sessions and when they may be tried again
+	PeerQueue        *QueueStats               // Counters of PeerChannel
+	ProxyQueue       *QueueStats               // Counters of ProxyChannel
+	ResponsesLock    sync.Mutex
+	PeersLock        sync.Mutex // Guards Peers
+	ConnectionLock   sync.Mutex // Guards Connection
+	LeaseLock        sync.Mutex // Guards IP and Network
+	SecretLock       sync.Mutex // Guards Secret, which is replaced with network key
+	StatsLock        sync.Mutex
 	ForwardersLock   sync.Mutex // To avoid multiple read-write
 }
 
+// RouterStats keeps statistics of traffic exchanged with a single router
+type RouterStats struct {
+	Address  string
+	Sent     uint64
+	Received uint64
+	Errors   uint64
+	LastPing time.Time
+}
+
 type Forwarder struct {
 	Addr          *net.UDPAddr
 	DestinationID string
@@ -64,7 +107,7 @@ type PeerIP struct {
 	Ips []*net.UDPAddr
 }
 
-type DHTResponseCallback func(data DHTMessage, conn *net.UDPConn)
+type DHTResponseCallback func(data DHTMessage, conn PacketConn)
 
 func (dht *DHTClient) DHTClientConfig() *DHTClient {
 	return &DHTClient{
@@ -75,10 +118,10 @@ func (dht *DHTClient) DHTClientConfig() *DHTClient {
 }
 
 // AddConnection adds new UDP Connection reference onto list of DHT node connections
-func (dht *DHTClient) AddConnection(connections []*net.UDPConn, conn *net.UDPConn) []*net.UDPConn {
+func (dht *DHTClient) AddConnection(connections []PacketConn, conn PacketConn) []PacketConn {
 	n := len(connections)
 	if n == cap(connections) {
-		newSlice := make([]*net.UDPConn, len(connections), 2*len(connections)+1)
+		newSlice := make([]PacketConn, len(connections), 2*len(connections)+1)
 		copy(newSlice, connections)
 		connections = newSlice
 	}
@@ -87,7 +130,7 @@ func (dht *DHTClient) AddConnection(connections []*net.UDPConn, conn *net.UDPCon
 	return connections
 }
 
-func (dht *DHTClient) Handshake(conn *net.UDPConn) error {
+func (dht *DHTClient) Handshake(conn PacketConn) error {
 	// Handshake
 	var req DHTMessage
 	req.Id = "0"
@@ -96,8 +139,30 @@ func (dht *DHTClient) Handshake(conn *net.UDPConn) error {
 	// TODO: rename Port to something more clear
 	req.Arguments = fmt.Sprintf("%d", dht.P2PPort)
 	req.Payload = dht.NetworkHash
-	for _, ip := range dht.IPList {
-		req.Arguments = req.Arguments + "|" + ip.String()
+	req.Stamp = dht.Stamp()
+	if len(dht.secret()) > 0 && len(dht.IPList) > 0 {
+		// Router can't append port to sealed addresses
+		var endpoints []string
+		for _, ip := range dht.IPList {
+			endpoints = append(endpoints, JoinEndpoint(ip.String(), dht.P2PPort))
+		}
+		req.Arguments = req.Arguments + "|" + dht.seal(strings.Join(endpoints, "|"))
+	} else {
+		for _, ip := range dht.IPList {
+			req.Arguments = req.Arguments + "|" + ip.String()
+		}
+	}
+	if dht.Identity != nil {
+		// Propose ID derived from our public key, so router can
+		// verify it and assign the same ID on every connection
+		req.Id = dht.Identity.ID
+		req.PublicKey = dht.Identity.PublicKeyString()
+	}
+	if dht.ResumeToken != "" {
+		// Ask router to restore previous session, so peers
+		// will not see us as a new node
+		req.Id = dht.ResumeID
+		req.Token = dht.ResumeToken
 	}
 	var b bytes.Buffer
 	if err := bencode.Marshal(&b, req); err != nil {
@@ -107,10 +172,11 @@ func (dht *DHTClient) Handshake(conn *net.UDPConn) error {
 	}
 	// TODO: Optimize types here
 	msg := b.String()
-	if dht.Shutdown {
+	if dht.Stopped() {
 		return nil
 	}
 	_, err := conn.Write([]byte(msg))
+	dht.CountSent(conn, err)
 	if err != nil {
 		Log(ERROR, "Failed to send packet: %v", err)
 		conn.Close()
@@ -119,27 +185,79 @@ func (dht *DHTClient) Handshake(conn *net.UDPConn) error {
 	return nil
 }
 
-// ConnectAndHandshake sends an initial packet to a DHT bootstrap node
-func (dht *DHTClient) ConnectAndHandshake(router string, ips []net.IP) (*net.UDPConn, error) {
+// ConnectAndHandshake connects to a DHT bootstrap node and handshakes with
+// it. Listener of the connection is started, so CONN reply can be received.
+// Returns error if router didn't assign an ID
+func (dht *DHTClient) ConnectAndHandshake(router string, ips []net.IP) (PacketConn, error) {
 	dht.State = D_CONNECTING
 	Log(INFO, "Connecting to a router %s", router)
-	addr, err := net.ResolveUDPAddr("udp", router)
+	addr, err := dht.Resolve(router)
 	if err != nil {
 		Log(ERROR, "Failed to resolve discovery service address: %v", err)
 		return nil, err
 	}
 
-	conn, err := net.DialUDP("udp4", nil, addr)
+	conn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
 		Log(ERROR, "Failed to establish connection to discovery service: %v", err)
 		return nil, err
 	}
 
 	Log(INFO, "Ready to peer discovery via %s [%s]", router, conn.RemoteAddr().String())
+	go dht.ListenDHT(conn)
+	err = dht.AwaitHandshake(conn, DHT_HANDSHAKE_ATTEMPTS, DHT_HANDSHAKE_TIMEOUT)
+	if err != nil {
+		// Stops the listener
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	err = dht.Handshake(conn)
+// AwaitHandshake sends handshake and retransmits it until router replies
+// with CONN. Timeout is doubled after every attempt
+func (dht *DHTClient) AwaitHandshake(conn PacketConn, attempts int, timeout time.Duration) error {
+	confirmed := make(chan bool, 1)
+	dht.StatsLock.Lock()
+	if dht.Handshakes == nil {
+		dht.Handshakes = make(map[PacketConn]chan bool)
+	}
+	dht.Handshakes[conn] = confirmed
+	dht.StatsLock.Unlock()
+	defer func() {
+		dht.StatsLock.Lock()
+		delete(dht.Handshakes, conn)
+		dht.StatsLock.Unlock()
+	}()
+	for i := 0; i < attempts && !dht.Stopped(); i++ {
+		if i > 0 {
+			Log(DEBUG, "No reply from router %s. Sending handshake again", conn.RemoteAddr().String())
+		}
+		err := dht.Handshake(conn)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-confirmed:
+			return nil
+		case <-time.After(timeout):
+		}
+		timeout *= 2
+	}
+	return fmt.Errorf("%w: router %s didn't confirm connection", ErrHandshakeTimeout, conn.RemoteAddr().String())
+}
 
-	return conn, err
+// confirmHandshake wakes up AwaitHandshake waiting for this connection
+func (dht *DHTClient) confirmHandshake(conn PacketConn) {
+	dht.StatsLock.Lock()
+	confirmed, exists := dht.Handshakes[conn]
+	dht.StatsLock.Unlock()
+	if exists {
+		select {
+		case confirmed <- true:
+		default:
+		}
+	}
 }
 
 // Extracts DHTMessage from received packet
@@ -212,8 +330,8 @@ func (dht *DHTClient) UpdateLastCatch(catch string) {
 // target node we want to connect to
 func (dht *DHTClient) RequestPeerIPs(id string) {
 	msg := dht.Compose(CMD_NODE, dht.ID, id, "")
-	for _, conn := range dht.Connection {
-		if dht.Shutdown {
+	for _, conn := range dht.Connections() {
+		if dht.Stopped() {
 			continue
 		}
 		_, err := conn.Write([]byte(msg))
@@ -228,7 +346,7 @@ func (dht *DHTClient) RequestPeerIPs(id string) {
 // This method should be called periodically in case any new peers was discovered
 func (dht *DHTClient) UpdatePeers() {
 	for {
-		if dht.Shutdown {
+		if dht.Stopped() {
 			break
 		}
 		dht.SendUpdateRequest()
@@ -239,8 +357,8 @@ func (dht *DHTClient) UpdatePeers() {
 
 func (dht *DHTClient) SendUpdateRequest() {
 	msg := dht.Compose(CMD_FIND, dht.ID, dht.NetworkHash, "")
-	for _, conn := range dht.Connection {
-		if dht.Shutdown {
+	for _, conn := range dht.Connections() {
+		if dht.Stopped() {
 			continue
 		}
 		Log(DEBUG, "Updating peers from %s", conn.RemoteAddr().String())
@@ -254,33 +372,50 @@ func (dht *DHTClient) SendUpdateRequest() {
 // Listens for packets received from DHT bootstrap node
 // Every packet is unmarshaled and turned into Request structure
 // which we should analyze and respond
-func (dht *DHTClient) ListenDHT(conn *net.UDPConn) {
+func (dht *DHTClient) ListenDHT(conn PacketConn) {
+	if dht.Recover != nil {
+		defer dht.Recover()
+	}
 	defer conn.Close()
+	defer dht.forgetSession(conn)
 	Log(INFO, "Bootstraping via %s", conn.RemoteAddr().String())
 	dht.Listeners++
 	var failCounter = 0
 	for {
-		if dht.Shutdown {
+		if dht.Stopped() {
 			Log(INFO, "Closing DHT Connection to %s", conn.RemoteAddr().String())
-			conn.Close()
-			for i, c := range dht.Connection {
-				if c.RemoteAddr().String() == conn.RemoteAddr().String() {
-					dht.Connection = append(dht.Connection[:i], dht.Connection[i+1:]...)
-				}
-			}
+			dht.removeConnection(conn)
 			break
 		}
 		var buf [512]byte
-		_, _, err := conn.ReadFromUDP(buf[0:])
+		_, err := conn.Read(buf[0:])
 		if err != nil {
 			Log(DEBUG, "Failed to read from Discovery Service: %v", err)
+			if !dht.HasConnection(conn) {
+				// Connection was replaced after reconnect
+				break
+			}
+			dht.CountError(conn)
 			failCounter++
 		} else {
 			failCounter = 0
+			dht.CountReceived(conn)
 			data, err := dht.Extract(buf[:512])
+			if err == nil && !dht.Authenticate(data, conn) {
+				Log(WARNING, "Dropping %s from %s: message isn't authenticated", data.Command, conn.RemoteAddr().String())
+				continue
+			}
+			if err == nil && dht.RateLimit != nil && !dht.RateLimit.Allow(data.Command) {
+				// Every router relays messages of the whole network, so
+				// a flood of one command mustn't starve the others
+				Log(TRACE, "DHT rate limit exceeded for %s from %s", data.Command, conn.RemoteAddr().String())
+				continue
+			}
 			if err != nil {
 				Log(ERROR, "Failed to extract a message received from discovery service: %v", err)
+				dht.CountError(conn)
 			} else {
+				dht.ObserveStamp(data, conn)
 				callback, exists := dht.ResponseHandlers[data.Command]
 				if exists {
 					Log(TRACE, "DHT Received %v", data)
@@ -298,10 +433,7 @@ func (dht *DHTClient) ListenDHT(conn *net.UDPConn) {
 	dht.Listeners--
 }
 
-func (dht *DHTClient) HandleConn(data DHTMessage, conn *net.UDPConn) {
-	if dht.State != D_CONNECTING && dht.State != D_RECONNECTING {
-		return
-	}
+func (dht *DHTClient) HandleConn(data DHTMessage, conn PacketConn) {
 	if data.Id == "" {
 		Log(ERROR, "Empty ID was received")
 		return
@@ -310,8 +442,25 @@ func (dht *DHTClient) HandleConn(data DHTMessage, conn *net.UDPConn) {
 		Log(ERROR, "Empty ID were received. Stopping")
 		return
 	}
+	// Every router confirms connection, while only the first one
+	// assigns ID
+	dht.confirmHandshake(conn)
+	if dht.State != D_CONNECTING && dht.State != D_RECONNECTING {
+		return
+	}
 	dht.State = D_OPERATING
+	if dht.ResumeID != "" && dht.ResumeID != data.Id {
+		Log(WARNING, "Router didn't resume session %s. New ID was assigned", dht.ResumeID)
+	}
+	if data.Token != "" {
+		dht.ResumeToken = data.Token
+	}
+	if dht.Identity != nil && dht.Identity.ID != data.Id {
+		Log(WARNING, "Router assigned ID %s that doesn't match our identity %s. Introductions won't be signed", data.Id, dht.Identity.ID)
+	}
+	dht.ResumeID = data.Id
 	dht.ID = data.Id
+	dht.CompleteMigration(conn)
 	Log(INFO, "Received connection confirmation from router %s",
 		conn.RemoteAddr().String())
 	Log(INFO, "Received personal ID for this session: %s", data.Id)
@@ -321,7 +470,7 @@ func (dht *DHTClient) HandleConn(data DHTMessage, conn *net.UDPConn) {
 	// first connected node.
 	/*
 		msg := dht.Compose(CMD_FIND, dht.ID, dht.NetworkHash, "")
-		if dht.Shutdown {
+		if dht.Stopped() {
 			return
 		}
 		_, err := conn.Write([]byte(msg))
@@ -335,80 +484,106 @@ func (dht *DHTClient) HandleConn(data DHTMessage, conn *net.UDPConn) {
 	*/
 }
 
-func (dht *DHTClient) HandlePing(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandlePing(data DHTMessage, conn PacketConn) {
 	Log(TRACE, "Ping message from DHT")
 	dht.LastDHTPing = time.Now()
+	dht.StatsLock.Lock()
+	dht.routerStats(conn).LastPing = dht.LastDHTPing
+	dht.StatsLock.Unlock()
 	msg := dht.Compose(CMD_PING, dht.ID, "", "")
 	_, err := conn.Write([]byte(msg))
+	dht.CountSent(conn, err)
 	if err != nil {
 		Log(ERROR, "Failed to send 'ping' packet: %v", err)
 	}
 }
 
-func (dht *DHTClient) HandleFind(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleFind(data DHTMessage, conn PacketConn) {
+	// Routers may disagree about the list of peers. Lists of all routers
+	// are merged according to quorum policy, so a single stale router
+	// can't remove live peers
+	var lists [][]string
+	for _, response := range dht.recordResponse(dht.FindResponses, conn, data.Arguments) {
+		lists = append(lists, strings.Split(response, ","))
+	}
+	ids := ResolveQuorum(dht.Quorum, lists)
+	dht.PeersLock.Lock()
 	// This means we've received a list of nodes we can connect to
-	if data.Arguments != "" {
-		ids := strings.Split(data.Arguments, ",")
-		if len(ids) == 0 {
-			Log(ERROR, "Malformed list of peers received")
-		} else {
-			// Go over list of received peer IDs and look if we know
-			// anything about them. Add every new peer into list of peers
-			for _, id := range ids {
-				var found bool = false
-				for _, peer := range dht.Peers {
-					if peer.ID == id {
-						found = true
-					}
-				}
-				if !found {
-					var p PeerIP
-					p.ID = id
-					dht.Peers = append(dht.Peers, p)
+	if len(ids) > 0 {
+		// Go over list of received peer IDs and look if we know
+		// anything about them. Add every new peer into list of peers
+		for _, id := range ids {
+			var found bool = false
+			for _, peer := range dht.Peers {
+				if peer.ID == id {
+					found = true
 				}
 			}
-			for i, peer := range dht.Peers {
-				var found bool = false
-				for _, id := range ids {
-					if peer.ID == id {
-						found = true
-					}
-				}
-				if !found {
-					Log(INFO, "Removing")
-					dht.Peers = append(dht.Peers[:i], dht.Peers[i+1:]...)
+			if !found {
+				var p PeerIP
+				p.ID = id
+				dht.Peers = append(dht.Peers, p)
+			}
+		}
+		var peers []PeerIP
+		for _, peer := range dht.Peers {
+			var found bool = false
+			for _, id := range ids {
+				if peer.ID == id {
+					found = true
 				}
 			}
-			dht.PeerChannel <- dht.Peers
-			Log(DEBUG, "Received peers from %s: %s", conn.RemoteAddr().String(), data.Arguments)
-			dht.UpdateLastCatch(data.Arguments)
+			if found {
+				peers = append(peers, peer)
+			} else {
+				Log(INFO, "Removing %s", peer.ID)
+			}
 		}
+		dht.Peers = peers
+		dht.PeersLock.Unlock()
+		dht.sendPeers(peers)
+		Log(DEBUG, "Received peers from %s: %s", conn.RemoteAddr().String(), data.Arguments)
+		dht.UpdateLastCatch(data.Arguments)
 	} else {
 		dht.Peers = dht.Peers[:0]
+		dht.PeersLock.Unlock()
 	}
 }
 
-func (dht *DHTClient) HandleRegCp(data DHTMessage, conn *net.UDPConn) {
+// PeerList returns a copy of peers received from routers
+func (dht *DHTClient) PeerList() []PeerIP {
+	dht.PeersLock.Lock()
+	defer dht.PeersLock.Unlock()
+	return append([]PeerIP(nil), dht.Peers...)
+}
+
+func (dht *DHTClient) HandleRegCp(data DHTMessage, conn PacketConn) {
 	Log(INFO, "Control peer has been registered in Service Discovery Peer")
 	// We've received a registration confirmation message from DHT bootstrap node
 }
 
-func (dht *DHTClient) HandleNode(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleNode(data DHTMessage, conn PacketConn) {
 	// We've received an IPs associated with target node
 	Log(DEBUG, "Received IPs from %s: %v", data.Id, data.Arguments)
+	dht.PeersLock.Lock()
+	defer dht.PeersLock.Unlock()
 	for i, peer := range dht.Peers {
 		if peer.ID == data.Id {
-			ips := strings.Split(data.Arguments, "|")
+			ips := dht.openList(data.Arguments)
 			var list []*net.UDPAddr
 			for _, addr := range ips {
 				if addr == "" {
 					continue
 				}
-				ip, err := net.ResolveUDPAddr("udp", addr)
+				ip, err := ResolveEndpoint(addr, false)
 				if err != nil {
 					Log(ERROR, "Failed to resolve address of peer: %v", err)
 					continue
 				}
+				if !dht.Reachable(ip) {
+					Log(DEBUG, "Skipping IPv4 address %s of peer on IPv6-only host", ip)
+					continue
+				}
 				list = append(list, ip)
 			}
 			dht.Peers[i].Ips = list
@@ -421,34 +596,46 @@ func (dht *DHTClient) NotifyPeerAboutProxy(id string) {
 
 }
 
-func (dht *DHTClient) HandleCp(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleCp(data DHTMessage, conn PacketConn) {
 	// We've received information about proxy
 	if data.Query == "0" || data.Query == "" {
 		return
 	}
+	if !dht.FreshStamp(data, conn) {
+		Log(WARNING, "Dropping stale forwarder assignment from %s", conn.RemoteAddr().String())
+		return
+	}
 	Log(INFO, "Received forwarder %s", data.Query)
-	addr, err := net.ResolveUDPAddr("udp", data.Query)
+	addr, err := ResolveEndpoint(data.Query, false)
 	if err != nil {
 		Log(ERROR, "Received invalid forwarder: %v", err)
 		return
 	}
+	if !dht.Reachable(addr) {
+		Log(INFO, "Forwarder %s doesn't speak IPv6. Asking for another one", addr)
+		dht.BlacklistForwarder(addr)
+		return
+	}
 	var fwd Forwarder
 	fwd.Addr = addr
 	fwd.DestinationID = data.Arguments
-	dht.ProxyChannel <- fwd
+	dht.sendProxy(fwd)
 	found := false
 	for _, f := range dht.Forwarders {
 		if f.Addr.String() == fwd.Addr.String() && f.DestinationID == fwd.DestinationID {
 			found = true
 		}
 	}
-	if !found {
+	if !found && dht.IsPreferredRelay(addr) {
+		// Cached forwarders are looked up in order
+		dht.Forwarders = append([]Forwarder{fwd}, dht.Forwarders...)
+	} else if !found {
 		dht.Forwarders = append(dht.Forwarders, fwd)
 	}
 	/*
 		msg := dht.Compose(CMD_NOTIFY, dht.ID, dht.ID, data.Id)
-		for _, conn := range dht.Connection {
-			if dht.Shutdown {
+		for _, conn := range dht.Connections() {
+			if dht.Stopped() {
 				continue
 			}
 			_, err := conn.Write([]byte(msg))
@@ -478,8 +665,8 @@ func (dht *DHTClient) HandleCp(data DHTMessage, conn *net.UDPConn) {
 				Log(DEBUG, "Control peer has been added to the list of forwarders")
 				Log(DEBUG, "Sending notify request back to the DHT")
 				msg := dht.Compose(CMD_NOTIFY, dht.ID, dht.ID, data.Id)
-				for _, conn := range dht.Connection {
-					if dht.Shutdown {
+				for _, conn := range dht.Connections() {
+					if dht.Stopped() {
 						continue
 					}
 					_, err := conn.Write([]byte(msg))
@@ -492,7 +679,7 @@ func (dht *DHTClient) HandleCp(data DHTMessage, conn *net.UDPConn) {
 	*/
 }
 
-func (dht *DHTClient) HandleNotify(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleNotify(data DHTMessage, conn PacketConn) {
 	// Notify means we should ask DHT bootstrap node for a control peer
 	// in order to connect to a node that can't reach us
 	// TODO: Fix this
@@ -500,35 +687,81 @@ func (dht *DHTClient) HandleNotify(data DHTMessage, conn *net.UDPConn) {
 	dht.RequestControlPeer(data.Id, l)
 }
 
-func (dht *DHTClient) HandleStop(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleStop(data DHTMessage, conn PacketConn) {
+	if !dht.FreshStamp(data, conn) {
+		Log(WARNING, "Dropping stale STOP from %s", conn.RemoteAddr().String())
+		return
+	}
+	notice := ParseStopNotice(data.Payload)
 	if data.Arguments != "" {
 		// We need to stop particular peer by changing it's state to
 		// P_DISCONNECT
-		Log(INFO, "Stop command for %s", data.Arguments)
+		if notice != nil {
+			Log(INFO, "Stop command for %s: %s", data.Arguments, notice.Reason)
+		} else {
+			Log(INFO, "Stop command for %s", data.Arguments)
+		}
 		dht.RemovePeerChan <- data.Arguments
-	} else {
-		conn.Close()
+		return
 	}
+	if notice != nil {
+		notice.Router = conn.RemoteAddr().String()
+		if dht.StopHandler != nil {
+			dht.StopHandler(notice)
+		}
+	}
+	conn.Close()
 }
 
-func (dht *DHTClient) HandleDHCP(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleDHCP(data DHTMessage, conn PacketConn) {
 	if data.Arguments == "ok" {
 		Log(INFO, "DHCP Registration confirmed")
 		return
 	} else {
 		Log(INFO, "Received DHCP Information")
 	}
-	ip, ipnet, err := net.ParseCIDR(data.Arguments)
+	var err error
+	data.Arguments, err = dht.open(data.Arguments)
+	if err != nil {
+		Log(ERROR, "Failed to open DHCP packet: %v", err)
+		return
+	}
+	_, _, err = net.ParseCIDR(data.Arguments)
 	if err != nil {
 		Log(ERROR, "Failed to parse received DHCP packet: %v", err)
 		return
 	}
+	responses := dht.recordResponse(dht.DHCPResponses, conn, data.Arguments)
+	value := ResolveValue(dht.Quorum, responses)
+	if value == "" {
+		Log(WARNING, "Routers disagree about DHCP data. Waiting for quorum")
+		return
+	}
+	if value != data.Arguments {
+		Log(WARNING, "Router %s sent DHCP data %s that differs from quorum %s", conn.RemoteAddr().String(), data.Arguments, value)
+	}
+	ip, ipnet, _ := net.ParseCIDR(value)
 	Log(INFO, "Saving IP/Net data: %s", ip)
+	dht.SetLease(ip, ipnet)
+}
+
+// Lease returns address and network assigned by routers. Both are nil
+// until routers answer
+func (dht *DHTClient) Lease() (net.IP, *net.IPNet) {
+	dht.LeaseLock.Lock()
+	defer dht.LeaseLock.Unlock()
+	return dht.IP, dht.Network
+}
+
+// SetLease saves address and network of this instance
+func (dht *DHTClient) SetLease(ip net.IP, network *net.IPNet) {
+	dht.LeaseLock.Lock()
 	dht.IP = ip
-	dht.Network = ipnet
+	dht.Network = network
+	dht.LeaseLock.Unlock()
 }
 
-func (dht *DHTClient) HandleUnknown(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleUnknown(data DHTMessage, conn PacketConn) {
 	Log(WARNING, "DHT server refuses our identity")
 	if dht.State == D_CONNECTING || dht.State == D_RECONNECTING {
 		time.Sleep(3 * time.Second)
@@ -541,13 +774,22 @@ func (dht *DHTClient) HandleUnknown(data DHTMessage, conn *net.UDPConn) {
 	}
 }
 
-func (dht *DHTClient) HandleError(data DHTMessage, conn *net.UDPConn) {
+func (dht *DHTClient) HandleError(data DHTMessage, conn PacketConn) {
 	e, exists := ErrorList[ErrorType(data.Arguments)]
 	if !exists {
 		Log(ERROR, "Unknown error were received from DHT: %s", data.Arguments)
 	} else {
 		Log(ERROR, "DHT returned error: %s", e.Error())
 	}
+	if ErrorType(data.Arguments) == ERR_PORT_CONFLICT {
+		atomic.StoreUint32(&dht.portConflict, 1)
+	}
+}
+
+// PortConflict returns whether DHT has reported that our port can't be
+// used since the last call
+func (dht *DHTClient) PortConflict() bool {
+	return atomic.SwapUint32(&dht.portConflict, 0) == 1
 }
 
 // This method initializes DHT by splitting list of routers and connect to each one
@@ -556,9 +798,15 @@ func (dht *DHTClient) Initialize(config *DHTClient, ips []net.IP, peerChan chan
 	dht = config
 	dht.PeerChannel = peerChan
 	dht.ProxyChannel = proxyChan
+	dht.PeerQueue = NewQueueStats("peers")
+	dht.ProxyQueue = NewQueueStats("forwarders")
 	routers := strings.Split(dht.Routers, ",")
 	dht.FailedRouters = make([]string, len(routers))
 	dht.ResponseHandlers = make(map[string]DHTResponseCallback)
+	dht.RateLimit = NewRateLimiter(DHT_RATE_LIMIT, DHT_RATE_BURST)
+	dht.Stats = make(map[string]*RouterStats)
+	dht.FindResponses = make(map[string]string)
+	dht.DHCPResponses = make(map[string]string)
 	if dht.Mode != MODE_CP && dht.Mode != MODE_CLIENT {
 		dht.Mode = MODE_CLIENT
 	}
@@ -568,6 +816,10 @@ func (dht *DHTClient) Initialize(config *DHTClient, ips []net.IP, peerChan chan
 		dht.ResponseHandlers[CMD_CP] = dht.HandleCp
 		dht.ResponseHandlers[CMD_NOTIFY] = dht.HandleNotify
 		dht.ResponseHandlers[CMD_STOP] = dht.HandleStop
+		dht.ResponseHandlers[CMD_MIGRATE] = dht.HandleMigrate
+		dht.ResponseHandlers[CMD_PUNCH] = dht.HandlePunch
+		dht.ResponseHandlers[CMD_CLAIM] = dht.HandleClaim
+		dht.ResponseHandlers[CMD_HINTS] = dht.HandleHints
 	} else {
 		Log(INFO, "DHT operating in CONTROL PEER mode")
 		dht.ResponseHandlers[CMD_REGCP] = dht.HandleRegCp
@@ -579,19 +831,33 @@ func (dht *DHTClient) Initialize(config *DHTClient, ips []net.IP, peerChan chan
 	dht.ResponseHandlers[CMD_UNKNOWN] = dht.HandleUnknown
 	dht.ResponseHandlers[CMD_ERROR] = dht.HandleError
 	dht.IPList = ips
+	dht.IPv6Only = IsIPv6Only(ips)
+	if dht.IPv6Only {
+		Log(INFO, "Host has no IPv4 addresses. Using IPv6 only")
+	}
 	var connected int = 0
-	for _, router := range routers {
-		conn, err := dht.ConnectAndHandshake(router, dht.IPList)
-		if err != nil || conn == nil {
-			Log(ERROR, "Failed to handshake with a DHT Server: %v", err)
-			dht.FailedRouters[0] = router
-		} else {
-			Log(INFO, "Handshaked. Starting listener")
-			dht.Connection = append(dht.Connection, conn)
+	// Routers are handshaked in parallel, so unreachable ones don't
+	// delay the rest
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for i, router := range routers {
+		wg.Add(1)
+		go func(i int, router string) {
+			defer wg.Done()
+			conn, err := dht.ConnectAndHandshake(router, dht.IPList)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				Log(ERROR, "Failed to handshake with a DHT Server: %v", err)
+				dht.FailedRouters[i] = router
+				return
+			}
+			Log(INFO, "Handshaked with %s", router)
+			dht.addConnection(conn)
 			connected += 1
-			go dht.ListenDHT(conn)
-		}
+		}(i, router)
 	}
+	wg.Wait()
 	started := time.Now()
 	period := time.Duration(time.Second * 3)
 	for len(dht.ID) != 36 {
@@ -602,6 +868,11 @@ func (dht *DHTClient) Initialize(config *DHTClient, ips []net.IP, peerChan chan
 		}
 	}
 	dht.LastDHTPing = time.Now()
+	dht.StatsLock.Lock()
+	for _, conn := range dht.Connections() {
+		dht.routerStats(conn).LastPing = dht.LastDHTPing
+	}
+	dht.StatsLock.Unlock()
 	if connected == 0 {
 		return nil
 	} else {
@@ -620,6 +891,10 @@ func (dht *DHTClient) RegisterControlPeer() {
 	req.Query = "0"
 	req.Command = CMD_REGCP
 	req.Arguments = fmt.Sprintf("%d", dht.P2PPort)
+	if dht.Relay != nil {
+		req.Payload = dht.Relay.Capacity()
+	}
+	req.Stamp = dht.Stamp()
 	var b bytes.Buffer
 	if err := bencode.Marshal(&b, req); err != nil {
 		Log(ERROR, "Failed to Marshal bencode %v", err)
@@ -627,8 +902,8 @@ func (dht *DHTClient) RegisterControlPeer() {
 	}
 	// TODO: Optimize types here
 	msg := b.String()
-	for _, conn := range dht.Connection {
-		if dht.Shutdown {
+	for _, conn := range dht.Connections() {
+		if dht.Stopped() {
 			continue
 		}
 		_, err = conn.Write([]byte(msg))
@@ -646,12 +921,13 @@ func (dht *DHTClient) RequestControlPeer(id string, omit []*net.UDPAddr) {
 	var err error
 	req.Id = dht.ID
 	req.Query = ""
-	// Collect list of failed forwarders
-	for _, fwd := range omit {
+	// Collect list of failed and saturated forwarders
+	for _, fwd := range append(omit, dht.SaturatedList()...) {
 		req.Query += fwd.String() + "|"
 	}
 	req.Command = CMD_CP
 	req.Arguments = id
+	req.Stamp = dht.Stamp()
 	var b bytes.Buffer
 	if err := bencode.Marshal(&b, req); err != nil {
 		Log(ERROR, "Failed to Marshal bencode %v", err)
@@ -659,8 +935,8 @@ func (dht *DHTClient) RequestControlPeer(id string, omit []*net.UDPAddr) {
 	}
 	msg := b.String()
 	// TODO: Move sending to a separate method
-	for _, conn := range dht.Connection {
-		if dht.Shutdown {
+	for _, conn := range dht.Connections() {
+		if dht.Stopped() {
 			continue
 		}
 		_, err = conn.Write([]byte(msg))
@@ -677,6 +953,9 @@ func (dht *DHTClient) ReportControlPeerLoad(amount int) {
 	req.Id = dht.ID
 	req.Command = CMD_LOAD
 	req.Arguments = fmt.Sprintf("%d", amount)
+	if dht.Relay != nil {
+		req.Payload = dht.Relay.Load()
+	}
 	var b bytes.Buffer
 	if err := bencode.Marshal(&b, req); err != nil {
 		Log(ERROR, "Failed to Marshal bencode %v", err)
@@ -686,11 +965,12 @@ func (dht *DHTClient) ReportControlPeerLoad(amount int) {
 }
 
 func (dht *DHTClient) Send(msg string) bool {
-	for _, conn := range dht.Connection {
-		if dht.Shutdown {
+	for _, conn := range dht.Connections() {
+		if dht.Stopped() {
 			continue
 		}
 		_, err := conn.Write([]byte(msg))
+		dht.CountSent(conn, err)
 		if err != nil {
 			Log(ERROR, "Failed to send DHT packet: %v", err)
 			return false
@@ -710,29 +990,40 @@ func (dht *DHTClient) RequestIP() {
 // Notify DHT about configured IP and netmask
 func (dht *DHTClient) SendIP(ip string, mask string) {
 	Log(INFO, "Sending DHCP information")
-	req := dht.Compose(CMD_DHCP, dht.ID, ip, mask)
+	req := dht.Compose(CMD_DHCP, dht.ID, dht.seal(ip), dht.seal(mask))
 	dht.Send(req)
 }
 
+// Stopped returns true once client was stopped. Listeners quit on it
+func (dht *DHTClient) Stopped() bool {
+	return atomic.LoadUint32(&dht.shutdown) == 1
+}
+
+// halt stops listeners of the client without telling routers
+func (dht *DHTClient) halt() {
+	atomic.StoreUint32(&dht.shutdown, 1)
+}
+
 func (dht *DHTClient) Stop() {
-	dht.Shutdown = true
+	dht.halt()
 	var req DHTMessage
 	req.Id = dht.ID
 	req.Command = CMD_STOP
 	req.Arguments = "0"
+	req.Stamp = dht.Stamp()
 	var b bytes.Buffer
 	if err := bencode.Marshal(&b, req); err != nil {
 		Log(ERROR, "Failed to Marshal bencode %v", err)
 		return
 	}
 	msg := b.String()
-	for _, conn := range dht.Connection {
+	for _, conn := range dht.Connections() {
 		conn.Write([]byte(msg))
 	}
 }
 
 func (dht *DHTClient) ReadFromDHT() {
-	for !dht.Shutdown {
+	for !dht.Stopped() {
 
 	}
 }
@@ -778,3 +1069,133 @@ func (dht *DHTClient) CleanForwarderBlacklist() {
 	Log(DEBUG, "Cleaning forwarders blacklist")
 	dht.ProxyBlacklist = dht.ProxyBlacklist[:0]
 }
+
+// routerStats returns statistics of router on the other side of connection.
+// StatsLock should be held by the caller
+func (dht *DHTClient) routerStats(conn PacketConn) *RouterStats {
+	if dht.Stats == nil {
+		dht.Stats = make(map[string]*RouterStats)
+	}
+	addr := conn.RemoteAddr().String()
+	stats, exists := dht.Stats[addr]
+	if !exists {
+		stats = &RouterStats{Address: addr, LastPing: time.Now()}
+		dht.Stats[addr] = stats
+	}
+	return stats
+}
+
+// CountSent updates statistics after packet was sent to a router
+func (dht *DHTClient) CountSent(conn PacketConn, err error) {
+	dht.StatsLock.Lock()
+	if err != nil {
+		dht.routerStats(conn).Errors++
+	} else {
+		dht.routerStats(conn).Sent++
+	}
+	dht.StatsLock.Unlock()
+}
+
+// CountReceived updates statistics after packet was received from a router
+func (dht *DHTClient) CountReceived(conn PacketConn) {
+	dht.StatsLock.Lock()
+	dht.routerStats(conn).Received++
+	dht.StatsLock.Unlock()
+}
+
+// CountError updates statistics after failed read or malformed packet
+func (dht *DHTClient) CountError(conn PacketConn) {
+	dht.StatsLock.Lock()
+	dht.routerStats(conn).Errors++
+	dht.StatsLock.Unlock()
+}
+
+// GetStats returns copy of statistics of every router
+func (dht *DHTClient) GetStats() []RouterStats {
+	dht.StatsLock.Lock()
+	defer dht.StatsLock.Unlock()
+	var stats []RouterStats
+	for _, s := range dht.Stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+	return stats
+}
+
+// Connections returns a copy of connections to routers, so they can be
+// iterated while routers are connected and replaced
+func (dht *DHTClient) Connections() []PacketConn {
+	dht.ConnectionLock.Lock()
+	defer dht.ConnectionLock.Unlock()
+	return append([]PacketConn(nil), dht.Connection...)
+}
+
+// HasConnection returns true if connection is still used by the client
+func (dht *DHTClient) HasConnection(conn PacketConn) bool {
+	dht.ConnectionLock.Lock()
+	defer dht.ConnectionLock.Unlock()
+	for _, c := range dht.Connection {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// addConnection starts using connection to a router
+func (dht *DHTClient) addConnection(conn PacketConn) {
+	dht.ConnectionLock.Lock()
+	dht.Connection = append(dht.Connection, conn)
+	dht.ConnectionLock.Unlock()
+}
+
+// removeConnection closes connection and stops using it
+func (dht *DHTClient) removeConnection(conn PacketConn) {
+	dht.ConnectionLock.Lock()
+	for i, c := range dht.Connection {
+		if c == conn {
+			dht.Connection = append(dht.Connection[:i], dht.Connection[i+1:]...)
+			break
+		}
+	}
+	dht.ConnectionLock.Unlock()
+	conn.Close()
+}
+
+// DeadRouters returns connections to routers that didn't ping us for
+// longer than specified timeout
+func (dht *DHTClient) DeadRouters(timeout time.Duration) []PacketConn {
+	dht.StatsLock.Lock()
+	defer dht.StatsLock.Unlock()
+	var dead []PacketConn
+	for _, conn := range dht.Connections() {
+		if time.Since(dht.routerStats(conn).LastPing) > timeout {
+			dead = append(dead, conn)
+		}
+	}
+	return dead
+}
+
+// ReconnectRouter replaces connection to a router that stopped responding.
+// Connections to other routers are not affected
+func (dht *DHTClient) ReconnectRouter(conn PacketConn) {
+	addr := conn.RemoteAddr().(*net.UDPAddr)
+	Log(INFO, "Reconnecting to router %s", addr)
+	dht.StatsLock.Lock()
+	// Give new connection some time before it's considered dead
+	dht.routerStats(conn).LastPing = time.Now()
+	dht.StatsLock.Unlock()
+	dht.removeConnection(conn)
+	newConn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		Log(ERROR, "Failed to reconnect to router %s: %v", addr, err)
+		return
+	}
+	dht.addConnection(newConn)
+	go dht.ListenDHT(newConn)
+	dht.State = D_RECONNECTING
+	err = dht.Handshake(newConn)
+	if err != nil {
+		Log(ERROR, "Failed to handshake with router %s: %v", addr, err)
+	}
+}
@@ -1,7 +1,10 @@
 package ptp
 
 import (
+	"errors"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestExtract(t *testing.T) {
@@ -15,3 +18,158 @@ func TestExtract(t *testing.T) {
 		t.Errorf("Error during DHT message extraction")
 	}
 }
+
+func TestExtractToken(t *testing.T) {
+	var m string = "d1:a0:1:c4:conn1:i36:00000000-1111-2222-3333-4444444444441:p0:1:q1:01:t5:tokene"
+	var dht DHTClient
+	result, err := dht.Extract([]byte(m))
+	if err != nil {
+		t.Errorf("Error during DHT message extraction: %v", err)
+	}
+	if result.Token != "token" {
+		t.Errorf("Failed to extract resumption token: %s", result.Token)
+	}
+}
+
+func TestRouterStats(t *testing.T) {
+	dht := new(DHTClient)
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881})
+	if err != nil {
+		t.Skipf("Can't create UDP socket: %v", err)
+	}
+	defer conn.Close()
+	dht.Connection = append(dht.Connection, conn)
+	dht.CountSent(conn, nil)
+	dht.CountSent(conn, errors.New("test"))
+	dht.CountReceived(conn)
+	stats := dht.GetStats()
+	if len(stats) != 1 || stats[0].Sent != 1 || stats[0].Received != 1 || stats[0].Errors != 1 {
+		t.Errorf("Wrong router statistics: %v", stats)
+	}
+	if len(dht.DeadRouters(time.Minute)) != 0 {
+		t.Errorf("Router was reported dead right after connection")
+	}
+	dht.Stats[conn.RemoteAddr().String()].LastPing = time.Now().Add(-2 * time.Minute)
+	if len(dht.DeadRouters(time.Minute)) != 1 {
+		t.Errorf("Silent router was not reported dead")
+	}
+}
+
+func TestHandleNodeAndCp(t *testing.T) {
+	router := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	conn := NewFakeConn(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}, router)
+	dht := new(DHTClient)
+	dht.Peers = []PeerIP{{ID: "peer"}}
+	dht.HandleNode(DHTMessage{Id: "peer", Arguments: "192.168.1.5:5000|bad address|[2001:db8::5]:5000"}, conn)
+	if len(dht.Peers[0].Ips) != 2 || dht.Peers[0].Ips[1].String() != "[2001:db8::5]:5000" {
+		t.Errorf("Wrong addresses of peer: %v", dht.Peers[0].Ips)
+	}
+
+	dht.ProxyChannel = make(chan Forwarder, 1)
+	dht.HandleCp(DHTMessage{Query: "10.0.0.3:7000", Arguments: "peer"}, conn)
+	fwd := <-dht.ProxyChannel
+	if fwd.Addr.String() != "10.0.0.3:7000" || fwd.DestinationID != "peer" || len(dht.Forwarders) != 1 {
+		t.Errorf("Forwarder wasn't saved: %+v", fwd)
+	}
+
+	// IPv6-only host asks for another forwarder instead of IPv4 one
+	dht.IPv6Only = true
+	dht.HandleCp(DHTMessage{Query: "10.0.0.4:7000", Arguments: "peer"}, conn)
+	if len(dht.Forwarders) != 1 || len(dht.ProxyBlacklist) != 1 {
+		t.Errorf("Unreachable forwarder was accepted")
+	}
+}
+
+func TestListenDHTFake(t *testing.T) {
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	dht := new(DHTClient)
+	dht.Connection = []PacketConn{conn}
+	dht.RateLimit = NewRateLimiter(DHT_RATE_LIMIT, DHT_RATE_BURST)
+	dht.Stats = make(map[string]*RouterStats)
+	pinged := make(chan bool, 1)
+	dht.ResponseHandlers = map[string]DHTResponseCallback{
+		CMD_PING: func(data DHTMessage, c PacketConn) { pinged <- c == conn },
+	}
+	go dht.ListenDHT(conn)
+	conn.Deliver([]byte(dht.Compose(CMD_PING, "0", "", "")))
+	select {
+	case ok := <-pinged:
+		if !ok {
+			t.Errorf("Handler received wrong connection")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Packet delivered to fake connection wasn't handled")
+	}
+	dht.halt()
+	conn.Close()
+}
+
+func TestListenDHTRateLimit(t *testing.T) {
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	dht := new(DHTClient)
+	dht.Connection = []PacketConn{conn}
+	dht.RateLimit = NewRateLimiter(0.1, 2)
+	dht.Stats = make(map[string]*RouterStats)
+	handled := make(chan string, 10)
+	dht.ResponseHandlers = map[string]DHTResponseCallback{
+		CMD_PING:  func(data DHTMessage, c PacketConn) { handled <- data.Command },
+		CMD_PUNCH: func(data DHTMessage, c PacketConn) { handled <- data.Command },
+	}
+	go dht.ListenDHT(conn)
+	for i := 0; i < 5; i++ {
+		conn.Deliver([]byte(dht.Compose(CMD_PUNCH, "0", "", "")))
+	}
+	conn.Deliver([]byte(dht.Compose(CMD_PING, "0", "", "")))
+	punches := 0
+	for pinged := false; !pinged; {
+		select {
+		case command := <-handled:
+			if command == CMD_PUNCH {
+				punches++
+			} else {
+				pinged = true
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Flood of one command has starved the others")
+		}
+	}
+	if punches != 2 || dht.RateLimit.Dropped() != 3 {
+		t.Errorf("Flood wasn't limited: %d handled, %d dropped", punches, dht.RateLimit.Dropped())
+	}
+	dht.halt()
+	conn.Close()
+}
+
+func TestAwaitHandshake(t *testing.T) {
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	dht := new(DHTClient)
+	dht.State = D_CONNECTING
+	dht.Stats = make(map[string]*RouterStats)
+	dht.ResponseHandlers = map[string]DHTResponseCallback{CMD_CONN: dht.HandleConn}
+	go dht.ListenDHT(conn)
+	go func() {
+		// Router answers the second handshake only
+		for len(conn.Sent()) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		conn.Deliver([]byte(dht.Compose(CMD_CONN, "12345678-1234-1234-1234-123456789012", "", "")))
+	}()
+	err := dht.AwaitHandshake(conn, 3, 20*time.Millisecond)
+	if err != nil {
+		t.Errorf("Handshake failed: %v", err)
+	}
+	if dht.ID != "12345678-1234-1234-1234-123456789012" {
+		t.Errorf("ID wasn't assigned")
+	}
+
+	silent := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6881})
+	err = dht.AwaitHandshake(silent, 2, 10*time.Millisecond)
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Errorf("Expected handshake timeout, got %v", err)
+	}
+	if len(silent.Sent()) != 2 {
+		t.Errorf("Handshake was sent %d times instead of 2", len(silent.Sent()))
+	}
+	dht.halt()
+	conn.Close()
+}
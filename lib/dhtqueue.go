@@ -0,0 +1,119 @@
+package ptp
+
+import (
+	"sync/atomic"
+)
+
+// QueueStats counts events passed from DHT listener to the instance.
+// Listener never waits for the instance: when queue is full the oldest
+// event is dropped, so a slow consumer can't freeze discovery and pings
+// of routers
+type QueueStats struct {
+	delivered uint64
+	dropped   uint64
+	peak      uint64
+	Name      string
+}
+
+// QueueSnapshot is a point-in-time copy of QueueStats
+type QueueSnapshot struct {
+	Name      string
+	Depth     int
+	Capacity  int
+	Peak      uint64 // Largest depth seen
+	Delivered uint64 // Events put into the queue
+	Dropped   uint64 // Events dropped in favor of newer ones
+}
+
+// NewQueueStats creates counters of a queue
+func NewQueueStats(name string) *QueueStats {
+	return &QueueStats{Name: name}
+}
+
+// queued counts event put into the queue of specified depth. Stats may
+// be nil when DHT client wasn't initialized, like in tests
+func (qs *QueueStats) queued(depth int) {
+	if qs == nil {
+		return
+	}
+	atomic.AddUint64(&qs.delivered, 1)
+	for {
+		peak := atomic.LoadUint64(&qs.peak)
+		if uint64(depth) <= peak || atomic.CompareAndSwapUint64(&qs.peak, peak, uint64(depth)) {
+			return
+		}
+	}
+}
+
+// drop counts event that was dropped
+func (qs *QueueStats) drop() {
+	if qs != nil {
+		atomic.AddUint64(&qs.dropped, 1)
+	}
+}
+
+// Snapshot returns counters of the queue with its current depth
+func (qs *QueueStats) Snapshot(depth, capacity int) QueueSnapshot {
+	return QueueSnapshot{
+		Name:      qs.Name,
+		Depth:     depth,
+		Capacity:  capacity,
+		Peak:      atomic.LoadUint64(&qs.peak),
+		Delivered: atomic.LoadUint64(&qs.delivered),
+		Dropped:   atomic.LoadUint64(&qs.dropped),
+	}
+}
+
+// sendPeers passes list of peers to the instance without blocking. Each
+// list replaces the previous one, so dropping stale lists loses nothing
+func (dht *DHTClient) sendPeers(peers []PeerIP) {
+	for {
+		select {
+		case dht.PeerChannel <- peers:
+			dht.PeerQueue.queued(len(dht.PeerChannel))
+			return
+		default:
+		}
+		dht.PeerQueue.drop()
+		select {
+		case <-dht.PeerChannel:
+		default:
+			// Unbuffered channel without a waiting reader
+			return
+		}
+	}
+}
+
+// sendProxy passes forwarder to the instance without blocking. Oldest
+// forwarder is dropped when queue is full: peer that waits for it asks
+// for another one on timeout
+func (dht *DHTClient) sendProxy(fwd Forwarder) {
+	for {
+		select {
+		case dht.ProxyChannel <- fwd:
+			dht.ProxyQueue.queued(len(dht.ProxyChannel))
+			return
+		default:
+		}
+		dht.ProxyQueue.drop()
+		select {
+		case old := <-dht.ProxyChannel:
+			Log(WARNING, "Forwarder queue is full. Dropping forwarder %s of %s", old.Addr, old.DestinationID)
+		default:
+			Log(WARNING, "Instance doesn't read forwarders. Dropping forwarder %s of %s", fwd.Addr, fwd.DestinationID)
+			return
+		}
+	}
+}
+
+// Queues returns counters of queues between DHT listener and the instance
+func (dht *DHTClient) Queues() []QueueSnapshot {
+	var result []QueueSnapshot
+	if dht.PeerQueue != nil {
+		result = append(result, dht.PeerQueue.Snapshot(len(dht.PeerChannel), cap(dht.PeerChannel)))
+	}
+	if dht.ProxyQueue != nil {
+		result = append(result, dht.ProxyQueue.Snapshot(len(dht.ProxyChannel), cap(dht.ProxyChannel)))
+	}
+	return result
+}
@@ -0,0 +1,45 @@
+package ptp
+
+import (
+	"testing"
+)
+
+func TestDHTQueues(t *testing.T) {
+	dht := &DHTClient{
+		PeerChannel:  make(chan []PeerIP, 2),
+		ProxyChannel: make(chan Forwarder),
+		PeerQueue:    NewQueueStats("peers"),
+		ProxyQueue:   NewQueueStats("forwarders"),
+	}
+	for i := 0; i < 3; i++ {
+		dht.sendPeers([]PeerIP{{ID: string(rune('a' + i))}})
+	}
+	if peers := <-dht.PeerChannel; peers[0].ID != "b" {
+		t.Errorf("Oldest list of peers was not dropped: got %s", peers[0].ID)
+	}
+
+	// Nobody reads unbuffered channel, but sender must not wait
+	dht.sendProxy(Forwarder{DestinationID: "c"})
+
+	queues := dht.Queues()
+	if len(queues) != 2 {
+		t.Fatalf("Expected 2 queues, got %d", len(queues))
+	}
+	peers := queues[0]
+	if peers.Depth != 1 || peers.Capacity != 2 || peers.Peak != 2 || peers.Delivered != 3 || peers.Dropped != 1 {
+		t.Errorf("Wrong counters of peers queue: %+v", peers)
+	}
+	proxy := queues[1]
+	if proxy.Delivered != 0 || proxy.Dropped != 1 {
+		t.Errorf("Wrong counters of forwarders queue: %+v", proxy)
+	}
+
+	// Stats are optional
+	var empty DHTClient
+	empty.PeerChannel = make(chan []PeerIP, 1)
+	empty.sendPeers(nil)
+	empty.sendPeers(nil)
+	if len(empty.Queues()) != 0 {
+		t.Errorf("Client without stats reported queues")
+	}
+}
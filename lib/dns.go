@@ -0,0 +1,224 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNSRule sends queries for a domain and its subdomains to a resolver on
+// the virtual network
+type DNSRule struct {
+	Domain   string
+	Resolver net.IP
+}
+
+func (r DNSRule) String() string {
+	return r.Domain + "=" + r.Resolver.String()
+}
+
+// ParseDNSRules parses comma-separated list of DOMAIN=RESOLVER rules
+func ParseDNSRules(list string) ([]DNSRule, error) {
+	var rules []DNSRule
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, "=")
+		if len(parts) != 2 {
+			return nil, errors.New(fmt.Sprintf("Rule %s is not in a form of DOMAIN=RESOLVER", item))
+		}
+		domain := strings.Trim(strings.ToLower(strings.TrimSpace(parts[0])), ".")
+		if !validDomain(domain) {
+			return nil, errors.New(fmt.Sprintf("Bad domain in rule %s", item))
+		}
+		resolver := net.ParseIP(strings.TrimSpace(parts[1]))
+		if resolver == nil {
+			return nil, errors.New(fmt.Sprintf("Bad resolver address in rule %s", item))
+		}
+		rules = append(rules, DNSRule{Domain: domain, Resolver: resolver})
+	}
+	return rules, nil
+}
+
+// validDomain checks that domain consists of letters, digits, hyphens and
+// dots only. Domains are passed to system tools, so nothing else is allowed
+func validDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, c := range domain {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return !strings.Contains(domain, "..")
+}
+
+// FormatDNSRules is the reverse of ParseDNSRules
+func FormatDNSRules(rules []DNSRule) string {
+	var items []string
+	for _, r := range rules {
+		items = append(items, r.String())
+	}
+	return strings.Join(items, ",")
+}
+
+// dnsResolvers returns distinct resolvers of the rules
+func dnsResolvers(rules []DNSRule) []string {
+	var resolvers []string
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		if !seen[r.Resolver.String()] {
+			seen[r.Resolver.String()] = true
+			resolvers = append(resolvers, r.Resolver.String())
+		}
+	}
+	return resolvers
+}
+
+// OnVirtualNetwork returns true when address belongs to the subnet of the
+// virtual interface
+func (p *PTPCloud) OnVirtualNetwork(ip net.IP) bool {
+	local := net.ParseIP(p.IP)
+	mask := net.ParseIP(p.Mask).To4()
+	if local == nil || mask == nil || ip == nil {
+		return false
+	}
+	return local.Mask(net.IPMask(mask)).Equal(ip.Mask(net.IPMask(mask)))
+}
+
+// PushDNS sends split-DNS rules of this instance to connected peers. Rules
+// are sent again every DNS_PUSH_INTERVAL, so peers that missed them or
+// restarted catch up
+func (p *PTPCloud) PushDNS() {
+	if len(p.SplitDNS) == 0 || time.Since(p.lastDNSPush) < DNS_PUSH_INTERVAL {
+		return
+	}
+	p.lastDNSPush = time.Now()
+	p.PeersLock.Lock()
+	var peers []*NetworkPeer
+	for _, peer := range p.NetworkPeers {
+		if peer.State == P_CONNECTED {
+			peers = append(peers, peer)
+		}
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		p.SendDNS(peer)
+	}
+}
+
+// SendDNS sends split-DNS rules of this instance to a peer
+func (p *PTPCloud) SendDNS(peer *NetworkPeer) {
+	if len(p.SplitDNS) == 0 {
+		return
+	}
+	Log(DEBUG, "Sending split-DNS rules to %s", peer.ID)
+	p.SendTo(peer.PeerHW, CreateDNSP2PMessage(p.CurrentCrypter(), p.Dht.ID, p.SplitDNS))
+}
+
+func CreateDNSP2PMessage(c Crypto, id string, rules []DNSRule) *P2PMessage {
+	data := id + "|" + FormatDNSRules(rules)
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_DNS)
+	msg.Header.Length = uint16(len(data))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, []byte(data))
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = []byte(data)
+	}
+	return msg
+}
+
+// HandleDNSMessage is called when peer pushes its split-DNS rules
+func (p *PTPCloud) HandleDNSMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	parts := strings.SplitN(string(msg.Data), "|", 2)
+	if len(parts) != 2 {
+		Log(DEBUG, "Bad split-DNS rules from %s: %v", src_addr, ErrMalformedMessage)
+		return
+	}
+	id := parts[0]
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[id]
+	p.PeersLock.Unlock()
+	if !exists || peer.Endpoint == nil || peer.Endpoint.String() != src_addr.String() {
+		Log(DEBUG, "Split-DNS rules from unknown endpoint %s", src_addr)
+		return
+	}
+	rules, err := ParseDNSRules(parts[1])
+	if err == nil {
+		err = p.ApplyDNS(id, rules)
+	}
+	if err != nil {
+		Log(WARNING, "Split-DNS rules of %s were not installed: %v", id, err)
+	}
+}
+
+// ApplyDNS installs split-DNS rules pushed by a provider. Rules of a single
+// provider are installed at a time and every resolver must be on the
+// virtual network, so queries never leave the tunnel
+func (p *PTPCloud) ApplyDNS(provider string, rules []DNSRule) error {
+	if !p.AcceptDNS {
+		return errors.New("Instance doesn't accept split-DNS rules")
+	}
+	for _, r := range rules {
+		if !p.OnVirtualNetwork(r.Resolver) {
+			return errors.New(fmt.Sprintf("Resolver %s is not on the virtual network", r.Resolver))
+		}
+	}
+	p.dnsLock.Lock()
+	defer p.dnsLock.Unlock()
+	if p.DNSProvider != "" && p.DNSProvider != provider {
+		p.PeersLock.Lock()
+		_, exists := p.NetworkPeers[p.DNSProvider]
+		p.PeersLock.Unlock()
+		if exists {
+			return errors.New(fmt.Sprintf("Rules of %s are already installed", p.DNSProvider))
+		}
+	}
+	if p.DNSProvider == provider && FormatDNSRules(p.DNSInstalled) == FormatDNSRules(rules) {
+		return nil
+	}
+	if len(p.DNSInstalled) > 0 {
+		if err := removeSplitDNS(p.DeviceName, p.DNSInstalled); err != nil {
+			Log(WARNING, "Failed to remove split-DNS rules: %v", err)
+		}
+		p.DNSInstalled = nil
+	}
+	p.DNSProvider = provider
+	if len(rules) == 0 {
+		Log(INFO, "Peer %s has withdrawn its split-DNS rules", provider)
+		return nil
+	}
+	if err := installSplitDNS(p.DeviceName, rules); err != nil {
+		return err
+	}
+	Log(INFO, "Installed split-DNS rules of %s: %s", provider, FormatDNSRules(rules))
+	p.DNSInstalled = rules
+	return nil
+}
+
+// RemoveDNS removes installed split-DNS rules when instance goes down
+func (p *PTPCloud) RemoveDNS() {
+	p.dnsLock.Lock()
+	defer p.dnsLock.Unlock()
+	if len(p.DNSInstalled) == 0 {
+		return
+	}
+	if err := removeSplitDNS(p.DeviceName, p.DNSInstalled); err != nil {
+		Log(WARNING, "Failed to remove split-DNS rules: %v", err)
+	}
+	p.DNSInstalled = nil
+	p.DNSProvider = ""
+}
@@ -0,0 +1,46 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// scutil feeds commands to scutil
+func scutil(commands string) error {
+	cmd := exec.Command("scutil")
+	cmd.Stdin = strings.NewReader(commands)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("scutil: %v: %s", err, strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+// dnsServiceKey returns key of dynamic store that holds a rule
+func dnsServiceKey(device string, i int) string {
+	return fmt.Sprintf("State:/Network/Service/p2p-%s-%d/DNS", device, i)
+}
+
+// installSplitDNS publishes supplemental resolver configuration for every
+// rule, so queries for the domain go to its resolver
+func installSplitDNS(device string, rules []DNSRule) error {
+	var commands string
+	for i, r := range rules {
+		commands += "d.init\n" +
+			"d.add ServerAddresses * " + r.Resolver.String() + "\n" +
+			"d.add SupplementalMatchDomains * " + r.Domain + "\n" +
+			"set " + dnsServiceKey(device, i) + "\n"
+	}
+	return scutil(commands)
+}
+
+// removeSplitDNS removes configuration published by installSplitDNS
+func removeSplitDNS(device string, rules []DNSRule) error {
+	var commands string
+	for i := range rules {
+		commands += "remove " + dnsServiceKey(device, i) + "\n"
+	}
+	return scutil(commands)
+}
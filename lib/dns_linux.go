@@ -0,0 +1,40 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// resolvectl runs resolvectl of systemd-resolved
+func resolvectl(args ...string) error {
+	if err := CheckTool("resolvectl"); err != nil {
+		return err
+	}
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("resolvectl %s: %v: %s", args[0], err, strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+// installSplitDNS configures resolvers and routing domains of the TAP
+// interface in systemd-resolved. Resolvers are set per interface, so every
+// domain is sent to all resolvers of the rules
+func installSplitDNS(device string, rules []DNSRule) error {
+	err := resolvectl(append([]string{"dns", device}, dnsResolvers(rules)...)...)
+	if err != nil {
+		return err
+	}
+	domains := []string{"domain", device}
+	for _, r := range rules {
+		domains = append(domains, "~"+r.Domain)
+	}
+	return resolvectl(domains...)
+}
+
+// removeSplitDNS drops DNS configuration of the TAP interface
+func removeSplitDNS(device string, rules []DNSRule) error {
+	return resolvectl("revert", device)
+}
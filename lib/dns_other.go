@@ -0,0 +1,16 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package ptp
+
+import (
+	"errors"
+)
+
+func installSplitDNS(device string, rules []DNSRule) error {
+	return errors.New("Split DNS is not supported on this platform")
+}
+
+func removeSplitDNS(device string, rules []DNSRule) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseDNSRules(t *testing.T) {
+	rules, err := ParseDNSRules("Corp.Example.=10.0.0.53, lab=10.0.0.54")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	if s := FormatDNSRules(rules); s != "corp.example=10.0.0.53,lab=10.0.0.54" {
+		t.Errorf("Wrong rules: %s", s)
+	}
+	if rules, err := ParseDNSRules(""); err != nil || len(rules) != 0 {
+		t.Errorf("Empty list wasn't accepted: %v", err)
+	}
+	for _, bad := range []string{"corp", "corp=resolver", "=10.0.0.53", "co'rp=10.0.0.53", "a..b=10.0.0.53"} {
+		if _, err := ParseDNSRules(bad); err == nil {
+			t.Errorf("Bad rule %s was accepted", bad)
+		}
+	}
+}
+
+func TestApplyDNS(t *testing.T) {
+	p := &PTPCloud{IP: "10.0.0.2", Mask: "255.255.255.0"}
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	rules, _ := ParseDNSRules("corp=10.0.0.53")
+	if err := p.ApplyDNS("provider", rules); err == nil {
+		t.Errorf("Rules were installed without -accept-dns")
+	}
+	p.AcceptDNS = true
+	outside, _ := ParseDNSRules("corp=8.8.8.8")
+	if err := p.ApplyDNS("provider", outside); err == nil {
+		t.Errorf("Resolver outside of the virtual network was accepted")
+	}
+	p.DNSProvider = "provider"
+	p.DNSInstalled = rules
+	if err := p.ApplyDNS("provider", rules); err != nil {
+		t.Errorf("Same rules weren't accepted again: %v", err)
+	}
+	p.NetworkPeers["provider"] = &NetworkPeer{ID: "provider"}
+	if err := p.ApplyDNS("other", rules); err == nil {
+		t.Errorf("Rules of the second provider were accepted")
+	}
+	if !p.OnVirtualNetwork(net.ParseIP("10.0.0.200")) || p.OnVirtualNetwork(net.ParseIP("10.0.1.1")) {
+		t.Errorf("Wrong check of virtual network")
+	}
+}
@@ -0,0 +1,34 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// powershell runs a PowerShell command
+func powershell(command string) error {
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", command).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%v: %s", err, strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+// installSplitDNS adds NRPT rule for every domain. Rules are marked with
+// name of the TAP interface, so they can be found on removal
+func installSplitDNS(device string, rules []DNSRule) error {
+	for _, r := range rules {
+		err := powershell(fmt.Sprintf("Add-DnsClientNrptRule -Namespace '.%s' -NameServers '%s' -Comment 'p2p:%s'", r.Domain, r.Resolver, device))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSplitDNS removes NRPT rules added for the TAP interface
+func removeSplitDNS(device string, rules []DNSRule) error {
+	return powershell(fmt.Sprintf("Get-DnsClientNrptRule | Where-Object Comment -eq 'p2p:%s' | Remove-DnsClientNrptRule -Force", device))
+}
@@ -0,0 +1,48 @@
+// Package ptp implements p2p network endpoint that can be embedded into
+// other Go programs:
+//
+//	inst, err := ptp.New(ptp.Options{IP: "dhcp", Hash: "my-network", Attempts: 3})
+//	if errors.Is(err, ptp.ErrRouterUnreachable) {
+//		// No router has answered
+//	}
+//	inst.Go(inst.Run)
+//	...
+//	inst.StopInstance()
+//
+// Package consists of these parts:
+//
+//	Discovery  DHTClient talks to routers (dht.go, migrate.go, quorum.go,
+//	           sealed.go) and to mainline DHT (mainline.go). Forwarders
+//	           advertise capacity and refuse sessions when saturated
+//	           (relay.go)
+//	Transport  PTPNet owns UDP sockets (net.go), NetworkPeer drives
+//	           connection to a single peer (peer.go, punch.go, local.go,
+//	           samenat.go). Peers exchange small messages over reliable
+//	           control channel (control.go), tell each other which
+//	           peers stopped answering (liveness.go) and probe whether
+//	           paths carry jumbo frames (pmtu.go)
+//	Crypto     Crypto encrypts traffic (crypto.go, rekey.go), Identity
+//	           signs introductions and claims (identity.go), Manifest
+//	           limits membership to keys signed by admin (manifest.go)
+//	           and external hook may decide on every new peer
+//	           (authhook.go)
+//	Device     Interface reads and writes frames of the virtual network
+//	           interface (tuntap*.go, packet.go) and copies them to an
+//	           IDS (mirror*.go). Addresses of networks behind peers may
+//	           be translated to local aliases (nat.go). Messages from the
+//	           network may be parsed in a seccomp-restricted worker
+//	           (sandbox*.go)
+//	Instance   PTPCloud ties everything together (p2p.go, options.go),
+//	           installs split-DNS rules (dns*.go), firewall rules and
+//	           routes (hostsetup*.go), which may be isolated in a table
+//	           of their own (isolation*.go), and reports its counters
+//	           (stats.go), which may be recorded into history
+//	           (history.go). Webhooks are notified when peers join,
+//	           leave or fall back to relay (webhooks.go), and the
+//	           latest events are kept for the console (events.go). Members with
+//	           public addresses may relay traffic of their network
+//	           (community.go). Stub resolver
+//	           forwards DNS queries to a peer (resolver.go).
+//	           In hardened mode access to the host is confined to the
+//	           paths listed in confine.go
+package ptp
@@ -0,0 +1,209 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type DoctorStatus int
+
+const (
+	DOCTOR_OK DoctorStatus = iota
+	DOCTOR_WARNING
+	DOCTOR_FAIL
+)
+
+const (
+	DOCTOR_TIMEOUT    time.Duration = 3 * time.Second
+	DOCTOR_NTP_SERVER string        = "pool.ntp.org:123"
+	DOCTOR_MAX_SKEW   time.Duration = 30 * time.Second
+)
+
+// DoctorFinding is a result of a single diagnostic check
+type DoctorFinding struct {
+	Check   string
+	Status  DoctorStatus
+	Details string
+	Advice  string // What user should do to fix the problem
+}
+
+func (s DoctorStatus) String() string {
+	switch s {
+	case DOCTOR_OK:
+		return "OK"
+	case DOCTOR_WARNING:
+		return "WARNING"
+	case DOCTOR_FAIL:
+		return "FAIL"
+	}
+	return "UNKNOWN"
+}
+
+// RunDiagnostics runs every available check and returns list of findings
+func RunDiagnostics(routers string, port int) []DoctorFinding {
+	var findings []DoctorFinding
+	findings = append(findings, checkTAPDriver()...)
+	findings = append(findings, checkForwarding()...)
+	findings = append(findings, CheckPortBinding(port))
+	if routers == "" {
+		routers = new(DHTClient).DHTClientConfig().Routers
+	}
+	for _, router := range strings.Split(routers, ",") {
+		findings = append(findings, CheckRouter(router))
+	}
+	findings = append(findings, CheckNAT())
+	findings = append(findings, CheckClockSkew(DOCTOR_NTP_SERVER))
+	return findings
+}
+
+// CheckPortBinding verifies that p2p socket can be bound to specified port
+func CheckPortBinding(port int) DoctorFinding {
+	f := DoctorFinding{Check: "Port binding"}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = fmt.Sprintf("Can't bind UDP port %d: %v", port, err)
+		f.Advice = "Stop application that uses this port or choose another one with -port or -ports"
+		return f
+	}
+	defer conn.Close()
+	f.Details = fmt.Sprintf("UDP port %d is available", conn.LocalAddr().(*net.UDPAddr).Port)
+	return f
+}
+
+// CheckRouter sends ping to a DHT router and waits for any response
+func CheckRouter(router string) DoctorFinding {
+	f := DoctorFinding{Check: "Router " + router}
+	addr, err := ResolveEndpoint(router, false)
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = fmt.Sprintf("Can't resolve router address: %v", err)
+		f.Advice = "Check DNS configuration and router address"
+		return f
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = fmt.Sprintf("Can't create UDP socket: %v", err)
+		return f
+	}
+	defer conn.Close()
+	dht := new(DHTClient)
+	started := time.Now()
+	_, err = conn.Write([]byte(dht.Compose(CMD_PING, "0", "", "")))
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = fmt.Sprintf("Failed to send packet: %v", err)
+		f.Advice = "Check that outgoing UDP traffic is allowed by firewall"
+		return f
+	}
+	conn.SetReadDeadline(time.Now().Add(DOCTOR_TIMEOUT))
+	buf := make([]byte, 512)
+	_, err = conn.Read(buf)
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = fmt.Sprintf("No response from %s within %s", addr, DOCTOR_TIMEOUT)
+		f.Advice = "Check that outgoing and incoming UDP traffic is allowed by firewall"
+		return f
+	}
+	f.Details = fmt.Sprintf("Router %s responded in %s", addr, time.Since(started))
+	return f
+}
+
+// CheckNAT looks for public addresses on local interfaces. Without public
+// address this host is behind NAT and direct connections may fail
+func CheckNAT() DoctorFinding {
+	f := DoctorFinding{Check: "NAT"}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		f.Status = DOCTOR_WARNING
+		f.Details = fmt.Sprintf("Failed to list local addresses: %v", err)
+		return f
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if !isPrivateIP(ipnet.IP) {
+			f.Details = fmt.Sprintf("Public address %s is assigned to this host", ipnet.IP)
+			return f
+		}
+	}
+	f.Status = DOCTOR_WARNING
+	f.Details = "Host has private addresses only and is behind NAT"
+	f.Advice = "Forward p2p port on the gateway or use fixed -port to improve direct connectivity. Proxies are used otherwise"
+	return f
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckClockSkew compares local time with time reported by NTP server
+func CheckClockSkew(server string) DoctorFinding {
+	f := DoctorFinding{Check: "Clock"}
+	remote, err := QueryNTP(server)
+	if err != nil {
+		f.Status = DOCTOR_WARNING
+		f.Details = fmt.Sprintf("Failed to query %s: %v", server, err)
+		f.Advice = "Make sure system clock is synchronized. Key expiration and network rotation depend on it"
+		return f
+	}
+	skew := time.Since(remote)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > DOCTOR_MAX_SKEW {
+		f.Status = DOCTOR_FAIL
+		f.Details = fmt.Sprintf("Local clock differs from %s by %s", server, skew)
+		f.Advice = "Synchronize system clock with NTP. Key expiration and network rotation depend on it"
+		return f
+	}
+	f.Details = fmt.Sprintf("Local clock differs from %s by %s", server, skew)
+	return f
+}
+
+// QueryNTP requests current time from SNTP server
+func QueryNTP(server string) (time.Time, error) {
+	conn, err := net.DialTimeout("udp", server, DOCTOR_TIMEOUT)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	req := make([]byte, 48)
+	// Leap indicator 0, version 3, client mode
+	req[0] = 0x1b
+	started := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return time.Time{}, err
+	}
+	conn.SetReadDeadline(time.Now().Add(DOCTOR_TIMEOUT))
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n < 48 {
+		return time.Time{}, errors.New("Short NTP response")
+	}
+	return ParseNTPTime(resp[40:48]).Add(time.Since(started) / 2), nil
+}
+
+// ParseNTPTime converts 64-bit NTP timestamp into time
+func ParseNTPTime(b []byte) time.Time {
+	const epochOffset = 2208988800 // Seconds between 1900 and 1970
+	seconds := int64(binary.BigEndian.Uint32(b[0:4])) - epochOffset
+	fraction := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(seconds, (fraction*1e9)>>32)
+}
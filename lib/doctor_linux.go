@@ -0,0 +1,43 @@
+package ptp
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func checkTAPDriver() []DoctorFinding {
+	f := DoctorFinding{Check: "TAP driver"}
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = "Can't open /dev/net/tun: " + err.Error()
+		if os.IsPermission(err) {
+			f.Advice = "Run p2p daemon with root privileges"
+		} else {
+			f.Advice = "Load tun kernel module with 'modprobe tun'"
+		}
+		return []DoctorFinding{f}
+	}
+	file.Close()
+	f.Details = "/dev/net/tun is available"
+	return []DoctorFinding{f}
+}
+
+func checkForwarding() []DoctorFinding {
+	f := DoctorFinding{Check: "IP forwarding"}
+	data, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		f.Status = DOCTOR_WARNING
+		f.Details = "Failed to read forwarding settings: " + err.Error()
+		return []DoctorFinding{f}
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		f.Status = DOCTOR_WARNING
+		f.Details = "IPv4 forwarding is disabled"
+		f.Advice = "Enable it with 'sysctl -w net.ipv4.ip_forward=1' if traffic should be routed between p2p and other networks"
+		return []DoctorFinding{f}
+	}
+	f.Details = "IPv4 forwarding is enabled"
+	return []DoctorFinding{f}
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package ptp
+
+import (
+	"os"
+)
+
+func checkTAPDriver() []DoctorFinding {
+	f := DoctorFinding{Check: "TAP driver"}
+	_, err := os.Stat("/dev/tap0")
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = "TAP device /dev/tap0 doesn't exist"
+		f.Advice = "Install TUN/TAP driver for this platform"
+		return []DoctorFinding{f}
+	}
+	f.Details = "/dev/tap0 is available"
+	return []DoctorFinding{f}
+}
+
+func checkForwarding() []DoctorFinding {
+	return nil
+}
@@ -0,0 +1,31 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseNTPTime(t *testing.T) {
+	// 2017-01-01 00:00:00.5 UTC
+	b := []byte{0xdc, 0x12, 0xc5, 0x00, 0x80, 0x00, 0x00, 0x00}
+	expected := time.Date(2017, 1, 1, 0, 0, 0, 500000000, time.UTC)
+	if !ParseNTPTime(b).Equal(expected) {
+		t.Errorf("Wrong NTP time: %s", ParseNTPTime(b).UTC())
+	}
+}
+
+func TestCheckPortBinding(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Skipf("Can't bind UDP socket: %v", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if CheckPortBinding(port).Status != DOCTOR_FAIL {
+		t.Errorf("Busy port was reported as available")
+	}
+	if CheckPortBinding(0).Status != DOCTOR_OK {
+		t.Errorf("Random port was reported as busy")
+	}
+}
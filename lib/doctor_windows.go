@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package ptp
+
+import (
+	"syscall"
+)
+
+func checkTAPDriver() []DoctorFinding {
+	f := DoctorFinding{Check: "TAP driver"}
+	handle, err := queryNetworkKey()
+	if err != nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = "Failed to read network adapters from registry: " + err.Error()
+		return []DoctorFinding{f}
+	}
+	defer syscall.RegCloseKey(handle)
+	dev, err := queryAdapters(handle)
+	if err != nil || dev == nil {
+		f.Status = DOCTOR_FAIL
+		f.Details = "No free TAP adapter was found"
+		f.Advice = "Install TAP-Windows driver and create a TAP adapter with addtap.bat"
+		return []DoctorFinding{f}
+	}
+	syscall.CloseHandle(dev.file)
+	f.Details = "TAP adapter " + dev.Interface + " is available"
+	return []DoctorFinding{f}
+}
+
+func checkForwarding() []DoctorFinding {
+	return nil
+}
@@ -0,0 +1,116 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Drain prepares instance for maintenance. New peers are not accepted
+// anymore and connected peers are asked one by one to stop using this
+// host, so they don't reconnect all at once
+func (p *PTPCloud) Drain() {
+	if p.Draining {
+		return
+	}
+	p.Draining = true
+	p.DrainStarted = time.Now()
+	Log(INFO, "Draining instance. New peers will not be accepted")
+	p.Go(p.notifyDrain)
+}
+
+func (p *PTPCloud) notifyDrain() {
+	p.PeersLock.Lock()
+	var peers []*NetworkPeer
+	for _, peer := range p.NetworkPeers {
+		peers = append(peers, peer)
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		if p.Shutdown {
+			return
+		}
+		if peer.State == P_CONNECTED {
+			Log(DEBUG, "Asking %s to stop using this host", peer.ID)
+			p.SendTo(peer.PeerHW, CreateDrainP2PMessage(p.CurrentCrypter(), p.Dht.ID))
+			time.Sleep(DRAIN_NOTIFY_INTERVAL)
+		}
+		peer.DrainNotified = true
+	}
+}
+
+// DrainStatus returns number of notified peers and peers that still send
+// or receive traffic
+func (p *PTPCloud) DrainStatus() (notified, total, active int) {
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	for _, peer := range p.NetworkPeers {
+		total++
+		if peer.DrainNotified {
+			notified++
+		}
+		if peer.State == P_CONNECTED && time.Since(peer.LastActivity) < DRAIN_IDLE_TIMEOUT {
+			active++
+		}
+	}
+	return
+}
+
+// Drained returns true when every peer was notified and traffic has ceased
+func (p *PTPCloud) Drained() bool {
+	if !p.Draining {
+		return false
+	}
+	notified, total, active := p.DrainStatus()
+	return notified == total && active == 0
+}
+
+// DrainReport describes progress of draining
+func (p *PTPCloud) DrainReport() string {
+	notified, total, active := p.DrainStatus()
+	if p.Drained() {
+		return fmt.Sprintf("Drained in %s. Traffic has ceased", time.Since(p.DrainStarted).Truncate(time.Second))
+	}
+	return fmt.Sprintf("Draining for %s: %d of %d peers notified, %d peers still active",
+		time.Since(p.DrainStarted).Truncate(time.Second), notified, total, active)
+}
+
+func CreateDrainP2PMessage(c Crypto, id string) *P2PMessage {
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_DRAIN)
+	msg.Header.Length = uint16(len(id))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, []byte(id))
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = []byte(id)
+	}
+	return msg
+}
+
+// HandleDrainMessage is called when peer goes into maintenance. We stop
+// using it and resolve it again after a while
+func (p *PTPCloud) HandleDrainMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	id := string(msg.Data)
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[id]
+	p.PeersLock.Unlock()
+	if !exists || peer.Endpoint == nil || peer.Endpoint.String() != src_addr.String() {
+		Log(DEBUG, "Drain notification from unknown endpoint %s", src_addr)
+		return
+	}
+	Log(INFO, "Peer %s is going into maintenance. Disconnecting", id)
+	peer.LastError = "Peer is draining"
+	peer.DrainedAt = time.Now()
+	peer.State = P_INIT
+	peer.PeerAddr = nil
+	peer.Endpoint = nil
+	peer.Forwarder = nil
+	peer.ProxyID = 0
+}
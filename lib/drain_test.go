@@ -0,0 +1,57 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainStatus(t *testing.T) {
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	active := &NetworkPeer{ID: "active", State: P_CONNECTED, LastActivity: time.Now()}
+	idle := &NetworkPeer{ID: "idle", State: P_CONNECTED}
+	p.NetworkPeers[active.ID] = active
+	p.NetworkPeers[idle.ID] = idle
+	if p.Drained() {
+		t.Errorf("Instance that is not draining was reported as drained")
+	}
+	p.Draining = true
+	p.DrainStarted = time.Now()
+	active.DrainNotified = true
+	notified, total, busy := p.DrainStatus()
+	if notified != 1 || total != 2 || busy != 1 {
+		t.Errorf("Wrong drain status: %d/%d, %d active", notified, total, busy)
+	}
+	idle.DrainNotified = true
+	if p.Drained() {
+		t.Errorf("Instance with active peer was reported as drained")
+	}
+	active.LastActivity = time.Now().Add(-DRAIN_IDLE_TIMEOUT)
+	if !p.Drained() {
+		t.Errorf("Instance was not drained: %s", p.DrainReport())
+	}
+}
+
+func TestHandleDrainMessage(t *testing.T) {
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	endpoint := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	peer := &NetworkPeer{ID: "peer", State: P_CONNECTED, Endpoint: endpoint, PeerAddr: endpoint}
+	p.NetworkPeers[peer.ID] = peer
+
+	msg := CreateDrainP2PMessage(p.Crypter, peer.ID)
+	p.HandleDrainMessage(msg, &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6881})
+	if peer.State != P_CONNECTED {
+		t.Fatalf("Drain notification from foreign address was accepted")
+	}
+	p.HandleDrainMessage(msg, endpoint)
+	if peer.State != P_INIT || peer.Endpoint != nil || peer.DrainedAt.IsZero() {
+		t.Fatalf("Peer was not disconnected after drain notification")
+	}
+	// Peer is not resolved again while it is in maintenance
+	peer.StateInit(p)
+	if peer.State != P_INIT {
+		t.Errorf("Drained peer was resolved again: %d", peer.State)
+	}
+}
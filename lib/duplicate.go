@@ -0,0 +1,153 @@
+package ptp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Claim is periodically announced to every member of the network. An
+// instance that receives a claim with its own ID or interface address from
+// another instance has a clone running somewhere, e.g. on a copied VM
+type Claim struct {
+	ID        string
+	Nonce     string    // Random value generated on start of the instance
+	Started   time.Time // When instance was started
+	IP        string
+	Mac       string
+	PublicKey string
+	Signature string
+}
+
+type ClaimCallback func(c *Claim)
+
+// NewClaimNonce generates random value that distinguishes instances
+// sharing the same identity
+func NewClaimNonce() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Arguments returns a string representation of signed part of the claim
+func (c *Claim) Arguments() string {
+	return fmt.Sprintf("%s|%d|%s|%s", c.Nonce, c.Started.UnixNano(), c.IP, c.Mac)
+}
+
+// Verify checks that claim was signed by the owner of the ID
+func (c *Claim) Verify() bool {
+	pub, err := hex.DecodeString(c.PublicKey)
+	if err != nil {
+		return false
+	}
+	signature, err := hex.DecodeString(c.Signature)
+	if err != nil {
+		return false
+	}
+	return VerifyIdentity(c.ID, pub, []byte(c.ID+"|"+c.Arguments()), signature)
+}
+
+// NewerThan returns true if claiming instance was started after the other
+// one. Nonce breaks ties, so exactly one of two instances is newer
+func (c *Claim) NewerThan(other *Claim) bool {
+	if !c.Started.Equal(other.Started) {
+		return c.Started.After(other.Started)
+	}
+	return c.Nonce > other.Nonce
+}
+
+// ParseClaim extracts claim from a DHT message
+func ParseClaim(data DHTMessage) (*Claim, error) {
+	parts := strings.Split(data.Arguments, "|")
+	if len(parts) != 4 || data.Id == "" || parts[0] == "" {
+		return nil, errors.New("Malformed claim")
+	}
+	started, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Claim)
+	c.ID = data.Id
+	c.Nonce = parts[0]
+	c.Started = time.Unix(0, started)
+	c.IP = parts[2]
+	c.Mac = parts[3]
+	c.PublicKey = data.PublicKey
+	c.Signature = data.Payload
+	return c, nil
+}
+
+// Claim returns signed claim of this instance
+func (p *PTPCloud) Claim() *Claim {
+	c := &Claim{ID: p.Dht.ID, Nonce: p.ClaimNonce, Started: p.Started, IP: p.IP, Mac: p.Mac}
+	if p.Identity != nil {
+		c.PublicKey = p.Identity.PublicKeyString()
+		c.Signature = hex.EncodeToString(p.Identity.Sign([]byte(c.ID + "|" + c.Arguments())))
+	}
+	return c
+}
+
+// HandleClaim compares claim of another instance with ours. Conflicts are
+// reported on both sides, because both receive claims of each other
+func (p *PTPCloud) HandleClaim(c *Claim) {
+	own := p.Claim()
+	if c.Nonce == own.Nonce {
+		return
+	}
+	var conflict string
+	if c.ID == own.ID {
+		if !c.Verify() {
+			Log(WARNING, "Claim for our ID %s has bad signature. Ignoring", c.ID)
+			return
+		}
+		conflict = fmt.Sprintf("identity %s is active on another machine started at %s", c.ID, c.Started.Format(time.RFC1123))
+	} else if c.IP != "" && c.IP == own.IP {
+		conflict = fmt.Sprintf("peer %s uses the same IP %s", c.ID, c.IP)
+	} else if c.Mac != "" && c.Mac == own.Mac {
+		conflict = fmt.Sprintf("peer %s uses the same MAC %s", c.ID, c.Mac)
+	} else {
+		return
+	}
+	if conflict != p.Conflict {
+		p.Conflict = conflict
+		Log(ERROR, "==================== DUPLICATE INSTANCE ====================")
+		Log(ERROR, "Network %s: %s. Was this machine cloned?", p.Dht.NetworkHash, conflict)
+		Log(ERROR, "============================================================")
+	}
+	// Only a signed claim for our own ID can fence us. Addresses can be
+	// claimed by anyone who knows the network
+	if c.ID == own.ID && p.FenceDuplicates && own.NewerThan(c) && !p.Fenced {
+		p.Fenced = true
+		Log(ERROR, "This instance is newer than its duplicate. Shutting it down")
+		p.Go(p.StopInstance)
+	}
+}
+
+// SendClaim announces claim of this instance to every member of the network
+func (dht *DHTClient) SendClaim(c *Claim) {
+	var req DHTMessage
+	req.Id = c.ID
+	req.Command = CMD_CLAIM
+	req.Query = dht.NetworkHash
+	req.Arguments = c.Arguments()
+	req.PublicKey = c.PublicKey
+	req.Payload = c.Signature
+	dht.Send(dht.EncodeRequest(req))
+}
+
+func (dht *DHTClient) HandleClaim(data DHTMessage, conn PacketConn) {
+	c, err := ParseClaim(data)
+	if err != nil {
+		Log(DEBUG, "Failed to parse claim: %v", err)
+		return
+	}
+	if dht.ClaimHandler != nil {
+		dht.ClaimHandler(c)
+	}
+}
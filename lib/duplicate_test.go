@@ -0,0 +1,77 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func newClaimTestInstance(identity *Identity, started time.Time) *PTPCloud {
+	p := new(PTPCloud)
+	p.Identity = identity
+	p.Dht = new(DHTClient)
+	p.Dht.ID = identity.ID
+	p.IP = "10.0.0.1"
+	p.Mac = "06:00:00:00:00:01"
+	p.Started = started
+	p.ClaimNonce = NewClaimNonce()
+	return p
+}
+
+func TestParseClaim(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	p := newClaimTestInstance(identity, time.Unix(0, 1500000000123456789))
+	c := p.Claim()
+	parsed, err := ParseClaim(DHTMessage{Id: c.ID, Command: CMD_CLAIM, Arguments: c.Arguments(), PublicKey: c.PublicKey, Payload: c.Signature})
+	if err != nil {
+		t.Fatalf("Failed to parse claim: %v", err)
+	}
+	if parsed.Nonce != c.Nonce || !parsed.Started.Equal(c.Started) || parsed.IP != c.IP || parsed.Mac != c.Mac {
+		t.Errorf("Parsed claim differs: %+v != %+v", parsed, c)
+	}
+	if !parsed.Verify() {
+		t.Errorf("Valid signature was rejected")
+	}
+	parsed.IP = "10.0.0.2"
+	if parsed.Verify() {
+		t.Errorf("Modified claim was accepted")
+	}
+	if _, err := ParseClaim(DHTMessage{Id: c.ID, Arguments: "nonce|time|ip|mac"}); err == nil {
+		t.Errorf("Malformed claim was accepted")
+	}
+}
+
+func TestHandleClaim(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	older := newClaimTestInstance(identity, time.Now().Add(-time.Hour))
+	newer := newClaimTestInstance(identity, time.Now())
+	older.FenceDuplicates = true
+
+	if !newer.Claim().NewerThan(older.Claim()) || older.Claim().NewerThan(newer.Claim()) {
+		t.Errorf("Wrong order of instances")
+	}
+	older.HandleClaim(older.Claim())
+	if older.Conflict != "" {
+		t.Errorf("Own claim was reported as conflict")
+	}
+	older.HandleClaim(newer.Claim())
+	if older.Conflict == "" {
+		t.Errorf("Duplicate identity was not detected")
+	}
+	if older.Fenced {
+		t.Errorf("Older instance was fenced")
+	}
+
+	forged := newer.Claim()
+	forged.Signature = older.Claim().Signature
+	newer.HandleClaim(forged)
+	if newer.Conflict != "" {
+		t.Errorf("Claim with bad signature was accepted")
+	}
+
+	other, _ := GenerateIdentity()
+	clone := newClaimTestInstance(other, time.Now())
+	newer.HandleClaim(clone.Claim())
+	if newer.Conflict == "" || newer.Fenced {
+		t.Errorf("Duplicate address was not reported: %s", newer.Conflict)
+	}
+}
@@ -18,6 +18,7 @@ const (
 	ERR_BAD_UDP_ADDR        ErrorType = "badudpaddr"
 	ERR_BAD_ID_RECEIVED     ErrorType = "badid"
 	ERR_BAD_DHCP_DATA       ErrorType = "baddhcp"
+	ERR_PORT_CONFLICT       ErrorType = "portconflict"
 )
 
 type Error struct {
@@ -32,4 +33,15 @@ func InitErrors() {
 	ErrorList[ERR_BAD_UDP_ADDR] = errors.New("DHT failed to extract UDP address from handshake")
 	ErrorList[ERR_BAD_ID_RECEIVED] = errors.New("DHT received invalid ID from client")
 	ErrorList[ERR_BAD_DHCP_DATA] = errors.New("DHT failed to parse provided DHCP packet")
+	ErrorList[ERR_PORT_CONFLICT] = errors.New("DHT detected that port is already mapped by another client behind the same NAT")
 }
+
+// Errors returned by the library. Returned errors wrap one of these with
+// details, so callers can tell them apart with errors.Is
+var (
+	ErrRouterUnreachable = errors.New("no router is reachable")
+	ErrHandshakeTimeout  = errors.New("handshake timed out")
+	ErrMalformedMessage  = errors.New("malformed message")
+	ErrNoRelayAvailable  = errors.New("no relay is available")
+	ErrRelaySaturated    = errors.New("relay is saturated")
+)
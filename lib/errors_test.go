@@ -0,0 +1,57 @@
+package ptp
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestMalformedMessageErrors(t *testing.T) {
+	_, err := P2PMessageFromBytes([]byte{1, 2, 3})
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Short message: expected ErrMalformedMessage, got %v", err)
+	}
+	msg := CreateTestP2PMessage(Crypto{}, "test", 0)
+	data := msg.Serialize()
+	data[0] ^= 0xff
+	_, err = P2PMessageFromBytes(data)
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Bad magic cookie: expected ErrMalformedMessage, got %v", err)
+	}
+	_, _, _, err = ParseFeedback("id|x|1")
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Bad feedback: expected ErrMalformedMessage, got %v", err)
+	}
+}
+
+func TestNewReturnsError(t *testing.T) {
+	p, err := New(Options{Mac: "not-a-mac"})
+	if p != nil || err == nil {
+		t.Errorf("New accepted invalid MAC address")
+	}
+}
+
+func TestNewReleasesSocket(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to find free port: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	opts := Options{
+		Hash:         "release-test",
+		Port:         port,
+		Tags:         "bad tag!",
+		IdentityFile: filepath.Join(t.TempDir(), "identity"),
+	}
+	p, err := New(opts)
+	if p != nil || err == nil {
+		t.Fatalf("New accepted bad tags")
+	}
+	conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		t.Fatalf("UDP port is still in use after New failed: %v", err)
+	}
+	conn.Close()
+}
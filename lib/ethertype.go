@@ -0,0 +1,160 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Names of ethertypes users ask about most often
+var etherTypeNames = map[PacketType]string{
+	PT_PARC_UNIVERSAL:  "PUP",
+	PT_RARP:            "RARP",
+	PT_8021Q:           "802.1Q",
+	PT_PPPOE_DISCOVERY: "PPPoE discovery",
+	PT_PPPOE_SESSION:   "PPPoE session",
+	PT_LLDP:            "LLDP",
+	0x8892:             "PROFINET",
+	0x88a4:             "EtherCAT",
+	0x88f7:             "PTP",
+}
+
+// EtherTypeName returns name and number of an ethertype
+func EtherTypeName(pt PacketType) string {
+	if name, exists := etherTypeNames[pt]; exists {
+		return fmt.Sprintf("%s(0x%04x)", name, int(pt))
+	}
+	return fmt.Sprintf("0x%04x", int(pt))
+}
+
+// ParseEtherPolicy parses policy for frames of ethertypes other than IP
+// and ARP. Empty value means drop
+func ParseEtherPolicy(value string) (EtherPolicy, error) {
+	switch value {
+	case "", "drop":
+		return ETHER_DROP, nil
+	case "forward":
+		return ETHER_FORWARD, nil
+	case "log":
+		return ETHER_LOG, nil
+	}
+	return ETHER_DROP, errors.New(fmt.Sprintf("Unknown ethertype policy %s. Use forward, drop or log", value))
+}
+
+func (ep EtherPolicy) String() string {
+	switch ep {
+	case ETHER_FORWARD:
+		return "forward"
+	case ETHER_LOG:
+		return "log"
+	}
+	return "drop"
+}
+
+// EtherCount counts frames of a single ethertype
+type EtherCount struct {
+	Type    PacketType
+	Frames  uint64
+	Dropped uint64
+}
+
+func (ec EtherCount) String() string {
+	return fmt.Sprintf("%s:%d/%d dropped", EtherTypeName(ec.Type), ec.Frames, ec.Dropped)
+}
+
+// EtherStats counts frames read from the device by ethertype
+type EtherStats struct {
+	counts map[PacketType]*EtherCount
+	lock   sync.Mutex
+}
+
+// NewEtherStats creates empty counters
+func NewEtherStats() *EtherStats {
+	return &EtherStats{counts: make(map[PacketType]*EtherCount)}
+}
+
+// Count records a frame. Returns true if ethertype is seen for the first time
+func (es *EtherStats) Count(pt PacketType, dropped bool) bool {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	c, exists := es.counts[pt]
+	if !exists {
+		c = &EtherCount{Type: pt}
+		es.counts[pt] = c
+	}
+	c.Frames++
+	if dropped {
+		c.Dropped++
+	}
+	return !exists
+}
+
+// Summary returns counters sorted by ethertype
+func (es *EtherStats) Summary() []EtherCount {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	var list []EtherCount
+	for _, c := range es.counts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Type < list[j].Type })
+	return list
+}
+
+// handleEtherType applies ethertype policy to a frame that isn't IP or ARP
+func (p *PTPCloud) handleEtherType(contents []byte, proto int) {
+	pt := PacketType(proto)
+	switch p.EtherPolicy {
+	case ETHER_FORWARD:
+		p.EtherStats.Count(pt, !p.forwardFrame(contents, proto))
+	case ETHER_LOG:
+		if p.EtherStats.Count(pt, true) {
+			Log(INFO, "Dropping frames of ethertype %s. Start instance with -ethertypes forward to send them to peers", EtherTypeName(pt))
+		} else {
+			Log(DEBUG, "Dropping frame of ethertype %s", EtherTypeName(pt))
+		}
+	default:
+		p.EtherStats.Count(pt, true)
+		Log(TRACE, "Dropping frame of ethertype %s", EtherTypeName(pt))
+	}
+}
+
+// forwardFrame sends a frame to the peer it is addressed to. Broadcast and
+// multicast frames are sent to every connected peer. Returns false if
+// frame was dropped
+func (p *PTPCloud) forwardFrame(contents []byte, proto int) bool {
+	if len(contents) < 14 {
+		return false
+	}
+	dst := net.HardwareAddr(contents[0:6])
+	var peers []*NetworkPeer
+	if dst[0]&1 == 1 {
+		p.PeersLock.Lock()
+		for _, peer := range p.NetworkPeers {
+			if peer.State == P_CONNECTED && peer.PeerHW != nil {
+				peers = append(peers, peer)
+			}
+		}
+		p.PeersLock.Unlock()
+	} else if peer := p.MACPeer(dst); peer != nil {
+		peers = append(peers, peer)
+	}
+	sent := false
+	for _, peer := range peers {
+		if !p.Allowed(peer, contents, true) {
+			Log(TRACE, "Frame to %s was dropped by ACL", peer.ID)
+			continue
+		}
+		if !p.Resources.Transfer(len(contents)) {
+			Log(TRACE, "Bandwidth limit reached. Dropping frame to %s", peer.ID)
+			continue
+		}
+		p.MirrorFrame(peer, contents)
+		msg := CreateNencP2PMessage(p.CurrentCrypter(), contents, uint16(proto), 1, 1, 1)
+		p.SendTo(peer.PeerHW, msg)
+		sent = true
+	}
+	return sent
+}
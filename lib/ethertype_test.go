@@ -0,0 +1,49 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseEtherPolicy(t *testing.T) {
+	for value, expected := range map[string]EtherPolicy{"": ETHER_DROP, "drop": ETHER_DROP, "forward": ETHER_FORWARD, "log": ETHER_LOG} {
+		policy, err := ParseEtherPolicy(value)
+		if err != nil || policy != expected {
+			t.Errorf("%q was parsed as %s: %v", value, policy, err)
+		}
+	}
+	if _, err := ParseEtherPolicy("pass"); err == nil {
+		t.Errorf("Unknown policy was accepted")
+	}
+}
+
+func TestEtherStats(t *testing.T) {
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.MACIDTable = make(map[string]string)
+	p.EtherStats = NewEtherStats()
+	frame := make([]byte, 60)
+	mac, _ := net.ParseMAC("06:00:00:00:00:02")
+	copy(frame, mac)
+
+	p.EtherPolicy = ETHER_LOG
+	p.handlePacket(frame, int(PT_LLDP))
+	p.handlePacket(frame, int(PT_LLDP))
+	p.EtherPolicy = ETHER_FORWARD
+	// Nobody has this address, so the frame is dropped
+	p.handlePacket(frame, 0x8892)
+
+	counts := p.EtherStats.Summary()
+	if len(counts) != 2 {
+		t.Fatalf("Expected counters of 2 ethertypes, got %v", counts)
+	}
+	if counts[0].Type != 0x8892 || counts[0].Frames != 1 || counts[0].Dropped != 1 {
+		t.Errorf("Wrong PROFINET counters: %v", counts[0])
+	}
+	if counts[1].Type != PT_LLDP || counts[1].Frames != 2 || counts[1].Dropped != 2 {
+		t.Errorf("Wrong LLDP counters: %v", counts[1])
+	}
+	if counts[1].String() != "LLDP(0x88cc):2/2 dropped" {
+		t.Errorf("Counter is formatted wrong: %s", counts[1])
+	}
+}
@@ -0,0 +1,50 @@
+package ptp
+
+import (
+	"sync"
+)
+
+// EventLog keeps recent peer events of an instance, so clients like the
+// console can follow them. Every event gets a sequence number and oldest
+// events are forgotten when log is full
+type EventLog struct {
+	events []PeerEvent
+	last   uint64 // Sequence number of the latest event
+	size   int
+	lock   sync.Mutex
+}
+
+// NewEventLog creates log keeping size latest events
+func NewEventLog(size int) *EventLog {
+	return &EventLog{size: size}
+}
+
+// Add records event
+func (l *EventLog) Add(event PeerEvent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.last++
+	l.events = append(l.events, event)
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+}
+
+// Since returns events that followed event with sequence number after and
+// sequence number of the latest event. Client that has seen more events
+// than log has recorded follows a log of previous run of the instance,
+// so every event is returned
+func (l *EventLog) Since(after uint64) ([]PeerEvent, uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if after > l.last {
+		after = 0
+	}
+	first := l.last - uint64(len(l.events)) + 1
+	if after < first {
+		after = first - 1
+	}
+	events := make([]PeerEvent, int(l.last-after))
+	copy(events, l.events[after-first+1:])
+	return events, l.last
+}
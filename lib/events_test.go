@@ -0,0 +1,30 @@
+package ptp
+
+import (
+	"testing"
+)
+
+func TestEventLog(t *testing.T) {
+	l := NewEventLog(3)
+	if events, last := l.Since(0); len(events) != 0 || last != 0 {
+		t.Errorf("Empty log returned %d events, last %d", len(events), last)
+	}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		l.Add(PeerEvent{Type: EVENT_JOIN, PeerID: id})
+	}
+	events, last := l.Since(2)
+	if last != 4 || len(events) != 2 || events[0].PeerID != "c" || events[1].PeerID != "d" {
+		t.Errorf("Wrong events after 2: %+v, last %d", events, last)
+	}
+	// Oldest event is forgotten
+	if events, _ := l.Since(0); len(events) != 3 || events[0].PeerID != "b" {
+		t.Errorf("Wrong events of full log: %+v", events)
+	}
+	if events, _ := l.Since(4); len(events) != 0 {
+		t.Errorf("Seen events were returned: %+v", events)
+	}
+	// Client followed previous run of the instance
+	if events, _ := l.Since(10); len(events) != 3 {
+		t.Errorf("Events of restarted instance were not returned: %+v", events)
+	}
+}
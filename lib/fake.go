@@ -0,0 +1,145 @@
+package ptp
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var errFakeClosed = errors.New("Fake device is closed")
+
+// FakeConn is an in-memory PacketConn. Packets passed to Deliver are
+// returned by Read, packets written by the client are kept in Sent
+type FakeConn struct {
+	Local   net.Addr
+	Remote  net.Addr
+	inbound chan []byte
+	sent    [][]byte
+	closed  bool
+	lock    sync.Mutex
+}
+
+// NewFakeConn creates connection between two addresses
+func NewFakeConn(local, remote net.Addr) *FakeConn {
+	return &FakeConn{Local: local, Remote: remote, inbound: make(chan []byte, 64)}
+}
+
+// Deliver queues packet for Read
+func (c *FakeConn) Deliver(b []byte) {
+	c.inbound <- append([]byte{}, b...)
+}
+
+// Sent returns packets written to the connection
+func (c *FakeConn) Sent() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([][]byte{}, c.sent...)
+}
+
+func (c *FakeConn) Read(b []byte) (int, error) {
+	data, ok := <-c.inbound
+	if !ok {
+		return 0, errFakeClosed
+	}
+	return copy(b, data), nil
+}
+
+func (c *FakeConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, errFakeClosed
+	}
+	c.sent = append(c.sent, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func (c *FakeConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.inbound)
+	}
+	return nil
+}
+
+func (c *FakeConn) LocalAddr() net.Addr  { return c.Local }
+func (c *FakeConn) RemoteAddr() net.Addr { return c.Remote }
+
+// FakeTap is an in-memory TapDevice. Packets passed to Deliver are
+// returned by ReadPacket, packets written by the instance are kept in
+// Written
+type FakeTap struct {
+	inbound chan *Packet
+	written []*Packet
+	batches []int // Sizes of batches passed to WritePackets
+	closed  bool
+	lock    sync.Mutex
+}
+
+// NewFakeTap creates virtual interface without OS device behind it
+func NewFakeTap() *FakeTap {
+	return &FakeTap{inbound: make(chan *Packet, 64)}
+}
+
+// Deliver queues frame as if it was sent by the OS
+func (t *FakeTap) Deliver(frame []byte, proto int) {
+	t.inbound <- &Packet{Protocol: proto, Packet: append([]byte{}, frame...)}
+}
+
+// Written returns packets the instance has written to the interface
+func (t *FakeTap) Written() []*Packet {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]*Packet{}, t.written...)
+}
+
+func (t *FakeTap) Run() {}
+
+func (t *FakeTap) ReadPacket() (*Packet, error) {
+	pkt, ok := <-t.inbound
+	if !ok {
+		return nil, errFakeClosed
+	}
+	return pkt, nil
+}
+
+func (t *FakeTap) WritePacket(pkt *Packet) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return errFakeClosed
+	}
+	t.written = append(t.written, pkt)
+	return nil
+}
+
+// WritePackets records frames written in a single batch
+func (t *FakeTap) WritePackets(pkts []*Packet) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return errFakeClosed
+	}
+	t.written = append(t.written, pkts...)
+	t.batches = append(t.batches, len(pkts))
+	return nil
+}
+
+// Batches returns sizes of batches written with WritePackets
+func (t *FakeTap) Batches() []int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]int{}, t.batches...)
+}
+
+func (t *FakeTap) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.inbound)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Feature is a change of the wire format that is rolled out gradually.
+// Instances always understand messages of features they know, rollout
+// only decides whether such messages are sent to a peer
+type Feature struct {
+	Name        string
+	Description string
+	Rollout     int // Percent of sessions using the feature unless configured otherwise
+}
+
+// Features known to this version
+var (
+	features     = make(map[string]Feature)
+	featuresLock sync.Mutex
+)
+
+// RegisterFeature adds feature to the registry. Names are advertised to
+// peers, so they should be short and never reused
+func RegisterFeature(f Feature) {
+	featuresLock.Lock()
+	defer featuresLock.Unlock()
+	features[f.Name] = f
+}
+
+// KnownFeatures returns registered features sorted by name
+func KnownFeatures() []Feature {
+	featuresLock.Lock()
+	defer featuresLock.Unlock()
+	var list []Feature
+	for _, f := range features {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func knownFeature(name string) (Feature, bool) {
+	featuresLock.Lock()
+	defer featuresLock.Unlock()
+	f, exists := features[name]
+	return f, exists
+}
+
+// FeatureFlags holds rollout percents of features for an instance.
+// Percents from config.yaml take precedence over those suggested by
+// routers, which in turn take precedence over defaults of features
+type FeatureFlags struct {
+	configured map[string]int
+	remote     map[string]int
+	lock       sync.Mutex
+}
+
+// NewFeatureFlags creates flags with rollout percents from configuration
+func NewFeatureFlags(configured map[string]int) *FeatureFlags {
+	return &FeatureFlags{configured: configured, remote: make(map[string]int)}
+}
+
+// Rollout returns percent of sessions feature is used in. Unknown features
+// are never used
+func (f *FeatureFlags) Rollout(name string) int {
+	feature, exists := knownFeature(name)
+	if !exists {
+		return 0
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	percent := feature.Rollout
+	if remote, exists := f.remote[name]; exists {
+		percent = remote
+	}
+	if configured, exists := f.configured[name]; exists {
+		percent = configured
+	}
+	return int(clamp(int64(percent), 0, 100))
+}
+
+// Apply replaces rollout suggested by routers. Features missing from the
+// list return to their defaults
+func (f *FeatureFlags) Apply(remote map[string]int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for name, percent := range remote {
+		if _, exists := knownFeature(name); !exists {
+			Log(DEBUG, "Skipping rollout of unknown feature %s", name)
+			continue
+		}
+		if old, exists := f.remote[name]; !exists || old != percent {
+			Log(INFO, "Routers set rollout of feature %s to %d%%", name, percent)
+		}
+	}
+	f.remote = remote
+}
+
+// Advertised returns capabilities announcing features enabled for at
+// least some sessions
+func (f *FeatureFlags) Advertised() []string {
+	var caps []string
+	for _, feature := range KnownFeatures() {
+		if percent := f.Rollout(feature.Name); percent > 0 {
+			caps = append(caps, FEATURE_PREFIX+feature.Name+"="+strconv.Itoa(percent))
+		}
+	}
+	return caps
+}
+
+// ParseFeatures extracts rollout percents of features from capabilities
+// of a peer
+func ParseFeatures(caps []string) map[string]int {
+	result := make(map[string]int)
+	for _, c := range caps {
+		if !strings.HasPrefix(c, FEATURE_PREFIX) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(c, FEATURE_PREFIX), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if percent, err := strconv.Atoi(kv[1]); err == nil {
+			result[kv[0]] = percent
+		}
+	}
+	return result
+}
+
+// ParseRollout reads rollout from a string in a form of
+// NAME:PERCENT,NAME:PERCENT
+func ParseRollout(list string) (map[string]int, error) {
+	result := make(map[string]int)
+	for _, item := range strings.Split(list, ",") {
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Malformed feature rollout " + item)
+		}
+		percent, err := strconv.Atoi(kv[1])
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, errors.New(fmt.Sprintf("Bad rollout percent of feature %s: %s", kv[0], kv[1]))
+		}
+		result[kv[0]] = percent
+	}
+	return result, nil
+}
+
+// FeatureSelected returns true if session between two peers falls into
+// rollout percent. Both peers come to the same result
+func FeatureSelected(name, a, b string, percent int) bool {
+	if a > b {
+		a, b = b, a
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "|" + a + "|" + b))
+	return int(h.Sum32()%100) < percent
+}
+
+// FeatureEnabled returns true if feature should be used in the session
+// with the peer. Lower of two rollout percents is used, so rollback on
+// either side disables the feature
+func (p *PTPCloud) FeatureEnabled(peer *NetworkPeer, name string) bool {
+	if p.Features == nil || p.Dht == nil || peer == nil {
+		return false
+	}
+	percent := p.Features.Rollout(name)
+	remote, exists := ParseFeatures(peer.Capabilities)[name]
+	if !exists {
+		return false
+	}
+	if remote < percent {
+		percent = remote
+	}
+	return FeatureSelected(name, p.Dht.ID, peer.ID, percent)
+}
+
+// FeatureSummary describes rollout of known features and how many
+// connected peers use them
+func (p *PTPCloud) FeatureSummary() string {
+	if p.Features == nil {
+		return ""
+	}
+	var list []string
+	for _, feature := range KnownFeatures() {
+		used, connected := 0, 0
+		p.PeersLock.Lock()
+		for _, peer := range p.NetworkPeers {
+			if peer.State != P_CONNECTED {
+				continue
+			}
+			connected++
+			if p.FeatureEnabled(peer, feature.Name) {
+				used++
+			}
+		}
+		p.PeersLock.Unlock()
+		list = append(list, fmt.Sprintf("%s %d%% (%d/%d peers)", feature.Name, p.Features.Rollout(feature.Name), used, connected))
+	}
+	return strings.Join(list, ", ")
+}
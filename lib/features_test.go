@@ -0,0 +1,101 @@
+package ptp
+
+import (
+	"testing"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	RegisterFeature(Feature{Name: "testwire", Description: "Test wire format", Rollout: 10})
+	defer func() {
+		featuresLock.Lock()
+		delete(features, "testwire")
+		featuresLock.Unlock()
+	}()
+
+	f := NewFeatureFlags(map[string]int{"unknown": 100, CONTROL_FEATURE: 0, PMTU_FEATURE: 0})
+	if f.Rollout("testwire") != 10 || f.Rollout("unknown") != 0 {
+		t.Errorf("Wrong default rollout: %d %d", f.Rollout("testwire"), f.Rollout("unknown"))
+	}
+	f.Apply(map[string]int{"testwire": 50})
+	if f.Rollout("testwire") != 50 {
+		t.Errorf("Rollout of routers wasn't applied: %d", f.Rollout("testwire"))
+	}
+	if caps := f.Advertised(); len(caps) != 1 || caps[0] != "x-testwire=50" {
+		t.Errorf("Wrong advertised features: %v", caps)
+	}
+	f.Apply(map[string]int{})
+	if f.Rollout("testwire") != 10 {
+		t.Errorf("Rollout didn't return to default: %d", f.Rollout("testwire"))
+	}
+
+	// Configured rollout can't be changed by routers
+	f = NewFeatureFlags(map[string]int{"testwire": 0, CONTROL_FEATURE: 0, PMTU_FEATURE: 0})
+	f.Apply(map[string]int{"testwire": 100})
+	if f.Rollout("testwire") != 0 || len(f.Advertised()) != 0 {
+		t.Errorf("Routers overrode configured rollout: %d", f.Rollout("testwire"))
+	}
+}
+
+func TestFeatureEnabled(t *testing.T) {
+	RegisterFeature(Feature{Name: "testwire", Rollout: 100})
+	defer func() {
+		featuresLock.Lock()
+		delete(features, "testwire")
+		featuresLock.Unlock()
+	}()
+
+	p := new(PTPCloud)
+	p.Dht = &DHTClient{ID: "local"}
+	p.Features = NewFeatureFlags(nil)
+	peer := &NetworkPeer{ID: "remote", Capabilities: []string{CAP_IDENTITY, "x-testwire=100"}}
+	if !p.FeatureEnabled(peer, "testwire") {
+		t.Errorf("Feature wasn't enabled while both sides use it everywhere")
+	}
+	// Rollback on either side disables the feature
+	peer.Capabilities = []string{CAP_IDENTITY, "x-testwire=0"}
+	if p.FeatureEnabled(peer, "testwire") {
+		t.Errorf("Feature was enabled while peer rolled it back")
+	}
+	peer.Capabilities = []string{CAP_IDENTITY}
+	if p.FeatureEnabled(peer, "testwire") {
+		t.Errorf("Feature was enabled while peer doesn't know it")
+	}
+
+	// Rolled back feature isn't a downgrade
+	peer.PublicKey = "key"
+	peer.Capabilities = []string{CAP_IDENTITY, "x-testwire=100"}
+	intro := Introduction{ID: "remote", Capabilities: []string{CAP_IDENTITY}, PublicKey: "key", Signed: true}
+	if err := p.CheckDowngrade(peer, intro); err != nil {
+		t.Errorf("Rollback of feature was taken for downgrade: %v", err)
+	}
+
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		a, b := string(rune('a'+i%26))+string(rune(i)), "peer"
+		if FeatureSelected("testwire", a, b, 30) != FeatureSelected("testwire", b, a, 30) {
+			t.Fatalf("Peers disagree about session %s-%s", a, b)
+		}
+		if FeatureSelected("testwire", a, b, 30) {
+			selected++
+		}
+	}
+	if selected < 200 || selected > 400 {
+		t.Errorf("%d of 1000 sessions were selected for 30%% rollout", selected)
+	}
+}
+
+func TestParseRollout(t *testing.T) {
+	rollout, err := ParseRollout("compress:30,batch:0")
+	if err != nil || rollout["compress"] != 30 || rollout["batch"] != 0 || len(rollout) != 2 {
+		t.Errorf("Wrong rollout: %v %v", rollout, err)
+	}
+	for _, bad := range []string{"compress", "compress:all", "compress:101"} {
+		if _, err := ParseRollout(bad); err == nil {
+			t.Errorf("Malformed rollout %q was accepted", bad)
+		}
+	}
+	h, err := ParseConfigHints("mtu=1400|features=compress:10")
+	if err != nil || h.Features["compress"] != 10 {
+		t.Errorf("Rollout hint wasn't parsed: %+v %v", h, err)
+	}
+}
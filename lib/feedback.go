@@ -0,0 +1,177 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LossMeter tracks sequence numbers of data messages received from a
+// peer and counts gaps as lost messages
+type LossMeter struct {
+	expected uint16 // Sequence number of the next message
+	received uint64
+	lost     uint64
+	since    time.Time // Start of the current interval
+	started  bool
+	lock     sync.Mutex
+}
+
+// Receive accounts message with specified sequence number
+func (l *LossMeter) Receive(seq uint16, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.started {
+		l.started = true
+		l.since = now
+		l.expected = seq
+	}
+	l.received++
+	ahead := seq - l.expected
+	if ahead < 0x8000 {
+		l.lost += uint64(ahead)
+		l.expected = seq + 1
+	} else if l.lost > 0 {
+		// Reordered message was already counted as lost
+		l.lost--
+	}
+}
+
+// Flush returns counters of the interval and starts a new one when
+// FEEDBACK_INTERVAL has passed
+func (l *LossMeter) Flush(now time.Time) (received, lost uint64, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.started || now.Sub(l.since) < FEEDBACK_INTERVAL {
+		return 0, 0, false
+	}
+	received, lost = l.received, l.lost
+	l.received, l.lost = 0, 0
+	l.since = now
+	return received, lost, true
+}
+
+// countReceived accounts data message from the peer and reports counters
+// back to it once per FEEDBACK_INTERVAL
+func (p *PTPCloud) countReceived(peer *NetworkPeer, seq uint16, now time.Time) {
+	p.PeersLock.Lock()
+	if peer.Loss == nil {
+		peer.Loss = new(LossMeter)
+	}
+	counter := peer.Loss
+	p.PeersLock.Unlock()
+	counter.Receive(seq, now)
+	if received, lost, ok := counter.Flush(now); ok {
+		p.SendTo(peer.PeerHW, CreateFeedbackP2PMessage(p.CurrentCrypter(), p.Dht.ID, received, lost))
+	}
+}
+
+func CreateFeedbackP2PMessage(c Crypto, id string, received, lost uint64) *P2PMessage {
+	data := fmt.Sprintf("%s|%d|%d", id, received, lost)
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_FEEDBACK)
+	msg.Header.Length = uint16(len(data))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, []byte(data))
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = []byte(data)
+	}
+	return msg
+}
+
+// ParseFeedback extracts ID of the reporting peer and its counters
+func ParseFeedback(data string) (string, uint64, uint64, error) {
+	parts := strings.Split(data, "|")
+	if len(parts) != 3 {
+		return "", 0, 0, fmt.Errorf("%w: feedback has %d fields", ErrMalformedMessage, len(parts))
+	}
+	received, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	lost, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	return parts[0], received, lost, nil
+}
+
+// HandleFeedbackMessage is called when peer reports how much of our data
+// it has received
+func (p *PTPCloud) HandleFeedbackMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	id, received, lost, err := ParseFeedback(string(msg.Data))
+	if err != nil {
+		Log(DEBUG, "Bad feedback from %s: %v", src_addr, err)
+		return
+	}
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[id]
+	p.PeersLock.Unlock()
+	if !exists || peer.Endpoint == nil || peer.Endpoint.String() != src_addr.String() {
+		Log(DEBUG, "Feedback from unknown endpoint %s", src_addr)
+		return
+	}
+	p.ApplyFeedback(peer, received, lost)
+}
+
+// ApplyFeedback reacts to loss reported by the peer. Sustained loss slows
+// pacing down. When pacing can't help, relayed peer is moved to another
+// forwarder. Pacing recovers slowly while reports are clean
+func (p *PTPCloud) ApplyFeedback(peer *NetworkPeer, received, lost uint64) {
+	if received+lost == 0 {
+		return
+	}
+	peer.ReportedLoss = float64(lost) / float64(received+lost)
+	if peer.ReportedLoss < FEEDBACK_LOSS_THRESHOLD {
+		peer.LossyReports = 0
+		if peer.Pacer != nil {
+			limit := p.PacingRate * 1024
+			if rate := peer.Pacer.GetRate(); rate < limit {
+				rate += rate / 8
+				if rate > limit {
+					rate = limit
+				}
+				peer.Pacer.SetRate(rate)
+			}
+		}
+		return
+	}
+	peer.LossyReports++
+	if peer.LossyReports < FEEDBACK_SUSTAINED {
+		return
+	}
+	peer.LossyReports = 0
+	if peer.Pacer != nil {
+		if rate := peer.Pacer.GetRate(); rate > PACING_MIN_RATE {
+			rate = rate * 3 / 4
+			if rate < PACING_MIN_RATE {
+				rate = PACING_MIN_RATE
+			}
+			Log(INFO, "Peer %s reports %.0f%% loss. Slowing pacing down to %s/s", peer.ID, peer.ReportedLoss*100, FormatBytes(rate))
+			peer.Pacer.SetRate(rate)
+			return
+		}
+	}
+	if peer.ProxyID != 0 && peer.Forwarder != nil {
+		Log(WARNING, "Peer %s reports %.0f%% loss through forwarder %s. Switching to another one", peer.ID, peer.ReportedLoss*100, peer.Forwarder)
+		peer.LastError = fmt.Sprintf("%.0f%% loss through forwarder", peer.ReportedLoss*100)
+		peer.BlacklistCurrentProxy(p)
+		peer.ProxyID = 0
+		peer.Endpoint = nil
+		peer.Forwarder = nil
+		peer.PeerAddr = nil
+		peer.State = P_INIT
+		return
+	}
+	Log(WARNING, "Peer %s reports %.0f%% loss on direct path", peer.ID, peer.ReportedLoss*100)
+}
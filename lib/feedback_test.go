@@ -0,0 +1,68 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLossMeter(t *testing.T) {
+	l := new(LossMeter)
+	now := time.Now()
+	// 65535 and 0 are consecutive, 2 and 3 are lost, 5 arrives late
+	for _, seq := range []uint16{65534, 65535, 0, 1, 4, 6, 5} {
+		l.Receive(seq, now)
+	}
+	if _, _, ok := l.Flush(now); ok {
+		t.Errorf("Counters were flushed before interval has passed")
+	}
+	received, lost, ok := l.Flush(now.Add(FEEDBACK_INTERVAL))
+	if !ok || received != 7 || lost != 2 {
+		t.Errorf("Wrong counters: received %d lost %d", received, lost)
+	}
+	if received, lost, _ = l.Flush(now.Add(2 * FEEDBACK_INTERVAL)); received != 0 || lost != 0 {
+		t.Errorf("Counters weren't reset")
+	}
+
+	id, received, lost, err := ParseFeedback("peer|100|3")
+	if err != nil || id != "peer" || received != 100 || lost != 3 {
+		t.Errorf("Failed to parse feedback: %v", err)
+	}
+	if _, _, _, err := ParseFeedback("peer|100"); err == nil {
+		t.Errorf("Malformed feedback was parsed")
+	}
+}
+
+func TestApplyFeedback(t *testing.T) {
+	p := new(PTPCloud)
+	p.PacingRate = 1024
+	p.Dht = new(DHTClient)
+	peer := &NetworkPeer{ID: "peer"}
+	peer.Pacer = NewPacer(p.PacingRate*1024, PACING_DEFAULT_BURST)
+
+	for i := 0; i < FEEDBACK_SUSTAINED-1; i++ {
+		p.ApplyFeedback(peer, 80, 20)
+	}
+	if peer.Pacer.GetRate() != 1024*1024 {
+		t.Errorf("Pacing was slowed down before loss became sustained")
+	}
+	p.ApplyFeedback(peer, 80, 20)
+	if peer.Pacer.GetRate() != 768*1024 {
+		t.Errorf("Pacing wasn't slowed down on sustained loss: %d", peer.Pacer.GetRate())
+	}
+	p.ApplyFeedback(peer, 100, 0)
+	if peer.Pacer.GetRate() != 864*1024 || peer.ReportedLoss != 0 {
+		t.Errorf("Pacing doesn't recover after clean report: %d", peer.Pacer.GetRate())
+	}
+
+	// Relayed peer without pacing is moved to another forwarder
+	relayed := &NetworkPeer{ID: "relayed", ProxyID: 5, State: P_CONNECTED}
+	relayed.Forwarder, _ = net.ResolveUDPAddr("udp4", "10.0.0.1:6881")
+	relayed.Endpoint = relayed.Forwarder
+	for i := 0; i < FEEDBACK_SUSTAINED; i++ {
+		p.ApplyFeedback(relayed, 50, 50)
+	}
+	if relayed.State != P_INIT || relayed.ProxyID != 0 || len(relayed.ProxyBlacklist) != 1 {
+		t.Errorf("Peer wasn't moved away from lossy forwarder")
+	}
+}
@@ -0,0 +1,213 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// PeerFilterConfig limits traffic of a semi-trusted peer to a few
+// protocols and ports without writing ACL rules for it
+type PeerFilterConfig struct {
+	Peer  string `yaml:"peer"`  // ID, IP or tag of the peer
+	Allow string `yaml:"allow"` // Comma-separated PROTO[/PORTS], e.g. tcp/22,icmp
+}
+
+// FilterEntry allows one protocol and range of ports
+type FilterEntry struct {
+	hits  uint64
+	Proto int
+	Min   int // Zero if any port is allowed
+	Max   int
+}
+
+// PeerFilter allows traffic exchanged with the peer only if it matches
+// one of the entries. Ports are ports of this host, so the peer reaches
+// listed services and receives replies from them
+type PeerFilter struct {
+	dropped uint64
+	Peer    string
+	Entries []*FilterEntry
+}
+
+// ParseFilterEntries parses list of allowed protocols and ports
+func ParseFilterEntries(allow string) ([]*FilterEntry, error) {
+	var entries []*FilterEntry
+	for _, item := range strings.Split(allow, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "/", 2)
+		proto, err := parseACLProto(parts[0])
+		if err != nil || proto == 0 {
+			return nil, errors.New(fmt.Sprintf("Bad filter %s: protocol should be tcp, udp or icmp", item))
+		}
+		e := &FilterEntry{Proto: proto}
+		if len(parts) == 2 {
+			if proto != IPPROTO_TCP && proto != IPPROTO_UDP {
+				return nil, errors.New(fmt.Sprintf("Bad filter %s: ports can be specified only for tcp and udp", item))
+			}
+			e.Min, e.Max, err = parseACLPorts(parts[1])
+			if err != nil || e.Min == 0 {
+				return nil, errors.New(fmt.Sprintf("Bad filter %s: bad port", item))
+			}
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("Filter allows nothing")
+	}
+	return entries, nil
+}
+
+// NewPeerFilter creates filter of the peer
+func NewPeerFilter(peer, allow string) (*PeerFilter, error) {
+	if strings.TrimSpace(peer) == "" {
+		return nil, errors.New("Peer of filter is not specified")
+	}
+	entries, err := ParseFilterEntries(allow)
+	if err != nil {
+		return nil, err
+	}
+	return &PeerFilter{Peer: strings.ToLower(strings.TrimSpace(peer)), Entries: entries}, nil
+}
+
+func (e *FilterEntry) String() string {
+	s := "icmp"
+	switch e.Proto {
+	case IPPROTO_TCP:
+		s = "tcp"
+	case IPPROTO_UDP:
+		s = "udp"
+	}
+	if e.Min == 0 {
+		return s
+	}
+	if e.Min == e.Max {
+		return s + "/" + strconv.Itoa(e.Min)
+	}
+	return fmt.Sprintf("%s/%d-%d", s, e.Min, e.Max)
+}
+
+// matches checks packet against entry. Port of this host is destination
+// port of inbound packets and source port of outbound ones
+func (e *FilterEntry) matches(f flow, outbound bool) bool {
+	if e.Proto != f.proto {
+		return false
+	}
+	if e.Min == 0 || f.fragment {
+		return true
+	}
+	port := f.dst
+	if outbound {
+		port = f.src
+	}
+	return port >= e.Min && port <= e.Max
+}
+
+// Check returns true if packet exchanged with the peer is allowed and
+// counts hits of the entry that allowed it
+func (pf *PeerFilter) Check(f flow, outbound bool) bool {
+	for _, e := range pf.Entries {
+		if e.matches(f, outbound) {
+			atomic.AddUint64(&e.hits, 1)
+			return true
+		}
+	}
+	atomic.AddUint64(&pf.dropped, 1)
+	return false
+}
+
+// Allow returns allowed protocols and ports in the form they are parsed
+func (pf *PeerFilter) Allow() string {
+	var list []string
+	for _, e := range pf.Entries {
+		list = append(list, e.String())
+	}
+	return strings.Join(list, ",")
+}
+
+// String returns filter with hit counters
+func (pf *PeerFilter) String() string {
+	var list []string
+	for _, e := range pf.Entries {
+		list = append(list, fmt.Sprintf("%s (%d hits)", e, atomic.LoadUint64(&e.hits)))
+	}
+	return fmt.Sprintf("%s: %s, %d dropped", pf.Peer, strings.Join(list, ", "), atomic.LoadUint64(&pf.dropped))
+}
+
+// loadFilters parses filters of config file
+func (p *PTPCloud) loadFilters() error {
+	for _, cfg := range p.FilterConfig {
+		pf, err := NewPeerFilter(cfg.Peer, cfg.Allow)
+		if err != nil {
+			return err
+		}
+		p.Filters = append(p.Filters, pf)
+	}
+	return nil
+}
+
+// SetFilter adds or replaces filter of the peer. Counters start over
+func (p *PTPCloud) SetFilter(peer, allow string) error {
+	pf, err := NewPeerFilter(peer, allow)
+	if err != nil {
+		return err
+	}
+	p.filterLock.Lock()
+	defer p.filterLock.Unlock()
+	filters := []*PeerFilter{}
+	for _, f := range p.Filters {
+		if f.Peer != pf.Peer {
+			filters = append(filters, f)
+		}
+	}
+	p.Filters = append(filters, pf)
+	Log(INFO, "Traffic of %s is limited to %s", pf.Peer, pf.Allow())
+	return nil
+}
+
+// ClearFilter removes filter of the peer. Returns false if peer had no
+// filter
+func (p *PTPCloud) ClearFilter(peer string) bool {
+	peer = strings.ToLower(strings.TrimSpace(peer))
+	p.filterLock.Lock()
+	defer p.filterLock.Unlock()
+	for i, f := range p.Filters {
+		if f.Peer == peer {
+			p.Filters = append(p.Filters[:i:i], p.Filters[i+1:]...)
+			Log(INFO, "Filter of %s was removed", peer)
+			return true
+		}
+	}
+	return false
+}
+
+// PeerFilters returns filters of the instance
+func (p *PTPCloud) PeerFilters() []*PeerFilter {
+	p.filterLock.Lock()
+	defer p.filterLock.Unlock()
+	return append([]*PeerFilter{}, p.Filters...)
+}
+
+// filtered returns false if frame exchanged with the peer is dropped by
+// its filter. First filter matching the peer applies. Frames other than
+// IPv4 pass, like they pass ACL
+func (p *PTPCloud) filtered(peer *NetworkPeer, frame []byte, outbound bool) bool {
+	if len(p.Filters) == 0 || peer == nil {
+		return true
+	}
+	f, ok := parseFlow(frame)
+	if !ok {
+		return true
+	}
+	for _, pf := range p.PeerFilters() {
+		if p.peerListed([]string{pf.Peer}, peer) {
+			return pf.Check(f, outbound)
+		}
+	}
+	return true
+}
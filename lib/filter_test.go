@@ -0,0 +1,60 @@
+package ptp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterEntries(t *testing.T) {
+	entries, err := ParseFilterEntries("tcp/22, udp/5000-5010,icmp")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Filter was rejected: %v", err)
+	}
+	pf := &PeerFilter{Entries: entries}
+	if pf.Allow() != "tcp/22,udp/5000-5010,icmp" {
+		t.Errorf("Wrong entries: %s", pf.Allow())
+	}
+	for _, bad := range []string{"", "tcp/0", "icmp/8", "gre", "tcp/ssh"} {
+		if _, err := ParseFilterEntries(bad); err == nil {
+			t.Errorf("Bad filter %q was accepted", bad)
+		}
+	}
+}
+
+func TestPeerFilter(t *testing.T) {
+	p := new(PTPCloud)
+	semi := &NetworkPeer{ID: "Semi", PeerLocalIP: net.ParseIP("10.0.0.7")}
+	other := &NetworkPeer{ID: "other"}
+	if err := p.SetFilter("10.0.0.7", "tcp/22,icmp"); err != nil {
+		t.Fatalf("Failed to set filter: %v", err)
+	}
+	if !p.Allowed(semi, ipv4Frame(IPPROTO_TCP, 40000, 22), false) || !p.Allowed(semi, ipv4Frame(IPPROTO_TCP, 22, 40000), true) {
+		t.Errorf("SSH session of filtered peer was dropped")
+	}
+	if !p.Allowed(semi, ipv4Frame(IPPROTO_ICMP, 0, 0), false) {
+		t.Errorf("ICMP of filtered peer was dropped")
+	}
+	if p.Allowed(semi, ipv4Frame(IPPROTO_TCP, 40000, 5432), false) || p.Allowed(semi, ipv4Frame(IPPROTO_TCP, 40000, 80), true) {
+		t.Errorf("Traffic not listed in filter was allowed")
+	}
+	if !p.Allowed(other, ipv4Frame(IPPROTO_TCP, 40000, 5432), false) {
+		t.Errorf("Traffic of unfiltered peer was dropped")
+	}
+	filters := p.PeerFilters()
+	if len(filters) != 1 || !strings.Contains(filters[0].String(), "tcp/22 (2 hits), icmp (1 hits), 2 dropped") {
+		t.Errorf("Wrong counters: %v", filters)
+	}
+
+	p.SetFilter("semi", "udp/53")
+	p.SetFilter("semi", "tcp/80")
+	if len(p.PeerFilters()) != 2 {
+		t.Errorf("Filter of the same peer wasn't replaced")
+	}
+	if !p.ClearFilter("10.0.0.7") || p.ClearFilter("10.0.0.7") {
+		t.Errorf("Filter wasn't removed once")
+	}
+	if !p.Allowed(semi, ipv4Frame(IPPROTO_TCP, 40000, 80), false) || p.Allowed(semi, ipv4Frame(IPPROTO_TCP, 40000, 22), false) {
+		t.Errorf("Filter by ID doesn't apply")
+	}
+}
@@ -0,0 +1,138 @@
+package ptp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigHints are per-network settings suggested by routers. Zero values
+// mean that router has no suggestion
+type ConfigHints struct {
+	Keepalive time.Duration  // Ping interval of connected peers
+	Relays    []*net.UDPAddr // Forwarders that should be preferred
+	MTU       int            // MTU of the interface
+	Features  map[string]int // Rollout percents of features. Nil if not suggested
+}
+
+type HintsCallback func(h *ConfigHints)
+
+// ParseConfigHints extracts hints from a string in a form of
+// keepalive=SECONDS|mtu=BYTES|relays=HOST:PORT,HOST:PORT|features=NAME:PERCENT.
+// Unknown hints are skipped, so routers can introduce new ones
+func ParseConfigHints(arguments string) (*ConfigHints, error) {
+	h := new(ConfigHints)
+	for _, hint := range strings.Split(arguments, "|") {
+		if hint == "" {
+			continue
+		}
+		kv := strings.SplitN(hint, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Malformed hint " + hint)
+		}
+		switch kv[0] {
+		case "keepalive":
+			seconds, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			h.Keepalive = time.Duration(seconds) * time.Second
+		case "mtu":
+			mtu, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			h.MTU = mtu
+		case "relays":
+			for _, relay := range strings.Split(kv[1], ",") {
+				addr, err := net.ResolveUDPAddr("udp", relay)
+				if err != nil {
+					return nil, err
+				}
+				h.Relays = append(h.Relays, addr)
+			}
+		case "features":
+			rollout, err := ParseRollout(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			h.Features = rollout
+		default:
+			Log(DEBUG, "Skipping unknown hint %s", kv[0])
+		}
+	}
+	return h, nil
+}
+
+// clamp returns value limited to specified range
+func clamp(value, min, max int64) int64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// ApplyHints adjusts settings of the instance to hints received from
+// routers. Values are clamped to safe bounds and options set in local
+// configuration are never overridden
+func (p *PTPCloud) ApplyHints(h *ConfigHints) {
+	if p.IgnoreHints {
+		Log(DEBUG, "Ignoring configuration hints of routers")
+		return
+	}
+	if h.Keepalive > 0 && p.Keepalive == 0 {
+		interval := time.Duration(clamp(int64(h.Keepalive), int64(HINT_KEEPALIVE_MIN), int64(HINT_KEEPALIVE_MAX)))
+		if interval != p.PingInterval {
+			Log(INFO, "Routers suggest ping interval of %s", interval)
+			p.PingInterval = interval
+		}
+	}
+	if h.MTU > 0 {
+		mtu := int(clamp(int64(h.MTU), int64(HINT_MTU_MIN), int64(HINT_MTU_MAX)))
+		if dev, ok := p.Device.(*Interface); ok && mtu != p.MTU {
+			Log(INFO, "Routers suggest MTU of %d", mtu)
+			if p.Jumbo {
+				// Applied when interface leaves jumbo MTU
+				p.MTU = mtu
+			} else if err := SetMTU(dev, p.DeviceName, p.IPTool, strconv.Itoa(mtu)); err == nil {
+				p.MTU = mtu
+			}
+		}
+	}
+	if len(h.Relays) > HINT_MAX_RELAYS {
+		h.Relays = h.Relays[:HINT_MAX_RELAYS]
+	}
+	if h.Relays != nil {
+		p.Dht.PreferredRelays = h.Relays
+	}
+	if h.Features != nil && p.Features != nil {
+		p.Features.Apply(h.Features)
+	}
+}
+
+// IsPreferredRelay returns true if routers suggested to use this forwarder
+func (dht *DHTClient) IsPreferredRelay(addr *net.UDPAddr) bool {
+	for _, relay := range dht.PreferredRelays {
+		if relay.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (dht *DHTClient) HandleHints(data DHTMessage, conn PacketConn) {
+	h, err := ParseConfigHints(data.Arguments)
+	if err != nil {
+		Log(WARNING, "Failed to parse configuration hints from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	Log(DEBUG, "Received configuration hints from %s: %s", conn.RemoteAddr(), data.Arguments)
+	if dht.HintsHandler != nil {
+		dht.HintsHandler(h)
+	}
+}
@@ -0,0 +1,50 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseConfigHints(t *testing.T) {
+	h, err := ParseConfigHints("keepalive=20|mtu=1400|relays=10.0.0.1:6881,10.0.0.2:6882|future=1")
+	if err != nil {
+		t.Fatalf("Failed to parse hints: %v", err)
+	}
+	if h.Keepalive != 20*time.Second || h.MTU != 1400 || len(h.Relays) != 2 || h.Relays[1].String() != "10.0.0.2:6882" {
+		t.Errorf("Wrong hints: %+v", h)
+	}
+	for _, bad := range []string{"keepalive", "mtu=big", "relays=nowhere"} {
+		if _, err := ParseConfigHints(bad); err == nil {
+			t.Errorf("Malformed hints %q were accepted", bad)
+		}
+	}
+}
+
+func TestApplyHints(t *testing.T) {
+	p := new(PTPCloud)
+	p.Dht = new(DHTClient)
+	p.PingInterval = PEER_PING_TIMEOUT
+	relay := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	p.ApplyHints(&ConfigHints{Keepalive: time.Hour, Relays: []*net.UDPAddr{relay}})
+	if p.PingInterval != HINT_KEEPALIVE_MAX {
+		t.Errorf("Ping interval was not clamped: %s", p.PingInterval)
+	}
+	if !p.Dht.IsPreferredRelay(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}) {
+		t.Errorf("Preferred relay was not saved")
+	}
+
+	p.Keepalive = 15
+	p.PingInterval = 15 * time.Second
+	p.ApplyHints(&ConfigHints{Keepalive: 10 * time.Second})
+	if p.PingInterval != 15*time.Second {
+		t.Errorf("Hint has overridden local configuration")
+	}
+
+	p.Keepalive = 0
+	p.IgnoreHints = true
+	p.ApplyHints(&ConfigHints{Keepalive: 10 * time.Second})
+	if p.PingInterval != 15*time.Second {
+		t.Errorf("Hint was applied while hints are ignored")
+	}
+}
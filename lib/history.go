@@ -0,0 +1,254 @@
+package ptp
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistorySample is counters of a single peer at a point in time
+type HistorySample struct {
+	Time      time.Time
+	Peer      string
+	Connected bool
+	BytesSent uint64
+	BytesRecv uint64
+	RTT       time.Duration
+}
+
+// HistorySummary is throughput and availability of a peer over a period
+type HistorySummary struct {
+	Peer         string
+	Availability float64 // Percent of samples peer was connected
+	SendRate     int64   // Bytes per second
+	RecvRate     int64   // Bytes per second
+	RTT          time.Duration
+}
+
+// History records counters of peers into a file at intervals, so
+// throughput and availability can be queried later without external
+// monitoring. Samples older than HISTORY_RETENTION are dropped
+type History struct {
+	File      string
+	Interval  time.Duration
+	recorded  time.Time
+	compacted time.Time
+	lock      sync.Mutex
+}
+
+// HistoryPath returns location of recorded counters of a network
+func HistoryPath(hash string) string {
+	return filepath.Join(CONFIG_DIR, "p2p", "history", url.PathEscape(hash)+".log")
+}
+
+// NewHistory creates history recorded into file every interval
+func NewHistory(file string, interval time.Duration) (*History, error) {
+	if err := CheckAccess(file); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	return &History{File: file, Interval: interval}, nil
+}
+
+// Due returns true when next sample should be recorded
+func (h *History) Due() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return time.Since(h.recorded) >= h.Interval
+}
+
+// Marshal returns sample in a form of TIME PEER CONNECTED SENT RECV RTT,
+// where time is in seconds and RTT is in milliseconds
+func (s HistorySample) Marshal() string {
+	connected := 0
+	if s.Connected {
+		connected = 1
+	}
+	return fmt.Sprintf("%d %s %d %d %d %d", s.Time.Unix(), s.Peer, connected, s.BytesSent, s.BytesRecv, s.RTT.Milliseconds())
+}
+
+// ParseHistorySample is the reverse of Marshal
+func ParseHistorySample(line string) (HistorySample, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 {
+		return HistorySample{}, ErrMalformedMessage
+	}
+	var values [5]uint64
+	for i, j := range []int{0, 2, 3, 4, 5} {
+		value, err := strconv.ParseUint(fields[j], 10, 64)
+		if err != nil {
+			return HistorySample{}, ErrMalformedMessage
+		}
+		values[i] = value
+	}
+	return HistorySample{
+		Time:      time.Unix(int64(values[0]), 0),
+		Peer:      fields[1],
+		Connected: values[1] == 1,
+		BytesSent: values[2],
+		BytesRecv: values[3],
+		RTT:       time.Duration(values[4]) * time.Millisecond,
+	}, nil
+}
+
+// Record appends counters of the instance and its peers to the file.
+// File is compacted once in HISTORY_COMPACT_INTERVAL
+func (h *History) Record(stats InstanceStats) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.recorded = stats.Time
+	if time.Since(h.compacted) >= HISTORY_COMPACT_INTERVAL {
+		h.compacted = time.Now()
+		if err := h.compact(stats.Time.Add(-HISTORY_RETENTION)); err != nil {
+			Log(WARNING, "Failed to compact history of counters: %v", err)
+		}
+	}
+	lines := HistorySample{Time: stats.Time, Peer: HISTORY_TOTAL, Connected: stats.Connected > 0, BytesSent: stats.BytesSent, BytesRecv: stats.BytesRecv}.Marshal() + "\n"
+	for _, peer := range stats.PeerStats {
+		if peer.ID == "" {
+			continue
+		}
+		s := HistorySample{Time: stats.Time, Peer: peer.ID, Connected: peer.State == P_CONNECTED, BytesSent: peer.BytesSent, BytesRecv: peer.BytesRecv, RTT: peer.RTT}
+		lines += s.Marshal() + "\n"
+	}
+	f, err := os.OpenFile(h.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(lines)
+	return err
+}
+
+// compact drops samples recorded before since. Must be called with lock
+// held
+func (h *History) compact(since time.Time) error {
+	samples, err := ReadHistory(h.File, since)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var data []byte
+	for _, s := range samples {
+		data = append(data, s.Marshal()+"\n"...)
+	}
+	tmp := h.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.File)
+}
+
+// ReadHistory returns samples recorded in file since specified time.
+// Malformed lines, e.g. one cut by a crash, are skipped
+func ReadHistory(file string, since time.Time) ([]HistorySample, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var samples []HistorySample
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s, err := ParseHistorySample(scanner.Text())
+		if err != nil || s.Time.Before(since) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// SummarizeHistory returns throughput and availability of every peer
+// over the period covered by samples. Instance totals go first and peers
+// are sorted by ID. Throughput is averaged over the whole period and
+// availability counts samples in which peer was missing as unavailable.
+// Counters that went down were reset by a restart
+func SummarizeHistory(samples []HistorySample) []HistorySummary {
+	type summary struct {
+		last       HistorySample
+		connected  int
+		sent, recv uint64
+		rtt        time.Duration
+		measured   int
+	}
+	peers := make(map[string]*summary)
+	times := make(map[int64]bool)
+	var first, last time.Time
+	for _, s := range samples {
+		times[s.Time.Unix()] = true
+		if first.IsZero() || s.Time.Before(first) {
+			first = s.Time
+		}
+		if s.Time.After(last) {
+			last = s.Time
+		}
+		p, exists := peers[s.Peer]
+		if !exists {
+			p = &summary{last: s}
+			peers[s.Peer] = p
+		} else {
+			p.sent += counterDelta(s.BytesSent, p.last.BytesSent)
+			p.recv += counterDelta(s.BytesRecv, p.last.BytesRecv)
+			p.last = s
+		}
+		if s.Connected {
+			p.connected++
+			if s.RTT > 0 {
+				p.rtt += s.RTT
+				p.measured++
+			}
+		}
+	}
+	seconds := last.Sub(first).Seconds()
+	var result []HistorySummary
+	for id, p := range peers {
+		sum := HistorySummary{Peer: id, Availability: float64(p.connected) * 100 / float64(len(times))}
+		if seconds > 0 {
+			sum.SendRate = int64(float64(p.sent) / seconds)
+			sum.RecvRate = int64(float64(p.recv) / seconds)
+		}
+		if p.measured > 0 {
+			sum.RTT = p.rtt / time.Duration(p.measured)
+		}
+		result = append(result, sum)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Peer == HISTORY_TOTAL || result[j].Peer == HISTORY_TOTAL {
+			return result[i].Peer == HISTORY_TOTAL
+		}
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
+
+// counterDelta returns growth of a counter between two samples
+func counterDelta(current, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// RecordHistory records counters of the instance if history is enabled
+// and the interval has passed
+func (p *PTPCloud) RecordHistory() {
+	if p.History == nil || !p.History.Due() {
+		return
+	}
+	if err := p.History.Record(p.Stats()); err != nil {
+		Log(WARNING, "Failed to record counters: %v", err)
+	}
+}
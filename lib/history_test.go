@@ -0,0 +1,97 @@
+package ptp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistorySample(t *testing.T) {
+	s := HistorySample{Time: time.Unix(1700000000, 0), Peer: "peer", Connected: true, BytesSent: 10, BytesRecv: 20, RTT: 30 * time.Millisecond}
+	parsed, err := ParseHistorySample(s.Marshal())
+	if err != nil || parsed != s {
+		t.Errorf("Wrong sample: %+v %v", parsed, err)
+	}
+	for _, bad := range []string{"", "1700000000 peer 1 10 20", "x peer 1 10 20 30", "1700000000 peer 1 -10 20 30"} {
+		if _, err := ParseHistorySample(bad); err == nil {
+			t.Errorf("Malformed sample %q was accepted", bad)
+		}
+	}
+}
+
+func TestHistoryRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "history", "net.log")
+	h, err := NewHistory(file, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create history: %v", err)
+	}
+	if !h.Due() {
+		t.Errorf("First sample is not due")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	old := HistorySample{Time: now.Add(-HISTORY_RETENTION - time.Hour), Peer: "gone"}
+	if err := ioutil.WriteFile(file, []byte(old.Marshal()+"\ncut by cra"), 0600); err != nil {
+		t.Fatalf("Failed to write history: %v", err)
+	}
+	stats := InstanceStats{Time: now, Connected: 1, BytesSent: 100, PeerStats: []PeerStats{
+		{ID: "a", State: P_CONNECTED, BytesSent: 100, RTT: 20 * time.Millisecond},
+		{ID: "b", State: P_CONNECTING_DIRECTLY},
+	}}
+	if err := h.Record(stats); err != nil {
+		t.Fatalf("Failed to record counters: %v", err)
+	}
+	if h.Due() {
+		t.Errorf("Sample is due right after recording")
+	}
+	samples, err := ReadHistory(file, time.Time{})
+	if err != nil || len(samples) != 3 {
+		t.Fatalf("Old or malformed samples were kept: %+v %v", samples, err)
+	}
+	if samples[0].Peer != HISTORY_TOTAL || samples[1].Peer != "a" || !samples[1].Connected || samples[2].Connected {
+		t.Errorf("Wrong samples: %+v", samples)
+	}
+	if samples, _ := ReadHistory(file, now.Add(time.Second)); len(samples) != 0 {
+		t.Errorf("Samples before the period were returned: %+v", samples)
+	}
+}
+
+func TestSummarizeHistory(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	sample := func(offset int, peer string, connected bool, sent, recv uint64) HistorySample {
+		return HistorySample{Time: start.Add(time.Duration(offset) * time.Second), Peer: peer, Connected: connected, BytesSent: sent, BytesRecv: recv, RTT: 10 * time.Millisecond}
+	}
+	samples := []HistorySample{
+		sample(0, HISTORY_TOTAL, true, 0, 0),
+		sample(0, "b", true, 0, 0),
+		sample(50, HISTORY_TOTAL, true, 5000, 0),
+		sample(50, "b", true, 5000, 0),
+		sample(50, "a", false, 0, 0),
+		sample(100, HISTORY_TOTAL, true, 5000, 1000),
+		sample(100, "b", false, 5000, 1000),
+		sample(100, "a", true, 0, 0),
+	}
+	summary := SummarizeHistory(samples)
+	if len(summary) != 3 || summary[0].Peer != HISTORY_TOTAL || summary[1].Peer != "a" || summary[2].Peer != "b" {
+		t.Fatalf("Wrong summary order: %+v", summary)
+	}
+	if b := summary[2]; b.SendRate != 50 || b.RecvRate != 10 || int(b.Availability) != 66 || b.RTT != 10*time.Millisecond {
+		t.Errorf("Wrong summary of peer: %+v", b)
+	}
+	if a := summary[1]; int(a.Availability) != 33 || a.SendRate != 0 {
+		t.Errorf("Missing samples weren't counted as unavailable: %+v", a)
+	}
+
+	// Daemon was restarted, so counters start over
+	restarted := SummarizeHistory([]HistorySample{sample(0, "a", true, 9000, 0), sample(10, "a", true, 100, 0)})
+	if restarted[0].SendRate != 10 {
+		t.Errorf("Reset counter wasn't handled: %+v", restarted[0])
+	}
+}
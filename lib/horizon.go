@@ -0,0 +1,44 @@
+package ptp
+
+import (
+	"strings"
+)
+
+// ParseHubs splits comma-separated list of hubs. Hub is specified by peer
+// ID, IP address of its interface or tag
+func ParseHubs(hubs string) ([]string, error) {
+	return ParseTags(hubs)
+}
+
+// IsHub returns true if peer is one of the hubs this instance may
+// exchange traffic with
+func (p *PTPCloud) IsHub(peer *NetworkPeer) bool {
+	return p.peerListed(p.Hubs, peer)
+}
+
+// peerListed returns true if ID, IP or one of tags of the peer is in the
+// list. List is expected to be parsed with ParseTags
+func (p *PTPCloud) peerListed(list []string, peer *NetworkPeer) bool {
+	if peer == nil || len(list) == 0 {
+		return false
+	}
+	tags := p.PeerTags(peer)
+	for _, item := range list {
+		if item == strings.ToLower(peer.ID) || HasTag(tags, item) {
+			return true
+		}
+		if peer.PeerLocalIP != nil && item == peer.PeerLocalIP.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Reachable returns false when instance runs in split-horizon mode and
+// peer is not a hub. Spokes never exchange traffic with each other
+func (p *PTPCloud) Reachable(peer *NetworkPeer) bool {
+	if len(p.Hubs) == 0 {
+		return true
+	}
+	return p.IsHub(peer)
+}
@@ -0,0 +1,34 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSplitHorizon(t *testing.T) {
+	p := new(PTPCloud)
+	hub := &NetworkPeer{ID: "hub", PeerLocalIP: net.ParseIP("10.0.0.1")}
+	tagged := &NetworkPeer{ID: "tagged", Tags: []string{"hubs"}, TagsConfirmed: true}
+	spoke := &NetworkPeer{ID: "spoke", PeerLocalIP: net.ParseIP("10.0.0.5")}
+	frame := ipv4Frame(IPPROTO_TCP, 40000, 22)
+	if !p.Allowed(spoke, frame, true) {
+		t.Errorf("Traffic was dropped in full mesh")
+	}
+
+	var err error
+	p.Hubs, err = ParseHubs("10.0.0.1, hubs")
+	if err != nil {
+		t.Fatalf("Failed to parse hubs: %v", err)
+	}
+	for _, peer := range []*NetworkPeer{hub, tagged} {
+		if !p.Allowed(peer, frame, true) || !p.Allowed(peer, frame, false) {
+			t.Errorf("Traffic with hub %s was dropped", peer.ID)
+		}
+	}
+	if p.Allowed(spoke, frame, true) || p.Allowed(spoke, frame, false) {
+		t.Errorf("Traffic between spokes was allowed")
+	}
+	if p.Reachable(nil) {
+		t.Errorf("Unknown peer is reachable")
+	}
+}
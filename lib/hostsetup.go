@@ -0,0 +1,71 @@
+package ptp
+
+import (
+	"net"
+)
+
+// HostSetup describes changes made to the host for an instance: firewall
+// rule accepting p2p traffic, metric of the virtual interface and
+// isolation of its routes
+type HostSetup struct {
+	Rule     string     // Name of the firewall rule
+	Port     int        // UDP port accepted by the rule
+	Device   TapDevice  // Virtual interface
+	Network  *net.IPNet // Virtual network routed through Device
+	Metric   int        // Metric of the interface and route of the network
+	Firewall bool       // Firewall rule was added
+	Routed   bool       // Metric was changed
+	Table    int        // Routing table isolating routes of the network. Zero if not isolated
+	Undo     [][]string // Arguments of ip commands rolling isolation back
+}
+
+// SetupHost opens p2p port in host firewall and makes virtual network
+// preferred over other routes, where platform doesn't do it by itself.
+// Routes are isolated when configured, even if host setup is skipped.
+// Changes are rolled back by RestoreHost
+func (p *PTPCloud) SetupHost() {
+	if p.Device == nil || p.UDPSocket == nil || (p.SkipHostSetup && p.Isolation.Mode == "") {
+		return
+	}
+	h := &HostSetup{
+		Rule:   "p2p:" + p.DeviceName,
+		Port:   p.UDPSocket.GetPort(),
+		Device: p.Device,
+		Metric: p.InterfaceMetric,
+	}
+	if h.Metric == 0 {
+		h.Metric = DEFAULT_INTERFACE_METRIC
+	}
+	if p.Dht != nil {
+		h.Network = p.Dht.Network
+	}
+	if !p.SkipHostSetup {
+		err := setupHost(h)
+		if err != nil {
+			Log(WARNING, "Failed to configure host for the instance: %v", err)
+		}
+	}
+	if err := p.isolate(h); err != nil {
+		Log(ERROR, "Failed to isolate routes of the instance: %v", err)
+	}
+	if h.Firewall || h.Routed || h.Table != 0 {
+		Log(INFO, "Host configured: firewall rule %t, interface metric %t, routing table %d", h.Firewall, h.Routed, h.Table)
+		p.HostSetup = h
+	}
+}
+
+// RestoreHost rolls back changes made by SetupHost
+func (p *PTPCloud) RestoreHost() {
+	if p.HostSetup == nil {
+		return
+	}
+	err := restoreHost(p.HostSetup)
+	if err != nil {
+		Log(WARNING, "Failed to restore host configuration: %v", err)
+	}
+	err = restoreIsolation(p.HostSetup, p.IPTool)
+	if err != nil {
+		Log(WARNING, "Failed to roll back isolation of routes: %v", err)
+	}
+	p.HostSetup = nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package ptp
+
+// setupHost does nothing. Interface route is added when interface is
+// configured and firewall is left to the administrator
+func setupHost(h *HostSetup) error {
+	return nil
+}
+
+func restoreHost(h *HostSetup) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+package ptp
+
+import (
+	"testing"
+)
+
+func TestSetupHostSkipped(t *testing.T) {
+	p := new(PTPCloud)
+	p.Device = NewFakeTap()
+	p.SkipHostSetup = true
+	p.SetupHost()
+	if p.HostSetup != nil {
+		t.Errorf("Host was configured while setup is disabled")
+	}
+	// Nothing to roll back
+	p.RestoreHost()
+}
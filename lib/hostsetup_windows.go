@@ -0,0 +1,64 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+)
+
+// interfaceAlias returns name of the TAP adapter used by PowerShell
+func interfaceAlias(dev TapDevice) string {
+	if inf, ok := dev.(*Interface); ok {
+		return inf.Interface
+	}
+	return ""
+}
+
+// networkPrefix returns network in CIDR notation with host bits cleared
+func networkPrefix(network *net.IPNet) string {
+	ones, _ := network.Mask.Size()
+	return fmt.Sprintf("%s/%d", network.IP.Mask(network.Mask), ones)
+}
+
+// setupHost adds inbound firewall rule for the p2p port and sets metric of
+// the TAP adapter and route of the virtual network
+func setupHost(h *HostSetup) error {
+	// Rule left by a crashed instance is replaced
+	err := powershell(fmt.Sprintf("Remove-NetFirewallRule -DisplayName '%s' -ErrorAction SilentlyContinue; "+
+		"New-NetFirewallRule -DisplayName '%s' -Direction Inbound -Protocol UDP -LocalPort %d -Action Allow | Out-Null", h.Rule, h.Rule, h.Port))
+	if err != nil {
+		return err
+	}
+	h.Firewall = true
+	alias := interfaceAlias(h.Device)
+	if alias == "" {
+		return nil
+	}
+	err = powershell(fmt.Sprintf("Set-NetIPInterface -InterfaceAlias '%s' -AddressFamily IPv4 -InterfaceMetric %d", alias, h.Metric))
+	if err != nil {
+		return err
+	}
+	h.Routed = true
+	if h.Network == nil {
+		return nil
+	}
+	prefix := networkPrefix(h.Network)
+	return powershell(fmt.Sprintf("$r = Get-NetRoute -DestinationPrefix '%s' -InterfaceAlias '%s' -ErrorAction SilentlyContinue; "+
+		"if ($r) { $r | Set-NetRoute -RouteMetric %d } else { New-NetRoute -DestinationPrefix '%s' -InterfaceAlias '%s' -RouteMetric %d -PolicyStore ActiveStore | Out-Null }",
+		prefix, alias, h.Metric, prefix, alias, h.Metric))
+}
+
+// restoreHost removes firewall rule and returns automatic metric to the
+// adapter. Routes of the virtual network are removed with the adapter
+func restoreHost(h *HostSetup) error {
+	var result error
+	if h.Firewall {
+		result = powershell(fmt.Sprintf("Remove-NetFirewallRule -DisplayName '%s'", h.Rule))
+	}
+	if alias := interfaceAlias(h.Device); h.Routed && alias != "" {
+		err := powershell(fmt.Sprintf("Set-NetIPInterface -InterfaceAlias '%s' -AddressFamily IPv4 -AutomaticMetric Enabled", alias))
+		if result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,14 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworkPrefix(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.10.0.7/24")
+	network.IP = net.ParseIP("10.10.0.7")
+	if prefix := networkPrefix(network); prefix != "10.10.0.0/24" {
+		t.Errorf("Wrong prefix: %s", prefix)
+	}
+}
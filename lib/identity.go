@@ -0,0 +1,172 @@
+package ptp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Identity is a long-term key pair of an instance. ID of the instance
+// is derived from the public key, so it stays the same across reconnects
+// and can't be used by anyone without the private key
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	ID         string
+}
+
+// GenerateIdentity creates new key pair
+func GenerateIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	i := new(Identity)
+	i.PublicKey = pub
+	i.PrivateKey = priv
+	i.ID = DeriveID(pub)
+	return i, nil
+}
+
+// DeriveID returns ID in the same 36 characters format that DHT uses
+func DeriveID(pub []byte) string {
+	h := sha256.Sum256(pub)
+	s := hex.EncodeToString(h[:16])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", s[0:8], s[8:12], s[12:16], s[16:20], s[20:32])
+}
+
+// Sign returns signature of provided data
+func (i *Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(i.PrivateKey, data)
+}
+
+// PublicKeyString returns hex-encoded public key
+func (i *Identity) PublicKeyString() string {
+	return hex.EncodeToString(i.PublicKey)
+}
+
+// VerifyIdentity checks that ID was derived from provided public key and
+// that data was signed with the corresponding private key
+func VerifyIdentity(id string, pub, data, signature []byte) bool {
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	if DeriveID(pub) != id {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), data, signature)
+}
+
+// identityFile is the content of a file identity is stored in. ID is kept
+// for humans and is checked against the key on load
+type identityFile struct {
+	ID         string `yaml:"id"`
+	PrivateKey string `yaml:"private_key"`
+}
+
+// IdentityPath returns default location of identity file of a network
+func IdentityPath(hash string) string {
+	return filepath.Join(CONFIG_DIR, "p2p", "identity", url.PathEscape(hash)+".yaml")
+}
+
+// LoadIdentity reads identity from a file. Files readable by other users
+// are rejected, because anyone with the key can pose as this instance
+func LoadIdentity(path string) (*Identity, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, errors.New(fmt.Sprintf("Identity file %s is accessible by other users. Set its permissions to 0600", path))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file identityFile
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(file.PrivateKey)
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New(fmt.Sprintf("Identity file %s contains malformed key", path))
+	}
+	i := new(Identity)
+	i.PrivateKey = ed25519.PrivateKey(key)
+	i.PublicKey = i.PrivateKey.Public().(ed25519.PublicKey)
+	i.ID = DeriveID(i.PublicKey)
+	if file.ID != "" && file.ID != i.ID {
+		return nil, errors.New(fmt.Sprintf("Identity file %s was modified: ID doesn't match the key", path))
+	}
+	return i, nil
+}
+
+// Save writes identity into a file readable by the owner only. File is
+// replaced atomically, so interrupted rotation doesn't lose identity
+func (i *Identity) Save(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(identityFile{ID: i.ID, PrivateKey: hex.EncodeToString(i.PrivateKey)})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadOrCreateIdentity reads identity from a file. New identity is
+// generated and saved when file doesn't exist yet. Generated identity is
+// returned along with the error if it couldn't be saved
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	if err := CheckAccess(path); err != nil {
+		return nil, err
+	}
+	i, err := LoadIdentity(path)
+	if err == nil || !os.IsNotExist(err) {
+		return i, err
+	}
+	i, err = GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	Log(INFO, "Created new identity %s in %s", i.ID, path)
+	return i, i.Save(path)
+}
+
+// RotateIdentity replaces identity of the instance with a new one and
+// rejoins the network, so routers and peers learn the new ID
+func (p *PTPCloud) RotateIdentity() (*Identity, error) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if p.IdentityFile != "" {
+		err = identity.Save(p.IdentityFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to save identity: %v", err))
+		}
+	}
+	Log(INFO, "Rotating identity %s to %s", p.Identity.ID, identity.ID)
+	hash := p.Dht.NetworkHash
+	routers := p.Dht.Routers
+	p.leaveNetwork()
+	p.Identity = identity
+	p.rejoinNetwork(hash, routers)
+	return identity, nil
+}
@@ -0,0 +1,104 @@
+package ptp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestIdentity(t *testing.T) {
+	i, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	if len(i.ID) != 36 {
+		t.Errorf("Wrong ID length: %d", len(i.ID))
+	}
+	if DeriveID(i.PublicKey) != i.ID {
+		t.Errorf("ID is not stable")
+	}
+	data := []byte("id,01:02:03:04:05:06,127.0.0.1")
+	signature := i.Sign(data)
+	if !VerifyIdentity(i.ID, i.PublicKey, data, signature) {
+		t.Errorf("Failed to verify valid signature")
+	}
+	other, _ := GenerateIdentity()
+	if VerifyIdentity(other.ID, i.PublicKey, data, signature) {
+		t.Errorf("Foreign ID was accepted")
+	}
+	if VerifyIdentity(i.ID, i.PublicKey, []byte("tampered"), signature) {
+		t.Errorf("Tampered data was accepted")
+	}
+}
+
+func TestVerifyIntroString(t *testing.T) {
+	p := new(PTPCloud)
+	p.Mac = "01:02:03:04:05:06"
+	p.IP = "127.0.0.1"
+	p.Identity, _ = GenerateIdentity()
+	msg := p.PrepareIntroductionMessage(p.Identity.ID)
+	if !p.VerifyIntroString(string(msg.Data)) {
+		t.Errorf("Failed to verify signed introduction")
+	}
+	id, _, _ := p.ParseIntroString(string(msg.Data))
+	if id != p.Identity.ID {
+		t.Errorf("Failed to parse signed introduction")
+	}
+	spoofed := strings.Replace(string(msg.Data), p.Identity.ID, "spoofed-id", 1)
+	if p.VerifyIntroString(spoofed) {
+		t.Errorf("Spoofed ID was accepted")
+	}
+}
+
+func TestStrippedIntroduction(t *testing.T) {
+	p := new(PTPCloud)
+	p.Mac = "01:02:03:04:05:06"
+	p.IP = "127.0.0.1"
+	p.Identity, _ = GenerateIdentity()
+	signed := string(p.PrepareIntroductionMessage(p.Identity.ID).Data)
+	stripped := strings.Join(strings.Split(signed, ",")[:3], ",")
+	if !p.VerifyIntroString(stripped) {
+		t.Errorf("Unsigned introduction of unknown peer was refused")
+	}
+	p.AcceptIntroduction(&NetworkPeer{ID: p.Identity.ID}, ParseIntroduction(signed))
+	if p.VerifyIntroString(stripped) {
+		t.Errorf("Stripped introduction of a peer with known identity was accepted")
+	}
+	if !p.VerifyIntroString(signed) {
+		t.Errorf("Signed introduction of known peer was refused")
+	}
+}
+
+func TestIdentityFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "p2p", "net.yaml")
+	created, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	loaded, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to load identity: %v", err)
+	}
+	if loaded.ID != created.ID || !loaded.PublicKey.Equal(created.PublicKey) {
+		t.Errorf("Identity changed after reload: %s, %s", created.ID, loaded.ID)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Identity file has permissions %o", info.Mode().Perm())
+	}
+	os.Chmod(path, 0644)
+	if _, err := LoadIdentity(path); err == nil {
+		t.Errorf("Identity file readable by others was loaded")
+	}
+}
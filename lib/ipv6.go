@@ -0,0 +1,55 @@
+package ptp
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// IsIPv6Only returns true when none of the addresses is IPv4. Host without
+// IPv4 can't reach routers, peers and forwarders over IPv4
+func IsIPv6Only(ips []net.IP) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// JoinEndpoint formats address and port of an endpoint. IPv6 literals are
+// enclosed in brackets
+func JoinEndpoint(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ResolveEndpoint resolves HOST:PORT. When ipv6only is set names are
+// resolved into AAAA records only, otherwise IPv4 is preferred. Unbracketed
+// IPv6 literals, like 2001:db8::1:6881, are accepted with the last part
+// being the port
+func ResolveEndpoint(endpoint string, ipv6only bool) (*net.UDPAddr, error) {
+	network := "udp"
+	if ipv6only {
+		network = "udp6"
+	}
+	if strings.Count(endpoint, ":") > 1 && !strings.HasPrefix(endpoint, "[") {
+		if i := strings.LastIndex(endpoint, ":"); net.ParseIP(endpoint[:i]) != nil {
+			endpoint = "[" + endpoint[:i] + "]" + endpoint[i:]
+		}
+	}
+	return net.ResolveUDPAddr(network, endpoint)
+}
+
+// Resolve resolves address of a router, peer or forwarder using address
+// family available on this host
+func (dht *DHTClient) Resolve(endpoint string) (*net.UDPAddr, error) {
+	return ResolveEndpoint(endpoint, dht.IPv6Only)
+}
+
+// Reachable returns false for IPv4 endpoints on IPv6-only host
+func (dht *DHTClient) Reachable(addr *net.UDPAddr) bool {
+	return !dht.IPv6Only || addr.IP.To4() == nil
+}
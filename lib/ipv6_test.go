@@ -0,0 +1,47 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPv6Only(t *testing.T) {
+	if IsIPv6Only(nil) {
+		t.Errorf("Host without addresses isn't IPv6-only")
+	}
+	if IsIPv6Only([]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.168.1.2")}) {
+		t.Errorf("Dual-stack host was considered IPv6-only")
+	}
+	if !IsIPv6Only([]net.IP{net.ParseIP("2001:db8::1")}) {
+		t.Errorf("IPv6-only host wasn't detected")
+	}
+
+	if e := JoinEndpoint("2001:db8::1", 6881); e != "[2001:db8::1]:6881" {
+		t.Errorf("IPv6 endpoint should be bracketed: %s", e)
+	}
+	if e := JoinEndpoint("10.0.0.1", 6881); e != "10.0.0.1:6881" {
+		t.Errorf("Wrong IPv4 endpoint: %s", e)
+	}
+
+	for _, endpoint := range []string{"[2001:db8::1]:6881", "2001:db8::1:6881"} {
+		addr, err := ResolveEndpoint(endpoint, false)
+		if err != nil {
+			t.Errorf("Failed to resolve %s: %v", endpoint, err)
+			continue
+		}
+		if addr.String() != "[2001:db8::1]:6881" {
+			t.Errorf("%s was resolved to %s", endpoint, addr)
+		}
+	}
+	if _, err := ResolveEndpoint("10.0.0.1:6881", true); err == nil {
+		t.Errorf("IPv4 endpoint was resolved on IPv6-only host")
+	}
+
+	dht := &DHTClient{IPv6Only: true}
+	if dht.Reachable(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}) {
+		t.Errorf("IPv4 forwarder is unreachable from IPv6-only host")
+	}
+	if !dht.Reachable(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}) {
+		t.Errorf("IPv6 forwarder should be reachable")
+	}
+}
@@ -0,0 +1,164 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+)
+
+// IsolationConfig places routes of the virtual network into a routing
+// table of its own, so they can't leak into the main table and instances
+// with overlapping subnets can coexist on one host
+type IsolationConfig struct {
+	Mode  string `yaml:"mode"`  // vrf or table. Empty disables isolation
+	Table int    `yaml:"table"` // Routing table of the instance. Derived from interface name if zero
+	Mark  int    `yaml:"mark"`  // Firewall mark of packets routed through the table in table mode. Table number if zero
+}
+
+// ParseIsolationMode parses mode of routing isolation. Empty value means
+// routes are installed into the main table
+func ParseIsolationMode(value string) (IsolationMode, error) {
+	switch value {
+	case "":
+		return ISOLATION_NONE, nil
+	case "vrf":
+		return ISOLATION_VRF, nil
+	case "table":
+		return ISOLATION_TABLE, nil
+	}
+	return ISOLATION_NONE, errors.New(fmt.Sprintf("Unknown isolation mode %s. Use vrf or table", value))
+}
+
+func (im IsolationMode) String() string {
+	switch im {
+	case ISOLATION_VRF:
+		return "vrf"
+	case ISOLATION_TABLE:
+		return "table"
+	}
+	return "none"
+}
+
+// ValidateIsolation checks isolation configured for an instance
+func ValidateIsolation(cfg IsolationConfig) error {
+	mode, err := ParseIsolationMode(cfg.Mode)
+	if err != nil || mode == ISOLATION_NONE {
+		return err
+	}
+	if !isolationSupported {
+		return errors.New("Routing isolation is supported on Linux only")
+	}
+	if cfg.Table < 0 || cfg.Mark < 0 {
+		return errors.New("Routing table and mark can't be negative")
+	}
+	return nil
+}
+
+// IsolationTable returns routing table of an interface. Table is derived
+// from the name, so it stays the same across restarts
+func IsolationTable(device string) int {
+	h := fnv.New32a()
+	h.Write([]byte(device))
+	return ISOLATION_TABLE_BASE + int(h.Sum32()%uint32(ISOLATION_TABLE_RANGE))
+}
+
+// vrfName returns name of VRF device of an interface
+func vrfName(device string) string {
+	name := "vrf-" + device
+	if len(name) > 15 {
+		// Longer interface names are rejected by the kernel
+		name = name[:15]
+	}
+	return name
+}
+
+// isolationCommands returns arguments of ip commands that isolate routes
+// of the interface and those that roll isolation back. In VRF mode kernel
+// moves routes of the interface into the table of VRF itself. In table
+// mode route of the network is moved from the main table and traffic is
+// routed through the table by source address or firewall mark
+func isolationCommands(mode IsolationMode, device string, table, mark int, ip net.IP, network *net.IPNet) (setup, restore [][]string, err error) {
+	t := strconv.Itoa(table)
+	switch mode {
+	case ISOLATION_VRF:
+		vrf := vrfName(device)
+		setup = [][]string{
+			{"link", "add", vrf, "type", "vrf", "table", t},
+			{"link", "set", "dev", vrf, "up"},
+			{"link", "set", "dev", device, "master", vrf},
+		}
+		restore = [][]string{{"link", "del", vrf}}
+	case ISOLATION_TABLE:
+		if ip == nil || network == nil {
+			return nil, nil, errors.New("Address of the instance is not known yet")
+		}
+		m := strconv.Itoa(mark)
+		setup = [][]string{
+			{"route", "del", network.String(), "dev", device},
+			{"route", "add", network.String(), "dev", device, "src", ip.String(), "table", t},
+			{"rule", "add", "from", ip.String(), "table", t},
+			{"rule", "add", "fwmark", m, "table", t},
+		}
+		restore = [][]string{
+			{"rule", "del", "fwmark", m, "table", t},
+			{"rule", "del", "from", ip.String(), "table", t},
+			{"route", "flush", "table", t},
+		}
+	}
+	return setup, restore, nil
+}
+
+// isolate applies isolation configured for the instance. Commands that
+// roll it back are kept in host setup
+func (p *PTPCloud) isolate(h *HostSetup) error {
+	mode, err := ParseIsolationMode(p.Isolation.Mode)
+	if err != nil || mode == ISOLATION_NONE {
+		return err
+	}
+	table := p.Isolation.Table
+	if table == 0 {
+		table = IsolationTable(p.DeviceName)
+	}
+	mark := p.Isolation.Mark
+	if mark == 0 {
+		mark = table
+	}
+	var ip net.IP
+	if p.Dht != nil {
+		ip = p.Dht.IP
+	}
+	setup, restore, err := isolationCommands(mode, p.DeviceName, table, mark, ip, h.Network)
+	if err != nil {
+		return err
+	}
+	for i, args := range setup {
+		if err := runIPTool(p.IPTool, args); err != nil {
+			// Roll back what was applied. Undo commands of steps that
+			// weren't applied fail harmlessly
+			if i > 0 {
+				for _, args := range restore {
+					runIPTool(p.IPTool, args)
+				}
+			}
+			return err
+		}
+	}
+	Log(INFO, "Routes of %s are isolated in table %d (%s)", p.DeviceName, table, mode)
+	h.Table = table
+	h.Undo = restore
+	return nil
+}
+
+// restoreIsolation rolls back isolation of the instance routes
+func restoreIsolation(h *HostSetup, tool string) error {
+	var failed error
+	for _, args := range h.Undo {
+		if err := runIPTool(tool, args); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	h.Undo = nil
+	return failed
+}
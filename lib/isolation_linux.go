@@ -0,0 +1,19 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const isolationSupported = true
+
+// runIPTool runs ip tool with specified arguments
+func runIPTool(tool string, args []string) error {
+	out, err := exec.Command(tool, args...).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s %s: %v: %s", tool, strings.Join(args, " "), err, strings.TrimSpace(string(out))))
+	}
+	return nil
+}
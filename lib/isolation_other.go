@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package ptp
+
+import (
+	"errors"
+)
+
+const isolationSupported = false
+
+// runIPTool fails, since routing isolation relies on Linux policy routing
+func runIPTool(tool string, args []string) error {
+	return errors.New("Routing isolation is not supported on this platform")
+}
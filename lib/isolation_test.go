@@ -0,0 +1,79 @@
+package ptp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseIsolationMode(t *testing.T) {
+	for value, expected := range map[string]IsolationMode{"": ISOLATION_NONE, "vrf": ISOLATION_VRF, "table": ISOLATION_TABLE} {
+		mode, err := ParseIsolationMode(value)
+		if err != nil || mode != expected {
+			t.Errorf("Wrong mode of %q: %s %v", value, mode, err)
+		}
+	}
+	if _, err := ParseIsolationMode("netns"); err == nil {
+		t.Errorf("Unknown mode was accepted")
+	}
+	if err := ValidateIsolation(IsolationConfig{}); err != nil {
+		t.Errorf("Disabled isolation was rejected: %v", err)
+	}
+	if err := ValidateIsolation(IsolationConfig{Mode: "vrf", Table: -1}); err == nil {
+		t.Errorf("Negative table was accepted")
+	}
+}
+
+func TestIsolationTable(t *testing.T) {
+	a, b := IsolationTable("vptp1"), IsolationTable("vptp2")
+	if a != IsolationTable("vptp1") || a == b {
+		t.Errorf("Tables of interfaces are not stable or collide: %d %d", a, b)
+	}
+	for _, table := range []int{a, b} {
+		if table < ISOLATION_TABLE_BASE || table >= ISOLATION_TABLE_BASE+ISOLATION_TABLE_RANGE {
+			t.Errorf("Table %d is out of range", table)
+		}
+	}
+	if name := vrfName("averylongdevice"); len(name) > 15 {
+		t.Errorf("VRF name is too long: %s", name)
+	}
+}
+
+func TestIsolationCommands(t *testing.T) {
+	join := func(commands [][]string) string {
+		var lines []string
+		for _, args := range commands {
+			lines = append(lines, strings.Join(args, " "))
+		}
+		return strings.Join(lines, "\n")
+	}
+	setup, restore, err := isolationCommands(ISOLATION_VRF, "vptp1", 10100, 0, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to isolate in VRF: %v", err)
+	}
+	if !strings.Contains(join(setup), "link add vrf-vptp1 type vrf table 10100") || !strings.Contains(join(setup), "link set dev vptp1 master vrf-vptp1") {
+		t.Errorf("Wrong VRF setup:\n%s", join(setup))
+	}
+	if join(restore) != "link del vrf-vptp1" {
+		t.Errorf("Wrong VRF rollback:\n%s", join(restore))
+	}
+
+	if _, _, err := isolationCommands(ISOLATION_TABLE, "vptp1", 10100, 7, nil, nil); err == nil {
+		t.Errorf("Table isolation without address was accepted")
+	}
+	ip, network, _ := net.ParseCIDR("192.168.1.5/24")
+	setup, restore, err = isolationCommands(ISOLATION_TABLE, "vptp1", 10100, 7, ip, network)
+	if err != nil {
+		t.Fatalf("Failed to isolate in table: %v", err)
+	}
+	expected := "route del 192.168.1.0/24 dev vptp1\n" +
+		"route add 192.168.1.0/24 dev vptp1 src 192.168.1.5 table 10100\n" +
+		"rule add from 192.168.1.5 table 10100\n" +
+		"rule add fwmark 7 table 10100"
+	if join(setup) != expected {
+		t.Errorf("Wrong table setup:\n%s", join(setup))
+	}
+	if !strings.Contains(join(restore), "rule del fwmark 7 table 10100") || !strings.Contains(join(restore), "route flush table 10100") {
+		t.Errorf("Wrong table rollback:\n%s", join(restore))
+	}
+}
@@ -0,0 +1,133 @@
+package ptp
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// Layout of latency histogram. Values are microseconds. Below
+// 2*LATENCY_SUB_BUCKETS every value has its own bucket, above that every
+// power of two is split into LATENCY_SUB_BUCKETS buckets, so error of a
+// quantile stays within about 6% from microseconds up to two minutes
+const (
+	LATENCY_SUB_BUCKETS int = 16
+	LATENCY_BUCKETS     int = LATENCY_SUB_BUCKETS * 24
+)
+
+// LatencySummary is a snapshot of latency distribution of a peer
+type LatencySummary struct {
+	P50     time.Duration
+	P95     time.Duration
+	P99     time.Duration
+	Jitter  time.Duration // Mean deviation between consecutive round trips
+	Samples int
+}
+
+func (s LatencySummary) String() string {
+	return fmt.Sprintf("RTT p50/p95/p99: %s/%s/%s, jitter %s", s.P50, s.P95, s.P99, s.Jitter)
+}
+
+// LatencyStats keeps histogram of round trip times measured by pings of
+// a peer and jitter estimate. Histogram covers the last one or two
+// LATENCY_WINDOW, so old spikes don't hide current state
+type LatencyStats struct {
+	current  [LATENCY_BUCKETS]uint32
+	previous [LATENCY_BUCKETS]uint32
+	rotated  time.Time // When current window has started
+	jitter   float64   // Microseconds
+	last     time.Duration
+	measured bool
+	lock     sync.Mutex
+}
+
+// latencyBucket returns bucket of a value in microseconds
+func latencyBucket(us uint64) int {
+	if us < uint64(2*LATENCY_SUB_BUCKETS) {
+		return int(us)
+	}
+	shift := bits.Len64(us) - bits.Len(uint(2*LATENCY_SUB_BUCKETS)) + 1
+	bucket := LATENCY_SUB_BUCKETS*(shift+1) + int(us>>uint(shift)) - LATENCY_SUB_BUCKETS
+	if bucket >= LATENCY_BUCKETS {
+		return LATENCY_BUCKETS - 1
+	}
+	return bucket
+}
+
+// latencyValue returns middle of a bucket in microseconds
+func latencyValue(bucket int) uint64 {
+	if bucket < 2*LATENCY_SUB_BUCKETS {
+		return uint64(bucket)
+	}
+	shift := uint(bucket/LATENCY_SUB_BUCKETS - 1)
+	base := uint64(bucket%LATENCY_SUB_BUCKETS+LATENCY_SUB_BUCKETS) << shift
+	return base + (uint64(1)<<shift)/2
+}
+
+// Add accounts round trip time measured at specified moment
+func (l *LatencyStats) Add(rtt time.Duration, now time.Time) {
+	if rtt < 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if elapsed := now.Sub(l.rotated); elapsed >= LATENCY_WINDOW {
+		if elapsed >= 2*LATENCY_WINDOW {
+			l.previous = [LATENCY_BUCKETS]uint32{}
+		} else {
+			l.previous = l.current
+		}
+		l.current = [LATENCY_BUCKETS]uint32{}
+		l.rotated = now
+	}
+	l.current[latencyBucket(uint64(rtt/time.Microsecond))]++
+	if l.measured {
+		// Smoothed like interarrival jitter of RTP, see RFC 3550
+		d := math.Abs(float64((rtt - l.last) / time.Microsecond))
+		l.jitter += (d - l.jitter) / 16
+	}
+	l.last = rtt
+	l.measured = true
+}
+
+// Summary returns quantiles of round trip times and jitter
+func (l *LatencyStats) Summary() LatencySummary {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var counts [LATENCY_BUCKETS]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = uint64(l.current[i]) + uint64(l.previous[i])
+		total += counts[i]
+	}
+	s := LatencySummary{Samples: int(total), Jitter: time.Duration(l.jitter) * time.Microsecond}
+	if total == 0 {
+		return s
+	}
+	quantile := func(q float64) time.Duration {
+		rank := uint64(math.Ceil(q * float64(total)))
+		var seen uint64
+		for i, count := range counts {
+			seen += count
+			if seen >= rank {
+				return time.Duration(latencyValue(i)) * time.Microsecond
+			}
+		}
+		return 0
+	}
+	s.P50, s.P95, s.P99 = quantile(0.5), quantile(0.95), quantile(0.99)
+	return s
+}
+
+// measureLatency accounts round trip time of a ping answered by the peer
+func (p *PTPCloud) measureLatency(peer *NetworkPeer, rtt time.Duration) {
+	p.PeersLock.Lock()
+	if peer.Latency == nil {
+		peer.Latency = new(LatencyStats)
+	}
+	stats := peer.Latency
+	p.PeersLock.Unlock()
+	stats.Add(rtt, time.Now())
+}
@@ -0,0 +1,65 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	for _, us := range []uint64{0, 1, 31, 32, 33, 100, 1500, 20000, 250000, 3000000, 100000000} {
+		value := latencyValue(latencyBucket(us))
+		if diff := float64(value) - float64(us); diff > float64(us)/16+1 || -diff > float64(us)/16+1 {
+			t.Errorf("Value %d is reported as %d", us, value)
+		}
+	}
+	for us := uint64(1); us < 1<<20; us = us*3/2 + 1 {
+		if latencyBucket(us) < latencyBucket(us-1) {
+			t.Fatalf("Buckets are not ordered at %d", us)
+		}
+	}
+	if latencyBucket(1<<40) != LATENCY_BUCKETS-1 {
+		t.Errorf("Huge value is out of histogram")
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	l := new(LatencyStats)
+	if s := l.Summary(); s.Samples != 0 || s.P99 != 0 {
+		t.Errorf("Empty histogram has samples: %+v", s)
+	}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		rtt := 20 * time.Millisecond
+		if i%10 == 0 {
+			rtt = 200 * time.Millisecond
+		}
+		l.Add(rtt, now)
+	}
+	s := l.Summary()
+	if s.Samples != 100 {
+		t.Errorf("Wrong number of samples: %d", s.Samples)
+	}
+	within := func(d, expected time.Duration) bool {
+		return d >= expected*15/16 && d <= expected*17/16
+	}
+	if !within(s.P50, 20*time.Millisecond) || !within(s.P95, 200*time.Millisecond) || !within(s.P99, 200*time.Millisecond) {
+		t.Errorf("Wrong quantiles: %s", s)
+	}
+	if s.Jitter <= 0 || s.Jitter >= 180*time.Millisecond {
+		t.Errorf("Wrong jitter: %s", s.Jitter)
+	}
+
+	// Spike is forgotten two windows later
+	l.Add(30*time.Millisecond, now.Add(LATENCY_WINDOW))
+	if s := l.Summary(); s.Samples != 101 {
+		t.Errorf("Previous window was dropped: %d", s.Samples)
+	}
+	l.Add(30*time.Millisecond, now.Add(2*LATENCY_WINDOW))
+	if s := l.Summary(); s.Samples != 2 || !within(s.P99, 30*time.Millisecond) {
+		t.Errorf("Old samples are still counted: %s (%d samples)", s, s.Samples)
+	}
+	l.Add(30*time.Millisecond, now.Add(5*LATENCY_WINDOW))
+	if s := l.Summary(); s.Samples != 1 {
+		t.Errorf("Samples of stale window are counted: %d", s.Samples)
+	}
+}
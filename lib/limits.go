@@ -0,0 +1,172 @@
+package ptp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resources tracks usage of daemon resources by an instance and enforces
+// configured caps, so one busy network can't starve others. Zero cap
+// means unlimited
+type Resources struct {
+	MaxBuffers    int64  // Bytes held by packets being processed
+	MaxGoroutines int64  // Goroutines started by the instance
+	MaxBandwidth  int64  // Bytes of data traffic per second in both directions
+	Quota         *Quota // Transfer totals and their limits. Nil if unlimited
+	buffers       int64
+	goroutines    int64
+	dropped       uint64
+	tokens        float64   // Bandwidth bucket
+	last          time.Time // Last refill of bandwidth bucket
+	window        time.Time // Start of current measurement window
+	windowBytes   int64
+	rate          int64 // Bandwidth measured in the previous window
+	lock          sync.Mutex
+}
+
+// NewResources creates resource counters with specified caps
+func NewResources(buffers, goroutines, bandwidth int64) *Resources {
+	r := new(Resources)
+	r.MaxBuffers = buffers
+	r.MaxGoroutines = goroutines
+	r.MaxBandwidth = bandwidth
+	r.tokens = float64(bandwidth)
+	r.last = time.Now()
+	r.window = r.last
+	return r
+}
+
+func (r *Resources) started() {
+	if r != nil {
+		atomic.AddInt64(&r.goroutines, 1)
+	}
+}
+
+func (r *Resources) finished() {
+	if r != nil {
+		atomic.AddInt64(&r.goroutines, -1)
+	}
+}
+
+// CanSpawn returns false when instance has reached goroutines cap.
+// Packet that needs a new goroutine should be dropped in this case
+func (r *Resources) CanSpawn() bool {
+	if r == nil || r.MaxGoroutines == 0 || atomic.LoadInt64(&r.goroutines) < r.MaxGoroutines {
+		return true
+	}
+	atomic.AddUint64(&r.dropped, 1)
+	return false
+}
+
+// AcquireBuffer reserves memory for a packet. Returns false and counts
+// packet as dropped if cap would be exceeded
+func (r *Resources) AcquireBuffer(size int) bool {
+	if r == nil {
+		return true
+	}
+	if atomic.AddInt64(&r.buffers, int64(size)) > r.MaxBuffers && r.MaxBuffers > 0 {
+		atomic.AddInt64(&r.buffers, -int64(size))
+		atomic.AddUint64(&r.dropped, 1)
+		return false
+	}
+	return true
+}
+
+// ReleaseBuffer returns memory reserved with AcquireBuffer
+func (r *Resources) ReleaseBuffer(size int) {
+	if r != nil {
+		atomic.AddInt64(&r.buffers, -int64(size))
+	}
+}
+
+// Transfer accounts data exchanged with peers. Returns false when
+// bandwidth cap is exceeded or instance is paused by quota and data
+// should be dropped
+func (r *Resources) Transfer(size int) bool {
+	if r == nil {
+		return true
+	}
+	limit, paused := r.Quota.Limit()
+	if paused {
+		atomic.AddUint64(&r.dropped, 1)
+		return false
+	}
+	if limit == 0 || (r.MaxBandwidth > 0 && r.MaxBandwidth < limit) {
+		limit = r.MaxBandwidth
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if elapsed := now.Sub(r.window); elapsed >= time.Second {
+		r.rate = int64(float64(r.windowBytes) / elapsed.Seconds())
+		r.windowBytes = 0
+		r.window = now
+	}
+	if limit > 0 {
+		r.tokens += now.Sub(r.last).Seconds() * float64(limit)
+		if r.tokens > float64(limit) {
+			r.tokens = float64(limit)
+		}
+		r.last = now
+		if r.tokens < float64(size) {
+			atomic.AddUint64(&r.dropped, 1)
+			return false
+		}
+		r.tokens -= float64(size)
+	}
+	r.windowBytes += int64(size)
+	r.Quota.Add(size)
+	return true
+}
+
+// Usage returns current usage of buffers, goroutines and bandwidth
+// together with number of dropped packets
+func (r *Resources) Usage() (buffers, goroutines, bandwidth int64, dropped uint64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	bandwidth = r.rate
+	if time.Since(r.window) >= 2*time.Second {
+		// No traffic during the whole previous window
+		bandwidth = 0
+	}
+	r.lock.Unlock()
+	return atomic.LoadInt64(&r.buffers), atomic.LoadInt64(&r.goroutines), bandwidth, atomic.LoadUint64(&r.dropped)
+}
+
+// String describes usage of resources and caps
+func (r *Resources) String() string {
+	if r == nil {
+		return ""
+	}
+	buffers, goroutines, bandwidth, dropped := r.Usage()
+	s := fmt.Sprintf("Goroutines:%d", goroutines)
+	if r.MaxGoroutines > 0 {
+		s += fmt.Sprintf("/%d", r.MaxGoroutines)
+	}
+	s += " Buffers:" + FormatBytes(buffers)
+	if r.MaxBuffers > 0 {
+		s += "/" + FormatBytes(r.MaxBuffers)
+	}
+	s += " Bandwidth:" + FormatBytes(bandwidth) + "/s"
+	if r.MaxBandwidth > 0 {
+		s += "/" + FormatBytes(r.MaxBandwidth) + "/s"
+	}
+	return s + fmt.Sprintf(" Dropped:%d", dropped)
+}
+
+// FormatBytes returns size in human readable form
+func FormatBytes(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", size)
+}
@@ -0,0 +1,54 @@
+package ptp
+
+import (
+	"testing"
+)
+
+func TestResources(t *testing.T) {
+	r := NewResources(1000, 2, 1500)
+	if !r.AcquireBuffer(600) || r.AcquireBuffer(600) {
+		t.Errorf("Buffer cap was not enforced")
+	}
+	r.ReleaseBuffer(600)
+	if !r.AcquireBuffer(1000) {
+		t.Errorf("Released buffer was not returned")
+	}
+
+	p := new(PTPCloud)
+	p.Resources = r
+	block := make(chan bool)
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		p.Go(func() {
+			<-block
+			done <- true
+		})
+	}
+	if r.CanSpawn() {
+		t.Errorf("Goroutines cap was not enforced")
+	}
+	close(block)
+	<-done
+	<-done
+
+	if !r.Transfer(1000) || r.Transfer(1000) {
+		t.Errorf("Bandwidth cap was not enforced")
+	}
+	_, _, _, dropped := r.Usage()
+	if dropped != 3 {
+		t.Errorf("Wrong number of dropped packets: %d", dropped)
+	}
+
+	var unlimited *Resources
+	if !unlimited.AcquireBuffer(1<<30) || !unlimited.CanSpawn() || !unlimited.Transfer(1<<30) {
+		t.Errorf("Missing limits were enforced")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for size, expected := range map[int64]string{512: "512B", 1536: "1.5KB", 5 << 20: "5.0MB"} {
+		if s := FormatBytes(size); s != expected {
+			t.Errorf("%d formatted as %s instead of %s", size, s, expected)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package ptp
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Liveness collects reports of members that can't reach a peer. Every
+// member pings peers on its own, so a failed peer would be noticed by each
+// of them only when its own pings run out. Reports let members probe such
+// peer at once and time it out in seconds
+type Liveness struct {
+	reports map[string]map[string]time.Time // When members reported they can't reach a peer, by ID of the peer and ID of the member
+	lock    sync.Mutex
+}
+
+// NewLiveness creates empty set of reports
+func NewLiveness() *Liveness {
+	return &Liveness{reports: make(map[string]map[string]time.Time)}
+}
+
+// Report records whether observer can reach the peer
+func (l *Liveness) Report(observer, subject string, reachable bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if reachable {
+		delete(l.reports[subject], observer)
+		if len(l.reports[subject]) == 0 {
+			delete(l.reports, subject)
+		}
+		return
+	}
+	if l.reports[subject] == nil {
+		l.reports[subject] = make(map[string]time.Time)
+	}
+	l.reports[subject][observer] = time.Now()
+}
+
+// Unreachable returns number of members that reported they can't reach
+// the peer after since. Earlier reports are disproved by contact we had
+// with the peer
+func (l *Liveness) Unreachable(subject string, since time.Time) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	count := 0
+	for _, reported := range l.reports[subject] {
+		if reported.After(since) && time.Since(reported) < LIVENESS_WINDOW {
+			count++
+		}
+	}
+	return count
+}
+
+// Forget drops reports about removed peer and reports it has made
+func (l *Liveness) Forget(id string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.reports, id)
+	for subject, observers := range l.reports {
+		delete(observers, id)
+		if len(observers) == 0 {
+			delete(l.reports, subject)
+		}
+	}
+}
+
+// livenessQuorum returns number of distinct members that should report
+// they can't reach the peer before it's timed out early. Quorum grows with
+// the network, so a single member can't disconnect peers from others
+func (p *PTPCloud) livenessQuorum(subject *NetworkPeer) int {
+	members := 0
+	p.PeersLock.Lock()
+	for _, peer := range p.NetworkPeers {
+		if peer != subject && peer.State == P_CONNECTED {
+			members++
+		}
+	}
+	p.PeersLock.Unlock()
+	quorum := (members + LIVENESS_QUORUM_SHARE - 1) / LIVENESS_QUORUM_SHARE
+	if quorum < LIVENESS_QUORUM {
+		quorum = LIVENESS_QUORUM
+	}
+	return quorum
+}
+
+// gossipLiveness tells connected members whether this instance can reach
+// the peer. Members that don't use control channel aren't told
+func (p *PTPCloud) gossipLiveness(subject *NetworkPeer, reachable bool) {
+	state := "down"
+	if reachable {
+		state = "up"
+	}
+	data := []byte(subject.ID + "|" + state)
+	p.PeersLock.Lock()
+	var peers []*NetworkPeer
+	for _, peer := range p.NetworkPeers {
+		if peer != subject && peer.State == P_CONNECTED {
+			peers = append(peers, peer)
+		}
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		if err := p.SendControl(peer, CONTROL_LIVENESS, data); err != nil {
+			Log(TRACE, "Peer %s wasn't told about %s: %v", peer.ID, subject.ID, err)
+		}
+	}
+}
+
+// HandleLivenessControl is called when member tells whether it can reach
+// another peer
+func (p *PTPCloud) HandleLivenessControl(peer *NetworkPeer, data []byte) {
+	parts := strings.Split(string(data), "|")
+	if len(parts) != 2 || (parts[1] != "up" && parts[1] != "down") {
+		Log(DEBUG, "Bad liveness report from %s: %v", peer.ID, ErrMalformedMessage)
+		return
+	}
+	if p.Liveness == nil || parts[0] == p.Dht.ID {
+		return
+	}
+	p.PeersLock.Lock()
+	_, exists := p.NetworkPeers[parts[0]]
+	p.PeersLock.Unlock()
+	if !exists {
+		return
+	}
+	if parts[1] == "down" {
+		Log(DEBUG, "Peer %s can't reach %s", peer.ID, parts[0])
+	}
+	p.Liveness.Report(peer.ID, parts[0], parts[1] == "up")
+}
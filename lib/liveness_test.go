@@ -0,0 +1,101 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	l := NewLiveness()
+	before := time.Now().Add(-time.Second)
+	l.Report("a", "x", false)
+	l.Report("b", "x", false)
+	if n := l.Unreachable("x", before); n != 2 {
+		t.Errorf("Expected 2 reports, got %d", n)
+	}
+	if n := l.Unreachable("x", time.Now().Add(time.Second)); n != 0 {
+		t.Errorf("Reports older than contact were counted: %d", n)
+	}
+	l.Report("a", "x", true)
+	if n := l.Unreachable("x", before); n != 1 {
+		t.Errorf("Report wasn't retracted: %d", n)
+	}
+	l.Forget("b")
+	if n := l.Unreachable("x", before); n != 0 || len(l.reports) != 0 {
+		t.Errorf("Reports of removed peer were kept: %d", n)
+	}
+}
+
+func TestLivenessTimeout(t *testing.T) {
+	p := new(PTPCloud)
+	p.Dht = &DHTClient{ID: "self"}
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.MACIDTable = make(map[string]string)
+	p.PingInterval = time.Second * 30
+	p.IdlePingInterval = time.Second * 30
+	p.Liveness = NewLiveness()
+	p.HardwareAddr, _ = net.ParseMAC("01:02:03:04:05:06")
+	peer := &NetworkPeer{ID: "peer", State: P_CONNECTED, Endpoint: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}}
+	peer.LastContact = time.Now().Add(-time.Second * 5)
+	peer.LastActivity = time.Now()
+	other := &NetworkPeer{ID: "other", State: P_CONNECTED}
+	third := &NetworkPeer{ID: "third", State: P_CONNECTED}
+	p.NetworkPeers[peer.ID] = peer
+	p.NetworkPeers[other.ID] = other
+	p.NetworkPeers[third.ID] = third
+
+	peer.StateConnected(p)
+	if peer.PingCount != 0 {
+		t.Fatalf("Peer was pinged before its interval")
+	}
+	p.HandleLivenessControl(other, []byte("self|down"))
+	p.HandleLivenessControl(other, []byte("peer|down"))
+	peer.StateConnected(p)
+	if peer.PingCount != 1 {
+		t.Fatalf("Peer other members can't reach wasn't probed at once")
+	}
+	peer.StateConnected(p)
+	if peer.State != P_CONNECTED {
+		t.Fatalf("Peer was timed out before probe timeout")
+	}
+	peer.LastPing = time.Now().Add(-LIVENESS_PROBE_TIMEOUT)
+	if err := peer.StateConnected(p); err != nil || peer.State != P_CONNECTED {
+		t.Fatalf("Peer was timed out on report of a single member")
+	}
+	p.HandleLivenessControl(third, []byte("peer|down"))
+	if err := peer.StateConnected(p); err == nil || peer.State != P_INIT {
+		t.Fatalf("Peer wasn't timed out after missing probe")
+	}
+	if !strings.Contains(peer.LastError, "2 members") {
+		t.Errorf("Wrong reason: %s", peer.LastError)
+	}
+
+	// Member that answers our probe isn't timed out
+	peer.State = P_CONNECTED
+	peer.Endpoint = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	peer.LastContact = time.Now()
+	if err := peer.StateConnected(p); err != nil || peer.PingCount != 0 {
+		t.Errorf("Stale report was counted after contact: %v", err)
+	}
+}
+
+func TestLivenessQuorum(t *testing.T) {
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	subject := &NetworkPeer{ID: "subject", State: P_CONNECTED}
+	p.NetworkPeers[subject.ID] = subject
+	if q := p.livenessQuorum(subject); q != LIVENESS_QUORUM {
+		t.Errorf("Quorum of small network is %d", q)
+	}
+	for i := 0; i < 12; i++ {
+		id := fmt.Sprintf("member%d", i)
+		p.NetworkPeers[id] = &NetworkPeer{ID: id, State: P_CONNECTED}
+	}
+	p.NetworkPeers["gone"] = &NetworkPeer{ID: "gone", State: P_INIT}
+	if q := p.livenessQuorum(subject); q != 12/LIVENESS_QUORUM_SHARE {
+		t.Errorf("Quorum doesn't grow with connected members: %d", q)
+	}
+}
@@ -0,0 +1,60 @@
+package ptp
+
+import (
+	"net"
+)
+
+// IsHostAddress returns true if IP is assigned to one of local interfaces
+func IsHostAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoopbackEndpoint returns loopback address of a peer that runs on this
+// host, e.g. in another container or another daemon. Returns nil if none
+// of peer addresses belongs to this host or our socket is bound to a
+// specific address and can't receive on loopback
+func (np *NetworkPeer) LoopbackEndpoint(ptpc *PTPCloud) *net.UDPAddr {
+	if bound := ptpc.UDPSocket.Addr(); bound != nil && bound.IP != nil && !bound.IP.IsUnspecified() {
+		return nil
+	}
+	for _, kip := range np.KnownIPs {
+		if kip.IP.IsLoopback() || IsHostAddress(kip.IP) {
+			loopback := net.IPv4(127, 0, 0, 1)
+			if ptpc.Dht.IPv6Only {
+				loopback = net.IPv6loopback
+			}
+			return &net.UDPAddr{IP: loopback, Port: kip.Port}
+		}
+	}
+	return nil
+}
+
+// ProbeLoopback connects to a peer running on the same host over loopback
+// interface, which doesn't depend on external addresses, firewall rules
+// for them or relays
+func (np *NetworkPeer) ProbeLoopback(ptpc *PTPCloud) bool {
+	addr := np.LoopbackEndpoint(ptpc)
+	if addr == nil {
+		return false
+	}
+	if addr.Port == ptpc.UDPSocket.GetPort() {
+		// This is our own socket
+		return false
+	}
+	Log(DEBUG, "Peer %s runs on this host. Probing %s", np.ID, addr)
+	if !np.TestConnection(ptpc, addr) {
+		return false
+	}
+	np.Endpoint = addr
+	Log(INFO, "Setting endpoint for %s to %s", np.ID, addr)
+	return true
+}
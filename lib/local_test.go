@@ -0,0 +1,36 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLoopbackEndpoint(t *testing.T) {
+	p := new(PTPCloud)
+	p.Dht = new(DHTClient)
+	p.UDPSocket = new(PTPNet)
+	p.UDPSocket.addr = &net.UDPAddr{Port: 6881}
+
+	remote := &NetworkPeer{ID: "remote"}
+	remote.KnownIPs = []*net.UDPAddr{{IP: net.ParseIP("192.0.2.1"), Port: 5000}}
+	if remote.LoopbackEndpoint(p) != nil {
+		t.Errorf("Remote peer was considered local")
+	}
+
+	local := &NetworkPeer{ID: "local"}
+	local.KnownIPs = append(remote.KnownIPs, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5001})
+	addr := local.LoopbackEndpoint(p)
+	if addr == nil || addr.String() != "127.0.0.1:5001" {
+		t.Errorf("Wrong loopback endpoint of local peer: %v", addr)
+	}
+
+	p.Dht.IPv6Only = true
+	if addr := local.LoopbackEndpoint(p); addr == nil || addr.String() != "[::1]:5001" {
+		t.Errorf("IPv6-only host should use IPv6 loopback: %v", addr)
+	}
+
+	p.UDPSocket.addr = &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 6881}
+	if local.LoopbackEndpoint(p) != nil {
+		t.Errorf("Socket bound to specific address can't use loopback")
+	}
+}
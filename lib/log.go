@@ -1,8 +1,12 @@
 package ptp
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type LOG_LEVEL int32
@@ -34,9 +38,51 @@ func SetMinLogLevel(level LOG_LEVEL) {
 }
 func MinLogLevel() LOG_LEVEL { return log_level_min }
 
+// Number of latest warnings and errors kept for status page
+const LOG_EVENTS_KEPT int = 100
+
+// LogEvent is a warning or error that was logged recently
+type LogEvent struct {
+	Time    time.Time
+	Level   LOG_LEVEL
+	Message string
+}
+
+var (
+	log_events      []LogEvent
+	log_events_lock sync.Mutex
+)
+
 func Log(level LOG_LEVEL, format string, v ...interface{}) {
+	if level >= WARNING {
+		recordEvent(level, fmt.Sprintf(format, v...))
+	}
 	if level < log_level_min {
 		return
 	}
 	std_loggers[level].Printf(format, v...)
 }
+
+func recordEvent(level LOG_LEVEL, message string) {
+	log_events_lock.Lock()
+	defer log_events_lock.Unlock()
+	log_events = append(log_events, LogEvent{Time: time.Now(), Level: level, Message: message})
+	if len(log_events) > LOG_EVENTS_KEPT {
+		log_events = log_events[len(log_events)-LOG_EVENTS_KEPT:]
+	}
+}
+
+// RecentEvents returns latest warnings and errors, oldest first
+func RecentEvents() []LogEvent {
+	log_events_lock.Lock()
+	defer log_events_lock.Unlock()
+	return append([]LogEvent{}, log_events...)
+}
+
+// String returns name of the level
+func (l LOG_LEVEL) String() string {
+	if l < TRACE || l > ERROR {
+		return "UNKNOWN"
+	}
+	return strings.Trim(log_prefixes[l], "[] ")
+}
@@ -0,0 +1,337 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	bencode "github.com/jackpal/bencode-go"
+	"net"
+	"sort"
+	"time"
+)
+
+// MainlineDHT is a minimal client of the public BitTorrent mainline DHT
+// (BEP 5). Members of a network announce themselves under the infohash
+// derived from network secret and look up each other without relying
+// on our own bootstrap routers
+type MainlineDHT struct {
+	ID        string // Our node ID
+	InfoHash  string // Rendezvous point of the network
+	Port      int    // Port of p2p socket that is announced
+	Bootstrap []string
+	conn      *net.UDPConn
+	tid       uint16
+}
+
+// MainlineNode is a DHT node received in response to get_peers
+type MainlineNode struct {
+	ID    string
+	Addr  *net.UDPAddr
+	Token string // Token required to announce on this node
+}
+
+// MainlineInfoHash derives infohash from network hash and secret, so
+// outsiders can't find members of the network by its public hash
+func MainlineInfoHash(hash string, key []byte) []byte {
+	h := sha1.New()
+	h.Write([]byte("p2p-mainline|" + hash + "|"))
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// NewMainlineDHT creates client with random node ID
+func NewMainlineDHT(infohash []byte, port int) (*MainlineDHT, error) {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	m := new(MainlineDHT)
+	m.ID = string(id)
+	m.InfoHash = string(infohash)
+	m.Port = port
+	m.Bootstrap = MAINLINE_BOOTSTRAP
+	m.conn = conn
+	return m, nil
+}
+
+// Close releases socket of the client
+func (m *MainlineDHT) Close() {
+	m.conn.Close()
+}
+
+// query sends KRPC query and waits for response with the same transaction ID
+func (m *MainlineDHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	m.tid++
+	tid := string([]byte{byte(m.tid >> 8), byte(m.tid)})
+	args["id"] = m.ID
+	msg := map[string]interface{}{
+		"t": tid,
+		"y": "q",
+		"q": method,
+		"a": args,
+	}
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, msg); err != nil {
+		return nil, err
+	}
+	if _, err := m.conn.WriteToUDP(b.Bytes(), addr); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(MAINLINE_TIMEOUT)
+	buf := make([]byte, 2048)
+	for {
+		m.conn.SetReadDeadline(deadline)
+		n, _, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+		data, err := bencode.Decode(bytes.NewReader(buf[:n]))
+		if err != nil {
+			continue
+		}
+		resp, ok := data.(map[string]interface{})
+		if !ok || resp["t"] != tid {
+			// Late response to one of previous queries
+			continue
+		}
+		if resp["y"] == "e" {
+			return nil, errors.New(fmt.Sprintf("Node %s returned error: %v", addr, resp["e"]))
+		}
+		r, ok := resp["r"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Malformed response")
+		}
+		return r, nil
+	}
+}
+
+// Lookup searches for peers announced under our infohash. Returns found
+// peers and closest nodes that can be used for announcement
+func (m *MainlineDHT) Lookup() ([]*net.UDPAddr, []MainlineNode) {
+	var candidates []MainlineNode
+	for _, router := range m.Bootstrap {
+		addr, err := net.ResolveUDPAddr("udp4", router)
+		if err != nil {
+			Log(DEBUG, "Failed to resolve mainline bootstrap node %s: %v", router, err)
+			continue
+		}
+		candidates = append(candidates, MainlineNode{Addr: addr})
+	}
+	queried := make(map[string]bool)
+	seen := make(map[string]bool)
+	var peers []*net.UDPAddr
+	var responded []MainlineNode
+	for i := 0; i < MAINLINE_MAX_QUERIES; i++ {
+		// Query the closest node that wasn't queried yet
+		m.sortByDistance(candidates)
+		var node *MainlineNode
+		for j := range candidates {
+			if !queried[candidates[j].Addr.String()] {
+				node = &candidates[j]
+				break
+			}
+		}
+		if node == nil {
+			break
+		}
+		queried[node.Addr.String()] = true
+		r, err := m.query(node.Addr, "get_peers", map[string]interface{}{"info_hash": m.InfoHash})
+		if err != nil {
+			Log(TRACE, "get_peers to %s failed: %v", node.Addr, err)
+			continue
+		}
+		if id, ok := r["id"].(string); ok {
+			node.ID = id
+		}
+		if token, ok := r["token"].(string); ok {
+			node.Token = token
+			responded = append(responded, *node)
+		}
+		if values, ok := r["values"].([]interface{}); ok {
+			for _, peer := range ParseCompactPeers(values) {
+				if !seen[peer.String()] {
+					seen[peer.String()] = true
+					peers = append(peers, peer)
+				}
+			}
+		}
+		if nodes, ok := r["nodes"].(string); ok {
+			for _, n := range ParseCompactNodes(nodes) {
+				if !queried[n.Addr.String()] {
+					candidates = append(candidates, n)
+				}
+			}
+		}
+	}
+	m.sortByDistance(responded)
+	if len(responded) > MAINLINE_K {
+		responded = responded[:MAINLINE_K]
+	}
+	return peers, responded
+}
+
+// Announce tells closest nodes that we are a member of the network
+func (m *MainlineDHT) Announce(nodes []MainlineNode) int {
+	announced := 0
+	for _, node := range nodes {
+		_, err := m.query(node.Addr, "announce_peer", map[string]interface{}{
+			"info_hash":    m.InfoHash,
+			"port":         int64(m.Port),
+			"token":        node.Token,
+			"implied_port": int64(0),
+		})
+		if err != nil {
+			Log(TRACE, "announce_peer to %s failed: %v", node.Addr, err)
+			continue
+		}
+		announced++
+	}
+	return announced
+}
+
+func (m *MainlineDHT) sortByDistance(nodes []MainlineNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return bytes.Compare(xorDistance(nodes[i].ID, m.InfoHash), xorDistance(nodes[j].ID, m.InfoHash)) < 0
+	})
+}
+
+// xorDistance returns Kademlia distance between IDs. Unknown IDs are
+// considered the most distant
+func xorDistance(a, b string) []byte {
+	d := make([]byte, 20)
+	if len(a) != 20 || len(b) != 20 {
+		for i := range d {
+			d[i] = 0xff
+		}
+		return d
+	}
+	for i := 0; i < 20; i++ {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// ParseCompactPeers decodes list of 6-byte peer addresses
+func ParseCompactPeers(values []interface{}) []*net.UDPAddr {
+	var peers []*net.UDPAddr
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+		peers = append(peers, &net.UDPAddr{
+			IP:   net.IPv4(s[0], s[1], s[2], s[3]),
+			Port: int(binary.BigEndian.Uint16([]byte(s[4:6]))),
+		})
+	}
+	return peers
+}
+
+// ParseCompactNodes decodes 26-byte node records: ID followed by address
+func ParseCompactNodes(s string) []MainlineNode {
+	var nodes []MainlineNode
+	for i := 0; i+26 <= len(s); i += 26 {
+		rec := s[i : i+26]
+		nodes = append(nodes, MainlineNode{
+			ID: rec[:20],
+			Addr: &net.UDPAddr{
+				IP:   net.IPv4(rec[20], rec[21], rec[22], rec[23]),
+				Port: int(binary.BigEndian.Uint16([]byte(rec[24:26]))),
+			},
+		})
+	}
+	return nodes
+}
+
+// RunMainline periodically announces instance on mainline DHT and probes
+// members found there. Discovered members are connected directly, so they
+// stay reachable even when our routers are down
+func (p *PTPCloud) RunMainline() {
+	key := []byte{}
+	if crypter := p.CurrentCrypter(); crypter.Active {
+		key = crypter.ActiveKey.Key
+	}
+	for !p.Shutdown {
+		m, err := NewMainlineDHT(MainlineInfoHash(p.Dht.NetworkHash, key), p.UDPSocket.GetPort())
+		if err != nil {
+			Log(ERROR, "Failed to start mainline DHT client: %v", err)
+			return
+		}
+		peers, nodes := m.Lookup()
+		announced := m.Announce(nodes)
+		m.Close()
+		Log(DEBUG, "Mainline DHT: %d members found, announced on %d nodes", len(peers), announced)
+		for _, addr := range peers {
+			p.ProbeMainlinePeer(addr)
+		}
+		for i := 0; i < int(MAINLINE_INTERVAL/time.Second) && !p.Shutdown; i++ {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// ProbeMainlinePeer sends introduction request to an address found on
+// mainline DHT. Member will answer with signed introduction
+func (p *PTPCloud) ProbeMainlinePeer(addr *net.UDPAddr) {
+	if p.Draining {
+		return
+	}
+	p.PeersLock.Lock()
+	for _, peer := range p.NetworkPeers {
+		if peer.Endpoint != nil && peer.Endpoint.String() == addr.String() {
+			p.PeersLock.Unlock()
+			return
+		}
+	}
+	if p.MainlineProbes == nil {
+		p.MainlineProbes = make(map[string]time.Time)
+	}
+	p.MainlineProbes[addr.String()] = time.Now()
+	p.PeersLock.Unlock()
+	msg := CreateIntroRequest(p.CurrentCrypter(), p.Dht.ID)
+	_, err := p.UDPSocket.SendMessage(msg, addr)
+	if err != nil {
+		Log(DEBUG, "Failed to probe mainline peer %s: %v", addr, err)
+	}
+}
+
+// IsMainlineCandidate returns true if we have recently probed this address
+func (p *PTPCloud) IsMainlineCandidate(addr *net.UDPAddr) bool {
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	probed, exists := p.MainlineProbes[addr.String()]
+	return exists && time.Since(probed) < MAINLINE_INTERVAL
+}
+
+// AddMainlinePeer registers member that answered our probe with a
+// verified introduction
+func (p *PTPCloud) AddMainlinePeer(intro Introduction, mac net.HardwareAddr, ip net.IP, addr *net.UDPAddr) {
+	id := intro.ID
+	peer := new(NetworkPeer)
+	peer.ID = id
+	peer.PeerAddr = addr
+	peer.Endpoint = addr
+	peer.KnownIPs = []*net.UDPAddr{addr}
+	peer.PeerHW = mac
+	peer.PeerLocalIP = ip
+	peer.State = P_CONNECTED
+	peer.LastContact = time.Now()
+	peer.attemptSucceeded()
+	p.AcceptIntroduction(peer, intro)
+	p.PeersLock.Lock()
+	delete(p.MainlineProbes, addr.String())
+	p.IPIDTable[ip.String()] = id
+	p.MACIDTable[mac.String()] = id
+	p.NetworkPeers[id] = peer
+	p.PeersLock.Unlock()
+	p.peerJoined(peer)
+	Log(INFO, "Connection with peer %s found on mainline DHT has been established", id)
+	p.Go(func() { peer.Run(p) })
+}
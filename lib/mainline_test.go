@@ -0,0 +1,79 @@
+package ptp
+
+import (
+	"bytes"
+	bencode "github.com/jackpal/bencode-go"
+	"net"
+	"testing"
+)
+
+// fakeMainlineNode answers get_peers with a single peer and accepts announcements
+func fakeMainlineNode(t *testing.T, conn *net.UDPConn, announced chan string) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data, err := bencode.Decode(bytes.NewReader(buf[:n]))
+		if err != nil {
+			t.Errorf("Failed to decode query: %v", err)
+			return
+		}
+		q := data.(map[string]interface{})
+		args := q["a"].(map[string]interface{})
+		r := map[string]interface{}{"id": string(make([]byte, 20))}
+		switch q["q"] {
+		case "get_peers":
+			r["token"] = "secret-token"
+			r["values"] = []interface{}{string([]byte{10, 0, 0, 1, 0x1a, 0xe1})}
+		case "announce_peer":
+			if args["token"] != "secret-token" {
+				t.Errorf("Wrong announce token: %v", args["token"])
+			}
+			announced <- args["info_hash"].(string)
+		}
+		var b bytes.Buffer
+		bencode.Marshal(&b, map[string]interface{}{"t": q["t"], "y": "r", "r": r})
+		conn.WriteToUDP(b.Bytes(), addr)
+	}
+}
+
+func TestMainlineLookup(t *testing.T) {
+	node, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skipf("Can't create UDP socket: %v", err)
+	}
+	defer node.Close()
+	announced := make(chan string, 1)
+	go fakeMainlineNode(t, node, announced)
+
+	infohash := MainlineInfoHash("hash", []byte("key"))
+	m, err := NewMainlineDHT(infohash, 7000)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer m.Close()
+	m.Bootstrap = []string{node.LocalAddr().String()}
+	peers, nodes := m.Lookup()
+	if len(peers) != 1 || peers[0].String() != "10.0.0.1:6881" {
+		t.Fatalf("Wrong peers found: %v", peers)
+	}
+	if len(nodes) != 1 || nodes[0].Token != "secret-token" {
+		t.Fatalf("Wrong nodes for announcement: %v", nodes)
+	}
+	if m.Announce(nodes) != 1 {
+		t.Errorf("Announcement failed")
+	}
+	if <-announced != string(infohash) {
+		t.Errorf("Wrong infohash announced")
+	}
+}
+
+func TestParseCompactNodes(t *testing.T) {
+	rec := string(bytes.Repeat([]byte{1}, 20)) + string([]byte{192, 168, 0, 1, 0x1a, 0xe1})
+	nodes := ParseCompactNodes(rec + rec[:10])
+	if len(nodes) != 1 || nodes[0].Addr.String() != "192.168.0.1:6881" || len(nodes[0].ID) != 20 {
+		t.Errorf("Failed to parse compact nodes: %v", nodes)
+	}
+}
@@ -0,0 +1,272 @@
+package ptp
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest lists identity keys of peers allowed to join the network. It's
+// signed by admin key of the network, which instances are started with,
+// so manifest can be passed around by anyone. Newer manifest replaces
+// older one
+type Manifest struct {
+	Network   string   `yaml:"network"`
+	Version   uint64   `yaml:"version"` // Grows with every update
+	Members   []string `yaml:"members"` // Hex-encoded public keys of members
+	Signature string   `yaml:"signature"`
+}
+
+// ManifestPath returns location of the latest manifest of a network
+func ManifestPath(hash string) string {
+	return filepath.Join(CONFIG_DIR, "p2p", "manifest", url.PathEscape(hash)+".yaml")
+}
+
+// ParseAdminKey checks hex-encoded public key of network admin
+func ParseAdminKey(key string) (string, error) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if decoded, err := hex.DecodeString(key); err != nil || len(decoded) != ed25519.PublicKeySize {
+		return "", errors.New("Bad admin key: hex-encoded ed25519 public key is expected")
+	}
+	return key, nil
+}
+
+// payload returns data covered by signature
+func (m *Manifest) payload() []byte {
+	members := append([]string(nil), m.Members...)
+	sort.Strings(members)
+	return []byte(m.Network + "\n" + strconv.FormatUint(m.Version, 10) + "\n" + strings.Join(members, ","))
+}
+
+// SignManifest creates manifest of network signed by admin
+func SignManifest(admin *Identity, network string, version uint64, members []string) (*Manifest, error) {
+	m := &Manifest{Network: network, Version: version}
+	for _, member := range members {
+		member = strings.ToLower(strings.TrimSpace(member))
+		if member == "" {
+			continue
+		}
+		if key, err := hex.DecodeString(member); err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New(fmt.Sprintf("Bad public key of member: %s", member))
+		}
+		m.Members = append(m.Members, member)
+	}
+	sort.Strings(m.Members)
+	m.Signature = hex.EncodeToString(admin.Sign(m.payload()))
+	return m, nil
+}
+
+// Verify checks that manifest of the network was signed by admin key
+func (m *Manifest) Verify(network, admin string) error {
+	if m.Network != network {
+		return errors.New(fmt.Sprintf("Manifest is for another network: %s", m.Network))
+	}
+	if _, err := ParseAdminKey(admin); err != nil {
+		return err
+	}
+	key, _ := hex.DecodeString(admin)
+	signature, err := hex.DecodeString(m.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), m.payload(), signature) {
+		return errors.New("Manifest is not signed by admin key")
+	}
+	return nil
+}
+
+// IsMember returns true if public key is listed in manifest
+func (m *Manifest) IsMember(key string) bool {
+	key = strings.ToLower(key)
+	for _, member := range m.Members {
+		if member == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Marshal returns manifest in YAML
+func (m *Manifest) Marshal() []byte {
+	data, _ := yaml.Marshal(m)
+	return data
+}
+
+// ParseManifest reads manifest from YAML. Signature isn't checked
+func ParseManifest(data []byte) (*Manifest, error) {
+	m := new(Manifest)
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, errors.New(fmt.Sprintf("Malformed manifest: %v", err))
+	}
+	return m, nil
+}
+
+func (m *Manifest) String() string {
+	return fmt.Sprintf("Manifest version %d: %d members", m.Version, len(m.Members))
+}
+
+// loadManifest reads manifest saved by ApplyManifest. Missing or invalid
+// manifest is skipped
+func (p *PTPCloud) loadManifest(hash string) {
+	path := p.ManifestFile
+	if err := CheckAccess(path); err != nil {
+		Log(WARNING, "Can't load manifest: %v", err)
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Log(WARNING, "Can't load manifest: %v", err)
+		}
+		return
+	}
+	m, err := ParseManifest(data)
+	if err == nil {
+		err = m.Verify(hash, p.AdminKey)
+	}
+	if err != nil {
+		Log(WARNING, "Ignoring saved manifest %s: %v", path, err)
+		return
+	}
+	p.Manifest = m
+	Log(INFO, "Loaded membership manifest version %d with %d members", m.Version, len(m.Members))
+}
+
+// ApplyManifest accepts manifest signed by admin key if it's newer than
+// the current one. Manifest is saved, pushed to connected peers and peers
+// that are not members anymore are disconnected
+func (p *PTPCloud) ApplyManifest(m *Manifest) error {
+	if p.AdminKey == "" {
+		return errors.New("Instance was started without admin key")
+	}
+	if err := m.Verify(p.Dht.NetworkHash, p.AdminKey); err != nil {
+		return err
+	}
+	p.manifestLock.Lock()
+	if p.Manifest != nil && m.Version <= p.Manifest.Version {
+		p.manifestLock.Unlock()
+		return errors.New(fmt.Sprintf("Manifest version %d is not newer than %d", m.Version, p.Manifest.Version))
+	}
+	p.Manifest = m
+	p.manifestLock.Unlock()
+	Log(INFO, "Accepted membership manifest version %d with %d members", m.Version, len(m.Members))
+
+	if err := p.saveManifest(m); err != nil {
+		Log(WARNING, "Failed to save manifest: %v", err)
+	}
+
+	var peers []*NetworkPeer
+	p.PeersLock.Lock()
+	for _, peer := range p.NetworkPeers {
+		if peer.PublicKey != "" && !m.IsMember(peer.PublicKey) && peer.State != P_DISCONNECT {
+			Log(WARNING, "Peer %s is not a member anymore. Disconnecting", peer.ID)
+			peer.LastError = "Not a member"
+			peer.State = P_DISCONNECT
+		} else if peer.State == P_CONNECTED {
+			peers = append(peers, peer)
+		}
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		p.SendManifest(peer)
+	}
+	return nil
+}
+
+func (p *PTPCloud) saveManifest(m *Manifest) error {
+	if p.ManifestFile == "" {
+		return nil
+	}
+	if err := CheckAccess(p.ManifestFile); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.ManifestFile), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.ManifestFile, m.Marshal(), 0600)
+}
+
+// CurrentManifest returns manifest the instance enforces. Nil if it's not
+// known yet
+func (p *PTPCloud) CurrentManifest() *Manifest {
+	p.manifestLock.Lock()
+	defer p.manifestLock.Unlock()
+	return p.Manifest
+}
+
+// CheckMembership returns error if manifest is enforced and introduction
+// isn't signed by a member. Everyone is rejected until manifest is known
+func (p *PTPCloud) CheckMembership(intro Introduction) error {
+	if p.AdminKey == "" {
+		return nil
+	}
+	if !intro.Signed {
+		return errors.New("Introduction is not signed")
+	}
+	p.manifestLock.Lock()
+	defer p.manifestLock.Unlock()
+	if p.Manifest == nil {
+		return errors.New("Membership manifest is not known yet")
+	}
+	if !p.Manifest.IsMember(intro.PublicKey) {
+		return errors.New("Peer is not listed in membership manifest")
+	}
+	return nil
+}
+
+// SendManifest passes current manifest to a peer
+func (p *PTPCloud) SendManifest(peer *NetworkPeer) {
+	m := p.CurrentManifest()
+	if m == nil || peer.PeerHW == nil {
+		return
+	}
+	p.SendTo(peer.PeerHW, CreateManifestP2PMessage(p.CurrentCrypter(), m))
+}
+
+func CreateManifestP2PMessage(c Crypto, m *Manifest) *P2PMessage {
+	data := m.Marshal()
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_MANIFEST)
+	msg.Header.Length = uint16(len(data))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, data)
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = data
+	}
+	return msg
+}
+
+// HandleManifestMessage is called when peer passes membership manifest.
+// Manifest is accepted from anyone, because it's signed, so peers that
+// are not connected yet can learn who is a member
+func (p *PTPCloud) HandleManifestMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	if p.AdminKey == "" {
+		return
+	}
+	m, err := ParseManifest(msg.Data)
+	if err != nil {
+		Log(DEBUG, "Bad manifest from %s: %v", src_addr, err)
+		return
+	}
+	if current := p.CurrentManifest(); current != nil && m.Version <= current.Version {
+		return
+	}
+	if err := p.ApplyManifest(m); err != nil {
+		Log(WARNING, "Rejected manifest from %s: %v", src_addr, err)
+	}
+}
@@ -0,0 +1,91 @@
+package ptp
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	admin, _ := GenerateIdentity()
+	member, _ := GenerateIdentity()
+	m, err := SignManifest(admin, "net", 1, []string{member.PublicKeyString(), ""})
+	if err != nil {
+		t.Fatalf("Failed to sign manifest: %v", err)
+	}
+	parsed, err := ParseManifest(m.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if err := parsed.Verify("net", admin.PublicKeyString()); err != nil {
+		t.Errorf("Valid manifest was rejected: %v", err)
+	}
+	if !parsed.IsMember(member.PublicKeyString()) || parsed.IsMember(admin.PublicKeyString()) {
+		t.Errorf("Wrong members: %v", parsed.Members)
+	}
+	if err := parsed.Verify("other", admin.PublicKeyString()); err == nil {
+		t.Errorf("Manifest of another network was accepted")
+	}
+	if err := parsed.Verify("net", member.PublicKeyString()); err == nil {
+		t.Errorf("Manifest signed by another key was accepted")
+	}
+	parsed.Members = append(parsed.Members, admin.PublicKeyString())
+	if err := parsed.Verify("net", admin.PublicKeyString()); err == nil {
+		t.Errorf("Modified manifest was accepted")
+	}
+	if _, err := SignManifest(admin, "net", 1, []string{"abcd"}); err == nil {
+		t.Errorf("Malformed member key was accepted")
+	}
+}
+
+func TestCheckMembership(t *testing.T) {
+	admin, _ := GenerateIdentity()
+	member, _ := GenerateIdentity()
+	stranger, _ := GenerateIdentity()
+	p := new(PTPCloud)
+	p.Dht = &DHTClient{NetworkHash: "net"}
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.ManifestFile = filepath.Join(t.TempDir(), "manifest.yaml")
+	intro := Introduction{ID: member.ID, PublicKey: member.PublicKeyString(), Signed: true}
+	if err := p.CheckMembership(intro); err != nil {
+		t.Errorf("Peer was rejected while manifest isn't enforced: %v", err)
+	}
+
+	p.AdminKey = admin.PublicKeyString()
+	if err := p.CheckMembership(intro); err == nil {
+		t.Errorf("Peer was accepted before manifest is known")
+	}
+	m, _ := SignManifest(admin, "net", 2, []string{member.PublicKeyString(), stranger.PublicKeyString()})
+	if err := p.ApplyManifest(m); err != nil {
+		t.Fatalf("Failed to apply manifest: %v", err)
+	}
+	if err := p.CheckMembership(intro); err != nil {
+		t.Errorf("Member was rejected: %v", err)
+	}
+	intro.Signed = false
+	if err := p.CheckMembership(intro); err == nil {
+		t.Errorf("Unsigned introduction was accepted")
+	}
+
+	// Older manifest can't replace newer one
+	old, _ := SignManifest(admin, "net", 1, []string{member.PublicKeyString()})
+	if err := p.ApplyManifest(old); err == nil {
+		t.Errorf("Older manifest was applied")
+	}
+
+	// Peers removed from manifest are disconnected
+	p.NetworkPeers[stranger.ID] = &NetworkPeer{ID: stranger.ID, PublicKey: stranger.PublicKeyString(), State: P_CONNECTED}
+	m, _ = SignManifest(admin, "net", 3, []string{member.PublicKeyString()})
+	if err := p.ApplyManifest(m); err != nil {
+		t.Fatalf("Failed to apply manifest: %v", err)
+	}
+	if p.NetworkPeers[stranger.ID].State != P_DISCONNECT {
+		t.Errorf("Removed member wasn't disconnected")
+	}
+
+	// Saved manifest is loaded after restart
+	restarted := &PTPCloud{AdminKey: p.AdminKey, ManifestFile: p.ManifestFile}
+	restarted.loadManifest("net")
+	if restarted.Manifest == nil || restarted.Manifest.Version != 3 {
+		t.Errorf("Saved manifest wasn't loaded: %v", restarted.Manifest)
+	}
+}
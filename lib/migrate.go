@@ -0,0 +1,98 @@
+package ptp
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// HandleMigrate is called when router asks us to move to another router,
+// usually before maintenance. Connection to the old router is kept until
+// the new one confirms our handshake
+func (dht *DHTClient) HandleMigrate(data DHTMessage, conn PacketConn) {
+	addr, err := dht.Resolve(data.Arguments)
+	if err != nil {
+		Log(ERROR, "Router %s asked to migrate to bad address %s: %v", conn.RemoteAddr().String(), data.Arguments, err)
+		return
+	}
+	if addr.String() == conn.RemoteAddr().String() {
+		return
+	}
+	for _, c := range dht.Connections() {
+		if c.RemoteAddr().String() == addr.String() {
+			Log(DEBUG, "Already connected to router %s", addr)
+			return
+		}
+	}
+	Log(INFO, "Router %s asked to migrate to %s", conn.RemoteAddr().String(), addr)
+	newConn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		Log(ERROR, "Failed to connect to router %s: %v", addr, err)
+		return
+	}
+	dht.StatsLock.Lock()
+	if dht.Migrations == nil {
+		dht.Migrations = make(map[PacketConn]PacketConn)
+	}
+	dht.Migrations[newConn] = conn
+	dht.StatsLock.Unlock()
+	dht.addConnection(newConn)
+	go dht.ListenDHT(newConn)
+	dht.State = D_RECONNECTING
+	err = dht.Handshake(newConn)
+	if err != nil {
+		Log(ERROR, "Failed to handshake with router %s: %v", addr, err)
+	}
+	go dht.expireMigration(newConn)
+}
+
+// CompleteMigration drops connection to the old router after the new
+// one has confirmed our handshake
+func (dht *DHTClient) CompleteMigration(conn PacketConn) {
+	dht.StatsLock.Lock()
+	old, exists := dht.Migrations[conn]
+	delete(dht.Migrations, conn)
+	dht.StatsLock.Unlock()
+	if !exists {
+		return
+	}
+	oldAddr := old.RemoteAddr().String()
+	newAddr := conn.RemoteAddr().String()
+	Log(INFO, "Migration from router %s to %s completed", oldAddr, newAddr)
+	// Confirm migration to the old router, so it can forget about us
+	_, err := old.Write([]byte(dht.Compose(CMD_MIGRATE, dht.ID, "", newAddr)))
+	dht.CountSent(old, err)
+	dht.removeConnection(old)
+	dht.replaceRouter(oldAddr, newAddr)
+}
+
+// expireMigration abandons migration when the new router didn't confirm
+// connection in time. Connection to the old router is kept
+func (dht *DHTClient) expireMigration(conn PacketConn) {
+	time.Sleep(MIGRATION_TIMEOUT)
+	dht.StatsLock.Lock()
+	_, exists := dht.Migrations[conn]
+	delete(dht.Migrations, conn)
+	dht.StatsLock.Unlock()
+	if !exists {
+		return
+	}
+	Log(WARNING, "Router %s didn't confirm migration. Staying with the current router", conn.RemoteAddr().String())
+	dht.removeConnection(conn)
+	if dht.State == D_RECONNECTING {
+		dht.State = D_OPERATING
+	}
+}
+
+// replaceRouter updates list of routers, so future reconnects will use
+// the new router instead of the old one
+func (dht *DHTClient) replaceRouter(oldAddr, newAddr string) {
+	routers := strings.Split(dht.Routers, ",")
+	for i, router := range routers {
+		addr, err := dht.Resolve(router)
+		if err == nil && addr.String() == oldAddr {
+			routers[i] = newAddr
+		}
+	}
+	dht.Routers = strings.Join(routers, ",")
+}
@@ -0,0 +1,70 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMigration(t *testing.T) {
+	oldRouter, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skipf("Can't create UDP socket: %v", err)
+	}
+	defer oldRouter.Close()
+	newRouter, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Skipf("Can't create UDP socket: %v", err)
+	}
+	defer newRouter.Close()
+
+	dht := new(DHTClient)
+	dht.ResponseHandlers = make(map[string]DHTResponseCallback)
+	dht.ID = "00000000-1111-2222-3333-444444444444"
+	dht.Routers = oldRouter.LocalAddr().String()
+	old, err := net.DialUDP("udp4", nil, oldRouter.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to connect to router: %v", err)
+	}
+	dht.Connection = append(dht.Connection, old)
+
+	var msg DHTMessage
+	msg.Command = CMD_MIGRATE
+	msg.Arguments = newRouter.LocalAddr().String()
+	dht.HandleMigrate(msg, old)
+	if len(dht.Connection) != 2 || len(dht.Migrations) != 1 {
+		t.Fatalf("Connection to the new router was not established")
+	}
+	newConn := dht.Connection[1]
+
+	// New router should receive a handshake
+	buf := make([]byte, 512)
+	newRouter.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := newRouter.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Handshake was not received: %v", err)
+	}
+	handshake, err := dht.Extract(buf[:n])
+	if err != nil || handshake.Command != CMD_CONN {
+		t.Fatalf("Wrong handshake: %v", handshake)
+	}
+
+	dht.CompleteMigration(newConn)
+	if len(dht.Connection) != 1 || dht.Connection[0] != newConn {
+		t.Errorf("Connection to the old router was not dropped")
+	}
+	if dht.Routers != newRouter.LocalAddr().String() {
+		t.Errorf("List of routers was not updated: %s", dht.Routers)
+	}
+	oldRouter.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = oldRouter.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Confirmation was not received: %v", err)
+	}
+	confirmation, err := dht.Extract(buf[:n])
+	if err != nil || confirmation.Command != CMD_MIGRATE {
+		t.Errorf("Wrong confirmation: %v", confirmation)
+	}
+	dht.halt()
+	newConn.Close()
+}
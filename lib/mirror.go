@@ -0,0 +1,154 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// MirrorConfig describes where decrypted frames of selected peers are
+// copied for inspection by an IDS, like Suricata or Zeek. Mirroring is
+// off unless explicitly enabled
+type MirrorConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Peers     []string `yaml:"peers"`     // IDs, IPs or tags of peers. * mirrors every peer
+	Socket    string   `yaml:"socket"`    // UNIX datagram socket receiving a frame per datagram
+	Interface string   `yaml:"interface"` // TAP interface created for IDS to sniff on
+}
+
+// Mirror copies frames to IDS without blocking data path. Frames are
+// dropped when IDS doesn't keep up
+type Mirror struct {
+	sent    uint64
+	dropped uint64
+	Peers   []string
+	Target  string // Socket or interface frames are copied to
+	conn    net.Conn
+	dev     TapDevice
+	queue   chan []byte
+	done    chan bool
+	once    sync.Once
+}
+
+// NewMirror opens socket or creates interface specified in config
+func NewMirror(cfg MirrorConfig, tool string) (*Mirror, error) {
+	if (cfg.Socket == "") == (cfg.Interface == "") {
+		return nil, errors.New("Either socket or interface should be specified for mirroring")
+	}
+	m := &Mirror{queue: make(chan []byte, MIRROR_QUEUE_SIZE), done: make(chan bool)}
+	for _, peer := range cfg.Peers {
+		if strings.TrimSpace(peer) == TAG_ANY {
+			m.Peers = append(m.Peers, TAG_ANY)
+			continue
+		}
+		parsed, err := ParseTags(peer)
+		if err != nil {
+			return nil, err
+		}
+		m.Peers = append(m.Peers, parsed...)
+	}
+	if len(m.Peers) == 0 {
+		return nil, errors.New("No peers were selected for mirroring")
+	}
+	var err error
+	if cfg.Socket != "" {
+		if err := CheckAccess(cfg.Socket); err != nil {
+			return nil, err
+		}
+		m.Target = cfg.Socket
+		m.conn, err = net.Dial("unixgram", cfg.Socket)
+	} else {
+		m.Target = cfg.Interface
+		m.dev, err = openMirrorDevice(cfg.Interface, tool)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to open %s for mirroring: %v", m.Target, err))
+	}
+	return m, nil
+}
+
+// Copy queues frame for IDS
+func (m *Mirror) Copy(frame []byte) {
+	select {
+	case m.queue <- append([]byte{}, frame...):
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+	}
+}
+
+// Run writes queued frames until mirror is closed
+func (m *Mirror) Run() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case frame := <-m.queue:
+			var err error
+			if m.conn != nil {
+				_, err = m.conn.Write(frame)
+			} else {
+				err = m.dev.WritePacket(&Packet{Packet: frame})
+			}
+			if err != nil {
+				atomic.AddUint64(&m.dropped, 1)
+				Log(TRACE, "Failed to mirror frame to %s: %v", m.Target, err)
+				continue
+			}
+			atomic.AddUint64(&m.sent, 1)
+		}
+	}
+}
+
+// Close stops mirroring
+func (m *Mirror) Close() {
+	m.once.Do(func() {
+		close(m.done)
+		if m.conn != nil {
+			m.conn.Close()
+		}
+		if m.dev != nil {
+			m.dev.Close()
+		}
+	})
+}
+
+func (m *Mirror) String() string {
+	return fmt.Sprintf("Mirroring %s to %s: %d frames, %d dropped", strings.Join(m.Peers, ","), m.Target,
+		atomic.LoadUint64(&m.sent), atomic.LoadUint64(&m.dropped))
+}
+
+// StartMirror enables mirroring configured in config file. Activation is
+// logged as a warning, so it shows up among recent events of the status
+// page and can't go unnoticed
+func (p *PTPCloud) StartMirror() error {
+	if !p.MirrorConfig.Enabled {
+		return nil
+	}
+	m, err := NewMirror(p.MirrorConfig, p.IPTool)
+	if err != nil {
+		return err
+	}
+	p.Mirror = m
+	p.Go(m.Run)
+	Log(WARNING, "AUDIT: Decrypted traffic of peers %s is mirrored to %s", strings.Join(m.Peers, ","), m.Target)
+	return nil
+}
+
+// StopMirror disables mirroring
+func (p *PTPCloud) StopMirror() {
+	if p.Mirror == nil {
+		return
+	}
+	p.Mirror.Close()
+	Log(WARNING, "AUDIT: Mirroring to %s was stopped. %s", p.Mirror.Target, p.Mirror.String())
+}
+
+// MirrorFrame copies frame exchanged with a peer if the peer is mirrored
+func (p *PTPCloud) MirrorFrame(peer *NetworkPeer, frame []byte) {
+	if p.Mirror != nil && p.peerListed(p.Mirror.Peers, peer) {
+		p.Mirror.Copy(frame)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package ptp
+
+// openMirrorDevice creates TAP interface without addresses, so IDS can
+// sniff on it while host doesn't route anything through it
+func openMirrorDevice(name, tool string) (TapDevice, error) {
+	dev, err := Open(name, DevTap)
+	if err != nil {
+		return nil, err
+	}
+	err = LinkUp(dev.Name, tool)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
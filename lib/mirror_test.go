@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package ptp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ids.sock")
+	ids, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ids.Close()
+
+	if _, err := NewMirror(MirrorConfig{Enabled: true, Socket: path}, ""); err == nil {
+		t.Errorf("Mirror without peers was created")
+	}
+	p := new(PTPCloud)
+	p.Resources = NewResources(0, 0, 0)
+	p.MirrorConfig = MirrorConfig{Enabled: true, Peers: []string{"Untrusted"}, Socket: path}
+	if err := p.StartMirror(); err != nil {
+		t.Fatalf("Failed to start mirror: %v", err)
+	}
+	defer p.StopMirror()
+
+	p.MirrorFrame(&NetworkPeer{ID: "trusted"}, []byte("skipped"))
+	p.MirrorFrame(&NetworkPeer{ID: "other", Tags: []string{"untrusted"}, TagsConfirmed: true}, []byte("frame"))
+	buf := make([]byte, 64)
+	ids.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := ids.Read(buf)
+	if err != nil || string(buf[:n]) != "frame" {
+		t.Errorf("Expected mirrored frame, got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,10 @@
+package ptp
+
+import (
+	"errors"
+)
+
+// TAP adapters on Windows can't be brought up without an address
+func openMirrorDevice(name, tool string) (TapDevice, error) {
+	return nil, errors.New("Mirroring to an interface is not supported on Windows. Use socket instead")
+}
@@ -0,0 +1,375 @@
+package ptp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockRouter is an in-process DHT router for tests of this package and of
+// programs embedding it. It listens on loopback unless created with
+// ListenMockRouter and answers CONN, FIND, NODE, PING, CP, REGCP, LOAD,
+// DHCP and STOP the way routers do. Behavior fields should be set before
+// Start, except drop rate that can be changed any time
+type MockRouter struct {
+	AssignID     func(req DHTMessage) string // Chooses ID of a new node. ID proposed with identity key or a random one is used if nil
+	Network      *net.IPNet                  // Addresses leased over DHCP. DHCP requests are not answered if nil
+	Forwarders   []string                    // Forwarders handed out on CP requests in addition to registered ones
+	Ignore       []string                    // Commands that are not answered
+	PingInterval time.Duration               // How often nodes are pinged. Zero disables pings
+	ListSelf     bool                        // Node is listed to itself, like routers do, so it learns addresses it's seen at
+	conn         *net.UDPConn
+	nodes        map[string]*mockNode
+	leased       map[string]string // Leased IP by ID of a node
+	tokens       map[string]string // Resume token by ID of a node
+	relays       map[string]string // Endpoint of registered forwarder by its ID
+	saturated    map[string]bool   // Forwarders that reported saturation are not handed out
+	scopes       map[string]string // Network hash of community relays by endpoint
+	dropRate     float64
+	stop         chan bool
+	lock         sync.Mutex
+}
+
+// mockNode is a node connected to MockRouter
+type mockNode struct {
+	ID        string
+	Hash      string
+	Addr      *net.UDPAddr // Source of the handshake
+	Endpoints []string     // Addresses of the node as they are sent in NODE replies
+}
+
+// NewMockRouter creates router bound to a random port on loopback
+func NewMockRouter() (*MockRouter, error) {
+	return ListenMockRouter("127.0.0.1:0")
+}
+
+// ListenMockRouter creates router bound to the address, so it's reachable
+// from other hosts or network namespaces
+func ListenMockRouter(address string) (*MockRouter, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &MockRouter{
+		PingInterval: time.Second * 10,
+		conn:         conn,
+		nodes:        make(map[string]*mockNode),
+		leased:       make(map[string]string),
+		tokens:       make(map[string]string),
+		relays:       make(map[string]string),
+		saturated:    make(map[string]bool),
+		scopes:       make(map[string]string),
+		stop:         make(chan bool),
+	}, nil
+}
+
+// Endpoint returns address of the router in a form accepted as
+// Options.Routers
+func (m *MockRouter) Endpoint() string {
+	return m.conn.LocalAddr().String()
+}
+
+// SetDropRate makes router silently drop share of received packets
+func (m *MockRouter) SetDropRate(rate float64) {
+	m.lock.Lock()
+	m.dropRate = rate
+	m.lock.Unlock()
+}
+
+// Nodes returns IDs of connected nodes
+func (m *MockRouter) Nodes() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var ids []string
+	for id := range m.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Stop sends STOP with reason to the node, like routers do when node is
+// kicked or network is deleted
+func (m *MockRouter) Stop(id, reason string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	node, exists := m.nodes[id]
+	if !exists {
+		return errors.New(fmt.Sprintf("Node %s is not connected", id))
+	}
+	m.send(DHTMessage{Command: CMD_STOP, Id: id, Payload: reason}, node.Addr)
+	delete(m.nodes, id)
+	m.notifyNetwork(node.Hash)
+	return nil
+}
+
+// Start serves requests in background until Close is called
+func (m *MockRouter) Start() {
+	go m.listen()
+	if m.PingInterval > 0 {
+		go m.ping()
+	}
+}
+
+// Close stops the router
+func (m *MockRouter) Close() error {
+	close(m.stop)
+	return m.conn.Close()
+}
+
+func (m *MockRouter) listen() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := new(DHTClient).Extract(buf[:n])
+		if err != nil {
+			continue
+		}
+		m.handle(req, addr)
+	}
+}
+
+func (m *MockRouter) ping() {
+	ticker := time.NewTicker(m.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.lock.Lock()
+		for _, node := range m.nodes {
+			m.send(DHTMessage{Command: CMD_PING, Id: node.ID}, node.Addr)
+		}
+		m.lock.Unlock()
+	}
+}
+
+// send writes reply to a node. Replies are stamped with time of the router
+// and authenticated with session token of the node
+func (m *MockRouter) send(msg DHTMessage, addr *net.UDPAddr) {
+	if msg.Query == "" {
+		msg.Query = "0"
+	}
+	msg.Stamp = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	for _, node := range m.nodes {
+		if node.Addr.String() == addr.String() {
+			msg.Mac = MessageMAC(m.tokens[node.ID], msg)
+			break
+		}
+	}
+	m.conn.WriteToUDP([]byte(new(DHTClient).EncodeRequest(msg)), addr)
+}
+
+func (m *MockRouter) handle(req DHTMessage, addr *net.UDPAddr) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.dropRate > 0 && mrand.Float64() < m.dropRate {
+		return
+	}
+	for _, command := range m.Ignore {
+		if command == req.Command {
+			return
+		}
+	}
+	switch req.Command {
+	case CMD_CONN:
+		m.handleConn(req, addr)
+	case CMD_FIND:
+		m.sendFind(req.Id)
+	case CMD_NODE:
+		if node, exists := m.nodes[req.Query]; exists {
+			m.send(DHTMessage{Command: CMD_NODE, Id: node.ID, Arguments: strings.Join(node.Endpoints, "|")}, addr)
+		}
+	case CMD_PING:
+		// Reply to our ping. Nothing to do
+	case CMD_REGCP:
+		endpoint := JoinEndpoint(addr.IP.String(), atoi(req.Arguments))
+		m.relays[req.Id] = endpoint
+		if req.Query != "0" && req.Query != "" {
+			// Community relay of a single network
+			m.scopes[endpoint] = req.Query
+		}
+		m.Forwarders = append(m.Forwarders, endpoint)
+		m.send(DHTMessage{Command: CMD_REGCP, Id: req.Id}, addr)
+	case CMD_LOAD:
+		if load := strings.Split(req.Payload, "|"); len(load) == 3 {
+			m.saturated[m.relays[req.Id]] = load[2] == "1"
+		}
+	case CMD_CP:
+		m.handleCp(req, addr)
+	case CMD_DHCP:
+		m.handleDHCP(req, addr)
+	case CMD_STOP:
+		if node, exists := m.nodes[req.Id]; exists {
+			delete(m.nodes, req.Id)
+			m.notifyNetwork(node.Hash)
+		}
+	default:
+		m.send(DHTMessage{Command: CMD_UNKNOWN, Id: req.Id}, addr)
+	}
+}
+
+func (m *MockRouter) handleConn(req DHTMessage, addr *net.UDPAddr) {
+	if req.Query != PACKET_VERSION {
+		m.send(DHTMessage{Command: CMD_ERROR, Arguments: string(ERR_INCOPATIBLE_VERSION)}, addr)
+		return
+	}
+	args := strings.Split(req.Arguments, "|")
+	port := atoi(args[0])
+	var id string
+	if token, exists := m.tokens[req.Id]; exists && req.Token != "" && token == req.Token {
+		id = req.Id
+	} else if m.AssignID != nil {
+		id = m.AssignID(req)
+	} else {
+		id = mockID(req)
+	}
+	if _, exists := m.tokens[id]; !exists {
+		m.tokens[id] = mockToken()
+	}
+	node := &mockNode{ID: id, Hash: req.Payload, Addr: addr}
+	for _, item := range args[1:] {
+		if IsSealed(item) {
+			node.Endpoints = append(node.Endpoints, item)
+		} else if item != "" {
+			node.Endpoints = append(node.Endpoints, JoinEndpoint(item, port))
+		}
+	}
+	node.Endpoints = append(node.Endpoints, JoinEndpoint(addr.IP.String(), port))
+	m.nodes[id] = node
+	m.send(DHTMessage{Command: CMD_CONN, Id: id, Token: m.tokens[id]}, addr)
+	m.notifyNetwork(node.Hash)
+}
+
+// mockID returns ID proposed by the node if it was derived from its
+// identity key, or a random one
+func mockID(req DHTMessage) string {
+	pub, err := hex.DecodeString(req.PublicKey)
+	if err == nil && len(pub) > 0 && DeriveID(pub) == req.Id {
+		return req.Id
+	}
+	random := make([]byte, 32)
+	rand.Read(random)
+	return DeriveID(random)
+}
+
+func mockToken() string {
+	random := make([]byte, 16)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// sendFind sends list of other nodes of the network to a node
+func (m *MockRouter) sendFind(id string) {
+	node, exists := m.nodes[id]
+	if !exists {
+		return
+	}
+	var ids []string
+	for _, other := range m.nodes {
+		if other.Hash == node.Hash && (other.ID != id || m.ListSelf) {
+			ids = append(ids, other.ID)
+		}
+	}
+	sort.Strings(ids)
+	m.send(DHTMessage{Command: CMD_FIND, Id: id, Arguments: strings.Join(ids, ",")}, node.Addr)
+}
+
+// notifyNetwork sends fresh list of nodes to every node of the network
+func (m *MockRouter) notifyNetwork(hash string) {
+	for _, node := range m.nodes {
+		if node.Hash == hash {
+			m.sendFind(node.ID)
+		}
+	}
+}
+
+func (m *MockRouter) handleCp(req DHTMessage, addr *net.UDPAddr) {
+	omit := strings.Split(req.Query, "|")
+	var hash string
+	if node, exists := m.nodes[req.Id]; exists {
+		hash = node.Hash
+	}
+	for _, fwd := range m.Forwarders {
+		scope, scoped := m.scopes[fwd]
+		skip := m.saturated[fwd] || (scoped && scope != hash) || fwd == m.relays[req.Id]
+		for _, o := range omit {
+			if o == fwd {
+				skip = true
+			}
+		}
+		if !skip {
+			m.send(DHTMessage{Command: CMD_CP, Id: req.Id, Query: fwd, Arguments: req.Arguments}, addr)
+			return
+		}
+	}
+}
+
+func (m *MockRouter) handleDHCP(req DHTMessage, addr *net.UDPAddr) {
+	if m.Network == nil {
+		return
+	}
+	if req.Query != "0" && req.Query != "" {
+		// Node reports address it has configured itself
+		m.leased[req.Id] = req.Query
+		m.send(DHTMessage{Command: CMD_DHCP, Id: req.Id, Arguments: "ok"}, addr)
+		return
+	}
+	ip, err := m.lease(req.Id)
+	if err != nil {
+		return
+	}
+	ones, _ := m.Network.Mask.Size()
+	m.send(DHTMessage{Command: CMD_DHCP, Id: req.Id, Arguments: fmt.Sprintf("%s/%d", ip, ones)}, addr)
+}
+
+// lease returns address leased to the node, picking the first free one
+// for a new node
+func (m *MockRouter) lease(id string) (string, error) {
+	if ip, exists := m.leased[id]; exists {
+		return ip, nil
+	}
+	used := make(map[string]bool)
+	for _, ip := range m.leased {
+		used[ip] = true
+	}
+	base := m.Network.IP.To4()
+	if base == nil {
+		return "", errors.New("Only IPv4 networks are leased")
+	}
+	ones, bits := m.Network.Mask.Size()
+	for i := 1; i < 1<<uint(bits-ones)-1; i++ {
+		ip := make(net.IP, 4)
+		copy(ip, base)
+		for b, n := 3, i; b >= 0 && n > 0; b, n = b-1, n>>8 {
+			ip[b] += byte(n)
+		}
+		if !used[ip.String()] {
+			m.leased[id] = ip.String()
+			return ip.String(), nil
+		}
+	}
+	return "", errors.New("Network is exhausted")
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,147 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it's true or a second passes
+func waitFor(condition func() bool) bool {
+	for started := time.Now(); time.Since(started) < time.Second; time.Sleep(time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+func TestMockRouter(t *testing.T) {
+	router, err := NewMockRouter()
+	if err != nil {
+		t.Fatalf("Failed to start mock router: %v", err)
+	}
+	_, router.Network, _ = net.ParseCIDR("10.10.0.0/24")
+	router.Start()
+	defer router.Close()
+
+	var clients []*DHTClient
+	for i := 0; i < 2; i++ {
+		config := &DHTClient{Routers: router.Endpoint(), NetworkHash: "mock", P2PPort: 6000 + i}
+		dht := new(DHTClient).Initialize(config, []net.IP{net.ParseIP("192.168.1.10")}, make(chan []PeerIP, 10), make(chan Forwarder, 10))
+		if dht == nil {
+			t.Fatalf("Client %d failed to connect to mock router", i)
+		}
+		if len(dht.ID) != 36 {
+			t.Fatalf("Mock router assigned malformed ID %q", dht.ID)
+		}
+		defer dht.Stop()
+		clients = append(clients, dht)
+	}
+	if len(router.Nodes()) != 2 {
+		t.Errorf("Router knows %d nodes instead of 2", len(router.Nodes()))
+	}
+	select {
+	case peers := <-clients[1].PeerChannel:
+		if len(peers) != 1 || peers[0].ID != clients[0].ID {
+			t.Errorf("Second client received wrong peers: %v", peers)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Mock router didn't send list of peers")
+	}
+
+	clients[0].RequestIP()
+	if !waitFor(func() bool { ip, _ := clients[0].Lease(); return ip != nil }) {
+		t.Fatalf("Mock router didn't lease an address")
+	}
+	if ip, _ := clients[0].Lease(); ip.String() != "10.10.0.1" {
+		t.Errorf("Mock router leased %s instead of 10.10.0.1", ip)
+	}
+
+	clients[1].Stop()
+	if !waitFor(func() bool { return len(router.Nodes()) == 1 }) {
+		t.Errorf("Stopped client wasn't removed from mock router")
+	}
+}
+
+func TestMockRouterDrop(t *testing.T) {
+	router, err := NewMockRouter()
+	if err != nil {
+		t.Fatalf("Failed to start mock router: %v", err)
+	}
+	router.SetDropRate(1)
+	router.Start()
+	defer router.Close()
+	dht := &DHTClient{NetworkHash: "mock", Stats: make(map[string]*RouterStats)}
+	dht.ResponseHandlers = map[string]DHTResponseCallback{CMD_CONN: dht.HandleConn}
+	addr, _ := net.ResolveUDPAddr("udp", router.Endpoint())
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to mock router: %v", err)
+	}
+	defer conn.Close()
+	go dht.ListenDHT(conn)
+	if err := dht.AwaitHandshake(conn, 2, 20*time.Millisecond); err == nil {
+		t.Errorf("Handshake succeeded while router drops every packet")
+	}
+	router.SetDropRate(0)
+	dht.State = D_CONNECTING
+	if err := dht.AwaitHandshake(conn, 2, 100*time.Millisecond); err != nil {
+		t.Errorf("Handshake failed: %v", err)
+	}
+	dht.halt()
+}
+
+func TestMockRouterListSelf(t *testing.T) {
+	router, err := ListenMockRouter("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock router: %v", err)
+	}
+	router.ListSelf = true
+	router.Start()
+	defer router.Close()
+	config := &DHTClient{Routers: router.Endpoint(), NetworkHash: "mock", P2PPort: 6020}
+	dht := new(DHTClient).Initialize(config, []net.IP{net.ParseIP("192.168.1.10")}, make(chan []PeerIP, 10), make(chan Forwarder, 10))
+	if dht == nil {
+		t.Fatalf("Client failed to connect to mock router")
+	}
+	defer dht.Stop()
+	select {
+	case peers := <-dht.PeerChannel:
+		if len(peers) != 1 || peers[0].ID != dht.ID {
+			t.Errorf("Node wasn't listed to itself: %v", peers)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Mock router didn't send list of peers")
+	}
+}
+
+func TestMockRouterAssignedID(t *testing.T) {
+	// Router that ignores identity keys assigns IDs of its own, and
+	// introductions are sent unsigned, so peers still accept them
+	router, err := NewMockRouter()
+	if err != nil {
+		t.Fatalf("Failed to start mock router: %v", err)
+	}
+	router.AssignID = func(req DHTMessage) string { return "assigned-by-router" }
+	router.Start()
+	defer router.Close()
+	identity, _ := GenerateIdentity()
+	config := &DHTClient{Routers: router.Endpoint(), NetworkHash: "mock", P2PPort: 6030, Identity: identity}
+	dht := new(DHTClient).Initialize(config, []net.IP{net.ParseIP("192.168.1.10")}, make(chan []PeerIP, 10), make(chan Forwarder, 10))
+	if dht == nil {
+		t.Fatalf("Client failed to connect to mock router")
+	}
+	defer dht.Stop()
+	if dht.ID != "assigned-by-router" {
+		t.Fatalf("Router didn't assign its own ID: %s", dht.ID)
+	}
+	p := &PTPCloud{Dht: dht, Identity: identity, Mac: "01:02:03:04:05:06", IP: "10.10.0.2"}
+	intro := string(p.PrepareIntroductionMessage(p.Dht.ID).Data)
+	if ParseIntroduction(intro).Signed {
+		t.Errorf("Introduction with ID of the router was signed")
+	}
+	if !new(PTPCloud).VerifyIntroString(intro) {
+		t.Errorf("Introduction with ID of the router was refused")
+	}
+}
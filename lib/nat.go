@@ -0,0 +1,162 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NATRule maps network behind a peer that overlaps with a local network
+// to a locally unique alias network of the same size. Host routes alias
+// network through the peer, addresses are translated one to one on the
+// way to and from the peer
+type NATRule struct {
+	Peer   string `yaml:"peer"`   // ID, virtual IP or tag of the peer
+	Remote string `yaml:"remote"` // Network behind the peer, e.g. 192.168.1.0/24
+	Alias  string `yaml:"alias"`  // Network this host uses for it, e.g. 10.201.1.0/24
+}
+
+// NATMapping is a parsed NATRule
+type NATMapping struct {
+	Peer   string
+	Remote *net.IPNet
+	Alias  *net.IPNet
+}
+
+// ParseNATRules validates translation rules. Alias networks must not
+// overlap, since destination of a packet selects the rule
+func ParseNATRules(rules []NATRule) ([]NATMapping, error) {
+	var mappings []NATMapping
+	for _, r := range rules {
+		peer := strings.ToLower(strings.TrimSpace(r.Peer))
+		if peer == "" {
+			return nil, errors.New("Peer of NAT rule is not specified")
+		}
+		_, remote, err := net.ParseCIDR(r.Remote)
+		if err != nil || remote.IP.To4() == nil {
+			return nil, errors.New(fmt.Sprintf("Bad remote network %s of NAT rule: IPv4 network is expected", r.Remote))
+		}
+		_, alias, err := net.ParseCIDR(r.Alias)
+		if err != nil || alias.IP.To4() == nil {
+			return nil, errors.New(fmt.Sprintf("Bad alias network %s of NAT rule: IPv4 network is expected", r.Alias))
+		}
+		rs, _ := remote.Mask.Size()
+		as, _ := alias.Mask.Size()
+		if rs != as {
+			return nil, errors.New(fmt.Sprintf("Alias %s and remote network %s of NAT rule differ in size", r.Alias, r.Remote))
+		}
+		for _, m := range mappings {
+			if m.Alias.Contains(alias.IP) || alias.Contains(m.Alias.IP) {
+				return nil, errors.New(fmt.Sprintf("Alias networks %s and %s of NAT rules overlap", m.Alias, alias))
+			}
+		}
+		mappings = append(mappings, NATMapping{Peer: peer, Remote: remote, Alias: alias})
+	}
+	return mappings, nil
+}
+
+// mapAddress moves address from one network into the same position of
+// another network of the same size
+func mapAddress(ip net.IP, from, to *net.IPNet) net.IP {
+	ip4, base := ip.To4(), to.IP.To4()
+	mapped := make(net.IP, net.IPv4len)
+	for i := range mapped {
+		mapped[i] = base[i] | (ip4[i] &^ from.Mask[i])
+	}
+	return mapped
+}
+
+// checksumAdjust updates internet checksum after data covered by it has
+// changed from old to new, see RFC 1624. Data is even-sized
+func checksumAdjust(sum uint16, old, new []byte) uint16 {
+	s := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		s += uint32(^binary.BigEndian.Uint16(old[i:]))
+		s += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// rewriteIPv4 replaces source or destination address of IPv4 packet in
+// an ethernet frame and fixes checksums of IP header and TCP or UDP
+// segment, which covers addresses too. Non-first fragments carry no
+// segment header, so only IP header is fixed for them
+func rewriteIPv4(frame []byte, addr net.IP, source bool) {
+	ip := frame[ETH_HEADER_SIZE:]
+	offset := 16
+	if source {
+		offset = 12
+	}
+	old := make([]byte, net.IPv4len)
+	copy(old, ip[offset:offset+4])
+	copy(ip[offset:offset+4], addr.To4())
+	new := ip[offset : offset+4]
+	binary.BigEndian.PutUint16(ip[10:12], checksumAdjust(binary.BigEndian.Uint16(ip[10:12]), old, new))
+
+	ihl := int(ip[0]&0x0f) * 4
+	if binary.BigEndian.Uint16(ip[6:8])&0x1fff != 0 {
+		return
+	}
+	segment := ip[ihl:]
+	var sum int
+	switch int(ip[9]) {
+	case IPPROTO_TCP:
+		sum = 16
+	case IPPROTO_UDP:
+		sum = 6
+		if len(segment) >= 8 && binary.BigEndian.Uint16(segment[6:8]) == 0 {
+			// Checksum is not used
+			return
+		}
+	default:
+		return
+	}
+	if len(segment) < sum+2 {
+		return
+	}
+	binary.BigEndian.PutUint16(segment[sum:sum+2], checksumAdjust(binary.BigEndian.Uint16(segment[sum:sum+2]), old, new))
+}
+
+// ipv4Header returns true if frame carries complete IPv4 header
+func ipv4Header(frame []byte) bool {
+	if len(frame) < ETH_HEADER_SIZE+20 || frame[ETH_HEADER_SIZE]>>4 != 4 {
+		return false
+	}
+	ihl := int(frame[ETH_HEADER_SIZE]&0x0f) * 4
+	return ihl >= 20 && len(frame) >= ETH_HEADER_SIZE+ihl
+}
+
+// TranslateOutgoing rewrites destination of a frame sent to the peer
+// from alias network to the network behind the peer
+func (p *PTPCloud) TranslateOutgoing(peer *NetworkPeer, frame []byte) {
+	if len(p.NAT) == 0 || peer == nil || !ipv4Header(frame) {
+		return
+	}
+	dst := net.IP(frame[ETH_HEADER_SIZE+16 : ETH_HEADER_SIZE+20])
+	for _, m := range p.NAT {
+		if m.Alias.Contains(dst) && p.peerListed([]string{m.Peer}, peer) {
+			rewriteIPv4(frame, mapAddress(dst, m.Alias, m.Remote), false)
+			return
+		}
+	}
+}
+
+// TranslateIncoming rewrites source of a frame received from the peer
+// from the network behind the peer to alias network
+func (p *PTPCloud) TranslateIncoming(peer *NetworkPeer, frame []byte) {
+	if len(p.NAT) == 0 || peer == nil || !ipv4Header(frame) {
+		return
+	}
+	src := net.IP(frame[ETH_HEADER_SIZE+12 : ETH_HEADER_SIZE+16])
+	for _, m := range p.NAT {
+		if m.Remote.Contains(src) && p.peerListed([]string{m.Peer}, peer) {
+			rewriteIPv4(frame, mapAddress(src, m.Remote, m.Alias), true)
+			return
+		}
+	}
+}
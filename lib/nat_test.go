@@ -0,0 +1,109 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// checksum computes internet checksum of data
+func checksum(data []byte) uint16 {
+	var s uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// natFrame builds ethernet frame with UDP packet and valid checksums
+func natFrame(src, dst string) []byte {
+	frame := ipv4Frame(IPPROTO_UDP, 40000, 53)
+	ip := frame[14:]
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+	ip[8] = 64
+	copy(ip[12:16], net.ParseIP(src).To4())
+	copy(ip[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(ip[20+4:20+6], 8)
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip[:20]))
+	binary.BigEndian.PutUint16(ip[20+6:20+8], udpChecksum(ip))
+	return frame
+}
+
+// udpChecksum computes checksum of UDP segment with pseudo header
+func udpChecksum(ip []byte) uint16 {
+	segment := make([]byte, len(ip)-20)
+	copy(segment, ip[20:])
+	segment[6], segment[7] = 0, 0
+	pseudo := append([]byte{}, ip[12:20]...)
+	pseudo = append(pseudo, 0, ip[9], byte(len(segment)>>8), byte(len(segment)))
+	return checksum(append(pseudo, segment...))
+}
+
+func TestParseNATRules(t *testing.T) {
+	good := []NATRule{
+		{Peer: "10.10.10.2", Remote: "192.168.1.0/24", Alias: "10.201.1.0/24"},
+		{Peer: "branch", Remote: "192.168.1.0/24", Alias: "10.201.2.0/24"},
+	}
+	mappings, err := ParseNATRules(good)
+	if err != nil || len(mappings) != 2 {
+		t.Fatalf("Rules were rejected: %v", err)
+	}
+	bad := [][]NATRule{
+		{{Remote: "192.168.1.0/24", Alias: "10.201.1.0/24"}},
+		{{Peer: "a", Remote: "192.168.1.0/24", Alias: "10.201.1.0/25"}},
+		{{Peer: "a", Remote: "fd00::/64", Alias: "fd01::/64"}},
+		{{Peer: "a", Remote: "192.168.1.0/24", Alias: "10.201.0.0/16"}, {Peer: "b", Remote: "192.168.1.0/24", Alias: "10.201.1.0/24"}},
+	}
+	for _, rules := range bad {
+		if _, err := ParseNATRules(rules); err == nil {
+			t.Errorf("Bad rules were accepted: %v", rules)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	p := new(PTPCloud)
+	p.NAT, _ = ParseNATRules([]NATRule{{Peer: "branch", Remote: "192.168.1.0/24", Alias: "10.201.1.0/24"}})
+	branch := &NetworkPeer{ID: "branch", Tags: []string{"branch"}}
+	other := &NetworkPeer{ID: "other"}
+
+	frame := natFrame("192.168.1.5", "10.201.1.7")
+	p.TranslateOutgoing(other, frame)
+	if !net.IP(frame[30:34]).Equal(net.ParseIP("10.201.1.7")) {
+		t.Errorf("Frame to other peer was translated")
+	}
+	p.TranslateOutgoing(branch, frame)
+	ip := frame[14:]
+	if !net.IP(ip[16:20]).Equal(net.ParseIP("192.168.1.7")) || !net.IP(ip[12:16]).Equal(net.ParseIP("192.168.1.5")) {
+		t.Errorf("Wrong addresses after translation: %s -> %s", net.IP(ip[12:16]), net.IP(ip[16:20]))
+	}
+	if checksum(ip[:20]) != 0 {
+		t.Errorf("IP header checksum is broken")
+	}
+	if sum := binary.BigEndian.Uint16(ip[26:28]); sum != udpChecksum(ip) {
+		t.Errorf("UDP checksum is broken: %x, expected %x", sum, udpChecksum(ip))
+	}
+
+	reply := natFrame("192.168.1.7", "192.168.1.5")
+	p.TranslateIncoming(branch, reply)
+	ip = reply[14:]
+	if !net.IP(ip[12:16]).Equal(net.ParseIP("10.201.1.7")) || checksum(ip[:20]) != 0 || binary.BigEndian.Uint16(ip[26:28]) != udpChecksum(ip) {
+		t.Errorf("Reply was translated wrong: %s", net.IP(ip[12:16]))
+	}
+}
+
+func TestNATRulePeerCase(t *testing.T) {
+	p := new(PTPCloud)
+	p.NAT, _ = ParseNATRules([]NATRule{{Peer: " Branch ", Remote: "192.168.1.0/24", Alias: "10.201.1.0/24"}})
+	frame := natFrame("192.168.1.5", "10.201.1.7")
+	p.TranslateOutgoing(&NetworkPeer{ID: "BRANCH"}, frame)
+	if !net.IP(frame[30:34]).Equal(net.ParseIP("192.168.1.7")) {
+		t.Errorf("Peer of NAT rule was matched case-sensitively")
+	}
+}
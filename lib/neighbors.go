@@ -0,0 +1,71 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Neighbor maps virtual address of a peer to its hardware address
+type Neighbor struct {
+	ID  string
+	IP  string
+	Mac string
+}
+
+// Neighbors returns IP to MAC mapping learned from peers. Seeded entries
+// of peers that haven't introduced themselves yet are included, so the
+// table survives restarts that happen before peers come back
+func (p *PTPCloud) Neighbors() []Neighbor {
+	var list []Neighbor
+	p.PeersLock.Lock()
+	learned := make(map[string]bool)
+	for _, peer := range p.NetworkPeers {
+		if peer.PeerLocalIP == nil || peer.PeerHW == nil {
+			continue
+		}
+		learned[peer.PeerLocalIP.String()] = true
+		list = append(list, Neighbor{ID: peer.ID, IP: peer.PeerLocalIP.String(), Mac: peer.PeerHW.String()})
+	}
+	for ip, n := range p.Seeded {
+		if !learned[ip] {
+			list = append(list, n)
+		}
+	}
+	p.PeersLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// SeedNeighbors pre-populates mapping with entries saved before restart.
+// ARP requests for seeded addresses are answered before peers introduce
+// themselves, so traffic flows as soon as they are connected
+func (p *PTPCloud) SeedNeighbors(list []Neighbor) error {
+	seeded := make(map[string]Neighbor)
+	for _, n := range list {
+		ip := net.ParseIP(n.IP)
+		if ip == nil {
+			return errors.New(fmt.Sprintf("Bad IP of neighbor %s: %s", n.ID, n.IP))
+		}
+		mac, err := net.ParseMAC(n.Mac)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Bad MAC of neighbor %s: %s", n.ID, n.Mac))
+		}
+		seeded[ip.String()] = Neighbor{ID: n.ID, IP: ip.String(), Mac: mac.String()}
+	}
+	p.PeersLock.Lock()
+	p.Seeded = seeded
+	p.PeersLock.Unlock()
+	return nil
+}
+
+// seededMac returns hardware address seeded for the IP
+func (p *PTPCloud) seededMac(ip string) net.HardwareAddr {
+	n, exists := p.Seeded[ip]
+	if !exists {
+		return nil
+	}
+	mac, _ := net.ParseMAC(n.Mac)
+	return mac
+}
@@ -0,0 +1,39 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNeighbors(t *testing.T) {
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	mac, _ := net.ParseMAC("06:00:00:00:00:02")
+	p.NetworkPeers["peer2"] = &NetworkPeer{ID: "peer2", PeerLocalIP: net.ParseIP("10.0.0.2"), PeerHW: mac}
+	p.NetworkPeers["peer4"] = &NetworkPeer{ID: "peer4"}
+
+	err := p.SeedNeighbors([]Neighbor{
+		{ID: "peer2", IP: "10.0.0.2", Mac: "06:00:00:00:00:99"},
+		{ID: "peer3", IP: "10.0.0.3", Mac: "06:00:00:00:00:03"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to seed neighbors: %v", err)
+	}
+	list := p.Neighbors()
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 neighbors, got %v", list)
+	}
+	if list[0].Mac != "06:00:00:00:00:02" {
+		t.Errorf("Seeded entry overrides learned one: %v", list[0])
+	}
+	if list[1].ID != "peer3" || list[1].Mac != "06:00:00:00:00:03" {
+		t.Errorf("Seeded entry is missing: %v", list[1])
+	}
+	if p.seededMac("10.0.0.3").String() != "06:00:00:00:00:03" {
+		t.Errorf("Seeded MAC isn't returned")
+	}
+
+	if p.SeedNeighbors([]Neighbor{{ID: "bad", IP: "10.0.0.5", Mac: "zz"}}) == nil {
+		t.Errorf("Malformed MAC was accepted")
+	}
+}
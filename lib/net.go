@@ -1,10 +1,16 @@
 package ptp
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -45,7 +51,7 @@ func (v *P2PMessageHeader) Serialize() []byte {
 
 func P2PMessageHeaderFromBytes(bytes []byte) (*P2PMessageHeader, error) {
 	if len(bytes) < HEADER_SIZE {
-		return nil, errors.New("P2PMessageHeaderFromBytes_error : less then 14 bytes")
+		return nil, fmt.Errorf("%w: header is shorter than %d bytes", ErrMalformedMessage, HEADER_SIZE)
 	}
 
 	result := new(P2PMessageHeader)
@@ -82,7 +88,7 @@ func P2PMessageFromBytes(bytes []byte) (*P2PMessage, error) {
 	}
 	Log(TRACE, "--- P2PMessageHeaderFromBytes Length : %d, SerLen : %d", res.Header.Length, res.Header.SerializedLen)
 	if res.Header.Magic != MAGIC_COOKIE {
-		return nil, errors.New("magic cookie not presented")
+		return nil, fmt.Errorf("%w: magic cookie not presented", ErrMalformedMessage)
 	}
 	res.Data = make([]byte, res.Header.SerializedLen)
 	Log(TRACE, "BYTES : %s", bytes)
@@ -273,51 +279,317 @@ type PTPNet struct {
 	port         int
 	addr         *net.UDPAddr
 	conn         *net.UDPConn
-	input_buffer [4096]byte
-	disposed     bool
+	input_buffer [RECEIVE_BUFFER_SIZE]byte
+	disposed     uint32         // Set once socket is stopped. Accessed atomically
+	dscp         int            // DSCP value of outgoing packets
+	workers      int            // Number of sockets receiving packets on the same port
+	device       string         // Interface every socket is restricted to
+	receivers    []*net.UDPConn // Additional sockets opened with SO_REUSEPORT
+	callback     UDPReceivedCallback
+	lock         sync.Mutex
+	connLock     sync.RWMutex // Guards socket, address and port replaced by Rebind
+	Recover      func()       // Reports panics of receiver goroutines
 }
 
 func (uc *PTPNet) Stop() {
-	uc.disposed = true
+	atomic.StoreUint32(&uc.disposed, 1)
+	uc.lock.Lock()
+	for _, conn := range uc.receivers {
+		conn.Close()
+	}
+	uc.receivers = nil
+	uc.lock.Unlock()
+	if conn := uc.socket(); conn != nil {
+		// Unblocks Listen
+		conn.Close()
+	}
 }
 
 func (uc *PTPNet) Disposed() bool {
-	return uc.disposed
+	return atomic.LoadUint32(&uc.disposed) == 1
 }
 
 func (uc *PTPNet) Addr() *net.UDPAddr {
+	uc.connLock.RLock()
+	defer uc.connLock.RUnlock()
 	return uc.addr
 }
 
+// socket returns the socket packets are sent from
+func (uc *PTPNet) socket() *net.UDPConn {
+	uc.connLock.RLock()
+	defer uc.connLock.RUnlock()
+	return uc.conn
+}
+
 func (uc *PTPNet) Init(host string, port int) error {
 	var err error = nil
 	uc.host = host
 	uc.port = port
-	uc.disposed = true
+	atomic.StoreUint32(&uc.disposed, 1)
 
 	//todo check if we need Host and Port
-	uc.addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+	uc.addr, err = net.ResolveUDPAddr("udp", JoinEndpoint(host, port))
 	if err != nil {
 		return err
 	}
-	uc.conn, err = net.ListenUDP("udp", uc.addr)
+	conns, err := uc.open(uc.addr)
 	if err != nil {
 		return err
 	}
-	uc.disposed = false
+	uc.connLock.Lock()
+	uc.conn = conns[0]
+	uc.connLock.Unlock()
+	uc.setReceivers(conns[1:])
+	atomic.StoreUint32(&uc.disposed, 0)
 	return nil
 }
 
+// SetWorkers specifies how many sockets should receive packets. Kernel
+// spreads inbound traffic between sockets, so packets are processed on
+// several cores. Should be called before Init
+func (uc *PTPNet) SetWorkers(workers int) {
+	if workers > 1 && !reusePortSupported {
+		Log(WARNING, "Multiple receiving sockets are not supported on this platform. Using single socket")
+		workers = 1
+	}
+	uc.workers = workers
+}
+
+// open creates sockets listening on the address. Multiple sockets share
+// the same port with SO_REUSEPORT. Sockets are restricted to the device
+// and marked with DSCP set before
+func (uc *PTPNet) open(addr *net.UDPAddr) ([]*net.UDPConn, error) {
+	var conns []*net.UDPConn
+	if uc.workers <= 1 {
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	} else {
+		lc := net.ListenConfig{Control: reusePort}
+		for i := 0; i < uc.workers; i++ {
+			pc, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+			if err != nil {
+				closeAll(conns)
+				return nil, err
+			}
+			conn := pc.(*net.UDPConn)
+			if i == 0 {
+				// Other sockets should use port selected for the first one
+				addr = &net.UDPAddr{IP: addr.IP, Port: conn.LocalAddr().(*net.UDPAddr).Port, Zone: addr.Zone}
+			}
+			conns = append(conns, conn)
+		}
+	}
+	for _, conn := range conns {
+		if uc.device != "" {
+			if err := bindToDevice(conn, uc.device); err != nil {
+				closeAll(conns)
+				return nil, err
+			}
+		}
+		if uc.dscp != 0 {
+			if err := setTOS(conn, uc.dscp<<2); err != nil {
+				Log(WARNING, "Failed to set DSCP of a new socket: %v", err)
+			}
+		}
+	}
+	return conns, nil
+}
+
+func closeAll(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// setReceivers replaces additional sockets and starts receiving on new ones
+// if Listen was already called
+func (uc *PTPNet) setReceivers(conns []*net.UDPConn) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	for _, conn := range uc.receivers {
+		conn.Close()
+	}
+	uc.receivers = conns
+	if uc.callback != nil {
+		for _, conn := range conns {
+			uc.receive(conn)
+		}
+	}
+}
+
+func (uc *PTPNet) isReceiver(conn *net.UDPConn) bool {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	for _, c := range uc.receivers {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// receive reads packets from an additional socket until it is replaced
+func (uc *PTPNet) receive(conn *net.UDPConn) {
+	callback := uc.callback
+	go func() {
+		if uc.Recover != nil {
+			defer uc.Recover()
+		}
+		buf := make([]byte, len(uc.input_buffer))
+		for !uc.Disposed() {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil && !uc.isReceiver(conn) {
+				return
+			}
+			callback(n, src, err, buf)
+		}
+	}()
+}
+
+// InitRange starts listening on a port from the range between min and max.
+// Requested port is tried first, other ports are tried in random order
+func (uc *PTPNet) InitRange(host string, port, min, max int) error {
+	var err error
+	if port >= min && port <= max {
+		err = uc.Init(host, port)
+		if err == nil {
+			return nil
+		}
+		Log(WARNING, "Can't use port %d: %v", port, err)
+	}
+	for _, candidate := range shufflePorts(min, max, port) {
+		err = uc.Init(host, candidate)
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("No free ports in range %d-%d: %v", min, max, err))
+}
+
+// Rebind opens a socket on another port from the range and replaces the
+// current one. Listen() will continue on a new socket
+func (uc *PTPNet) Rebind(current, min, max int) error {
+	for _, candidate := range shufflePorts(min, max, current) {
+		addr, err := net.ResolveUDPAddr("udp", JoinEndpoint(uc.host, candidate))
+		if err != nil {
+			return err
+		}
+		conns, err := uc.open(addr)
+		if err != nil {
+			continue
+		}
+		uc.connLock.Lock()
+		old := uc.conn
+		uc.addr = addr
+		uc.port = candidate
+		uc.conn = conns[0]
+		uc.connLock.Unlock()
+		old.Close()
+		uc.setReceivers(conns[1:])
+		return nil
+	}
+	return errors.New(fmt.Sprintf("No free ports in range %d-%d", min, max))
+}
+
+// ParsePortRange extracts bounds from a range in a form of START-END
+func ParsePortRange(ports string) (int, int, error) {
+	parts := strings.Split(ports, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Range should be specified as START-END")
+	}
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, errors.New(fmt.Sprintf("Bad range %d-%d", min, max))
+	}
+	return min, max, nil
+}
+
+// shufflePorts returns every port in range except the skipped one in random order
+func shufflePorts(min, max, skip int) []int {
+	var ports []int
+	for _, i := range rand.Perm(max - min + 1) {
+		if min+i != skip {
+			ports = append(ports, min+i)
+		}
+	}
+	return ports
+}
+
+// BindToDevice restricts sockets to send and receive packets only through
+// specified network interface. Sockets opened by Rebind are restricted too.
+// Not every platform supports this
+func (uc *PTPNet) BindToDevice(device string) error {
+	uc.device = device
+	return uc.eachSocket(func(conn *net.UDPConn) error { return bindToDevice(conn, device) })
+}
+
+// SetDSCP marks outgoing packets with specified DSCP value, so QoS
+// policies of the physical network can be applied to p2p traffic
+func (uc *PTPNet) SetDSCP(dscp int) error {
+	uc.dscp = dscp
+	return uc.eachSocket(func(conn *net.UDPConn) error { return setTOS(conn, dscp<<2) })
+}
+
+// eachSocket applies an option to the socket and additional receivers
+func (uc *PTPNet) eachSocket(apply func(conn *net.UDPConn) error) error {
+	if err := apply(uc.socket()); err != nil {
+		return err
+	}
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	for _, conn := range uc.receivers {
+		if err := apply(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseDSCP accepts DSCP value as a number or as a name of a class
+func ParseDSCP(value string) (int, error) {
+	if dscp, exists := DSCP_CLASSES[strings.ToUpper(value)]; exists {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Unknown DSCP class %s", value))
+	}
+	if dscp < 0 || dscp > 63 {
+		return 0, errors.New(fmt.Sprintf("DSCP value %d is out of range 0-63", dscp))
+	}
+	return dscp, nil
+}
+
 func (uc *PTPNet) GetPort() int {
-	addr, _ := net.ResolveUDPAddr("udp", uc.conn.LocalAddr().String())
+	addr, _ := net.ResolveUDPAddr("udp", uc.socket().LocalAddr().String())
 	return addr.Port
 }
 
 type UDPReceivedCallback func(count int, src_addr *net.UDPAddr, err error, buff []byte)
 
 func (uc *PTPNet) Listen(fn_received_callback UDPReceivedCallback) {
+	uc.lock.Lock()
+	uc.callback = fn_received_callback
+	for _, conn := range uc.receivers {
+		uc.receive(conn)
+	}
+	uc.lock.Unlock()
 	for !uc.Disposed() {
-		n, src, err := uc.conn.ReadFromUDP(uc.input_buffer[:])
+		n, src, err := uc.socket().ReadFromUDP(uc.input_buffer[:])
+		if err != nil && uc.Disposed() {
+			break
+		}
 		fn_received_callback(n, src, err, uc.input_buffer[:])
 	}
 	Log(INFO, "Stopping UDP Listener")
@@ -329,7 +601,7 @@ func (uc *PTPNet) Bind(addr *net.UDPAddr, local_addr *net.UDPAddr) {
 
 func (uc *PTPNet) SendMessage(msg *P2PMessage, dst_addr *net.UDPAddr) (int, error) {
 	ser_data := msg.Serialize()
-	n, err := uc.conn.WriteToUDP(ser_data, dst_addr)
+	n, err := uc.socket().WriteToUDP(ser_data, dst_addr)
 	if err != nil {
 		return 0, err
 	}
@@ -337,7 +609,7 @@ func (uc *PTPNet) SendMessage(msg *P2PMessage, dst_addr *net.UDPAddr) (int, erro
 }
 
 func (uc *PTPNet) SendRawBytes(bytes []byte, dst_addr *net.UDPAddr) (int, error) {
-	n, err := uc.conn.WriteToUDP(bytes, dst_addr)
+	n, err := uc.socket().WriteToUDP(bytes, dst_addr)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,57 @@
+package ptp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+const reusePortSupported = true
+
+// Socket may listen on every address and be restricted to an interface
+const bindDeviceSupported = true
+
+// bindToDevice sets SO_BINDTODEVICE option on a socket
+func bindToDevice(conn *net.UDPConn, device string) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// setTOS sets type of service field of outgoing IPv4 packets
+func setTOS(conn *net.UDPConn, tos int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// reusePort sets SO_REUSEPORT option, so several sockets can be bound to
+// the same port
+func reusePort(network, address string, raw syscall.RawConn) error {
+	var serr error
+	err := raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,100 @@
+package ptp
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReceiveWorkers(t *testing.T) {
+	uc := new(PTPNet)
+	uc.SetWorkers(4)
+	if err := uc.Init("127.0.0.1", 0); err != nil {
+		t.Skipf("Can't create UDP sockets: %v", err)
+	}
+	defer uc.Stop()
+	if len(uc.receivers) != 3 {
+		t.Fatalf("Expected 3 additional sockets, got %d", len(uc.receivers))
+	}
+	for _, conn := range uc.receivers {
+		if conn.LocalAddr().(*net.UDPAddr).Port != uc.GetPort() {
+			t.Errorf("Receiver listens on another port: %s", conn.LocalAddr())
+		}
+	}
+
+	var received int32
+	go uc.Listen(func(count int, src_addr *net.UDPAddr, err error, buf []byte) {
+		if err == nil && count > 0 {
+			atomic.AddInt32(&received, 1)
+		}
+	})
+	// Kernel selects socket by source address, so use several senders
+	for i := 0; i < 16; i++ {
+		sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: uc.GetPort()})
+		if err != nil {
+			t.Fatalf("Failed to create sender: %v", err)
+		}
+		sender.Write([]byte("packet"))
+		sender.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&received) < 16 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&received); n != 16 {
+		t.Errorf("Received %d of 16 packets", n)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	uc := new(PTPNet)
+	uc.SetWorkers(2)
+	if err := uc.InitRange("127.0.0.1", 0, 42000, 42100); err != nil {
+		t.Skipf("Can't create UDP sockets: %v", err)
+	}
+	defer uc.Stop()
+	if err := uc.BindToDevice("lo"); err != nil {
+		t.Skipf("Can't bind socket to device: %v", err)
+	}
+	var received int32
+	go uc.Listen(func(count int, src_addr *net.UDPAddr, err error, buf []byte) {
+		if err == nil && count > 0 {
+			atomic.AddInt32(&received, 1)
+		}
+	})
+	current := uc.GetPort()
+	if err := uc.Rebind(current, 42000, 42100); err != nil {
+		t.Fatalf("Failed to rebind: %v", err)
+	}
+	if uc.GetPort() == current || uc.Addr().Port != uc.GetPort() {
+		t.Errorf("Port wasn't changed: %d", uc.GetPort())
+	}
+	uc.lock.Lock()
+	sockets := append([]*net.UDPConn{uc.socket()}, uc.receivers...)
+	uc.lock.Unlock()
+	for _, conn := range sockets {
+		raw, _ := conn.SyscallConn()
+		var device string
+		raw.Control(func(fd uintptr) {
+			device, _ = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+		})
+		if device != "lo" {
+			t.Errorf("New socket isn't bound to device: %q", device)
+		}
+	}
+	sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: uc.GetPort()})
+	if err != nil {
+		t.Fatalf("Failed to create sender: %v", err)
+	}
+	defer sender.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&received) == 0 && time.Now().Before(deadline) {
+		sender.Write([]byte("packet"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&received) == 0 {
+		t.Errorf("Nothing was received on the new port")
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package ptp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// Socket is bound to a single address of an interface instead
+const bindDeviceSupported = false
+
+// bindToDevice is not supported on this platform. Socket is already bound
+// to the address of the interface, so we only report it
+func bindToDevice(conn *net.UDPConn, device string) error {
+	Log(WARNING, "Binding to a device is not supported on this platform. Using address of %s only", device)
+	return nil
+}
+
+// setTOS is not supported on this platform. Packets are sent unmarked
+func setTOS(conn *net.UDPConn, tos int) error {
+	Log(WARNING, "Marking of packets with DSCP is not supported on this platform")
+	return nil
+}
+
+// reusePort is not supported on this platform
+func reusePort(network, address string, raw syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
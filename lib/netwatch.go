@@ -0,0 +1,107 @@
+package ptp
+
+import (
+	"net"
+	"time"
+)
+
+// Addresses used to find out whether host has default route. Nothing is
+// sent to them: connecting UDP socket only looks up a route
+var routeProbes = []string{"198.51.100.1:9", "[2001:db8::1]:9"}
+
+// hasAddresses returns true when any interface that is up, except loopback
+// and ignored one, has an address other than link-local
+func hasAddresses(ignore string) bool {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		// Can't tell, so network is not considered lost
+		return true
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == ignore {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasRoute returns true when host has a route to any of the endpoints
+func hasRoute(endpoints []string) bool {
+	for _, endpoint := range endpoints {
+		conn, err := net.Dial("udp", endpoint)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkAvailable checks that host has an address other than loopback and
+// either a default route or a route to one of the routers. Interface of the
+// instance itself is ignored. Returns reason when network is unavailable
+func (p *PTPCloud) NetworkAvailable() (bool, string) {
+	if !hasAddresses(p.DeviceName) {
+		return false, "no addresses except loopback"
+	}
+	endpoints := append([]string{}, routeProbes...)
+	if p.Dht != nil {
+		for _, conn := range p.Dht.Connections() {
+			endpoints = append(endpoints, conn.RemoteAddr().String())
+		}
+	}
+	if !hasRoute(endpoints) {
+		return false, "no default route"
+	}
+	return true, ""
+}
+
+// WatchNetwork pauses instance when host loses connectivity and resumes it
+// when connectivity returns. It's called from the main loop of the instance
+func (p *PTPCloud) WatchNetwork() {
+	if time.Since(p.lastNetCheck) < NETWORK_CHECK_INTERVAL {
+		return
+	}
+	p.lastNetCheck = time.Now()
+	available, reason := p.NetworkAvailable()
+	if !available && !p.NoNetwork {
+		Log(WARNING, "Host has lost network connectivity: %s. Waiting for network", reason)
+		p.NoNetwork = true
+	} else if available && p.NoNetwork {
+		Log(INFO, "Network connectivity is back. Resuming instance")
+		p.ResumeNetwork()
+	}
+}
+
+// ResumeNetwork ends the pause. Routers and peers get a fresh timeout, so
+// they aren't considered dead for having been silent while network was down
+func (p *PTPCloud) ResumeNetwork() {
+	now := time.Now()
+	if p.Dht != nil {
+		p.Dht.LastDHTPing = now
+		p.Dht.StatsLock.Lock()
+		for _, conn := range p.Dht.Connections() {
+			p.Dht.routerStats(conn).LastPing = now
+		}
+		p.Dht.StatsLock.Unlock()
+	}
+	p.PeersLock.Lock()
+	for _, peer := range p.NetworkPeers {
+		peer.LastContact = now
+		peer.PingCount = 0
+		// Failures during the pause say nothing about the peer
+		peer.attemptSucceeded()
+	}
+	p.PeersLock.Unlock()
+	p.NoNetwork = false
+}
@@ -0,0 +1,42 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetworkPause(t *testing.T) {
+	p := &PTPCloud{NoNetwork: true, Dht: new(DHTClient)}
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	endpoint := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	peer := &NetworkPeer{ID: "peer", State: P_CONNECTED, Endpoint: endpoint, PingCount: 5}
+	p.NetworkPeers[peer.ID] = peer
+	if err := peer.StateConnected(p); err != nil || peer.State != P_CONNECTED {
+		t.Errorf("Peer was timed out while waiting for network: %v", err)
+	}
+	peer.Failures = 3
+	peer.RetryAt = time.Now().Add(time.Minute)
+	p.ResumeNetwork()
+	if p.NoNetwork {
+		t.Errorf("Instance is still paused")
+	}
+	if peer.PingCount != 0 || time.Since(peer.LastContact) > time.Second {
+		t.Errorf("Peer didn't get a fresh timeout")
+	}
+	if peer.Failures != 0 || !peer.RetryAt.IsZero() {
+		t.Errorf("Failures during the pause were kept")
+	}
+	if time.Since(p.Dht.LastDHTPing) > time.Second {
+		t.Errorf("Routers didn't get a fresh timeout")
+	}
+}
+
+func TestHasRoute(t *testing.T) {
+	if !hasRoute([]string{"127.0.0.1:9"}) {
+		t.Errorf("No route to loopback")
+	}
+	if hasRoute(nil) {
+		t.Errorf("Route found without endpoints")
+	}
+}
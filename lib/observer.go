@@ -0,0 +1,75 @@
+package ptp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Observer is a read-only mode of an instance. Observer joins the network,
+// connects to peers and learns topology like any member, but never
+// originates or forwards unicast data, so monitoring probes and
+// compliance observers can't reach production hosts. Broadcast and
+// multicast frames are still exchanged
+type Observer struct {
+	withheld uint64 // Unicast frames from the device that were not sent
+	ignored  uint64 // Frames from peers that were addressed to other hosts
+}
+
+// ValidateObserver rejects options that make other members send unicast
+// traffic to observer on their own
+func ValidateObserver(opts Options) error {
+	if !opts.Observer {
+		return nil
+	}
+	if opts.SplitDNS != "" || opts.Services != "" {
+		return errors.New("Observer can't push split-DNS rules or announce services")
+	}
+	if opts.Resolver != "" {
+		return errors.New("Observer can't forward DNS queries to peers")
+	}
+	return nil
+}
+
+// observerMaySend returns true if observer may send frame read from the
+// device. ARP requests never leave the host, since they are answered
+// locally
+func observerMaySend(frame []byte, proto int) bool {
+	if PacketType(proto) == PT_ARP {
+		return true
+	}
+	return len(frame) >= ETH_HEADER_SIZE && frame[0]&1 == 1
+}
+
+// observerAccepts returns true if frame received from a peer is
+// addressed to this host. Frames to other hosts are not forwarded
+func observerAccepts(frame []byte, mac []byte) bool {
+	if len(frame) < ETH_HEADER_SIZE {
+		return false
+	}
+	return frame[0]&1 == 1 || bytes.Equal(frame[0:6], mac)
+}
+
+// Outgoing returns false if frame read from the device is withheld
+func (o *Observer) Outgoing(frame []byte, proto int) bool {
+	if observerMaySend(frame, proto) {
+		return true
+	}
+	atomic.AddUint64(&o.withheld, 1)
+	return false
+}
+
+// Incoming returns false if frame received from a peer is ignored
+func (o *Observer) Incoming(frame []byte, mac []byte) bool {
+	if observerAccepts(frame, mac) {
+		return true
+	}
+	atomic.AddUint64(&o.ignored, 1)
+	return false
+}
+
+func (o *Observer) String() string {
+	return fmt.Sprintf("Observer mode: %d unicast frames withheld, %d frames to other hosts ignored",
+		atomic.LoadUint64(&o.withheld), atomic.LoadUint64(&o.ignored))
+}
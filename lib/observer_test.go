@@ -0,0 +1,43 @@
+package ptp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestObserver(t *testing.T) {
+	mac := []byte{0x06, 0, 0, 0, 0, 1}
+	unicast := ipv4Frame(IPPROTO_TCP, 40000, 22)
+	copy(unicast[0:6], []byte{0x06, 0, 0, 0, 0, 2})
+	broadcast := ipv4Frame(IPPROTO_UDP, 40000, 514)
+	copy(broadcast[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	local := ipv4Frame(IPPROTO_UDP, 40000, 514)
+	copy(local[0:6], mac)
+
+	o := new(Observer)
+	if o.Outgoing(unicast, int(PT_IPV4)) {
+		t.Errorf("Observer sent unicast frame")
+	}
+	if !o.Outgoing(broadcast, int(PT_IPV4)) || !o.Outgoing(unicast, int(PT_ARP)) {
+		t.Errorf("Observer withheld broadcast or ARP frame")
+	}
+	if o.Incoming(unicast, mac) {
+		t.Errorf("Observer accepted frame addressed to another host")
+	}
+	if !o.Incoming(broadcast, mac) || !o.Incoming(local, mac) {
+		t.Errorf("Observer ignored broadcast or its own frame")
+	}
+	if !strings.Contains(o.String(), "1 unicast frames withheld, 1 frames to other hosts ignored") {
+		t.Errorf("Wrong counters: %s", o)
+	}
+
+	if ValidateObserver(Options{Observer: true, Services: "web:80"}) == nil {
+		t.Errorf("Observer announcing services was accepted")
+	}
+	if ValidateObserver(Options{Observer: true, Resolver: "10.10.0.53"}) == nil {
+		t.Errorf("Observer forwarding DNS queries was accepted")
+	}
+	if ValidateObserver(Options{Services: "web:80"}) != nil || ValidateObserver(Options{Observer: true}) != nil {
+		t.Errorf("Valid options were rejected")
+	}
+}
@@ -0,0 +1,65 @@
+package ptp
+
+// Options describe an instance started with New. Daemon-wide settings,
+// like ACL or resource caps, are read from configuration file instead
+type Options struct {
+	IP      string // Address of the virtual interface in CIDR notation or "dhcp"
+	Mac     string // Hardware address of the interface. Generated if empty
+	Dev     string // Name of the interface. Generated if empty
+	Hash    string // Hash of the network to join
+	Routers string // Comma-separated list of DHT routers. Default routers are used if empty
+	Keyfile string // File with encryption keys
+	Key     string // Encryption key. Overrides keys from Keyfile
+	TTL     string // Lifetime of Key
+	Forward bool   // Connect to peers through forwarders only
+	Port    int    // UDP port. Random port is used if zero
+	Bind    string // Address or interface name the UDP socket is bound to
+	Ports   string // Range of UDP ports in a form of START-END
+	DSCP    string // DSCP value of outgoing packets
+	Tags    string // Comma-separated list of tags of this instance
+	Hubs    string // Peers that traffic is exchanged with in split-horizon mode
+
+	// Peers, specified by ID, IP or tag, that are always reached through
+	// forwarders, so endpoints are not exposed to each other
+	RelayOnly string
+	// Peers that are never reached through forwarders. Connection fails
+	// when there is no direct path
+	NoRelay string
+	// Peers that data is sent to over direct path and relay at once, so
+	// loss on one path is covered by the other at the cost of bandwidth
+	Redundant string
+	// Privacy mode: local addresses are not advertised to routers and
+	// every peer is reached through forwarders
+	Private bool
+	// Observer mode: instance receives traffic of the network, but never
+	// originates or forwards unicast data
+	Observer bool
+	// Split-DNS rules in a form of DOMAIN=RESOLVER[,DOMAIN=RESOLVER] that
+	// are pushed to other members. Instance with rules is a DNS provider
+	SplitDNS string
+	// Install split-DNS rules pushed by a DNS provider
+	AcceptDNS bool
+	// Resolvers in a form of IP[:PORT][,IP[:PORT]] that stub resolver on
+	// the virtual interface forwards queries to. First one should be a
+	// peer, others are fallbacks. Stub resolver is disabled if empty
+	Resolver string
+	// Services announced to other members in a form of
+	// NAME:PORT[/PROTO][,NAME:PORT[/PROTO]]
+	Services string
+	// What is done with frames of ethertypes other than IP and ARP:
+	// forward, drop or log. Frames are dropped if empty
+	EtherTypes string
+	// IP to MAC mapping saved before restart. ARP requests for these
+	// addresses are answered before peers introduce themselves
+	Neighbors []Neighbor
+	// Hex-encoded public key of network admin. Only peers listed in
+	// membership manifest signed by this key are accepted
+	Admin string
+	// File with identity of the instance. Default location is derived
+	// from hash, see IdentityPath
+	IdentityFile string
+
+	// Attempts to reach routers before New fails with ErrRouterUnreachable.
+	// Zero means retrying until routers become reachable
+	Attempts int
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	//"crypto/md5"
 	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -19,34 +23,144 @@ type MessageHandler func(message *P2PMessage, src_addr *net.UDPAddr)
 
 // Main structure
 type PTPCloud struct {
-	IP              string                               // Interface IP address
-	Mac             string                               // String representation of a MAC address
-	HardwareAddr    net.HardwareAddr                     // MAC address of network interface
-	Mask            string                               // Network mask in the dot-decimal notation
-	DeviceName      string                               // Name of the network interface
-	IPTool          string                               `yaml:"iptool"` // Network interface configuration tool
-	Device          *Interface                           // Network interface
-	NetworkPeers    map[string]*NetworkPeer              // Knows peers
-	UDPSocket       *PTPNet                              // Peer-to-peer interconnection socket
-	LocalIPs        []net.IP                             // List of IPs available in the system
-	Dht             *DHTClient                           // DHT Client
-	Crypter         Crypto                               // Instance of crypto
-	Shutdown        bool                                 // Set to true when instance in shutdown mode
-	Restart         bool                                 // Instance will be restarted
-	IPIDTable       map[string]string                    // Mapping for IP->ID
-	MACIDTable      map[string]string                    // Mapping for MAC->ID
-	ForwardMode     bool                                 // Skip local peer discovery
-	MessageHandlers map[uint16]MessageHandler            // Callbacks
-	ReadyToStop     bool                                 // Set to true when instance is ready to stop
-	PacketHandlers  map[PacketType]PacketHandlerCallback // Callbacks for network packet handlers
-	DHTPeerChannel  chan []PeerIP
-	ProxyChannel    chan Forwarder
-	RemovePeer      chan string
-	MessageBuffer   map[string]map[uint16]map[uint16][]byte
-	MessageLifetime map[string]map[uint16]time.Time
-	MessagePacket   map[string][]byte
-	BufferLock      sync.Mutex
-	PeersLock       sync.Mutex
+	IP               string                               // Interface IP address
+	Mac              string                               // String representation of a MAC address
+	HardwareAddr     net.HardwareAddr                     // MAC address of network interface
+	Mask             string                               // Network mask in the dot-decimal notation
+	DeviceName       string                               // Name of the network interface
+	IPTool           string                               `yaml:"iptool"`            // Network interface configuration tool
+	AdvertiseInclude []string                             `yaml:"advertise_include"` // Interfaces and networks allowed to be advertised
+	AdvertiseExclude []string                             `yaml:"advertise_exclude"` // Interfaces and networks that will never be advertised
+	Keepalive        int                                  `yaml:"keepalive"`         // Ping interval in seconds
+	KeepaliveIdle    int                                  `yaml:"keepalive_idle"`    // Ping interval in seconds for idle peers
+	Quorum           string                               `yaml:"dht_quorum"`        // Policy for conflicting responses of routers
+	MainlineDHT      bool                                 `yaml:"mainline_dht"`      // Discover members on public BitTorrent DHT
+	ReceiveWorkers   int                                  `yaml:"receive_workers"`   // Number of sockets receiving p2p traffic
+	ACL              []ACLRule                            `yaml:"acl"`               // Rules allowing traffic between tagged peers
+	ConfigTags       map[string][]string                  `yaml:"peer_tags"`         // Tags of peers by ID or IP. Override advertised tags
+	TrustTags        bool                                 `yaml:"trust_tags"`        // Use tags peers advertise even if nobody has confirmed them
+	MaxBuffers       int64                                `yaml:"max_buffers"`       // Kilobytes of packets processed at once by an instance
+	MaxGoroutines    int64                                `yaml:"max_goroutines"`    // Goroutines started by an instance
+	MaxBandwidth     int64                                `yaml:"max_bandwidth"`     // Kilobytes per second of data traffic of an instance
+	FenceDuplicates  bool                                 `yaml:"fence_duplicates"`  // Newer of two instances with the same identity is stopped
+	IgnoreHints      bool                                 `yaml:"ignore_hints"`      // Don't apply configuration hints of routers
+	PacingRate       int64                                `yaml:"pacing_rate"`       // Kilobytes per second sent to a single peer. Zero disables pacing
+	PacingBurst      int64                                `yaml:"pacing_burst"`      // Kilobytes sent to a peer without delay
+	EncryptDHT       bool                                 `yaml:"encrypt_dht"`       // Seal addresses and DHCP data sent to routers
+	MirrorConfig     MirrorConfig                         `yaml:"mirror"`            // Copying of decrypted frames to IDS
+	SkipHostSetup    bool                                 `yaml:"skip_host_setup"`   // Don't add firewall rule and routes for the instance
+	InterfaceMetric  int                                  `yaml:"interface_metric"`  // Metric of the virtual interface and its route. Zero for default
+	UseSandbox       bool                                 `yaml:"sandbox"`           // Parse messages from the network in a seccomp-restricted worker
+	FeatureRollout   map[string]int                       `yaml:"features"`          // Rollout percents of protocol features. Routers can't override them
+	QuotaConfig      QuotaConfig                          `yaml:"quota"`             // Daily and monthly limits of data exchanged by an instance
+	HistoryInterval  int                                  `yaml:"history_interval"`  // Seconds between samples of counters recorded into history. Zero disables history
+	JumboMTU         int                                  `yaml:"jumbo_mtu"`         // MTU used when every peer accepts jumbo frames. Zero disables jumbo frames
+	Isolation        IsolationConfig                      `yaml:"isolation"`         // Routes of the virtual network are kept in a table of their own
+	NATRules         []NATRule                            `yaml:"nat"`               // Networks behind peers that are reached through local aliases
+	WebhookConfig    []WebhookConfig                      `yaml:"webhooks"`          // HTTP endpoints notified when peers join, leave or fall back to relay
+	FilterConfig     []PeerFilterConfig                   `yaml:"peer_filters"`      // Protocols and ports allowed for semi-trusted peers
+	RelayConfig      CommunityRelayConfig                 `yaml:"community_relay"`   // Forwarding traffic of members while host has a public address
+	AuthHookConfig   AuthHookConfig                       `yaml:"auth_hook"`         // External command or HTTP endpoint deciding whether peers are admitted
+	RekeyAuthority   []string                             `yaml:"rekey_authorities"` // Public keys that may approve rotation of the network besides admin key
+	MainlineProbes   map[string]time.Time                 `yaml:"-"`                 // Addresses found on mainline DHT that were probed
+	PingInterval     time.Duration                        `yaml:"-"`                 // How often connected peers are pinged
+	IdlePingInterval time.Duration                        `yaml:"-"`                 // How often idle peers are pinged
+	Timers           *TimerWheel                          `yaml:"-"`                 // Timers shared by every peer
+	Device           TapDevice                            // Network interface
+	NetworkPeers     map[string]*NetworkPeer              // Knows peers
+	UDPSocket        *PTPNet                              // Peer-to-peer interconnection socket
+	LocalIPs         []net.IP                             // List of IPs available in the system
+	Dht              *DHTClient                           // DHT Client
+	Crypter          Crypto                               // Instance of crypto
+	Shutdown         bool                                 // Set to true when instance in shutdown mode
+	Restart          bool                                 // Instance will be restarted
+	IPIDTable        map[string]string                    // Mapping for IP->ID
+	MACIDTable       map[string]string                    // Mapping for MAC->ID
+	ForwardMode      bool                                 // Skip local peer discovery
+	MessageHandlers  map[uint16]MessageHandler            // Callbacks
+	ReadyToStop      bool                                 // Set to true when instance is ready to stop
+	PacketHandlers   map[PacketType]PacketHandlerCallback // Callbacks for network packet handlers
+	DHTPeerChannel   chan []PeerIP
+	ProxyChannel     chan Forwarder
+	RemovePeer       chan string
+	MessageBuffer    map[string]map[uint16]map[uint16][]byte
+	MessageLifetime  map[string]map[uint16]time.Time
+	MessagePacket    map[string][]byte
+	Registry         map[string][]Service `yaml:"-"`
+	Seeded           map[string]Neighbor  `yaml:"-"`
+	HandshakeLimit   *RateLimiter         `yaml:"-"` // Rate limiter for handshake packets
+	Identity         *Identity            `yaml:"-"` // Key pair of this instance
+	MinPort          int                  `yaml:"-"` // Lower bound of ports range
+	Offline          bool                 `yaml:"-"` // No router is reachable. Established connections are kept
+	Resync           bool                 `yaml:"-"` // Peers should be synchronized with the next list received from DHT
+	NoNetwork        bool                 `yaml:"-"` // Host has lost connectivity. Instance is paused until it returns
+	MaxPort          int                  `yaml:"-"` // Upper bound of ports range
+	Draining         bool                 `yaml:"-"` // Instance doesn't accept new peers before maintenance
+	DrainStarted     time.Time            `yaml:"-"` // When draining has started
+	Tags             []string             `yaml:"-"` // Tags of this instance advertised to peers
+	Hubs             []string             `yaml:"-"` // Split-horizon mode: peers this spoke may talk to
+	RelayOnly        []string             `yaml:"-"` // Peers that are reached through forwarders only
+	NoRelay          []string             `yaml:"-"` // Peers that are never reached through forwarders
+	Redundant        []string             `yaml:"-"` // Peers that data is sent to over direct path and relay at once
+	NAT              []NATMapping         `yaml:"-"` // Translation of networks behind peers to local aliases
+	Private          bool                 `yaml:"-"` // Privacy mode: local addresses are never advertised
+	Observer         *Observer            `yaml:"-"` // Observer mode: unicast data is never sent. Nil for regular members
+	IdentityFile     string               `yaml:"-"` // Where identity of the instance is stored
+	Mirror           *Mirror              `yaml:"-"` // Copies frames of selected peers to IDS
+	Webhooks         *Webhooks            `yaml:"-"` // Delivers peer events to HTTP endpoints
+	SplitDNS         []DNSRule            `yaml:"-"` // Split-DNS rules pushed to peers by this DNS provider
+	AcceptDNS        bool                 `yaml:"-"` // Split-DNS rules pushed by a peer are installed
+	DNSInstalled     []DNSRule            `yaml:"-"` // Split-DNS rules installed on this host
+	DNSProvider      string               `yaml:"-"` // Peer whose split-DNS rules are installed
+	Resolver         *Resolver            `yaml:"-"` // Stub resolver on the virtual interface. Nil if disabled
+	HostSetup        *HostSetup           `yaml:"-"` // Changes made to host firewall and routes. Nil if nothing was changed
+	Services         []Service            `yaml:"-"` // Services announced by this instance. Services of peers are in Registry
+	Started          time.Time            `yaml:"-"` // When instance was started
+	ClaimNonce       string               `yaml:"-"` // Distinguishes this instance from its duplicates
+	Conflict         string               `yaml:"-"` // Last detected duplicate of this instance
+	Fenced           bool                 `yaml:"-"` // Instance was stopped in favor of its duplicate
+	Stopped          *StopNotice          `yaml:"-"` // Last STOP with reason received from a router
+	MTU              int                  `yaml:"-"` // MTU suggested by routers. Zero if default is used
+	EtherPolicy      EtherPolicy          `yaml:"-"` // What is done with frames of ethertypes other than IP and ARP
+	EtherStats       *EtherStats          `yaml:"-"` // Frames seen on the device by ethertype
+	AdminKey         string               `yaml:"-"` // Key that signs membership manifest. Manifest is not enforced if empty
+	Manifest         *Manifest            `yaml:"-"` // Latest membership manifest. Nil until received
+	ManifestFile     string               `yaml:"-"` // Where manifest is saved. Not saved if empty
+	BufferLock       sync.Mutex
+	PeersLock        sync.Mutex
+	Traversal        *TraversalStats `yaml:"-"` // Outcomes of NAT traversal attempts
+	Resources        *Resources      `yaml:"-"` // Usage and caps of daemon resources
+	Writer           *DeviceWriter   `yaml:"-"` // Writes frames received from peers to Device in batches
+	Sandbox          *Sandbox        `yaml:"-"` // Worker parsing messages from the network. Nil if sandbox is disabled
+	Features         *FeatureFlags   `yaml:"-"` // Rollout of protocol features
+	History          *History        `yaml:"-"` // Counters recorded at intervals. Nil if history is disabled
+	Jumbo            bool            `yaml:"-"` // Interface uses jumbo MTU
+	Filters          []*PeerFilter   `yaml:"-"` // Protocols and ports allowed for selected peers
+	Community        *CommunityRelay `yaml:"-"` // Forwards traffic of members. Nil unless enabled in config file
+	Events           *EventLog       `yaml:"-"` // Recent peer events
+	Liveness         *Liveness       `yaml:"-"` // Peers other members can't reach
+	Admission        *PeerAdmission  `yaml:"-"` // Decisions of authentication hook. Nil if hook isn't configured
+	crash            *CrashReport    // First panic that happened in the instance
+	crashLock        sync.Mutex
+	punches          map[string]*PunchAttempt // Hole punching attempts by peer ID
+	punchLock        sync.Mutex
+	lastClaim        time.Time // When claim was sent last time
+	lastNetCheck     time.Time // When network connectivity was checked last time
+	lastDNSPush      time.Time // When split-DNS rules were pushed last time
+	dnsLock          sync.Mutex
+	lastServicePush  time.Time // When services were announced last time
+	serviceLock      sync.Mutex
+	manifestLock     sync.Mutex
+	controls         map[string]*ControlChannel // Control channels by peer ID
+	controlHandlers  map[string]ControlHandler
+	controlLock      sync.Mutex
+	pendingRekey     *RekeyAnnouncement // Rotation of the network waiting for its time
+	rekeyLock        sync.Mutex
+	crypterLock      sync.RWMutex         // Guards keys of Crypter once instance is running
+	identities       map[string]string    // Identity keys peers have signed introductions with. Kept after peers are removed
+	introStamps      map[string]time.Time // Latest stamps of introductions of peers that stamp them
+	identityLock     sync.Mutex
+	filterLock       sync.Mutex
 }
 
 // Creates TUN/TAP Interface and configures it with provided IP tool
@@ -58,38 +172,64 @@ func (p *PTPCloud) AssignInterface(ip, mac, mask, device string) error {
 	p.Mask = mask
 	p.DeviceName = device
 
-	// Extract necessary information from config file
-	// TODO: Remove hard-coded path
-	yamlFile, err := ioutil.ReadFile(CONFIG_DIR + "/p2p/config.yaml")
-	if err != nil {
-		Log(WARNING, "Failed to load config: %v", err)
-		p.IPTool = "/sbin/ip"
-	}
-	err = yaml.Unmarshal(yamlFile, p)
-	if err != nil {
-		Log(ERROR, "Failed to parse config: %v", err)
-		return err
-	}
-
-	p.Device, err = Open(p.DeviceName, DevTap)
-	if p.Device == nil {
+	dev, err := Open(p.DeviceName, DevTap)
+	if dev == nil {
 		Log(ERROR, "Failed to open TAP device %s: %v", device, err)
 		return err
 	} else {
 		Log(INFO, "%v TAP Device created", p.DeviceName)
 	}
 
+	p.Device = dev
+	p.Writer = NewDeviceWriter(dev)
+	p.Writer.Start()
 	// Windows returns a real mac here. However, other systems should return empty string
-	mac = ExtractMacFromInterface(p.Device)
+	mac = ExtractMacFromInterface(dev)
 	if mac != "" {
 		p.Mac = mac
 		p.HardwareAddr, _ = net.ParseMAC(mac)
 	}
 
-	err = ConfigureInterface(p.Device, p.IP, p.Mac, p.DeviceName, p.IPTool)
+	err = ConfigureInterface(dev, p.IP, p.Mac, p.DeviceName, p.IPTool)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Extracts necessary information from config file
+func (p *PTPCloud) ReadConfig() error {
+	// TODO: Remove hard-coded path
+	yamlFile, err := ioutil.ReadFile(CONFIG_DIR + "/p2p/config.yaml")
+	if err != nil {
+		Log(WARNING, "Failed to load config: %v", err)
+		p.IPTool = "/sbin/ip"
+	}
+	err = yaml.Unmarshal(yamlFile, p)
 	if err != nil {
+		Log(ERROR, "Failed to parse config: %v", err)
 		return err
 	}
+	if p.AdvertiseExclude == nil {
+		p.AdvertiseExclude = DEFAULT_ADVERTISE_EXCLUDE
+	}
+	p.PingInterval = PEER_PING_TIMEOUT
+	if p.Keepalive > 0 {
+		p.PingInterval = time.Duration(p.Keepalive) * time.Second
+	}
+	p.IdlePingInterval = PEER_IDLE_PING_TIMEOUT
+	if p.KeepaliveIdle > 0 {
+		p.IdlePingInterval = time.Duration(p.KeepaliveIdle) * time.Second
+	}
+	switch p.Quorum {
+	case "":
+		p.Quorum = QUORUM_UNION
+	case QUORUM_UNION, QUORUM_INTERSECTION, QUORUM_MAJORITY:
+	default:
+		Log(WARNING, "Unknown quorum policy %s. Using %s", p.Quorum, QUORUM_UNION)
+		p.Quorum = QUORUM_UNION
+	}
+	p.checkACL()
 	return nil
 }
 
@@ -107,12 +247,24 @@ func (p *PTPCloud) ListenInterface() {
 		packet, err := p.Device.ReadPacket()
 		if err != nil {
 			Log(ERROR, "Reading packet %s", err)
+			continue
 		}
 		if packet.Truncated {
 			Log(DEBUG, "Truncated packet")
 		}
+		size := len(packet.Packet)
+		if !p.Resources.CanSpawn() || !p.Resources.AcquireBuffer(size) {
+			Log(TRACE, "Resource limit reached. Dropping packet")
+			continue
+		}
 		// TODO: Make handlePacket as a part of PTPCloud
-		go p.handlePacket(packet.Packet, packet.Protocol)
+		p.Go(func() {
+			defer p.Resources.ReleaseBuffer(size)
+			p.handlePacket(packet.Packet, packet.Protocol)
+		})
+	}
+	if p.Writer != nil {
+		p.Writer.Close()
 	}
 	p.Device.Close()
 	Log(INFO, "Shutting down interface listener")
@@ -157,12 +309,18 @@ func (p *PTPCloud) IsIPv4(ip string) bool {
 // This method lists interfaces available in the system and retrieves their
 // IP addresses
 func (p *PTPCloud) FindNetworkAddresses() {
+	if p.Private {
+		return
+	}
 	Log(INFO, "Looking for available network interfaces")
 	inf, err := net.Interfaces()
 	if err != nil {
 		Log(ERROR, "Failed to retrieve list of network interfaces")
 		return
 	}
+	// IPv6 addresses are advertised only by hosts without IPv4, so peers
+	// don't waste time on family they might not have
+	var ipv6 []net.IP
 	for _, i := range inf {
 		addresses, err := i.Addrs()
 
@@ -191,8 +349,12 @@ func (p *PTPCloud) FindNetworkAddresses() {
 			} else if ip.IsInterfaceLocalMulticast() {
 				ipType = "Interface Local Multicast"
 			}
-			if !p.IsIPv4(ip.String()) {
-				decision = "No IPv4"
+			if decision == "Saving" && !p.IsAdvertised(i.Name, ip) {
+				decision = "Excluded by policy"
+			}
+			if decision == "Saving" && !p.IsIPv4(ip.String()) {
+				decision = "Saving if there is no IPv4"
+				ipv6 = append(ipv6, ip)
 			}
 			Log(INFO, "Interface %s: %s. Type: %s. %s", i.Name, addr.String(), ipType, decision)
 			if decision == "Saving" {
@@ -200,23 +362,131 @@ func (p *PTPCloud) FindNetworkAddresses() {
 			}
 		}
 	}
+	if len(p.LocalIPs) == 0 && len(ipv6) > 0 {
+		Log(INFO, "No IPv4 addresses were found. Advertising IPv6 addresses")
+		p.LocalIPs = ipv6
+	}
 	Log(INFO, "%d interfaces were saved", len(p.LocalIPs))
 }
 
-func StartP2PInstance(argIp, argMac, argDev, argDirect, argHash, argDht, argKeyfile, argKey, argTTL, argLog string, fwd bool, port int) *PTPCloud {
+// ResolveBindAddress returns IP addresses that p2p socket may use and a
+// name of the interface if it was specified instead of address. Every
+// usable address of the interface is returned, IPv4 addresses first
+func ResolveBindAddress(bind string) ([]net.IP, string, error) {
+	if bind == "" {
+		return nil, "", nil
+	}
+	ip := net.ParseIP(bind)
+	if ip != nil {
+		return []net.IP{ip}, "", nil
+	}
+	inf, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, "", err
+	}
+	addresses, err := inf.Addrs()
+	if err != nil {
+		return nil, "", err
+	}
+	var ipv4, ipv6 []net.IP
+	for _, addr := range addresses {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	if len(ipv4)+len(ipv6) == 0 {
+		return nil, "", errors.New(fmt.Sprintf("Interface %s has no usable address", bind))
+	}
+	return append(ipv4, ipv6...), inf.Name, nil
+}
+
+// IsAdvertised checks address against advertise_include and advertise_exclude
+// lists. Every entry in these lists is either a network in CIDR notation or a
+// pattern for an interface name, like "docker*"
+func (p *PTPCloud) IsAdvertised(name string, ip net.IP) bool {
+	if len(p.AdvertiseInclude) > 0 && !MatchAddressPolicy(name, ip, p.AdvertiseInclude) {
+		return false
+	}
+	if MatchAddressPolicy(name, ip, p.AdvertiseExclude) {
+		return false
+	}
+	return true
+}
+
+// MatchAddressPolicy returns true if interface name or IP matches
+// any of the provided patterns
+func MatchAddressPolicy(name string, ip net.IP, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			if err != nil {
+				Log(WARNING, "Bad network in address policy: %s", pattern)
+				continue
+			}
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			Log(WARNING, "Bad interface pattern in address policy: %s", pattern)
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// StartP2PInstance is kept for compatibility. Use New instead
+func StartP2PInstance(argIp, argMac, argDev, argDirect, argHash, argDht, argKeyfile, argKey, argTTL, argLog string, fwd bool, port int, bind, ports, dscp, tags, hubs string) *PTPCloud {
+	p, err := New(Options{
+		IP:      argIp,
+		Mac:     argMac,
+		Dev:     argDev,
+		Hash:    argHash,
+		Routers: argDht,
+		Keyfile: argKeyfile,
+		Key:     argKey,
+		TTL:     argTTL,
+		Forward: fwd,
+		Port:    port,
+		Bind:    bind,
+		Ports:   ports,
+		DSCP:    dscp,
+		Tags:    tags,
+		Hubs:    hubs,
+	})
+	if err != nil {
+		Log(ERROR, "%v", err)
+	}
+	return p
+}
+
+// New creates and starts an instance with specified options. Instance
+// joins the network, configures virtual interface and starts to exchange
+// traffic with peers. Errors wrap one of Err* values when cause is known
+func New(opts Options) (*PTPCloud, error) {
 
 	var hw net.HardwareAddr
 
-	if argMac != "" {
+	if opts.Mac != "" {
 		var err2 error
-		hw, err2 = net.ParseMAC(argMac)
+		hw, err2 = net.ParseMAC(opts.Mac)
 		if err2 != nil {
-			Log(ERROR, "Invalid MAC address provided: %v", err2)
-			return nil
+			return nil, errors.New(fmt.Sprintf("Invalid MAC address provided: %v", err2))
 		}
 	} else {
-		argMac, hw = GenerateMAC()
-		Log(INFO, "Generate MAC for TAP device: %s", argMac)
+		opts.Mac, hw = GenerateMAC()
+		Log(INFO, "Generate MAC for TAP device: %s", opts.Mac)
 	}
 
 	// Create new DHT Client, configured it and initialize
@@ -226,12 +496,54 @@ func StartP2PInstance(argIp, argMac, argDev, argDirect, argHash, argDht, argKeyf
 	/*
 		dhtClient := new(DHTClient)
 		config := dhtClient.DHTClientConfig()
-		config.NetworkHash = argHash
+		config.NetworkHash = opts.Hash
 		config.Mode = MODE_CLIENT
 	*/
 
 	p := new(PTPCloud)
+	// Everything started before a failure is released, so caller
+	// may retry without leaking ports, goroutines and devices
+	started := false
+	defer func() {
+		if !started {
+			p.Shutdown = true
+			p.releaseResources()
+			if p.Device != nil {
+				p.Device.Close()
+			}
+		}
+	}()
+	err := p.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckTool(p.IPTool); err != nil {
+		return nil, err
+	}
+	p.Features = NewFeatureFlags(p.FeatureRollout)
+	p.Private = opts.Private
+	if err := ValidateObserver(opts); err != nil {
+		return nil, err
+	}
+	if opts.Observer {
+		p.Observer = new(Observer)
+	}
 	p.FindNetworkAddresses()
+	bindIPs, bindDevice, err := ResolveBindAddress(opts.Bind)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Can't bind to %s: %v", opts.Bind, err))
+	}
+	var bindIP net.IP
+	if len(bindIPs) > 0 && (bindDevice == "" || !bindDeviceSupported) {
+		// Socket is bound to a single address of the interface. Otherwise
+		// it listens on every address and is restricted to the interface
+		bindIPs = bindIPs[:1]
+		bindIP = bindIPs[0]
+	}
+	if len(bindIPs) > 0 && !p.Private {
+		// Only bound addresses can be used by peers
+		p.LocalIPs = bindIPs
+	}
 	p.HardwareAddr = hw
 	p.NetworkPeers = make(map[string]*NetworkPeer)
 	p.IPIDTable = make(map[string]string)
@@ -239,34 +551,111 @@ func StartP2PInstance(argIp, argMac, argDev, argDirect, argHash, argDht, argKeyf
 	p.MessageBuffer = make(map[string]map[uint16]map[uint16][]byte)
 	p.MessageLifetime = make(map[string]map[uint16]time.Time)
 	p.MessagePacket = make(map[string][]byte)
+	p.HandshakeLimit = NewRateLimiter(HANDSHAKE_RATE_LIMIT, HANDSHAKE_RATE_BURST)
+	p.Timers = NewTimerWheel(TIMER_WHEEL_TICK, TIMER_WHEEL_SIZE)
+	p.Traversal = new(TraversalStats)
+	p.Resources = NewResources(p.MaxBuffers*1024, p.MaxGoroutines, p.MaxBandwidth*1024)
+	p.Resources.Quota, err = NewQuota(p.QuotaConfig, QuotaPath(opts.Hash))
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateJumboMTU(p.JumboMTU); err != nil {
+		return nil, err
+	}
+	if err := ValidateIsolation(p.Isolation); err != nil {
+		return nil, err
+	}
+	p.NAT, err = ParseNATRules(p.NATRules)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.loadFilters(); err != nil {
+		return nil, err
+	}
+	if p.HistoryInterval > 0 {
+		p.History, err = NewHistory(HistoryPath(opts.Hash), time.Duration(p.HistoryInterval)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.Started = time.Now()
+	p.ClaimNonce = NewClaimNonce()
+	p.Events = NewEventLog(EVENT_LOG_SIZE)
+	p.Liveness = NewLiveness()
+	p.Admission, err = NewPeerAdmission(p.AuthHookConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = p.StartMirror()
+	if err != nil {
+		return nil, err
+	}
+	err = p.StartWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	p.IdentityFile = opts.IdentityFile
+	if p.IdentityFile == "" {
+		p.IdentityFile = IdentityPath(opts.Hash)
+	}
+	identity, err := LoadOrCreateIdentity(p.IdentityFile)
+	if identity == nil {
+		return nil, errors.New(fmt.Sprintf("Failed to load identity: %v", err))
+	} else if err != nil {
+		// Instance works, but will get another ID after restart
+		Log(WARNING, "Failed to save identity: %v", err)
+	}
+	p.Identity = identity
+	err = p.SeedNeighbors(opts.Neighbors)
+	if err != nil {
+		Log(WARNING, "Saved neighbors are ignored: %v", err)
+	}
+	if opts.Admin != "" {
+		p.AdminKey, err = ParseAdminKey(opts.Admin)
+		if err != nil {
+			return nil, err
+		}
+		p.ManifestFile = ManifestPath(opts.Hash)
+		p.loadManifest(opts.Hash)
+	}
+	for i, key := range p.RekeyAuthority {
+		p.RekeyAuthority[i], err = ParseAdminKey(key)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad rotation authority %s: %v", key, err))
+		}
+	}
 
-	if fwd {
+	if opts.Forward {
+		p.ForwardMode = true
+	}
+	if p.Private {
+		// Peers found on mainline DHT are probed directly
+		Log(INFO, "Privacy mode: local addresses are not advertised, peers are reached through forwarders")
 		p.ForwardMode = true
+		p.MainlineDHT = false
 	}
 
-	if argDev == "" {
-		argDev = p.GenerateDeviceName(1)
+	if opts.Dev == "" {
+		opts.Dev = p.GenerateDeviceName(1)
 	} else {
-		if len(argDev) > 12 {
-			Log(INFO, "Interface name lenght should be 12 symbols max")
-			return nil
+		if len(opts.Dev) > 12 {
+			return nil, errors.New("Interface name lenght should be 12 symbols max")
 		}
 	}
-	if p.IsDeviceExists(argDev) {
-		Log(ERROR, "Interface is already in use. Can't create duplicate")
-		return nil
+	if p.IsDeviceExists(opts.Dev) {
+		return nil, errors.New("Interface is already in use. Can't create duplicate")
 	}
 
-	if argKeyfile != "" {
-		p.Crypter.ReadKeysFromFile(argKeyfile)
+	if opts.Keyfile != "" {
+		p.Crypter.ReadKeysFromFile(opts.Keyfile)
 	}
-	if argKey != "" {
+	if opts.Key != "" {
 		// Override key from file
-		if argTTL == "" {
-			argTTL = "default"
+		if opts.TTL == "" {
+			opts.TTL = "default"
 		}
 		var newKey CryptoKey
-		newKey = p.Crypter.EnrichKeyValues(newKey, argKey, argTTL)
+		newKey = p.Crypter.EnrichKeyValues(newKey, opts.Key, opts.TTL)
 		p.Crypter.Keys = append(p.Crypter.Keys, newKey)
 		p.Crypter.ActiveKey = p.Crypter.Keys[0]
 		p.Crypter.Active = true
@@ -288,6 +677,17 @@ func StartP2PInstance(argIp, argMac, argDev, argDirect, argHash, argDht, argKeyf
 	p.MessageHandlers[MT_PROXY] = p.HandleProxyMessage
 	p.MessageHandlers[MT_TEST] = p.HandleTestMessage
 	p.MessageHandlers[MT_BAD_TUN] = p.HandleBadTun
+	p.MessageHandlers[MT_PUNCH] = p.HandlePunchMessage
+	p.MessageHandlers[MT_DRAIN] = p.HandleDrainMessage
+	p.MessageHandlers[MT_FEEDBACK] = p.HandleFeedbackMessage
+	p.MessageHandlers[MT_DNS] = p.HandleDNSMessage
+	p.MessageHandlers[MT_SERVICES] = p.HandleServicesMessage
+	p.MessageHandlers[MT_MANIFEST] = p.HandleManifestMessage
+	p.MessageHandlers[MT_CONTROL] = p.HandleControlMessage
+	p.MessageHandlers[MT_PMTU] = p.HandlePMTUMessage
+	p.RegisterControlHandler(CONTROL_SERVICES, p.HandleServicesControl)
+	p.RegisterControlHandler(CONTROL_LIVENESS, p.HandleLivenessControl)
+	p.RegisterControlHandler(CONTROL_REKEY, p.HandleRekeyControl)
 
 	// Register packet handlers
 	p.PacketHandlers = make(map[PacketType]PacketHandlerCallback)
@@ -302,19 +702,95 @@ func StartP2PInstance(argIp, argMac, argDev, argDirect, argHash, argDht, argKeyf
 	p.PacketHandlers[PT_LLDP] = p.handlePacketLLDP
 
 	p.UDPSocket = new(PTPNet)
-	p.UDPSocket.Init("", port)
-	port = p.UDPSocket.GetPort()
-	Log(INFO, "Started UDP Listener at port %d", port)
+	p.UDPSocket.Recover = p.Recover
+	p.UDPSocket.SetWorkers(p.ReceiveWorkers)
+	var host string
+	if bindIP != nil {
+		host = bindIP.String()
+	}
+	if opts.Ports != "" {
+		p.MinPort, p.MaxPort, err = ParsePortRange(opts.Ports)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad ports range: %v", err))
+		}
+		err = p.UDPSocket.InitRange(host, opts.Port, p.MinPort, p.MaxPort)
+	} else {
+		err = p.UDPSocket.Init(host, opts.Port)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to start UDP Listener: %v", err))
+	}
+	if bindDevice != "" {
+		err = p.UDPSocket.BindToDevice(bindDevice)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to bind UDP Listener to %s: %v", bindDevice, err))
+		}
+	}
+	if opts.DSCP != "" {
+		value, err := ParseDSCP(opts.DSCP)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad DSCP value: %v", err))
+		}
+		err = p.UDPSocket.SetDSCP(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to set DSCP of UDP Listener: %v", err))
+		}
+	}
+	p.Tags, err = ParseTags(opts.Tags)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad tags: %v", err))
+	}
+	p.Hubs, err = ParseHubs(opts.Hubs)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad hubs: %v", err))
+	}
+	p.RelayOnly, err = ParseTags(opts.RelayOnly)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad list of relay-only peers: %v", err))
+	}
+	p.NoRelay, err = ParseTags(opts.NoRelay)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad list of no-relay peers: %v", err))
+	}
+	p.Redundant, err = ParseTags(opts.Redundant)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad list of redundant peers: %v", err))
+	}
+	p.SplitDNS, err = ParseDNSRules(opts.SplitDNS)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad split-DNS rules: %v", err))
+	}
+	p.AcceptDNS = opts.AcceptDNS
+	p.Services, err = ParseServices(opts.Services)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad list of services: %v", err))
+	}
+	p.EtherPolicy, err = ParseEtherPolicy(opts.EtherTypes)
+	if err != nil {
+		return nil, err
+	}
+	p.EtherStats = NewEtherStats()
+	if len(p.Hubs) > 0 {
+		Log(INFO, "Split-horizon mode: traffic is exchanged only with hubs %s", strings.Join(p.Hubs, ","))
+	}
+	if p.Observer != nil {
+		Log(INFO, "Observer mode: unicast data is neither sent nor forwarded")
+	}
+	opts.Port = p.UDPSocket.GetPort()
+	Log(INFO, "Started UDP Listener at port %d", opts.Port)
 	/*
-		config.P2PPort = port
-		if argDht != "" {
-			config.Routers = argDht
+		config.P2PPort = opts.Port
+		if opts.Routers != "" {
+			config.Routers = opts.Routers
 		}
 	*/
 	// TODO: Move channels inside DHT
-	p.DHTPeerChannel = make(chan []PeerIP)
-	p.ProxyChannel = make(chan Forwarder)
-	p.StartDHT(argHash, argDht)
+	p.DHTPeerChannel = make(chan []PeerIP, DHT_PEER_QUEUE_SIZE)
+	p.ProxyChannel = make(chan Forwarder, DHT_PROXY_QUEUE_SIZE)
+	err = p.StartDHT(opts.Hash, opts.Routers, opts.Attempts)
+	if err != nil {
+		return nil, err
+	}
 	/*
 			p.Dht = dhtClient.Initialize(config, p.LocalIPs, p.DHTPeerChannel, p.ProxyChannel)
 		for p.Dht == nil {
@@ -330,80 +806,124 @@ func StartP2PInstance(argIp, argMac, argDev, argDirect, argHash, argDht, argKeyf
 		}
 	*/
 	var retries int = 0
-	if argIp == "dhcp" {
+	if opts.IP == "dhcp" {
 		Log(INFO, "Requesting IP")
 		p.Dht.RequestIP()
 		time.Sleep(1 * time.Second)
-		for p.Dht.IP == nil && p.Dht.Network == nil {
+		ip, network := p.Dht.Lease()
+		for ip == nil && network == nil {
 			Log(INFO, "No IP were received. Requesting again")
 			p.Dht.RequestIP()
 			time.Sleep(3 * time.Second)
 			retries++
 			if retries >= 10 {
-				Log(ERROR, "Failed to retrieve IP from network after 10 retries")
-				return nil
+				return nil, errors.New("Failed to retrieve IP from network after 10 retries")
 			}
+			ip, network = p.Dht.Lease()
 		}
-		m := p.Dht.Network.Mask
+		m := network.Mask
 		mask := fmt.Sprintf("%d.%d.%d.%d", m[0], m[1], m[2], m[3])
-		p.AssignInterface(p.Dht.IP.String(), argMac, mask, argDev)
+		err = p.AssignInterface(ip.String(), opts.Mac, mask, opts.Dev)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Can't configure interface: %v", err))
+		}
 	} else {
-		ip, ipnet, err := net.ParseCIDR(argIp)
+		ip, ipnet, err := net.ParseCIDR(opts.IP)
 		if err != nil {
-			nip := net.ParseIP(argIp)
+			nip := net.ParseIP(opts.IP)
 			if nip == nil {
-				Log(ERROR, "Invalid address were provided for network interface. Use -ip \"dhcp\" or specify correct IP address")
-				return nil
+				return nil, errors.New("Invalid address were provided for network interface. Use -ip \"dhcp\" or specify correct IP address")
 			}
-			argIp += `/24`
+			opts.IP += `/24`
 			Log(WARNING, "No CIDR mask was provided. Assumming /24")
-			ip, ipnet, err = net.ParseCIDR(argIp)
+			ip, ipnet, err = net.ParseCIDR(opts.IP)
 			if err != nil {
-				Log(ERROR, "Failed to setup provided IP address for local device")
-				return nil
+				return nil, errors.New("Failed to setup provided IP address for local device")
 			}
 		}
-		p.Dht.IP = ip
-		p.Dht.Network = ipnet
+		p.Dht.SetLease(ip, ipnet)
 		mask := fmt.Sprintf("%d.%d.%d.%d", ipnet.Mask[0], ipnet.Mask[1], ipnet.Mask[2], ipnet.Mask[3])
-		p.Dht.SendIP(argIp, mask)
-		err = p.AssignInterface(p.Dht.IP.String(), argMac, mask, argDev)
+		p.Dht.SendIP(opts.IP, mask)
+		err = p.AssignInterface(p.Dht.IP.String(), opts.Mac, mask, opts.Dev)
 		if err != nil {
-			Log(ERROR, "Can't configure interface")
-			return nil
+			return nil, errors.New(fmt.Sprintf("Can't configure interface: %v", err))
 		}
 	}
 
-	go p.UDPSocket.Listen(p.HandleP2PMessage)
+	if p.UseSandbox {
+		p.Sandbox = NewSandbox(SandboxCommand)
+		if err := p.Sandbox.Start(); err != nil {
+			return nil, err
+		}
+	}
+	p.SetupHost()
+	if err := p.StartResolver(opts.Resolver); err != nil {
+		Log(ERROR, "Stub resolver is disabled: %v", err)
+	}
+	p.Go(p.Timers.Run)
+	p.Go(func() { p.UDPSocket.Listen(p.HandleP2PMessage) })
 
-	go p.ListenInterface()
-	return p
+	p.Go(p.ListenInterface)
+	started = true
+	return p, nil
 }
 
-func (p *PTPCloud) StartDHT(hash, routers string) {
+// StartDHT connects to routers. Zero attempts means retrying until
+// connected or instance is shut down
+func (p *PTPCloud) StartDHT(hash, routers string, attempts int) error {
 	dhtClient := new(DHTClient)
 	config := dhtClient.DHTClientConfig()
 	config.NetworkHash = hash
 	config.Mode = MODE_CLIENT
 	config.P2PPort = p.UDPSocket.GetPort()
+	config.Identity = p.Identity
+	config.Recover = p.Recover
+	config.Quorum = p.Quorum
+	config.PunchHandler = p.HandlePunchProposal
+	config.ClaimHandler = p.HandleClaim
+	config.HintsHandler = p.ApplyHints
+	config.StopHandler = p.HandleStopNotice
+	if p.EncryptDHT {
+		if crypter := p.CurrentCrypter(); crypter.Active {
+			config.Secret = DHTSecret(hash, crypter.ActiveKey.Key)
+		} else {
+			Log(WARNING, "DHT encryption requires network key. Addresses are sent to routers in the clear")
+		}
+	}
 	if routers != "" {
 		config.Routers = routers
 	}
-	p.Dht = dhtClient.Initialize(config, p.LocalIPs, p.DHTPeerChannel, p.ProxyChannel)
-	for p.Dht == nil {
+	if p.Dht != nil {
+		// Keep session data from previous connection
+		config.ResumeID = p.Dht.ResumeID
+		config.ResumeToken = p.Dht.ResumeToken
+		config.PreferredRelays = p.Dht.PreferredRelays
+	}
+	// Previous client is kept until the new one is connected, so
+	// established connections can still use it
+	dht := dhtClient.Initialize(config, p.LocalIPs, p.DHTPeerChannel, p.ProxyChannel)
+	for tries := 1; dht == nil; tries++ {
+		if p.Shutdown {
+			return ErrRouterUnreachable
+		}
+		if attempts > 0 && tries >= attempts {
+			return fmt.Errorf("%w: %s", ErrRouterUnreachable, config.Routers)
+		}
 		Log(WARNING, "Failed to connect to DHT. Retrying in 5 seconds")
 		time.Sleep(5 * time.Second)
 		p.LocalIPs = p.LocalIPs[:0]
 		p.FindNetworkAddresses()
-		p.Dht = dhtClient.Initialize(config, p.LocalIPs, p.DHTPeerChannel, p.ProxyChannel)
+		dht = dhtClient.Initialize(config, p.LocalIPs, p.DHTPeerChannel, p.ProxyChannel)
 	}
+	p.Dht = dht
 	Log(INFO, "ID assigned. Continue")
+	return nil
 }
 
 func (p *PTPCloud) Run() {
-	go p.ReadDHTPeers()
-	go p.ReadProxies()
-	go func() {
+	p.Go(p.ReadDHTPeers)
+	p.Go(p.ReadProxies)
+	p.Go(func() {
 		for {
 			if p.Shutdown {
 				break
@@ -428,8 +948,11 @@ func (p *PTPCloud) Run() {
 			}
 		}
 		Log(INFO, "Stopping peer state listener")
-	}()
-	go p.Dht.UpdatePeers()
+	})
+	p.Go(p.Dht.UpdatePeers)
+	if p.MainlineDHT {
+		p.Go(p.RunMainline)
+	}
 	for {
 		if p.Shutdown {
 			// TODO: Do it more safely
@@ -450,28 +973,138 @@ func (p *PTPCloud) Run() {
 				p.PeersLock.Lock()
 				delete(p.NetworkPeers, i)
 				p.PeersLock.Unlock()
+				p.dropControlChannel(i)
+				if p.Liveness != nil {
+					p.Liveness.Forget(i)
+				}
 				runtime.Gosched()
 			}
 		}
-		passed := time.Since(p.Dht.LastDHTPing)
-		interval := time.Duration(time.Second * 50)
-		if passed > interval {
-			Log(ERROR, "Lost connection to DHT")
-			p.Dht.Shutdown = true
-			p.Dht.ID = ""
-			hash := p.Dht.NetworkHash
-			routers := p.Dht.Routers
-			time.Sleep(time.Second * 5)
-			p.StartDHT(hash, routers)
-			go p.Dht.UpdatePeers()
+		if ann := p.DueRekey(); ann != nil {
+			err := p.ApplyRekey(ann)
+			if err != nil {
+				Log(ERROR, "Failed to rotate network: %v", err)
+			}
+		}
+		if p.Dht.PortConflict() {
+			err := p.ReselectPort()
+			if err != nil {
+				Log(ERROR, "Failed to change port: %v", err)
+			}
+		}
+		p.WatchNetwork()
+		if err := p.Resources.Quota.Save(false); err != nil {
+			Log(WARNING, "Failed to save transfer totals: %v", err)
+		}
+		p.RecordHistory()
+		if p.Offline || p.NoNetwork {
+			continue
+		}
+		p.PushDNS()
+		p.PushServices()
+		p.PromoteRelay()
+		p.RetransmitControl()
+		p.ProbePathMTU()
+		p.AdjustMTU()
+		if p.Dht.ID != "" && time.Since(p.lastClaim) > CLAIM_INTERVAL {
+			p.lastClaim = time.Now()
+			p.Dht.SendClaim(p.Claim())
+		}
+		dead := p.Dht.DeadRouters(DHT_PING_TIMEOUT)
+		if len(dead) > 0 && len(dead) < len(p.Dht.Connections()) {
+			// Other routers are still alive, so only dead ones are reconnected
+			for _, conn := range dead {
+				Log(WARNING, "Router %s doesn't respond", conn.RemoteAddr().String())
+				p.Dht.ReconnectRouter(conn)
+			}
+		} else if len(dead) > 0 || time.Since(p.Dht.LastDHTPing) > DHT_PING_TIMEOUT {
+			Log(ERROR, "Lost connection to DHT. Established connections are kept until it's restored")
+			p.Offline = true
+			p.Dht.halt()
+			p.Go(p.RestoreDHT)
 		}
 	}
 	Log(INFO, "Shutting down instance %s completed", p.Dht.NetworkHash)
 }
 
+// RestoreDHT reconnects to routers in background. Instance stays in
+// offline mode until at least one router becomes reachable
+func (p *PTPCloud) RestoreDHT() {
+	hash := p.Dht.NetworkHash
+	routers := p.Dht.Routers
+	time.Sleep(time.Second * 5)
+	for p.NoNetwork && !p.Shutdown {
+		time.Sleep(time.Second)
+	}
+	p.StartDHT(hash, routers, 0)
+	if p.Shutdown {
+		return
+	}
+	Log(INFO, "Connection to DHT restored")
+	p.Resync = true
+	p.Offline = false
+	p.Go(p.Dht.UpdatePeers)
+}
+
+// ResyncPeers disconnects peers that left the network while DHT
+// was unreachable
+func (p *PTPCloud) ResyncPeers(peers []PeerIP) {
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	for id, peer := range p.NetworkPeers {
+		found := false
+		for _, newPeer := range peers {
+			if newPeer.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found && peer.State != P_STOP {
+			Log(INFO, "Peer %s has left the network while DHT was unreachable", id)
+			peer.State = P_DISCONNECT
+		}
+	}
+}
+
+// ReselectPort moves p2p socket to another port from configured range and
+// sends a new handshake to DHT, so other peers will learn the new port
+func (p *PTPCloud) ReselectPort() error {
+	if p.MinPort == 0 {
+		return errors.New("No ports range was specified")
+	}
+	current := p.UDPSocket.GetPort()
+	err := p.UDPSocket.Rebind(current, p.MinPort, p.MaxPort)
+	if err != nil {
+		return err
+	}
+	port := p.UDPSocket.GetPort()
+	Log(INFO, "P2P port changed from %d to %d", current, port)
+	p.Dht.P2PPort = port
+	p.Dht.State = D_RECONNECTING
+	for _, conn := range p.Dht.Connections() {
+		err = p.Dht.Handshake(conn)
+		if err != nil {
+			Log(ERROR, "Failed to handshake after port change: %v", err)
+		}
+	}
+	return nil
+}
+
 func (p *PTPCloud) PrepareIntroductionMessage(id string) *P2PMessage {
 	var intro string = id + "," + p.Mac + "," + p.IP
-	msg := CreateIntroP2PMessage(p.Crypter, intro, 0)
+	// ID assigned by router that ignores identity keys isn't derived from
+	// ours, so peers would reject signature. Such introduction goes unsigned
+	if p.Identity != nil && p.Identity.ID == id {
+		// Sign introduction together with our capabilities, so peer can
+		// verify that ID belongs to us and nobody has stripped them
+		intro += "," + strings.Join(p.Capabilities(), CAP_SEPARATOR)
+		// Stamp is signed as well, so captured introduction can't be
+		// replayed later
+		intro += "," + strings.Join(p.Tags, TAG_SEPARATOR) + "," + p.Stamp()
+		signature := p.Identity.Sign([]byte(intro))
+		intro += "," + p.Identity.PublicKeyString() + "," + hex.EncodeToString(signature)
+	}
+	msg := CreateIntroP2PMessage(p.CurrentCrypter(), intro, 0)
 	return msg
 }
 
@@ -480,13 +1113,14 @@ func (p *PTPCloud) PrepareIntroductionMessage(id string) *P2PMessage {
 func (p *PTPCloud) PurgePeers() {
 	for i, peer := range p.NetworkPeers {
 		var f bool = false
-		for _, newPeer := range p.Dht.Peers {
+		for _, newPeer := range p.Dht.PeerList() {
 			if newPeer.ID == peer.ID {
 				f = true
 			}
 		}
 		if !f {
 			Log(INFO, ("Removing outdated peer"))
+			p.peerLeft(peer, "Peer has left the network")
 			delete(p.IPIDTable, peer.PeerLocalIP.String())
 			delete(p.MACIDTable, peer.PeerHW.String())
 			p.PeersLock.Lock()
@@ -554,7 +1188,7 @@ func GenerateMAC() (string, net.HardwareAddr) {
 
 func (p *PTPCloud) ParseIntroString(intro string) (string, net.HardwareAddr, net.IP) {
 	parts := strings.Split(intro, ",")
-	if len(parts) != 3 {
+	if len(parts) < 3 || len(parts) > 8 || len(parts) == 4 {
 		Log(ERROR, "Failed to parse introduction string: %s", intro)
 		return "", nil, nil
 	}
@@ -576,6 +1210,48 @@ func (p *PTPCloud) ParseIntroString(intro string) (string, net.HardwareAddr, net
 	return id, mac, ip
 }
 
+// VerifyIntroString checks that ID from the introduction string was derived
+// from the attached public key and signed by the owner of the private key.
+// Introductions from older peers come without a signature and are accepted
+func (p *PTPCloud) VerifyIntroString(intro string) bool {
+	parts := strings.Split(intro, ",")
+	if len(parts) == 3 {
+		// Legacy peers don't sign introductions, but a peer that has
+		// signed them once can't be impersonated with a stripped one
+		if p.KnownIdentity(parts[0]) != "" {
+			Log(WARNING, "Peer %s has signed its introductions before, but this one is not signed", parts[0])
+			return false
+		}
+		Log(DEBUG, "Peer %s didn't provide identity key", parts[0])
+		return true
+	}
+	if len(parts) < 5 || len(parts) > 8 {
+		return false
+	}
+	// Public key and signature are the last two fields
+	pub, err := hex.DecodeString(parts[len(parts)-2])
+	if err != nil {
+		return false
+	}
+	signature, err := hex.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return false
+	}
+	if !VerifyIdentity(parts[0], pub, []byte(strings.Join(parts[:len(parts)-2], ",")), signature) {
+		return false
+	}
+	if len(parts) < 8 {
+		// Peer that has stamped its introductions once can't be
+		// replayed with an older unstamped one
+		if !p.IntroStamp(parts[0]).IsZero() {
+			Log(WARNING, "Peer %s has stamped its introductions before, but this one is not stamped", parts[0])
+			return false
+		}
+		return true
+	}
+	return p.FreshIntro(parts[0], parts[5])
+}
+
 // Handler for new messages received from P2P network
 func (p *PTPCloud) HandleP2PMessage(count int, src_addr *net.UDPAddr, err error, rcv_bytes []byte) {
 	if err != nil {
@@ -583,19 +1259,38 @@ func (p *PTPCloud) HandleP2PMessage(count int, src_addr *net.UDPAddr, err error,
 		return
 	}
 
+	if !p.Resources.AcquireBuffer(count) {
+		Log(TRACE, "Buffer limit reached. Dropping message from %s", src_addr)
+		return
+	}
+	defer p.Resources.ReleaseBuffer(count)
 	buf := make([]byte, count)
 	copy(buf[:], rcv_bytes[:])
 
-	msg, des_err := P2PMessageFromBytes(buf)
+	var msg *P2PMessage
+	var des_err error
+	if p.Sandbox != nil {
+		msg, des_err = p.Sandbox.Parse(buf)
+	} else {
+		msg, des_err = P2PMessageFromBytes(buf)
+	}
 	if des_err != nil {
 		Log(ERROR, "P2PMessageFromBytes error: %v", des_err)
 		return
 	}
+	if p.relayMessage(msg, buf, src_addr) {
+		return
+	}
+	if p.HandshakeLimit != nil && p.IsHandshakeMessage(msg.Header.Type) && !p.HandshakeLimit.Allow(src_addr.IP.String()) {
+		Log(TRACE, "Handshake rate limit exceeded for %s", src_addr.String())
+		return
+	}
 	//var msgType MSG_TYPE = MSG_TYPE(msg.Header.Type)
 	// Decrypt message if crypter is active
-	if p.Crypter.Active && (msg.Header.Type == MT_INTRO || msg.Header.Type == MT_NENC || msg.Header.Type == MT_INTRO_REQ) {
+	crypter := p.CurrentCrypter()
+	if crypter.Active && (msg.Header.Type == MT_INTRO || msg.Header.Type == MT_NENC || msg.Header.Type == MT_INTRO_REQ || msg.Header.Type == MT_PUNCH || msg.Header.Type == MT_DRAIN || msg.Header.Type == MT_FEEDBACK || msg.Header.Type == MT_DNS || msg.Header.Type == MT_SERVICES || msg.Header.Type == MT_MANIFEST || msg.Header.Type == MT_CONTROL || msg.Header.Type == MT_PMTU) {
 		var dec_err error
-		msg.Data, dec_err = p.Crypter.Decrypt(p.Crypter.ActiveKey.Key, msg.Data)
+		msg.Data, dec_err = crypter.Decrypt(crypter.ActiveKey.Key, msg.Data)
 		if dec_err != nil {
 			Log(ERROR, "Failed to decrypt message")
 		}
@@ -609,6 +1304,16 @@ func (p *PTPCloud) HandleP2PMessage(count int, src_addr *net.UDPAddr, err error,
 	}
 }
 
+// IsHandshakeMessage returns true for message types that are used during
+// connection establishment and can arrive from any address
+func (p *PTPCloud) IsHandshakeMessage(t uint16) bool {
+	switch t {
+	case MT_INTRO, MT_INTRO_REQ, MT_TEST, MT_PROXY, MT_BAD_TUN, MT_PUNCH, MT_MANIFEST:
+		return true
+	}
+	return false
+}
+
 func (p *PTPCloud) HandleNotEncryptedMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
 	Log(TRACE, "Data: %s, Proto: %d, From: %s", msg.Data, msg.Header.NetProto, src_addr.String())
 	/*
@@ -620,7 +1325,41 @@ func (p *PTPCloud) HandleNotEncryptedMessage(msg *P2PMessage, src_addr *net.UDPA
 			Log(ERROR, "Packet sum mismatch")
 		}
 	*/
-	p.WriteToDevice(msg.Data, msg.Header.NetProto, false)
+	peer := p.FramePeer(msg.Data)
+	if peer != nil && msg.Header.Id == NENC_REDUNDANT && !p.peerDedup(peer).Accept(msg.Header.Seq) {
+		Log(TRACE, "Dropping copy of message %d from %s", msg.Header.Seq, src_addr)
+		return
+	}
+	if !p.Allowed(peer, msg.Data, false) {
+		Log(TRACE, "Frame from %s was dropped by ACL", src_addr)
+		return
+	}
+	if !p.Resources.Transfer(len(msg.Data)) {
+		Log(TRACE, "Bandwidth limit reached. Dropping frame from %s", src_addr)
+		return
+	}
+	if peer != nil {
+		// Received data proves that peer is alive, so it doesn't have
+		// to be pinged while traffic flows
+		now := time.Now()
+		peer.LastActivity = now
+		peer.LastReceived = now
+		peer.LastContact = now
+		peer.PingCount = 0
+		atomic.AddUint64(&peer.BytesRecv, uint64(len(msg.Data)))
+		if msg.Header.Id == NENC_SEQUENCED || msg.Header.Id == NENC_REDUNDANT {
+			p.countReceived(peer, msg.Header.Seq, now)
+		}
+	}
+	if p.Observer != nil && !p.Observer.Incoming(msg.Data, p.HardwareAddr) {
+		Log(TRACE, "Observer ignores frame from %s addressed to another host", src_addr)
+		return
+	}
+	if PacketType(msg.Header.NetProto) == PT_IPV4 {
+		p.TranslateIncoming(peer, msg.Data)
+	}
+	p.MirrorFrame(peer, msg.Data)
+	p.QueueToDevice(msg.Data, msg.Header.NetProto)
 	return
 	p.BufferLock.Lock()
 	// Allocate memory
@@ -723,6 +1462,10 @@ func (p *PTPCloud) HandleXpeerPingMessage(msg *P2PMessage, src_addr *net.UDPAddr
 		// Handle PING response
 		for i, peer := range p.NetworkPeers {
 			if peer.PeerHW.String() == string(msg.Data) {
+				if peer.PingCount > 0 {
+					peer.RTT = time.Since(peer.LastPing)
+					p.measureLatency(peer, peer.RTT)
+				}
 				peer.PingCount = 0
 				peer.LastContact = time.Now()
 				p.PeersLock.Lock()
@@ -737,34 +1480,84 @@ func (p *PTPCloud) HandleXpeerPingMessage(msg *P2PMessage, src_addr *net.UDPAddr
 func (p *PTPCloud) HandleIntroMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
 	Log(INFO, "Introduction string from %s[%d]", src_addr, msg.Header.ProxyId)
 	id, mac, ip := p.ParseIntroString(string(msg.Data))
+	if !p.VerifyIntroString(string(msg.Data)) {
+		Log(WARNING, "Introduction from %s has bad identity signature. Ignoring", id)
+		return
+	}
+	intro := ParseIntroduction(string(msg.Data))
+	if err := p.CheckMembership(intro); err != nil {
+		Log(WARNING, "Rejecting introduction of %s from %s: %v", id, src_addr, err)
+		return
+	}
 	p.PeersLock.Lock()
 	peer, exists := p.NetworkPeers[id]
 	p.PeersLock.Unlock()
 	runtime.Gosched()
-	if !exists {
+	// Members found on mainline DHT are accepted only with signed introduction
+	candidate := !exists && id != "" && id != p.Dht.ID && p.MainlineDHT && intro.Signed && p.IsMainlineCandidate(src_addr)
+	if !exists && !candidate {
 		Log(DEBUG, "Received introduction confirmation from unknown peer: %s", id)
 		p.Dht.SendUpdateRequest()
 		return
 	}
+	// Hook is asked only about peers that may join, so unknown hosts
+	// can't make it run
+	decision, err := p.CheckAdmission(intro, ip, src_addr)
+	if err != nil {
+		Log(WARNING, "Rejecting introduction of %s from %s: %v", id, src_addr, err)
+		return
+	}
+	if candidate {
+		p.AddMainlinePeer(intro, mac, ip, src_addr)
+		return
+	}
+	if err := p.CheckDowngrade(peer, intro); err != nil {
+		Log(WARNING, "Rejecting introduction of %s from %s: %v", id, src_addr, err)
+		peer.LastError = err.Error()
+		return
+	}
+	p.AcceptIntroduction(peer, intro)
+	peer.TagsConfirmed = decision != nil
+	if decision != nil && len(decision.Tags) > 0 {
+		peer.Tags = decision.Tags
+	}
 	peer.PeerHW = mac
 	peer.PeerLocalIP = ip
 	peer.State = P_CONNECTED
 	peer.LastContact = time.Now()
+	peer.attemptSucceeded()
 	p.PeersLock.Lock()
 	p.IPIDTable[ip.String()] = id
 	p.MACIDTable[mac.String()] = id
 	p.NetworkPeers[id] = peer
 	p.PeersLock.Unlock()
+	p.peerJoined(peer)
+	p.SendDNS(peer)
+	p.SendServices(peer)
+	p.SendManifest(peer)
 	runtime.Gosched()
 	Log(INFO, "Connection with peer %s has been established", id)
 }
 
 func (p *PTPCloud) HandleIntroRequestMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
 	id := string(msg.Data)
+	if p.Draining {
+		Log(DEBUG, "Instance is draining. Ignoring introduction request from %s", id)
+		return
+	}
 	p.PeersLock.Lock()
 	peer, exists := p.NetworkPeers[id]
 	p.PeersLock.Unlock()
 	runtime.Gosched()
+	if !exists && p.MainlineDHT && id != "" && id != p.Dht.ID {
+		// Peer may have found us on mainline DHT. Introduce ourselves
+		// and ask it to do the same
+		Log(DEBUG, "Introduction request came from unknown peer %s. Probing it", id)
+		response := p.PrepareIntroductionMessage(p.Dht.ID)
+		p.UDPSocket.SendMessage(response, src_addr)
+		p.ProbeMainlinePeer(src_addr)
+		return
+	}
 	if !exists {
 		Log(DEBUG, "Introduction request came from unknown peer: %s", id)
 		p.Dht.SendUpdateRequest()
@@ -780,7 +1573,12 @@ func (p *PTPCloud) HandleIntroRequestMessage(msg *P2PMessage, src_addr *net.UDPA
 
 func (p *PTPCloud) HandleProxyMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
 	// Proxy registration data
+	if msg.Header.ProxyId == PROXY_REQUEST {
+		p.HandleTunnelRequest(msg, src_addr)
+		return
+	}
 	if msg.Header.ProxyId < 1 {
+		p.HandleRelayBusy(msg, src_addr)
 		return
 	}
 	ip := string(msg.Data)
@@ -816,7 +1614,7 @@ func (p *PTPCloud) HandleBadTun(msg *P2PMessage, src_addr *net.UDPAddr) {
 }
 
 func (p *PTPCloud) HandleTestMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
-	response := CreateTestP2PMessage(p.Crypter, "TEST", 0)
+	response := CreateTestP2PMessage(p.CurrentCrypter(), "TEST", 0)
 	_, err := p.UDPSocket.SendMessage(response, src_addr)
 	if err != nil {
 		Log(ERROR, "Failed to respond to test message: %v", err)
@@ -831,18 +1629,119 @@ func (p *PTPCloud) SendTo(dst net.HardwareAddr, msg *P2PMessage) (int, error) {
 	if exists {
 		p.PeersLock.Lock()
 		peer, exists := p.NetworkPeers[id]
+		var pacer *Pacer
+		if exists {
+			pacer = p.peerPacer(peer)
+		}
 		p.PeersLock.Unlock()
 		runtime.Gosched()
 		if exists {
+			if msg.Header.Type == MT_NENC {
+				if !pacer.Wait(len(msg.Data)) {
+					Log(TRACE, "Pacing queue to %s is full. Dropping packet", peer.ID)
+					return 0, nil
+				}
+				msg.Header.Id = NENC_SEQUENCED
+				if peer.Backup != nil {
+					msg.Header.Id = NENC_REDUNDANT
+				}
+				msg.Header.Seq = uint16(atomic.AddUint32(&peer.SendSeq, 1))
+				peer.LastActivity = time.Now()
+			}
 			msg.Header.ProxyId = uint16(peer.ProxyID)
 			Log(DEBUG, "Sending to %s via proxy id %d", dst.String(), msg.Header.ProxyId)
 			size, err := p.UDPSocket.SendMessage(msg, peer.Endpoint)
+			if err == nil && msg.Header.Type == MT_NENC {
+				atomic.AddUint64(&peer.BytesSent, uint64(len(msg.Data)))
+			}
+			if msg.Header.Id == NENC_REDUNDANT {
+				p.sendRedundant(peer, msg)
+			}
 			return size, err
 		}
 	}
 	return 0, nil
 }
 
+// FramePeer returns a peer that sent provided ethernet frame
+func (p *PTPCloud) FramePeer(frame []byte) *NetworkPeer {
+	if len(frame) < 12 {
+		return nil
+	}
+	return p.MACPeer(net.HardwareAddr(frame[6:12]))
+}
+
+// MACPeer returns a peer with provided hardware address
+func (p *PTPCloud) MACPeer(mac net.HardwareAddr) *NetworkPeer {
+	id, exists := p.MACIDTable[mac.String()]
+	if !exists {
+		return nil
+	}
+	p.PeersLock.Lock()
+	peer := p.NetworkPeers[id]
+	p.PeersLock.Unlock()
+	return peer
+}
+
+// releaseResources stops instance services and rolls back changes made to
+// the host. Both StopInstance and Teardown use it, so nothing is left
+// behind by instance that has crashed. Every step is guarded, so one that
+// fails doesn't keep others from running
+func (p *PTPCloud) releaseResources() {
+	steps := []func(){
+		func() {
+			if p.Dht != nil {
+				p.Dht.Stop()
+			}
+		},
+		func() {
+			if p.UDPSocket != nil {
+				p.UDPSocket.Stop()
+			}
+		},
+		func() {
+			if p.Timers != nil {
+				p.Timers.Stop()
+			}
+		},
+		p.StopMirror,
+		p.StopWebhooks,
+		func() {
+			if p.Admission != nil {
+				Log(INFO, "%s", p.Admission.String())
+			}
+		},
+		p.RemoveDNS,
+		p.StopResolver,
+		p.RestoreHost,
+		func() {
+			if p.Sandbox != nil {
+				p.Sandbox.Close()
+			}
+		},
+		func() {
+			if err := p.Resources.Quota.Save(true); err != nil {
+				Log(WARNING, "Failed to save transfer totals: %v", err)
+			}
+		},
+		func() {
+			if p.Writer != nil {
+				p.Writer.Close()
+			}
+		},
+	}
+	for _, step := range steps {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					Log(WARNING, "Failed to release resources of the instance: %v", r)
+				}
+			}()
+			step()
+		}()
+	}
+}
+
 func (p *PTPCloud) StopInstance() {
 	for i, peer := range p.NetworkPeers {
 		peer.State = P_DISCONNECT
@@ -857,17 +1756,27 @@ func (p *PTPCloud) StopInstance() {
 	} else {
 		ip = p.Dht.Network.IP
 	}
-	p.Dht.Stop()
-	p.UDPSocket.Stop()
+	p.releaseResources()
 	p.Shutdown = true
+	// Wake up readers. Queues that are full wake them up anyway
 	var peers []PeerIP
 	var proxy Forwarder
-	p.DHTPeerChannel <- peers
-	p.ProxyChannel <- proxy
+	select {
+	case p.DHTPeerChannel <- peers:
+	default:
+	}
+	select {
+	case p.ProxyChannel <- proxy:
+	default:
+	}
 	Log(INFO, "Stopping P2P Message handler")
 	// Tricky part: we need to send a message to ourselves to quit blocking operation
-	msg := CreateTestP2PMessage(p.Crypter, "STOP", 1)
-	addr, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", p.Dht.P2PPort))
+	msg := CreateTestP2PMessage(p.CurrentCrypter(), "STOP", 1)
+	loopback := "127.0.0.1"
+	if p.Dht.IPv6Only {
+		loopback = "::1"
+	}
+	addr, _ := net.ResolveUDPAddr("udp", JoinEndpoint(loopback, p.Dht.P2PPort))
 	p.UDPSocket.SendMessage(msg, addr)
 	var ipIt int = 200
 	if ip != nil {
@@ -895,6 +1804,10 @@ func (p *PTPCloud) ReadDHTPeers() {
 			break
 		}
 		peers := <-p.DHTPeerChannel
+		if p.Resync && !p.Shutdown {
+			p.Resync = false
+			p.ResyncPeers(peers)
+		}
 		p.UpdatePeers(peers)
 	}
 	Log(INFO, "Stopped DHT reader channel")
@@ -938,6 +1851,10 @@ func (p *PTPCloud) UpdatePeers(peers []PeerIP) {
 				found = true
 			}
 		}
+		if !found && p.Draining {
+			Log(DEBUG, "Instance is draining. Ignoring new peer %s", newPeer.ID)
+			continue
+		}
 		if !found && newPeer.ID != p.Dht.ID {
 			peer := new(NetworkPeer)
 			peer.ID = newPeer.ID
@@ -947,7 +1864,7 @@ func (p *PTPCloud) UpdatePeers(peers []PeerIP) {
 			p.NetworkPeers[newPeer.ID] = peer
 			p.PeersLock.Unlock()
 			runtime.Gosched()
-			go p.NetworkPeers[newPeer.ID].Run(p)
+			p.Go(func() { peer.Run(p) })
 		}
 	}
 }
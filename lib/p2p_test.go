@@ -2,7 +2,12 @@ package ptp
 
 import (
 	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 func TestGenerateDeviceName(t *testing.T) {
@@ -13,6 +18,34 @@ func TestGenerateDeviceName(t *testing.T) {
 	}
 }
 
+func TestConfigKeys(t *testing.T) {
+	// Runtime fields are tagged out of config.yaml, so they neither take
+	// keys of config options nor can be set from config
+	keys := make(map[string]string)
+	fields := reflect.TypeOf((*PTPCloud)(nil)).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		f := fields.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if f.PkgPath != "" || key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(f.Name)
+		}
+		if other, exists := keys[key]; exists {
+			t.Errorf("Fields %s and %s take the same key %s", other, f.Name, key)
+		}
+		keys[key] = f.Name
+	}
+	p := new(PTPCloud)
+	if err := yaml.Unmarshal([]byte("iptool: /sbin/ip\nprivate: true\n"), p); err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if p.IPTool != "/sbin/ip" || p.Private {
+		t.Errorf("Config wasn't parsed or set runtime field: iptool %s, private %t", p.IPTool, p.Private)
+	}
+}
+
 func TestParseIntroString(t *testing.T) {
 	p := new(PTPCloud)
 	id, mac, ip := p.ParseIntroString("id,01:02:03:04:05:06,127.0.0.1")
@@ -48,3 +81,133 @@ func TestPrepareIntroductionMessage(t *testing.T) {
 		t.Errorf("Failed to create introduction message")
 	}
 }
+
+func TestIsAdvertised(t *testing.T) {
+	p := new(PTPCloud)
+	p.AdvertiseExclude = DEFAULT_ADVERTISE_EXCLUDE
+	if p.IsAdvertised("docker0", net.ParseIP("172.17.0.1")) {
+		t.Errorf("docker0 address should not be advertised")
+	}
+	if !p.IsAdvertised("eth0", net.ParseIP("192.168.1.10")) {
+		t.Errorf("eth0 address should be advertised")
+	}
+	p.AdvertiseInclude = []string{"10.0.0.0/8"}
+	if p.IsAdvertised("eth0", net.ParseIP("192.168.1.10")) {
+		t.Errorf("Address outside of included network was advertised")
+	}
+	if !p.IsAdvertised("eth1", net.ParseIP("10.1.2.3")) {
+		t.Errorf("Address of included network was not advertised")
+	}
+}
+
+func TestResolveBindAddress(t *testing.T) {
+	ips, device, err := ResolveBindAddress("2001:db8::10")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::10")) || device != "" {
+		t.Errorf("IPv6 address was resolved wrong: %v %s %v", ips, device, err)
+	}
+	ips, device, err = ResolveBindAddress("")
+	if err != nil || ips != nil || device != "" {
+		t.Errorf("Empty bind address was resolved to %v %s %v", ips, device, err)
+	}
+	// Loopback interface has no addresses that peers could use
+	if _, _, err := ResolveBindAddress("lo"); err == nil {
+		t.Errorf("Interface without usable addresses was accepted")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	min, max, err := ParsePortRange("30000-30010")
+	if err != nil || min != 30000 || max != 30010 {
+		t.Errorf("Failed to parse ports range: %d-%d %v", min, max, err)
+	}
+	for _, bad := range []string{"", "30000", "30010-30000", "0-10", "1-70000", "a-b"} {
+		_, _, err = ParsePortRange(bad)
+		if err == nil {
+			t.Errorf("Bad range was accepted: %s", bad)
+		}
+	}
+	ports := shufflePorts(30000, 30010, 30005)
+	if len(ports) != 10 {
+		t.Errorf("Wrong number of ports in range: %d", len(ports))
+	}
+	for _, port := range ports {
+		if port == 30005 || port < 30000 || port > 30010 {
+			t.Errorf("Bad port in shuffled range: %d", port)
+		}
+	}
+}
+
+func TestParseDSCP(t *testing.T) {
+	for value, expected := range map[string]int{"46": 46, "ef": 46, "AF41": 34, "CS0": 0, "63": 63} {
+		dscp, err := ParseDSCP(value)
+		if err != nil || dscp != expected {
+			t.Errorf("Failed to parse DSCP %s: %d %v", value, dscp, err)
+		}
+	}
+	for _, bad := range []string{"", "64", "-1", "AF44", "voice"} {
+		if _, err := ParseDSCP(bad); err == nil {
+			t.Errorf("Bad DSCP value was accepted: %s", bad)
+		}
+	}
+}
+
+func TestResyncPeers(t *testing.T) {
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.NetworkPeers["stayed"] = &NetworkPeer{ID: "stayed", State: P_CONNECTED}
+	p.NetworkPeers["left"] = &NetworkPeer{ID: "left", State: P_CONNECTED}
+	p.ResyncPeers([]PeerIP{{ID: "stayed"}, {ID: "new"}})
+	if p.NetworkPeers["stayed"].State != P_CONNECTED {
+		t.Errorf("Peer that stayed in the network was disconnected")
+	}
+	if p.NetworkPeers["left"].State != P_DISCONNECT {
+		t.Errorf("Peer that left the network was not disconnected")
+	}
+}
+
+func TestPassiveLiveness(t *testing.T) {
+	p := new(PTPCloud)
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.MACIDTable = make(map[string]string)
+	p.PingInterval = time.Second
+	p.IdlePingInterval = time.Second
+	p.HardwareAddr, _ = net.ParseMAC("01:02:03:04:05:06")
+	mac, _ := net.ParseMAC("06:05:04:03:02:01")
+	peer := &NetworkPeer{ID: "peer", PeerHW: mac, State: P_CONNECTED, PingCount: 2}
+	peer.Endpoint = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	peer.LastContact = time.Now().Add(-time.Minute)
+	p.NetworkPeers[peer.ID] = peer
+	p.MACIDTable[mac.String()] = peer.ID
+
+	frame := ipv4Frame(IPPROTO_UDP, 1000, 2000)
+	copy(frame[6:12], mac)
+	msg := &P2PMessage{Header: &P2PMessageHeader{Type: uint16(MT_NENC)}, Data: frame}
+	p.HandleNotEncryptedMessage(msg, peer.Endpoint)
+	if peer.PingCount != 0 || time.Since(peer.LastContact) > time.Second || peer.LastReceived.IsZero() {
+		t.Fatalf("Received data was not treated as proof of liveness")
+	}
+	peer.StateConnected(p)
+	if !peer.LastPing.IsZero() {
+		t.Errorf("Peer was pinged while traffic flows")
+	}
+}
+
+func TestWriteToFakeDevice(t *testing.T) {
+	p := new(PTPCloud)
+	tap := NewFakeTap()
+	p.Device = tap
+	p.WriteToDevice([]byte{1, 2, 3}, uint16(PT_IPV4), false)
+	written := tap.Written()
+	if len(written) != 1 || written[0].Protocol != int(PT_IPV4) || len(written[0].Packet) != 3 {
+		t.Errorf("Frame wasn't written to device: %v", written)
+	}
+	tap.Deliver([]byte{4, 5}, int(PT_ARP))
+	pkt, err := p.Device.ReadPacket()
+	if err != nil || pkt.Protocol != int(PT_ARP) {
+		t.Errorf("Failed to read delivered frame: %v", err)
+	}
+	tap.Close()
+	if _, err := p.Device.ReadPacket(); err == nil {
+		t.Errorf("Closed device should return an error")
+	}
+}
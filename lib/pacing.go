@@ -0,0 +1,110 @@
+package ptp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pacer spreads packets sent to a peer in time. Bursts up to Burst bytes
+// are sent immediately, the rest is delayed to match Rate, so routers with
+// small buffers don't drop the tail of the burst
+type Pacer struct {
+	Rate    int64 // Bytes per second
+	Burst   int64 // Bytes sent without delay
+	next    time.Time
+	sent    uint64
+	paced   uint64 // Packets that were delayed
+	dropped uint64 // Packets that would wait longer than PACING_MAX_DELAY
+	delay   time.Duration
+	lock    sync.Mutex
+}
+
+// NewPacer creates pacer with specified rate and burst in bytes
+func NewPacer(rate, burst int64) *Pacer {
+	return &Pacer{Rate: rate, Burst: burst}
+}
+
+// schedule reserves time for a packet and returns how long it should wait.
+// Returns false if packet should be dropped
+func (pc *Pacer) schedule(size int, now time.Time) (time.Duration, bool) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if pc.Rate <= 0 {
+		pc.sent++
+		return 0, true
+	}
+	if pc.next.Before(now) {
+		pc.next = now
+	}
+	burst := time.Duration(pc.Burst * int64(time.Second) / pc.Rate)
+	wait := pc.next.Sub(now) - burst
+	if wait > PACING_MAX_DELAY {
+		pc.dropped++
+		return 0, false
+	}
+	pc.next = pc.next.Add(time.Duration(int64(size) * int64(time.Second) / pc.Rate))
+	pc.sent++
+	if wait <= 0 {
+		return 0, true
+	}
+	pc.paced++
+	pc.delay += wait
+	return wait, true
+}
+
+// Wait blocks until packet of specified size can be sent. Returns false if
+// queue is too long and packet should be dropped
+func (pc *Pacer) Wait(size int) bool {
+	if pc == nil {
+		return true
+	}
+	wait, ok := pc.schedule(size, time.Now())
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return ok
+}
+
+// SetRate changes rate of the pacer
+func (pc *Pacer) SetRate(rate int64) {
+	pc.lock.Lock()
+	pc.Rate = rate
+	pc.lock.Unlock()
+}
+
+// GetRate returns current rate of the pacer
+func (pc *Pacer) GetRate() int64 {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return pc.Rate
+}
+
+// Stats returns number of sent, delayed and dropped packets and average delay
+func (pc *Pacer) Stats() (sent, paced, dropped uint64, delay time.Duration) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if pc.paced > 0 {
+		delay = pc.delay / time.Duration(pc.paced)
+	}
+	return pc.sent, pc.paced, pc.dropped, delay
+}
+
+func (pc *Pacer) String() string {
+	sent, paced, dropped, delay := pc.Stats()
+	return fmt.Sprintf("Pacing:%s/s Sent:%d Delayed:%d (avg %s) Dropped:%d",
+		FormatBytes(pc.GetRate()), sent, paced, delay, dropped)
+}
+
+// peerPacer returns pacer of the peer, creating it when pacing is enabled.
+// Should be called with PeersLock held
+func (p *PTPCloud) peerPacer(peer *NetworkPeer) *Pacer {
+	if peer.Pacer == nil && p.PacingRate > 0 {
+		burst := p.PacingBurst * 1024
+		if burst == 0 {
+			burst = PACING_DEFAULT_BURST
+		}
+		peer.Pacer = NewPacer(p.PacingRate*1024, burst)
+	}
+	return peer.Pacer
+}
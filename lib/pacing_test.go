@@ -0,0 +1,44 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	// 1000 bytes per second with burst of 2000 bytes
+	pc := NewPacer(1000, 2000)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if wait, ok := pc.schedule(1000, now); !ok || wait != 0 {
+			t.Errorf("Packet %d of the burst was delayed by %s", i, wait)
+		}
+	}
+	// Next 10ms are the limit of the queue: 10 bytes fit
+	if wait, ok := pc.schedule(5, now); !ok || wait != 0 {
+		t.Errorf("Packet after burst should be sent right away: %s", wait)
+	}
+	wait, ok := pc.schedule(5, now)
+	if !ok || wait != 5*time.Millisecond {
+		t.Errorf("Packet should be delayed by 5ms, got %s", wait)
+	}
+	if wait, ok := pc.schedule(1000, now); !ok || wait != PACING_MAX_DELAY {
+		t.Errorf("Packet should wait for the whole queue, got %s", wait)
+	}
+	if _, ok := pc.schedule(1, now); ok {
+		t.Errorf("Pacer should drop packets when queue is too long")
+	}
+	// Queue drains over time
+	if wait, ok := pc.schedule(100, now.Add(time.Minute)); !ok || wait != 0 {
+		t.Errorf("Idle pacer should send without delay")
+	}
+	sent, paced, dropped, delay := pc.Stats()
+	if paced == 0 || dropped != 1 || sent != paced+4 || delay == 0 {
+		t.Errorf("Wrong pacing stats: sent %d paced %d dropped %d delay %s", sent, paced, dropped, delay)
+	}
+
+	var disabled *Pacer
+	if !disabled.Wait(1500) {
+		t.Errorf("Missing pacer should never drop")
+	}
+}
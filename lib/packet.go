@@ -110,11 +110,15 @@ type ARPPacket struct {
 // packet within a subnet in which our application works.
 // This method calls appropriate gorouting for extracted packet protocol
 func (p *PTPCloud) handlePacket(contents []byte, proto int) {
+	if p.Observer != nil && !p.Observer.Outgoing(contents, proto) {
+		Log(TRACE, "Observer withholds unicast frame")
+		return
+	}
 	callback, exists := p.PacketHandlers[PacketType(proto)]
 	if exists {
 		callback(contents, proto)
 	} else {
-		Log(WARNING, "Captured undefined packet: %d", PacketType(proto))
+		p.handleEtherType(contents, proto)
 	}
 }
 
@@ -139,6 +143,21 @@ func (p *PTPCloud) handlePacketIPv4(contents []byte, proto int) {
 	if f.EtherType != ethernet.EtherTypeIPv4 {
 		return
 	}
+	peer := p.MACPeer(f.Destination)
+	if !p.Allowed(peer, contents, true) {
+		Log(TRACE, "Frame to %s was dropped by ACL", f.Destination)
+		return
+	}
+	if !p.FitsPath(peer, len(contents)) {
+		Log(TRACE, "Frame of %d bytes is too large for the path to %s. Dropping it", len(contents), f.Destination)
+		return
+	}
+	if !p.Resources.Transfer(len(contents)) {
+		Log(TRACE, "Bandwidth limit reached. Dropping frame to %s", f.Destination)
+		return
+	}
+	p.MirrorFrame(peer, contents)
+	p.TranslateOutgoing(peer, contents)
 	/*
 		// md5
 		sum := md5.Sum(contents)
@@ -146,7 +165,7 @@ func (p *PTPCloud) handlePacketIPv4(contents []byte, proto int) {
 		d = append(d, sum[:]...)
 		d = append(d, contents...)
 	*/
-	msg := CreateNencP2PMessage(p.Crypter, contents, uint16(proto), 1, 1, 1)
+	msg := CreateNencP2PMessage(p.CurrentCrypter(), contents, uint16(proto), 1, 1, 1)
 	p.SendTo(f.Destination, msg)
 	return
 	pid := uint16(0)
@@ -160,7 +179,7 @@ func (p *PTPCloud) handlePacketIPv4(contents []byte, proto int) {
 			complete = seq
 			shift = len(contents)
 		}
-		msg := CreateNencP2PMessage(p.Crypter, contents[0:shift], uint16(proto), complete, pid, seq)
+		msg := CreateNencP2PMessage(p.CurrentCrypter(), contents[0:shift], uint16(proto), complete, pid, seq)
 		msg.Header.NetProto = uint16(proto)
 		//SendLock.Lock()
 		_, err := p.SendTo(f.Destination, msg)
@@ -181,26 +200,31 @@ func (p *PTPCloud) handlePacketIPv6(contents []byte, proto int) {
 // TODO: Implement PARC Universal Support
 func (p *PTPCloud) handlePARCUniversalPacket(contents []byte, proto int) {
 	Log(TRACE, "Handling PARC Universal Packet")
+	p.handleEtherType(contents, proto)
 }
 
 // TODO: Implement RARP Support
 func (p *PTPCloud) handleRARPPacket(contents []byte, proto int) {
 	Log(TRACE, "Handling RARP Packet")
+	p.handleEtherType(contents, proto)
 }
 
 // TODO: Implement 802.1q Support
 func (p *PTPCloud) handle8021qPacket(contents []byte, proto int) {
 	Log(TRACE, "Handling 802.1q Packet")
+	p.handleEtherType(contents, proto)
 }
 
 // TODO: Implement PPPoE Discovery Support
 func (p *PTPCloud) handlePPPoEDiscoveryPacket(contents []byte, proto int) {
 	Log(TRACE, "Handling PPPoE Discovery Packet")
+	p.handleEtherType(contents, proto)
 }
 
 // TODO: Implement PPPoE Session Support
 func (p *PTPCloud) handlePPPoESessionPacket(contents []byte, proto int) {
 	Log(TRACE, "Handling PPPoE Session Packet")
+	p.handleEtherType(contents, proto)
 }
 
 func (p *PTPCloud) handlePacketARP(contents []byte, proto int) {
@@ -226,27 +250,36 @@ func (p *PTPCloud) handlePacketARP(contents []byte, proto int) {
 	var hwAddr net.HardwareAddr = nil
 	id, exists := p.IPIDTable[packet.TargetIP.String()]
 	if !exists {
-		Log(DEBUG, "Unknown IP requested")
-		return
-	}
-	peer, exists := p.NetworkPeers[id]
-	if !exists {
-		Log(DEBUG, "Specified ID was not found in peer list")
-		return
-	}
-	hwAddr = peer.PeerHW
-	// TODO: Put there normal IP from list of ips
-	// Send a reply
-	if hwAddr == nil {
-		Log(ERROR, "Cannot find hardware address for requested IP")
-		_, hwAddr = GenerateMAC()
-		peer.PeerHW = hwAddr
-		p.NetworkPeers[id] = peer
-	}
-	if hwAddr.String() == "00:00:00:00:00:00" {
-		_, hwAddr = GenerateMAC()
-		peer.PeerHW = hwAddr
-		p.NetworkPeers[id] = peer
+		hwAddr = p.seededMac(packet.TargetIP.String())
+		if hwAddr == nil {
+			Log(DEBUG, "Unknown IP requested")
+			return
+		}
+		Log(DEBUG, "Answering ARP request for %s from saved neighbors", packet.TargetIP.String())
+	} else {
+		peer, exists := p.NetworkPeers[id]
+		if !exists {
+			Log(DEBUG, "Specified ID was not found in peer list")
+			return
+		}
+		if !p.Reachable(peer) {
+			Log(TRACE, "Peer %s is not a hub. Ignoring ARP request", id)
+			return
+		}
+		hwAddr = peer.PeerHW
+		// TODO: Put there normal IP from list of ips
+		// Send a reply
+		if hwAddr == nil {
+			Log(ERROR, "Cannot find hardware address for requested IP")
+			_, hwAddr = GenerateMAC()
+			peer.PeerHW = hwAddr
+			p.NetworkPeers[id] = peer
+		}
+		if hwAddr.String() == "00:00:00:00:00:00" {
+			_, hwAddr = GenerateMAC()
+			peer.PeerHW = hwAddr
+			p.NetworkPeers[id] = peer
+		}
 	}
 	var reply ARPPacket
 	ip := net.ParseIP(packet.TargetIP.String())
@@ -278,6 +311,7 @@ func (p *PTPCloud) handlePacketARP(contents []byte, proto int) {
 
 func (p *PTPCloud) handlePacketLLDP(contents []byte, proto int) {
 	Log(TRACE, "Handling LLDP Session Packet")
+	p.handleEtherType(contents, proto)
 }
 
 func (p *ARPPacket) String() string {
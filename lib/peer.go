@@ -10,9 +10,13 @@ import (
 type StateHandlerCallback func(ptpc *PTPCloud) error
 
 type NetworkPeer struct {
+	BytesSent      uint64                             // Data sent to this peer. Counters go first to be 64-bit aligned
+	BytesRecv      uint64                             // Data received from this peer
 	ID             string                             // ID of a peer
 	ProxyID        int                                // ID of the proxy
 	Forwarder      *net.UDPAddr                       // Forwarder address
+	Backup         *net.UDPAddr                       // Relay kept as redundant path after switch to direct connection
+	BackupProxy    int                                // ID of the proxy on redundant path
 	PeerAddr       *net.UDPAddr                       // Address of peer
 	PeerLocalIP    net.IP                             // IP of peers interface. TODO: Rename to IP
 	PeerHW         net.HardwareAddr                   // Hardware addres of peer interface. TODO: Rename to Mac
@@ -20,12 +24,43 @@ type NetworkPeer struct {
 	KnownIPs       []*net.UDPAddr                     // List of IP addresses that accepts connection on peer
 	Retries        int                                // Number of introduction retries
 	State          PeerState                          // State of a peer
-	LastContact    time.Time                          // Last ping with this peer
+	LastContact    time.Time                          // Last proof of liveness: ping response or received data
 	PingCount      int                                // Number of pings messages sent without response
+	RTT            time.Duration                      // Round trip time measured by the last answered ping
+	Latency        *LatencyStats                      // Distribution of round trip times of pings
 	StateHandlers  map[PeerState]StateHandlerCallback // List of callbacks for different peer states
 	ProxyBlacklist []*net.UDPAddr                     // Blacklist of proxies
 	ProxyRequests  int                                // Number of requests sent
 	LastError      string
+	Failure        error       // Last error returned by a state handler
+	LastActivity   time.Time   // Last time data was exchanged with this peer
+	LastPing       time.Time   // Last time ping was sent to this peer
+	Keepalive      *WheelTimer // Next scheduled check of connected peer
+	LastPunch      time.Time   // Last attempt to replace relay with direct connection
+	ConnectStarted time.Time   // When we have started to look for a way to reach the peer
+	PublicKey      string      // Identity key the peer has signed its introductions with
+	DrainNotified  bool        // Peer was asked to stop using this host
+	DrainedAt      time.Time   // When peer told us it goes into maintenance
+	Capabilities   []string    // Capabilities the peer has signed
+	Tags           []string    // Tags the peer has advertised
+	TagsConfirmed  bool        // Authentication hook has admitted the peer with these tags
+	LastReceived   time.Time   // Last time data frame was received from this peer
+	Pacer          *Pacer      // Spreads bursts of data sent to this peer
+	SendSeq        uint32      // Sequence number of the last data message sent to this peer
+	Loss           *LossMeter  // Counts data lost on the way from this peer
+	Dedup          *Dedup      // Drops copies of data received over redundant paths
+	BytesCopied    uint64      // Data sent to this peer over redundant path
+	LossyReports   int         // Consecutive feedback reports with high loss
+	ReportedLoss   float64     // Share of data lost on the way to this peer
+	Failures       int         // Consecutive attempts to reach the peer that have failed
+	RetryAt        time.Time   // Next attempt to reach the peer is delayed until this time
+	PunchFailures  int         // Consecutive failed attempts to switch from relay to direct connection
+	RelayRejected  bool        // Forwarder refused the session because it's saturated
+	PathMTU        int         // Largest MTU confirmed to reach the peer whole. Zero if unknown
+	MTUProbed      time.Time   // When path MTU was probed last time
+	MTUConfirmed   time.Time   // When peer answered probe of path MTU last time
+	Joined         time.Time   // When join event of the peer was emitted. Zero while peer is not connected
+	ReportedDown   bool        // Members were told this host can't reach the peer
 }
 
 func (np *NetworkPeer) Run(ptpc *PTPCloud) {
@@ -39,6 +74,12 @@ func (np *NetworkPeer) Run(ptpc *PTPCloud) {
 			time.Sleep(time.Millisecond * 500)
 			continue
 		}
+		if np.State == P_CONNECTED {
+			// Connected peers are served by the timer wheel, so we don't
+			// need to keep a goroutine for every one of them
+			np.ScheduleCheck(ptpc)
+			return
+		}
 		if !initialize {
 			np.StateHandlers = make(map[PeerState]StateHandlerCallback)
 			np.StateHandlers[P_INIT] = np.StateInit
@@ -60,16 +101,32 @@ func (np *NetworkPeer) Run(ptpc *PTPCloud) {
 		}
 		err := callback(ptpc)
 		if err != nil {
+			np.Failure = err
 			Log(WARNING, "Peer %s: %v", np.ID, err)
+			if np.State == P_INIT {
+				np.attemptFailed()
+			}
 		}
 		time.Sleep(time.Millisecond * 500)
 	}
 }
 
 func (np *NetworkPeer) StateInit(ptpc *PTPCloud) error {
+	if time.Since(np.DrainedAt) < DRAIN_HOLD {
+		// Peer is in maintenance. Wait before resolving it again
+		return nil
+	}
+	if ptpc.NoNetwork || time.Now().Before(np.RetryAt) {
+		return nil
+	}
+	np.dropBackup()
 	// Send request about IPs of a peer
 	Log(INFO, "Initializing new peer: %s", np.ID)
 	ptpc.Dht.RequestPeerIPs(np.ID)
+	if len(ptpc.PublicIPs()) == 0 {
+		// Our own addresses tell whether peer is behind the same NAT
+		ptpc.Dht.RequestPeerIPs(ptpc.Dht.ID)
+	}
 	np.State = P_REQUESTED_IP
 	return nil
 }
@@ -78,7 +135,7 @@ func (np *NetworkPeer) StateRequestedIp(ptpc *PTPCloud) error {
 	// Waiting for IPs from DHT
 	Log(INFO, "Waiting network addresses for peer: %s", np.ID)
 	for {
-		for _, PeerInfo := range ptpc.Dht.Peers {
+		for _, PeerInfo := range ptpc.Dht.PeerList() {
 			if PeerInfo.ID == np.ID {
 				if len(PeerInfo.Ips) >= 1 {
 					np.KnownIPs = PeerInfo.Ips
@@ -105,7 +162,8 @@ func (np *NetworkPeer) SetPeerAddr() bool {
 // In this state we're trying to establish direct connection.
 // First we're getting list of local interfaces and see if one of
 // received IPs are in the same network. If so, we will try to establish
-// local connection across LAN.
+// local connection across LAN. Peers behind the same NAT are tried at
+// their private addresses before NAT is asked to loop traffic back.
 // Otherwise, we will try to establish connection over WAN. If every attempt
 // will fail we will switch to Proxy mode.
 func (np *NetworkPeer) StateConnectingDirectly(ptpc *PTPCloud) error {
@@ -115,31 +173,83 @@ func (np *NetworkPeer) StateConnectingDirectly(ptpc *PTPCloud) error {
 		np.LastError = fmt.Sprintf("Didn't received any IP addresses")
 		return errors.New("Joined connection state without knowing any IPs")
 	}
-	// If forward mode was activated - skip direction connection attemps
-	if ptpc.ForwardMode {
+	np.ConnectStarted = time.Now()
+	if ptpc.PathPolicy(np) == PATH_RELAY_ONLY {
+		// Even LAN addresses are not probed, so peer doesn't learn them
+		Log(INFO, "Peer %s is reached through forwarders only", np.ID)
 		np.SetPeerAddr()
 		np.State = P_WAITING_FORWARDER
 		return nil
 	}
-	// Try to connect locally
+	// Peers on the same host or LAN are connected directly even in
+	// forward mode: relaying their traffic gives nothing. Failures are
+	// not recorded, because most of peers are not in the same network
+	started := time.Now()
+	if np.ProbeLoopback(ptpc) {
+		np.PeerAddr = np.Endpoint
+		ptpc.RecordTraversal(np, TRAVERSAL_LOCAL, NAT_NONE, started, "")
+		Log(INFO, "Connected with %s over loopback", np.ID)
+		np.State = P_HANDSHAKING
+		return nil
+	}
 	isLocal := np.ProbeLocalConnection(ptpc)
 	if isLocal {
 		np.PeerAddr = np.Endpoint
+		ptpc.RecordTraversal(np, TRAVERSAL_LAN, NAT_UNKNOWN, started, "")
 		Log(INFO, "Connected with %s over LAN", np.ID)
 		np.State = P_HANDSHAKING
 		return nil
 	}
+	started = time.Now()
+	if np.ProbeSameNAT(ptpc) {
+		np.PeerAddr = np.Endpoint
+		ptpc.RecordTraversal(np, TRAVERSAL_SAMENAT, NAT_UNKNOWN, started, "")
+		Log(INFO, "Connected with %s behind the same NAT", np.ID)
+		np.State = P_HANDSHAKING
+		return nil
+	} else if np.BehindSameNAT(ptpc) {
+		ptpc.RecordTraversal(np, TRAVERSAL_SAMENAT, NAT_UNKNOWN, started, np.LastError)
+	}
+	if ptpc.PathPolicy(np) == PATH_REDUNDANT {
+		// Relay comes first. Direct path is added by hole punching later
+		// and relay is kept as redundant path
+		np.SetPeerAddr()
+		np.State = P_WAITING_FORWARDER
+		return nil
+	}
+	// If forward mode was activated - skip direction connection attemps.
+	// Peers that can't be relayed are still tried directly
+	if ptpc.ForwardMode && ptpc.PathPolicy(np) != PATH_NO_RELAY {
+		np.SetPeerAddr()
+		np.State = P_WAITING_FORWARDER
+		return nil
+	}
 	// Try direct connection over the internet. If target host is not
 	// behind NAT we should connect to it successfully
 	// Otherwise we will failback to proxy
 	addr := np.KnownIPs[0]
+	started = time.Now()
 	conn := np.TestConnection(ptpc, addr)
 	if conn {
 		np.PeerAddr = np.Endpoint
+		ptpc.RecordTraversal(np, TRAVERSAL_DIRECT, NAT_NONE, started, "")
 		Log(INFO, "Connected with %s over Internet", np.ID)
 		np.State = P_HANDSHAKING
 		return nil
+	}
+	ptpc.RecordTraversal(np, TRAVERSAL_DIRECT, NAT_UNKNOWN, started, "No response to test message")
+	// Peer may be behind NAT. Agree on time with it and punch holes
+	// in both NATs simultaneously
+	started = time.Now()
+	if addr := np.Punch(ptpc); addr != nil {
+		np.Endpoint = addr
+		np.PeerAddr = addr
+		ptpc.RecordTraversal(np, TRAVERSAL_PUNCH, ptpc.punchedNAT(np.ID, addr), started, "")
+		Log(INFO, "Connected with %s through punched hole", np.ID)
+		np.State = P_HANDSHAKING
+		return nil
 	} else {
+		ptpc.RecordTraversal(np, TRAVERSAL_PUNCH, NAT_UNKNOWN, started, np.LastError)
 		Log(INFO, "Direct connection with %s failed", np.ID)
 		np.SetPeerAddr()
 		np.State = P_WAITING_FORWARDER
@@ -148,8 +258,27 @@ func (np *NetworkPeer) StateConnectingDirectly(ptpc *PTPCloud) error {
 }
 
 func (np *NetworkPeer) StateConnected(ptpc *PTPCloud) error {
-	if np.PingCount > 3 {
+	if ptpc.NoNetwork {
+		// Peer can't answer while host is offline, so it isn't timed out
+		return nil
+	}
+	// Peer that other members can't reach either is timed out as soon as
+	// it misses a probe
+	reports := 0
+	if ptpc.Liveness != nil {
+		reports = ptpc.Liveness.Unreachable(np.ID, np.LastContact)
+	}
+	confirmed := reports >= ptpc.livenessQuorum(np) && np.PingCount > 0 && time.Since(np.LastPing) > LIVENESS_PROBE_TIMEOUT
+	if np.PingCount > 3 || confirmed {
 		np.LastError = "Disconnected by timeout"
+		if confirmed {
+			np.LastError = fmt.Sprintf("Disconnected by timeout: %d members can't reach peer either", reports)
+		}
+		if !np.ReportedDown {
+			ptpc.gossipLiveness(np, false)
+		}
+		np.ReportedDown = false
+		ptpc.peerLeft(np, np.LastError)
 		np.State = P_INIT
 		np.PeerAddr = nil
 		np.Endpoint = nil
@@ -157,23 +286,89 @@ func (np *NetworkPeer) StateConnected(ptpc *PTPCloud) error {
 		return errors.New(fmt.Sprintf("Peer %s has been timed out", np.ID))
 	}
 	if np.Endpoint == nil {
+		ptpc.peerLeft(np, "Endpoint was lost")
 		np.State = P_INIT
 		np.PeerAddr = nil
 		np.PingCount = 0
 		return errors.New(fmt.Sprintf("Peer %s has lost endpoint", np.ID))
 	}
-	passed := time.Since(np.LastContact)
-	if passed > PEER_PING_TIMEOUT {
+	interval := np.PingInterval(ptpc)
+	retry := interval
+	if np.PingCount > 0 {
+		retry = PEER_PING_RETRY
+	}
+	// Members are told when peer misses a ping and when it answers again
+	if np.PingCount > 1 && !np.ReportedDown {
+		np.ReportedDown = true
+		ptpc.gossipLiveness(np, false)
+	} else if np.PingCount == 0 && np.ReportedDown {
+		np.ReportedDown = false
+		ptpc.gossipLiveness(np, true)
+	}
+	due := time.Since(np.LastContact) > interval && time.Since(np.LastPing) > retry
+	if reports > 0 && np.PingCount == 0 && time.Since(np.LastContact) > LIVENESS_PROBE_TIMEOUT {
+		due = true
+	}
+	if due {
 		np.LastError = ""
 		Log(DEBUG, "Sending ping")
 		msg := CreateXpeerPingMessage(PING_REQ, ptpc.HardwareAddr.String())
 		ptpc.SendTo(np.PeerHW, msg)
 		np.PingCount++
+		np.LastPing = time.Now()
+	}
+	policy := ptpc.PathPolicy(np)
+	if np.ProxyID != 0 && !ptpc.ForwardMode && (policy == PATH_AUTO || policy == PATH_REDUNDANT) && np.punchDue() {
+		np.LastPunch = time.Now()
+		ptpc.Go(func() { np.UpgradeToDirect(ptpc) })
 	}
-	time.Sleep(1 * time.Second)
 	return nil
 }
 
+// ScheduleCheck plans next check of a connected peer on the timer wheel.
+// Check sends to the peer and to other members, so it's run in a goroutine
+// of its own and doesn't hold up timers of other peers
+func (np *NetworkPeer) ScheduleCheck(ptpc *PTPCloud) {
+	if np.Keepalive != nil {
+		np.Keepalive.Cancel()
+	}
+	np.Keepalive = ptpc.Timers.Schedule(PEER_CHECK_INTERVAL, func() {
+		ptpc.Go(func() { np.CheckConnected(ptpc) })
+	})
+}
+
+// PingInterval returns how often peer should be pinged. Peers that haven't
+// exchanged any data for a while are pinged less often
+func (np *NetworkPeer) PingInterval(ptpc *PTPCloud) time.Duration {
+	if time.Since(np.LastActivity) > PEER_IDLE_TIMEOUT {
+		return ptpc.IdlePingInterval
+	}
+	return ptpc.PingInterval
+}
+
+// CheckConnected is scheduled on the timer wheel for connected peers.
+// When peer leaves connected state, state machine goroutine is started again
+func (np *NetworkPeer) CheckConnected(ptpc *PTPCloud) {
+	np.Keepalive = nil
+	if ptpc.Shutdown {
+		return
+	}
+	if np.State == P_CONNECTED {
+		err := np.StateConnected(ptpc)
+		if err != nil {
+			Log(WARNING, "Peer %s: %v", np.ID, err)
+			if np.State == P_INIT {
+				np.attemptFailed()
+			}
+		}
+	}
+	if np.State != P_CONNECTED {
+		ptpc.Go(func() { np.Run(ptpc) })
+		return
+	}
+	np.ScheduleCheck(ptpc)
+}
+
 func (np *NetworkPeer) StateHandshaking(ptpc *PTPCloud) error {
 	Log(INFO, "Sending handshake to %s", np.ID)
 	np.SendHandshake(ptpc)
@@ -185,9 +380,8 @@ func (np *NetworkPeer) StateHandshaking(ptpc *PTPCloud) error {
 		if passed > interval {
 			if retries >= 3 {
 				np.LastError = "Failed to handshake"
-				Log(ERROR, "Failed to handshake with %s", np.ID)
 				np.State = P_HANDSHAKING_FAILED
-				return errors.New(fmt.Sprintf("Failed to handshake with %s", np.ID))
+				return fmt.Errorf("%w: %s", ErrHandshakeTimeout, np.ID)
 			} else {
 				handshakeSentAt = time.Now()
 				np.SendHandshake(ptpc)
@@ -202,9 +396,16 @@ func (np *NetworkPeer) StateHandshaking(ptpc *PTPCloud) error {
 // Proxy was requested from DHT. This state waits for proxy
 // address
 func (np *NetworkPeer) StateWaitingForwarder(ptpc *PTPCloud) error {
+	if ptpc.PathPolicy(np) == PATH_NO_RELAY {
+		// Fail closed: peer is tried directly again from the beginning
+		np.LastError = "No direct path and relays are forbidden for this peer"
+		np.Forwarder = nil
+		np.State = P_INIT
+		return fmt.Errorf("%w: relays are forbidden for %s", ErrNoRelayAvailable, np.ID)
+	}
 	Log(INFO, "Looking in a list of cached proxies")
 	for _, fwd := range ptpc.Dht.Forwarders {
-		if fwd.DestinationID == np.ID {
+		if fwd.DestinationID == np.ID && !ptpc.Dht.IsSaturated(fwd.Addr) {
 			np.Forwarder = fwd.Addr
 			np.Endpoint = fwd.Addr
 			np.State = P_HANDSHAKING_FORWARDER
@@ -214,12 +415,12 @@ func (np *NetworkPeer) StateWaitingForwarder(ptpc *PTPCloud) error {
 	}
 	if np.ProxyRequests >= 3 {
 		np.LastError = "No more proxies for this peer"
-		Log(INFO, "We've failed to receive any proxies within this period")
+		ptpc.RecordTraversal(np, TRAVERSAL_RELAY, NAT_UNKNOWN, np.ConnectStarted, np.LastError)
 		np.State = P_INIT
 		ptpc.Dht.CleanForwarderBlacklist()
 		np.ProxyBlacklist = np.ProxyBlacklist[:0]
 		np.ProxyRequests = 0
-		return nil
+		return fmt.Errorf("%w: all proxies for %s have failed", ErrNoRelayAvailable, np.ID)
 	}
 	Log(INFO, "Requesting proxy for %s", np.ID)
 	np.RequestForwarder(ptpc)
@@ -230,7 +431,7 @@ func (np *NetworkPeer) StateWaitingForwarder(ptpc *PTPCloud) error {
 		if passed > WAIT_PROXY_TIMEOUT {
 			np.ProxyRequests++
 			np.LastError = "No forwarders received"
-			return errors.New(fmt.Sprintf("No proxy were received for %s", np.ID))
+			return fmt.Errorf("%w: no proxy were received for %s", ErrNoRelayAvailable, np.ID)
 		}
 	}
 	np.State = P_HANDSHAKING_FORWARDER
@@ -250,6 +451,15 @@ func (np *NetworkPeer) StateHandshakingForwarder(ptpc *PTPCloud) error {
 	handshakeSentAt := time.Now()
 	attempts := 0
 	for np.ProxyID == 0 {
+		if np.RelayRejected {
+			np.RelayRejected = false
+			np.BlacklistCurrentProxy(ptpc)
+			a := np.Forwarder
+			np.Forwarder = nil
+			np.State = P_WAITING_FORWARDER
+			np.LastError = "Forwarder is saturated"
+			return fmt.Errorf("%w: proxy %s for %s", ErrRelaySaturated, a.String(), np.ID)
+		}
 		passed := time.Since(handshakeSentAt)
 		if passed > HANDSHAKE_PROXY_TIMEOUT {
 			if attempts >= 3 {
@@ -258,7 +468,7 @@ func (np *NetworkPeer) StateHandshakingForwarder(ptpc *PTPCloud) error {
 				np.Forwarder = nil
 				np.State = P_WAITING_FORWARDER
 				np.LastError = "Failed to handshake with a forwarder"
-				return errors.New(fmt.Sprintf("Failed to handshake with proxy %s [%s]", np.ID, a.String()))
+				return fmt.Errorf("%w: proxy %s for %s", ErrHandshakeTimeout, a.String(), np.ID)
 			} else {
 				err := np.SendProxyHandshake(ptpc)
 				if err != nil {
@@ -271,6 +481,11 @@ func (np *NetworkPeer) StateHandshakingForwarder(ptpc *PTPCloud) error {
 		time.Sleep(time.Millisecond * 100)
 	}
 	Log(INFO, "%s handshaked with proxy %s", np.ID, np.Forwarder.String())
+	ptpc.RecordTraversal(np, TRAVERSAL_RELAY, NAT_UNKNOWN, np.ConnectStarted, "")
+	if ptpc.PathPolicy(np) == PATH_AUTO && !ptpc.ForwardMode {
+		// Relay was chosen by policy otherwise
+		ptpc.emitPeerEvent(EVENT_RELAY_FALLBACK, np, np.LastError)
+	}
 	np.State = P_HANDSHAKING
 	return nil
 }
@@ -291,6 +506,7 @@ func (np *NetworkPeer) StateHandshakingFailed(ptpc *PTPCloud) error {
 
 func (np *NetworkPeer) StateDisconnect(ptpc *PTPCloud) error {
 	Log(INFO, "Disconnecting %s", np.ID)
+	ptpc.peerLeft(np, "Disconnected")
 	np.State = P_STOP
 	// TODO: Send stop to DHT
 	return nil
@@ -320,8 +536,8 @@ func (np *NetworkPeer) BlacklistCurrentProxy(ptpc *PTPCloud) {
 
 // This method tests connection with specified endpoint
 func (np *NetworkPeer) TestConnection(ptpc *PTPCloud, endpoint *net.UDPAddr) bool {
-	msg := CreateTestP2PMessage(ptpc.Crypter, "TEST", 0)
-	conn, err := net.DialUDP("udp4", nil, endpoint)
+	msg := CreateTestP2PMessage(ptpc.CurrentCrypter(), "TEST", 0)
+	conn, err := net.DialUDP("udp", nil, endpoint)
 	if err != nil {
 		Log(DEBUG, "%v", err)
 		return false
@@ -404,7 +620,7 @@ func (np *NetworkPeer) SendHandshake(ptpc *PTPCloud) {
 		np.LastError = "DHT Disconnected"
 		return
 	}
-	msg := CreateIntroRequest(ptpc.Crypter, ptpc.Dht.ID)
+	msg := CreateIntroRequest(ptpc.CurrentCrypter(), ptpc.Dht.ID)
 	msg.Header.ProxyId = uint16(np.ProxyID)
 	_, err := ptpc.UDPSocket.SendMessage(msg, np.Endpoint)
 	if err != nil {
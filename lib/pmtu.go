@@ -0,0 +1,203 @@
+package ptp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterFeature(Feature{Name: PMTU_FEATURE, Description: "Path MTU probes for jumbo frames", Rollout: 100})
+}
+
+// ValidateJumboMTU checks MTU configured for jumbo frames. Zero means
+// jumbo frames are disabled
+func ValidateJumboMTU(mtu int) error {
+	if mtu != 0 && (mtu <= DEVICE_MTU || mtu > JUMBO_MTU_MAX) {
+		return errors.New(fmt.Sprintf("Jumbo MTU must be between %d and %d, got %d", DEVICE_MTU+1, JUMBO_MTU_MAX, mtu))
+	}
+	return nil
+}
+
+// CreatePMTUP2PMessage creates probe of path MTU or answer to it. Probe is
+// padded to the size of a frame of specified MTU, so it's as large as the
+// largest data message sent over the path. Answer is small
+func CreatePMTUP2PMessage(c Crypto, id string, mtu int, probe bool) *P2PMessage {
+	kind := PMTU_ACK
+	if probe {
+		kind = PMTU_PROBE
+	}
+	data := []byte(id + "|" + kind + "|" + strconv.Itoa(mtu) + "|")
+	if probe && len(data) < mtu+ETH_HEADER_SIZE {
+		data = append(data, bytes.Repeat([]byte{0}, mtu+ETH_HEADER_SIZE-len(data))...)
+	}
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_PMTU)
+	msg.Header.Length = uint16(len(data))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, data)
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = data
+	}
+	return msg
+}
+
+// ParsePMTUMessage returns sender, kind and MTU of a probe or an answer.
+// Probe that was cut on the way is rejected
+func ParsePMTUMessage(data []byte) (id, kind string, mtu int, err error) {
+	parts := strings.SplitN(string(data), "|", 4)
+	if len(parts) != 4 || (parts[1] != PMTU_PROBE && parts[1] != PMTU_ACK) {
+		return "", "", 0, ErrMalformedMessage
+	}
+	mtu, err = strconv.Atoi(parts[2])
+	if err != nil || mtu <= 0 || mtu > JUMBO_MTU_MAX {
+		return "", "", 0, ErrMalformedMessage
+	}
+	if parts[1] == PMTU_PROBE && len(data) < mtu+ETH_HEADER_SIZE {
+		return "", "", 0, ErrMalformedMessage
+	}
+	return parts[0], parts[1], mtu, nil
+}
+
+// JumboPath returns true if frames of jumbo MTU were recently confirmed to
+// reach the peer whole. Relayed peers never get jumbo frames
+func (np *NetworkPeer) JumboPath(mtu int) bool {
+	return np.ProxyID == 0 && np.PathMTU >= mtu && time.Since(np.MTUConfirmed) < 2*PMTU_PROBE_INTERVAL
+}
+
+// ProbePathMTU sends jumbo-sized probes to connected peers whose path
+// wasn't validated recently. Probes are answered only by peers that can
+// receive frames of this size
+func (p *PTPCloud) ProbePathMTU() {
+	if p.JumboMTU == 0 {
+		return
+	}
+	now := time.Now()
+	p.PeersLock.Lock()
+	var peers []*NetworkPeer
+	for _, peer := range p.NetworkPeers {
+		if peer.State != P_CONNECTED || peer.ProxyID != 0 || !p.FeatureEnabled(peer, PMTU_FEATURE) {
+			continue
+		}
+		interval := PMTU_PROBE_RETRY
+		if peer.JumboPath(p.JumboMTU) {
+			interval = PMTU_PROBE_INTERVAL
+		}
+		if now.Sub(peer.MTUProbed) >= interval {
+			peer.MTUProbed = now
+			peers = append(peers, peer)
+		}
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		Log(DEBUG, "Probing MTU of %d on the path to %s", p.JumboMTU, peer.ID)
+		p.SendTo(peer.PeerHW, CreatePMTUP2PMessage(p.CurrentCrypter(), p.Dht.ID, p.JumboMTU, true))
+	}
+}
+
+// HandlePMTUMessage answers probes of path MTU and records answers
+func (p *PTPCloud) HandlePMTUMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	id, kind, mtu, err := ParsePMTUMessage(msg.Data)
+	if err != nil {
+		Log(DEBUG, "Bad MTU probe from %s: %v", src_addr, err)
+		return
+	}
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[id]
+	p.PeersLock.Unlock()
+	if !exists || peer.Endpoint == nil || peer.Endpoint.String() != src_addr.String() {
+		Log(DEBUG, "MTU probe from unknown endpoint %s", src_addr)
+		return
+	}
+	if kind == PMTU_PROBE {
+		p.SendTo(peer.PeerHW, CreatePMTUP2PMessage(p.CurrentCrypter(), p.Dht.ID, mtu, false))
+		return
+	}
+	if mtu != p.JumboMTU {
+		return
+	}
+	p.PeersLock.Lock()
+	if peer.PathMTU < mtu {
+		Log(INFO, "Path to %s carries frames of MTU %d", peer.ID, mtu)
+	}
+	peer.PathMTU = mtu
+	peer.MTUConfirmed = time.Now()
+	p.PeersLock.Unlock()
+}
+
+// FitsPath returns false if frame is too large for the path to the peer.
+// Frames up to the default MTU are always sent, since sockets fragment
+// them if needed. Jumbo frames are sent whole only over validated paths
+// and are never split by p2p, so they're dropped while interface MTU is
+// being lowered for a peer without such path
+func (p *PTPCloud) FitsPath(peer *NetworkPeer, frame int) bool {
+	if frame <= p.baseMTU()+ETH_HEADER_SIZE {
+		return true
+	}
+	return peer != nil && peer.JumboPath(p.JumboMTU) && frame <= p.JumboMTU+ETH_HEADER_SIZE
+}
+
+// baseMTU returns MTU of the interface when jumbo frames are not used
+func (p *PTPCloud) baseMTU() int {
+	if p.MTU > 0 {
+		return p.MTU
+	}
+	return DEVICE_MTU
+}
+
+// jumboReady returns true if every connected peer can receive jumbo
+// frames. Unconnected peers don't matter until they connect
+func (p *PTPCloud) jumboReady() bool {
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	connected := 0
+	for _, peer := range p.NetworkPeers {
+		if peer.State != P_CONNECTED {
+			continue
+		}
+		if !peer.JumboPath(p.JumboMTU) {
+			return false
+		}
+		connected++
+	}
+	return connected > 0
+}
+
+// AdjustMTU raises MTU of the interface to the jumbo MTU once path to
+// every connected peer is validated and lowers it back as soon as a peer
+// without such path connects
+func (p *PTPCloud) AdjustMTU() {
+	if p.JumboMTU == 0 {
+		return
+	}
+	ready := p.jumboReady()
+	if ready == p.Jumbo {
+		return
+	}
+	dev, ok := p.Device.(*Interface)
+	if !ok {
+		return
+	}
+	mtu := p.baseMTU()
+	if ready {
+		mtu = p.JumboMTU
+		Log(INFO, "Every peer accepts jumbo frames. Setting MTU to %d", mtu)
+	} else {
+		Log(INFO, "Not every peer accepts jumbo frames. Setting MTU to %d", mtu)
+	}
+	if err := SetMTU(dev, p.DeviceName, p.IPTool, strconv.Itoa(mtu)); err != nil {
+		return
+	}
+	p.Jumbo = ready
+}
@@ -0,0 +1,80 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPMTUMessage(t *testing.T) {
+	probe := CreatePMTUP2PMessage(Crypto{}, "local", 9000, true)
+	if len(probe.Data) != 9000+ETH_HEADER_SIZE {
+		t.Errorf("Probe wasn't padded to frame size: %d", len(probe.Data))
+	}
+	parsed, err := P2PMessageFromBytes(probe.Serialize())
+	if err != nil {
+		t.Fatalf("Failed to parse probe: %v", err)
+	}
+	id, kind, mtu, err := ParsePMTUMessage(parsed.Data)
+	if err != nil || id != "local" || kind != PMTU_PROBE || mtu != 9000 {
+		t.Errorf("Wrong probe: %s %s %d %v", id, kind, mtu, err)
+	}
+	if _, _, _, err := ParsePMTUMessage(probe.Data[:4096]); err == nil {
+		t.Errorf("Truncated probe was accepted")
+	}
+	ack := CreatePMTUP2PMessage(Crypto{}, "remote", 9000, false)
+	if id, kind, mtu, err := ParsePMTUMessage(ack.Data); err != nil || id != "remote" || kind != PMTU_ACK || mtu != 9000 {
+		t.Errorf("Wrong answer: %s %s %d %v", id, kind, mtu, err)
+	}
+	for _, bad := range []string{"", "id|ack|9000", "id|nack|9000|", "id|ack|90000|"} {
+		if _, _, _, err := ParsePMTUMessage([]byte(bad)); err == nil {
+			t.Errorf("Malformed message %q was accepted", bad)
+		}
+	}
+	for mtu, valid := range map[int]bool{0: true, 1500: false, DEVICE_MTU: false, 9000: true, 9001: false} {
+		if err := ValidateJumboMTU(mtu); (err == nil) != valid {
+			t.Errorf("Wrong validation of MTU %d: %v", mtu, err)
+		}
+	}
+}
+
+func TestJumboPath(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("192.168.10.2"), Port: 6882}
+	peer := &NetworkPeer{ID: "remote", State: P_CONNECTED, Endpoint: addr}
+	p := new(PTPCloud)
+	p.Dht = &DHTClient{ID: "local"}
+	p.JumboMTU = 9000
+	p.NetworkPeers = map[string]*NetworkPeer{"remote": peer}
+
+	if !p.FitsPath(peer, DEVICE_MTU+ETH_HEADER_SIZE) || p.FitsPath(peer, 9000) {
+		t.Errorf("Wrong size check before path was validated")
+	}
+	if p.jumboReady() {
+		t.Errorf("Jumbo frames are used before path was validated")
+	}
+
+	p.HandlePMTUMessage(CreatePMTUP2PMessage(Crypto{}, "remote", 9000, false), &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6882})
+	if peer.PathMTU != 0 {
+		t.Errorf("Answer from another endpoint was accepted")
+	}
+	p.HandlePMTUMessage(CreatePMTUP2PMessage(Crypto{}, "remote", 9000, false), addr)
+	if !peer.JumboPath(9000) || !p.jumboReady() || !p.FitsPath(peer, 9000+ETH_HEADER_SIZE) || p.FitsPath(peer, 9001+ETH_HEADER_SIZE) {
+		t.Errorf("Validated path wasn't used: %d", peer.PathMTU)
+	}
+
+	// Path is not trusted for long without new answers and never when relayed
+	peer.MTUConfirmed = time.Now().Add(-2 * PMTU_PROBE_INTERVAL)
+	if p.jumboReady() {
+		t.Errorf("Stale validation was trusted")
+	}
+	peer.MTUConfirmed = time.Now()
+	peer.ProxyID = 1
+	if p.jumboReady() || p.FitsPath(peer, 9000) {
+		t.Errorf("Jumbo frames are sent through forwarder")
+	}
+	peer.ProxyID = 0
+	p.NetworkPeers["new"] = &NetworkPeer{ID: "new", State: P_CONNECTED}
+	if p.jumboReady() {
+		t.Errorf("Jumbo MTU is kept after peer without validated path connected")
+	}
+}
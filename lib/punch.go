@@ -0,0 +1,335 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PunchProposal is exchanged by peers before hole punching. Both peers
+// start sending probes to candidates of each other at the same moment,
+// so mappings are created on both NATs before first probes arrive
+type PunchProposal struct {
+	Kind       string         // PUNCH_OFFER, PUNCH_ANSWER or PUNCH_PROBE
+	ID         string         // ID of the sender
+	At         time.Time      // Moment when both peers start sending probes
+	Candidates []*net.UDPAddr // Endpoints of the sender
+}
+
+// PunchCallback processes proposal. Source address is nil for proposals
+// received from DHT
+type PunchCallback func(pp *PunchProposal, src_addr *net.UDPAddr)
+
+// PunchAttempt tracks coordinated hole punching with a single peer
+type PunchAttempt struct {
+	At         time.Time
+	Candidates []*net.UDPAddr // Endpoints of the remote peer
+	Answered   bool           // Remote peer agreed on time and candidates
+	Result     *net.UDPAddr   // Address the first probe was received from
+	Finished   time.Time
+}
+
+func (pp *PunchProposal) String() string {
+	var candidates []string
+	for _, addr := range pp.Candidates {
+		candidates = append(candidates, addr.String())
+	}
+	return fmt.Sprintf("%s|%s|%d|%s", pp.Kind, pp.ID, pp.At.UnixNano(), strings.Join(candidates, ","))
+}
+
+// ParsePunchProposal decodes proposal received from DHT or from a peer
+func ParsePunchProposal(s string) (*PunchProposal, error) {
+	parts := strings.Split(s, "|")
+	if len(parts) != 4 {
+		return nil, errors.New("Malformed punch proposal")
+	}
+	switch parts[0] {
+	case PUNCH_OFFER, PUNCH_ANSWER, PUNCH_PROBE:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown punch proposal kind: %s", parts[0]))
+	}
+	at, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	pp := new(PunchProposal)
+	pp.Kind = parts[0]
+	pp.ID = parts[1]
+	pp.At = time.Unix(0, at)
+	for _, candidate := range strings.Split(parts[3], ",") {
+		if candidate == "" {
+			continue
+		}
+		addr, err := ResolveEndpoint(candidate, false)
+		if err != nil {
+			return nil, err
+		}
+		pp.Candidates = append(pp.Candidates, addr)
+	}
+	return pp, nil
+}
+
+// CreatePunchP2PMessage wraps proposal into a message that is sent over
+// an established relay or directly as a probe
+func CreatePunchP2PMessage(c Crypto, pp *PunchProposal) *P2PMessage {
+	data := pp.String()
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_PUNCH)
+	msg.Header.Length = uint16(len(data))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, []byte(data))
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = []byte(data)
+	}
+	return msg
+}
+
+// LocalCandidates returns endpoints peers may reach us at. Address
+// assigned by NAT is known to peers from DHT
+func (p *PTPCloud) LocalCandidates() []*net.UDPAddr {
+	var candidates []*net.UDPAddr
+	for _, ip := range p.LocalIPs {
+		candidates = append(candidates, &net.UDPAddr{IP: ip, Port: p.UDPSocket.GetPort()})
+	}
+	return candidates
+}
+
+// Punch agrees with peer on time and candidates and punches holes in
+// both NATs simultaneously. Returns address of the peer or nil on failure
+func (np *NetworkPeer) Punch(ptpc *PTPCloud) *net.UDPAddr {
+	if addr := ptpc.punchResult(np.ID); addr != nil {
+		// Peer has already punched the hole while answering our peer
+		return addr
+	}
+	offer := &PunchProposal{
+		Kind:       PUNCH_OFFER,
+		ID:         ptpc.Dht.ID,
+		At:         time.Now().Add(PUNCH_DELAY),
+		Candidates: ptpc.LocalCandidates(),
+	}
+	ptpc.punchLock.Lock()
+	if ptpc.punches == nil {
+		ptpc.punches = make(map[string]*PunchAttempt)
+	}
+	attempt := &PunchAttempt{At: offer.At}
+	ptpc.punches[np.ID] = attempt
+	ptpc.punchLock.Unlock()
+
+	Log(INFO, "Coordinating hole punching with %s", np.ID)
+	np.SendPunch(ptpc, offer)
+	for !ptpc.punchAnswered(attempt) {
+		if time.Now().After(offer.At) {
+			np.LastError = "Peer didn't answer punch proposal"
+			return nil
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	ptpc.Go(func() { ptpc.SendProbes(attempt) })
+	deadline := offer.At.Add(PUNCH_DURATION)
+	for time.Now().Before(deadline) {
+		if addr := ptpc.punchResult(np.ID); addr != nil {
+			Log(INFO, "Hole punched with %s at %s", np.ID, addr)
+			return addr
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	np.LastError = "Hole punching failed"
+	return nil
+}
+
+// SendPunch delivers proposal over the relay if peer is connected through
+// one, or over DHT otherwise
+func (np *NetworkPeer) SendPunch(ptpc *PTPCloud, pp *PunchProposal) {
+	if np.State == P_CONNECTED && np.ProxyID != 0 {
+		_, err := ptpc.SendTo(np.PeerHW, CreatePunchP2PMessage(ptpc.CurrentCrypter(), pp))
+		if err == nil {
+			return
+		}
+		Log(DEBUG, "Failed to send punch proposal over relay: %v", err)
+	}
+	ptpc.Dht.SendPunch(np.ID, pp)
+}
+
+// UpgradeToDirect tries to replace relay with a direct connection
+func (np *NetworkPeer) UpgradeToDirect(ptpc *PTPCloud) {
+	started := time.Now()
+	addr := np.Punch(ptpc)
+	if addr == nil {
+		np.PunchFailures++
+		ptpc.RecordTraversal(np, TRAVERSAL_UPGRADE, NAT_UNKNOWN, started, np.LastError)
+		return
+	}
+	np.PunchFailures = 0
+	ptpc.RecordTraversal(np, TRAVERSAL_UPGRADE, ptpc.punchedNAT(np.ID, addr), started, "")
+	if np.State != P_CONNECTED {
+		return
+	}
+	Log(INFO, "Switching %s from relay %s to direct connection %s", np.ID, np.Forwarder, addr)
+	if ptpc.PathPolicy(np) == PATH_REDUNDANT {
+		np.keepBackup()
+	}
+	np.Forwarder = nil
+	np.ProxyID = 0
+	np.Endpoint = addr
+	np.PeerAddr = addr
+	np.State = P_HANDSHAKING
+}
+
+// SendProbes waits for agreed time and sends probes to every candidate
+// of the peer until the hole is punched or time is over
+func (p *PTPCloud) SendProbes(attempt *PunchAttempt) {
+	time.Sleep(time.Until(attempt.At))
+	probe := &PunchProposal{Kind: PUNCH_PROBE, ID: p.Dht.ID, At: attempt.At}
+	msg := CreatePunchP2PMessage(p.CurrentCrypter(), probe)
+	deadline := attempt.At.Add(PUNCH_DURATION)
+	for time.Now().Before(deadline) && !p.Shutdown {
+		p.punchLock.Lock()
+		done := attempt.Result != nil
+		p.punchLock.Unlock()
+		if done {
+			return
+		}
+		for _, addr := range attempt.Candidates {
+			p.UDPSocket.SendMessage(msg, addr)
+		}
+		time.Sleep(PUNCH_PROBE_INTERVAL)
+	}
+}
+
+// HandlePunchMessage receives proposals sent over a relay and probes
+func (p *PTPCloud) HandlePunchMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	pp, err := ParsePunchProposal(string(msg.Data))
+	if err != nil {
+		Log(DEBUG, "Bad punch message from %s: %v", src_addr, err)
+		return
+	}
+	p.HandlePunchProposal(pp, src_addr)
+}
+
+// HandlePunchProposal processes coordination messages. Source address is
+// nil for proposals received from DHT
+func (p *PTPCloud) HandlePunchProposal(pp *PunchProposal, src_addr *net.UDPAddr) {
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[pp.ID]
+	p.PeersLock.Unlock()
+	if !exists || pp.ID == p.Dht.ID {
+		Log(DEBUG, "Punch proposal from unknown peer %s", pp.ID)
+		return
+	}
+	switch pp.Kind {
+	case PUNCH_OFFER:
+		policy := p.PathPolicy(peer)
+		if policy == PATH_RELAY_ONLY || (p.ForwardMode && policy != PATH_NO_RELAY) {
+			return
+		}
+		if pp.At.Before(time.Now()) || time.Until(pp.At) > PUNCH_MAX_DELAY {
+			Log(DEBUG, "Punch proposal of %s has bad time: %s", pp.ID, pp.At)
+			return
+		}
+		attempt := &PunchAttempt{At: pp.At, Candidates: punchCandidates(pp, peer), Answered: true}
+		p.punchLock.Lock()
+		if p.punches == nil {
+			p.punches = make(map[string]*PunchAttempt)
+		}
+		p.punches[pp.ID] = attempt
+		p.punchLock.Unlock()
+		answer := &PunchProposal{Kind: PUNCH_ANSWER, ID: p.Dht.ID, At: pp.At, Candidates: p.LocalCandidates()}
+		if src_addr != nil {
+			// Answer over the same relay
+			msg := CreatePunchP2PMessage(p.CurrentCrypter(), answer)
+			msg.Header.ProxyId = uint16(peer.ProxyID)
+			p.UDPSocket.SendMessage(msg, src_addr)
+		} else {
+			p.Dht.SendPunch(pp.ID, answer)
+		}
+		Log(INFO, "Agreed to punch hole with %s at %s", pp.ID, pp.At)
+		p.Go(func() { p.SendProbes(attempt) })
+	case PUNCH_ANSWER:
+		p.punchLock.Lock()
+		attempt, exists := p.punches[pp.ID]
+		if exists && attempt.At.Equal(pp.At) {
+			attempt.Candidates = punchCandidates(pp, peer)
+			attempt.Answered = true
+		}
+		p.punchLock.Unlock()
+	case PUNCH_PROBE:
+		if src_addr == nil {
+			return
+		}
+		p.punchLock.Lock()
+		attempt, exists := p.punches[pp.ID]
+		first := exists && attempt.Result == nil
+		if first {
+			attempt.Result = src_addr
+			attempt.Finished = time.Now()
+		}
+		p.punchLock.Unlock()
+		if first {
+			// Peer may not have received our probes yet
+			reply := &PunchProposal{Kind: PUNCH_PROBE, ID: p.Dht.ID, At: attempt.At}
+			p.UDPSocket.SendMessage(CreatePunchP2PMessage(p.CurrentCrypter(), reply), src_addr)
+		}
+	}
+}
+
+func (p *PTPCloud) punchAnswered(attempt *PunchAttempt) bool {
+	p.punchLock.Lock()
+	defer p.punchLock.Unlock()
+	return attempt.Answered
+}
+
+// punchResult returns address of the peer if hole was punched recently
+func (p *PTPCloud) punchResult(id string) *net.UDPAddr {
+	p.punchLock.Lock()
+	defer p.punchLock.Unlock()
+	attempt, exists := p.punches[id]
+	if !exists || attempt.Result == nil || time.Since(attempt.Finished) > PUNCH_RESULT_TTL {
+		return nil
+	}
+	return attempt.Result
+}
+
+// punchCandidates merges endpoints proposed by peer with endpoints
+// received from DHT, which include address assigned by NAT
+func punchCandidates(pp *PunchProposal, peer *NetworkPeer) []*net.UDPAddr {
+	seen := make(map[string]bool)
+	var candidates []*net.UDPAddr
+	for _, addr := range append(append([]*net.UDPAddr{}, peer.KnownIPs...), pp.Candidates...) {
+		if !seen[addr.String()] {
+			seen[addr.String()] = true
+			candidates = append(candidates, addr)
+		}
+	}
+	return candidates
+}
+
+// SendPunch asks router to deliver punch proposal to peer with specified ID
+func (dht *DHTClient) SendPunch(id string, pp *PunchProposal) {
+	var req DHTMessage
+	req.Id = dht.ID
+	req.Command = CMD_PUNCH
+	req.Query = id
+	req.Arguments = pp.String()
+	dht.Send(dht.EncodeRequest(req))
+}
+
+func (dht *DHTClient) HandlePunch(data DHTMessage, conn PacketConn) {
+	pp, err := ParsePunchProposal(data.Arguments)
+	if err != nil {
+		Log(ERROR, "Failed to parse punch proposal: %v", err)
+		return
+	}
+	if dht.PunchHandler != nil {
+		dht.PunchHandler(pp, nil)
+	}
+}
@@ -0,0 +1,91 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParsePunchProposal(t *testing.T) {
+	pp := &PunchProposal{
+		Kind: PUNCH_OFFER,
+		ID:   "00000000-1111-2222-3333-444444444444",
+		At:   time.Unix(0, 1500000000123456789),
+		Candidates: []*net.UDPAddr{
+			{IP: net.ParseIP("192.168.1.2"), Port: 6881},
+			{IP: net.ParseIP("10.0.0.3"), Port: 6882},
+		},
+	}
+	parsed, err := ParsePunchProposal(pp.String())
+	if err != nil {
+		t.Fatalf("Failed to parse proposal: %v", err)
+	}
+	if parsed.Kind != pp.Kind || parsed.ID != pp.ID || !parsed.At.Equal(pp.At) {
+		t.Errorf("Parsed proposal differs: %s != %s", parsed.String(), pp.String())
+	}
+	if len(parsed.Candidates) != 2 || parsed.Candidates[1].String() != "10.0.0.3:6882" {
+		t.Errorf("Wrong candidates: %v", parsed.Candidates)
+	}
+	for _, bad := range []string{"", "offer|id|1", "hello|id|1|", "offer|id|time|", "offer|id|1|host"} {
+		if _, err := ParsePunchProposal(bad); err == nil {
+			t.Errorf("Malformed proposal %q was accepted", bad)
+		}
+	}
+}
+
+func newPunchTestInstance(t *testing.T, id string) *PTPCloud {
+	p := new(PTPCloud)
+	p.UDPSocket = new(PTPNet)
+	if err := p.UDPSocket.Init("127.0.0.1", 0); err != nil {
+		t.Skipf("Can't create UDP socket: %v", err)
+	}
+	p.Dht = new(DHTClient)
+	p.Dht.ID = id
+	p.NetworkPeers = make(map[string]*NetworkPeer)
+	p.MessageHandlers = map[uint16]MessageHandler{MT_PUNCH: p.HandlePunchMessage}
+	p.LocalIPs = []net.IP{net.ParseIP("127.0.0.1")}
+	go p.UDPSocket.Listen(p.HandleP2PMessage)
+	return p
+}
+
+func TestPunch(t *testing.T) {
+	a := newPunchTestInstance(t, "aaaaaaaa-1111-2222-3333-444444444444")
+	defer a.UDPSocket.Stop()
+	b := newPunchTestInstance(t, "bbbbbbbb-1111-2222-3333-444444444444")
+	defer b.UDPSocket.Stop()
+	a.NetworkPeers[b.Dht.ID] = &NetworkPeer{ID: b.Dht.ID}
+	b.NetworkPeers[a.Dht.ID] = &NetworkPeer{ID: a.Dht.ID}
+
+	// Offer of A is delivered to B, which answers and starts sending probes
+	at := time.Now().Add(time.Millisecond * 200)
+	a.punches = map[string]*PunchAttempt{b.Dht.ID: {At: at}}
+	offer := &PunchProposal{Kind: PUNCH_OFFER, ID: a.Dht.ID, At: at, Candidates: a.LocalCandidates()}
+	b.HandlePunchProposal(offer, nil)
+	answer := &PunchProposal{Kind: PUNCH_ANSWER, ID: b.Dht.ID, At: at, Candidates: b.LocalCandidates()}
+	a.HandlePunchProposal(answer, nil)
+	if !a.punchAnswered(a.punches[b.Dht.ID]) {
+		t.Fatalf("Answer was not accepted")
+	}
+	go a.SendProbes(a.punches[b.Dht.ID])
+
+	deadline := at.Add(PUNCH_DURATION)
+	for time.Now().Before(deadline) {
+		if a.punchResult(b.Dht.ID) != nil && b.punchResult(a.Dht.ID) != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if addr := a.punchResult(b.Dht.ID); addr == nil || addr.Port != b.UDPSocket.GetPort() {
+		t.Errorf("A didn't receive probe of B: %v", addr)
+	}
+	if addr := b.punchResult(a.Dht.ID); addr == nil || addr.Port != a.UDPSocket.GetPort() {
+		t.Errorf("B didn't receive probe of A: %v", addr)
+	}
+
+	// Offers scheduled in the past are ignored
+	stale := &PunchProposal{Kind: PUNCH_OFFER, ID: a.Dht.ID, At: time.Now().Add(-time.Second)}
+	b.HandlePunchProposal(stale, nil)
+	if b.punches[a.Dht.ID].At.Equal(stale.At) {
+		t.Errorf("Stale offer was accepted")
+	}
+}
@@ -0,0 +1,89 @@
+package ptp
+
+// ResolveQuorum merges lists received from different routers according to
+// policy. Order of the first appearance of every item is preserved
+func ResolveQuorum(policy string, lists [][]string) []string {
+	var order []string
+	votes := make(map[string]int)
+	for _, list := range lists {
+		seen := make(map[string]bool)
+		for _, item := range list {
+			if item == "" || seen[item] {
+				continue
+			}
+			seen[item] = true
+			if votes[item] == 0 {
+				order = append(order, item)
+			}
+			votes[item]++
+		}
+	}
+	var result []string
+	for _, item := range order {
+		switch policy {
+		case QUORUM_INTERSECTION:
+			if votes[item] == len(lists) {
+				result = append(result, item)
+			}
+		case QUORUM_MAJORITY:
+			if votes[item]*2 > len(lists) {
+				result = append(result, item)
+			}
+		default:
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// ResolveValue chooses single value among values received from different
+// routers. Intersection requires every router to agree, other policies
+// choose the most common value. Empty string is returned when there is
+// no agreement
+func ResolveValue(policy string, values []string) string {
+	var order []string
+	votes := make(map[string]int)
+	for _, v := range values {
+		if votes[v] == 0 {
+			order = append(order, v)
+		}
+		votes[v]++
+	}
+	best := ""
+	for _, v := range order {
+		if votes[v] > votes[best] || best == "" {
+			best = v
+		}
+	}
+	switch policy {
+	case QUORUM_INTERSECTION:
+		if votes[best] != len(values) {
+			return ""
+		}
+	case QUORUM_MAJORITY:
+		if votes[best]*2 <= len(values) {
+			return ""
+		}
+	}
+	return best
+}
+
+// recordResponse saves answer of a router and returns answers of every
+// router we are still connected to
+func (dht *DHTClient) recordResponse(responses map[string]string, conn PacketConn, value string) []string {
+	dht.ResponsesLock.Lock()
+	defer dht.ResponsesLock.Unlock()
+	responses[conn.RemoteAddr().String()] = value
+	var values []string
+	for _, c := range dht.Connections() {
+		v, exists := responses[c.RemoteAddr().String()]
+		if exists {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		// Connection was just replaced. Use this answer alone
+		values = append(values, value)
+	}
+	return values
+}
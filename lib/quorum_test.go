@@ -0,0 +1,41 @@
+package ptp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveQuorum(t *testing.T) {
+	lists := [][]string{
+		{"a", "b", "c"},
+		{"a", "b"},
+		{"a", "d"},
+	}
+	cases := map[string][]string{
+		QUORUM_UNION:        {"a", "b", "c", "d"},
+		QUORUM_INTERSECTION: {"a"},
+		QUORUM_MAJORITY:     {"a", "b"},
+	}
+	for policy, expected := range cases {
+		result := ResolveQuorum(policy, lists)
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("Wrong result for %s policy: %v", policy, result)
+		}
+	}
+}
+
+func TestResolveValue(t *testing.T) {
+	values := []string{"10.0.0.1/24", "10.0.0.2/24", "10.0.0.1/24"}
+	if ResolveValue(QUORUM_MAJORITY, values) != "10.0.0.1/24" {
+		t.Errorf("Majority value was not chosen")
+	}
+	if ResolveValue(QUORUM_UNION, values) != "10.0.0.1/24" {
+		t.Errorf("Most common value was not chosen")
+	}
+	if ResolveValue(QUORUM_INTERSECTION, values) != "" {
+		t.Errorf("Value was chosen without agreement of every router")
+	}
+	if ResolveValue(QUORUM_MAJORITY, []string{"a", "b"}) != "" {
+		t.Errorf("Value was chosen without majority")
+	}
+}
@@ -0,0 +1,222 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// QuotaConfig limits data exchanged by an instance with peers per day and
+// per calendar month of local time. Zero means unlimited
+type QuotaConfig struct {
+	Daily   int64  `yaml:"daily"`   // Megabytes per day
+	Monthly int64  `yaml:"monthly"` // Megabytes per month
+	Action  string `yaml:"action"`  // log, throttle or pause
+	Floor   int64  `yaml:"floor"`   // Kilobytes per second of throttled instance
+}
+
+// QuotaUsage is the transfer totals of current periods. It's saved, so
+// totals survive restarts
+type QuotaUsage struct {
+	Day        string `yaml:"day"` // Period in a form of 2006-01-02
+	DayBytes   int64  `yaml:"day_bytes"`
+	Month      string `yaml:"month"` // Period in a form of 2006-01
+	MonthBytes int64  `yaml:"month_bytes"`
+}
+
+// Quota tracks transfer totals of an instance and tells what to do when
+// they exceed configured limits
+type Quota struct {
+	Daily    int64 // Bytes per day
+	Monthly  int64 // Bytes per month
+	Action   QuotaAction
+	Floor    int64  // Bytes per second of throttled instance
+	File     string // Where usage is saved. Not saved if empty
+	usage    QuotaUsage
+	exceeded string // Period whose limit was exceeded. Empty if none
+	dirty    bool
+	saved    time.Time
+	lock     sync.Mutex
+}
+
+// QuotaPath returns location of saved transfer totals of a network
+func QuotaPath(hash string) string {
+	return filepath.Join(CONFIG_DIR, "p2p", "usage", url.PathEscape(hash)+".yaml")
+}
+
+// ParseQuotaAction parses action taken on exceeded quota. Empty value
+// means log
+func ParseQuotaAction(value string) (QuotaAction, error) {
+	switch value {
+	case "", "log":
+		return QUOTA_LOG, nil
+	case "throttle":
+		return QUOTA_THROTTLE, nil
+	case "pause":
+		return QUOTA_PAUSE, nil
+	}
+	return QUOTA_LOG, errors.New(fmt.Sprintf("Unknown quota action %s. Use log, throttle or pause", value))
+}
+
+func (qa QuotaAction) String() string {
+	switch qa {
+	case QUOTA_THROTTLE:
+		return "throttle"
+	case QUOTA_PAUSE:
+		return "pause"
+	}
+	return "log"
+}
+
+// NewQuota creates quota from configuration and loads saved usage from
+// file. Nil is returned if no limit is configured
+func NewQuota(cfg QuotaConfig, file string) (*Quota, error) {
+	if cfg.Daily <= 0 && cfg.Monthly <= 0 {
+		return nil, nil
+	}
+	action, err := ParseQuotaAction(cfg.Action)
+	if err != nil {
+		return nil, err
+	}
+	q := &Quota{Daily: cfg.Daily << 20, Monthly: cfg.Monthly << 20, Action: action, Floor: cfg.Floor << 10, File: file}
+	if q.Floor <= 0 {
+		q.Floor = DEFAULT_QUOTA_FLOOR << 10
+	}
+	if file == "" {
+		return q, nil
+	}
+	if err := CheckAccess(file); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &q.usage); err != nil {
+			Log(WARNING, "Ignoring malformed transfer totals in %s: %v", file, err)
+		}
+	}
+	q.check(time.Now())
+	return q, nil
+}
+
+// check starts new periods and updates exceeded limit. Excess is logged
+// once per period. Must be called with lock held
+func (q *Quota) check(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if q.usage.Day != day {
+		q.usage.Day, q.usage.DayBytes = day, 0
+	}
+	if q.usage.Month != month {
+		q.usage.Month, q.usage.MonthBytes = month, 0
+	}
+	exceeded := ""
+	if q.Monthly > 0 && q.usage.MonthBytes >= q.Monthly {
+		exceeded = "monthly"
+	} else if q.Daily > 0 && q.usage.DayBytes >= q.Daily {
+		exceeded = "daily"
+	}
+	if exceeded != q.exceeded {
+		if exceeded != "" {
+			Log(WARNING, "Instance has exceeded %s transfer quota. Action: %s", exceeded, q.Action)
+		} else {
+			Log(INFO, "New quota period has started. Traffic is not limited anymore")
+		}
+		q.exceeded = exceeded
+	}
+}
+
+// Add accounts data exchanged with peers
+func (q *Quota) Add(size int) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	q.usage.DayBytes += int64(size)
+	q.usage.MonthBytes += int64(size)
+	q.dirty = true
+	q.check(time.Now())
+	q.lock.Unlock()
+}
+
+// Limit returns bandwidth instance is throttled to, or zero if it's not.
+// Paused is true when data traffic should be dropped
+func (q *Quota) Limit() (limit int64, paused bool) {
+	if q == nil {
+		return 0, false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.exceeded == "" {
+		return 0, false
+	}
+	switch q.Action {
+	case QUOTA_THROTTLE:
+		return q.Floor, false
+	case QUOTA_PAUSE:
+		return 0, true
+	}
+	return 0, false
+}
+
+// Usage returns transfer totals of current periods
+func (q *Quota) Usage() QuotaUsage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.check(time.Now())
+	return q.usage
+}
+
+// Save writes transfer totals into file. Unless forced, totals are
+// written only if they changed and QUOTA_SAVE_INTERVAL has passed
+func (q *Quota) Save(force bool) error {
+	if q == nil || q.File == "" {
+		return nil
+	}
+	q.lock.Lock()
+	if !q.dirty || (!force && time.Since(q.saved) < QUOTA_SAVE_INTERVAL) {
+		q.lock.Unlock()
+		return nil
+	}
+	data, err := yaml.Marshal(q.usage)
+	q.dirty = false
+	q.saved = time.Now()
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.File), 0700); err != nil {
+		return err
+	}
+	tmp := q.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.File)
+}
+
+func (q *Quota) String() string {
+	usage := q.Usage()
+	s := "Transfer:"
+	if q.Daily > 0 {
+		s += fmt.Sprintf(" %s/%s today", FormatBytes(usage.DayBytes), FormatBytes(q.Daily))
+	}
+	if q.Monthly > 0 {
+		s += fmt.Sprintf(" %s/%s this month", FormatBytes(usage.MonthBytes), FormatBytes(q.Monthly))
+	}
+	q.lock.Lock()
+	exceeded := q.exceeded
+	q.lock.Unlock()
+	if exceeded != "" {
+		s += fmt.Sprintf(" (%s quota exceeded: %s)", exceeded, q.Action)
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package ptp
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	if q, err := NewQuota(QuotaConfig{}, ""); q != nil || err != nil {
+		t.Errorf("Quota was created without limits: %v", err)
+	}
+	if _, err := NewQuota(QuotaConfig{Daily: 1, Action: "stop"}, ""); err == nil {
+		t.Errorf("Unknown action was accepted")
+	}
+
+	file := filepath.Join(t.TempDir(), "usage", "net.yaml")
+	q, err := NewQuota(QuotaConfig{Daily: 1, Action: "pause"}, file)
+	if err != nil {
+		t.Fatalf("Failed to create quota: %v", err)
+	}
+	r := NewResources(0, 0, 0)
+	r.Quota = q
+	if !r.Transfer(1<<20 - 1) {
+		t.Errorf("Data was dropped before quota was exceeded")
+	}
+	if !r.Transfer(1) || r.Transfer(1) {
+		t.Errorf("Instance was not paused after quota was exceeded")
+	}
+	if err := q.Save(true); err != nil {
+		t.Fatalf("Failed to save transfer totals: %v", err)
+	}
+
+	loaded, err := NewQuota(QuotaConfig{Daily: 2, Action: "throttle", Floor: 1}, file)
+	if err != nil {
+		t.Fatalf("Failed to load quota: %v", err)
+	}
+	if usage := loaded.Usage(); usage.DayBytes != 1<<20 || usage.MonthBytes != 1<<20 {
+		t.Errorf("Transfer totals were not loaded: %+v", usage)
+	}
+	if limit, paused := loaded.Limit(); limit != 0 || paused {
+		t.Errorf("Quota was exceeded after limit was raised")
+	}
+	loaded.Add(1 << 20)
+	if limit, paused := loaded.Limit(); limit != 1024 || paused {
+		t.Errorf("Instance was not throttled: %d %v", limit, paused)
+	}
+
+	loaded.lock.Lock()
+	loaded.check(time.Now().AddDate(0, 0, 1))
+	exceeded := loaded.exceeded
+	loaded.lock.Unlock()
+	if exceeded != "" {
+		t.Errorf("Quota was not reset in new period: %s", exceeded)
+	}
+}
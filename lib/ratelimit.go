@@ -0,0 +1,95 @@
+package ptp
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter maintains a token bucket for every source and decides
+// whether a packet received from this source should be processed
+type RateLimiter struct {
+	Rate        float64 // Number of packets allowed per second
+	Burst       float64 // Maximum number of packets allowed at once
+	dropped     uint64  // Number of packets that was rejected
+	buckets     map[string]*tokenBucket
+	recent      *list.List // Sources from the most to the least recently seen
+	lastCleanup time.Time
+	lock        sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	seen   *list.Element
+}
+
+// NewRateLimiter creates a limiter that allows `rate` packets per second
+// from a single source with bursts up to `burst` packets
+func NewRateLimiter(rate, burst float64) *RateLimiter {
+	r := new(RateLimiter)
+	r.Rate = rate
+	r.Burst = burst
+	r.buckets = make(map[string]*tokenBucket)
+	r.recent = list.New()
+	r.lastCleanup = time.Now()
+	return r
+}
+
+// Allow takes a token from the bucket of specified source. Returns false
+// when bucket is empty and packet should be dropped
+func (r *RateLimiter) Allow(source string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastCleanup) > RATE_LIMIT_CLEANUP {
+		r.cleanup(now)
+	}
+	bucket, exists := r.buckets[source]
+	if !exists {
+		if len(r.buckets) >= RATE_LIMIT_MAX_SOURCES {
+			// Table is full of active sources. Source that was silent
+			// for the longest time gives its place, so flood of spoofed
+			// sources can't lock out others
+			r.remove(r.recent.Back().Value.(string))
+		}
+		bucket = &tokenBucket{tokens: r.Burst, last: now}
+		bucket.seen = r.recent.PushFront(source)
+		r.buckets[source] = bucket
+	} else {
+		r.recent.MoveToFront(bucket.seen)
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * r.Rate
+	if bucket.tokens > r.Burst {
+		bucket.tokens = r.Burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		atomic.AddUint64(&r.dropped, 1)
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Dropped returns number of packets that was rejected
+func (r *RateLimiter) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// cleanup removes buckets of sources that were silent long enough for
+// their bucket to become full again
+func (r *RateLimiter) cleanup(now time.Time) {
+	for source, bucket := range r.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*r.Rate >= r.Burst {
+			r.remove(source)
+		}
+	}
+	r.lastCleanup = now
+}
+
+func (r *RateLimiter) remove(source string) {
+	r.recent.Remove(r.buckets[source].seen)
+	delete(r.buckets, source)
+}
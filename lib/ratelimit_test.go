@@ -0,0 +1,42 @@
+package ptp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := NewRateLimiter(1, 5)
+	for i := 0; i < 5; i++ {
+		if !r.Allow("10.0.0.1") {
+			t.Errorf("Packet %d was rejected within burst", i)
+		}
+	}
+	if r.Allow("10.0.0.1") {
+		t.Errorf("Packet above burst was allowed")
+	}
+	if !r.Allow("10.0.0.2") {
+		t.Errorf("Different source was limited")
+	}
+	if r.Dropped() != 1 {
+		t.Errorf("Wrong number of dropped packets: %d", r.Dropped())
+	}
+}
+
+func TestRateLimiterFlood(t *testing.T) {
+	// Spoofed sources evict the least recently seen ones instead of
+	// filling the table
+	r := NewRateLimiter(1, 10)
+	r.Allow("10.0.0.1")
+	for i := 0; i < RATE_LIMIT_MAX_SOURCES*2; i++ {
+		if !r.Allow(fmt.Sprintf("spoofed-%d", i)) {
+			t.Fatalf("New source %d was refused", i)
+		}
+		if i%1000 == 0 && !r.Allow("10.0.0.1") {
+			t.Fatalf("Active source was locked out")
+		}
+	}
+	if len(r.buckets) != RATE_LIMIT_MAX_SOURCES || r.recent.Len() != RATE_LIMIT_MAX_SOURCES {
+		t.Errorf("Table holds %d buckets, %d in order", len(r.buckets), r.recent.Len())
+	}
+}
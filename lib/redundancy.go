@@ -0,0 +1,97 @@
+package ptp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Dedup drops copies of data messages that were sent over several paths.
+// It remembers which of the last DEDUP_WINDOW sequence numbers were seen
+type Dedup struct {
+	highest uint16
+	seen    [DEDUP_WINDOW]bool
+	started bool
+	dropped uint64
+	lock    sync.Mutex
+}
+
+// Accept returns false if message with this sequence number was already
+// received. Messages older than the window are accepted, because there is
+// no way to tell whether they are copies
+func (d *Dedup) Accept(seq uint16) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.started {
+		d.started = true
+		d.highest = seq
+		d.seen[seq%DEDUP_WINDOW] = true
+		return true
+	}
+	ahead := seq - d.highest
+	if ahead != 0 && ahead < 0x8000 {
+		if ahead > DEDUP_WINDOW {
+			ahead = DEDUP_WINDOW
+		}
+		for i := uint16(1); i <= ahead; i++ {
+			d.seen[(d.highest+i)%DEDUP_WINDOW] = false
+		}
+		d.highest = seq
+		d.seen[seq%DEDUP_WINDOW] = true
+		return true
+	}
+	if d.highest-seq >= DEDUP_WINDOW {
+		return true
+	}
+	if d.seen[seq%DEDUP_WINDOW] {
+		d.dropped++
+		return false
+	}
+	d.seen[seq%DEDUP_WINDOW] = true
+	return true
+}
+
+// Dropped returns number of copies that were dropped
+func (d *Dedup) Dropped() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.dropped
+}
+
+// peerDedup returns deduplicator of the peer, creating it on first use
+func (p *PTPCloud) peerDedup(peer *NetworkPeer) *Dedup {
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	if peer.Dedup == nil {
+		peer.Dedup = new(Dedup)
+	}
+	return peer.Dedup
+}
+
+// keepBackup remembers current relay of the peer as redundant path before
+// peer switches to direct connection
+func (np *NetworkPeer) keepBackup() {
+	Log(INFO, "Keeping relay %s as redundant path to %s", np.Forwarder, np.ID)
+	np.Backup = np.Forwarder
+	np.BackupProxy = np.ProxyID
+}
+
+// dropBackup forgets redundant path of the peer and sequence numbers
+// received over it. Called before peer is resolved again
+func (np *NetworkPeer) dropBackup() {
+	np.Backup = nil
+	np.BackupProxy = 0
+	np.Dedup = nil
+}
+
+// sendRedundant sends a copy of data message over the relay kept as
+// redundant path. Receiver drops the copy that arrives last
+func (p *PTPCloud) sendRedundant(peer *NetworkPeer, msg *P2PMessage) {
+	backup := peer.Backup
+	if backup == nil || peer.Endpoint == nil || backup.String() == peer.Endpoint.String() {
+		return
+	}
+	msg.Header.ProxyId = uint16(peer.BackupProxy)
+	if _, err := p.UDPSocket.SendMessage(msg, backup); err == nil {
+		atomic.AddUint64(&peer.BytesCopied, uint64(len(msg.Data)))
+	}
+}
@@ -0,0 +1,56 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDedup(t *testing.T) {
+	d := new(Dedup)
+	for _, seq := range []uint16{65534, 65535, 0, 1} {
+		if !d.Accept(seq) {
+			t.Errorf("Message %d was dropped", seq)
+		}
+	}
+	for _, seq := range []uint16{65535, 0, 1} {
+		if d.Accept(seq) {
+			t.Errorf("Copy of message %d was accepted", seq)
+		}
+	}
+	if !d.Accept(5) || !d.Accept(3) || d.Accept(3) {
+		t.Errorf("Reordered messages were handled wrong")
+	}
+	if !d.Accept(5 + DEDUP_WINDOW*2) {
+		t.Errorf("Message far ahead was dropped")
+	}
+	if !d.Accept(5) {
+		t.Errorf("Message older than window was dropped")
+	}
+	if d.Dropped() != 4 {
+		t.Errorf("Expected 4 dropped copies, got %d", d.Dropped())
+	}
+}
+
+func TestRedundantPolicy(t *testing.T) {
+	p := new(PTPCloud)
+	peer := &NetworkPeer{ID: "Peer", PeerLocalIP: net.ParseIP("10.0.0.2"), Tags: []string{"voip"}, TagsConfirmed: true}
+	p.Redundant, _ = ParseTags("voip")
+	if policy := p.PathPolicy(peer); policy != PATH_REDUNDANT {
+		t.Errorf("Expected redundant policy, got %s", policy)
+	}
+	p.NoRelay, _ = ParseTags("10.0.0.2")
+	if policy := p.PathPolicy(peer); policy != PATH_NO_RELAY {
+		t.Errorf("No-relay didn't take precedence over redundancy: %s", policy)
+	}
+	peer.Forwarder = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6882}
+	peer.ProxyID = 7
+	peer.keepBackup()
+	if peer.Backup != peer.Forwarder || peer.BackupProxy != 7 {
+		t.Errorf("Relay wasn't kept as redundant path")
+	}
+	peer.Dedup = new(Dedup)
+	peer.dropBackup()
+	if peer.Backup != nil || peer.Dedup != nil {
+		t.Errorf("Redundant path wasn't dropped")
+	}
+}
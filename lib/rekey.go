@@ -0,0 +1,424 @@
+package ptp
+
+import (
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RekeyAnnouncement is sent over control channel to every connected member
+// of a network when network hash and secret are rotated. New key is sealed
+// to identity key of the member and announcement is signed with identity
+// of the announcer, so a leaked network key neither reveals nor forges it.
+// Rotation itself must be approved by admin key of the network or by a
+// rotation authority from config, so a member can't move others away
+type RekeyAnnouncement struct {
+	Hash      string    // New network hash
+	Key       []byte    // New key sealed to identity of the recipient
+	At        time.Time // Moment when every member should switch
+	Signature []byte    // Signature of the announcer's identity
+	Authority string    // Public key that approved rotation
+	Approval  []byte    // Signature of the authority
+}
+
+// NewRekeyAnnouncement prepares announcement of a new hash and key for the
+// recipient. Network is the current hash, so announcement can't be replayed
+// in another network
+func NewRekeyAnnouncement(id *Identity, network, recipient string, pub ed25519.PublicKey, hash string, key []byte, at time.Time) (*RekeyAnnouncement, error) {
+	sealed, err := sealKey(pub, key)
+	if err != nil {
+		return nil, err
+	}
+	ann := new(RekeyAnnouncement)
+	ann.Hash = hash
+	ann.Key = sealed
+	ann.At = time.Unix(at.Unix(), 0)
+	ann.Signature = id.Sign(ann.payload(network, recipient))
+	return ann, nil
+}
+
+// payload returns data covered by the signature
+func (r *RekeyAnnouncement) payload(network, recipient string) []byte {
+	return []byte(fmt.Sprintf("rekey|%s|%s|%s|%d|%s", network, recipient, r.Hash, r.At.Unix(), hex.EncodeToString(r.Key)))
+}
+
+// Verify checks that announcement for the recipient in the network was
+// signed by the announcer
+func (r *RekeyAnnouncement) Verify(network, recipient, announcer string, pub []byte) bool {
+	return VerifyIdentity(announcer, pub, r.payload(network, recipient), r.Signature)
+}
+
+// approvalPayload returns data authority signs to approve rotation. Hash of
+// the new key is covered, so a member can't pair approval with another key
+func approvalPayload(network, hash string, at time.Time, key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return []byte(fmt.Sprintf("rekey-approval|%s|%s|%d|%s", network, hash, at.Unix(), hex.EncodeToString(sum[:])))
+}
+
+// ApproveRekey signs rotation of the network to new hash and key at
+// specified time with key of admin or rotation authority
+func ApproveRekey(authority *Identity, network, hash string, key []byte, at time.Time) []byte {
+	return authority.Sign(approvalPayload(network, hash, at, key))
+}
+
+// Approved returns error unless rotation to the key was approved by one of
+// the authorities
+func (r *RekeyAnnouncement) Approved(network string, key []byte, authorities []string) error {
+	authorized := false
+	for _, authority := range authorities {
+		if authority == r.Authority {
+			authorized = true
+		}
+	}
+	if r.Authority == "" || !authorized {
+		return errors.New("Rotation isn't approved by admin key or rotation authority")
+	}
+	pub, err := hex.DecodeString(r.Authority)
+	if err != nil || len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, approvalPayload(network, r.Hash, r.At, key), r.Approval) {
+		return errors.New("Approval of rotation has bad signature")
+	}
+	return nil
+}
+
+// RekeyAuthorities returns keys that may approve rotation of the network
+func (p *PTPCloud) RekeyAuthorities() []string {
+	authorities := append([]string(nil), p.RekeyAuthority...)
+	if p.AdminKey != "" {
+		authorities = append(authorities, p.AdminKey)
+	}
+	return authorities
+}
+
+// Marshal returns announcement in a form of
+// HASH|AT|KEY|SIGNATURE|AUTHORITY|APPROVAL
+func (r *RekeyAnnouncement) Marshal() []byte {
+	return []byte(fmt.Sprintf("%s|%d|%s|%s|%s|%s", r.Hash, r.At.Unix(), hex.EncodeToString(r.Key), hex.EncodeToString(r.Signature),
+		r.Authority, hex.EncodeToString(r.Approval)))
+}
+
+// ParseRekeyAnnouncement is the reverse of Marshal
+func ParseRekeyAnnouncement(data []byte) (*RekeyAnnouncement, error) {
+	parts := strings.Split(string(data), "|")
+	if len(parts) != 6 || parts[0] == "" {
+		return nil, errors.New("Malformed rekey announcement")
+	}
+	at, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	ann := new(RekeyAnnouncement)
+	ann.Hash = parts[0]
+	ann.At = time.Unix(at, 0)
+	ann.Key, err = hex.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	ann.Signature, err = hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	ann.Authority = parts[4]
+	ann.Approval, err = hex.DecodeString(parts[5])
+	if err != nil {
+		return nil, err
+	}
+	return ann, nil
+}
+
+// sealKey encrypts key to an identity key. Ephemeral X25519 key is agreed
+// with Montgomery form of the identity key, so only owner of the identity
+// can open it. Result is EPHEMERAL|NONCE|CIPHERTEXT
+func sealKey(pub ed25519.PublicKey, key []byte) ([]byte, error) {
+	recipient, err := x25519PublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := sealCipher(keySecret(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	sealed := append([]byte{}, ephemeral.PublicKey().Bytes()...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed = append(sealed, nonce...)
+	return gcm.Seal(sealed, nonce, key, nil), nil
+}
+
+// openKey decrypts key sealed to the identity
+func openKey(id *Identity, sealed []byte) ([]byte, error) {
+	private, err := ecdh.X25519().NewPrivateKey(x25519PrivateKey(id.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 32 {
+		return nil, errors.New("Sealed key is too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := sealCipher(keySecret(shared, sealed[:32], private.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 32+gcm.NonceSize() {
+		return nil, errors.New("Sealed key is too short")
+	}
+	nonce := sealed[32 : 32+gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[32+gcm.NonceSize():], nil)
+}
+
+// keySecret derives secret of a sealed key from shared secret and both
+// public keys
+func keySecret(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+// curve25519P is the prime of Curve25519 and Edwards25519
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// x25519PublicKey converts Ed25519 public key to X25519 one: u = (1+y)/(1-y)
+func x25519PublicKey(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("Malformed identity key")
+	}
+	le := make([]byte, len(pub))
+	for i := range pub {
+		le[len(pub)-1-i] = pub[i]
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 || y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("Malformed identity key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+	be := u.FillBytes(make([]byte, 32))
+	for i := 0; i < 16; i++ {
+		be[i], be[31-i] = be[31-i], be[i]
+	}
+	return ecdh.X25519().NewPublicKey(be)
+}
+
+// x25519PrivateKey converts Ed25519 private key to X25519 scalar, which is
+// the first half of hashed seed, same as Ed25519 signing uses
+func x25519PrivateKey(priv ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(priv.Seed())
+	return h[:32]
+}
+
+// Rekey sends new network hash and key to every connected member together
+// with approval of the authority. At specified time all members, including
+// this one, will leave current network and join the new one. Members without
+// identity key or control channel aren't told and have to be moved to the
+// new network by hand
+func (p *PTPCloud) Rekey(hash string, key []byte, at time.Time, authority string, approval []byte) error {
+	if hash == p.Dht.NetworkHash {
+		return errors.New("New hash should differ from the current one")
+	}
+	if hash == "" || strings.Contains(hash, "|") {
+		return errors.New("Bad network hash: " + hash)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	if p.Identity == nil {
+		return errors.New("Identity is required to rotate network")
+	}
+	if time.Until(at) < 0 {
+		return errors.New("Time of rotation has passed")
+	}
+	own, err := NewRekeyAnnouncement(p.Identity, p.Dht.NetworkHash, p.Identity.ID, p.Identity.PublicKey, hash, key, at)
+	if err != nil {
+		return err
+	}
+	own.Authority = authority
+	own.Approval = approval
+	if err := own.Approved(p.Dht.NetworkHash, key, p.RekeyAuthorities()); err != nil {
+		return err
+	}
+	p.PeersLock.Lock()
+	var peers []*NetworkPeer
+	for _, peer := range p.NetworkPeers {
+		if peer.State == P_CONNECTED {
+			peers = append(peers, peer)
+		}
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		pub, err := hex.DecodeString(peer.PublicKey)
+		if peer.PublicKey == "" || err != nil {
+			Log(WARNING, "Peer %s has no identity key and won't be rotated", peer.ID)
+			continue
+		}
+		ann, err := NewRekeyAnnouncement(p.Identity, p.Dht.NetworkHash, peer.ID, ed25519.PublicKey(pub), hash, key, at)
+		if err == nil {
+			ann.Authority = authority
+			ann.Approval = approval
+			err = p.SendControl(peer, CONTROL_REKEY, ann.Marshal())
+		}
+		if err != nil {
+			Log(WARNING, "Failed to send rekey announcement to %s: %v", peer.ID, err)
+		}
+	}
+	p.setPendingRekey(own)
+	Log(INFO, "Network %s will be rotated to %s at %s", p.Dht.NetworkHash, hash, own.At.String())
+	return nil
+}
+
+// HandleRekeyControl accepts rotation announced by a member. Announcement
+// must be sealed to our identity, signed with identity of the member and
+// approved by admin key or rotation authority
+func (p *PTPCloud) HandleRekeyControl(peer *NetworkPeer, data []byte) {
+	ann, err := ParseRekeyAnnouncement(data)
+	if err != nil {
+		Log(ERROR, "Failed to parse rekey announcement of %s: %v", peer.ID, err)
+		return
+	}
+	pub, err := hex.DecodeString(peer.PublicKey)
+	if err != nil || !ann.Verify(p.Dht.NetworkHash, p.Identity.ID, peer.ID, pub) {
+		Log(WARNING, "Rekey announcement of %s has bad signature", peer.ID)
+		return
+	}
+	if ann.Hash == p.Dht.NetworkHash {
+		return
+	}
+	key, err := openKey(p.Identity, ann.Key)
+	if err != nil {
+		Log(WARNING, "Failed to open key of rekey announcement of %s: %v", peer.ID, err)
+		return
+	}
+	if err := ann.Approved(p.Dht.NetworkHash, key, p.RekeyAuthorities()); err != nil {
+		Log(WARNING, "Rejecting rekey announcement of %s: %v", peer.ID, err)
+		return
+	}
+	Log(INFO, "Received rekey announcement from %s. Network will be rotated at %s", peer.ID, ann.At.String())
+	p.setPendingRekey(ann)
+}
+
+// setPendingRekey remembers rotation to apply at its time
+func (p *PTPCloud) setPendingRekey(ann *RekeyAnnouncement) {
+	p.rekeyLock.Lock()
+	p.pendingRekey = ann
+	p.rekeyLock.Unlock()
+}
+
+// DueRekey returns rotation whose time has come. It's returned once
+func (p *PTPCloud) DueRekey() *RekeyAnnouncement {
+	p.rekeyLock.Lock()
+	defer p.rekeyLock.Unlock()
+	ann := p.pendingRekey
+	if ann == nil || time.Now().Before(ann.At) {
+		return nil
+	}
+	p.pendingRekey = nil
+	return ann
+}
+
+// ApplyRekey says goodbye to the current network and rejoins with new hash and key
+func (p *PTPCloud) ApplyRekey(ann *RekeyAnnouncement) error {
+	if time.Since(ann.At) > REKEY_MAX_AGE {
+		return errors.New("Rekey announcement is outdated")
+	}
+	key, err := openKey(p.Identity, ann.Key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to open key of rekey announcement: %v", err))
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	Log(INFO, "Rotating network %s to %s", p.Dht.NetworkHash, ann.Hash)
+	routers := p.Dht.Routers
+	p.leaveNetwork()
+
+	var newKey CryptoKey
+	newKey.Key = key
+	newKey.Until = p.CurrentCrypter().ActiveKey.Until
+	p.AddKey(newKey, true)
+
+	if p.IdentityFile == IdentityPath(p.Dht.NetworkHash) {
+		// Identity follows the network
+		p.IdentityFile = IdentityPath(ann.Hash)
+		if err := p.Identity.Save(p.IdentityFile); err != nil {
+			Log(WARNING, "Failed to save identity for network %s: %v", ann.Hash, err)
+		}
+	}
+	p.rejoinNetwork(ann.Hash, routers)
+	return nil
+}
+
+// leaveNetwork disconnects from routers and peers
+func (p *PTPCloud) leaveNetwork() {
+	p.Dht.Stop()
+	p.PeersLock.Lock()
+	for _, peer := range p.NetworkPeers {
+		peer.State = P_DISCONNECT
+	}
+	p.PeersLock.Unlock()
+}
+
+// rejoinNetwork connects to routers as a new member. Previous session
+// can't be resumed with another hash or identity
+func (p *PTPCloud) rejoinNetwork(hash, routers string) {
+	p.Dht.ResumeID = ""
+	p.Dht.ResumeToken = ""
+	p.StartDHT(hash, routers, 0)
+	p.Go(p.Dht.UpdatePeers)
+}
+
+// SwapKey replaces network key of a running instance. Interface and its
+// configuration are kept, while connected peers are asked to handshake
+// again, so they confirm that they use the new key too
+func (p *PTPCloud) SwapKey(key CryptoKey) error {
+	if _, err := aes.NewCipher(key.Key); err != nil {
+		return err
+	}
+	p.AddKey(key, true)
+	if p.Dht != nil && len(p.Dht.secret()) > 0 {
+		// Values sealed with the old key can't be opened by members
+		// that have the new one
+		p.Dht.SetSecret(DHTSecret(p.Dht.NetworkHash, key.Key))
+	}
+	Log(INFO, "Network key was replaced. Key valid until %s", key.Until.String())
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	for _, peer := range p.NetworkPeers {
+		if peer.State == P_CONNECTED && peer.Endpoint != nil {
+			// Endpoint is kept, so traffic keeps flowing while
+			// state machine handshakes with the new key
+			peer.State = P_HANDSHAKING
+		}
+	}
+	return nil
+}
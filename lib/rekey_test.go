@@ -0,0 +1,187 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRekeyAnnouncement(t *testing.T) {
+	announcer, _ := GenerateIdentity()
+	recipient, _ := GenerateIdentity()
+	key := []byte("fedcba9876543210fedcba9876543210")
+	ann, err := NewRekeyAnnouncement(announcer, "oldhash", recipient.ID, recipient.PublicKey, "newhash", key, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create rekey announcement: %v", err)
+	}
+	parsed, err := ParseRekeyAnnouncement(ann.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to parse rekey announcement: %v", err)
+	}
+	if !parsed.Verify("oldhash", recipient.ID, announcer.ID, announcer.PublicKey) {
+		t.Errorf("Valid announcement failed verification")
+	}
+	if parsed.Verify("oldhash", announcer.ID, announcer.ID, announcer.PublicKey) {
+		t.Errorf("Announcement was accepted by another recipient")
+	}
+	if parsed.Verify("otherhash", recipient.ID, announcer.ID, announcer.PublicKey) {
+		t.Errorf("Announcement was accepted in another network")
+	}
+	if parsed.Verify("oldhash", recipient.ID, recipient.ID, recipient.PublicKey) {
+		t.Errorf("Announcement was verified with a wrong identity")
+	}
+	opened, err := openKey(recipient, parsed.Key)
+	if err != nil || string(opened) != string(key) {
+		t.Errorf("Failed to open new key: %v", err)
+	}
+	if _, err := openKey(announcer, parsed.Key); err == nil {
+		t.Errorf("Key was opened by another identity")
+	}
+	parsed.Hash = "otherhash"
+	if parsed.Verify("oldhash", recipient.ID, announcer.ID, announcer.PublicKey) {
+		t.Errorf("Modified announcement passed verification")
+	}
+}
+
+func TestRekeyApproval(t *testing.T) {
+	admin, _ := GenerateIdentity()
+	member, _ := GenerateIdentity()
+	key := []byte("fedcba9876543210fedcba9876543210")
+	at := time.Now().Add(time.Minute)
+	ann, err := NewRekeyAnnouncement(member, "oldhash", admin.ID, admin.PublicKey, "newhash", key, at)
+	if err != nil {
+		t.Fatalf("Failed to create rekey announcement: %v", err)
+	}
+	ann.Authority = admin.PublicKeyString()
+	ann.Approval = ApproveRekey(admin, "oldhash", "newhash", key, at)
+	parsed, err := ParseRekeyAnnouncement(ann.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to parse rekey announcement: %v", err)
+	}
+	if parsed.Authority != ann.Authority || !bytes.Equal(parsed.Approval, ann.Approval) {
+		t.Errorf("Approval was lost: %+v", parsed)
+	}
+	authorities := []string{admin.PublicKeyString()}
+	if err := parsed.Approved("oldhash", key, authorities); err != nil {
+		t.Errorf("Approved rotation was rejected: %v", err)
+	}
+	if err := parsed.Approved("oldhash", key, nil); err == nil {
+		t.Errorf("Rotation was accepted without authorities")
+	}
+	if err := parsed.Approved("oldhash", key, []string{member.PublicKeyString()}); err == nil {
+		t.Errorf("Rotation was accepted from unknown authority")
+	}
+	if err := parsed.Approved("otherhash", key, authorities); err == nil {
+		t.Errorf("Approval was accepted in another network")
+	}
+	if err := parsed.Approved("oldhash", []byte("0123456789abcdef0123456789abcdef"), authorities); err == nil {
+		t.Errorf("Approval was accepted for another key")
+	}
+	// Member signs approval with its own key but claims admin approved it
+	parsed.Approval = ApproveRekey(member, "oldhash", "newhash", key, at)
+	if err := parsed.Approved("oldhash", key, authorities); err == nil {
+		t.Errorf("Approval signed by member was accepted")
+	}
+}
+
+func TestSealKey(t *testing.T) {
+	id, _ := GenerateIdentity()
+	private, err := ecdh.X25519().NewPrivateKey(x25519PrivateKey(id.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to convert private key: %v", err)
+	}
+	public, err := x25519PublicKey(id.PublicKey)
+	if err != nil || !public.Equal(private.PublicKey()) {
+		t.Fatalf("Converted keys don't match: %v", err)
+	}
+	for _, size := range []int{16, 24, 32} {
+		key := make([]byte, size)
+		key[0] = byte(size)
+		sealed, err := sealKey(id.PublicKey, key)
+		if err != nil {
+			t.Fatalf("Failed to seal key of %d bytes: %v", size, err)
+		}
+		opened, err := openKey(id, sealed)
+		if err != nil || len(opened) != size || opened[0] != byte(size) {
+			t.Errorf("Key of %d bytes was opened wrong: %v", size, err)
+		}
+	}
+}
+
+func TestSwapKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-key")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "key.yaml")
+	ioutil.WriteFile(keyfile, []byte("key: 01234567890123456789012345678901\nttl: \"2000000000\"\n"), 0600)
+	badfile := filepath.Join(dir, "bad.yaml")
+	ioutil.WriteFile(badfile, []byte("key: short\n"), 0600)
+
+	p := new(PTPCloud)
+	key, err := p.Crypter.LoadKeyFile(keyfile)
+	if err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+	if string(key.Key) != "01234567890123456789012345678901" || key.Until.Unix() != 2000000000 {
+		t.Errorf("Wrong key was loaded: %+v", key)
+	}
+	if _, err := p.Crypter.LoadKeyFile(badfile); err == nil {
+		t.Errorf("Key of wrong size was loaded")
+	}
+
+	endpoint := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 6881}
+	p.NetworkPeers = map[string]*NetworkPeer{
+		"connected": {ID: "connected", State: P_CONNECTED, Endpoint: endpoint},
+		"resolving": {ID: "resolving", State: P_INIT},
+	}
+	if err := p.SwapKey(key); err != nil {
+		t.Fatalf("Failed to swap key: %v", err)
+	}
+	if !p.Crypter.Active || string(p.Crypter.ActiveKey.Key) != string(key.Key) {
+		t.Errorf("Key was not activated")
+	}
+	if peer := p.NetworkPeers["connected"]; peer.State != P_HANDSHAKING || peer.Endpoint != endpoint {
+		t.Errorf("Connected peer should handshake again over the same endpoint")
+	}
+	if p.NetworkPeers["resolving"].State != P_INIT {
+		t.Errorf("State of unconnected peer was changed")
+	}
+
+	p.Dht = &DHTClient{NetworkHash: "hash", Secret: DHTSecret("hash", key.Key)}
+	other := CryptoKey{Key: []byte("abcdefghijklmnopqrstuvwxyz012345")}
+	if err := p.SwapKey(other); err != nil {
+		t.Fatalf("Failed to swap key: %v", err)
+	}
+	if !bytes.Equal(p.Dht.secret(), DHTSecret("hash", other.Key)) {
+		t.Errorf("DHT secret wasn't derived from the new key")
+	}
+}
+
+func TestSwapKeyWhileRunning(t *testing.T) {
+	// Keys are swapped while messages are encrypted by other goroutines
+	p := new(PTPCloud)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if c := p.CurrentCrypter(); c.Active && len(c.Keys) == 0 {
+				t.Errorf("Active key isn't in keys")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		p.SwapKey(CryptoKey{Key: []byte("01234567890123456789012345678901")})
+	}
+	<-done
+	if len(p.CryptoKeys()) != 100 {
+		t.Errorf("Keys were lost: %d", len(p.CryptoKeys()))
+	}
+}
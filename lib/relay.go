@@ -0,0 +1,202 @@
+package ptp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RelayAdmission decides whether a forwarder accepts new sessions. Relay
+// advertises its capacity to routers, reports load and refuses sessions
+// once it's saturated, asking clients to try another forwarder
+type RelayAdmission struct {
+	MaxSessions  int   // Zero means unlimited
+	MaxBandwidth int64 // Bytes per second. Zero means unlimited
+	RetryHint    time.Duration
+	sessions     map[string]bool
+	bandwidth    int64
+	rejected     uint64
+	lock         sync.Mutex
+}
+
+// NewRelayAdmission creates admission control with specified capacity
+func NewRelayAdmission(maxSessions int, maxBandwidth int64) *RelayAdmission {
+	return &RelayAdmission{
+		MaxSessions:  maxSessions,
+		MaxBandwidth: maxBandwidth,
+		RetryHint:    RELAY_RETRY_HINT,
+		sessions:     make(map[string]bool),
+	}
+}
+
+// saturated must be called with lock held
+func (a *RelayAdmission) saturated() bool {
+	if a.MaxSessions > 0 && float64(len(a.sessions)) >= float64(a.MaxSessions)*RELAY_SATURATION {
+		return true
+	}
+	return a.MaxBandwidth > 0 && float64(a.bandwidth) >= float64(a.MaxBandwidth)*RELAY_SATURATION
+}
+
+// Saturated returns true when new sessions are refused
+func (a *RelayAdmission) Saturated() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.saturated()
+}
+
+// Admit returns true if session may be relayed. Established sessions are
+// always admitted
+func (a *RelayAdmission) Admit(session string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.sessions[session] {
+		return true
+	}
+	if a.saturated() {
+		a.rejected++
+		return false
+	}
+	a.sessions[session] = true
+	return true
+}
+
+// Release frees capacity taken by a session
+func (a *RelayAdmission) Release(session string) {
+	a.lock.Lock()
+	delete(a.sessions, session)
+	a.lock.Unlock()
+}
+
+// SetBandwidth updates traffic currently relayed in bytes per second
+func (a *RelayAdmission) SetBandwidth(rate int64) {
+	a.lock.Lock()
+	a.bandwidth = rate
+	a.lock.Unlock()
+}
+
+// Capacity returns capacity advertised to routers in a form of
+// SESSIONS|BANDWIDTH
+func (a *RelayAdmission) Capacity() string {
+	return fmt.Sprintf("%d|%d", a.MaxSessions, a.MaxBandwidth)
+}
+
+// Load returns load reported to routers in a form of
+// SESSIONS|BANDWIDTH|SATURATED
+func (a *RelayAdmission) Load() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	saturated := 0
+	if a.saturated() {
+		saturated = 1
+	}
+	return fmt.Sprintf("%d|%d|%d", len(a.sessions), a.bandwidth, saturated)
+}
+
+func (a *RelayAdmission) String() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return fmt.Sprintf("Relay: %d/%d sessions, %s/s of %s/s, %d rejected", len(a.sessions), a.MaxSessions,
+		FormatBytes(a.bandwidth), FormatBytes(a.MaxBandwidth), a.rejected)
+}
+
+// CreateRelayBusyMessage answers proxy handshake of a client for peer at
+// addr, refusing the session. Client is asked not to use this forwarder
+// for retry duration
+func CreateRelayBusyMessage(addr string, retry time.Duration) *P2PMessage {
+	return CreateProxyP2PMessage(0, addr+"|"+RELAY_BUSY+"|"+strconv.Itoa(int(retry.Seconds())), 0)
+}
+
+// ParseRelayBusy reads message of a forwarder that refused the session.
+// Hint is clamped to RELAY_MAX_RETRY_HINT, so a forwarder can't make
+// clients avoid it forever
+func ParseRelayBusy(data []byte) (addr string, retry time.Duration, ok bool) {
+	parts := strings.Split(string(data), "|")
+	if len(parts) != 3 || parts[1] != RELAY_BUSY {
+		return "", 0, false
+	}
+	seconds, err := strconv.Atoi(parts[2])
+	if err != nil || seconds < 0 {
+		return "", 0, false
+	}
+	return parts[0], time.Duration(clamp(int64(seconds), 0, int64(RELAY_MAX_RETRY_HINT.Seconds()))) * time.Second, true
+}
+
+// MarkSaturated makes client avoid forwarder for retry duration
+func (dht *DHTClient) MarkSaturated(addr *net.UDPAddr, retry time.Duration) {
+	dht.ForwardersLock.Lock()
+	defer dht.ForwardersLock.Unlock()
+	if dht.SaturatedRelays == nil {
+		dht.SaturatedRelays = make(map[string]time.Time)
+	}
+	dht.SaturatedRelays[addr.String()] = time.Now().Add(retry)
+	for i, fwd := range dht.Forwarders {
+		if fwd.Addr.String() == addr.String() {
+			dht.Forwarders = append(dht.Forwarders[:i], dht.Forwarders[i+1:]...)
+			break
+		}
+	}
+}
+
+// SaturatedList returns forwarders that asked not to be used right now
+func (dht *DHTClient) SaturatedList() []*net.UDPAddr {
+	dht.ForwardersLock.Lock()
+	defer dht.ForwardersLock.Unlock()
+	var list []*net.UDPAddr
+	for addr, until := range dht.SaturatedRelays {
+		if time.Now().After(until) {
+			delete(dht.SaturatedRelays, addr)
+			continue
+		}
+		if resolved, err := net.ResolveUDPAddr("udp", addr); err == nil {
+			list = append(list, resolved)
+		}
+	}
+	return list
+}
+
+// IsSaturated returns true if forwarder asked not to be used right now
+func (dht *DHTClient) IsSaturated(addr *net.UDPAddr) bool {
+	dht.ForwardersLock.Lock()
+	defer dht.ForwardersLock.Unlock()
+	until, exists := dht.SaturatedRelays[addr.String()]
+	return exists && time.Now().Before(until)
+}
+
+// isForwarder returns true if routers handed out forwarder at addr
+func (dht *DHTClient) isForwarder(addr *net.UDPAddr) bool {
+	dht.ForwardersLock.Lock()
+	defer dht.ForwardersLock.Unlock()
+	for _, fwd := range dht.Forwarders {
+		if fwd.Addr.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleRelayBusy is called when forwarder refuses to relay traffic to a
+// peer. Peer handshaking with it looks for another forwarder. Refusals of
+// hosts that are not our forwarders are ignored, so nobody can push
+// instance away from its relays
+func (p *PTPCloud) HandleRelayBusy(msg *P2PMessage, src_addr *net.UDPAddr) {
+	addr, retry, ok := ParseRelayBusy(msg.Data)
+	if !ok {
+		return
+	}
+	if !p.Dht.isForwarder(src_addr) {
+		Log(DEBUG, "Ignoring refusal of %s: it's not a forwarder of this instance", src_addr)
+		return
+	}
+	Log(INFO, "Forwarder %s is saturated. Avoiding it for %s", src_addr, retry)
+	p.Dht.MarkSaturated(src_addr, retry)
+	p.PeersLock.Lock()
+	defer p.PeersLock.Unlock()
+	for _, peer := range p.NetworkPeers {
+		if peer.Forwarder != nil && peer.Forwarder.String() == src_addr.String() && peer.PeerAddr != nil && peer.PeerAddr.String() == addr && peer.ProxyID == 0 {
+			peer.RelayRejected = true
+		}
+	}
+}
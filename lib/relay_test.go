@@ -0,0 +1,124 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayAdmission(t *testing.T) {
+	a := NewRelayAdmission(10, 1000)
+	for i := 0; i < 9; i++ {
+		if !a.Admit(string(rune('a' + i))) {
+			t.Fatalf("Session %d was refused", i)
+		}
+	}
+	if a.Admit("new") || !a.Saturated() {
+		t.Errorf("Session was admitted to saturated relay")
+	}
+	if !a.Admit("a") {
+		t.Errorf("Established session was refused")
+	}
+	a.Release("a")
+	if !a.Admit("new") {
+		t.Errorf("Released capacity wasn't reused")
+	}
+	if a.Capacity() != "10|1000" || a.Load() != "9|0|1" {
+		t.Errorf("Wrong capacity %s or load %s", a.Capacity(), a.Load())
+	}
+	a.Release("new")
+	a.SetBandwidth(950)
+	if !a.Saturated() || a.Admit("new") {
+		t.Errorf("Bandwidth saturation was ignored")
+	}
+
+	msg := CreateRelayBusyMessage("203.0.113.5:6882", time.Minute)
+	parsed, err := P2PMessageFromBytes(msg.Serialize())
+	if err != nil || parsed.Header.Type != MT_PROXY || parsed.Header.ProxyId != 0 {
+		t.Fatalf("Wrong busy message: %+v %v", parsed, err)
+	}
+	addr, retry, ok := ParseRelayBusy(parsed.Data)
+	if !ok || addr != "203.0.113.5:6882" || retry != time.Minute {
+		t.Errorf("Wrong busy hint: %s %s %v", addr, retry, ok)
+	}
+	if _, retry, _ := ParseRelayBusy([]byte("addr|busy|999999")); retry != RELAY_MAX_RETRY_HINT {
+		t.Errorf("Retry hint wasn't clamped: %s", retry)
+	}
+	if _, _, ok := ParseRelayBusy([]byte("203.0.113.5:6882")); ok {
+		t.Errorf("Proxy confirmation was taken for refusal")
+	}
+}
+
+func TestRelayBusy(t *testing.T) {
+	p := new(PTPCloud)
+	p.Dht = new(DHTClient)
+	relay := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 7000}
+	p.Dht.Forwarders = []Forwarder{{Addr: relay, DestinationID: "remote"}}
+	peer := &NetworkPeer{ID: "remote", Forwarder: relay, PeerAddr: &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 6882}}
+	p.NetworkPeers = map[string]*NetworkPeer{"remote": peer}
+
+	stranger := &net.UDPAddr{IP: net.ParseIP("192.0.2.66"), Port: 7000}
+	p.HandleRelayBusy(CreateRelayBusyMessage(peer.PeerAddr.String(), time.Minute), stranger)
+	if p.Dht.IsSaturated(stranger) || len(p.Dht.Forwarders) != 1 {
+		t.Errorf("Refusal of a host that is not a forwarder was accepted")
+	}
+
+	p.HandleRelayBusy(CreateRelayBusyMessage(peer.PeerAddr.String(), time.Minute), relay)
+	if !peer.RelayRejected {
+		t.Errorf("Peer handshaking with saturated forwarder wasn't notified")
+	}
+	if !p.Dht.IsSaturated(relay) || len(p.Dht.Forwarders) != 0 {
+		t.Errorf("Saturated forwarder is still used")
+	}
+	if list := p.Dht.SaturatedList(); len(list) != 1 || list[0].String() != relay.String() {
+		t.Errorf("Wrong list of saturated forwarders: %v", list)
+	}
+	p.Dht.SaturatedRelays[relay.String()] = time.Now().Add(-time.Second)
+	if p.Dht.IsSaturated(relay) || len(p.Dht.SaturatedList()) != 0 {
+		t.Errorf("Forwarder was avoided after retry hint has passed")
+	}
+}
+
+func TestRelaySaturationRouting(t *testing.T) {
+	router, err := NewMockRouter()
+	if err != nil {
+		t.Fatalf("Failed to start mock router: %v", err)
+	}
+	router.Forwarders = []string{"10.0.0.9:7000"}
+	router.Start()
+	defer router.Close()
+
+	connect := func(port int) *DHTClient {
+		config := &DHTClient{Routers: router.Endpoint(), NetworkHash: "mock", P2PPort: port}
+		dht := new(DHTClient).Initialize(config, []net.IP{net.ParseIP("192.168.1.10")}, make(chan []PeerIP, 10), make(chan Forwarder, 10))
+		if dht == nil {
+			t.Fatalf("Client failed to connect to mock router")
+		}
+		return dht
+	}
+	relay := connect(7100)
+	defer relay.Stop()
+	relay.Relay = NewRelayAdmission(1, 0)
+	relay.RegisterControlPeer()
+	client := connect(7101)
+	defer client.Stop()
+
+	static := &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: 7000}
+	request := func() string {
+		client.RequestControlPeer("peer", []*net.UDPAddr{static})
+		select {
+		case fwd := <-client.ProxyChannel:
+			return fwd.Addr.String()
+		case <-time.After(time.Millisecond * 300):
+			return ""
+		}
+	}
+	if fwd := request(); fwd != "127.0.0.1:7100" {
+		t.Fatalf("Registered forwarder wasn't handed out: %q", fwd)
+	}
+	relay.Relay.Admit("session")
+	relay.ReportControlPeerLoad(1)
+	if !waitFor(func() bool { return request() == "" }) {
+		t.Errorf("Saturated forwarder was handed out")
+	}
+}
@@ -0,0 +1,30 @@
+package ptp
+
+// PathPolicy returns how connection to the peer may be established.
+// Peers listed in both RelayOnly and NoRelay are relayed, so endpoints
+// are never exposed by mistake. In privacy mode every peer is relayed.
+// Redundancy needs both paths, so other policies take precedence over it
+func (p *PTPCloud) PathPolicy(peer *NetworkPeer) PathPolicy {
+	if p.Private || p.peerListed(p.RelayOnly, peer) {
+		return PATH_RELAY_ONLY
+	}
+	if p.peerListed(p.NoRelay, peer) {
+		return PATH_NO_RELAY
+	}
+	if p.peerListed(p.Redundant, peer) {
+		return PATH_REDUNDANT
+	}
+	return PATH_AUTO
+}
+
+func (pp PathPolicy) String() string {
+	switch pp {
+	case PATH_RELAY_ONLY:
+		return "relay-only"
+	case PATH_NO_RELAY:
+		return "no-relay"
+	case PATH_REDUNDANT:
+		return "redundant"
+	}
+	return "auto"
+}
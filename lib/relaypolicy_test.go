@@ -0,0 +1,50 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPrivacyMode(t *testing.T) {
+	p := &PTPCloud{Private: true}
+	p.FindNetworkAddresses()
+	if len(p.LocalIPs) != 0 {
+		t.Errorf("Local addresses were collected in privacy mode: %v", p.LocalIPs)
+	}
+	dht := &DHTClient{P2PPort: 1234, IPList: p.LocalIPs, Stats: make(map[string]*RouterStats)}
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	if err := dht.Handshake(conn); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	msg, err := dht.Extract(conn.Sent()[0])
+	if err != nil {
+		t.Fatalf("Failed to parse handshake: %v", err)
+	}
+	if msg.Arguments != "1234" {
+		t.Errorf("Handshake advertises addresses: %s", msg.Arguments)
+	}
+}
+
+func TestPathPolicy(t *testing.T) {
+	p := new(PTPCloud)
+	peer := &NetworkPeer{ID: "Peer", PeerLocalIP: net.ParseIP("10.0.0.2"), Tags: []string{"untrusted"}}
+	if p.PathPolicy(peer) != PATH_AUTO {
+		t.Errorf("Peer isn't in auto mode by default")
+	}
+	p.NoRelay, _ = ParseTags("peer")
+	if policy := p.PathPolicy(peer); policy != PATH_NO_RELAY {
+		t.Errorf("Expected no-relay policy, got %s", policy)
+	}
+	p.RelayOnly, _ = ParseTags("10.0.0.2")
+	if policy := p.PathPolicy(peer); policy != PATH_RELAY_ONLY {
+		t.Errorf("Relay-only didn't take precedence over no-relay: %s", policy)
+	}
+	other := &NetworkPeer{ID: "other"}
+	if p.PathPolicy(other) != PATH_AUTO {
+		t.Errorf("Policy applied to unlisted peer")
+	}
+	p.Private = true
+	if policy := p.PathPolicy(other); policy != PATH_RELAY_ONLY {
+		t.Errorf("Peer isn't relayed in privacy mode: %s", policy)
+	}
+}
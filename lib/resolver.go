@@ -0,0 +1,338 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver is a caching stub resolver listening on the virtual interface.
+// Members that can't reconfigure DNS of the whole system, like embedded
+// devices, point single applications at it and resolve internal names
+// with a resolver of a designated peer. Upstreams are tried in order and
+// expired answers are served while none of them responds
+type Resolver struct {
+	hits      uint64
+	misses    uint64
+	stale     uint64
+	failed    uint64
+	Upstreams []string
+	Timeout   time.Duration // Wait for each upstream
+	conn      *net.UDPConn
+	cache     map[string]*cachedAnswer
+	lock      sync.Mutex
+}
+
+// cachedAnswer is a response of upstream with offsets of its TTLs, so
+// TTLs are decreased when answer is served from cache
+type cachedAnswer struct {
+	response []byte
+	ttls     []int
+	stored   time.Time
+	expires  time.Time
+}
+
+// ParseUpstreams parses comma-separated list of IP[:PORT] resolvers
+func ParseUpstreams(list string) ([]string, error) {
+	var upstreams []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, port := item, "53"
+		if h, p, err := net.SplitHostPort(item); err == nil {
+			host, port = h, p
+		}
+		if net.ParseIP(host) == nil || atoi(port) <= 0 || atoi(port) > 65535 {
+			return nil, errors.New(fmt.Sprintf("Bad resolver %s: should be IP[:PORT]", item))
+		}
+		upstreams = append(upstreams, net.JoinHostPort(host, port))
+	}
+	if len(upstreams) == 0 {
+		return nil, errors.New("No resolvers specified")
+	}
+	return upstreams, nil
+}
+
+// NewResolver listens for queries on the address
+func NewResolver(listen string, upstreams []string) (*Resolver, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{
+		Upstreams: upstreams,
+		Timeout:   DNS_STUB_TIMEOUT,
+		conn:      conn,
+		cache:     make(map[string]*cachedAnswer),
+	}, nil
+}
+
+// Addr returns address the resolver listens on
+func (r *Resolver) Addr() string {
+	return r.conn.LocalAddr().String()
+}
+
+// Serve answers queries until resolver is closed
+func (r *Resolver) Serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if response := r.Resolve(query); response != nil {
+				r.conn.WriteToUDP(response, addr)
+			}
+		}()
+	}
+}
+
+// Resolve returns response to the query. Malformed queries are not
+// answered
+func (r *Resolver) Resolve(query []byte) []byte {
+	key, ok := dnsQuestion(query)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	r.lock.Lock()
+	cached := r.cache[key]
+	r.lock.Unlock()
+	if cached != nil && now.Before(cached.expires) {
+		atomic.AddUint64(&r.hits, 1)
+		return cached.answer(query, uint32(cached.expires.Sub(now)/time.Second))
+	}
+	atomic.AddUint64(&r.misses, 1)
+	for _, upstream := range r.Upstreams {
+		response, err := r.exchange(upstream, query)
+		if err != nil {
+			Log(DEBUG, "Resolver %s failed: %v", upstream, err)
+			continue
+		}
+		r.store(key, response, now)
+		return response
+	}
+	if cached != nil && now.Sub(cached.expires) < DNS_CACHE_STALE {
+		atomic.AddUint64(&r.stale, 1)
+		return cached.answer(query, DNS_STALE_TTL)
+	}
+	atomic.AddUint64(&r.failed, 1)
+	return dnsServFail(query)
+}
+
+// exchange sends query to upstream and waits for matching response
+func (r *Resolver) exchange(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", upstream, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Responses to other queries are ignored
+		if n >= 12 && buf[0] == query[0] && buf[1] == query[1] && buf[2]&0x80 != 0 {
+			return append([]byte{}, buf[:n]...), nil
+		}
+	}
+}
+
+// store caches successful and negative answers for the lowest TTL of
+// their records
+func (r *Resolver) store(key string, response []byte, now time.Time) {
+	rcode := response[3] & 0x0f
+	if response[2]&0x02 != 0 || (rcode != 0 && rcode != 3) {
+		// Truncated answers and failures are not cached
+		return
+	}
+	ttls, min, ok := dnsTTLs(response)
+	if !ok || len(ttls) == 0 || min == 0 {
+		return
+	}
+	lifetime := time.Duration(min) * time.Second
+	if lifetime > DNS_CACHE_MAX_TTL {
+		lifetime = DNS_CACHE_MAX_TTL
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.cache) >= DNS_CACHE_SIZE {
+		r.evict(now)
+	}
+	r.cache[key] = &cachedAnswer{response: response, ttls: ttls, stored: now, expires: now.Add(lifetime)}
+}
+
+// evict removes answers that can't be served anymore. Oldest answer is
+// removed if all of them can
+func (r *Resolver) evict(now time.Time) {
+	var oldest string
+	for key, a := range r.cache {
+		if now.Sub(a.expires) >= DNS_CACHE_STALE {
+			delete(r.cache, key)
+		} else if oldest == "" || a.stored.Before(r.cache[oldest].stored) {
+			oldest = key
+		}
+	}
+	if len(r.cache) >= DNS_CACHE_SIZE {
+		delete(r.cache, oldest)
+	}
+}
+
+// answer returns copy of cached response to the query with TTLs set to
+// time left
+func (a *cachedAnswer) answer(query []byte, ttl uint32) []byte {
+	response := append([]byte{}, a.response...)
+	copy(response[0:2], query[0:2])
+	for _, off := range a.ttls {
+		binary.BigEndian.PutUint32(response[off:off+4], ttl)
+	}
+	return response
+}
+
+// Close stops the resolver
+func (r *Resolver) Close() {
+	r.conn.Close()
+}
+
+func (r *Resolver) String() string {
+	r.lock.Lock()
+	cached := len(r.cache)
+	r.lock.Unlock()
+	return fmt.Sprintf("Resolver %s via %s: %d cached, %d hits, %d misses, %d stale, %d failed",
+		r.Addr(), strings.Join(r.Upstreams, ","), cached, atomic.LoadUint64(&r.hits), atomic.LoadUint64(&r.misses),
+		atomic.LoadUint64(&r.stale), atomic.LoadUint64(&r.failed))
+}
+
+// dnsQuestion returns question of a query as cache key. Names are
+// case-insensitive
+func dnsQuestion(msg []byte) (string, bool) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return "", false
+	}
+	end, ok := skipDNSName(msg, 12)
+	if !ok || end+4 > len(msg) {
+		return "", false
+	}
+	return strings.ToLower(string(msg[12 : end+4])), true
+}
+
+// skipDNSName returns offset following the name that starts at off
+func skipDNSName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, true
+		case length&0xc0 == 0xc0:
+			// Compression pointer ends the name
+			return off + 2, off+2 <= len(msg)
+		case length&0xc0 != 0:
+			return 0, false
+		}
+		off += length + 1
+	}
+	return 0, false
+}
+
+// dnsTTLs returns offsets of TTLs of every record in response and the
+// lowest of them. TTL of OPT pseudo-record holds flags and is skipped
+func dnsTTLs(msg []byte) ([]int, uint32, bool) {
+	if len(msg) < 12 {
+		return nil, 0, false
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		end, ok := skipDNSName(msg, off)
+		if !ok {
+			return nil, 0, false
+		}
+		off = end + 4
+	}
+	records := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) +
+		int(binary.BigEndian.Uint16(msg[10:12]))
+	var ttls []int
+	var min uint32
+	for i := 0; i < records; i++ {
+		end, ok := skipDNSName(msg, off)
+		if !ok || end+10 > len(msg) {
+			return nil, 0, false
+		}
+		rtype := binary.BigEndian.Uint16(msg[end : end+2])
+		if rtype != 41 {
+			ttl := binary.BigEndian.Uint32(msg[end+4 : end+8])
+			if len(ttls) == 0 || ttl < min {
+				min = ttl
+			}
+			ttls = append(ttls, end+4)
+		}
+		off = end + 10 + int(binary.BigEndian.Uint16(msg[end+8:end+10]))
+		if off > len(msg) {
+			return nil, 0, false
+		}
+	}
+	return ttls, min, true
+}
+
+// dnsServFail returns SERVFAIL response to the query
+func dnsServFail(query []byte) []byte {
+	key, _ := dnsQuestion(query)
+	response := make([]byte, 12, 12+len(key))
+	copy(response[0:2], query[0:2])
+	response[2] = 0x80 | query[2]&0x79 // QR, opcode and RD of the query
+	response[3] = 0x82                 // RA, SERVFAIL
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	return append(response, query[12:12+len(key)]...)
+}
+
+// StartResolver starts stub resolver on the virtual interface. First
+// upstream must be on the virtual network, so names are resolved by a
+// peer. Others are fallbacks and may be anywhere
+func (p *PTPCloud) StartResolver(list string) error {
+	if list == "" {
+		return nil
+	}
+	upstreams, err := ParseUpstreams(list)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(upstreams[0])
+	if !p.OnVirtualNetwork(net.ParseIP(host)) {
+		return errors.New(fmt.Sprintf("Resolver %s is not on the virtual network", host))
+	}
+	r, err := NewResolver(JoinEndpoint(p.IP, DNS_STUB_PORT), upstreams)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to start resolver: %v", err))
+	}
+	p.Resolver = r
+	p.Go(r.Serve)
+	Log(INFO, "Resolver listens on %s and forwards queries to %s", r.Addr(), strings.Join(upstreams, ","))
+	return nil
+}
+
+// StopResolver stops stub resolver
+func (p *PTPCloud) StopResolver() {
+	if p.Resolver == nil {
+		return
+	}
+	p.Resolver.Close()
+	Log(INFO, "%s", p.Resolver.String())
+}
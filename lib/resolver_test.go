@@ -0,0 +1,129 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsQuery builds query for A record of the name
+func dnsQuery(id uint16, name string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1)
+}
+
+// fakeUpstream answers every query with A record of 10.0.0.1 and TTL
+// of 60 seconds
+func fakeUpstream(t *testing.T, queries *uint64) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start upstream: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddUint64(queries, 1)
+			response := append([]byte{}, buf[:n]...)
+			response[2] |= 0x80
+			response[3] = 0x80
+			binary.BigEndian.PutUint16(response[6:8], 1)
+			response = append(response, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 0, 0, 1)
+			conn.WriteToUDP(response, addr)
+		}
+	}()
+	return conn
+}
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := ParseUpstreams("10.10.0.53, 10.10.0.54:5353,fd00::53")
+	if err != nil {
+		t.Fatalf("Failed to parse resolvers: %v", err)
+	}
+	if strings.Join(upstreams, ",") != "10.10.0.53:53,10.10.0.54:5353,[fd00::53]:53" {
+		t.Errorf("Wrong resolvers: %v", upstreams)
+	}
+	for _, bad := range []string{"", "dns.example", "10.10.0.53:0", "10.10.0.53:dns"} {
+		if _, err := ParseUpstreams(bad); err == nil {
+			t.Errorf("Bad list of resolvers %q was accepted", bad)
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	var queries uint64
+	upstream := fakeUpstream(t, &queries)
+	// Nothing listens on port of closed socket, so first upstream fails
+	dead, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	dead.Close()
+
+	r, err := NewResolver("127.0.0.1:0", []string{dead.LocalAddr().String(), upstream.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("Failed to start resolver: %v", err)
+	}
+	defer r.Close()
+	r.Timeout = time.Millisecond * 200
+	go r.Serve()
+
+	client, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Fatalf("Failed to connect to resolver: %v", err)
+	}
+	defer client.Close()
+	client.Write(dnsQuery(1, "db.corp"))
+	client.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buf := make([]byte, 512)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Resolver didn't answer: %v", err)
+	}
+	if binary.BigEndian.Uint16(buf[0:2]) != 1 || binary.BigEndian.Uint16(buf[6:8]) != 1 || n != len(dnsQuery(1, "db.corp"))+16 {
+		t.Fatalf("Wrong answer of fallback resolver: %x", buf[:n])
+	}
+
+	cached := r.Resolve(dnsQuery(2, "DB.corp"))
+	if atomic.LoadUint64(&queries) != 1 {
+		t.Errorf("Cached answer was requested again")
+	}
+	if binary.BigEndian.Uint16(cached[0:2]) != 2 {
+		t.Errorf("ID of cached answer wasn't replaced")
+	}
+	if ttl := binary.BigEndian.Uint32(cached[len(cached)-10:]); ttl == 0 || ttl > 60 {
+		t.Errorf("Wrong TTL of cached answer: %d", ttl)
+	}
+
+	// Upstreams are gone: expired answer is served
+	upstream.Close()
+	r.lock.Lock()
+	for _, a := range r.cache {
+		a.expires = time.Now().Add(-time.Minute)
+	}
+	r.lock.Unlock()
+	stale := r.Resolve(dnsQuery(3, "db.corp"))
+	if ttl := binary.BigEndian.Uint32(stale[len(stale)-10:]); ttl != DNS_STALE_TTL {
+		t.Errorf("Wrong TTL of stale answer: %d", ttl)
+	}
+	failed := r.Resolve(dnsQuery(4, "web.corp"))
+	if binary.BigEndian.Uint16(failed[0:2]) != 4 || failed[3]&0x0f != 2 {
+		t.Errorf("Resolver didn't fail unknown name: %x", failed)
+	}
+	if !strings.HasSuffix(r.String(), "1 cached, 1 hits, 3 misses, 1 stale, 1 failed") {
+		t.Errorf("Wrong counters: %s", r)
+	}
+	if r.Resolve([]byte{1, 2, 3}) != nil {
+		t.Errorf("Malformed query was answered")
+	}
+}
@@ -0,0 +1,90 @@
+package ptp
+
+import (
+	"net"
+)
+
+// isPublicIP returns true if IP is routable on the internet
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !isPrivateIP(ip)
+}
+
+// PublicIPs returns addresses routers see this host at. Routers list them
+// in answer to request of our own addresses. Empty until it arrives
+func (p *PTPCloud) PublicIPs() []net.IP {
+	if p.Dht == nil || p.Dht.ID == "" {
+		return nil
+	}
+	var ips []net.IP
+	for _, peer := range p.Dht.PeerList() {
+		if peer.ID != p.Dht.ID {
+			continue
+		}
+		for _, addr := range peer.Ips {
+			if isPublicIP(addr.IP) {
+				ips = append(ips, addr.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// BehindSameNAT returns true if peer is seen by routers at one of our
+// public addresses, which means both hosts are behind the same NAT
+func (np *NetworkPeer) BehindSameNAT(ptpc *PTPCloud) bool {
+	public := ptpc.PublicIPs()
+	for _, kip := range np.KnownIPs {
+		for _, ip := range public {
+			if kip.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onLocalNetwork returns true if IP belongs to a network of one of local
+// interfaces other than the virtual one
+func onLocalNetwork(ip net.IP, device string) bool {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, inf := range interfaces {
+		if inf.Name == device {
+			continue
+		}
+		addrs, _ := inf.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProbeSameNAT connects to a peer behind the same NAT at its private
+// addresses. Such peers are often in another subnet of the same site,
+// and NATs that don't support hairpinning drop traffic sent to their own
+// public address, so it would be relayed through the internet otherwise.
+// Addresses in networks of local interfaces were already probed as LAN
+func (np *NetworkPeer) ProbeSameNAT(ptpc *PTPCloud) bool {
+	if !np.BehindSameNAT(ptpc) {
+		return false
+	}
+	Log(INFO, "Peer %s is behind the same NAT. Probing its private addresses", np.ID)
+	for _, kip := range np.KnownIPs {
+		if !isPrivateIP(kip.IP) || onLocalNetwork(kip.IP, ptpc.DeviceName) {
+			continue
+		}
+		Log(DEBUG, "Probing private address %s of %s", kip, np.ID)
+		if np.TestConnection(ptpc, kip) {
+			np.Endpoint = kip
+			Log(INFO, "Setting endpoint for %s to %s", np.ID, kip.String())
+			return true
+		}
+	}
+	np.LastError = "Private addresses of peer behind the same NAT didn't answer"
+	return false
+}
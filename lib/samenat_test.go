@@ -0,0 +1,47 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBehindSameNAT(t *testing.T) {
+	p := new(PTPCloud)
+	p.Dht = &DHTClient{ID: "local"}
+	peer := &NetworkPeer{ID: "remote"}
+	peer.KnownIPs = []*net.UDPAddr{
+		{IP: net.ParseIP("203.0.113.5"), Port: 6882},
+		{IP: net.ParseIP("10.0.2.15"), Port: 6882},
+	}
+	if peer.BehindSameNAT(p) {
+		t.Errorf("Peer was considered behind the same NAT before our addresses are known")
+	}
+
+	p.Dht.Peers = []PeerIP{
+		{ID: "remote", Ips: peer.KnownIPs},
+		{ID: "local", Ips: []*net.UDPAddr{
+			{IP: net.ParseIP("198.51.100.7"), Port: 6881},
+			{IP: net.ParseIP("10.0.1.20"), Port: 6881},
+		}},
+	}
+	if ips := p.PublicIPs(); len(ips) != 1 || !ips[0].Equal(net.ParseIP("198.51.100.7")) {
+		t.Errorf("Wrong public addresses: %v", ips)
+	}
+	if peer.BehindSameNAT(p) {
+		t.Errorf("Peer with another public address was considered behind the same NAT")
+	}
+
+	p.Dht.Peers[1].Ips[0].IP = net.ParseIP("203.0.113.5")
+	if !peer.BehindSameNAT(p) {
+		t.Errorf("Peer behind the same NAT was not detected")
+	}
+}
+
+func TestOnLocalNetwork(t *testing.T) {
+	if !onLocalNetwork(net.ParseIP("127.0.0.2"), "") {
+		t.Errorf("Loopback network was not considered local")
+	}
+	if onLocalNetwork(net.ParseIP("127.0.0.2"), "lo") && onLocalNetwork(net.ParseIP("127.0.0.2"), "lo0") {
+		t.Errorf("Network of skipped interface was considered local")
+	}
+}
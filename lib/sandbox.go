@@ -0,0 +1,172 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replies of sandbox worker start with one of these bytes
+const (
+	sandboxReady  byte = 1 // Filter is installed and worker waits for messages
+	sandboxAccept byte = 2 // Followed by message in canonical form
+	sandboxReject byte = 3 // Followed by reason
+)
+
+// Largest datagram passed to the worker
+const sandboxBuffer int = 65536 + HEADER_SIZE + 1
+
+// Sandbox parses messages received from the network in a worker process
+// restricted by seccomp filter. Worker returns messages in canonical form,
+// so the daemon never runs the parser on data from the network. Worker
+// that crashed or hung is restarted and the message is dropped
+type Sandbox struct {
+	parsed   uint64
+	rejected uint64
+	restarts uint64
+	command  func() *exec.Cmd
+	cmd      *exec.Cmd
+	conn     net.Conn
+	buf      []byte
+	next     time.Time // Worker isn't restarted before that
+	lock     sync.Mutex
+}
+
+// SandboxCommand runs worker from executable of the daemon
+func SandboxCommand() *exec.Cmd {
+	binary, err := os.Executable()
+	if err != nil {
+		binary = os.Args[0]
+	}
+	return exec.Command(binary, SANDBOX_COMMAND)
+}
+
+// NewSandbox creates sandbox that runs workers with command
+func NewSandbox(command func() *exec.Cmd) *Sandbox {
+	return &Sandbox{command: command, buf: make([]byte, sandboxBuffer)}
+}
+
+// Start runs worker and waits until its filter is installed
+func (s *Sandbox) Start() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.start()
+}
+
+func (s *Sandbox) start() error {
+	s.next = time.Now().Add(SANDBOX_RESTART_DELAY)
+	cmd := s.command()
+	conn, err := startSandboxWorker(cmd)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(SANDBOX_TIMEOUT))
+	n, err := conn.Read(s.buf)
+	if err != nil || n != 1 || s.buf[0] != sandboxReady {
+		conn.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New(fmt.Sprintf("Sandbox worker failed to start: %v", err))
+	}
+	s.cmd, s.conn = cmd, conn
+	Log(DEBUG, "Sandbox worker %d started", cmd.Process.Pid)
+	return nil
+}
+
+// stop kills the worker
+func (s *Sandbox) stop() {
+	if s.cmd == nil {
+		return
+	}
+	s.conn.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+	s.cmd, s.conn = nil, nil
+}
+
+// Close kills the worker. Sandbox can't be used afterwards
+func (s *Sandbox) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stop()
+	s.next = time.Unix(1<<62, 0)
+}
+
+// Parse passes datagram to the worker and returns message it produced
+func (s *Sandbox) Parse(data []byte) (*P2PMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cmd == nil {
+		if time.Now().Before(s.next) {
+			return nil, errors.New("Sandbox worker is not running")
+		}
+		atomic.AddUint64(&s.restarts, 1)
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(SANDBOX_TIMEOUT))
+	_, err := s.conn.Write(data)
+	n := 0
+	if err == nil {
+		n, err = s.conn.Read(s.buf)
+	}
+	if err != nil || n == 0 {
+		Log(ERROR, "Sandbox worker failed: %v. Restarting", err)
+		s.stop()
+		return nil, errors.New(fmt.Sprintf("Sandbox worker failed: %v", err))
+	}
+	reply := s.buf[:n]
+	if reply[0] != sandboxAccept || len(reply) < 1+HEADER_SIZE {
+		atomic.AddUint64(&s.rejected, 1)
+		return nil, fmt.Errorf("%w: %s", ErrMalformedMessage, reply[1:])
+	}
+	atomic.AddUint64(&s.parsed, 1)
+	return canonicalMessage(reply[1:]), nil
+}
+
+// canonicalMessage reads message produced by the worker. Worker checked the
+// header, so only its fields are copied
+func canonicalMessage(data []byte) *P2PMessage {
+	msg := &P2PMessage{Header: new(P2PMessageHeader)}
+	fields := []*uint16{&msg.Header.Magic, &msg.Header.Type, &msg.Header.Length, &msg.Header.NetProto,
+		&msg.Header.ProxyId, &msg.Header.SerializedLen, &msg.Header.Complete, &msg.Header.Id, &msg.Header.Seq}
+	for i, field := range fields {
+		*field = binary.BigEndian.Uint16(data[i*2:])
+	}
+	msg.Data = make([]byte, len(data)-HEADER_SIZE)
+	copy(msg.Data, data[HEADER_SIZE:])
+	return msg
+}
+
+// sandboxHandle parses datagram the way daemon does and builds reply of
+// the worker
+func sandboxHandle(data []byte) (reply []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			reply = append([]byte{sandboxReject}, fmt.Sprintf("parser panic: %v", r)...)
+		}
+	}()
+	msg, err := P2PMessageFromBytes(data)
+	if err != nil {
+		return append([]byte{sandboxReject}, err.Error()...)
+	}
+	return append([]byte{sandboxAccept}, msg.Serialize()...)
+}
+
+func (s *Sandbox) String() string {
+	pid := 0
+	s.lock.Lock()
+	if s.cmd != nil {
+		pid = s.cmd.Process.Pid
+	}
+	s.lock.Unlock()
+	return fmt.Sprintf("Sandbox worker %d: %d parsed, %d rejected, %d restarts", pid,
+		atomic.LoadUint64(&s.parsed), atomic.LoadUint64(&s.rejected), atomic.LoadUint64(&s.restarts))
+}
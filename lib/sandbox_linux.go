@@ -0,0 +1,133 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Values from linux/seccomp.h
+const (
+	seccompSetModeFilter    = 1
+	seccompFlagTsync        = 1
+	seccompRetKillProcess   = 0x80000000
+	seccompRetAllow         = 0x7fff0000
+	seccompDataNrOffset     = 0
+	seccompDataArchOffset   = 4
+	sandboxWorkerDescriptor = 3
+)
+
+// System calls allowed to the worker: exchanging messages with the daemon
+// and what Go runtime needs for memory, threads and signals. Threads of
+// cgo builds are started by libc, which also registers rseq and robust
+// futex list
+var sandboxSyscalls = []uintptr{
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV,
+	unix.SYS_RECVMSG, unix.SYS_SENDMSG, unix.SYS_RECVFROM, unix.SYS_SENDTO,
+	unix.SYS_CLOSE, unix.SYS_FCNTL, unix.SYS_EPOLL_PWAIT, unix.SYS_EPOLL_CTL,
+	unix.SYS_FUTEX, unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MADVISE, unix.SYS_MPROTECT,
+	unix.SYS_CLONE, unix.SYS_GETTID, unix.SYS_GETPID, unix.SYS_TGKILL,
+	unix.SYS_RT_SIGRETURN, unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_SIGALTSTACK,
+	unix.SYS_NANOSLEEP, unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY, unix.SYS_GETRANDOM, unix.SYS_RESTART_SYSCALL,
+	unix.SYS_EXIT, unix.SYS_EXIT_GROUP,
+	unix.SYS_CLONE3, unix.SYS_RSEQ, unix.SYS_SET_ROBUST_LIST,
+}
+
+// seccompFilter builds BPF program that kills the process on any system
+// call not in the list or made with foreign architecture
+func seccompFilter(arch uint32, syscalls []uintptr) []unix.SockFilter {
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArchOffset},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNrOffset},
+	}
+	for i, nr := range syscalls {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(len(syscalls) - i), K: uint32(nr)})
+	}
+	return append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+}
+
+// installSeccomp restricts all threads of the process to sandboxSyscalls
+func installSeccomp() error {
+	filter := seccompFilter(seccompArch, append(sandboxSyscalls, seccompArchSyscalls...))
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.New(fmt.Sprintf("Failed to set no_new_privs: %v", err))
+	}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return errors.New(fmt.Sprintf("Failed to install seccomp filter: %v", errno))
+	}
+	if r != 0 {
+		return errors.New(fmt.Sprintf("Failed to apply seccomp filter to thread %d", r))
+	}
+	return nil
+}
+
+// startSandboxWorker runs worker connected with a socket pair. Worker
+// exits when the daemon dies, since only the daemon holds the other end
+// of the pair and worker reads end of file then. Parent death signal isn't
+// used: it is sent when the thread that started worker exits, and Go
+// runtime may end that thread while the daemon keeps running
+func startSandboxWorker(cmd *exec.Cmd) (net.Conn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "sandbox")
+	remote := os.NewFile(uintptr(fds[1]), "sandbox-worker")
+	defer local.Close()
+	defer remote.Close()
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to start sandbox worker: %v", err))
+	}
+	conn, err := net.FileConn(local)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// SandboxWorker installs seccomp filter and parses messages sent by the
+// daemon until it goes away. Never returns
+func SandboxWorker() {
+	conn := os.NewFile(sandboxWorkerDescriptor, "sandbox")
+	fd := int(conn.Fd())
+	if err := installSeccomp(); err != nil {
+		Log(ERROR, "%v", err)
+		os.Exit(1)
+	}
+	unix.Write(fd, []byte{sandboxReady})
+	buf := make([]byte, sandboxBuffer)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil || n == 0 {
+			os.Exit(0)
+		}
+		unix.Write(fd, sandboxHandle(buf[:n]))
+	}
+}
@@ -0,0 +1,8 @@
+package ptp
+
+import "golang.org/x/sys/unix"
+
+const seccompArch uint32 = unix.AUDIT_ARCH_X86_64
+
+// System calls of Go runtime that exist only on amd64
+var seccompArchSyscalls = []uintptr{unix.SYS_EPOLL_WAIT, unix.SYS_ARCH_PRCTL}
@@ -0,0 +1,7 @@
+package ptp
+
+import "golang.org/x/sys/unix"
+
+const seccompArch uint32 = unix.AUDIT_ARCH_AARCH64
+
+var seccompArchSyscalls []uintptr
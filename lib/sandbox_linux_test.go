@@ -0,0 +1,89 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package ptp
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestSandboxWorkerProcess is the worker started by TestSandbox
+func TestSandboxWorkerProcess(t *testing.T) {
+	if os.Getenv("P2P_SANDBOX_WORKER") != "1" {
+		return
+	}
+	SandboxWorker()
+}
+
+func TestSandbox(t *testing.T) {
+	s := NewSandbox(func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSandboxWorkerProcess$")
+		cmd.Env = append(os.Environ(), "P2P_SANDBOX_WORKER=1")
+		return cmd
+	})
+	if err := s.Start(); err != nil {
+		t.Skipf("Seccomp is not available: %v", err)
+	}
+	defer s.Close()
+	msg := CreateTestP2PMessage(Crypto{}, "hello", 1)
+	for i := 0; i < 100; i++ {
+		parsed, err := s.Parse(msg.Serialize())
+		if err != nil {
+			t.Fatalf("Failed to parse message: %v", err)
+		}
+		if parsed.Header.Type != MT_TEST || string(parsed.Data) != "hello" {
+			t.Fatalf("Wrong message: %+v %q", parsed.Header, parsed.Data)
+		}
+	}
+	if _, err := s.Parse([]byte{1, 2, 3}); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Malformed message wasn't rejected: %v", err)
+	}
+	// Worker is restarted after crash
+	s.lock.Lock()
+	s.cmd.Process.Kill()
+	s.next = s.next.Add(-SANDBOX_RESTART_DELAY)
+	s.lock.Unlock()
+	if _, err := s.Parse(msg.Serialize()); err == nil {
+		t.Errorf("Message was parsed by killed worker")
+	}
+	if _, err := s.Parse(msg.Serialize()); err != nil {
+		t.Errorf("Worker wasn't restarted: %v", err)
+	}
+	if s.restarts != 1 || s.rejected != 1 || s.parsed != 101 {
+		t.Errorf("Wrong counters: %s", s.String())
+	}
+}
+
+func TestSandboxWorkerExit(t *testing.T) {
+	// Worker goes away with the daemon, which closes its end of the pair
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandboxWorkerProcess$")
+	cmd.Env = append(os.Environ(), "P2P_SANDBOX_WORKER=1")
+	conn, err := startSandboxWorker(cmd)
+	if err != nil {
+		t.Fatalf("Failed to start worker: %v", err)
+	}
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(SANDBOX_TIMEOUT))
+	if n, err := conn.Read(buf); err != nil || n != 1 || buf[0] != sandboxReady {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Skipf("Seccomp is not available: %v", err)
+	}
+	conn.Close()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Worker didn't exit cleanly: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Errorf("Worker kept running after daemon closed the socket")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package ptp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+)
+
+func startSandboxWorker(cmd *exec.Cmd) (net.Conn, error) {
+	return nil, errors.New("Sandbox is supported only on Linux amd64 and arm64")
+}
+
+// SandboxWorker is not supported on this platform
+func SandboxWorker() {
+	Log(ERROR, "Sandbox is supported only on Linux amd64 and arm64")
+	os.Exit(1)
+}
@@ -0,0 +1,23 @@
+package ptp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSandboxHandle(t *testing.T) {
+	msg := CreateTestP2PMessage(Crypto{}, "hello", 1)
+	reply := sandboxHandle(msg.Serialize())
+	if reply[0] != sandboxAccept {
+		t.Fatalf("Valid message was rejected: %s", reply[1:])
+	}
+	parsed := canonicalMessage(reply[1:])
+	if *parsed.Header != *msg.Header || !bytes.Equal(parsed.Data, msg.Data) {
+		t.Errorf("Message changed in the worker: %+v %q", parsed.Header, parsed.Data)
+	}
+	for _, data := range [][]byte{{1, 2, 3}, make([]byte, HEADER_SIZE+4)} {
+		if reply := sandboxHandle(data); reply[0] != sandboxReject {
+			t.Errorf("Malformed message %v was accepted", data)
+		}
+	}
+}
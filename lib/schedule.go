@@ -0,0 +1,159 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a list of weekly time windows during which instance
+// should be up. Outside of these windows instance is kept down
+type Schedule struct {
+	Windows []ScheduleWindow
+	source  string
+}
+
+// ScheduleWindow is a daily interval applied to selected days of week.
+// Window that ends before it starts continues after midnight
+type ScheduleWindow struct {
+	Days  [7]bool
+	Start time.Duration // Offset from midnight
+	End   time.Duration // Offset from midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseSchedule parses windows separated by semicolon. Each window is an
+// optional list of days followed by time interval, for example:
+// "Mon-Fri 09:00-18:00;Sat,Sun 10:00-14:00" or "22:00-06:00"
+func ParseSchedule(s string) (*Schedule, error) {
+	schedule := new(Schedule)
+	schedule.source = s
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var window ScheduleWindow
+		fields := strings.Fields(item)
+		var interval string
+		switch len(fields) {
+		case 1:
+			for i := range window.Days {
+				window.Days[i] = true
+			}
+			interval = fields[0]
+		case 2:
+			days, err := parseDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			window.Days = days
+			interval = fields[1]
+		default:
+			return nil, errors.New(fmt.Sprintf("Malformed schedule window: %s", item))
+		}
+		bounds := strings.Split(interval, "-")
+		if len(bounds) != 2 {
+			return nil, errors.New(fmt.Sprintf("Malformed time interval: %s", interval))
+		}
+		var err error
+		window.Start, err = parseClock(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		window.End, err = parseClock(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if window.Start == window.End {
+			return nil, errors.New(fmt.Sprintf("Empty time interval: %s", interval))
+		}
+		schedule.Windows = append(schedule.Windows, window)
+	}
+	if len(schedule.Windows) == 0 {
+		return nil, errors.New("Schedule doesn't contain any window")
+	}
+	return schedule, nil
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.Split(strings.ToLower(item), "-")
+		first, exists := weekdays[bounds[0]]
+		if !exists {
+			return days, errors.New(fmt.Sprintf("Unknown day of week: %s", bounds[0]))
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, exists = weekdays[bounds[1]]
+			if !exists {
+				return days, errors.New(fmt.Sprintf("Unknown day of week: %s", bounds[1]))
+			}
+		} else if len(bounds) > 2 {
+			return days, errors.New(fmt.Sprintf("Malformed days range: %s", item))
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Malformed time: %s", s))
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Active returns true if specified moment belongs to one of the windows
+func (s *Schedule) Active(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+	prev := (day + 6) % 7
+	for _, w := range s.Windows {
+		if w.Start < w.End {
+			if w.Days[day] && offset >= w.Start && offset < w.End {
+				return true
+			}
+			continue
+		}
+		if (w.Days[day] && offset >= w.Start) || (w.Days[prev] && offset < w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextChange returns the moment when instance should be brought
+// up or down next time
+func (s *Schedule) NextChange(t time.Time) time.Time {
+	current := s.Active(t)
+	next := t.Truncate(time.Minute)
+	for i := 0; i < 8*24*60; i++ {
+		next = next.Add(time.Minute)
+		if s.Active(next) != current {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) String() string {
+	return s.source
+}
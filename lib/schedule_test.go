@@ -0,0 +1,40 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	s, err := ParseSchedule("Mon-Fri 09:00-18:00;Sat 22:00-02:00")
+	if err != nil {
+		t.Fatalf("Failed to parse schedule: %v", err)
+	}
+	// 2017-01-02 is Monday
+	cases := []struct {
+		at     time.Time
+		active bool
+	}{
+		{time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 1, 2, 18, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 1, 2, 8, 59, 0, 0, time.UTC), false},
+		{time.Date(2017, 1, 7, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 1, 7, 23, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 1, 8, 1, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 1, 8, 3, 0, 0, 0, time.UTC), false},
+	}
+	for _, c := range cases {
+		if s.Active(c.at) != c.active {
+			t.Errorf("Wrong state at %s: expected %v", c.at, c.active)
+		}
+	}
+	next := s.NextChange(time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2017, 1, 2, 18, 0, 0, 0, time.UTC)) {
+		t.Errorf("Wrong next change: %s", next)
+	}
+	for _, bad := range []string{"", "Mon", "Xyz 10:00-11:00", "10:00-10:00", "25:00-26:00"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("Bad schedule was accepted: %s", bad)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package ptp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Values of DHT messages that reveal topology of the network, like local
+// addresses of members and DHCP data, may be sealed with a secret derived
+// from the network key. Routers keep sealed values as is. Command and Id
+// stay in the clear, so messages are still routed
+
+// DHTSecret derives key that seals DHT values from network hash and key
+func DHTSecret(hash string, key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("p2p-dht|" + hash + "|"))
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+func sealCipher(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealValue encrypts and authenticates a value. Result contains no
+// characters used as separators in DHT messages
+func SealValue(secret []byte, value string) (string, error) {
+	gcm, err := sealCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return DHT_SEALED_PREFIX + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// IsSealed returns true if value was produced by SealValue
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, DHT_SEALED_PREFIX)
+}
+
+// OpenValue decrypts a sealed value. Port that router may append to an
+// address it keeps for us is ignored
+func OpenValue(secret []byte, value string) (string, error) {
+	if !IsSealed(value) {
+		return "", fmt.Errorf("%w: value is not sealed", ErrMalformedMessage)
+	}
+	data := strings.TrimPrefix(value, DHT_SEALED_PREFIX)
+	if i := strings.IndexByte(data, ':'); i >= 0 {
+		data = data[:i]
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	gcm, err := sealCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return "", fmt.Errorf("%w: sealed value is too short", ErrMalformedMessage)
+	}
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("Sealed value doesn't match network key")
+	}
+	return string(plain), nil
+}
+
+// seal returns value sealed with the network secret, or value itself when
+// sealing is disabled
+func (dht *DHTClient) seal(value string) string {
+	secret := dht.secret()
+	if len(secret) == 0 || value == "" {
+		return value
+	}
+	sealed, err := SealValue(secret, value)
+	if err != nil {
+		// Value is not sent in the clear when encryption was requested
+		Log(ERROR, "Failed to seal DHT value: %v", err)
+		return ""
+	}
+	return sealed
+}
+
+// open returns plain value. Values that aren't sealed, like data routers
+// generate themselves, are returned as is
+func (dht *DHTClient) open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	secret := dht.secret()
+	if len(secret) == 0 {
+		return "", errors.New("Received sealed value, but DHT encryption is disabled")
+	}
+	return OpenValue(secret, value)
+}
+
+func (dht *DHTClient) secret() []byte {
+	dht.SecretLock.Lock()
+	defer dht.SecretLock.Unlock()
+	return dht.Secret
+}
+
+// SetSecret replaces secret that seals DHT values, when network key is
+// replaced
+func (dht *DHTClient) SetSecret(secret []byte) {
+	dht.SecretLock.Lock()
+	dht.Secret = secret
+	dht.SecretLock.Unlock()
+}
+
+// openList replaces sealed items of a list separated by | with the items
+// they contain. Items that can't be opened are dropped
+func (dht *DHTClient) openList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, "|") {
+		if !IsSealed(item) {
+			items = append(items, item)
+			continue
+		}
+		value, err := dht.open(item)
+		if err != nil {
+			Log(WARNING, "Failed to open sealed DHT value: %v", err)
+			continue
+		}
+		items = append(items, strings.Split(value, "|")...)
+	}
+	return items
+}
@@ -0,0 +1,54 @@
+package ptp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSealValue(t *testing.T) {
+	secret := DHTSecret("hash", []byte("key"))
+	sealed, err := SealValue(secret, "10.0.0.2:1234|192.168.1.5:1234")
+	if err != nil {
+		t.Fatalf("Failed to seal value: %v", err)
+	}
+	if !IsSealed(sealed) || strings.ContainsAny(sealed, "|,:") {
+		t.Errorf("Sealed value can't be carried in DHT message: %s", sealed)
+	}
+	// Router may append our port to the value
+	value, err := OpenValue(secret, sealed+":1234")
+	if err != nil || value != "10.0.0.2:1234|192.168.1.5:1234" {
+		t.Errorf("Failed to open sealed value: %q, %v", value, err)
+	}
+	if _, err := OpenValue(DHTSecret("hash", []byte("other")), sealed); err == nil {
+		t.Errorf("Value was opened with wrong key")
+	}
+	if _, err := OpenValue(secret, DHT_SEALED_PREFIX+"!!"); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("Expected malformed message error, got %v", err)
+	}
+}
+
+func TestSealedDHTPayload(t *testing.T) {
+	secret := DHTSecret("hash", []byte("key"))
+	dht := &DHTClient{P2PPort: 1234, Secret: secret, Stats: make(map[string]*RouterStats)}
+	dht.IPList = []net.IP{net.ParseIP("192.168.1.5")}
+	conn := NewFakeConn(nil, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881})
+	if err := dht.Handshake(conn); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	msg, err := dht.Extract(conn.Sent()[0])
+	if err != nil {
+		t.Fatalf("Failed to parse handshake: %v", err)
+	}
+	if strings.Contains(msg.Arguments, "192.168") || !strings.HasPrefix(msg.Arguments, "1234|"+DHT_SEALED_PREFIX) {
+		t.Errorf("Local address wasn't sealed: %s", msg.Arguments)
+	}
+
+	// Router returns public endpoint it has seen along with sealed list
+	dht.Peers = []PeerIP{{ID: "peer"}}
+	dht.HandleNode(DHTMessage{Id: "peer", Arguments: "1.2.3.4:1234|" + strings.TrimPrefix(msg.Arguments, "1234|")}, conn)
+	if len(dht.Peers[0].Ips) != 2 || dht.Peers[0].Ips[1].String() != "192.168.1.5:1234" {
+		t.Errorf("Sealed addresses weren't opened: %v", dht.Peers[0].Ips)
+	}
+}
@@ -0,0 +1,261 @@
+package ptp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service is a named service announced by a member of the network
+type Service struct {
+	Name  string
+	Port  int
+	Proto string    // tcp or udp
+	Peer  string    // ID of the announcing peer. Empty for local services
+	IP    string    // Address of the announcing peer on the virtual network
+	Seen  time.Time // When announcement was received last time
+}
+
+func (s Service) String() string {
+	return s.Name + ":" + strconv.Itoa(s.Port) + "/" + s.Proto
+}
+
+// validServiceName checks that name consists of letters, digits, hyphens,
+// underscores and dots only
+func validServiceName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseService parses NAME:PORT[/PROTO]. Protocol is tcp by default
+func ParseService(spec string) (Service, error) {
+	s := Service{Proto: "tcp"}
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		s.Proto = spec[i+1:]
+		spec = spec[:i]
+	}
+	if s.Proto != "tcp" && s.Proto != "udp" {
+		return s, errors.New(fmt.Sprintf("Unknown protocol %s", s.Proto))
+	}
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 || !validServiceName(parts[0]) {
+		return s, errors.New(fmt.Sprintf("Service %s is not in a form of NAME:PORT[/PROTO]", spec))
+	}
+	s.Name = parts[0]
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return s, errors.New(fmt.Sprintf("Bad port of service %s", s.Name))
+	}
+	s.Port = port
+	return s, nil
+}
+
+// ParseServices parses comma-separated list of services
+func ParseServices(list string) ([]Service, error) {
+	var services []Service
+	for _, spec := range strings.Split(list, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		s, err := ParseService(spec)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// FormatServices is the reverse of ParseServices
+func FormatServices(services []Service) string {
+	var specs []string
+	for _, s := range services {
+		specs = append(specs, s.String())
+	}
+	return strings.Join(specs, ",")
+}
+
+// AnnounceService adds service to the list announced by this instance.
+// Service with the same name and protocol is replaced
+func (p *PTPCloud) AnnounceService(s Service) {
+	p.serviceLock.Lock()
+	var services []Service
+	for _, existing := range p.Services {
+		if existing.Name != s.Name || existing.Proto != s.Proto {
+			services = append(services, existing)
+		}
+	}
+	p.Services = append(services, s)
+	p.serviceLock.Unlock()
+	p.lastServicePush = time.Time{}
+}
+
+// WithdrawService removes services with specified name from the list
+// announced by this instance. Returns false if there was no such service
+func (p *PTPCloud) WithdrawService(name string) bool {
+	p.serviceLock.Lock()
+	var services []Service
+	for _, s := range p.Services {
+		if s.Name != name {
+			services = append(services, s)
+		}
+	}
+	found := len(services) != len(p.Services)
+	p.Services = services
+	p.serviceLock.Unlock()
+	if found {
+		p.lastServicePush = time.Time{}
+	}
+	return found
+}
+
+// FindServices returns services of this instance and of its peers with
+// specified name, or every service if name is empty. Announcements that
+// weren't refreshed for SERVICE_TTL are skipped
+func (p *PTPCloud) FindServices(name string) []Service {
+	p.serviceLock.Lock()
+	defer p.serviceLock.Unlock()
+	var result []Service
+	for _, s := range p.Services {
+		if name == "" || s.Name == name {
+			s.IP = p.IP
+			result = append(result, s)
+		}
+	}
+	for _, services := range p.Registry {
+		for _, s := range services {
+			if (name == "" || s.Name == name) && time.Since(s.Seen) < SERVICE_TTL {
+				result = append(result, s)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].IP < result[j].IP
+	})
+	return result
+}
+
+// PushServices announces services of this instance to connected peers
+// every SERVICE_ANNOUNCE_INTERVAL and right after the list has changed
+func (p *PTPCloud) PushServices() {
+	if time.Since(p.lastServicePush) < SERVICE_ANNOUNCE_INTERVAL {
+		return
+	}
+	p.lastServicePush = time.Now()
+	p.PeersLock.Lock()
+	var peers []*NetworkPeer
+	for _, peer := range p.NetworkPeers {
+		if peer.State == P_CONNECTED {
+			peers = append(peers, peer)
+		}
+	}
+	p.PeersLock.Unlock()
+	for _, peer := range peers {
+		p.SendServices(peer)
+	}
+}
+
+// SendServices announces services of this instance to a peer. Empty list
+// is sent too, so peer forgets services that were withdrawn. Control
+// channel is used if peer supports it
+func (p *PTPCloud) SendServices(peer *NetworkPeer) {
+	p.serviceLock.Lock()
+	list := FormatServices(p.Services)
+	p.serviceLock.Unlock()
+	if err := p.SendControl(peer, CONTROL_SERVICES, []byte(list)); err == nil {
+		return
+	}
+	p.SendTo(peer.PeerHW, CreateServicesP2PMessage(p.CurrentCrypter(), p.Dht.ID, list))
+}
+
+func CreateServicesP2PMessage(c Crypto, id, list string) *P2PMessage {
+	data := id + "|" + list
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MAGIC_COOKIE
+	msg.Header.Type = uint16(MT_SERVICES)
+	msg.Header.Length = uint16(len(data))
+	msg.Header.Complete = 1
+	if c.Active {
+		var err error
+		msg.Data, err = c.Encrypt(c.ActiveKey.Key, []byte(data))
+		if err != nil {
+			Log(ERROR, "Failed to encrypt data")
+		}
+	} else {
+		msg.Data = []byte(data)
+	}
+	return msg
+}
+
+// HandleServicesMessage is called when peer announces its services
+func (p *PTPCloud) HandleServicesMessage(msg *P2PMessage, src_addr *net.UDPAddr) {
+	parts := strings.SplitN(string(msg.Data), "|", 2)
+	if len(parts) != 2 {
+		Log(DEBUG, "Bad service announcement from %s: %v", src_addr, ErrMalformedMessage)
+		return
+	}
+	id := parts[0]
+	p.PeersLock.Lock()
+	peer, exists := p.NetworkPeers[id]
+	p.PeersLock.Unlock()
+	if !exists || peer.Endpoint == nil || peer.Endpoint.String() != src_addr.String() || peer.PeerLocalIP == nil {
+		Log(DEBUG, "Service announcement from unknown endpoint %s", src_addr)
+		return
+	}
+	services, err := ParseServices(parts[1])
+	if err != nil {
+		Log(DEBUG, "Bad service announcement from %s: %v", id, err)
+		return
+	}
+	p.RegisterServices(id, peer.PeerLocalIP.String(), services)
+}
+
+// HandleServicesControl is called when peer announces its services over
+// control channel
+func (p *PTPCloud) HandleServicesControl(peer *NetworkPeer, data []byte) {
+	if peer.PeerLocalIP == nil {
+		return
+	}
+	services, err := ParseServices(string(data))
+	if err != nil {
+		Log(DEBUG, "Bad service announcement from %s: %v", peer.ID, err)
+		return
+	}
+	p.RegisterServices(peer.ID, peer.PeerLocalIP.String(), services)
+}
+
+// RegisterServices replaces services known for a peer
+func (p *PTPCloud) RegisterServices(id, ip string, services []Service) {
+	now := time.Now()
+	for i := range services {
+		services[i].Peer = id
+		services[i].IP = ip
+		services[i].Seen = now
+	}
+	p.serviceLock.Lock()
+	defer p.serviceLock.Unlock()
+	if p.Registry == nil {
+		p.Registry = make(map[string][]Service)
+	}
+	if len(services) == 0 {
+		delete(p.Registry, id)
+		return
+	}
+	p.Registry[id] = services
+}
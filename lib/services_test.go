@@ -0,0 +1,44 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseServices(t *testing.T) {
+	services, err := ParseServices("web:80, DNS:53/udp")
+	if err != nil {
+		t.Fatalf("Failed to parse services: %v", err)
+	}
+	if s := FormatServices(services); s != "web:80/tcp,dns:53/udp" {
+		t.Errorf("Wrong services: %s", s)
+	}
+	for _, bad := range []string{"web", "web:http", "web:0", "web:80/sctp", "w|b:80"} {
+		if _, err := ParseService(bad); err == nil {
+			t.Errorf("Bad service %s was accepted", bad)
+		}
+	}
+}
+
+func TestServiceRegistry(t *testing.T) {
+	p := &PTPCloud{IP: "10.0.0.1"}
+	p.AnnounceService(Service{Name: "web", Port: 80, Proto: "tcp"})
+	p.AnnounceService(Service{Name: "web", Port: 8080, Proto: "tcp"})
+	services, _ := ParseServices("web:80,db:5432")
+	p.RegisterServices("peer", "10.0.0.2", services)
+	found := p.FindServices("web")
+	if len(found) != 2 || found[0].Port != 8080 || found[0].Peer != "" || found[1].IP != "10.0.0.2" {
+		t.Errorf("Wrong services were found: %+v", found)
+	}
+	if len(p.FindServices("")) != 3 {
+		t.Errorf("Not every service was listed")
+	}
+	p.Registry["peer"][1].Seen = time.Now().Add(-SERVICE_TTL)
+	if len(p.FindServices("db")) != 0 {
+		t.Errorf("Expired service was listed")
+	}
+	p.RegisterServices("peer", "10.0.0.2", nil)
+	if !p.WithdrawService("web") || len(p.FindServices("")) != 0 {
+		t.Errorf("Services were not withdrawn: %+v", p.FindServices(""))
+	}
+}
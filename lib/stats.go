@@ -0,0 +1,121 @@
+package ptp
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// InstanceStats is a point-in-time snapshot of counters of an instance.
+// CLI, status page and SNMP subagent read instance state through it
+type InstanceStats struct {
+	Time       time.Time
+	Hash       string
+	IP         string
+	Uptime     time.Duration
+	Offline    bool // No router is reachable
+	NoNetwork  bool // Host has lost connectivity. Instance is paused
+	Draining   bool
+	Conflict   string // Last detected duplicate of this instance
+	Peers      int
+	Connected  int
+	Relayed    int    // Connected peers reached through a forwarder
+	BytesSent  uint64 // Data sent to peers
+	BytesRecv  uint64 // Data received from peers
+	Buffers    int64
+	Goroutines int64
+	Bandwidth  int64  // Bytes per second
+	Dropped    uint64 // Packets dropped because of resource caps
+	Routers    []RouterStats
+	PeerStats  []PeerStats
+	Queues     []QueueSnapshot
+	ClockSkew  time.Duration // How far clock of routers is ahead of ours
+}
+
+// PeerStats is a snapshot of counters of a single peer
+type PeerStats struct {
+	ID           string
+	IP           string
+	State        PeerState
+	Endpoint     string
+	Relayed      bool
+	RTT          time.Duration
+	Latency      LatencySummary // Distribution of round trip times. Empty until pings are answered
+	Policy       PathPolicy
+	BytesSent    uint64
+	BytesRecv    uint64
+	LastReceived time.Time
+	LastActivity time.Time
+	Loss         float64 // Share of data lost on the way to the peer
+	Pacing       string  // Summary of the pacer. Empty when pacing is disabled
+	Tags         []string
+	LastError    string
+	RetryAt      time.Time // When unreachable peer is tried again
+	PathMTU      int       // MTU confirmed by probes of the path. Zero if unknown
+}
+
+// Stats returns a snapshot of instance counters. Peers are sorted by ID
+func (p *PTPCloud) Stats() InstanceStats {
+	s := InstanceStats{
+		Time:      time.Now(),
+		IP:        p.IP,
+		Offline:   p.Offline,
+		NoNetwork: p.NoNetwork,
+		Draining:  p.Draining,
+		Conflict:  p.Conflict,
+	}
+	if !p.Started.IsZero() {
+		s.Uptime = s.Time.Sub(p.Started)
+	}
+	s.Buffers, s.Goroutines, s.Bandwidth, s.Dropped = p.Resources.Usage()
+	if p.Dht != nil {
+		s.Hash = p.Dht.NetworkHash
+		s.Routers = p.Dht.GetStats()
+		s.ClockSkew = p.Dht.ClockSkew().Round(time.Second)
+		s.Queues = p.Dht.Queues()
+	}
+	p.PeersLock.Lock()
+	for _, peer := range p.NetworkPeers {
+		ps := PeerStats{
+			ID:           peer.ID,
+			State:        peer.State,
+			Relayed:      peer.ProxyID != 0,
+			RTT:          peer.RTT,
+			Policy:       p.PathPolicy(peer),
+			BytesSent:    atomic.LoadUint64(&peer.BytesSent),
+			BytesRecv:    atomic.LoadUint64(&peer.BytesRecv),
+			LastReceived: peer.LastReceived,
+			LastActivity: peer.LastActivity,
+			Loss:         peer.ReportedLoss,
+			Tags:         p.PeerTags(peer),
+			LastError:    peer.LastError,
+			RetryAt:      peer.RetryAt,
+			PathMTU:      peer.PathMTU,
+		}
+		if peer.PeerLocalIP != nil {
+			ps.IP = peer.PeerLocalIP.String()
+		}
+		if peer.Endpoint != nil {
+			ps.Endpoint = peer.Endpoint.String()
+		}
+		if peer.Latency != nil {
+			ps.Latency = peer.Latency.Summary()
+		}
+		if peer.Pacer != nil {
+			ps.Pacing = peer.Pacer.String()
+		}
+		if peer.State == P_CONNECTED {
+			s.Connected++
+			if ps.Relayed {
+				s.Relayed++
+			}
+		}
+		s.BytesSent += ps.BytesSent
+		s.BytesRecv += ps.BytesRecv
+		s.PeerStats = append(s.PeerStats, ps)
+	}
+	p.PeersLock.Unlock()
+	s.Peers = len(s.PeerStats)
+	sort.Slice(s.PeerStats, func(i, j int) bool { return s.PeerStats[i].ID < s.PeerStats[j].ID })
+	return s
+}
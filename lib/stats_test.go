@@ -0,0 +1,30 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	p := new(PTPCloud)
+	p.IP = "10.10.10.1"
+	p.NetworkPeers = map[string]*NetworkPeer{
+		"b": {ID: "b", State: P_CONNECTED, ProxyID: 3, BytesSent: 100, BytesRecv: 50,
+			Endpoint: &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 6882}},
+		"a": {ID: "a", State: P_CONNECTED, BytesSent: 10, PeerLocalIP: net.ParseIP("10.10.10.2")},
+		"c": {ID: "c", State: P_WAITING_FORWARDER},
+	}
+	s := p.Stats()
+	if s.IP != "10.10.10.1" || s.Peers != 3 || s.Connected != 2 || s.Relayed != 1 {
+		t.Errorf("Wrong peer counters: %+v", s)
+	}
+	if s.BytesSent != 110 || s.BytesRecv != 50 {
+		t.Errorf("Wrong traffic counters: sent %d, received %d", s.BytesSent, s.BytesRecv)
+	}
+	if s.PeerStats[0].ID != "a" || s.PeerStats[0].IP != "10.10.10.2" {
+		t.Errorf("Peers are not sorted: %+v", s.PeerStats)
+	}
+	if b := s.PeerStats[1]; !b.Relayed || b.Endpoint != "192.168.0.2:6882" {
+		t.Errorf("Wrong stats of relayed peer: %+v", b)
+	}
+}
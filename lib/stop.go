@@ -0,0 +1,87 @@
+package ptp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StopNotice is a reason of STOP sent by a router. Routers put reason
+// code into payload, optionally followed by a message for the operator,
+// e.g. "maintenance|back at 02:00 UTC"
+type StopNotice struct {
+	Reason  string
+	Message string
+	Router  string
+	Time    time.Time
+}
+
+type StopCallback func(n *StopNotice)
+
+// ParseStopNotice extracts reason of STOP. Returns nil if router didn't
+// specify any, like routers of older versions
+func ParseStopNotice(payload string) *StopNotice {
+	if payload == "" {
+		return nil
+	}
+	parts := strings.SplitN(payload, "|", 2)
+	n := &StopNotice{Reason: strings.ToLower(strings.TrimSpace(parts[0])), Time: time.Now()}
+	if len(parts) == 2 {
+		n.Message = strings.TrimSpace(parts[1])
+	}
+	return n
+}
+
+// Final returns true if reconnecting is pointless. Maintenance and
+// unknown reasons are retried
+func (n *StopNotice) Final() bool {
+	switch n.Reason {
+	case STOP_KICKED, STOP_DELETED, STOP_DUPLICATE:
+		return true
+	}
+	return false
+}
+
+func (n *StopNotice) String() string {
+	var s string
+	switch n.Reason {
+	case STOP_KICKED:
+		s = "Kicked from the network"
+	case STOP_DELETED:
+		s = "Network was deleted"
+	case STOP_DUPLICATE:
+		s = "Identity is used by another instance"
+	case STOP_MAINTENANCE:
+		s = "Router is under maintenance"
+	default:
+		s = "Stopped by router: " + n.Reason
+	}
+	if n.Router != "" {
+		s += " (" + n.Router + ")"
+	}
+	if n.Message != "" {
+		s += ": " + n.Message
+	}
+	if n.Final() {
+		return s + fmt.Sprintf(". Instance was stopped at %s", n.Time.Format(time.RFC1123))
+	}
+	return s + ". Reconnecting"
+}
+
+// HandleStopNotice records reason of STOP and shuts instance down if
+// router won't let it back
+func (p *PTPCloud) HandleStopNotice(n *StopNotice) {
+	if p.Stopped != nil && p.Stopped.Final() {
+		// Other routers follow the first one
+		return
+	}
+	p.Stopped = n
+	if !n.Final() {
+		Log(WARNING, "%s", n.String())
+		return
+	}
+	Log(ERROR, "%s", n.String())
+	if !p.Shutdown {
+		p.Go(p.StopInstance)
+	}
+}
@@ -0,0 +1,66 @@
+package ptp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseStopNotice(t *testing.T) {
+	if ParseStopNotice("") != nil {
+		t.Errorf("STOP without payload has a reason")
+	}
+	n := ParseStopNotice("Maintenance|back at 02:00 UTC")
+	if n.Reason != STOP_MAINTENANCE || n.Message != "back at 02:00 UTC" || n.Final() {
+		t.Errorf("Wrong maintenance notice: %+v", n)
+	}
+	if !strings.HasSuffix(n.String(), "back at 02:00 UTC. Reconnecting") {
+		t.Errorf("Wrong description of maintenance: %s", n)
+	}
+	for _, reason := range []string{STOP_KICKED, STOP_DELETED, STOP_DUPLICATE} {
+		if !ParseStopNotice(reason).Final() {
+			t.Errorf("Instance is retried after %s", reason)
+		}
+	}
+	if ParseStopNotice("upgrade").Final() {
+		t.Errorf("Instance is stopped for good after unknown reason")
+	}
+}
+
+func TestStopReason(t *testing.T) {
+	router, err := NewMockRouter()
+	if err != nil {
+		t.Fatalf("Failed to start mock router: %v", err)
+	}
+	router.Start()
+	defer router.Close()
+
+	var lock sync.Mutex
+	var received *StopNotice
+	config := &DHTClient{Routers: router.Endpoint(), NetworkHash: "mock", P2PPort: 6010}
+	config.StopHandler = func(n *StopNotice) {
+		lock.Lock()
+		received = n
+		lock.Unlock()
+	}
+	dht := new(DHTClient).Initialize(config, []net.IP{net.ParseIP("192.168.1.10")}, make(chan []PeerIP, 10), make(chan Forwarder, 10))
+	if dht == nil {
+		t.Fatalf("Client failed to connect to mock router")
+	}
+	defer dht.Stop()
+
+	if err := router.Stop(dht.ID, STOP_KICKED+"|banned by admin"); err != nil {
+		t.Fatalf("Failed to stop client: %v", err)
+	}
+	if !waitFor(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return received != nil
+	}) {
+		t.Fatalf("Reason of STOP was not passed to the instance")
+	}
+	if received.Reason != STOP_KICKED || received.Message != "banned by admin" || received.Router != router.Endpoint() {
+		t.Errorf("Wrong notice: %+v", received)
+	}
+}
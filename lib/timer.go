@@ -0,0 +1,93 @@
+package ptp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimerWheel is a hashed timer wheel that runs every scheduled callback
+// from a single goroutine. Callbacks should not block, because they are
+// executed one after another
+type TimerWheel struct {
+	Tick    time.Duration // Resolution of the wheel
+	slots   [][]*WheelTimer
+	current int
+	stopped uint32
+	lock    sync.Mutex
+}
+
+// WheelTimer is a handle of a callback scheduled on a wheel
+type WheelTimer struct {
+	rounds    int
+	callback  func()
+	cancelled uint32
+}
+
+// NewTimerWheel creates a wheel with specified resolution and number of slots
+func NewTimerWheel(tick time.Duration, size int) *TimerWheel {
+	w := new(TimerWheel)
+	w.Tick = tick
+	w.slots = make([][]*WheelTimer, size)
+	return w
+}
+
+// Schedule runs callback after specified delay
+func (w *TimerWheel) Schedule(delay time.Duration, callback func()) *WheelTimer {
+	ticks := int(delay / w.Tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t := &WheelTimer{callback: callback}
+	w.lock.Lock()
+	t.rounds = (ticks - 1) / len(w.slots)
+	slot := (w.current + ticks) % len(w.slots)
+	w.slots[slot] = append(w.slots[slot], t)
+	w.lock.Unlock()
+	return t
+}
+
+// Cancel prevents callback from being executed
+func (t *WheelTimer) Cancel() {
+	atomic.StoreUint32(&t.cancelled, 1)
+}
+
+// Run turns the wheel until Stop is called
+func (w *TimerWheel) Run() {
+	ticker := time.NewTicker(w.Tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadUint32(&w.stopped) == 1 {
+			break
+		}
+		w.advance()
+	}
+}
+
+// Stop terminates the wheel. Pending callbacks will never be executed
+func (w *TimerWheel) Stop() {
+	atomic.StoreUint32(&w.stopped, 1)
+}
+
+func (w *TimerWheel) advance() {
+	w.lock.Lock()
+	w.current = (w.current + 1) % len(w.slots)
+	var expired []*WheelTimer
+	var pending []*WheelTimer
+	for _, t := range w.slots[w.current] {
+		if atomic.LoadUint32(&t.cancelled) == 1 {
+			continue
+		}
+		if t.rounds > 0 {
+			t.rounds--
+			pending = append(pending, t)
+		} else {
+			expired = append(expired, t)
+		}
+	}
+	w.slots[w.current] = pending
+	w.lock.Unlock()
+	for _, t := range expired {
+		t.callback()
+	}
+}
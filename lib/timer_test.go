@@ -0,0 +1,33 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond*5, 4)
+	go w.Run()
+	defer w.Stop()
+	fired := make(chan int, 3)
+	w.Schedule(time.Millisecond*10, func() { fired <- 1 })
+	// Delay longer than one turn of the wheel
+	w.Schedule(time.Millisecond*40, func() { fired <- 2 })
+	cancelled := w.Schedule(time.Millisecond*15, func() { fired <- 3 })
+	cancelled.Cancel()
+	for _, expected := range []int{1, 2} {
+		select {
+		case id := <-fired:
+			if id != expected {
+				t.Errorf("Timer %d fired instead of %d", id, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timer %d didn't fire", expected)
+		}
+	}
+	select {
+	case <-fired:
+		t.Errorf("Cancelled timer fired")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
@@ -0,0 +1,162 @@
+package ptp
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TraversalAttempt is an outcome of a single attempt to reach a peer
+type TraversalAttempt struct {
+	Time      time.Time
+	Peer      string
+	Strategy  string // One of TRAVERSAL_* strategies
+	LocalNAT  string // One of NAT_* types
+	RemoteNAT string
+	Success   bool
+	Duration  time.Duration // Time spent on the attempt
+	Reason    string        // Why we had to fall back to the next strategy
+}
+
+// TraversalSummary aggregates attempts with the same strategy and NAT types
+type TraversalSummary struct {
+	Strategy  string
+	LocalNAT  string
+	RemoteNAT string
+	Attempts  int
+	Successes int
+	TotalTime time.Duration // Time spent on successful attempts
+}
+
+// TraversalStats collects outcomes of NAT traversal attempts of an instance
+type TraversalStats struct {
+	summary map[string]*TraversalSummary
+	history []TraversalAttempt // Latest attempts, oldest first
+	lock    sync.Mutex
+}
+
+// SuccessRate returns percentage of successful attempts
+func (s TraversalSummary) SuccessRate() float64 {
+	if s.Attempts == 0 {
+		return 0
+	}
+	return float64(s.Successes) * 100 / float64(s.Attempts)
+}
+
+// AverageTime returns average time to success
+func (s TraversalSummary) AverageTime() time.Duration {
+	if s.Successes == 0 {
+		return 0
+	}
+	return s.TotalTime / time.Duration(s.Successes)
+}
+
+// Record adds outcome of an attempt
+func (t *TraversalStats) Record(a TraversalAttempt) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.summary == nil {
+		t.summary = make(map[string]*TraversalSummary)
+	}
+	key := a.Strategy + "|" + a.LocalNAT + "|" + a.RemoteNAT
+	s, exists := t.summary[key]
+	if !exists {
+		s = &TraversalSummary{Strategy: a.Strategy, LocalNAT: a.LocalNAT, RemoteNAT: a.RemoteNAT}
+		t.summary[key] = s
+	}
+	s.Attempts++
+	if a.Success {
+		s.Successes++
+		s.TotalTime += a.Duration
+	}
+	t.history = append(t.history, a)
+	if len(t.history) > TRAVERSAL_HISTORY {
+		t.history = t.history[len(t.history)-TRAVERSAL_HISTORY:]
+	}
+}
+
+// Summary returns aggregated outcomes sorted by strategy and NAT types
+func (t *TraversalStats) Summary() []TraversalSummary {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var result []TraversalSummary
+	for _, s := range t.summary {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Strategy != b.Strategy {
+			return a.Strategy < b.Strategy
+		}
+		if a.LocalNAT != b.LocalNAT {
+			return a.LocalNAT < b.LocalNAT
+		}
+		return a.RemoteNAT < b.RemoteNAT
+	})
+	return result
+}
+
+// History returns latest attempts, oldest first
+func (t *TraversalStats) History() []TraversalAttempt {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]TraversalAttempt{}, t.history...)
+}
+
+// RecordTraversal saves outcome of an attempt to reach the peer. Attempt
+// is successful when no fallback reason is specified
+func (p *PTPCloud) RecordTraversal(np *NetworkPeer, strategy, remoteNAT string, started time.Time, reason string) {
+	var duration time.Duration
+	if !started.IsZero() {
+		duration = time.Since(started)
+	}
+	p.Traversal.Record(TraversalAttempt{
+		Time:      time.Now(),
+		Peer:      np.ID,
+		Strategy:  strategy,
+		LocalNAT:  p.LocalNAT(),
+		RemoteNAT: remoteNAT,
+		Success:   reason == "",
+		Duration:  duration,
+		Reason:    reason,
+	})
+}
+
+// LocalNAT returns NAT_NONE when this host has a public address. Type of
+// NAT we are behind can't be detected without help of the peer
+func (p *PTPCloud) LocalNAT() string {
+	for _, ip := range p.LocalIPs {
+		if !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !isPrivateIP(ip) {
+			return NAT_NONE
+		}
+	}
+	return NAT_UNKNOWN
+}
+
+// punchedNAT guesses NAT type of the peer from the address its probe came
+// from. NAT that keeps mapping of a known endpoint is considered cone,
+// while NAT that assigned a new port is considered symmetric
+func (p *PTPCloud) punchedNAT(id string, addr *net.UDPAddr) string {
+	p.punchLock.Lock()
+	defer p.punchLock.Unlock()
+	attempt, exists := p.punches[id]
+	if !exists || addr == nil {
+		return NAT_UNKNOWN
+	}
+	for _, candidate := range attempt.Candidates {
+		if candidate.String() == addr.String() {
+			return NAT_CONE
+		}
+	}
+	return NAT_SYMMETRIC
+}
@@ -0,0 +1,61 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTraversalStats(t *testing.T) {
+	stats := new(TraversalStats)
+	stats.Record(TraversalAttempt{Strategy: TRAVERSAL_PUNCH, LocalNAT: NAT_UNKNOWN, RemoteNAT: NAT_CONE, Success: true, Duration: time.Second})
+	stats.Record(TraversalAttempt{Strategy: TRAVERSAL_PUNCH, LocalNAT: NAT_UNKNOWN, RemoteNAT: NAT_CONE, Success: true, Duration: 3 * time.Second})
+	stats.Record(TraversalAttempt{Strategy: TRAVERSAL_PUNCH, LocalNAT: NAT_UNKNOWN, RemoteNAT: NAT_CONE, Reason: "Hole punching failed"})
+	stats.Record(TraversalAttempt{Strategy: TRAVERSAL_DIRECT, LocalNAT: NAT_UNKNOWN, RemoteNAT: NAT_UNKNOWN, Reason: "No response"})
+
+	summary := stats.Summary()
+	if len(summary) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(summary))
+	}
+	if summary[0].Strategy != TRAVERSAL_DIRECT || summary[0].SuccessRate() != 0 {
+		t.Errorf("Wrong summary of direct connections: %+v", summary[0])
+	}
+	punch := summary[1]
+	if punch.Attempts != 3 || punch.Successes != 2 {
+		t.Errorf("Wrong summary of hole punching: %+v", punch)
+	}
+	if rate := punch.SuccessRate(); rate < 66 || rate > 67 {
+		t.Errorf("Wrong success rate: %f", rate)
+	}
+	if punch.AverageTime() != 2*time.Second {
+		t.Errorf("Wrong average time: %s", punch.AverageTime())
+	}
+
+	for i := 0; i < TRAVERSAL_HISTORY+10; i++ {
+		stats.Record(TraversalAttempt{Strategy: TRAVERSAL_RELAY, Success: true})
+	}
+	if len(stats.History()) != TRAVERSAL_HISTORY {
+		t.Errorf("History is not limited: %d", len(stats.History()))
+	}
+
+	var empty *TraversalStats
+	empty.Record(TraversalAttempt{})
+	if empty.Summary() != nil {
+		t.Errorf("Nil statistics returned summary")
+	}
+}
+
+func TestPunchedNAT(t *testing.T) {
+	p := new(PTPCloud)
+	known := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 6881}
+	p.punches = map[string]*PunchAttempt{"peer": {Candidates: []*net.UDPAddr{known}}}
+	if nat := p.punchedNAT("peer", known); nat != NAT_CONE {
+		t.Errorf("Known endpoint should mean cone NAT, got %s", nat)
+	}
+	if nat := p.punchedNAT("peer", &net.UDPAddr{IP: known.IP, Port: 40000}); nat != NAT_SYMMETRIC {
+		t.Errorf("New port should mean symmetric NAT, got %s", nat)
+	}
+	if nat := p.punchedNAT("other", known); nat != NAT_UNKNOWN {
+		t.Errorf("Unknown attempt should mean unknown NAT, got %s", nat)
+	}
+}
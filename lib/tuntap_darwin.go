@@ -35,6 +35,16 @@ func ConfigureInterface(dev *Interface, ip, mac, device, tool string) error {
 	return nil
 }
 
+func SetMTU(dev *Interface, device, tool, mtu string) error {
+	setmtu := exec.Command(tool, device, "mtu", mtu)
+	err := setmtu.Run()
+	if err != nil {
+		Log(ERROR, "Failed to set MTU on device %s: %v", device, err)
+		return err
+	}
+	return nil
+}
+
 func LinkUp(device, tool string) error {
 	linkup := exec.Command(tool, "link", "set", "dev", device, "up")
 	err := linkup.Run()
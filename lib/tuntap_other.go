@@ -33,3 +33,7 @@ func SetIp(ip, device, tool string) error {
 func SetMac(mac, device, tool string) error {
 	panic("TUN/TAP functionality is not supported on this platform")
 }
+
+func SetMTU(dev *Interface, device, tool, mtu string) error {
+	panic("TUN/TAP functionality is not supported on this platform")
+}
@@ -252,6 +252,20 @@ func ConfigureInterface(dev *Interface, ip, mac, device, tool string) error {
 	return nil
 }
 
+func SetMTU(dev *Interface, device, tool, mtu string) error {
+	setmtu := exec.Command("netsh")
+	setmtu.SysProcAttr = &syscall.SysProcAttr{}
+	cmd := fmt.Sprintf(`netsh interface ipv4 set subinterface "%s" mtu=%s store=active`, dev.Interface, mtu)
+	Log(INFO, "Executing: %s", cmd)
+	setmtu.SysProcAttr.CmdLine = cmd
+	err := setmtu.Run()
+	if err != nil {
+		Log(ERROR, "Failed to set MTU on device %s: %v", dev.Interface, err)
+		return err
+	}
+	return nil
+}
+
 func ExtractMacFromInterface(dev *Interface) string {
 	mac := make([]byte, 6)
 	var length uint32
@@ -14,6 +14,10 @@ type DHTMessage struct {
 	Command   string "c"
 	Arguments string "a"
 	Payload   string "p"
+	Token     string "t"
+	PublicKey string "k"
+	Stamp     string "s" // Milliseconds since epoch by the clock of routers
+	Mac       string "m" // Authenticates message of router with session token, stamp included
 }
 
 type MSG_TYPE uint16
@@ -31,6 +35,14 @@ const (
 	MT_PROXY               = 8  // Information about proxy (forwarder)
 	MT_BAD_TUN             = 9  // Notifies about dead tunnel
 	MT_CONF                = 10 // Confirmation
+	MT_PUNCH               = 11 // Hole punching coordination and probes
+	MT_DRAIN               = 12 // Peer goes into maintenance
+	MT_FEEDBACK            = 13 // Receiver reports received and lost data
+	MT_DNS                 = 14 // Split-DNS rules pushed by DNS provider
+	MT_SERVICES            = 15 // Services announced by a peer
+	MT_MANIFEST            = 16 // Membership manifest signed by admin key
+	MT_CONTROL             = 17 // Message of reliable control channel between peers
+	MT_PMTU                = 18 // Probe of path MTU and answer to it
 )
 
 // List of commands used in DHT
@@ -48,6 +60,10 @@ const (
 	CMD_UNKNOWN string = "unk"
 	CMD_DHCP    string = "dhcp"
 	CMD_ERROR   string = "error"
+	CMD_MIGRATE string = "migrate"
+	CMD_PUNCH   string = "punch"
+	CMD_CLAIM   string = "claim"
+	CMD_HINTS   string = "hints"
 )
 
 const (
@@ -83,7 +99,424 @@ const (
 const (
 	DHT_MAX_RETRIES         int           = 10
 	DHCP_MAX_RETRIES        int           = 10
+	DHT_PING_TIMEOUT        time.Duration = time.Second * 50 // Router is considered dead when it doesn't ping us within this period
 	PEER_PING_TIMEOUT       time.Duration = time.Second * 15
 	WAIT_PROXY_TIMEOUT      time.Duration = time.Second * 5
 	HANDSHAKE_PROXY_TIMEOUT time.Duration = time.Second * 3
+	PEER_IDLE_TIMEOUT       time.Duration = time.Minute * 2  // Peer becomes idle when no data was exchanged within this period
+	PEER_IDLE_PING_TIMEOUT  time.Duration = time.Second * 30 // Should be lower than UDP mapping timeout of most NATs
+	PEER_PING_RETRY         time.Duration = time.Second * 3  // Interval between unanswered pings
+	PEER_CHECK_INTERVAL     time.Duration = time.Second * 1  // How often connected peers are checked
 )
+
+// Control messages stamped further than tolerance from the clock of
+// routers are dropped. Skew is corrected by 1/DHT_SKEW_SMOOTHING of every
+// new sample
+const (
+	DHT_STAMP_TOLERANCE time.Duration = time.Second * 30
+	DHT_SKEW_SMOOTHING  time.Duration = 8
+	DHT_MAC_SIZE        int           = 16 // Bytes of HMAC-SHA256 routers authenticate messages with
+)
+
+// Prefix of DHT values sealed with the network secret
+const DHT_SEALED_PREFIX string = "sealed."
+
+// Handshake with a router is retransmitted until router replies with CONN.
+// Timeout is doubled after every attempt
+const (
+	DHT_HANDSHAKE_TIMEOUT  time.Duration = time.Millisecond * 500
+	DHT_HANDSHAKE_ATTEMPTS int           = 4
+)
+
+// Timer wheel
+const (
+	TIMER_WHEEL_TICK time.Duration = time.Millisecond * 100
+	TIMER_WHEEL_SIZE int           = 512
+)
+
+// Network rotation
+const (
+	REKEY_DEFAULT_DELAY time.Duration = time.Second * 30 // Time given to members to receive rekey announcement
+	REKEY_MAX_AGE       time.Duration = time.Minute * 5  // Announcements older than this are ignored
+)
+
+// Policies of merging conflicting responses of routers
+const (
+	QUORUM_UNION        string = "union"        // Peer is known if any router reported it
+	QUORUM_INTERSECTION string = "intersection" // Peer is known if every router reported it
+	QUORUM_MAJORITY     string = "majority"     // Peer is known if most of routers reported it
+)
+
+// BitTorrent mainline DHT
+const (
+	MAINLINE_TIMEOUT     time.Duration = time.Second * 2  // Time to wait for response of a single node
+	MAINLINE_INTERVAL    time.Duration = time.Minute * 15 // Interval between lookups and announcements
+	MAINLINE_MAX_QUERIES int           = 64               // Number of nodes queried during single lookup
+	MAINLINE_K           int           = 8                // Number of closest nodes we announce on
+)
+
+var MAINLINE_BOOTSTRAP = []string{"router.bittorrent.com:6881", "dht.transmissionbt.com:6881", "router.utorrent.com:6881"}
+
+// Coordinated hole punching
+const (
+	PUNCH_OFFER          string        = "offer"                // Peer proposes time and candidates
+	PUNCH_ANSWER         string        = "answer"               // Peer agrees and sends its candidates
+	PUNCH_PROBE          string        = "probe"                // Packet that punches the hole
+	PUNCH_DELAY          time.Duration = time.Second * 2        // Time given to peer to receive the offer
+	PUNCH_MAX_DELAY      time.Duration = time.Second * 10       // Offers scheduled too far in the future are ignored
+	PUNCH_DURATION       time.Duration = time.Second * 3        // How long probes are sent. Covers small clock skew
+	PUNCH_PROBE_INTERVAL time.Duration = time.Millisecond * 100 // Interval between probes
+	PUNCH_RESULT_TTL     time.Duration = time.Second * 30       // Punched hole can be reused by the other side within this period
+	PUNCH_RETRY_INTERVAL time.Duration = time.Minute * 5        // How often relayed peers try to switch to direct connection
+)
+
+// Strategies used to reach a peer
+const (
+	TRAVERSAL_LOCAL   string = "local"   // Peer runs on the same host
+	TRAVERSAL_LAN     string = "lan"     // Peer is in the same network
+	TRAVERSAL_SAMENAT string = "samenat" // Peer is behind the same NAT and reached at its private address
+	TRAVERSAL_DIRECT  string = "direct"  // Peer is reachable without hole punching
+	TRAVERSAL_PUNCH   string = "punch"   // Coordinated hole punching
+	TRAVERSAL_UPGRADE string = "upgrade" // Hole punching of a peer connected over relay
+	TRAVERSAL_RELAY   string = "relay"   // Traffic is forwarded by a proxy
+)
+
+// NAT types reported in traversal statistics
+const (
+	NAT_UNKNOWN   string = "unknown"
+	NAT_NONE      string = "none"      // Host has a public address
+	NAT_CONE      string = "cone"      // NAT keeps mapping of an endpoint for every destination
+	NAT_SYMMETRIC string = "symmetric" // NAT creates new mapping for every destination
+)
+
+// Capabilities signed in introduction
+const (
+	CAP_IDENTITY   string = "ed25519" // Introductions are signed with identity key
+	CAP_ENCRYPTION string = "aes"     // Traffic is encrypted with network key
+	CAP_SEPARATOR  string = "+"
+)
+
+// Peer tags used in ACL rules
+const (
+	TAG_ANY       string = "*" // Matches every peer, including peers without tags
+	TAG_SEPARATOR string = "+" // Separates tags in introduction
+)
+
+// IP protocols recognized by ACL
+const (
+	IPPROTO_ICMP int = 1
+	IPPROTO_TCP  int = 6
+	IPPROTO_UDP  int = 17
+)
+
+// Names of DSCP classes accepted in place of numeric values
+var DSCP_CLASSES = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46,
+}
+
+// Draining before maintenance
+const (
+	DRAIN_NOTIFY_INTERVAL time.Duration = time.Second * 1  // Interval between notifications of peers
+	DRAIN_IDLE_TIMEOUT    time.Duration = time.Second * 10 // Peer is considered drained when no data was exchanged within this period
+	DRAIN_HOLD            time.Duration = time.Minute * 5  // Drained peer is not resolved again within this period
+)
+
+// Bounds of configuration hints received from routers
+const (
+	HINT_KEEPALIVE_MIN time.Duration = time.Second * 5
+	HINT_KEEPALIVE_MAX time.Duration = time.Second * 60
+	HINT_MTU_MIN       int           = 576
+	HINT_MTU_MAX       int           = 1600
+	HINT_MAX_RELAYS    int           = 8
+)
+
+// Packet pacing on the send path
+const (
+	PACING_DEFAULT_BURST int64         = 16 * 1024 // Bytes sent to a peer without delay
+	PACING_MAX_DELAY     time.Duration = time.Millisecond * 10
+	PACING_MIN_RATE      int64         = 64 * 1024 // Congestion never slows pacing below this rate
+)
+
+// Congestion feedback between peers
+const (
+	NENC_SEQUENCED          uint16        = 2 // Header ID of data messages carrying sequence number in Seq
+	NENC_REDUNDANT          uint16        = 3 // Same as NENC_SEQUENCED, but copies are sent over several paths
+	FEEDBACK_INTERVAL       time.Duration = time.Second * 1
+	FEEDBACK_LOSS_THRESHOLD float64       = 0.05 // Share of lost data that is considered congestion
+	FEEDBACK_SUSTAINED      int           = 3    // Consecutive lossy reports before sender reacts
+)
+
+// How often instance announces itself to find duplicates
+const CLAIM_INTERVAL time.Duration = time.Minute * 1
+
+// Number of latest traversal attempts kept for diagnostics
+const TRAVERSAL_HISTORY int = 256
+
+// Time given to a new router to confirm connection during migration
+const MIGRATION_TIMEOUT time.Duration = time.Second * 10
+
+// Rate limits for inbound packets per source address
+const (
+	HANDSHAKE_RATE_LIMIT   float64       = 10  // Handshake packets per second from single address
+	HANDSHAKE_RATE_BURST   float64       = 20  // Handshake packets accepted at once from single address
+	DHT_RATE_LIMIT         float64       = 50  // DHT messages per second of single command
+	DHT_RATE_BURST         float64       = 100 // DHT messages accepted at once of single command
+	RATE_LIMIT_MAX_SOURCES int           = 4096
+	RATE_LIMIT_CLEANUP     time.Duration = time.Second * 30
+)
+
+// Attempts to reach peers and to upgrade relayed peers to direct
+// connection are delayed more after every failure
+const (
+	PEER_BACKOFF_MIN time.Duration = time.Second * 5
+	PEER_BACKOFF_MAX time.Duration = time.Minute * 5
+	PUNCH_RETRY_MAX  time.Duration = time.Hour
+)
+
+// How often instance checks that host still has network connectivity
+const NETWORK_CHECK_INTERVAL time.Duration = time.Second * 5
+
+// How often DNS provider pushes its split-DNS rules to connected peers
+const DNS_PUSH_INTERVAL time.Duration = time.Minute * 5
+
+// Stub resolver on the virtual interface. Expired answers are served for
+// DNS_CACHE_STALE with DNS_STALE_TTL when no upstream responds
+const (
+	DNS_STUB_PORT     int           = 53
+	DNS_STUB_TIMEOUT  time.Duration = time.Second * 2
+	DNS_CACHE_SIZE    int           = 1024
+	DNS_CACHE_MAX_TTL time.Duration = time.Minute * 5
+	DNS_CACHE_STALE   time.Duration = time.Hour
+	DNS_STALE_TTL     uint32        = 30
+)
+
+// Services are announced to peers periodically and forgotten when
+// announcement wasn't refreshed for SERVICE_TTL
+const (
+	SERVICE_ANNOUNCE_INTERVAL time.Duration = time.Minute * 1
+	SERVICE_TTL               time.Duration = time.Minute * 3
+)
+
+// Sequence numbers of data messages remembered to drop copies received
+// over redundant paths. Must divide 65536
+const DEDUP_WINDOW uint16 = 1024
+
+// Frames waiting to be written to the device. Further frames are dropped
+const WRITE_QUEUE_SIZE int = 512
+
+// Most frames written to the device at once
+const WRITE_BATCH_SIZE int = 32
+
+// Metric of the virtual interface and its route unless configured. Lower
+// than metrics of physical interfaces, so virtual network is preferred
+const DEFAULT_INTERFACE_METRIC int = 5
+
+// Sandbox worker parses messages received from the network. Worker that
+// doesn't respond in SANDBOX_TIMEOUT is restarted, but not more often than
+// once in SANDBOX_RESTART_DELAY
+const (
+	SANDBOX_COMMAND       string        = "sandbox-worker" // Hidden command that runs the worker
+	SANDBOX_TIMEOUT       time.Duration = time.Second
+	SANDBOX_RESTART_DELAY time.Duration = time.Second
+)
+
+// Features are advertised among capabilities as FEATURE_PREFIX, name and
+// rollout percent, e.g. x-compress=30. Such capabilities may come and go
+// between introductions
+const FEATURE_PREFIX string = "x-"
+
+// Transfer totals are saved every QUOTA_SAVE_INTERVAL, so little is lost
+// on crash. Throttled instance gets DEFAULT_QUOTA_FLOOR unless configured
+const (
+	QUOTA_SAVE_INTERVAL time.Duration = time.Minute
+	DEFAULT_QUOTA_FLOOR int64         = 64 // Kilobytes per second
+)
+
+// Control messages are resent every CONTROL_RETRANSMIT until peer
+// acknowledges them. Queue of a peer that didn't acknowledge any of
+// CONTROL_MAX_RETRIES resends is dropped
+const (
+	CONTROL_RETRANSMIT  time.Duration = time.Second
+	CONTROL_MAX_RETRIES int           = 10
+	CONTROL_QUEUE_SIZE  int           = 64   // Unacknowledged messages to a single peer
+	CONTROL_MAX_SIZE    int           = 1024 // Bytes of payload of a single message
+)
+
+// Control channel is a protocol feature, so it's used only with peers
+// that advertise it
+const CONTROL_FEATURE string = "control"
+
+// Topics of control messages
+const (
+	CONTROL_SERVICES string = "services" // Services announced by a peer
+	CONTROL_LIVENESS string = "liveness" // Whether member can reach another peer
+	CONTROL_REKEY    string = "rekey"    // New network hash and key sealed to identity of the member
+)
+
+// Forwarder refuses new sessions once RELAY_SATURATION of its capacity is
+// taken and asks clients to try another one for RELAY_RETRY_HINT. Hints
+// of forwarders are clamped to RELAY_MAX_RETRY_HINT
+const (
+	RELAY_SATURATION     float64       = 0.9
+	RELAY_RETRY_HINT     time.Duration = time.Minute * 5
+	RELAY_MAX_RETRY_HINT time.Duration = time.Hour
+	RELAY_BUSY           string        = "busy" // Marks proxy handshake reply refusing the session
+)
+
+// Counters recorded into history are kept for HISTORY_RETENTION, so a
+// week can always be queried. Older samples are dropped once in
+// HISTORY_COMPACT_INTERVAL. Counters of the whole instance are recorded
+// in place of peer ID HISTORY_TOTAL every interval, even without peers
+const (
+	HISTORY_RETENTION        time.Duration = time.Hour * 24 * 8
+	HISTORY_COMPACT_INTERVAL time.Duration = time.Hour * 24
+	HISTORY_TOTAL            string        = "*"
+)
+
+// Quantiles of round trip times of a peer are computed over samples of
+// the current and the previous LATENCY_WINDOW
+const LATENCY_WINDOW time.Duration = time.Minute * 5
+
+// Interface MTU is DEVICE_MTU unless routers suggest another one. It's
+// raised up to JUMBO_MTU_MAX when jumbo frames are configured and path to
+// every connected peer carries them. Validated paths are probed again
+// every PMTU_PROBE_INTERVAL, others every PMTU_PROBE_RETRY
+const (
+	DEVICE_MTU          int           = 1600
+	JUMBO_MTU_MAX       int           = 9000
+	ETH_HEADER_SIZE     int           = 14
+	PMTU_PROBE_INTERVAL time.Duration = time.Minute * 5
+	PMTU_PROBE_RETRY    time.Duration = time.Second * 30
+	PMTU_FEATURE        string        = "pmtu"
+	PMTU_PROBE          string        = "probe"
+	PMTU_ACK            string        = "ack"
+)
+
+// Size of buffers receiving messages from the network. Fits messages
+// carrying jumbo frames
+const RECEIVE_BUFFER_SIZE int = 16384
+
+// Routing table of an isolated instance is derived from interface name
+// within ISOLATION_TABLE_RANGE tables starting at ISOLATION_TABLE_BASE
+const (
+	ISOLATION_TABLE_BASE  int = 10000
+	ISOLATION_TABLE_RANGE int = 50000
+)
+
+// Peer events delivered to webhooks
+const (
+	EVENT_JOIN           string = "join"
+	EVENT_LEAVE          string = "leave"
+	EVENT_RELAY_FALLBACK string = "relay-fallback"
+)
+
+// Peer events kept for console by every instance
+const EVENT_LOG_SIZE int = 64
+
+// Events waiting to be delivered to webhooks. Further events are dropped.
+// Failed delivery is retried WEBHOOK_RETRIES times
+const (
+	WEBHOOK_QUEUE_SIZE  int           = 256
+	WEBHOOK_TIMEOUT     time.Duration = time.Second * 10
+	WEBHOOK_RETRIES     int           = 3
+	WEBHOOK_RETRY_DELAY time.Duration = time.Second * 5
+)
+
+// Events passed from DHT listener to the instance. Oldest event is dropped
+// when queue is full, so listener never waits for the instance
+const (
+	DHT_PEER_QUEUE_SIZE  int = 4
+	DHT_PROXY_QUEUE_SIZE int = 32
+)
+
+// Reasons of STOP sent by routers. Instance is stopped for good when it
+// is kicked, network is deleted or its identity is used elsewhere
+const (
+	STOP_KICKED      string = "kicked"
+	STOP_DELETED     string = "deleted"
+	STOP_MAINTENANCE string = "maintenance"
+	STOP_DUPLICATE   string = "duplicate"
+)
+
+// Community relays refresh their registration every
+// COMMUNITY_RELAY_INTERVAL and close tunnels that carried nothing for
+// COMMUNITY_TUNNEL_TIMEOUT
+const (
+	COMMUNITY_RELAY_INTERVAL time.Duration = time.Minute * 2
+	COMMUNITY_TUNNEL_TIMEOUT time.Duration = time.Minute * 3
+)
+
+// Members tell each other which peers stopped answering their pings.
+// Reports older than LIVENESS_WINDOW are ignored. Peer that any member
+// can't reach is probed at once. It is timed out when it doesn't answer
+// within LIVENESS_PROBE_TIMEOUT and one in LIVENESS_QUORUM_SHARE connected
+// members, but no less than LIVENESS_QUORUM, can't reach it either
+const (
+	LIVENESS_WINDOW        time.Duration = time.Second * 30
+	LIVENESS_QUORUM        int           = 2
+	LIVENESS_QUORUM_SHARE  int           = 3
+	LIVENESS_PROBE_TIMEOUT time.Duration = time.Second * 2
+)
+
+// Authentication hook is given AUTH_HOOK_TIMEOUT to decide on a peer.
+// Decisions are remembered for AUTH_HOOK_CACHE and failures of the hook
+// for AUTH_HOOK_RETRY. Hook decides on AUTH_HOOK_MAX_PENDING peers at
+// once, others are asked about after they introduce themselves again
+const (
+	AUTH_HOOK_TIMEOUT     time.Duration = time.Second * 5
+	AUTH_HOOK_CACHE       time.Duration = time.Minute * 10
+	AUTH_HOOK_RETRY       time.Duration = time.Second * 10
+	AUTH_HOOK_MAX_PENDING int           = 16
+)
+
+// Tunnel ID of proxy handshake asking forwarder to open a tunnel
+const PROXY_REQUEST uint16 = 0xffff
+
+// Frames waiting to be copied to IDS. Further frames are dropped
+const MIRROR_QUEUE_SIZE int = 1024
+
+// How connection to a peer may be established
+type PathPolicy int
+
+const (
+	PATH_AUTO       PathPolicy = iota // Direct path is preferred, relay is a fallback
+	PATH_RELAY_ONLY                   // Peer is reached through forwarders only
+	PATH_NO_RELAY                     // Peer is never reached through forwarders
+	PATH_REDUNDANT                    // Data is sent over direct path and relay at once
+)
+
+// What is done with frames of ethertypes other than IP and ARP
+type EtherPolicy int
+
+const (
+	ETHER_DROP    EtherPolicy = iota // Frames are silently dropped
+	ETHER_FORWARD                    // Frames are sent to peers like IP traffic
+	ETHER_LOG                        // Frames are dropped and every new ethertype is logged
+)
+
+// What is done when instance exceeds its transfer quota
+type QuotaAction int
+
+const (
+	QUOTA_LOG      QuotaAction = iota // Excess is logged once per period
+	QUOTA_THROTTLE                    // Bandwidth is limited to a floor rate
+	QUOTA_PAUSE                       // Data traffic is dropped until the period ends
+)
+
+// How routes of the virtual network are kept apart from the main table
+type IsolationMode int
+
+const (
+	ISOLATION_NONE  IsolationMode = iota // Routes are installed into the main table
+	ISOLATION_VRF                        // Interface is enslaved to a VRF device
+	ISOLATION_TABLE                      // Routes are moved to a table selected by policy rules
+)
+
+// Interfaces which addresses are not advertised to other peers unless
+// advertise_exclude is specified in config
+var DEFAULT_ADVERTISE_EXCLUDE = []string{"docker*", "virbr*", "veth*", "vptp*", "tap*"}
@@ -0,0 +1,305 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// WebhookConfig describes an HTTP endpoint notified about peer events.
+// Each webhook receives events of selected types only, so joins and
+// leaves may go to different systems
+type WebhookConfig struct {
+	URL         string            `yaml:"url"`
+	Events      []string          `yaml:"events"`       // join, leave or relay-fallback. Every event if empty
+	Template    string            `yaml:"template"`     // Go template of payload. JSON with every field of event if empty
+	ContentType string            `yaml:"content_type"` // application/json if empty
+	Headers     map[string]string `yaml:"headers"`      // Extra headers, like authorization token
+}
+
+// PeerEvent is passed to payload template of a webhook
+type PeerEvent struct {
+	Type      string
+	Time      time.Time
+	Network   string // Hash of the network
+	Interface string // Interface of this instance
+	IP        string // Virtual IP of this instance
+	PeerID    string
+	PeerIP    string // Virtual IP of the peer
+	Endpoint  string // Address the peer is reached at
+	Forwarder string // Relay of the peer. Empty for direct paths
+	Reason    string // Why peer has left or fallen back to relay
+}
+
+const defaultWebhookTemplate = `{"event":{{json .Type}},"time":{{json .Time}},"network":{{json .Network}},` +
+	`"interface":{{json .Interface}},"ip":{{json .IP}},"peer":{{json .PeerID}},"peer_ip":{{json .PeerIP}},` +
+	`"endpoint":{{json .Endpoint}},"forwarder":{{json .Forwarder}},"reason":{{json .Reason}}}`
+
+var webhookFuncs = template.FuncMap{
+	// json quotes value, so templates produce valid JSON whatever
+	// peers report
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+type webhook struct {
+	url         string
+	events      []string
+	payload     *template.Template
+	contentType string
+	headers     map[string]string
+}
+
+type delivery struct {
+	hook    *webhook
+	event   string
+	payload []byte
+}
+
+// Webhooks delivers peer events without blocking the instance. Events
+// are dropped when endpoints don't keep up
+type Webhooks struct {
+	sent    uint64
+	failed  uint64
+	dropped uint64
+	hooks   []*webhook
+	client  *http.Client
+	queue   chan delivery
+	done    chan bool
+	once    sync.Once
+}
+
+// NewWebhooks validates webhooks of config file
+func NewWebhooks(cfgs []WebhookConfig) (*Webhooks, error) {
+	w := &Webhooks{
+		client: &http.Client{Timeout: WEBHOOK_TIMEOUT},
+		queue:  make(chan delivery, WEBHOOK_QUEUE_SIZE),
+		done:   make(chan bool),
+	}
+	for _, cfg := range cfgs {
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New(fmt.Sprintf("Bad URL of webhook: %s", cfg.URL))
+		}
+		for _, event := range cfg.Events {
+			if event != EVENT_JOIN && event != EVENT_LEAVE && event != EVENT_RELAY_FALLBACK {
+				return nil, errors.New(fmt.Sprintf("Unknown event %s of webhook %s", event, cfg.URL))
+			}
+		}
+		text := cfg.Template
+		if text == "" {
+			text = defaultWebhookTemplate
+		}
+		payload, err := template.New(cfg.URL).Funcs(webhookFuncs).Parse(text)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad template of webhook %s: %v", cfg.URL, err))
+		}
+		contentType := cfg.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		w.hooks = append(w.hooks, &webhook{
+			url:         cfg.URL,
+			events:      cfg.Events,
+			payload:     payload,
+			contentType: contentType,
+			headers:     cfg.Headers,
+		})
+	}
+	return w, nil
+}
+
+// wants returns true if webhook receives events of this type
+func (h *webhook) wants(event string) bool {
+	if len(h.events) == 0 {
+		return true
+	}
+	for _, e := range h.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// render returns payloads of an event for every webhook receiving it
+func (w *Webhooks) render(event PeerEvent) []delivery {
+	var result []delivery
+	for _, h := range w.hooks {
+		if !h.wants(event.Type) {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := h.payload.Execute(&buf, event); err != nil {
+			Log(WARNING, "Failed to render %s event for %s: %v", event.Type, h.url, err)
+			continue
+		}
+		result = append(result, delivery{hook: h, event: event.Type, payload: buf.Bytes()})
+	}
+	return result
+}
+
+// Emit queues event for webhooks receiving it
+func (w *Webhooks) Emit(event PeerEvent) {
+	for _, d := range w.render(event) {
+		select {
+		case w.queue <- d:
+		default:
+			atomic.AddUint64(&w.dropped, 1)
+			Log(WARNING, "Webhook %s doesn't keep up. Dropping %s event", d.hook.url, d.event)
+		}
+	}
+}
+
+// Run delivers queued events until webhooks are closed
+func (w *Webhooks) Run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case d := <-w.queue:
+			w.deliver(d)
+		}
+	}
+}
+
+// deliver posts payload to webhook. Failed deliveries are retried a few
+// times before the event is given up
+func (w *Webhooks) deliver(d delivery) {
+	for attempt := 0; ; attempt++ {
+		err := w.post(d)
+		if err == nil {
+			atomic.AddUint64(&w.sent, 1)
+			return
+		}
+		if attempt >= WEBHOOK_RETRIES {
+			atomic.AddUint64(&w.failed, 1)
+			Log(WARNING, "Failed to deliver %s event to %s: %v", d.event, d.hook.url, err)
+			return
+		}
+		Log(DEBUG, "Failed to deliver %s event to %s: %v. Retrying", d.event, d.hook.url, err)
+		select {
+		case <-w.done:
+			return
+		case <-time.After(WEBHOOK_RETRY_DELAY):
+		}
+	}
+}
+
+func (w *Webhooks) post(d delivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.hook.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", d.hook.contentType)
+	req.Header.Set("X-P2P-Event", d.event)
+	for name, value := range d.hook.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Endpoint responded with %s", resp.Status))
+	}
+	return nil
+}
+
+// Close stops delivery. Queued events are dropped
+func (w *Webhooks) Close() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *Webhooks) String() string {
+	return fmt.Sprintf("Webhooks: %d events delivered, %d failed, %d dropped",
+		atomic.LoadUint64(&w.sent), atomic.LoadUint64(&w.failed), atomic.LoadUint64(&w.dropped))
+}
+
+// StartWebhooks enables webhooks configured in config file
+func (p *PTPCloud) StartWebhooks() error {
+	if len(p.WebhookConfig) == 0 {
+		return nil
+	}
+	w, err := NewWebhooks(p.WebhookConfig)
+	if err != nil {
+		return err
+	}
+	p.Webhooks = w
+	p.Go(w.Run)
+	return nil
+}
+
+// StopWebhooks disables webhooks
+func (p *PTPCloud) StopWebhooks() {
+	if p.Webhooks == nil {
+		return
+	}
+	p.Webhooks.Close()
+	Log(INFO, "%s", p.Webhooks.String())
+}
+
+// emitPeerEvent records an event of the peer and notifies webhooks about it
+func (p *PTPCloud) emitPeerEvent(event string, np *NetworkPeer, reason string) {
+	if p.Webhooks == nil && p.Events == nil {
+		return
+	}
+	e := PeerEvent{
+		Type:      event,
+		Time:      time.Now(),
+		Interface: p.DeviceName,
+		PeerID:    np.ID,
+		Reason:    reason,
+	}
+	if p.Dht != nil {
+		e.Network = p.Dht.NetworkHash
+		if p.Dht.IP != nil {
+			e.IP = p.Dht.IP.String()
+		}
+	}
+	if np.PeerLocalIP != nil {
+		e.PeerIP = np.PeerLocalIP.String()
+	}
+	if np.Endpoint != nil {
+		e.Endpoint = np.Endpoint.String()
+	}
+	if np.Forwarder != nil {
+		e.Forwarder = np.Forwarder.String()
+	}
+	if p.Events != nil {
+		p.Events.Add(e)
+	}
+	if p.Webhooks != nil {
+		p.Webhooks.Emit(e)
+	}
+}
+
+// peerJoined emits join event once peer is connected
+func (p *PTPCloud) peerJoined(np *NetworkPeer) {
+	if !np.Joined.IsZero() {
+		return
+	}
+	np.Joined = time.Now()
+	p.emitPeerEvent(EVENT_JOIN, np, "")
+}
+
+// peerLeft emits leave event of a peer that has joined before
+func (p *PTPCloud) peerLeft(np *NetworkPeer, reason string) {
+	if np.Joined.IsZero() {
+		return
+	}
+	np.Joined = time.Time{}
+	p.emitPeerEvent(EVENT_LEAVE, np, reason)
+}
@@ -0,0 +1,88 @@
+package ptp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewWebhooks(t *testing.T) {
+	bad := []WebhookConfig{
+		{URL: "ftp://example.com/"},
+		{URL: "http://example.com/", Events: []string{"connect"}},
+		{URL: "http://example.com/", Template: "{{.Type"},
+	}
+	for _, cfg := range bad {
+		if _, err := NewWebhooks([]WebhookConfig{cfg}); err == nil {
+			t.Errorf("Bad webhook was accepted: %v", cfg)
+		}
+	}
+}
+
+func TestWebhookRouting(t *testing.T) {
+	w, err := NewWebhooks([]WebhookConfig{
+		{URL: "http://cmdb/", Events: []string{EVENT_JOIN, EVENT_LEAVE}},
+		{URL: "http://tickets/", Events: []string{EVENT_RELAY_FALLBACK}, Template: `{{.PeerID}} via {{.Forwarder}}: {{json .Reason}}`},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create webhooks: %v", err)
+	}
+	event := PeerEvent{Type: EVENT_JOIN, PeerID: "peer\"1", PeerIP: "10.0.0.2"}
+	deliveries := w.render(event)
+	if len(deliveries) != 1 || deliveries[0].hook.url != "http://cmdb/" {
+		t.Fatalf("Join was routed wrong: %v", deliveries)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(deliveries[0].payload, &payload); err != nil {
+		t.Fatalf("Default payload is not JSON: %v: %s", err, deliveries[0].payload)
+	}
+	if payload["event"] != EVENT_JOIN || payload["peer"] != "peer\"1" || payload["peer_ip"] != "10.0.0.2" {
+		t.Errorf("Wrong default payload: %s", deliveries[0].payload)
+	}
+
+	deliveries = w.render(PeerEvent{Type: EVENT_RELAY_FALLBACK, PeerID: "p", Forwarder: "1.2.3.4:6881", Reason: "No response"})
+	if len(deliveries) != 1 || string(deliveries[0].payload) != `p via 1.2.3.4:6881: "No response"` {
+		t.Errorf("Relay fallback was routed or rendered wrong: %v", deliveries)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		received <- r
+	}))
+	defer server.Close()
+
+	p := new(PTPCloud)
+	p.Resources = NewResources(0, 0, 0)
+	p.DeviceName = "vptp1"
+	p.WebhookConfig = []WebhookConfig{{URL: server.URL, Events: []string{EVENT_LEAVE}, Headers: map[string]string{"Authorization": "Bearer x"}}}
+	if err := p.StartWebhooks(); err != nil {
+		t.Fatalf("Failed to start webhooks: %v", err)
+	}
+	defer p.StopWebhooks()
+
+	peer := &NetworkPeer{ID: "peer", PeerLocalIP: net.ParseIP("10.0.0.2")}
+	p.peerLeft(peer, "Never joined")
+	p.peerJoined(peer)
+	p.peerJoined(peer)
+	p.peerLeft(peer, "Disconnected by timeout")
+	select {
+	case r := <-received:
+		if r.Header.Get("X-P2P-Event") != EVENT_LEAVE || r.Header.Get("Authorization") != "Bearer x" {
+			t.Errorf("Wrong headers of delivered event: %v", r.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Leave event wasn't delivered")
+	}
+	select {
+	case r := <-received:
+		t.Errorf("Unexpected %s event was delivered", r.Header.Get("X-P2P-Event"))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -6,9 +6,6 @@ import (
 	"testing"
 )
 
-func TestInitTuntap(t *testing.T) {
-	ret := InitTuntap()
-	if ret != 0 {
-		t.Errorf("Failed to initialize tuntap: %d", ret)
-	}
+func TestInitPlatform(t *testing.T) {
+	InitPlatform()
 }
@@ -4,12 +4,16 @@ import (
 	"flag"
 	"fmt"
 	ptp "github.com/subutai-io/p2p/lib"
+	"image/png"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
+	"strings"
 	"time"
 )
 
@@ -45,20 +49,59 @@ func StartProfiling(profile string) {
 func main() {
 
 	var (
-		argIp       string
-		argMac      string
-		argDev      string
-		argHash     string
-		argDht      string
-		argKeyfile  string
-		argKey      string
-		argTTL      string
-		argLog      string
-		argSaveFile string
-		argFwd      bool
-		argRPCPort  string
-		argProfile  string
-		argPort     int
+		argIp         string
+		argMac        string
+		argDev        string
+		argHash       string
+		argDht        string
+		argKeyfile    string
+		argKey        string
+		argTTL        string
+		argLog        string
+		argSaveFile   string
+		argFwd        bool
+		argRPCPort    string
+		argProfile    string
+		argPort       int
+		argBind       string
+		argPorts      string
+		argSchedule   string
+		argDSCP       string
+		argTags       string
+		argHubs       string
+		argPassword   string
+		argNewHash    string
+		argDelay      int
+		argWait       bool
+		argStatusPort string
+		argSNMP       string
+		argSNMPOID    string
+		argRelayOnly  string
+		argNoRelay    string
+		argPrivate    bool
+		argObserver   bool
+		argSplitDNS   string
+		argAcceptDNS  bool
+		argResolver   string
+		argServices   string
+		argRedundant  string
+		argName       string
+		argProto      string
+		argQR         bool
+		argPNG        string
+		argWatch      bool
+		argNeighbors  bool
+		argEtherTypes string
+		argHardened   bool
+		argFormat     string
+		argAdmin      string
+		argAdminKey   string
+		argMembers    string
+		argPeriod     string
+		argLifetime   string
+		argPeer       string
+		argAllow      string
+		argCheck      string
 	)
 
 	var Usage = func() {
@@ -68,9 +111,26 @@ func main() {
 		fmt.Printf("  start     Start new p2p instance\n")
 		fmt.Printf("  stop      Stop particular p2p instance\n")
 		fmt.Printf("  set       Modify p2p options during runtime\n")
+		fmt.Printf("  rekey     Rotate network hash and key for every member of the network\n")
+		fmt.Printf("  drain     Stop accepting peers and move traffic away before maintenance\n")
+		fmt.Printf("  export    Print bundle with options and keys of an instance\n")
+		fmt.Printf("  import    Start instance from previously exported bundle\n")
+		fmt.Printf("  invite    Print invitation code for a network\n")
+		fmt.Printf("  join      Join a network using invitation code\n")
+		fmt.Printf("  ephemeral Create or destroy short-lived network, e.g. for a CI job\n")
+		fmt.Printf("  identity  Show or rotate long-term identity of an instance\n")
+		fmt.Printf("  manifest  Sign, apply or show membership manifest of a network\n")
+		fmt.Printf("  service   List, announce or withdraw services within a network\n")
+		fmt.Printf("  filter    Limit traffic of a peer to selected protocols and ports\n")
 		fmt.Printf("  show      Display various information about p2p instances\n")
 		fmt.Printf("  status    Show detailed status about connectivity with each peer\n")
+		fmt.Printf("  traversal Show success rates of NAT traversal strategies\n")
+		fmt.Printf("  history   Show throughput and availability of peers over the last day or week\n")
 		fmt.Printf("  debug     Control debugging and profiling options\n")
+		fmt.Printf("  doctor    Check system for common configuration problems\n")
+		fmt.Printf("  policy    Print reference AppArmor or SELinux policy for the daemon\n")
+		fmt.Printf("  console   Run interactive console that completes hashes and peers and streams peer events\n")
+		fmt.Printf("  completion Print completion script for bash, zsh or fish\n")
 		fmt.Printf("  version   Display version information\n")
 		fmt.Printf("  help      Show this message or detailed information about commands listed above\n")
 		fmt.Printf("\n")
@@ -81,6 +141,10 @@ func main() {
 	daemon.StringVar(&argSaveFile, "save", "", "Path to restore file")
 	daemon.StringVar(&argRPCPort, "rpc", "52523", "Port for RPC communication")
 	daemon.StringVar(&argProfile, "profile", "", "Starts PTP package with profiling. Possible values : memory, cpu")
+	daemon.StringVar(&argStatusPort, "status", "", "Serve read-only status page on specified localhost `port`. Disabled by default")
+	daemon.StringVar(&argSNMP, "snmp", "", "Expose statistics over SNMP through AgentX master agent at specified `address`: path to unix socket or tcp:HOST:PORT. Disabled by default")
+	daemon.BoolVar(&argHardened, "hardened", false, "Confine daemon to configuration, state and runtime directories and known tools. Save file should be in the state directory. See 'p2p help policy'")
+	daemon.StringVar(&argSNMPOID, "snmp-oid", SNMP_DEFAULT_OID, "`OID` of the subtree registered with SNMP master agent")
 
 	start := flag.NewFlagSet("Startup options", flag.ContinueOnError)
 	start.StringVar(&argIp, "ip", "dhcp", "`IP` address to be used in local system. Should be specified in CIDR format or `dhcp` is used by default to receive free unused IP")
@@ -91,48 +155,226 @@ func main() {
 	start.StringVar(&argKeyfile, "keyfile", "", "Path to yaml file containing crypto key")
 	start.StringVar(&argKey, "key", "", "AES crypto key")
 	start.StringVar(&argTTL, "ttl", "", "Time until specified key will be available")
-	start.StringVar(&argTTL, "ports", "", "Ports range")
+	start.StringVar(&argPorts, "ports", "", "Ports `range` in a form of START-END. Port will be selected from this range and changed if it can't be used")
 	start.IntVar(&argPort, "port", 0, "`Port` that will be used for p2p communication. Random port number will be generated if no port were specified")
-	start.BoolVar(&argFwd, "fwd", false, "If specified, only external routing schemes will be used with use of proxy servers")
+	start.StringVar(&argBind, "bind", "", "Local `address` or interface name to bind p2p socket to. All interfaces are used by default")
+	start.StringVar(&argSchedule, "schedule", "", "Time `windows` during which instance should be up, e.g. \"Mon-Fri 09:00-18:00;Sat 10:00-14:00\"")
+	start.StringVar(&argDSCP, "dscp", "", "DSCP `value` of outgoing p2p packets: number from 0 to 63 or class name like EF or AF41")
+	start.StringVar(&argTags, "tags", "", "Comma-separated `tags` of this peer used in ACL rules of other peers, e.g. db-servers,backup")
+	start.StringVar(&argHubs, "hubs", "", "Comma-separated IDs, IPs or tags of hub `peers`. Instance exchanges traffic only with them and never with other spokes")
+	start.StringVar(&argRelayOnly, "relay-only", "", "Comma-separated IDs, IPs or tags of `peers` that are reached through forwarders only, so endpoints are not exposed to them")
+	start.StringVar(&argNoRelay, "no-relay", "", "Comma-separated IDs, IPs or tags of `peers` that are never reached through forwarders. Connection to them fails if there is no direct path")
+	start.StringVar(&argRedundant, "redundant", "", "Comma-separated IDs, IPs or tags of `peers` that data is sent to over direct path and relay at once. Trades bandwidth for lower loss")
+	start.BoolVar(&argPrivate, "private", false, "Privacy mode: local addresses are not advertised to routers and every peer is reached through forwarders")
+	start.BoolVar(&argObserver, "observer", false, "Observer mode: instance joins the network and receives broadcast traffic and traffic addressed to it, but never sends or forwards unicast data. For monitoring probes")
+	start.StringVar(&argSplitDNS, "split-dns", "", "Make this instance a DNS provider that pushes `rules` in a form of DOMAIN=RESOLVER[,DOMAIN=RESOLVER] to other members. Resolvers should be on the virtual network")
+	start.BoolVar(&argAcceptDNS, "accept-dns", false, "Install split-DNS rules pushed by DNS provider of the network while instance is up")
+	start.StringVar(&argResolver, "resolver", "", "Run caching stub resolver on port 53 of the virtual interface that forwards queries to `resolvers` in a form of IP[:PORT][,IP[:PORT]]. First resolver should be a peer, others are fallbacks")
+	start.StringVar(&argServices, "services", "", "Comma-separated `services` of this instance announced to other members in a form of NAME:PORT[/PROTO], e.g. web:80,dns:53/udp")
+	start.StringVar(&argAdmin, "admin", "", "Hex-encoded public `key` of network admin. Only peers listed in membership manifest signed by this key are accepted. See 'p2p help manifest'")
+	start.StringVar(&argEtherTypes, "ethertypes", "drop", "`Policy` for frames of ethertypes other than IP and ARP, like LLDP or PROFINET: forward them to peers, drop or log and drop. Status shows counters per ethertype")
+	start.BoolVar(&argFwd, "fwd", false, "If specified, only external routing schemes will be used with use of proxy servers. Peers on the same host or LAN are still connected directly")
 
 	stop := flag.NewFlagSet("Shutdown options", flag.ContinueOnError)
 	stop.StringVar(&argHash, "hash", "", "Infohash for environment")
 
 	show := flag.NewFlagSet("Show flagset", flag.ContinueOnError)
 	show.StringVar(&argHash, "hash", "", "Infohash for environment")
-	show.StringVar(&argIp, "check", "", "Check if integration with specified IP is finished")
+	show.StringVar(&argCheck, "check", "", "Check if integration with specified IP is finished")
+	show.BoolVar(&argWatch, "watch", false, "Refresh table of instances and peers with their state, path, RTT and throughput every second")
+	show.BoolVar(&argNeighbors, "neighbors", false, "Print IP to MAC mapping learned from peers of the instance specified with -hash")
 
 	set := flag.NewFlagSet("Option Setting", flag.ContinueOnError)
 	set.StringVar(&argLog, "log", "", "Log level")
 	set.StringVar(&argKey, "key", "", "AES crypto key")
 	set.StringVar(&argTTL, "ttl", "", "Time until specified key will be available")
+	set.StringVar(&argKeyfile, "keyfile", "", "Path to yaml file with a new crypto key. Running instance switches to it without restart")
 	set.StringVar(&argHash, "hash", "", "Infohash of environment")
 
+	rekey := flag.NewFlagSet("Network rotation options", flag.ContinueOnError)
+	rekey.StringVar(&argHash, "hash", "", "Current infohash of environment")
+	rekey.StringVar(&argNewHash, "newhash", "", "New infohash of environment")
+	rekey.StringVar(&argKey, "key", "", "New AES crypto key")
+	rekey.IntVar(&argDelay, "delay", 0, "Number of `seconds` given to members before rotation")
+	rekey.StringVar(&argAdminKey, "authority", "", "`File` with key pair of admin or rotation authority that approves rotation")
+
+	drain := flag.NewFlagSet("Draining options", flag.ContinueOnError)
+	drain.StringVar(&argHash, "hash", "", "Infohash of environment")
+	drain.BoolVar(&argWait, "wait", false, "Wait until traffic has ceased")
+
+	export := flag.NewFlagSet("Export options", flag.ContinueOnError)
+	export.StringVar(&argHash, "hash", "", "Infohash of environment")
+	export.StringVar(&argPassword, "passphrase", "", "Encrypt keys in the bundle with specified `passphrase`")
+
+	importBundle := flag.NewFlagSet("Import options", flag.ContinueOnError)
+	importBundle.StringVar(&argPassword, "passphrase", "", "`Passphrase` that keys of the bundle were encrypted with")
+
+	invite := flag.NewFlagSet("Invitation options", flag.ContinueOnError)
+	invite.StringVar(&argHash, "hash", "", "Infohash of environment")
+	invite.BoolVar(&argQR, "qr", false, "Print invitation as QR code in terminal")
+	invite.StringVar(&argPNG, "png", "", "Write invitation as QR code into PNG `file`")
+
+	join := flag.NewFlagSet("Join options", flag.ContinueOnError)
+	join.StringVar(&argKey, "key", "", "AES crypto key of the network. Required if network is encrypted")
+	join.StringVar(&argIp, "ip", "dhcp", "`IP` address to be used in local system in CIDR format or `dhcp`")
+	join.StringVar(&argPNG, "png", "", "Read invitation from PNG `file` with QR code instead of command line")
+
+	ephemeral := flag.NewFlagSet("Ephemeral network options", flag.ContinueOnError)
+	ephemeral.StringVar(&argHash, "hash", "", "Infohash of ephemeral network to destroy")
+	ephemeral.StringVar(&argIp, "ip", "dhcp", "`IP` address to be used in local system in CIDR format or `dhcp`")
+	ephemeral.StringVar(&argDht, "dht", "", "Specify DHT bootstrap node address in a form of `HOST:PORT[,HOST:PORT]`")
+	ephemeral.StringVar(&argLifetime, "lifetime", "", "`Duration` after which network is destroyed. 24h at most, which is the default")
+
+	identity := flag.NewFlagSet("Identity options", flag.ContinueOnError)
+	identity.StringVar(&argHash, "hash", "", "Infohash of environment")
+
+	manifest := flag.NewFlagSet("Manifest options", flag.ContinueOnError)
+	manifest.StringVar(&argHash, "hash", "", "Infohash of environment")
+	manifest.StringVar(&argAdminKey, "key", "", "`File` with admin key pair. Created if it doesn't exist")
+	manifest.StringVar(&argMembers, "members", "", "Comma-separated public `keys` of members. 'p2p identity' shows key of an instance")
+
+	service := flag.NewFlagSet("Service options", flag.ContinueOnError)
+	service.StringVar(&argHash, "hash", "", "Infohash of environment")
+	service.StringVar(&argName, "name", "", "`Name` of the service. Every service is listed if name is not specified")
+	service.IntVar(&argPort, "port", 0, "`Port` of announced service")
+	service.StringVar(&argProto, "proto", "tcp", "Protocol of announced service: tcp or udp")
+
+	filter := flag.NewFlagSet("Filter options", flag.ContinueOnError)
+	filter.StringVar(&argHash, "hash", "", "Infohash of environment")
+	filter.StringVar(&argPeer, "peer", "", "ID, IP or tag of the `peer`")
+	filter.StringVar(&argAllow, "allow", "", "Comma-separated `protocols` and ports allowed for the peer in a form of PROTO[/PORTS], e.g. tcp/22,icmp")
+
+	doctor := flag.NewFlagSet("Diagnostics options", flag.ContinueOnError)
+	doctor.StringVar(&argDht, "dht", "", "Check DHT bootstrap nodes in a form of `HOST:PORT[,HOST:PORT]`")
+	doctor.IntVar(&argPort, "port", 0, "Check that p2p can bind specified `port`")
+
+	traversal := flag.NewFlagSet("Traversal statistics options", flag.ContinueOnError)
+	traversal.StringVar(&argHash, "hash", "", "Infohash of environment. Statistics of every instance are shown by default")
+
+	history := flag.NewFlagSet("History options", flag.ContinueOnError)
+	history.StringVar(&argHash, "hash", "", "Infohash of environment")
+	history.StringVar(&argPeriod, "period", "day", "`Period` to summarize: day or week")
+
 	debug := flag.NewFlagSet("Debug and Profiling mode", flag.ContinueOnError)
 
+	policy := flag.NewFlagSet("Policy options", flag.ContinueOnError)
+	policy.StringVar(&argFormat, "format", "apparmor", "`Format` of the policy: apparmor or selinux")
+
+	// Commands and their options completion scripts are generated for
+	commands := map[string]*flag.FlagSet{
+		"daemon": daemon, "start": start, "stop": stop, "show": show, "set": set,
+		"rekey": rekey, "drain": drain, "export": export, "import": importBundle,
+		"invite": invite, "join": join, "ephemeral": ephemeral, "identity": identity,
+		"manifest": manifest, "service": service, "filter": filter, "doctor": doctor,
+		"traversal": traversal, "history": history, "debug": debug, "policy": policy,
+		"status": nil, "version": nil, "help": nil, "console": nil, "completion": nil,
+	}
+
 	if len(os.Args) < 2 {
 		os.Args = append(os.Args, "help")
 	}
 
 	switch os.Args[1] {
+	case ptp.SANDBOX_COMMAND:
+		ptp.SandboxWorker()
 	case "daemon":
 		daemon.Parse(os.Args[2:])
-		Daemon(argRPCPort, argSaveFile, argProfile)
+		Daemon(argRPCPort, argSaveFile, argProfile, argStatusPort, argSNMP, argSNMPOID, argHardened)
 	case "start":
 		start.Parse(os.Args[2:])
-		Start(argRPCPort, argIp, argHash, argMac, argDev, argDht, argKeyfile, argKey, argTTL, argFwd, argPort)
+		Start(argRPCPort, argIp, argHash, argMac, argDev, argDht, argKeyfile, argKey, argTTL, argFwd, argPort, argBind, argPorts, argSchedule, argDSCP, argTags, argHubs, argRelayOnly, argNoRelay, argPrivate, argObserver, argSplitDNS, argAcceptDNS, argResolver, argServices, argRedundant, argEtherTypes, argAdmin)
 	case "stop":
 		stop.Parse(os.Args[2:])
 		Stop(argRPCPort, argHash)
 	case "show":
 		show.Parse(os.Args[2:])
-		Show(argRPCPort, argHash, argIp)
+		if argWatch {
+			Watch(argRPCPort, argHash)
+		}
+		if argNeighbors {
+			Neighbors(argRPCPort, argHash)
+		}
+		Show(argRPCPort, argHash, argCheck)
 	case "set":
 		set.Parse(os.Args[2:])
 		Set(argRPCPort, argLog, argHash, argKeyfile, argKey, argTTL)
+	case "rekey":
+		rekey.Parse(os.Args[2:])
+		Rekey(argRPCPort, argHash, argNewHash, argKey, argAdminKey, argDelay)
+	case "drain":
+		drain.Parse(os.Args[2:])
+		Drain(argRPCPort, argHash, argWait)
+	case "export":
+		export.Parse(os.Args[2:])
+		Export(argRPCPort, argHash, argPassword)
+	case "import":
+		importBundle.Parse(os.Args[2:])
+		Import(argRPCPort, importBundle.Arg(0), argPassword)
+	case "invite":
+		invite.Parse(os.Args[2:])
+		Invite(argRPCPort, argHash, argQR, argPNG)
+	case "join":
+		join.Parse(os.Args[2:])
+		Join(argRPCPort, join.Arg(0), argKey, argIp, argPNG)
+	case "ephemeral":
+		// Action goes before options: p2p ephemeral destroy -hash HASH
+		action := "create"
+		args := os.Args[2:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			action = args[0]
+			args = args[1:]
+		}
+		ephemeral.Parse(args)
+		Ephemeral(argRPCPort, action, argHash, argIp, argDht, argLifetime)
+	case "identity":
+		// Action goes before options: p2p identity rotate -hash HASH
+		action := "show"
+		args := os.Args[2:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			action = args[0]
+			args = args[1:]
+		}
+		identity.Parse(args)
+		Identity(argRPCPort, action, argHash)
+	case "manifest":
+		// Action goes before options: p2p manifest sign -key FILE -hash HASH
+		action := "show"
+		args := os.Args[2:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			action = args[0]
+			args = args[1:]
+		}
+		manifest.Parse(args)
+		Manifest(argRPCPort, action, argHash, argAdminKey, argMembers, manifest.Arg(0))
+	case "service":
+		// Action goes before options: p2p service announce -name web -port 80
+		action := "list"
+		args := os.Args[2:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			action = args[0]
+			args = args[1:]
+		}
+		service.Parse(args)
+		Service(argRPCPort, action, argHash, argName, argPort, argProto)
+	case "filter":
+		// Action goes before options: p2p filter set -peer X -allow tcp/22
+		action := "list"
+		args := os.Args[2:]
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			action = args[0]
+			args = args[1:]
+		}
+		filter.Parse(args)
+		Filter(argRPCPort, action, argHash, argPeer, argAllow)
+	case "doctor":
+		doctor.Parse(os.Args[2:])
+		Doctor(argRPCPort, argDht, argPort)
 	case "debug":
 		debug.Parse(os.Args[2:])
 		Debug(argRPCPort)
+	case "policy":
+		policy.Parse(os.Args[2:])
+		Policy(argFormat)
 	case "version":
 		fmt.Printf("p2p Cloud project %s. Packet version: %s\n", VERSION, ptp.PACKET_VERSION)
 		os.Exit(0)
@@ -141,6 +383,23 @@ func main() {
 		os.Exit(0)
 	case "status":
 		ShowStatus(argRPCPort)
+	case "traversal":
+		traversal.Parse(os.Args[2:])
+		Traversal(argRPCPort, argHash)
+	case "history":
+		history.Parse(os.Args[2:])
+		History(argRPCPort, argHash, argPeriod)
+	case "console":
+		RunConsole(argRPCPort)
+	case "completion":
+		shell := "bash"
+		if len(os.Args) > 2 {
+			shell = os.Args[2]
+		}
+		Completion(shell, commands)
+	case "__complete":
+		// Used by completion scripts: p2p __complete hashes|peers [HASH]
+		CompleteCandidates(argRPCPort, os.Args[2:])
 	case "help":
 		if len(os.Args) > 2 {
 			switch os.Args[2] {
@@ -159,6 +418,55 @@ func main() {
 			case "set":
 				UsageSet()
 				set.PrintDefaults()
+			case "rekey":
+				UsageRekey()
+				rekey.PrintDefaults()
+			case "drain":
+				UsageDrain()
+				drain.PrintDefaults()
+			case "doctor":
+				UsageDoctor()
+				doctor.PrintDefaults()
+			case "export":
+				UsageExport()
+				export.PrintDefaults()
+			case "import":
+				UsageImport()
+				importBundle.PrintDefaults()
+			case "invite":
+				UsageInvite()
+				invite.PrintDefaults()
+			case "join":
+				UsageJoin()
+				join.PrintDefaults()
+			case "ephemeral":
+				UsageEphemeral()
+				ephemeral.PrintDefaults()
+			case "identity":
+				UsageIdentity()
+				identity.PrintDefaults()
+			case "manifest":
+				UsageManifest()
+				manifest.PrintDefaults()
+			case "service":
+				UsageService()
+				service.PrintDefaults()
+			case "filter":
+				UsageFilter()
+				filter.PrintDefaults()
+			case "traversal":
+				UsageTraversal()
+				traversal.PrintDefaults()
+			case "history":
+				UsageHistory()
+				history.PrintDefaults()
+			case "policy":
+				UsagePolicy()
+				policy.PrintDefaults()
+			case "console":
+				UsageConsole()
+			case "completion":
+				UsageCompletion()
 			}
 
 		} else {
@@ -180,7 +488,7 @@ func Dial(port string) *rpc.Client {
 	return client
 }
 
-func Start(rpcPort, ip, hash, mac, dev, dht, keyfile, key, ttl string, fwd bool, port int) {
+func Start(rpcPort, ip, hash, mac, dev, dht, keyfile, key, ttl string, fwd bool, port int, bind, ports, schedule, dscp, tags, hubs, relayOnly, noRelay string, private, observer bool, splitDNS string, acceptDNS bool, resolver, services, redundant, etherTypes, admin string) {
 	client := Dial(rpcPort)
 	var response Response
 
@@ -217,15 +525,105 @@ func Start(rpcPort, ip, hash, mac, dev, dht, keyfile, key, ttl string, fwd bool,
 	args.TTL = ttl
 	args.Fwd = fwd
 	args.Port = port
+	args.Bind = bind
+	if ports != "" {
+		_, _, err := ptp.ParsePortRange(ports)
+		if err != nil {
+			fmt.Printf("Invalid ports range: %v\n", err)
+			return
+		}
+	}
+	args.Ports = ports
+	if schedule != "" {
+		_, err := ptp.ParseSchedule(schedule)
+		if err != nil {
+			fmt.Printf("Invalid schedule: %v\n", err)
+			return
+		}
+	}
+	args.Schedule = schedule
+	if dscp != "" {
+		_, err := ptp.ParseDSCP(dscp)
+		if err != nil {
+			fmt.Printf("Invalid DSCP value: %v\n", err)
+			return
+		}
+	}
+	args.DSCP = dscp
+	if tags != "" {
+		_, err := ptp.ParseTags(tags)
+		if err != nil {
+			fmt.Printf("Invalid tags: %v\n", err)
+			return
+		}
+	}
+	args.Tags = tags
+	if hubs != "" {
+		_, err := ptp.ParseHubs(hubs)
+		if err != nil {
+			fmt.Printf("Invalid hubs: %v\n", err)
+			return
+		}
+	}
+	args.Hubs = hubs
+	for _, peers := range []string{relayOnly, noRelay, redundant} {
+		if _, err := ptp.ParseTags(peers); err != nil {
+			fmt.Printf("Invalid list of peers: %v\n", err)
+			return
+		}
+	}
+	args.Relayed = relayOnly
+	args.NoRelay = noRelay
+	args.Dual = redundant
+	args.Private = private
+	args.Observer = observer
+	if observer && (splitDNS != "" || services != "") {
+		fmt.Printf("Observer can't push split-DNS rules or announce services\n")
+		return
+	}
+	if observer && resolver != "" {
+		fmt.Printf("Observer can't forward DNS queries to peers\n")
+		return
+	}
+	if _, err := ptp.ParseDNSRules(splitDNS); err != nil {
+		fmt.Printf("Invalid split-DNS rules: %v\n", err)
+		return
+	}
+	args.DNS = splitDNS
+	args.PeerDNS = acceptDNS
+	if resolver != "" {
+		if _, err := ptp.ParseUpstreams(resolver); err != nil {
+			fmt.Printf("Invalid list of resolvers: %v\n", err)
+			return
+		}
+	}
+	args.Resolver = resolver
+	if _, err := ptp.ParseServices(services); err != nil {
+		fmt.Printf("Invalid list of services: %v\n", err)
+		return
+	}
+	args.Services = services
+	if _, err := ptp.ParseEtherPolicy(etherTypes); err != nil {
+		fmt.Printf("Invalid ethertype policy: %v\n", err)
+		return
+	}
+	args.Ether = etherTypes
+	if admin != "" {
+		if _, err := ptp.ParseAdminKey(admin); err != nil {
+			fmt.Printf("Invalid admin key: %v\n", err)
+			return
+		}
+	}
+	args.Admin = admin
 	err := client.Call("Procedures.Run", args, &response)
 	if err != nil {
 		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	if response.ExitCode == 0 {
 		fmt.Printf("%s\n", response.Output)
 	} else {
-		fmt.Errorf("%s\n", response.Output)
+		fmt.Fprintf(os.Stderr, "%s\n", response.Output)
 	}
 	os.Exit(response.ExitCode)
 }
@@ -293,6 +691,51 @@ func ShowStatus(rpcPort string) {
 	os.Exit(response.ExitCode)
 }
 
+func Neighbors(rpcPort, hash string) {
+	if hash == "" {
+		fmt.Printf("Specify instance with -hash option\n")
+		os.Exit(1)
+	}
+	client := Dial(rpcPort)
+	var response Response
+	err := client.Call("Procedures.Neighbors", &RunArgs{Hash: hash}, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Traversal(rpcPort, hash string) {
+	client := Dial(rpcPort)
+	var response Response
+	args := &RunArgs{Hash: hash}
+	err := client.Call("Procedures.Traversal", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func History(rpcPort, hash, period string) {
+	if hash == "" {
+		fmt.Printf("Specify instance with -hash option\n")
+		os.Exit(1)
+	}
+	client := Dial(rpcPort)
+	var response Response
+	err := client.Call("Procedures.History", &HistoryArgs{Hash: hash, Period: period}, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
 func Set(rpcPort, log, hash, keyfile, key, ttl string) {
 	client := Dial(rpcPort)
 	var response Response
@@ -306,6 +749,16 @@ func Set(rpcPort, log, hash, keyfile, key, ttl string) {
 		args.TTL = ttl
 		args.Hash = hash
 		err = client.Call("Procedures.AddKey", args, &response)
+	} else if keyfile != "" {
+		args := &RunArgs{}
+		args.Hash = hash
+		// Daemon may run in another working directory
+		args.Keyfile, err = filepath.Abs(keyfile)
+		if err != nil {
+			fmt.Printf("Invalid key file path: %v\n", err)
+			return
+		}
+		err = client.Call("Procedures.SwapKey", args, &response)
 	}
 	if err != nil {
 		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
@@ -319,6 +772,321 @@ func Set(rpcPort, log, hash, keyfile, key, ttl string) {
 	os.Exit(response.ExitCode)
 }
 
+func Rekey(rpcPort, hash, newHash, key, authorityFile string, delay int) {
+	if hash == "" || newHash == "" || key == "" {
+		fmt.Printf("Specify current hash, new hash and new key with -hash, -newhash and -key arguments\n")
+		return
+	}
+	if authorityFile == "" {
+		fmt.Printf("Specify file with key pair of admin or rotation authority with -authority argument\n")
+		return
+	}
+	// Rotation is approved here, so key of the authority never leaves
+	// this process
+	authority, err := ptp.LoadIdentity(authorityFile)
+	if err != nil {
+		fmt.Printf("Failed to load key of authority: %v\n", err)
+		os.Exit(1)
+	}
+	wait := ptp.REKEY_DEFAULT_DELAY
+	if delay > 0 {
+		wait = time.Duration(delay) * time.Second
+	}
+	at := time.Unix(time.Now().Add(wait).Unix(), 0)
+	approval := ptp.ApproveRekey(authority, hash, newHash, []byte(PadKey(key)), at)
+	args := &RekeyArgs{Hash: hash, NewHash: newHash, Key: key, At: at.Unix(), Authority: authority.PublicKeyString(), Approval: approval}
+	client := Dial(rpcPort)
+	var response Response
+	err = client.Call("Procedures.Rekey", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Drain(rpcPort, hash string, wait bool) {
+	client := Dial(rpcPort)
+	if hash == "" {
+		fmt.Printf("Specify a hash of instance with -hash argument\n")
+		return
+	}
+	args := &RunArgs{Hash: hash}
+	for {
+		var response Response
+		err := client.Call("Procedures.Drain", args, &response)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+			return
+		}
+		fmt.Printf("%s\n", response.Output)
+		if wait && response.ExitCode == EXIT_DRAINING {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if response.ExitCode == EXIT_DRAINING {
+			// Draining has started successfully
+			os.Exit(0)
+		}
+		os.Exit(response.ExitCode)
+	}
+}
+
+func Export(rpcPort, hash, passphrase string) {
+	client := Dial(rpcPort)
+	var response Response
+	if hash == "" {
+		fmt.Printf("Specify a hash of instance with -hash argument\n")
+		return
+	}
+	args := &BundleArgs{Hash: hash, Passphrase: passphrase}
+	err := client.Call("Procedures.Export", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Import(rpcPort, filename, passphrase string) {
+	if filename == "" {
+		fmt.Printf("Specify path to the bundle file\n")
+		return
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Printf("Failed to read bundle: %v\n", err)
+		return
+	}
+	client := Dial(rpcPort)
+	var response Response
+	args := &BundleArgs{Data: string(data), Passphrase: passphrase}
+	err = client.Call("Procedures.Import", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		return
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Ephemeral(rpcPort, action, hash, ip, dht, lifetime string) {
+	if action != "create" && action != "destroy" {
+		fmt.Printf("Unknown action %s. Use create or destroy\n", action)
+		os.Exit(1)
+	}
+	if action == "destroy" && hash == "" {
+		fmt.Printf("Specify a hash of ephemeral network with -hash argument\n")
+		os.Exit(1)
+	}
+	if _, err := ParseLifetime(lifetime); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	client := Dial(rpcPort)
+	var response Response
+	args := &EphemeralArgs{Hash: hash, IP: ip, Dht: dht, Lifetime: lifetime}
+	procedure := "Procedures.CreateEphemeral"
+	if action == "destroy" {
+		procedure = "Procedures.DestroyEphemeral"
+	}
+	err := client.Call(procedure, args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Filter(rpcPort, action, hash, peer, allow string) {
+	if action != "list" && action != "set" && action != "clear" {
+		fmt.Printf("Unknown action %s. Use list, set or clear\n", action)
+		os.Exit(1)
+	}
+	if hash == "" {
+		fmt.Printf("Specify a hash of instance with -hash argument\n")
+		os.Exit(1)
+	}
+	if action != "list" && peer == "" {
+		fmt.Printf("Specify a peer with -peer argument\n")
+		os.Exit(1)
+	}
+	if action == "set" {
+		if _, err := ptp.ParseFilterEntries(allow); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	client := Dial(rpcPort)
+	var response Response
+	args := &FilterArgs{Hash: hash, Action: action, Peer: peer, Allow: allow}
+	err := client.Call("Procedures.Filter", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Identity(rpcPort, action, hash string) {
+	if action != "show" && action != "rotate" {
+		fmt.Printf("Unknown action %s. Use show or rotate\n", action)
+		os.Exit(1)
+	}
+	if hash == "" {
+		fmt.Printf("Specify a hash of instance with -hash argument\n")
+		os.Exit(1)
+	}
+	client := Dial(rpcPort)
+	var response Response
+	args := &IdentityArgs{Hash: hash, Rotate: action == "rotate"}
+	err := client.Call("Procedures.Identity", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Service(rpcPort, action, hash, name string, port int, proto string) {
+	if action != "list" && action != "announce" && action != "withdraw" {
+		fmt.Printf("Unknown action %s. Use list, announce or withdraw\n", action)
+		os.Exit(1)
+	}
+	if hash == "" {
+		fmt.Printf("Specify a hash of instance with -hash argument\n")
+		os.Exit(1)
+	}
+	if action != "list" && name == "" {
+		fmt.Printf("Specify a name of the service with -name argument\n")
+		os.Exit(1)
+	}
+	client := Dial(rpcPort)
+	var response Response
+	args := &ServiceArgs{Hash: hash, Action: action, Name: name, Port: port, Proto: proto}
+	err := client.Call("Procedures.Service", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Invite(rpcPort, hash string, qr bool, pngFile string) {
+	if hash == "" {
+		fmt.Printf("Specify a hash of instance with -hash argument\n")
+		return
+	}
+	client := Dial(rpcPort)
+	var response Response
+	err := client.Call("Procedures.Invite", &InviteArgs{Hash: hash}, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		os.Exit(1)
+	}
+	if response.ExitCode != 0 || (!qr && pngFile == "") {
+		fmt.Printf("%s\n", response.Output)
+		os.Exit(response.ExitCode)
+	}
+	code, err := EncodeQR([]byte(response.Output))
+	if err != nil {
+		fmt.Printf("Failed to create QR code: %v\n", err)
+		os.Exit(1)
+	}
+	if pngFile != "" {
+		f, err := os.Create(pngFile)
+		if err == nil {
+			err = code.WritePNG(f)
+			f.Close()
+		}
+		if err != nil {
+			fmt.Printf("Failed to write QR code: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if qr {
+		fmt.Printf("%s", code.Terminal())
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(0)
+}
+
+func Join(rpcPort, code, key, ip, pngFile string) {
+	if pngFile != "" {
+		f, err := os.Open(pngFile)
+		if err != nil {
+			fmt.Printf("Failed to open QR code: %v\n", err)
+			os.Exit(1)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("Failed to read QR code: %v\n", err)
+			os.Exit(1)
+		}
+		data, err := DecodeQR(img)
+		if err != nil {
+			fmt.Printf("Failed to read QR code: %v\n", err)
+			os.Exit(1)
+		}
+		code = string(data)
+	}
+	if code == "" {
+		fmt.Printf("Specify invitation code\n")
+		return
+	}
+	// Code is checked before daemon is asked, so typos are reported early
+	inv, err := ParseInvitation(code)
+	if err == nil {
+		err = inv.CheckKey(key)
+	}
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	client := Dial(rpcPort)
+	var response Response
+	args := &InviteArgs{Code: code, Key: key, IP: ip}
+	err = client.Call("Procedures.Join", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
+
+func Doctor(rpcPort, dht string, port int) {
+	findings := ptp.RunDiagnostics(dht, port)
+	daemon := ptp.DoctorFinding{Check: "Daemon", Details: "Daemon is listening on RPC port " + rpcPort}
+	client, err := rpc.DialHTTP("tcp", "localhost:"+rpcPort)
+	if err != nil {
+		daemon.Status = ptp.DOCTOR_WARNING
+		daemon.Details = "Daemon is not running on RPC port " + rpcPort
+		daemon.Advice = "Start it with 'p2p daemon'"
+	} else {
+		client.Close()
+	}
+	findings = append([]ptp.DoctorFinding{daemon}, findings...)
+	exitCode := 0
+	for _, f := range findings {
+		fmt.Printf("[%7s] %s: %s\n", f.Status, f.Check, f.Details)
+		if f.Advice != "" {
+			fmt.Printf("          %s\n", f.Advice)
+		}
+		if f.Status == ptp.DOCTOR_FAIL {
+			exitCode = 1
+		}
+	}
+	os.Exit(exitCode)
+}
+
 func Debug(rpcPort string) {
 	client := Dial(rpcPort)
 	var response Response
@@ -332,7 +1100,7 @@ func Debug(rpcPort string) {
 	os.Exit(response.ExitCode)
 }
 
-func Daemon(port, saveFile, profiling string) {
+func Daemon(port, saveFile, profiling, statusPort, snmp, snmpOID string, hardened bool) {
 	StartProfiling(profiling)
 	ptp.InitPlatform()
 	Instances = make(map[string]Instance)
@@ -341,6 +1109,16 @@ func Daemon(port, saveFile, profiling string) {
 	if !ptp.CheckPermissions() {
 		os.Exit(1)
 	}
+	if hardened {
+		paths := ptp.DefaultPaths()
+		ptp.Confine(&paths)
+		if saveFile != "" {
+			if err := ptp.CheckAccess(saveFile); err != nil {
+				ptp.Log(ptp.ERROR, "Can't use save file: %v", err)
+				os.Exit(1)
+			}
+		}
+	}
 
 	proc := new(Procedures)
 	rpc.Register(proc)
@@ -363,6 +1141,9 @@ func Daemon(port, saveFile, profiling string) {
 			for _, inst := range instances {
 				resp := new(Response)
 				proc.Run(&inst, resp)
+				if resp.ExitCode != 0 {
+					ptp.Log(ptp.ERROR, "Failed to restore instance %s: %s", inst.Hash, resp.Output)
+				}
 			}
 		}
 	}
@@ -370,6 +1151,22 @@ func Daemon(port, saveFile, profiling string) {
 	ptp.Log(ptp.INFO, "Starting RPC Listener on %s port", port)
 	go http.Serve(listen, nil)
 
+	if statusPort != "" {
+		err = StartStatusPage(statusPort)
+		if err != nil {
+			ptp.Log(ptp.ERROR, "Cannot start status page: %v", err)
+		}
+	}
+
+	if snmp != "" {
+		subtree, err := ParseOID(snmpOID)
+		if err != nil {
+			ptp.Log(ptp.ERROR, "Cannot start SNMP subagent: %v", err)
+		} else {
+			go RunAgentX(snmp, subtree)
+		}
+	}
+
 	// Capture SIGINT
 	// This is used for development purposes only, but later we should consider updating
 	// this code to handle signals
@@ -385,6 +1182,11 @@ func Daemon(port, saveFile, profiling string) {
 	}()
 	for {
 		time.Sleep(1 * time.Second)
+		SyncInstances()
+		SaveNeighbors()
+		ApplySchedules()
+		RestartCrashed()
+		ExpireEphemeral()
 	}
 	return
 }
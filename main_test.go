@@ -1,8 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
 )
 
 func TestStateRestore(t *testing.T) {
@@ -43,3 +57,493 @@ func TestStateRestore(t *testing.T) {
 	}
 	os.Remove("t.file")
 }
+
+func TestBundle(t *testing.T) {
+	var inst Instance
+	inst.Args.Hash = "bundle-hash"
+	inst.Args.Dev = "vptp1"
+	inst.Args.Key = PadKey("secret")
+	inst.Args.TTL = "1893456000"
+	b, err := NewBundle(inst, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create bundle: %v", err)
+	}
+	if b.Options.Key != "" || !b.Encrypted {
+		t.Errorf("Key was exported in plain text")
+	}
+	other, _ := NewBundle(inst, "passphrase")
+	if bytes.Equal(other.Salt, b.Salt) {
+		t.Errorf("Bundles share salt of the passphrase")
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("Failed to encode bundle: %v", err)
+	}
+	if _, err := ParseBundle(data, "wrong"); err == nil {
+		t.Errorf("Bundle was decrypted with wrong passphrase")
+	}
+	parsed, err := ParseBundle(data, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to parse bundle: %v", err)
+	}
+	if parsed.Options.Hash != "bundle-hash" || parsed.Options.Dev != "vptp1" {
+		t.Errorf("Options doesn't match exported")
+	}
+	if len(parsed.Keys) != 1 || string(parsed.Keys[0].Key) != PadKey("secret") || parsed.Keys[0].Until.Unix() != 1893456000 {
+		t.Errorf("Keys doesn't match exported")
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	if RestartBackoff(1) != RESTART_BACKOFF_MIN {
+		t.Errorf("First restart should use minimal backoff")
+	}
+	if RestartBackoff(3) != 4*RESTART_BACKOFF_MIN {
+		t.Errorf("Backoff should double after every crash")
+	}
+	if RestartBackoff(100) != RESTART_BACKOFF_MAX {
+		t.Errorf("Backoff exceeds maximum value")
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	Instances = make(map[string]Instance)
+	var i Instance
+	i.Args.Hash = "status-hash"
+	Instances["status-hash"] = i
+	ptp.Log(ptp.WARNING, "Status page <test> event")
+
+	w := httptest.NewRecorder()
+	ServeStatusPage(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status page returned %d", w.Code)
+	}
+	if !strings.Contains(body, "status-hash") {
+		t.Errorf("Instance is missing on status page")
+	}
+	if !strings.Contains(body, "Status page &lt;test&gt; event") {
+		t.Errorf("Recent event is missing or not escaped on status page")
+	}
+
+	w = httptest.NewRecorder()
+	ServeStatusPage(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Status page should be read-only")
+	}
+}
+
+func TestAgentX(t *testing.T) {
+	subtree, err := ParseOID("1.3.6.1.4.1.48777.1")
+	if err != nil {
+		t.Fatalf("Failed to parse OID: %v", err)
+	}
+	if subtree.String() != "1.3.6.1.4.1.48777.1" {
+		t.Errorf("Wrong string representation of OID: %s", subtree)
+	}
+	vars := []SNMPVar{
+		{Name: OID{1, 1, 0}, Type: SNMP_GAUGE32, Value: uint32(2)},
+		{Name: OID{1, 2, 1, 1, 1}, Type: SNMP_OCTET_STRING, Value: "hash"},
+	}
+	agent := &AgentX{Subtree: OID{1}, Vars: func() []SNMPVar { return vars }}
+	master, sub := net.Pipe()
+	defer master.Close()
+	done := make(chan error, 1)
+	go func() {
+		if err := agent.Open(sub); err != nil {
+			done <- err
+			return
+		}
+		done <- agent.Serve()
+	}()
+
+	reply := func(session uint32) {
+		h, _, _, err := readPDU(master)
+		if err != nil {
+			t.Fatalf("Failed to read PDU of subagent: %v", err)
+		}
+		h.Session = session
+		master.Write(agent.response(h, 0, nil))
+	}
+	reply(7) // Open
+	reply(7) // Register
+	if agent.session != 7 {
+		t.Errorf("Session ID wasn't saved: %d", agent.session)
+	}
+
+	// GetNext from the beginning of subtree returns the first variable
+	b := new(bytes.Buffer)
+	writeOID(b, OID{1}, false)
+	writeOID(b, nil, false)
+	master.Write(encodePDU(agentxHeader{Type: AGENTX_GETNEXT, Session: 7, Packet: 1}, b.Bytes()))
+	h, order, payload, err := readPDU(master)
+	if err != nil || h.Type != AGENTX_RESPONSE || h.Packet != 1 {
+		t.Fatalf("Bad response to GetNext: %v %+v", err, h)
+	}
+	if len(payload) < 8 || order.Uint16(payload[4:]) != 0 {
+		t.Fatalf("GetNext returned an error")
+	}
+	expected := new(bytes.Buffer)
+	writeVar(expected, vars[0])
+	if !bytes.Equal(payload[8:], expected.Bytes()) {
+		t.Errorf("GetNext returned wrong variable")
+	}
+
+	if v := lookup(vars, searchRange{Start: OID{1, 1, 0}}, true); v.Name.Compare(vars[1].Name) != 0 {
+		t.Errorf("GetNext should skip requested OID")
+	}
+	if v := lookup(vars, searchRange{Start: OID{1, 2, 1, 1, 1}}, true); v.Type != SNMP_END_OF_MIB {
+		t.Errorf("GetNext after the last variable should return endOfMibView")
+	}
+	if v := lookup(vars, searchRange{Start: OID{1, 1}}, false); v.Type != SNMP_NO_SUCH {
+		t.Errorf("Get of missing variable should return noSuchInstance")
+	}
+
+	master.Write(encodePDU(agentxHeader{Type: AGENTX_CLOSE, Session: 7}, []byte{1, 0, 0, 0}))
+	if err := <-done; err == nil {
+		t.Errorf("Serve should return when master closes session")
+	}
+}
+
+func TestRunArgsOptions(t *testing.T) {
+	args := &RunArgs{IP: "10.0.0.1/24", Hash: "net", Dht: "router:6881", Fwd: true, Port: 1234, Tags: "db", Relayed: "dmz", NoRelay: "db", DNS: "corp=10.0.0.53", PeerDNS: true, Services: "web:80", Dual: "voip"}
+	opts := args.Options()
+	if opts.IP != args.IP || opts.Hash != args.Hash || opts.Routers != args.Dht || !opts.Forward || opts.Port != 1234 || opts.Tags != "db" {
+		t.Errorf("Arguments weren't converted into options: %+v", opts)
+	}
+	if opts.RelayOnly != "dmz" || opts.NoRelay != "db" || opts.SplitDNS != "corp=10.0.0.53" || !opts.AcceptDNS || opts.Services != "web:80" || opts.Redundant != "voip" {
+		t.Errorf("Arguments weren't converted into options: %+v", opts)
+	}
+}
+
+func TestNeighborsRestore(t *testing.T) {
+	Instances = make(map[string]Instance)
+	var inst Instance
+	inst.Args.Hash = "net"
+	inst.Args.Neighbor = []ptp.Neighbor{{ID: "peer", IP: "10.0.0.2", Mac: "06:00:00:00:00:02"}}
+	Instances["net"] = inst
+	data, err := EncodeInstances()
+	if err != nil {
+		t.Fatalf("Failed to encode instances: %v", err)
+	}
+	loaded, err := DecodeInstances(data)
+	if err != nil || len(loaded) != 1 {
+		t.Fatalf("Failed to decode instances: %v", err)
+	}
+	opts := loaded[0].Options()
+	if len(opts.Neighbors) != 1 || opts.Neighbors[0] != inst.Args.Neighbor[0] {
+		t.Errorf("Neighbors weren't restored: %+v", opts.Neighbors)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{errors.New("other"), 1},
+		{fmt.Errorf("%w: 10.0.0.1:6881", ptp.ErrRouterUnreachable), EXIT_ROUTER_UNREACHABLE},
+		{fmt.Errorf("%w: peer", ptp.ErrHandshakeTimeout), EXIT_HANDSHAKE_TIMEOUT},
+		{ptp.ErrMalformedMessage, EXIT_MALFORMED_MESSAGE},
+		{ptp.ErrNoRelayAvailable, EXIT_NO_RELAY},
+	}
+	for _, c := range cases {
+		if code := ExitCode(c.err); code != c.code {
+			t.Errorf("ExitCode(%v) = %d, expected %d", c.err, code, c.code)
+		}
+	}
+}
+
+func TestInvitation(t *testing.T) {
+	var inst Instance
+	inst.ID = "invite-hash"
+	inst.Args.Dht = "router1:6881,[2001:db8::1]:6881"
+	inst.Args.Key = PadKey("secret")
+	created, err := NewInvitation(inst)
+	if err != nil {
+		t.Fatalf("Failed to create invitation: %v", err)
+	}
+	code := created.Encode()
+	if !strings.HasPrefix(code, INVITE_PREFIX) {
+		t.Errorf("Code has no prefix: %s", code)
+	}
+	inv, err := ParseInvitation(strings.ToUpper(code[len(INVITE_PREFIX):]))
+	if err != nil {
+		t.Fatalf("Failed to parse invitation: %v", err)
+	}
+	if inv.Hash != "invite-hash" || inv.Routers != inst.Args.Dht {
+		t.Errorf("Wrong invitation: %+v", inv)
+	}
+	if inv.CheckKey("secret") != nil {
+		t.Errorf("Valid key was rejected")
+	}
+	if inv.CheckKey("other") == nil || inv.CheckKey("") == nil {
+		t.Errorf("Wrong key was accepted")
+	}
+	if other, _ := NewInvitation(inst); bytes.Equal(other.Fingerprint, inv.Fingerprint) {
+		t.Errorf("Fingerprints of the same key aren't salted")
+	}
+	mistyped := []byte(code)
+	if mistyped[10] == 'a' {
+		mistyped[10] = 'b'
+	} else {
+		mistyped[10] = 'a'
+	}
+	if _, err := ParseInvitation(string(mistyped)); err == nil {
+		t.Errorf("Mistyped code was accepted")
+	}
+
+	inst.Args.Key = ""
+	created, _ = NewInvitation(inst)
+	inv, err = ParseInvitation(created.Encode())
+	if err != nil || len(inv.Fingerprint) != 0 || inv.CheckKey("") != nil {
+		t.Errorf("Invitation to unencrypted network is wrong: %+v %v", inv, err)
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	// Remainder of "HELLO WORLD" in version 1-M from the QR specification
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ecc := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if !bytes.Equal(qrRemainder(data, qrDivisor(10)), ecc) {
+		t.Errorf("Wrong error correction codewords")
+	}
+	if qrFormatBits(0) != 0x5412 || qrFormatBits(1) != 0x5125 {
+		t.Errorf("Wrong format bits")
+	}
+	for _, size := range []int{1, 14, 15, 100, 200, 600} {
+		payload := bytes.Repeat([]byte("p2p-abc"), size/7+1)[:size]
+		code, err := EncodeQR(payload)
+		if err != nil {
+			t.Fatalf("Failed to encode %d bytes: %v", size, err)
+		}
+		decoded, err := DecodeQR(code.Image(3))
+		if err != nil {
+			t.Fatalf("Failed to decode version %d: %v", code.Version, err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Errorf("Version %d: decoded %q", code.Version, decoded)
+		}
+	}
+	if _, err := EncodeQR(make([]byte, 1000)); err == nil {
+		t.Errorf("Too long data was encoded")
+	}
+}
+
+func TestFormatWatch(t *testing.T) {
+	now := time.Now()
+	prev := []ptp.InstanceStats{{Time: now, Hash: "net", BytesSent: 1000, PeerStats: []ptp.PeerStats{
+		{ID: "peer1", State: ptp.P_CONNECTED, BytesSent: 1000},
+	}}}
+	cur := []ptp.InstanceStats{{Time: now.Add(2 * time.Second), Hash: "net", IP: "10.0.0.1", Peers: 2, Connected: 1, BytesSent: 5096, PeerStats: []ptp.PeerStats{
+		{ID: "peer1", IP: "10.0.0.2", State: ptp.P_CONNECTED, Relayed: true, RTT: 12 * time.Millisecond, BytesSent: 5096},
+		{ID: "peer2", State: ptp.P_INIT},
+	}}}
+	out := FormatWatch(cur, prev)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected header, instance and 2 peers, got:\n%s", out)
+	}
+	for _, expected := range []string{"1/2 peers", "relay", "12ms", "2.0KB/s"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Table doesn't contain %q:\n%s", expected, out)
+		}
+	}
+	if !strings.Contains(lines[3], "Initializing") || strings.Contains(lines[3], "relay") {
+		t.Errorf("Disconnected peer is shown wrong: %s", lines[3])
+	}
+}
+
+func TestGeneratePolicy(t *testing.T) {
+	paths := ptp.AccessPaths{
+		Binary:  "/usr/bin/p2p",
+		Config:  "/etc/p2p",
+		State:   "/var/lib/p2p",
+		Runtime: "/run/p2p",
+		Devices: []string{"/dev/net/tun"},
+		Tools:   []string{"/sbin/ip"},
+	}
+	for _, format := range []string{"apparmor", "selinux"} {
+		policy, err := GeneratePolicy(format, paths)
+		if err != nil {
+			t.Fatalf("Failed to generate %s policy: %v", format, err)
+		}
+		for _, path := range []string{paths.Binary, paths.Config, paths.State, paths.Runtime} {
+			if !strings.Contains(policy, path) {
+				t.Errorf("%s policy doesn't mention %s", format, path)
+			}
+		}
+	}
+	policy, _ := GeneratePolicy("apparmor", paths)
+	if !strings.Contains(policy, "/dev/net/tun rw") || !strings.Contains(policy, "/sbin/ip Pix") {
+		t.Errorf("AppArmor profile doesn't allow device or tool:\n%s", policy)
+	}
+	if _, err := GeneratePolicy("tomoyo", paths); err == nil {
+		t.Errorf("Unknown format was accepted")
+	}
+}
+
+func TestSignManifestFile(t *testing.T) {
+	member, _ := ptp.GenerateIdentity()
+	keyFile := t.TempDir() + "/admin.yaml"
+	m, admin, err := SignManifestFile(keyFile, "net", member.PublicKeyString())
+	if err != nil {
+		t.Fatalf("Failed to sign manifest: %v", err)
+	}
+	if err := m.Verify("net", admin.PublicKeyString()); err != nil || !m.IsMember(member.PublicKeyString()) {
+		t.Errorf("Wrong manifest %+v: %v", m, err)
+	}
+	// Admin key is kept for the next update
+	next, again, err := SignManifestFile(keyFile, "net", "")
+	if err != nil || again.PublicKeyString() != admin.PublicKeyString() || len(next.Members) != 0 {
+		t.Errorf("Admin key wasn't reused: %v", err)
+	}
+}
+
+func TestEphemeralNetwork(t *testing.T) {
+	hash, key, err := NewEphemeralNetwork()
+	if err != nil {
+		t.Fatalf("Failed to generate network: %v", err)
+	}
+	other, _, _ := NewEphemeralNetwork()
+	if !strings.HasPrefix(hash, EPHEMERAL_PREFIX) || hash == other {
+		t.Errorf("Bad hash of ephemeral network: %s %s", hash, other)
+	}
+	if len(key) != ptp.BLOCK_SIZE || PadKey(key) != key {
+		t.Errorf("Key doesn't fill AES block: %q", key)
+	}
+	if lifetime, err := ParseLifetime(""); err != nil || lifetime != EPHEMERAL_LIFETIME {
+		t.Errorf("Wrong default lifetime: %v %v", lifetime, err)
+	}
+	for _, bad := range []string{"forever", "-1h", "48h"} {
+		if _, err := ParseLifetime(bad); err == nil {
+			t.Errorf("Bad lifetime %s was accepted", bad)
+		}
+	}
+
+	Instances = make(map[string]Instance)
+	Instances["saved"] = Instance{ID: "saved", Args: RunArgs{Hash: "saved"}}
+	Instances[hash] = Instance{ID: hash, Args: RunArgs{Hash: hash, Ephemeral: true, Expires: time.Now().Add(-time.Second)}}
+	data, err := EncodeInstances()
+	if err != nil {
+		t.Fatalf("Failed to encode instances: %v", err)
+	}
+	saved, err := DecodeInstances(data)
+	if err != nil || len(saved) != 1 || saved[0].Hash != "saved" {
+		t.Errorf("Ephemeral network was saved: %v %v", saved, err)
+	}
+
+	var p Procedures
+	var resp Response
+	p.DestroyEphemeral(&EphemeralArgs{Hash: "saved"}, &resp)
+	if resp.ExitCode == 0 {
+		t.Errorf("Regular network was destroyed as ephemeral")
+	}
+	ExpireEphemeral()
+	if _, exists := Instances[hash]; exists {
+		t.Errorf("Expired network wasn't destroyed")
+	}
+	if _, exists := Instances["saved"]; !exists {
+		t.Errorf("Regular network was expired")
+	}
+	Instances = make(map[string]Instance)
+}
+
+func TestCompletionScript(t *testing.T) {
+	start := flag.NewFlagSet("start", flag.ContinueOnError)
+	start.String("hash", "", "Infohash of environment")
+	start.String("ip", "dhcp", "IP address. Second sentence")
+	start.Bool("private", false, "Don't 'publish' endpoints")
+	filter := flag.NewFlagSet("filter", flag.ContinueOnError)
+	filter.String("peer", "", "ID or IP of the peer")
+	commands := map[string]*flag.FlagSet{"start": start, "filter": filter, "status": nil}
+
+	bash, err := CompletionScript("bash", commands)
+	if err != nil {
+		t.Fatalf("Failed to generate bash script: %v", err)
+	}
+	for _, s := range []string{"\"filter start status\"", "words=\"-hash -ip -private\"", "words=\"list set clear -peer\"", "\t-ip)\n", "p2p __complete peers"} {
+		if !strings.Contains(bash, s) {
+			t.Errorf("Bash script misses %q", s)
+		}
+	}
+	if sh, err := exec.LookPath("bash"); err == nil {
+		if out, err := exec.Command(sh, "-n", "-c", bash).CombinedOutput(); err != nil {
+			t.Errorf("Bash script has syntax errors: %v %s", err, out)
+		}
+	}
+	fish, err := CompletionScript("fish", commands)
+	if err != nil {
+		t.Fatalf("Failed to generate fish script: %v", err)
+	}
+	for _, s := range []string{"-o ip -r -F -d 'IP address'", "-o private -d 'Don\\'t \\'publish\\' endpoints'", "(p2p __complete hashes 2>/dev/null)"} {
+		if !strings.Contains(fish, s) {
+			t.Errorf("Fish script misses %q", s)
+		}
+	}
+	if _, err := CompletionScript("csh", commands); err == nil {
+		t.Errorf("Script for unsupported shell was generated")
+	}
+}
+
+func TestCompleteConsole(t *testing.T) {
+	asked := 0
+	candidates := func() CandidatesResponse {
+		asked++
+		return CandidatesResponse{Hashes: []string{"net1"}, Peers: []string{"peer1", "10.10.10.2"}}
+	}
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"", "instances"},
+		{"pe", "peers"},
+		{"use ", "net1"},
+		{"peer 10", "10.10.10.2"},
+		{"events o", "on"},
+		{"use net1 ", ""},
+		{"status ", ""},
+	}
+	for _, c := range cases {
+		words := completeConsole(c.line, candidates)
+		if c.expected == "" && len(words) != 0 {
+			t.Errorf("%q: expected nothing, got %v", c.line, words)
+		}
+		found := c.expected == ""
+		for _, w := range words {
+			found = found || w == c.expected
+		}
+		if !found {
+			t.Errorf("%q: %s is missing from %v", c.line, c.expected, words)
+		}
+	}
+	if asked != 2 {
+		t.Errorf("Daemon was asked for candidates %d times, expected 2", asked)
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	var out bytes.Buffer
+	in := strings.NewReader("us\tne\t\tx\x7f1\r\x1b[A\r\x04")
+	e := NewLineEditor(in, &out, func(line string) []string {
+		return completeConsole(line, func() CandidatesResponse {
+			return CandidatesResponse{Hashes: []string{"net1", "net2"}}
+		})
+	})
+	e.Raw = true
+	line, err := e.ReadLine()
+	if err != nil || line != "use net1" {
+		t.Errorf("Expected completed line, got %q: %v", line, err)
+	}
+	line, err = e.ReadLine()
+	if err != nil || line != "use net1" {
+		t.Errorf("Expected line from history, got %q: %v", line, err)
+	}
+	if _, err := e.ReadLine(); err != io.EOF {
+		t.Errorf("Ctrl-D didn't end input: %v", err)
+	}
+	if !strings.Contains(out.String(), "net1  net2") {
+		t.Errorf("Ambiguous candidates weren't listed: %q", out.String())
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+type ManifestArgs struct {
+	Hash     string
+	Manifest string // Manifest to apply. Current manifest is shown if empty
+}
+
+// Manifest applies membership manifest to an instance or shows the one
+// the instance enforces
+func (p *Procedures) Manifest(args *ManifestArgs, resp *Response) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	resp.ExitCode = 1
+	inst, exists := Instances[args.Hash]
+	if !exists {
+		resp.Output = "Instance with hash " + args.Hash + " was not found"
+		return nil
+	}
+	if inst.PTP == nil {
+		resp.Output = "Instance " + args.Hash + " is out of schedule"
+		return nil
+	}
+	if inst.PTP.AdminKey == "" {
+		resp.Output = "Instance was started without -admin option. Manifest is not enforced"
+		return nil
+	}
+	if args.Manifest != "" {
+		m, err := ptp.ParseManifest([]byte(args.Manifest))
+		if err == nil {
+			err = inst.PTP.ApplyManifest(m)
+		}
+		if err != nil {
+			resp.Output = "Failed to apply manifest: " + err.Error()
+			return nil
+		}
+	}
+	resp.ExitCode = 0
+	resp.Output = "Admin key: " + inst.PTP.AdminKey
+	if m := inst.PTP.CurrentManifest(); m != nil {
+		resp.Output += "\n" + m.String() + "\n" + strings.Join(m.Members, "\n")
+	} else {
+		resp.Output += "\nManifest is not known yet. Peers are not accepted"
+	}
+	return nil
+}
+
+// SignManifestFile creates manifest signed with admin key from a file.
+// Current time is used as version, so newer manifest always wins
+func SignManifestFile(keyFile, hash, members string) (*ptp.Manifest, *ptp.Identity, error) {
+	admin, err := ptp.LoadOrCreateIdentity(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := ptp.SignManifest(admin, hash, uint64(time.Now().Unix()), strings.Split(members, ","))
+	return m, admin, err
+}
+
+func Manifest(rpcPort, action, hash, keyFile, members, file string) {
+	if action != "show" && action != "apply" && action != "sign" {
+		fmt.Printf("Unknown action %s. Use show, apply or sign\n", action)
+		os.Exit(1)
+	}
+	if hash == "" {
+		fmt.Printf("Specify a hash of instance with -hash argument\n")
+		os.Exit(1)
+	}
+	if action == "sign" {
+		if keyFile == "" {
+			fmt.Printf("Specify file with admin key with -key argument\n")
+			os.Exit(1)
+		}
+		m, admin, err := SignManifestFile(keyFile, hash, members)
+		if err != nil {
+			fmt.Printf("Failed to sign manifest: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("# Admin key: %s\n%s", admin.PublicKeyString(), m.Marshal())
+		os.Exit(0)
+	}
+	args := &ManifestArgs{Hash: hash}
+	if action == "apply" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Failed to read manifest: %v\n", err)
+			os.Exit(1)
+		}
+		args.Manifest = string(data)
+	}
+	client := Dial(rpcPort)
+	var response Response
+	err := client.Call("Procedures.Manifest", args, &response)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", response.Output)
+	os.Exit(response.ExitCode)
+}
@@ -0,0 +1,340 @@
+//go:build linux && netns
+// +build linux,netns
+
+package main
+
+// Tests below run daemons in separate network namespaces connected to a
+// simulated internet, where hosts may sit behind NAT of their own gateway.
+// They need root, iproute2, nftables, unshare and ping, take minutes and
+// are built with netns tag only:
+//
+//	sudo go test -tags netns -run Netns -v -timeout 20m .
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+const (
+	netnsBridge  = "p2pwan"
+	netnsRouter  = "203.0.113.1"
+	netnsHash    = "netns-test"
+	netnsTimeout = time.Second * 90
+)
+
+// nsHost is a member with a daemon of its own. Host behind NAT reaches
+// the internet through gateway namespace that translates its addresses
+type nsHost struct {
+	name   string // Namespace of the daemon
+	nat    string // NAT of the gateway: none, cone or symmetric
+	index  int
+	wan    string // Address on the internet: of the host or of its gateway
+	vip    string // Address on the virtual network
+	config string // Directory bound over CONFIG_DIR for the daemon
+	daemon *exec.Cmd
+	log    *os.File
+}
+
+// gateway returns namespace of the gateway
+func (h *nsHost) gateway() string {
+	return h.name + "g"
+}
+
+// nsLab is a set of hosts connected to the same bridge, which plays the
+// internet. Router runs in the test process on the bridge
+type nsLab struct {
+	t      *testing.T
+	dir    string
+	router *ptp.MockRouter
+	hosts  []*nsHost
+}
+
+// TestNetnsProcess runs p2p command inside of a namespace on behalf of
+// the tests. Daemon binds its own directory over CONFIG_DIR, which is
+// shared by every namespace, so each one reads config.yaml of its own
+func TestNetnsProcess(t *testing.T) {
+	args := os.Getenv("P2P_NETNS_ARGS")
+	if args == "" {
+		return
+	}
+	if dir := os.Getenv("P2P_NETNS_CONFIG"); dir != "" {
+		if err := syscall.Mount(dir, ptp.CONFIG_DIR, "", syscall.MS_BIND, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to bind config directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	os.Args = append([]string{"p2p"}, strings.Fields(args)...)
+	main()
+	os.Exit(0)
+}
+
+// newLab creates bridge with the router. Test is skipped if host can't
+// run namespaces
+func newLab(t *testing.T) *nsLab {
+	if os.Geteuid() != 0 {
+		t.Skipf("Namespaces require root")
+	}
+	for _, tool := range []string{"ip", "nft", "unshare", "ping"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	dir, err := ioutil.TempDir("", "p2p-netns")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	lab := &nsLab{t: t, dir: dir}
+	// Leftovers of interrupted runs
+	exec.Command("ip", "link", "del", netnsBridge).Run()
+	lab.run("ip", "link", "add", netnsBridge, "type", "bridge")
+	lab.run("ip", "addr", "add", netnsRouter+"/24", "dev", netnsBridge)
+	lab.run("ip", "link", "set", netnsBridge, "up")
+	lab.router, err = ptp.ListenMockRouter(netnsRouter + ":0")
+	if err != nil {
+		lab.Close()
+		t.Fatalf("Failed to start router: %v", err)
+	}
+	// Members learn their public addresses from their own entry
+	lab.router.ListSelf = true
+	lab.router.Start()
+	return lab
+}
+
+// run executes command and fails the test if it fails
+func (lab *nsLab) run(name string, args ...string) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		lab.t.Fatalf("%s %s: %v: %s", name, strings.Join(args, " "), err, out)
+	}
+}
+
+// nft loads ruleset into the namespace
+func (lab *nsLab) nft(ns, ruleset string) {
+	cmd := exec.Command("ip", "netns", "exec", ns, "nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		lab.t.Fatalf("Failed to load rules into %s: %v: %s", ns, err, out)
+	}
+}
+
+// netns creates namespace with loopback up
+func (lab *nsLab) netns(name string) {
+	exec.Command("ip", "netns", "del", name).Run()
+	lab.run("ip", "netns", "add", name)
+	lab.run("ip", "-n", name, "link", "set", "lo", "up")
+}
+
+// Add creates host with NAT of the kind and starts its daemon. Config is
+// written into config.yaml of the daemon
+func (lab *nsLab) Add(nat, config string) *nsHost {
+	i := len(lab.hosts) + 1
+	h := &nsHost{name: fmt.Sprintf("p2p%d", i), nat: nat, index: i}
+	h.wan = fmt.Sprintf("203.0.113.%d", 10+i)
+	h.vip = fmt.Sprintf("10.99.0.%d", i)
+	lab.hosts = append(lab.hosts, h)
+
+	// Namespace plugged into the bridge: host itself or its gateway
+	edge := h.name
+	if nat != "none" {
+		edge = h.gateway()
+	}
+	lab.netns(h.name)
+	if edge != h.name {
+		lab.netns(edge)
+	}
+	port := fmt.Sprintf("p2pb%d", i)
+	lab.run("ip", "link", "add", "wan0", "netns", edge, "type", "veth", "peer", "name", port)
+	lab.run("ip", "link", "set", port, "master", netnsBridge, "up")
+	lab.run("ip", "-n", edge, "addr", "add", h.wan+"/24", "dev", "wan0")
+	lab.run("ip", "-n", edge, "link", "set", "wan0", "up")
+
+	if edge != h.name {
+		lan := fmt.Sprintf("192.168.%d", i)
+		lab.run("ip", "link", "add", "lan0", "netns", edge, "type", "veth", "peer", "name", "wan0", "netns", h.name)
+		lab.run("ip", "-n", edge, "addr", "add", lan+".1/24", "dev", "lan0")
+		lab.run("ip", "-n", edge, "link", "set", "lan0", "up")
+		lab.run("ip", "-n", h.name, "addr", "add", lan+".2/24", "dev", "wan0")
+		lab.run("ip", "-n", h.name, "link", "set", "wan0", "up")
+		lab.run("ip", "-n", h.name, "route", "add", "default", "via", lan+".1")
+		lab.run("ip", "netns", "exec", edge, "sysctl", "-qw", "net.ipv4.ip_forward=1")
+		// Masquerade keeps source port, so mapping doesn't depend on
+		// destination. Random ports make a new mapping for every one
+		flags := ""
+		if nat == "symmetric" {
+			flags = " random,fully-random"
+		}
+		lab.nft(edge, "table ip nat {\n"+
+			"\tchain postrouting {\n"+
+			"\t\ttype nat hook postrouting priority 100;\n"+
+			"\t\toifname \"wan0\" masquerade"+flags+"\n"+
+			"\t}\n"+
+			"}\n")
+	}
+
+	iptool, _ := exec.LookPath("ip")
+	h.config = filepath.Join(lab.dir, h.name)
+	os.MkdirAll(filepath.Join(h.config, "p2p"), 0700)
+	ioutil.WriteFile(filepath.Join(h.config, "p2p", "config.yaml"), []byte("iptool: "+iptool+"\n"+config), 0600)
+	h.log, _ = os.Create(filepath.Join(lab.dir, h.name+".log"))
+	h.daemon = exec.Command("ip", "netns", "exec", h.name, "unshare", "--mount", "--propagation", "private",
+		os.Args[0], "-test.run=^TestNetnsProcess$")
+	h.daemon.Env = append(os.Environ(), "P2P_NETNS_ARGS=daemon", "P2P_NETNS_CONFIG="+h.config)
+	h.daemon.Stdout = h.log
+	h.daemon.Stderr = h.log
+	if err := h.daemon.Start(); err != nil {
+		lab.t.Fatalf("Failed to start daemon of %s: %v", h.name, err)
+	}
+
+	// Daemon needs a moment to listen for RPC
+	args := fmt.Sprintf("start -ip %s/24 -hash %s -dht %s", h.vip, netnsHash, lab.router.Endpoint())
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		out, err := lab.P2P(h, args)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			lab.t.Fatalf("Failed to start instance on %s: %v: %s", h.name, err, out)
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+	return h
+}
+
+// P2P runs p2p command in namespace of the host
+func (lab *nsLab) P2P(h *nsHost, args string) (string, error) {
+	cmd := exec.Command("ip", "netns", "exec", h.name, os.Args[0], "-test.run=^TestNetnsProcess$")
+	cmd.Env = append(os.Environ(), "P2P_NETNS_ARGS="+args)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// Ping waits until host reaches virtual address of another one
+func (lab *nsLab) Ping(from, to *nsHost, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if exec.Command("ip", "netns", "exec", from.name, "ping", "-c", "1", "-W", "1", to.vip).Run() == nil {
+			return true
+		}
+		time.Sleep(time.Second)
+	}
+	return false
+}
+
+// Endpoint returns endpoint host uses to reach another one
+func (lab *nsLab) Endpoint(from, to *nsHost) string {
+	out, _ := lab.P2P(from, "show -hash "+netnsHash)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) > 2 && fields[1] == to.vip {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+// Link brings WAN link of the host or of its gateway up or down
+func (lab *nsLab) Link(h *nsHost, up bool) {
+	state := "down"
+	if up {
+		state = "up"
+	}
+	lab.run("ip", "link", "set", fmt.Sprintf("p2pb%d", h.index), state)
+}
+
+// Close stops daemons and removes namespaces. Logs of daemons are kept if
+// test has failed
+func (lab *nsLab) Close() {
+	for _, h := range lab.hosts {
+		if h.daemon != nil && h.daemon.Process != nil {
+			h.daemon.Process.Kill()
+			h.daemon.Wait()
+		}
+		if h.log != nil {
+			h.log.Close()
+		}
+		exec.Command("ip", "netns", "del", h.name).Run()
+		if h.nat != "none" {
+			exec.Command("ip", "netns", "del", h.gateway()).Run()
+		}
+	}
+	if lab.router != nil {
+		lab.router.Close()
+	}
+	exec.Command("ip", "link", "del", netnsBridge).Run()
+	if lab.t.Failed() {
+		lab.t.Logf("Logs of daemons are kept in %s", lab.dir)
+	} else {
+		os.RemoveAll(lab.dir)
+	}
+}
+
+func TestNetnsConnectivity(t *testing.T) {
+	lab := newLab(t)
+	defer lab.Close()
+	public := lab.Add("none", "")
+	cone1 := lab.Add("cone", "")
+	cone2 := lab.Add("cone", "")
+
+	for _, pair := range [][2]*nsHost{{public, cone1}, {cone1, public}, {cone1, cone2}, {cone2, cone1}, {cone2, public}} {
+		if !lab.Ping(pair[0], pair[1], netnsTimeout) {
+			t.Errorf("%s (%s NAT) can't reach %s (%s NAT)", pair[0].name, pair[0].nat, pair[1].name, pair[1].nat)
+		}
+	}
+	// Cone NAT keeps mapping, so peers behind it are punched directly
+	if endpoint := lab.Endpoint(cone1, cone2); !strings.HasPrefix(endpoint, cone2.wan+":") {
+		t.Errorf("Peers behind cone NAT are not connected directly: %s", endpoint)
+	}
+}
+
+func TestNetnsRelayFallback(t *testing.T) {
+	lab := newLab(t)
+	defer lab.Close()
+	relay := lab.Add("none", "community_relay:\n  enabled: true\n")
+	sym1 := lab.Add("symmetric", "")
+	sym2 := lab.Add("symmetric", "")
+
+	if !lab.Ping(sym1, relay, netnsTimeout) {
+		t.Fatalf("Host behind symmetric NAT can't reach public host")
+	}
+	if out, _ := lab.P2P(relay, "status"); !strings.Contains(out, "Community relay since") {
+		t.Errorf("Public host wasn't promoted to community relay: %s", out)
+	}
+	// Ports of both sides are unpredictable, so only relay helps
+	if !lab.Ping(sym1, sym2, netnsTimeout) || !lab.Ping(sym2, sym1, netnsTimeout) {
+		t.Fatalf("Hosts behind symmetric NAT can't reach each other")
+	}
+	if endpoint := lab.Endpoint(sym1, sym2); !strings.HasPrefix(endpoint, relay.wan+":") {
+		t.Errorf("Hosts behind symmetric NAT are not connected through relay: %s", endpoint)
+	}
+}
+
+func TestNetnsReconnection(t *testing.T) {
+	lab := newLab(t)
+	defer lab.Close()
+	public := lab.Add("none", "")
+	cone := lab.Add("cone", "")
+
+	if !lab.Ping(cone, public, netnsTimeout) {
+		t.Fatalf("Hosts were not connected")
+	}
+	// Outage outlasts peer timeouts, so peers and routers are lost
+	lab.Link(cone, false)
+	time.Sleep(ptp.PEER_PING_TIMEOUT * 3)
+	if lab.Ping(cone, public, time.Second*2) {
+		t.Fatalf("Hosts are connected while link is down")
+	}
+	lab.Link(cone, true)
+	if !lab.Ping(cone, public, netnsTimeout*2) || !lab.Ping(public, cone, netnsTimeout) {
+		t.Errorf("Hosts didn't reconnect after outage")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// GeneratePolicy returns reference AppArmor profile or SELinux module that
+// allows the daemon to access listed paths only
+func GeneratePolicy(format string, paths ptp.AccessPaths) (string, error) {
+	switch format {
+	case "apparmor":
+		return appArmorProfile(paths), nil
+	case "selinux":
+		return seLinuxModule(paths), nil
+	}
+	return "", errors.New(fmt.Sprintf("Unknown policy format %s. Use apparmor or selinux", format))
+}
+
+func appArmorProfile(paths ptp.AccessPaths) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# AppArmor profile for p2p daemon. Install into /etc/apparmor.d/ and\n")
+	fmt.Fprintf(&b, "# run daemon with -hardened option\n")
+	fmt.Fprintf(&b, "#include <tunables/global>\n\n")
+	fmt.Fprintf(&b, "profile p2p %s {\n", paths.Binary)
+	fmt.Fprintf(&b, "  #include <abstractions/base>\n")
+	fmt.Fprintf(&b, "  #include <abstractions/nameservice>\n\n")
+	fmt.Fprintf(&b, "  capability net_admin,\n")
+	fmt.Fprintf(&b, "  network inet dgram,\n")
+	fmt.Fprintf(&b, "  network inet6 dgram,\n")
+	fmt.Fprintf(&b, "  network inet stream,\n")
+	fmt.Fprintf(&b, "  network unix dgram,\n")
+	fmt.Fprintf(&b, "  network netlink raw,\n\n")
+	fmt.Fprintf(&b, "  %s mrix,\n", paths.Binary)
+	fmt.Fprintf(&b, "  %s/ r,\n", paths.Config)
+	fmt.Fprintf(&b, "  %s/** rw,\n", paths.Config)
+	fmt.Fprintf(&b, "  %s/ rw,\n", paths.State)
+	fmt.Fprintf(&b, "  %s/** rwk,\n", paths.State)
+	fmt.Fprintf(&b, "  %s/** rw,\n", paths.Runtime)
+	for _, dev := range paths.Devices {
+		fmt.Fprintf(&b, "  %s rw,\n", dev)
+	}
+	for _, proc := range paths.Proc {
+		fmt.Fprintf(&b, "  @{PROC}%s r,\n", strings.TrimPrefix(proc, "/proc"))
+	}
+	for _, tool := range paths.Tools {
+		fmt.Fprintf(&b, "  %s Pix,\n", tool)
+	}
+	fmt.Fprintf(&b, "}\n")
+	return b.String()
+}
+
+func seLinuxModule(paths ptp.AccessPaths) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# SELinux policy module for p2p daemon. Save the first part as p2p.te,\n")
+	fmt.Fprintf(&b, "# the second one as p2p.fc, build with selinux-policy-devel and run\n")
+	fmt.Fprintf(&b, "# daemon with -hardened option\n\n")
+	fmt.Fprintf(&b, "# p2p.te\n")
+	fmt.Fprintf(&b, "policy_module(p2p, 1.0.0)\n\n")
+	fmt.Fprintf(&b, "type p2p_t;\n")
+	fmt.Fprintf(&b, "type p2p_exec_t;\n")
+	fmt.Fprintf(&b, "init_daemon_domain(p2p_t, p2p_exec_t)\n\n")
+	fmt.Fprintf(&b, "type p2p_conf_t;\n")
+	fmt.Fprintf(&b, "files_config_file(p2p_conf_t)\n")
+	fmt.Fprintf(&b, "type p2p_var_lib_t;\n")
+	fmt.Fprintf(&b, "files_type(p2p_var_lib_t)\n")
+	fmt.Fprintf(&b, "type p2p_var_run_t;\n")
+	fmt.Fprintf(&b, "files_pid_file(p2p_var_run_t)\n\n")
+	fmt.Fprintf(&b, "allow p2p_t self:capability net_admin;\n")
+	fmt.Fprintf(&b, "allow p2p_t self:tun_socket create_socket_perms;\n")
+	fmt.Fprintf(&b, "allow p2p_t self:udp_socket create_socket_perms;\n")
+	fmt.Fprintf(&b, "allow p2p_t self:tcp_socket create_stream_socket_perms;\n")
+	fmt.Fprintf(&b, "allow p2p_t self:unix_dgram_socket create_socket_perms;\n")
+	fmt.Fprintf(&b, "allow p2p_t self:netlink_route_socket create_netlink_socket_perms;\n")
+	fmt.Fprintf(&b, "corenet_rw_tun_tap_dev(p2p_t)\n")
+	fmt.Fprintf(&b, "corenet_udp_bind_generic_node(p2p_t)\n")
+	fmt.Fprintf(&b, "corenet_udp_bind_all_unreserved_ports(p2p_t)\n")
+	fmt.Fprintf(&b, "corenet_tcp_bind_generic_node(p2p_t)\n")
+	fmt.Fprintf(&b, "kernel_read_net_sysctls(p2p_t)\n")
+	fmt.Fprintf(&b, "sysnet_domtrans_ifconfig(p2p_t)\n")
+	fmt.Fprintf(&b, "manage_files_pattern(p2p_t, p2p_conf_t, p2p_conf_t)\n")
+	fmt.Fprintf(&b, "manage_dirs_pattern(p2p_t, p2p_conf_t, p2p_conf_t)\n")
+	fmt.Fprintf(&b, "manage_files_pattern(p2p_t, p2p_var_lib_t, p2p_var_lib_t)\n")
+	fmt.Fprintf(&b, "manage_sock_files_pattern(p2p_t, p2p_var_run_t, p2p_var_run_t)\n")
+	fmt.Fprintf(&b, "optional_policy(`\n")
+	fmt.Fprintf(&b, "\tsystemd_exec_resolvectl(p2p_t)\n")
+	fmt.Fprintf(&b, "')\n\n")
+	fmt.Fprintf(&b, "# p2p.fc\n")
+	fmt.Fprintf(&b, "%s\t--\tgen_context(system_u:object_r:p2p_exec_t,s0)\n", paths.Binary)
+	fmt.Fprintf(&b, "%s(/.*)?\tgen_context(system_u:object_r:p2p_conf_t,s0)\n", paths.Config)
+	fmt.Fprintf(&b, "%s(/.*)?\tgen_context(system_u:object_r:p2p_var_lib_t,s0)\n", paths.State)
+	fmt.Fprintf(&b, "%s(/.*)?\tgen_context(system_u:object_r:p2p_var_run_t,s0)\n", paths.Runtime)
+	return b.String()
+}
+
+// Policy prints reference policy for paths used by the daemon
+func Policy(format string) {
+	policy, err := GeneratePolicy(format, ptp.DefaultPaths())
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(policy)
+}
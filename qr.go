@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// QR codes are generated in byte mode with medium error correction,
+// which is enough for invitation codes. Versions above QR_MAX_VERSION
+// are too dense to be scanned from a terminal anyway
+const (
+	QR_MAX_VERSION int = 20
+	QR_QUIET_ZONE  int = 4 // Light modules around the symbol
+	QR_PNG_SCALE   int = 8 // Pixels per module in PNG images
+)
+
+// Error correction blocks of every version for level M: EC codewords per
+// block, number of blocks in the first group and their data codewords,
+// number of blocks in the second group. Blocks of the second group carry
+// one more data codeword
+var qrBlocks = [QR_MAX_VERSION + 1][4]int{
+	{}, {10, 1, 16, 0}, {16, 1, 28, 0}, {26, 1, 44, 0}, {18, 2, 32, 0},
+	{24, 2, 43, 0}, {16, 4, 27, 0}, {18, 4, 31, 0}, {22, 2, 38, 2},
+	{22, 3, 36, 2}, {26, 4, 43, 1}, {30, 1, 50, 4}, {22, 6, 36, 2},
+	{22, 8, 37, 1}, {24, 4, 40, 5}, {24, 5, 41, 5}, {28, 7, 45, 3},
+	{28, 10, 46, 1}, {26, 9, 43, 4}, {26, 3, 44, 11}, {26, 3, 41, 13},
+}
+
+// QRCode is a matrix of modules. True is dark
+type QRCode struct {
+	Version  int
+	Size     int
+	Modules  [][]bool
+	function [][]bool // Modules of finder, timing and other patterns
+}
+
+func qrDataCodewords(version int) int {
+	b := qrBlocks[version]
+	return b[1]*b[2] + b[3]*(b[2]+1)
+}
+
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// EncodeQR creates QR code with the smallest version that fits the data
+func EncodeQR(data []byte) (*QRCode, error) {
+	version := 1
+	for ; version <= QR_MAX_VERSION; version++ {
+		if 4+qrCountBits(version)+len(data)*8 <= qrDataCodewords(version)*8 {
+			break
+		}
+	}
+	if version > QR_MAX_VERSION {
+		return nil, errors.New(fmt.Sprintf("%d bytes don't fit into QR code", len(data)))
+	}
+	q := newQRCode(version)
+	q.drawCodewords(qrAddECC(qrDataBits(data, version), version))
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+func newQRCode(version int) *QRCode {
+	q := &QRCode{Version: version, Size: version*4 + 17}
+	q.Modules = make([][]bool, q.Size)
+	q.function = make([][]bool, q.Size)
+	for y := range q.Modules {
+		q.Modules[y] = make([]bool, q.Size)
+		q.function[y] = make([]bool, q.Size)
+	}
+	q.drawFunctionPatterns()
+	return q
+}
+
+func (q *QRCode) set(x, y int, dark bool) {
+	q.Modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *QRCode) drawFunctionPatterns() {
+	for i := 0; i < q.Size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(q.Size-4, 3)
+	q.drawFinder(3, q.Size-4)
+	align := qrAlignment(q.Version)
+	for i, x := range align {
+		for j, y := range align {
+			corner := (i == 0 && j == 0) || (i == 0 && j == len(align)-1) || (i == len(align)-1 && j == 0)
+			if !corner {
+				q.drawAlignment(x, y)
+			}
+		}
+	}
+	// Reserve format modules until mask is chosen
+	q.drawFormat(0)
+	q.drawVersion()
+}
+
+func (q *QRCode) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= q.Size || y >= q.Size {
+				continue
+			}
+			d := qrMax(qrAbs(dx), qrAbs(dy))
+			q.set(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (q *QRCode) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.set(cx+dx, cy+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+		}
+	}
+}
+
+// qrAlignment returns centers of alignment patterns
+func qrAlignment(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	count := version/7 + 2
+	step := (version*8 + count*3 + 5) / (count*4 - 4) * 2
+	positions := make([]int, count)
+	positions[0] = 6
+	for i, pos := count-1, version*4+10; i > 0; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+func qrFormatBits(mask int) int {
+	// Level M is encoded as 00
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *QRCode) drawFormat(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+	for i := 0; i < 6; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.Size-15+i, bit(i))
+	}
+	q.set(8, q.Size-8, true)
+}
+
+// readFormat returns mask of the code. Format with the least number of
+// differing bits is chosen
+func (q *QRCode) readFormat() (int, error) {
+	bits := 0
+	for i := 0; i < 6; i++ {
+		bits |= qrBit(q.Modules[i][8]) << uint(i)
+	}
+	bits |= qrBit(q.Modules[7][8]) << 6
+	bits |= qrBit(q.Modules[8][8]) << 7
+	bits |= qrBit(q.Modules[8][7]) << 8
+	for i := 9; i < 15; i++ {
+		bits |= qrBit(q.Modules[8][14-i]) << uint(i)
+	}
+	best, distance := -1, 4
+	for mask := 0; mask < 8; mask++ {
+		d := 0
+		for diff := bits ^ qrFormatBits(mask); diff != 0; diff &= diff - 1 {
+			d++
+		}
+		if d < distance {
+			best, distance = mask, d
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("Unsupported QR code format")
+	}
+	return best, nil
+}
+
+func (q *QRCode) drawVersion() {
+	if q.Version < 7 {
+		return
+	}
+	rem := q.Version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := q.Version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		a, b := q.Size-11+i%3, i/3
+		q.set(a, b, dark)
+		q.set(b, a, dark)
+	}
+}
+
+// zigzag calls f for every data module in placement order
+func (q *QRCode) zigzag(f func(x, y int)) {
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.Size; vert++ {
+			y := vert
+			if upward {
+				y = q.Size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				if x := right - j; !q.function[y][x] {
+					f(x, y)
+				}
+			}
+		}
+	}
+}
+
+func (q *QRCode) drawCodewords(data []byte) {
+	i := 0
+	q.zigzag(func(x, y int) {
+		// Remainder bits are left light
+		if i < len(data)*8 {
+			q.Modules[y][x] = (data[i/8]>>uint(7-i%8))&1 != 0
+			i++
+		}
+	})
+}
+
+func (q *QRCode) readCodewords() []byte {
+	data := make([]byte, qrTotalCodewords(q.Version))
+	i := 0
+	q.zigzag(func(x, y int) {
+		if i < len(data)*8 {
+			data[i/8] |= byte(qrBit(q.Modules[y][x])) << uint(7-i%8)
+			i++
+		}
+	})
+	return data
+}
+
+func qrMasked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+// applyMask inverts data modules selected by mask. Applying it twice
+// restores the original
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.function[y][x] && qrMasked(mask, x, y) {
+				q.Modules[y][x] = !q.Modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty rates how hard the code is to scan. Lower is better
+func (q *QRCode) penalty() int {
+	penalty, dark := 0, 0
+	finder := []bool{true, false, true, true, true, false, true}
+	line := func(get func(i int) bool) {
+		run := 1
+		for i := 1; i <= q.Size; i++ {
+			if i < q.Size && get(i) == get(i-1) {
+				run++
+				continue
+			}
+			if run >= 5 {
+				penalty += run - 2
+			}
+			run = 1
+		}
+		for i := 0; i+7 <= q.Size; i++ {
+			match := true
+			for j, v := range finder {
+				if get(i+j) != v {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			before, after := true, true
+			for j := 1; j <= 4; j++ {
+				before = before && (i-j < 0 || !get(i-j))
+				after = after && (i+6+j >= q.Size || !get(i+6+j))
+			}
+			if before || after {
+				penalty += 40
+			}
+		}
+	}
+	for y := 0; y < q.Size; y++ {
+		line(func(i int) bool { return q.Modules[y][i] })
+		line(func(i int) bool { return q.Modules[i][y] })
+		for x := 0; x < q.Size; x++ {
+			if q.Modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.Modules[y][x]
+				if q.Modules[y-1][x] == c && q.Modules[y][x-1] == c && q.Modules[y-1][x-1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := q.Size * q.Size
+	return penalty + qrAbs(dark*20-total*10)/total*10
+}
+
+// qrDataBits encodes data in byte mode and pads it to capacity of version
+func qrDataBits(data []byte, version int) []byte {
+	var bits []bool
+	add := func(value, count int) {
+		for i := count - 1; i >= 0; i-- {
+			bits = append(bits, (value>>uint(i))&1 != 0)
+		}
+	}
+	capacity := qrDataCodewords(version) * 8
+	add(4, 4)
+	add(len(data), qrCountBits(version))
+	for _, b := range data {
+		add(int(b), 8)
+	}
+	add(0, qrMin(4, capacity-len(bits)))
+	add(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		add(pad, 8)
+	}
+	result := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			result[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	return result
+}
+
+// qrSplit returns lengths of data blocks
+func qrSplit(version int) []int {
+	b := qrBlocks[version]
+	var lengths []int
+	for i := 0; i < b[1]; i++ {
+		lengths = append(lengths, b[2])
+	}
+	for i := 0; i < b[3]; i++ {
+		lengths = append(lengths, b[2]+1)
+	}
+	return lengths
+}
+
+func qrTotalCodewords(version int) int {
+	return qrDataCodewords(version) + len(qrSplit(version))*qrBlocks[version][0]
+}
+
+// qrAddECC splits data into blocks, appends error correction to every
+// block and interleaves them
+func qrAddECC(data []byte, version int) []byte {
+	ecLen := qrBlocks[version][0]
+	divisor := qrDivisor(ecLen)
+	var blocks, ecc [][]byte
+	for _, length := range qrSplit(version) {
+		blocks = append(blocks, data[:length])
+		ecc = append(ecc, qrRemainder(data[:length], divisor))
+		data = data[length:]
+	}
+	var result []byte
+	for i := 0; i <= qrBlocks[version][2]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for _, block := range ecc {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrRemoveECC deinterleaves codewords and verifies error correction of
+// every block. Damaged codes are not repaired
+func qrRemoveECC(codewords []byte, version int) ([]byte, error) {
+	ecLen := qrBlocks[version][0]
+	lengths := qrSplit(version)
+	blocks := make([][]byte, len(lengths))
+	pos := 0
+	for i := 0; i <= qrBlocks[version][2]; i++ {
+		for j, length := range lengths {
+			if i < length {
+				blocks[j] = append(blocks[j], codewords[pos])
+				pos++
+			}
+		}
+	}
+	ecc := make([][]byte, len(lengths))
+	for i := 0; i < ecLen; i++ {
+		for j := range lengths {
+			ecc[j] = append(ecc[j], codewords[pos])
+			pos++
+		}
+	}
+	divisor := qrDivisor(ecLen)
+	var data []byte
+	for j, block := range blocks {
+		if !bytes.Equal(qrRemainder(block, divisor), ecc[j]) {
+			return nil, errors.New("QR code is damaged")
+		}
+		data = append(data, block...)
+	}
+	return data, nil
+}
+
+func qrMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrDivisor returns Reed-Solomon generator polynomial of specified degree
+func qrDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 2)
+	}
+	return result
+}
+
+func qrRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= qrMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+// Image renders the code with quiet zone, scale pixels per module
+func (q *QRCode) Image(scale int) *image.Gray {
+	size := (q.Size + QR_QUIET_ZONE*2) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			mx, my := x/scale-QR_QUIET_ZONE, y/scale-QR_QUIET_ZONE
+			dark := mx >= 0 && my >= 0 && mx < q.Size && my < q.Size && q.Modules[my][mx]
+			if dark {
+				img.SetGray(x, y, color.Gray{0})
+			} else {
+				img.SetGray(x, y, color.Gray{255})
+			}
+		}
+	}
+	return img
+}
+
+// WritePNG writes the code as PNG image
+func (q *QRCode) WritePNG(w io.Writer) error {
+	return png.Encode(w, q.Image(QR_PNG_SCALE))
+}
+
+// Terminal renders the code with block characters, two rows per line.
+// Light modules are drawn, so the code is readable on dark background
+func (q *QRCode) Terminal() string {
+	light := func(x, y int) bool {
+		x, y = x-QR_QUIET_ZONE, y-QR_QUIET_ZONE
+		return x < 0 || y < 0 || x >= q.Size || y >= q.Size || !q.Modules[y][x]
+	}
+	size := q.Size + QR_QUIET_ZONE*2
+	var out strings.Builder
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			top, bottom := light(x, y), y+1 < size && light(x, y+1)
+			switch {
+			case top && bottom:
+				out.WriteString("█")
+			case top:
+				out.WriteString("▀")
+			case bottom:
+				out.WriteString("▄")
+			default:
+				out.WriteString(" ")
+			}
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// DecodeQR reads data from an upright image of QR code, like one written
+// by WritePNG or a screenshot of it. Photos of codes are not supported
+func DecodeQR(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	dark := func(x, y int) bool {
+		gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+		return gray.Y < 128
+	}
+	minX, minY, maxX, maxY := b.Max.X, b.Max.Y, b.Min.X-1, b.Min.Y-1
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if dark(x, y) {
+				minX, minY = qrMin(minX, x), qrMin(minY, y)
+				maxX, maxY = qrMax(maxX, x), qrMax(maxY, y)
+			}
+		}
+	}
+	if maxX < minX {
+		return nil, errors.New("No QR code was found in the image")
+	}
+	// Top row of the finder pattern is 7 modules wide
+	run := 0
+	for x := minX; x <= maxX && dark(x, minY); x++ {
+		run++
+	}
+	module := float64(run) / 7
+	size := int(float64(maxX-minX+1)/module + 0.5)
+	version := (size - 17) / 4
+	if module < 1 || version < 1 || version > QR_MAX_VERSION || size != version*4+17 {
+		return nil, errors.New("No QR code was found in the image")
+	}
+	q := newQRCode(version)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			q.Modules[y][x] = dark(minX+int((float64(x)+0.5)*module), minY+int((float64(y)+0.5)*module))
+		}
+	}
+	mask, err := q.readFormat()
+	if err != nil {
+		return nil, err
+	}
+	q.applyMask(mask)
+	data, err := qrRemoveECC(q.readCodewords(), version)
+	if err != nil {
+		return nil, err
+	}
+	if data[0]>>4 != 4 {
+		return nil, errors.New("QR code doesn't contain binary data")
+	}
+	var length, start int
+	if qrCountBits(version) == 8 {
+		length = int(data[0]&0x0f)<<4 | int(data[1]>>4)
+		start = 1
+	} else {
+		length = int(data[0]&0x0f)<<12 | int(data[1])<<4 | int(data[2]>>4)
+		start = 2
+	}
+	if start+length >= len(data) {
+		return nil, errors.New("QR code is truncated")
+	}
+	// Data is shifted by the 4 bits of mode indicator
+	result := make([]byte, length)
+	for i := range result {
+		result[i] = data[start+i]<<4 | data[start+i+1]>>4
+	}
+	return result, nil
+}
+
+func qrBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func qrAbs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func qrMin(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// Default subtree of the p2p MIB under enterprises. Can be changed with
+// -snmp-oid daemon option
+const SNMP_DEFAULT_OID string = "1.3.6.1.4.1.48777.1"
+
+// Values of instance state column
+const (
+	SNMP_STATE_UP      int32 = 1
+	SNMP_STATE_DOWN    int32 = 2
+	SNMP_STATE_OFFLINE int32 = 3
+	SNMP_STATE_WAITING int32 = 4 // Host has lost network connectivity
+)
+
+// SNMPVars returns function that takes a snapshot of instances and peers.
+// Layout of the subtree:
+//
+//	.1.0       number of instances
+//	.2.1.C.I   instance table: 1 hash, 2 IP, 3 state, 4 peers, 5 connected
+//	           peers, 6 dropped packets, 7 bandwidth (bytes/s),
+//	           8 goroutines, 9 packets sent to routers, 10 router errors,
+//	           11 bytes sent, 12 bytes received
+//	.3.1.C.I.P peer table: 1 ID, 2 IP, 3 state, 4 endpoint, 5 relayed
+//	           (1 true, 2 false), 6 seconds since data was received,
+//	           7 bytes sent, 8 bytes received, 9 50th, 10 95th and
+//	           11 99th percentile of round trip time, 12 jitter
+//	           (microseconds)
+//
+// Instances are indexed in order of their hashes and peers in order of
+// their IDs, starting from 1
+func SNMPVars(subtree OID) func() []SNMPVar {
+	return func() []SNMPVar {
+		WaitLock()
+		Lock()
+		defer Unlock()
+		hashes := make([]string, 0, len(Instances))
+		for hash := range Instances {
+			hashes = append(hashes, hash)
+		}
+		sort.Strings(hashes)
+
+		var vars []SNMPVar
+		add := func(t uint16, value interface{}, suffix ...uint32) {
+			name := append(append(OID{}, subtree...), suffix...)
+			vars = append(vars, SNMPVar{Name: name, Type: t, Value: value})
+		}
+		add(SNMP_GAUGE32, uint32(len(hashes)), 1, 0)
+		for i, hash := range hashes {
+			index := uint32(i + 1)
+			inst := Instances[hash]
+			add(SNMP_OCTET_STRING, hash, 2, 1, 1, index)
+			state := SNMP_STATE_DOWN
+			if inst.PTP == nil {
+				add(SNMP_INTEGER, state, 2, 1, 3, index)
+				continue
+			}
+			stats := inst.PTP.Stats()
+			state = SNMP_STATE_UP
+			if stats.NoNetwork {
+				state = SNMP_STATE_WAITING
+			} else if stats.Offline {
+				state = SNMP_STATE_OFFLINE
+			}
+			if ip := net.ParseIP(stats.IP).To4(); ip != nil {
+				add(SNMP_IP_ADDRESS, ip, 2, 1, 2, index)
+			}
+			add(SNMP_INTEGER, state, 2, 1, 3, index)
+			add(SNMP_GAUGE32, uint32(stats.Peers), 2, 1, 4, index)
+			add(SNMP_GAUGE32, uint32(stats.Connected), 2, 1, 5, index)
+			add(SNMP_COUNTER64, stats.Dropped, 2, 1, 6, index)
+			add(SNMP_GAUGE32, uint32(stats.Bandwidth), 2, 1, 7, index)
+			add(SNMP_GAUGE32, uint32(stats.Goroutines), 2, 1, 8, index)
+			if inst.PTP.Dht != nil {
+				var sent, errors uint64
+				for _, router := range stats.Routers {
+					sent += router.Sent
+					errors += router.Errors
+				}
+				add(SNMP_COUNTER64, sent, 2, 1, 9, index)
+				add(SNMP_COUNTER64, errors, 2, 1, 10, index)
+			}
+			add(SNMP_COUNTER64, stats.BytesSent, 2, 1, 11, index)
+			add(SNMP_COUNTER64, stats.BytesRecv, 2, 1, 12, index)
+
+			for j, peer := range stats.PeerStats {
+				pindex := uint32(j + 1)
+				add(SNMP_OCTET_STRING, peer.ID, 3, 1, 1, index, pindex)
+				if ip := net.ParseIP(peer.IP).To4(); ip != nil {
+					add(SNMP_IP_ADDRESS, ip, 3, 1, 2, index, pindex)
+				}
+				add(SNMP_INTEGER, int32(peer.State), 3, 1, 3, index, pindex)
+				if peer.Endpoint != "" {
+					add(SNMP_OCTET_STRING, peer.Endpoint, 3, 1, 4, index, pindex)
+				}
+				relayed := int32(2)
+				if peer.Relayed {
+					relayed = 1
+				}
+				add(SNMP_INTEGER, relayed, 3, 1, 5, index, pindex)
+				if !peer.LastReceived.IsZero() {
+					add(SNMP_GAUGE32, uint32(stats.Time.Sub(peer.LastReceived)/time.Second), 3, 1, 6, index, pindex)
+				}
+				add(SNMP_COUNTER64, peer.BytesSent, 3, 1, 7, index, pindex)
+				add(SNMP_COUNTER64, peer.BytesRecv, 3, 1, 8, index, pindex)
+				if l := peer.Latency; l.Samples > 0 {
+					for k, d := range []time.Duration{l.P50, l.P95, l.P99, l.Jitter} {
+						add(SNMP_GAUGE32, uint32(d/time.Microsecond), 3, 1, uint32(9+k), index, pindex)
+					}
+				}
+			}
+		}
+		sort.Slice(vars, func(a, b int) bool { return vars[a].Name.Compare(vars[b].Name) < 0 })
+		return vars
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// Page is refreshed by the browser with this interval in seconds
+const STATUS_PAGE_REFRESH int = 5
+
+// StatusPage is what local status page shows
+type StatusPage struct {
+	Generated time.Time
+	Refresh   int
+	Instances []InstanceStatus
+	Events    []ptp.LogEvent
+}
+
+// InstanceStatus describes a single instance on status page
+type InstanceStatus struct {
+	Hash      string
+	IP        string
+	State     string
+	Notes     []string
+	Resources string
+	Routers   []ptp.RouterStats
+	Peers     []PeerStatus
+	Traversal []ptp.TraversalSummary
+}
+
+// PeerStatus describes a peer of an instance on status page
+type PeerStatus struct {
+	ID           string
+	IP           string
+	State        string
+	Path         string
+	Traffic      string
+	Latency      string // Quantiles of round trip time and jitter
+	LastReceived string
+	LastError    string
+}
+
+// PeerPath describes how traffic reaches the peer
+func PeerPath(peer ptp.PeerStats) string {
+	if peer.Endpoint == "" {
+		return "-"
+	}
+	if peer.Relayed {
+		return "relay " + peer.Endpoint
+	}
+	return "direct " + peer.Endpoint
+}
+
+// CollectStatus gathers status of every instance
+func CollectStatus() StatusPage {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	page := StatusPage{Generated: time.Now(), Refresh: STATUS_PAGE_REFRESH}
+	for hash, inst := range Instances {
+		s := InstanceStatus{Hash: hash, State: "Down"}
+		if inst.LastCrash != nil {
+			s.Notes = append(s.Notes, "Crashed at "+inst.LastCrash.Time.Format(time.RFC1123)+": "+inst.LastCrash.Error)
+		}
+		if inst.PTP != nil {
+			stats := inst.PTP.Stats()
+			s.State = "Up"
+			s.IP = stats.IP
+			if stats.NoNetwork {
+				s.State = "Waiting for network"
+			} else if stats.Offline {
+				s.State = "Offline"
+			}
+			if stats.Draining {
+				s.Notes = append(s.Notes, inst.PTP.DrainReport())
+			}
+			if stats.Conflict != "" {
+				s.Notes = append(s.Notes, "Duplicate: "+stats.Conflict)
+			}
+			s.Resources = inst.PTP.Resources.String()
+			s.Routers = stats.Routers
+			s.Traversal = inst.PTP.Traversal.Summary()
+			for _, peer := range stats.PeerStats {
+				ps := PeerStatus{
+					ID:           peer.ID,
+					IP:           peer.IP,
+					State:        StringifyState(peer.State),
+					Path:         PeerPath(peer),
+					Traffic:      ptp.FormatBytes(int64(peer.BytesSent)) + " / " + ptp.FormatBytes(int64(peer.BytesRecv)),
+					LastReceived: sinceString(peer.LastReceived),
+					LastError:    peer.LastError,
+				}
+				if l := peer.Latency; l.Samples > 0 {
+					ps.Latency = roundLatency(l.P50) + " / " + roundLatency(l.P95) + " / " + roundLatency(l.P99) + " ± " + roundLatency(l.Jitter)
+				}
+				s.Peers = append(s.Peers, ps)
+			}
+		}
+		page.Instances = append(page.Instances, s)
+	}
+	sort.Slice(page.Instances, func(i, j int) bool { return page.Instances[i].Hash < page.Instances[j].Hash })
+	events := ptp.RecentEvents()
+	// Newest events go first
+	for i := len(events) - 1; i >= 0; i-- {
+		page.Events = append(page.Events, events[i])
+	}
+	return page
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>p2p status</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+.WARNING { color: #a60; }
+.ERROR { color: #c00; }
+</style>
+</head>
+<body>
+<h1>p2p status</h1>
+<p>Generated at {{time .Generated}}</p>
+{{range .Instances}}
+<h2>{{.Hash}}</h2>
+<p>{{.State}}{{if .IP}} | {{.IP}}{{end}}{{range .Notes}} | {{.}}{{end}}</p>
+{{if .Resources}}<p>{{.Resources}}</p>{{end}}
+{{if .Routers}}
+<table>
+<tr><th>Router</th><th>Sent</th><th>Received</th><th>Errors</th><th>Last ping</th></tr>
+{{range .Routers}}<tr><td>{{.Address}}</td><td>{{.Sent}}</td><td>{{.Received}}</td><td>{{.Errors}}</td><td>{{time .LastPing}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Peers}}
+<table>
+<tr><th>Peer</th><th>IP</th><th>State</th><th>Path</th><th>Sent / received</th><th>RTT p50 / p95 / p99 ± jitter</th><th>Last received</th><th>Last error</th></tr>
+{{range .Peers}}<tr><td>{{.ID}}</td><td>{{.IP}}</td><td>{{.State}}</td><td>{{.Path}}</td><td>{{.Traffic}}</td><td>{{.Latency}}</td><td>{{.LastReceived}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Traversal}}
+<table>
+<tr><th>Strategy</th><th>Local NAT</th><th>Remote NAT</th><th>Attempts</th><th>Success rate</th><th>Average time</th></tr>
+{{range .Traversal}}<tr><td>{{.Strategy}}</td><td>{{.LocalNAT}}</td><td>{{.RemoteNAT}}</td><td>{{.Attempts}}</td><td>{{printf "%.0f" .SuccessRate}}%</td><td>{{.AverageTime}}</td></tr>
+{{end}}</table>
+{{end}}
+{{else}}
+<p>No instances are running</p>
+{{end}}
+<h2>Recent events</h2>
+<table>
+{{range .Events}}<tr class="{{.Level}}"><td>{{time .Time}}</td><td>{{.Level}}</td><td>{{.Message}}</td></tr>
+{{else}}<tr><td>No warnings or errors</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// ServeStatusPage renders status page. Page is read-only
+func ServeStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Status page is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := statusTemplate.Execute(w, CollectStatus())
+	if err != nil {
+		ptp.Log(ptp.ERROR, "Failed to render status page: %v", err)
+	}
+}
+
+// StartStatusPage serves status page on localhost
+func StartStatusPage(port string) error {
+	listen, err := net.Listen("tcp", "localhost:"+port)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ServeStatusPage)
+	ptp.Log(ptp.INFO, "Serving status page on http://localhost:%s/", port)
+	go http.Serve(listen, mux)
+	return nil
+}
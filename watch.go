@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+const WATCH_INTERVAL time.Duration = time.Second
+
+// WatchResponse carries snapshots of running instances
+type WatchResponse struct {
+	ExitCode  int
+	Output    string
+	Instances []ptp.InstanceStats
+}
+
+// Watch returns statistics of running instances. Statistics of every
+// instance are returned when hash is empty
+func (p *Procedures) Watch(args *RunArgs, resp *WatchResponse) error {
+	WaitLock()
+	Lock()
+	defer Unlock()
+	if args.Hash != "" {
+		if _, exists := Instances[args.Hash]; !exists {
+			resp.ExitCode = 1
+			resp.Output = "Specified environment was not found: " + args.Hash
+			return nil
+		}
+	}
+	for hash, inst := range Instances {
+		if inst.PTP == nil || (args.Hash != "" && hash != args.Hash) {
+			continue
+		}
+		resp.Instances = append(resp.Instances, inst.PTP.Stats())
+	}
+	sort.Slice(resp.Instances, func(i, j int) bool { return resp.Instances[i].Hash < resp.Instances[j].Hash })
+	return nil
+}
+
+// rate returns bytes per second between two counter values
+func rate(current, previous uint64, elapsed time.Duration) string {
+	if elapsed <= 0 || current < previous {
+		return "-"
+	}
+	return ptp.FormatBytes(int64(float64(current-previous)/elapsed.Seconds())) + "/s"
+}
+
+// watchPath describes path to the peer in a table cell
+func watchPath(peer ptp.PeerStats) string {
+	if peer.State != ptp.P_CONNECTED {
+		return "-"
+	}
+	if peer.Relayed {
+		return "relay"
+	}
+	return "direct"
+}
+
+// FormatWatch renders instances and their peers as a table. Throughput is
+// calculated from the difference with previous snapshots, which may be empty
+func FormatWatch(current, previous []ptp.InstanceStats) string {
+	prevInst := make(map[string]ptp.InstanceStats)
+	prevPeer := make(map[string]ptp.PeerStats)
+	for _, inst := range previous {
+		prevInst[inst.Hash] = inst
+		for _, peer := range inst.PeerStats {
+			prevPeer[inst.Hash+"/"+peer.ID] = peer
+		}
+	}
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE/PEER\tIP\tSTATE\tPATH\tRTT\tTX\tRX")
+	for _, inst := range current {
+		state := "Up"
+		if inst.NoNetwork {
+			state = "Waiting for network"
+		} else if inst.Offline {
+			state = "Offline"
+		}
+		var elapsed time.Duration
+		prev, exists := prevInst[inst.Hash]
+		if exists {
+			elapsed = inst.Time.Sub(prev.Time)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d peers\t\t%s\t%s\n", inst.Hash, inst.IP, state, inst.Connected, inst.Peers,
+			rate(inst.BytesSent, prev.BytesSent, elapsed), rate(inst.BytesRecv, prev.BytesRecv, elapsed))
+		for _, peer := range inst.PeerStats {
+			rtt := "-"
+			if peer.State == ptp.P_CONNECTED && peer.RTT > 0 {
+				rtt = peer.RTT.Round(time.Millisecond / 10).String()
+			}
+			sent, recv := "-", "-"
+			if p, exists := prevPeer[inst.Hash+"/"+peer.ID]; exists {
+				sent = rate(peer.BytesSent, p.BytesSent, elapsed)
+				recv = rate(peer.BytesRecv, p.BytesRecv, elapsed)
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n", peer.ID, peer.IP, StringifyState(peer.State), watchPath(peer), rtt, sent, recv)
+		}
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// Watch redraws table of instances and peers every second until interrupted
+func Watch(rpcPort, hash string) {
+	client := Dial(rpcPort)
+	var previous []ptp.InstanceStats
+	for {
+		var response WatchResponse
+		err := client.Call("Procedures.Watch", &RunArgs{Hash: hash}, &response)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to run RPC request: %v\n", err)
+			os.Exit(1)
+		}
+		if response.ExitCode != 0 {
+			fmt.Printf("%s\n", response.Output)
+			os.Exit(response.ExitCode)
+		}
+		// Move cursor home and clear the screen
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("p2p %s | %s\n\n", VERSION, time.Now().Format("15:04:05"))
+		if len(response.Instances) == 0 {
+			fmt.Printf("No instances are running\n")
+		} else {
+			fmt.Print(FormatWatch(response.Instances, previous))
+		}
+		previous = response.Instances
+		time.Sleep(WATCH_INTERVAL)
+	}
+}